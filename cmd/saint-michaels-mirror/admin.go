@@ -0,0 +1,143 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Admin API for Espelho de São Miguel.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// adminPathPrefix is the path prefix of the admin API
+const adminPathPrefix = apiPathPrefix + "admin/"
+
+// adminHandler wraps an admin API handler with bearer token authentication.
+// When no ADMIN_TOKEN is configured the admin API is disabled.
+func adminHandler(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token == "" {
+			http.Error(w, "admin API disabled: ADMIN_TOKEN not configured", http.StatusNotFound)
+			return
+		}
+		if !hasAdminToken(req, token) {
+			logging.Warn("rejected admin request to %s from %s", req.URL.Path, req.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// hasAdminToken reports whether req carries the admin bearer token
+func hasAdminToken(req *http.Request, token string) bool {
+	provided := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// writeJSONEntity marshals a JsonEntity and writes it as the response
+func writeJSONEntity(w http.ResponseWriter, req *http.Request, status int, entity jsonlib.JsonEntity) {
+	jsonData, err := jsonlib.MarshalIndent(entity, "", "  ")
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, req, status, jsonData)
+}
+
+// loggingController tracks the active verbose filter so it can be inspected
+// and changed at runtime. Runtime changes apply to the modules of this
+// repository; nostr-lib's packages keep the startup setting, since its
+// logging cannot be reconfigured while they run.
+type loggingController struct {
+	mu      sync.Mutex
+	verbose string
+}
+
+// newLoggingController applies the initial verbose setting, to nostr-lib's
+// packages too; it must be called before any of them runs
+func newLoggingController(verbose string) *loggingController {
+	logging.SetLibraryVerbose(verbose)
+	c := &loggingController{}
+	c.Set(verbose)
+	return c
+}
+
+// Set replaces the verbose filter set
+func (c *loggingController) Set(verbose string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.verbose = verbose
+	logging.SetVerbose(verbose)
+}
+
+// Get returns the active verbose filter set
+func (c *loggingController) Get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.verbose
+}
+
+// loggingRequest is the body accepted by POST /api/v1/admin/logging. Either
+// a VERBOSE-style string or a list of module/method filters may be given;
+// level "info" disables verbose logging and "debug" without filters enables
+// it for everything.
+type loggingRequest struct {
+	Verbose *string  `json:"verbose"`
+	Filters []string `json:"filters"`
+	Level   string   `json:"level"`
+}
+
+// HandleLogging serves GET (inspect) and POST (update) of the verbose filters
+func (c *loggingController) HandleLogging(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body loggingRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		verbose := c.Get()
+		switch {
+		case body.Verbose != nil:
+			verbose = *body.Verbose
+		case len(body.Filters) > 0:
+			verbose = strings.Join(body.Filters, ",")
+		}
+		switch strings.ToLower(body.Level) {
+		case "":
+		case "info":
+			verbose = ""
+		case "debug":
+			if verbose == "" || verbose == "0" || verbose == "false" {
+				verbose = "all"
+			}
+		default:
+			http.Error(w, "invalid level: must be 'info' or 'debug'", http.StatusBadRequest)
+			return
+		}
+
+		c.Set(verbose)
+		logging.Info("verbose logging changed via admin API to %q", verbose)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	verbose := c.Get()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("verbose", jsonlib.NewJsonValue(verbose))
+	obj.Set("enabled", jsonlib.NewJsonValue(logging.Enabled()))
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
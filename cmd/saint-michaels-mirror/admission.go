@@ -0,0 +1,530 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Paid write access for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	nip19 "github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// admission is the write access granted to one pubkey
+type admission struct {
+	added   time.Time
+	expires time.Time // zero never expires
+	source  string    // config, admin or webhook
+}
+
+// admissionInvoice is an invoice that admits pubkey once paid
+type admissionInvoice struct {
+	PubKey    string    `json:"pubkey"`
+	Bolt11    string    `json:"bolt11"`
+	AmountSat int64     `json:"amount_sat"`
+	Created   time.Time `json:"created"`
+	Paid      bool      `json:"paid,omitempty"`
+}
+
+// admissionState is the persisted form of the admission list
+type admissionState struct {
+	PubKeys  map[string]admissionRecord  `json:"pubkeys"`
+	Invoices map[string]admissionInvoice `json:"invoices"`
+}
+
+// admissionRecord is the persisted form of an admission
+type admissionRecord struct {
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires,omitzero"`
+	Source  string    `json:"source"`
+}
+
+// admissionList tracks the pubkeys allowed to publish when payment is
+// required. Invoicing is left to an external service, which admits pubkeys
+// through the webhook once they have paid, or to a Lightning backend.
+type admissionList struct {
+	paymentsURL     string
+	defaultDuration time.Duration
+	webhookSecret   string
+	stateFile       string // empty keeps state in memory only
+	mu              sync.Mutex
+	pubkeys         map[string]*admission
+	invoices        map[string]*admissionInvoice // by payment hash
+	// stats
+	accepted     int64
+	rejected     int64
+	webhookCalls int64
+}
+
+// newAdmissionList creates the list, restoring stateFile when it exists;
+// permanent pubkeys never expire
+func newAdmissionList(paymentsURL string, defaultDuration time.Duration, webhookSecret, stateFile string, permanent []string) (*admissionList, error) {
+	a := &admissionList{
+		paymentsURL:     paymentsURL,
+		defaultDuration: defaultDuration,
+		webhookSecret:   webhookSecret,
+		stateFile:       stateFile,
+		pubkeys:         map[string]*admission{},
+		invoices:        map[string]*admissionInvoice{},
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	for _, pk := range permanent {
+		pubkey, err := parsePubKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		a.pubkeys[pubkey] = &admission{added: time.Now(), source: "config"}
+	}
+	return a, nil
+}
+
+// load restores the persisted state, if any
+func (a *admissionList) load() error {
+	if a.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(a.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state admissionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parsing %s: %w", a.stateFile, err)
+	}
+	for pubkey, rec := range state.PubKeys {
+		a.pubkeys[pubkey] = &admission{added: rec.Added, expires: rec.Expires, source: rec.Source}
+	}
+	for hash, inv := range state.Invoices {
+		a.invoices[hash] = &inv
+	}
+	logging.Info("restored %d admissions and %d invoices from %s", len(a.pubkeys), len(a.invoices), a.stateFile)
+	return nil
+}
+
+// saveLocked persists the state; a.mu must be held. Pubkeys admitted from
+// configuration and unpaid invoices are not saved.
+func (a *admissionList) saveLocked() {
+	if a.stateFile == "" {
+		return
+	}
+	state := admissionState{
+		PubKeys:  map[string]admissionRecord{},
+		Invoices: map[string]admissionInvoice{},
+	}
+	for pubkey, adm := range a.pubkeys {
+		if adm.source != "config" {
+			state.PubKeys[pubkey] = admissionRecord{Added: adm.added, Expires: adm.expires, Source: adm.source}
+		}
+	}
+	for hash, inv := range a.invoices {
+		if inv.Paid {
+			state.Invoices[hash] = *inv
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logging.Error("failed to encode admission state: %v", err)
+		return
+	}
+	if err := writeFileAtomic(a.stateFile, data); err != nil {
+		logging.Error("failed to save admission state to %s: %v", a.stateFile, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so a crash never leaves a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// parsePubKey accepts a hex or npub public key and returns it as hex
+func parsePubKey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "npub1") {
+		prefix, val, err := nip19.Decode(s)
+		if err != nil || prefix != "npub" {
+			return "", fmt.Errorf("invalid npub %q", s)
+		}
+		return val.(string), nil
+	}
+	s = strings.ToLower(s)
+	if !nostr.IsValid32ByteHex(s) {
+		return "", fmt.Errorf("invalid pubkey %q", s)
+	}
+	return s, nil
+}
+
+// Apply advertises payment_required in NIP-11 and installs the reject policy
+func (a *admissionList) Apply(r *khatru.Relay) {
+	if r.Info.Limitation == nil {
+		r.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	r.Info.Limitation.PaymentRequired = true
+	r.Info.Limitation.RestrictedWrites = true
+	r.Info.PaymentsURL = a.paymentsURL
+	r.RejectEvent = slices.Insert(r.RejectEvent, 0, policyRejects.Event("payment", a.RejectEvent))
+	logging.Info("payment required to publish: %d pubkeys admitted, payments at %q", a.count(), a.paymentsURL)
+}
+
+// Admitted reports whether pubkey may publish now
+func (a *admissionList) Admitted(pubkey string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	adm, ok := a.pubkeys[pubkey]
+	return ok && (adm.expires.IsZero() || time.Now().Before(adm.expires))
+}
+
+// Admit grants pubkey write access for duration, extending an admission that
+// has not expired yet; a non-positive duration never expires
+func (a *admissionList) Admit(pubkey string, duration time.Duration, source string) time.Time {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	adm, ok := a.pubkeys[pubkey]
+	if !ok || (!adm.expires.IsZero() && now.After(adm.expires)) {
+		adm = &admission{added: now, expires: now}
+		a.pubkeys[pubkey] = adm
+	}
+	adm.source = source
+	if duration <= 0 {
+		adm.expires = time.Time{}
+	} else if !adm.expires.IsZero() {
+		adm.expires = adm.expires.Add(duration)
+	}
+	a.saveLocked()
+	logging.Info("admitted %s via %s until %v", pubkey, source, adm.expires)
+	return adm.expires
+}
+
+// Revoke removes the write access of pubkey
+func (a *admissionList) Revoke(pubkey string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.pubkeys[pubkey]; !ok {
+		return false
+	}
+	delete(a.pubkeys, pubkey)
+	a.saveLocked()
+	logging.Info("revoked admission of %s", pubkey)
+	return true
+}
+
+// ForgetPubKey removes the admission and the invoices of pubkey, returning
+// how many there were. Admissions from configuration return on restart.
+func (a *admissionList) ForgetPubKey(pubkey string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := 0
+	if _, ok := a.pubkeys[pubkey]; ok {
+		delete(a.pubkeys, pubkey)
+		n++
+	}
+	for hash, inv := range a.invoices {
+		if inv.PubKey == pubkey {
+			delete(a.invoices, hash)
+			n++
+		}
+	}
+	if n > 0 {
+		a.saveLocked()
+	}
+	return n
+}
+
+// AddInvoice remembers an unpaid invoice that admits pubkey once paid. It
+// is kept in memory only until it is paid, so requesting invoices never
+// writes the state file.
+func (a *admissionList) AddInvoice(hash string, inv admissionInvoice) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.invoices[hash] = &inv
+}
+
+// PendingInvoices returns the number of unpaid invoices
+func (a *admissionList) PendingInvoices() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := 0
+	for _, inv := range a.invoices {
+		if !inv.Paid {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Invoice returns the invoice with the given payment hash
+func (a *admissionList) Invoice(hash string) (admissionInvoice, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	inv, ok := a.invoices[hash]
+	if !ok {
+		return admissionInvoice{}, false
+	}
+	return *inv, true
+}
+
+// SettleInvoice marks an invoice paid and admits its pubkey for duration. It
+// reports false when the invoice is unknown or was already settled.
+func (a *admissionList) SettleInvoice(hash string, duration time.Duration) (string, bool) {
+	a.mu.Lock()
+	inv, ok := a.invoices[hash]
+	if !ok || inv.Paid {
+		a.mu.Unlock()
+		return "", false
+	}
+	inv.Paid = true
+	a.mu.Unlock()
+	// Admit persists the invoice together with the admission
+	a.Admit(inv.PubKey, duration, "lightning")
+	return inv.PubKey, true
+}
+
+// Expires returns when the admission of pubkey expires, zero when it never
+// does, and whether pubkey is admitted
+func (a *admissionList) Expires(pubkey string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	adm, ok := a.pubkeys[pubkey]
+	if !ok {
+		return time.Time{}, false
+	}
+	return adm.expires, true
+}
+
+// PruneInvoices forgets paid and unpaid invoices created before cutoff
+func (a *admissionList) PruneInvoices(cutoff time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pruned, paid := 0, 0
+	for hash, inv := range a.invoices {
+		if inv.Created.Before(cutoff) {
+			delete(a.invoices, hash)
+			pruned++
+			if inv.Paid {
+				paid++
+			}
+		}
+	}
+	if paid > 0 {
+		a.saveLocked()
+	}
+	if pruned > 0 {
+		logging.DebugMethod("admission", "PruneInvoices", "pruned %d invoices, %d of them paid", pruned, paid)
+	}
+}
+
+// count returns the number of admitted pubkeys, expired or not
+func (a *admissionList) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pubkeys)
+}
+
+// RejectEvent rejects events from pubkeys without a valid admission
+func (a *admissionList) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if a.Admitted(evt.PubKey) {
+		atomic.AddInt64(&a.accepted, 1)
+		return false, ""
+	}
+	atomic.AddInt64(&a.rejected, 1)
+	logging.DebugMethod("admission", "RejectEvent", "pubkey %s not admitted", evt.PubKey)
+	if a.paymentsURL != "" {
+		return true, "restricted: payment required to publish, see " + a.paymentsURL
+	}
+	return true, "restricted: payment required to publish"
+}
+
+// admissionRequest is the body accepted by the admin API and the webhook
+type admissionRequest struct {
+	PubKey   string `json:"pubkey"`
+	Duration string `json:"duration"`
+}
+
+// decode reads an admission request and returns its hex pubkey and duration
+func (a *admissionList) decode(w http.ResponseWriter, req *http.Request) (string, time.Duration, error) {
+	var body admissionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+		return "", 0, fmt.Errorf("invalid request body: %w", err)
+	}
+	pubkey, err := parsePubKey(body.PubKey)
+	if err != nil {
+		return "", 0, err
+	}
+	duration := a.defaultDuration
+	if body.Duration != "" {
+		if duration, err = time.ParseDuration(body.Duration); err != nil {
+			return "", 0, fmt.Errorf("invalid duration %q", body.Duration)
+		}
+	}
+	return pubkey, duration, nil
+}
+
+// HandleAdmission serves GET (list), POST (admit) and DELETE (revoke) of
+// admitted pubkeys
+func (a *admissionList) HandleAdmission(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		pubkey, duration, err := a.decode(w, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.Admit(pubkey, duration, "admin")
+	case http.MethodDelete:
+		pubkey, _, err := a.decode(w, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !a.Revoke(pubkey) {
+			http.Error(w, "pubkey not admitted", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, a.list())
+}
+
+// HandleWebhook serves POST /api/v1/admission/webhook, called by the payment
+// service with the webhook secret as bearer token once a pubkey has paid
+func (a *admissionList) HandleWebhook(w http.ResponseWriter, req *http.Request) {
+	if a.webhookSecret == "" {
+		http.Error(w, "admission webhook disabled: ADMISSION_WEBHOOK_SECRET not configured", http.StatusNotFound)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provided := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(a.webhookSecret)) != 1 {
+		logging.Warn("rejected admission webhook from %s", req.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pubkey, duration, err := a.decode(w, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	atomic.AddInt64(&a.webhookCalls, 1)
+	expires := a.Admit(pubkey, duration, "webhook")
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkey", jsonlib.NewJsonValue(pubkey))
+	if !expires.IsZero() {
+		obj.Set("expires_at", jsonlib.NewJsonValue(expires.Unix()))
+	}
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// list renders every admitted pubkey, soonest expiry first
+func (a *admissionList) list() *jsonlib.JsonObject {
+	now := time.Now()
+	a.mu.Lock()
+	pubkeys := make([]string, 0, len(a.pubkeys))
+	for pubkey := range a.pubkeys {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	expiry := func(pubkey string) time.Time {
+		if e := a.pubkeys[pubkey].expires; !e.IsZero() {
+			return e
+		}
+		return time.Unix(1<<62, 0)
+	}
+	sort.Slice(pubkeys, func(i, j int) bool {
+		return expiry(pubkeys[i]).Before(expiry(pubkeys[j]))
+	})
+
+	list := jsonlib.NewJsonList()
+	for _, pubkey := range pubkeys {
+		adm := a.pubkeys[pubkey]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("pubkey", jsonlib.NewJsonValue(pubkey))
+		obj.Set("source", jsonlib.NewJsonValue(adm.source))
+		obj.Set("added", jsonlib.NewJsonValue(adm.added.Unix()))
+		if !adm.expires.IsZero() {
+			obj.Set("expires_at", jsonlib.NewJsonValue(adm.expires.Unix()))
+		}
+		obj.Set("expired", jsonlib.NewJsonValue(!adm.expires.IsZero() && now.After(adm.expires)))
+		list.Append(obj)
+	}
+	a.mu.Unlock()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkeys", list)
+	return obj
+}
+
+// GetStatsName returns the name of this stats provider
+func (a *admissionList) GetStatsName() string {
+	return "admission"
+}
+
+// GetStats returns stats as JsonEntity
+func (a *admissionList) GetStats() jsonlib.JsonEntity {
+	now := time.Now()
+	a.mu.Lock()
+	active := 0
+	for _, adm := range a.pubkeys {
+		if adm.expires.IsZero() || now.Before(adm.expires) {
+			active++
+		}
+	}
+	total := len(a.pubkeys)
+	a.mu.Unlock()
+	pending := a.PendingInvoices()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("payments_url", jsonlib.NewJsonValue(a.paymentsURL))
+	obj.Set("admitted", jsonlib.NewJsonValue(active))
+	obj.Set("expired", jsonlib.NewJsonValue(total-active))
+	obj.Set("pending_invoices", jsonlib.NewJsonValue(pending))
+	obj.Set("accepted_events", jsonlib.NewJsonValue(atomic.LoadInt64(&a.accepted)))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&a.rejected)))
+	obj.Set("webhook_calls", jsonlib.NewJsonValue(atomic.LoadInt64(&a.webhookCalls)))
+	return obj
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// API keys for the HTTP API of Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// APIKeyHeader is the request header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix starts every issued key, so leaked keys are easy to grep for
+const apiKeyPrefix = "smm_"
+
+// API key scopes, one per endpoint a key can be granted
+const (
+	apiScopeExport = "export"
+	apiScopeImport = "import"
+	apiScopeQuery  = "query"
+	apiScopeEvent  = "event"
+)
+
+// apiScopes lists the valid scopes
+var apiScopes = []string{apiScopeExport, apiScopeImport, apiScopeQuery, apiScopeEvent}
+
+// apiKey is one issued key. Only the hash of the key is kept.
+type apiKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Scopes  []string  `json:"scopes"`
+	Rate    int       `json:"rate"` // requests per ClientRateInterval
+	Burst   int       `json:"burst"`
+	Created time.Time `json:"created"`
+	// usage, not persisted
+	mu       sync.Mutex
+	tokens   float64
+	refilled time.Time
+	lastUsed time.Time
+	requests map[string]int64 // by scope
+	limited  int64
+}
+
+// apiKeyContextKey is the request context key of the apiKey that
+// authorized the request
+type apiKeyContextKey struct{}
+
+// apiKeys issues and checks keys that give third-party services access to
+// chosen HTTP API endpoints without the admin token: export and import act
+// as the admin would, for any author, while query and event skip the
+// per-connection rate limit. Each key has its own token bucket rate limit
+// and usage counters. Keys are shown once when issued; the list holds their
+// SHA-256 hashes.
+type apiKeys struct {
+	stateFile   string
+	defaultRate int
+	mu          sync.RWMutex
+	keys        map[string]*apiKey // by hash
+	// stats
+	issued    int64
+	revoked   int64
+	unknown   int64
+	forbidden int64
+	limited   int64
+}
+
+// apiKeysState is the persisted form of the keys
+type apiKeysState struct {
+	Keys []*apiKey `json:"keys"`
+}
+
+// newAPIKeys creates the key list, restoring it from stateFile if there is
+// one; keys issued without a rate get defaultRate
+func newAPIKeys(stateFile string, defaultRate int) (*apiKeys, error) {
+	k := &apiKeys{stateFile: stateFile, defaultRate: defaultRate, keys: map[string]*apiKey{}}
+	if stateFile == "" {
+		return k, nil
+	}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state apiKeysState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", stateFile, err)
+	}
+	for _, key := range state.Keys {
+		key.tokens = float64(key.Burst)
+		key.refilled = time.Now()
+		key.requests = map[string]int64{}
+		k.keys[key.Hash] = key
+	}
+	logging.Info("restored %d API keys from %s", len(k.keys), stateFile)
+	return k, nil
+}
+
+// apiKeyHash returns the hash key is listed under
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Issue creates a key for name, allowed the given scopes at rate requests
+// per ClientRateInterval, and returns it with its secret
+func (k *apiKeys) Issue(name string, scopes []string, rate, burst int) (*apiKey, string) {
+	if rate <= 0 {
+		rate = k.defaultRate
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	secret := apiKeyPrefix + randomHex(24)
+	key := &apiKey{
+		ID:       randomHex(4),
+		Name:     name,
+		Hash:     apiKeyHash(secret),
+		Scopes:   scopes,
+		Rate:     rate,
+		Burst:    burst,
+		Created:  time.Now(),
+		tokens:   float64(burst),
+		refilled: time.Now(),
+		requests: map[string]int64{},
+	}
+	k.mu.Lock()
+	k.keys[key.Hash] = key
+	k.saveLocked()
+	k.mu.Unlock()
+	atomic.AddInt64(&k.issued, 1)
+	logging.Info("issued API key %s (%s) for %v", key.ID, name, scopes)
+	return key, secret
+}
+
+// Revoke deletes the key with id, reporting whether there was one
+func (k *apiKeys) Revoke(id string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for hash, key := range k.keys {
+		if key.ID == id {
+			delete(k.keys, hash)
+			k.saveLocked()
+			atomic.AddInt64(&k.revoked, 1)
+			logging.Info("revoked API key %s (%s)", key.ID, key.Name)
+			return true
+		}
+	}
+	return false
+}
+
+// saveLocked persists the keys; k.mu must be held
+func (k *apiKeys) saveLocked() {
+	if k.stateFile == "" {
+		return
+	}
+	state := apiKeysState{Keys: make([]*apiKey, 0, len(k.keys))}
+	for _, key := range k.keys {
+		state.Keys = append(state.Keys, key)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logging.Error("failed to encode API keys: %v", err)
+		return
+	}
+	if err := writeFileAtomic(k.stateFile, data); err != nil {
+		logging.Error("failed to save API keys to %s: %v", k.stateFile, err)
+	}
+}
+
+// take counts a request in scope and reports whether the rate limit lets it
+// through
+func (key *apiKey) take(scope string) bool {
+	key.mu.Lock()
+	defer key.mu.Unlock()
+	now := time.Now()
+	key.tokens += now.Sub(key.refilled).Seconds() * float64(key.Rate) / ClientRateInterval.Seconds()
+	key.tokens = min(key.tokens, float64(key.Burst))
+	key.refilled = now
+	if key.tokens < 1 {
+		key.limited++
+		return false
+	}
+	key.tokens--
+	key.lastUsed = now
+	key.requests[scope]++
+	return true
+}
+
+// Handler checks the API key of requests to the endpoint of scope. Requests
+// without a key go through untouched, to be authenticated as before; a key
+// that is unknown, lacks the scope or is over its rate is refused.
+func (k *apiKeys) Handler(scope string, next http.HandlerFunc) http.HandlerFunc {
+	if k == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		secret := req.Header.Get(APIKeyHeader)
+		if secret == "" {
+			next(w, req)
+			return
+		}
+		k.mu.RLock()
+		key := k.keys[apiKeyHash(secret)]
+		k.mu.RUnlock()
+		if key == nil {
+			atomic.AddInt64(&k.unknown, 1)
+			logging.Warn("rejected unknown API key for %s from %s", req.URL.Path, req.RemoteAddr)
+			http.Error(w, "unauthorized: unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(key.Scopes, scope) {
+			atomic.AddInt64(&k.forbidden, 1)
+			http.Error(w, "forbidden: API key not allowed to "+scope, http.StatusForbidden)
+			return
+		}
+		if !key.take(scope) {
+			atomic.AddInt64(&k.limited, 1)
+			w.Header().Set("Retry-After", fmt.Sprint(max(int(ClientRateInterval.Seconds())/key.Rate, 1)))
+			http.Error(w, "rate-limited: API key over its rate", http.StatusTooManyRequests)
+			return
+		}
+		next(w, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// hasAPIKey reports whether req was authorized with an API key
+func hasAPIKey(req *http.Request) bool {
+	_, ok := req.Context().Value(apiKeyContextKey{}).(*apiKey)
+	return ok
+}
+
+// keyJSON renders key and its usage, without the hash
+func (key *apiKey) keyJSON() *jsonlib.JsonObject {
+	scopes := jsonlib.NewJsonList()
+	for _, scope := range key.Scopes {
+		scopes.Append(jsonlib.NewJsonValue(scope))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("id", jsonlib.NewJsonValue(key.ID))
+	obj.Set("name", jsonlib.NewJsonValue(key.Name))
+	obj.Set("scopes", scopes)
+	obj.Set("rate", jsonlib.NewJsonValue(key.Rate))
+	obj.Set("burst", jsonlib.NewJsonValue(key.Burst))
+	obj.Set("created", jsonlib.NewJsonValue(key.Created.Unix()))
+	key.mu.Lock()
+	defer key.mu.Unlock()
+	requests := jsonlib.NewJsonObject()
+	var total int64
+	for _, scope := range apiScopes {
+		if n := key.requests[scope]; n > 0 {
+			requests.Set(scope, jsonlib.NewJsonValue(n))
+			total += n
+		}
+	}
+	obj.Set("requests", jsonlib.NewJsonValue(total))
+	obj.Set("requests_by_scope", requests)
+	obj.Set("limited", jsonlib.NewJsonValue(key.limited))
+	if !key.lastUsed.IsZero() {
+		obj.Set("last_used", jsonlib.NewJsonValue(key.lastUsed.Unix()))
+	}
+	return obj
+}
+
+// apiKeyRequest is the body of POST /api/v1/admin/apikeys
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Rate   int      `json:"rate"`
+	Burst  int      `json:"burst"`
+}
+
+// HandleAPIKeys serves GET (list the keys and their usage), POST (issue a
+// key) and DELETE ?id= (revoke a key) of the API keys
+func (k *apiKeys) HandleAPIKeys(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		k.mu.RLock()
+		keys := make([]*apiKey, 0, len(k.keys))
+		for _, key := range k.keys {
+			keys = append(keys, key)
+		}
+		k.mu.RUnlock()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+		list := jsonlib.NewJsonList()
+		for _, key := range keys {
+			list.Append(key.keyJSON())
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("keys", list)
+		writeJSONEntity(w, req, http.StatusOK, obj)
+	case http.MethodPost:
+		var body apiKeyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		if len(body.Scopes) == 0 {
+			http.Error(w, fmt.Sprintf("missing scopes: any of %v", apiScopes), http.StatusBadRequest)
+			return
+		}
+		for _, scope := range body.Scopes {
+			if !slices.Contains(apiScopes, scope) {
+				http.Error(w, fmt.Sprintf("invalid scope %q: must be one of %v", scope, apiScopes), http.StatusBadRequest)
+				return
+			}
+		}
+		if body.Rate < 0 || body.Burst < 0 {
+			http.Error(w, "rate and burst must not be negative", http.StatusBadRequest)
+			return
+		}
+		key, secret := k.Issue(body.Name, body.Scopes, body.Rate, body.Burst)
+		obj := key.keyJSON()
+		obj.Set("key", jsonlib.NewJsonValue(secret))
+		writeJSONEntity(w, req, http.StatusCreated, obj)
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+		if !k.Revoke(id) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("revoked", jsonlib.NewJsonValue(id))
+		writeJSONEntity(w, req, http.StatusOK, obj)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (k *apiKeys) GetStatsName() string {
+	return "api_keys"
+}
+
+// GetStats returns stats as JsonEntity
+func (k *apiKeys) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	k.mu.RLock()
+	obj.Set("keys", jsonlib.NewJsonValue(len(k.keys)))
+	var requests int64
+	for _, key := range k.keys {
+		key.mu.Lock()
+		for _, n := range key.requests {
+			requests += n
+		}
+		key.mu.Unlock()
+	}
+	k.mu.RUnlock()
+	obj.Set("requests", jsonlib.NewJsonValue(requests))
+	obj.Set("issued", jsonlib.NewJsonValue(atomic.LoadInt64(&k.issued)))
+	obj.Set("revoked", jsonlib.NewJsonValue(atomic.LoadInt64(&k.revoked)))
+	obj.Set("unknown_key", jsonlib.NewJsonValue(atomic.LoadInt64(&k.unknown)))
+	obj.Set("forbidden", jsonlib.NewJsonValue(atomic.LoadInt64(&k.forbidden)))
+	obj.Set("rate_limited", jsonlib.NewJsonValue(atomic.LoadInt64(&k.limited)))
+	return obj
+}
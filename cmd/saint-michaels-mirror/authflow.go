@@ -0,0 +1,305 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-42 AUTH flow settings for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// AuthChallengeAuto challenges on connect when TRUSTED_PUBKEYS or
+	// RESTRICTED_READS make who the client is matter
+	AuthChallengeAuto = "auto"
+	// AuthChallengeAlways challenges every connection on connect
+	AuthChallengeAlways = "always"
+	// AuthChallengeNever only challenges when a policy requires AUTH
+	AuthChallengeNever = "never"
+)
+
+// authFlow adjusts khatru's NIP-42 flow and counts its outcomes. khatru has
+// no AUTH hook, so the AUTH and CLOSE frames of each connection are read
+// before khatru handles them: AUTH events are checked the way khatru checks
+// them to tell why they fail, and an AUTH that must be refused gets its
+// challenge replaced first, which makes khatru fail it. Frames are only read
+// when a challenge TTL, refusing AUTH during subscriptions or outcome stats
+// need them.
+type authFlow struct {
+	onConnect   bool
+	ttl         time.Duration // 0 for challenges that never expire
+	midSub      bool          // AUTH accepted while subscriptions are open
+	readsFrames bool          // AUTH and CLOSE frames are read
+	relay       *khatru.Relay
+	// stats
+	challengesOnConnect int64
+	challengesRenewed   int64
+	successes           int64
+	uninspected         int64
+	mu                  sync.Mutex
+	failures            map[string]int64 // by reason
+}
+
+// authConnState holds the AUTH state of one client connection
+type authConnState struct {
+	mu     sync.Mutex
+	ws     *khatru.WebSocket
+	issued time.Time       // when the current challenge was created
+	subs   map[string]bool // open subscriptions by id
+	// set when an AUTH was refused for open subscriptions, so a new
+	// challenge is sent once they are closed
+	refused bool
+}
+
+// authConnKey is the request context key of the authConnState
+type authConnKey struct{}
+
+// newAuthFlow parses AUTH_CHALLENGE_ON_CONNECT; auto challenges on connect
+// when authenticated clients are treated differently. Frames are read when
+// outcomes are counted or ttl or midSubscription need them.
+func newAuthFlow(challengeOnConnect string, authMatters bool, ttl time.Duration, midSubscription, outcomeStats bool) (*authFlow, error) {
+	f := &authFlow{
+		ttl:         ttl,
+		midSub:      midSubscription,
+		readsFrames: outcomeStats || ttl > 0 || !midSubscription,
+		failures:    map[string]int64{},
+	}
+	switch strings.ToLower(strings.TrimSpace(challengeOnConnect)) {
+	case "", AuthChallengeAuto:
+		f.onConnect = authMatters
+	case AuthChallengeAlways:
+		f.onConnect = true
+	case AuthChallengeNever:
+	default:
+		return nil, fmt.Errorf("invalid AUTH_CHALLENGE_ON_CONNECT %q: must be auto, always or never", challengeOnConnect)
+	}
+	return f, nil
+}
+
+// Apply sends the challenge on connect if requested and tracks the open
+// subscriptions of each connection. It must be called after every other
+// filter hook is installed, so only subscriptions khatru accepts are tracked.
+func (f *authFlow) Apply(r *khatru.Relay) {
+	f.relay = r
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if state := authState(ws); state != nil {
+			state.mu.Lock()
+			state.ws = ws
+			state.mu.Unlock()
+		}
+		if f.onConnect {
+			atomic.AddInt64(&f.challengesOnConnect, 1)
+			khatru.RequestAuth(ctx)
+		}
+	})
+	r.RejectFilter = append(r.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if state := authState(khatru.GetConnection(ctx)); state != nil {
+			state.mu.Lock()
+			state.subs[khatru.GetSubscriptionID(ctx)] = true
+			state.mu.Unlock()
+		}
+		return false, ""
+	})
+}
+
+// WrapHandler reads the AUTH and CLOSE frames of websocket connections, if
+// the flow needs them
+func (f *authFlow) WrapHandler(next http.Handler) http.Handler {
+	if !f.readsFrames {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		state := &authConnState{issued: time.Now(), subs: map[string]bool{}}
+		req = req.WithContext(context.WithValue(req.Context(), authConnKey{}, state))
+		next.ServeHTTP(&frameHijacker{ResponseWriter: w, inspector: frameInspector{
+			inspect: func(msg []byte) []byte {
+				f.inspect(state, msg)
+				return nil
+			},
+			skipped: func() { atomic.AddInt64(&f.uninspected, 1) },
+		}}, req)
+	})
+}
+
+// authState returns the AUTH state of the connection ws, if any
+func authState(ws *khatru.WebSocket) *authConnState {
+	if ws == nil || ws.Request == nil {
+		return nil
+	}
+	state, _ := ws.Request.Context().Value(authConnKey{}).(*authConnState)
+	return state
+}
+
+// inspect handles a message of the connection before khatru does
+func (f *authFlow) inspect(state *authConnState, msg []byte) {
+	msg = bytes.TrimLeft(msg, " \t\r\n")
+	switch {
+	case bytes.HasPrefix(msg, []byte(`["CLOSE"`)):
+		var frame []string
+		if json.Unmarshal(msg, &frame) != nil || len(frame) < 2 {
+			return
+		}
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		delete(state.subs, frame[1])
+		if state.refused && len(state.subs) == 0 && state.ws != nil {
+			state.refused = false
+			f.renew(state, "")
+		}
+	case bytes.HasPrefix(msg, []byte(`["AUTH"`)):
+		var frame []json.RawMessage
+		var evt nostr.Event
+		if json.Unmarshal(msg, &frame) != nil || len(frame) < 2 || json.Unmarshal(frame[1], &evt) != nil {
+			f.failed("invalid_message")
+			return
+		}
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if state.ws == nil {
+			return
+		}
+		switch {
+		case f.ttl > 0 && time.Since(state.issued) > f.ttl:
+			f.failed("expired_challenge")
+			f.renew(state, "")
+		case !f.midSub && len(state.subs) > 0:
+			f.failed("open_subscriptions")
+			state.refused = true
+			f.renew(state, "close your subscriptions before authenticating")
+		default:
+			if reason := f.check(state.ws, &evt); reason != "" {
+				f.failed(reason)
+			} else {
+				atomic.AddInt64(&f.successes, 1)
+			}
+		}
+	}
+}
+
+// renew replaces the challenge of the connection, which fails any AUTH
+// khatru has yet to handle, and sends the new one unless notice is given,
+// in which case the client is told why instead. khatru reads the challenge
+// from other goroutines without a lock; the string is replaced whole.
+func (f *authFlow) renew(state *authConnState, notice string) {
+	random := make([]byte, 8)
+	rand.Read(random)
+	challenge := hex.EncodeToString(random)
+	ws := state.ws
+	ws.Challenge = challenge
+	state.issued = time.Now()
+	if notice != "" {
+		go ws.WriteJSON(nostr.NoticeEnvelope(notice))
+		return
+	}
+	atomic.AddInt64(&f.challengesRenewed, 1)
+	go ws.WriteJSON(nostr.AuthEnvelope{Challenge: &challenge})
+}
+
+// check returns why khatru will reject evt as the AUTH of ws, in the order
+// nip42.ValidateAuthEvent checks it, or "" if it will accept it
+func (f *authFlow) check(ws *khatru.WebSocket, evt *nostr.Event) string {
+	if evt.Kind != nostr.KindClientAuthentication {
+		return "wrong_kind"
+	}
+	if evt.Tags.FindWithValue("challenge", ws.Challenge) == nil {
+		return "wrong_challenge"
+	}
+	tag := evt.Tags.Find("relay")
+	if tag == nil {
+		return "wrong_relay"
+	}
+	expected, err := parseAuthURL(f.relayURL(ws.Request))
+	if err != nil {
+		return "wrong_relay"
+	}
+	found, err := parseAuthURL(tag[1])
+	if err != nil || found.Scheme != expected.Scheme || found.Host != expected.Host || found.Path != expected.Path {
+		return "wrong_relay"
+	}
+	if created := evt.CreatedAt.Time(); time.Since(created).Abs() > 10*time.Minute {
+		return "stale_event"
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "bad_signature"
+	}
+	return ""
+}
+
+// relayURL returns the URL khatru expects in the relay tag of AUTH events
+// sent over the connection upgraded from req
+func (f *authFlow) relayURL(req *http.Request) string {
+	base := f.relay.ServiceURL
+	if base == "" {
+		host := req.Header.Get("X-Forwarded-Host")
+		if host == "" {
+			host = req.Host
+		}
+		proto := req.Header.Get("X-Forwarded-Proto")
+		if proto == "" {
+			proto = "https"
+			if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); host == "localhost" || strings.Contains(host, ":") || err == nil {
+				proto = "http"
+			}
+		}
+		base = proto + "://" + host
+	}
+	return strings.Replace(base, "http", "ws", 1)
+}
+
+// parseAuthURL parses a relay URL the way NIP-42 validation compares them
+func parseAuthURL(input string) (*url.URL, error) {
+	return url.Parse(strings.ToLower(strings.TrimSuffix(input, "/")))
+}
+
+// failed counts an AUTH that failed for reason
+func (f *authFlow) failed(reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[reason]++
+}
+
+// GetStatsName returns the name of this stats provider
+func (f *authFlow) GetStatsName() string {
+	return "auth"
+}
+
+// GetStats returns stats as JsonEntity
+func (f *authFlow) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("challenge_on_connect", jsonlib.NewJsonValue(f.onConnect))
+	obj.Set("challenge_ttl", jsonlib.NewJsonValue(f.ttl.String()))
+	obj.Set("auth_during_subscriptions", jsonlib.NewJsonValue(f.midSub))
+	obj.Set("inspecting_frames", jsonlib.NewJsonValue(f.readsFrames))
+	obj.Set("challenges_on_connect", jsonlib.NewJsonValue(atomic.LoadInt64(&f.challengesOnConnect)))
+	obj.Set("challenges_renewed", jsonlib.NewJsonValue(atomic.LoadInt64(&f.challengesRenewed)))
+	obj.Set("successes", jsonlib.NewJsonValue(atomic.LoadInt64(&f.successes)))
+	obj.Set("uninspected_frames", jsonlib.NewJsonValue(atomic.LoadInt64(&f.uninspected)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj.Set("failures", prefixCountsToJSON(f.failures))
+	return obj
+}
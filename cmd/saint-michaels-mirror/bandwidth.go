@@ -0,0 +1,259 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Bandwidth accounting for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// BandwidthRateWindow is the interval over which transfer rates are computed
+const BandwidthRateWindow = 10 * time.Second
+
+// Upstream traffic roles. Connections of the pool shared by the relaystore,
+// the mirror and the publisher are reported as "shared"; the upstream_pool
+// stats break that down by role. Connections opened by broadcast discovery,
+// or by the relaystore and the mirror without a shared pool, are not tagged
+// and are reported as "other".
+const (
+	bandwidthRoleOther   = "other"
+	bandwidthRoleShared  = "shared"
+	bandwidthRoleCount   = "count"
+	bandwidthRoleSearch  = "search"
+	bandwidthRolePublish = "publish"
+	bandwidthRoleQuorum  = "quorum"
+	bandwidthRoleShadow  = "shadow"
+)
+
+// bandwidthRoleKey is the context key tagging dials with a traffic role
+type bandwidthRoleKey struct{}
+
+// withBandwidthRole tags connections dialed with ctx as belonging to role
+func withBandwidthRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, bandwidthRoleKey{}, role)
+}
+
+// byteCounter counts bytes received and sent, plus the rates of the last window
+type byteCounter struct {
+	in      int64
+	out     int64
+	lastIn  int64
+	lastOut int64
+	rateIn  int64 // bytes per second
+	rateOut int64
+}
+
+// sample updates the rates from the bytes transferred since the last sample
+func (c *byteCounter) sample(elapsed time.Duration) {
+	in, out := atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+	seconds := elapsed.Seconds()
+	if seconds > 0 {
+		atomic.StoreInt64(&c.rateIn, int64(float64(in-c.lastIn)/seconds))
+		atomic.StoreInt64(&c.rateOut, int64(float64(out-c.lastOut)/seconds))
+	}
+	c.lastIn, c.lastOut = in, out
+}
+
+// toJSON renders the counter
+func (c *byteCounter) toJSON() *jsonlib.JsonObject {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("bytes_in", jsonlib.NewJsonValue(atomic.LoadInt64(&c.in)))
+	obj.Set("bytes_out", jsonlib.NewJsonValue(atomic.LoadInt64(&c.out)))
+	obj.Set("rate_in_bps", jsonlib.NewJsonValue(atomic.LoadInt64(&c.rateIn)))
+	obj.Set("rate_out_bps", jsonlib.NewJsonValue(atomic.LoadInt64(&c.rateOut)))
+	return obj
+}
+
+// countingConn adds the bytes it reads and writes to a set of counters
+type countingConn struct {
+	net.Conn
+	counters []*byteCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, counter := range c.counters {
+		atomic.AddInt64(&counter.in, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	for _, counter := range c.counters {
+		atomic.AddInt64(&counter.out, int64(n))
+	}
+	return n, err
+}
+
+// countingListener counts the traffic of every accepted connection
+type countingListener struct {
+	net.Listener
+	counter *byteCounter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counters: []*byteCounter{l.counter}}, nil
+}
+
+// bandwidthMeter accounts the bytes exchanged with clients and with every
+// upstream relay, split by the role of the upstream connection. Counts are
+// taken at the TCP level so they include TLS, HTTP and websocket framing,
+// which is what metered hosts bill.
+type bandwidthMeter struct {
+	clients byteCounter
+	mu      sync.Mutex
+	roles   map[string]*byteCounter
+	relays  map[string]*byteCounter // by dialed host:port
+}
+
+// newBandwidthMeter creates a meter
+func newBandwidthMeter() *bandwidthMeter {
+	return &bandwidthMeter{
+		roles:  map[string]*byteCounter{},
+		relays: map[string]*byteCounter{},
+	}
+}
+
+// WrapListener counts client traffic accepted on ln
+func (b *bandwidthMeter) WrapListener(ln net.Listener) net.Listener {
+	return &countingListener{Listener: ln, counter: &b.clients}
+}
+
+// InstallUpstreamDialer makes outgoing connections of http.DefaultTransport,
+// which go-nostr uses for websocket dials and NIP-11 probes, count their bytes.
+func (b *bandwidthMeter) InstallUpstreamDialer() {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		logging.Warn("cannot account upstream bandwidth: default transport is %T", http.DefaultTransport)
+		return
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		role, _ := ctx.Value(bandwidthRoleKey{}).(string)
+		if role == "" {
+			role = bandwidthRoleOther
+		}
+		return &countingConn{Conn: conn, counters: []*byteCounter{b.counter(b.roles, role), b.counter(b.relays, addr)}}, nil
+	}
+}
+
+// counter returns the counter for key in m, creating it on first use
+func (b *bandwidthMeter) counter(m map[string]*byteCounter, key string) *byteCounter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := m[key]
+	if !ok {
+		c = &byteCounter{}
+		m[key] = c
+	}
+	return c
+}
+
+// Start samples transfer rates until ctx is cancelled
+func (b *bandwidthMeter) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(BandwidthRateWindow)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				elapsed := now.Sub(last)
+				last = now
+				b.mu.Lock()
+				b.clients.sample(elapsed)
+				for _, c := range b.roles {
+					c.sample(elapsed)
+				}
+				for _, c := range b.relays {
+					c.sample(elapsed)
+				}
+				b.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// ClientBytesOut returns the bytes sent to clients
+func (b *bandwidthMeter) ClientBytesOut() int64 {
+	return atomic.LoadInt64(&b.clients.out)
+}
+
+// UpstreamBytesIn returns the bytes received from upstream relays
+func (b *bandwidthMeter) UpstreamBytesIn() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var in int64
+	for _, c := range b.roles {
+		in += atomic.LoadInt64(&c.in)
+	}
+	return in
+}
+
+// GetStatsName returns the name of this stats provider
+func (b *bandwidthMeter) GetStatsName() string {
+	return "bandwidth"
+}
+
+// GetStats returns stats as JsonEntity
+func (b *bandwidthMeter) GetStats() jsonlib.JsonEntity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	upstream := &byteCounter{}
+	for _, c := range b.roles {
+		upstream.in += atomic.LoadInt64(&c.in)
+		upstream.out += atomic.LoadInt64(&c.out)
+		upstream.rateIn += atomic.LoadInt64(&c.rateIn)
+		upstream.rateOut += atomic.LoadInt64(&c.rateOut)
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("rate_window", jsonlib.NewJsonValue(BandwidthRateWindow.String()))
+	obj.Set("clients", b.clients.toJSON())
+	obj.Set("upstream", upstream.toJSON())
+	obj.Set("upstream_by_role", countersToJSON(b.roles))
+	obj.Set("upstream_by_relay", countersToJSON(b.relays))
+	return obj
+}
+
+// countersToJSON renders counters sorted by key
+func countersToJSON(m map[string]*byteCounter) *jsonlib.JsonObject {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	obj := jsonlib.NewJsonObject()
+	for _, key := range keys {
+		obj.Set(key, m[key].toJSON())
+	}
+	return obj
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Per-event broadcast results for Espelho de São Miguel.
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Broadcast result states of one relay
+const (
+	broadcastPending   = "pending"
+	broadcastRetrying  = "retrying"
+	broadcastAccepted  = "accepted"
+	broadcastDuplicate = "duplicate"
+	broadcastRejected  = "rejected"
+	broadcastFailed    = "failed"
+	broadcastCanceled  = "canceled"
+	broadcastDryRun    = "dry_run"
+)
+
+// broadcastResult is the outcome of publishing one event to one relay
+type broadcastResult struct {
+	relay    string
+	hint     bool
+	status   string
+	attempts int
+	reason   string
+	updated  time.Time
+}
+
+// broadcastEntry holds the results of one event
+type broadcastEntry struct {
+	id       string
+	pubkey   string
+	queued   time.Time
+	started  time.Time
+	finished time.Time
+	dropped  string
+	relays   map[string]*broadcastResult
+}
+
+// broadcastLog remembers, for the most recently published events, which
+// relays each was sent to and how each answered, so users and operators can
+// see where an event actually landed. The least recently queued events are
+// evicted beyond its capacity. A nil log records nothing.
+type broadcastLog struct {
+	capacity   int
+	adminToken string
+	serviceURL *serviceURLResolver
+	// exclude, when set, keeps the events of the pubkeys it reports out
+	exclude func(pubkey string) bool
+	mu      sync.Mutex
+	order   *list.List               // of *broadcastEntry, most recent first
+	entries map[string]*list.Element // by event id
+	// stats
+	recorded int64
+	evicted  int64
+	lookups  int64
+	denied   int64
+}
+
+// newBroadcastLog creates a log holding up to capacity events; serviceURL
+// checks the NIP-98 authorization of lookups
+func newBroadcastLog(capacity int, adminToken string, serviceURL *serviceURLResolver) *broadcastLog {
+	return &broadcastLog{
+		capacity:   capacity,
+		adminToken: adminToken,
+		serviceURL: serviceURL,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Queued records that evt was queued for publishing, starting it over when
+// it is published again
+func (b *broadcastLog) Queued(evt *nostr.Event) {
+	if b == nil || (b.exclude != nil && b.exclude(evt.PubKey)) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recorded++
+	entry := &broadcastEntry{id: evt.ID, pubkey: evt.PubKey, queued: time.Now(), relays: map[string]*broadcastResult{}}
+	if elem, ok := b.entries[evt.ID]; ok {
+		elem.Value = entry
+		b.order.MoveToFront(elem)
+		return
+	}
+	b.entries[evt.ID] = b.order.PushFront(entry)
+	for b.order.Len() > b.capacity {
+		oldest := b.order.Back()
+		b.order.Remove(oldest)
+		delete(b.entries, oldest.Value.(*broadcastEntry).id)
+		b.evicted++
+	}
+}
+
+// SetExclude keeps the events of the pubkeys exclude reports out of the log
+func (b *broadcastLog) SetExclude(exclude func(pubkey string) bool) {
+	b.exclude = exclude
+}
+
+// ForgetPubKey removes the events of pubkey and returns their ids
+func (b *broadcastLog) ForgetPubKey(pubkey string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for elem := b.order.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*broadcastEntry); entry.pubkey == pubkey {
+			ids = append(ids, entry.id)
+			b.order.Remove(elem)
+			delete(b.entries, entry.id)
+		}
+		elem = next
+	}
+	return ids
+}
+
+// Dropped records that event id never left the queue
+func (b *broadcastLog) Dropped(id, reason string) {
+	b.update(id, func(entry *broadcastEntry) {
+		entry.dropped = reason
+		entry.finished = time.Now()
+	})
+}
+
+// Started records the relays event id is being sent to
+func (b *broadcastLog) Started(id string, relays []string, hinted int) {
+	b.update(id, func(entry *broadcastEntry) {
+		now := time.Now()
+		entry.started = now
+		for i, url := range relays {
+			entry.relays[url] = &broadcastResult{relay: url, hint: i >= len(relays)-hinted, status: broadcastPending, updated: now}
+		}
+	})
+}
+
+// Attempt records the outcome of the given attempt to send event id to
+// relay; status is broadcastRetrying while another attempt follows
+func (b *broadcastLog) Attempt(id, relay string, attempt int, status string, err error) {
+	b.update(id, func(entry *broadcastEntry) {
+		res, ok := entry.relays[relay]
+		if !ok {
+			return
+		}
+		res.attempts = attempt
+		res.status = status
+		res.reason = ""
+		if err != nil {
+			res.reason = err.Error()
+		}
+		res.updated = time.Now()
+	})
+}
+
+// Finished records that every relay of event id has answered or given up
+func (b *broadcastLog) Finished(id string) {
+	b.update(id, func(entry *broadcastEntry) {
+		entry.finished = time.Now()
+	})
+}
+
+// update applies fn to the entry of event id, if still logged
+func (b *broadcastLog) update(id string, fn func(*broadcastEntry)) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.entries[id]; ok {
+		fn(elem.Value.(*broadcastEntry))
+	}
+}
+
+// Result returns the results of event id as served by the broadcast status
+// endpoint and whether publishing it is done; ok is false when the event is
+// not logged
+func (b *broadcastLog) Result(id string) (result *jsonlib.JsonObject, done bool, ok bool) {
+	if b == nil {
+		return nil, false, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.entries[id]
+	if !ok {
+		return nil, false, false
+	}
+	entry := elem.Value.(*broadcastEntry)
+	return entry.toJSON(), !entry.finished.IsZero(), true
+}
+
+// HandleBroadcastStatus serves GET /api/v1/events/{id}/broadcast-status to
+// the admin or, authenticated with NIP-98, to the author of the event
+func (b *broadcastLog) HandleBroadcastStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := req.PathValue("id")
+	if !nostr.IsValid32ByteHex(id) {
+		http.Error(w, "invalid event id", http.StatusBadRequest)
+		return
+	}
+	admin := hasAdminToken(req, b.adminToken)
+	var pubkey string
+	if !admin {
+		var err error
+		if pubkey, err = verifyHTTPAuth(req, b.serviceURL, nil); err != nil {
+			b.mu.Lock()
+			b.denied++
+			b.mu.Unlock()
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lookups++
+	elem, ok := b.entries[id]
+	if !ok {
+		http.Error(w, "event not published recently", http.StatusNotFound)
+		return
+	}
+	entry := elem.Value.(*broadcastEntry)
+	if !admin && entry.pubkey != pubkey {
+		b.denied++
+		http.Error(w, "forbidden: only the author can see where an event was sent", http.StatusForbidden)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, entry.toJSON())
+}
+
+// toJSON renders the entry with its relays grouped by status
+func (entry *broadcastEntry) toJSON() *jsonlib.JsonObject {
+	results := make([]*broadcastResult, 0, len(entry.relays))
+	counts := map[string]int{}
+	for _, res := range entry.relays {
+		results = append(results, res)
+		counts[res.status]++
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].status != results[j].status {
+			return results[i].status < results[j].status
+		}
+		return results[i].relay < results[j].relay
+	})
+
+	state := "queued"
+	switch {
+	case !entry.finished.IsZero():
+		state = "done"
+	case !entry.started.IsZero():
+		state = "publishing"
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("id", jsonlib.NewJsonValue(entry.id))
+	obj.Set("state", jsonlib.NewJsonValue(state))
+	obj.Set("queued_at", jsonlib.NewJsonValue(entry.queued.Unix()))
+	if !entry.started.IsZero() {
+		obj.Set("started_at", jsonlib.NewJsonValue(entry.started.Unix()))
+	}
+	if !entry.finished.IsZero() {
+		obj.Set("finished_at", jsonlib.NewJsonValue(entry.finished.Unix()))
+	}
+	if entry.dropped != "" {
+		obj.Set("dropped", jsonlib.NewJsonValue(entry.dropped))
+	}
+
+	summary := jsonlib.NewJsonObject()
+	summary.Set("sent", jsonlib.NewJsonValue(len(results)))
+	summary.Set("accepted", jsonlib.NewJsonValue(counts[broadcastAccepted]+counts[broadcastDuplicate]))
+	summary.Set("rejected", jsonlib.NewJsonValue(counts[broadcastRejected]))
+	summary.Set("failed", jsonlib.NewJsonValue(counts[broadcastFailed]+counts[broadcastCanceled]))
+	summary.Set("pending", jsonlib.NewJsonValue(counts[broadcastPending]+counts[broadcastRetrying]))
+	if counts[broadcastDryRun] > 0 {
+		summary.Set("dry_run", jsonlib.NewJsonValue(counts[broadcastDryRun]))
+	}
+	obj.Set("summary", summary)
+
+	relays := jsonlib.NewJsonList()
+	for _, res := range results {
+		r := jsonlib.NewJsonObject()
+		r.Set("relay", jsonlib.NewJsonValue(res.relay))
+		r.Set("status", jsonlib.NewJsonValue(res.status))
+		r.Set("attempts", jsonlib.NewJsonValue(res.attempts))
+		if res.hint {
+			r.Set("hint", jsonlib.NewJsonValue(true))
+		}
+		if res.reason != "" {
+			r.Set("reason", jsonlib.NewJsonValue(res.reason))
+		}
+		r.Set("updated_at", jsonlib.NewJsonValue(res.updated.Unix()))
+		relays.Append(r)
+	}
+	obj.Set("relays", relays)
+	return obj
+}
+
+// GetStatsName returns the name of this stats provider
+func (b *broadcastLog) GetStatsName() string {
+	return "broadcast_log"
+}
+
+// GetStats returns stats as JsonEntity
+func (b *broadcastLog) GetStats() jsonlib.JsonEntity {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("capacity", jsonlib.NewJsonValue(b.capacity))
+	obj.Set("events", jsonlib.NewJsonValue(b.order.Len()))
+	obj.Set("recorded", jsonlib.NewJsonValue(b.recorded))
+	obj.Set("evicted", jsonlib.NewJsonValue(b.evicted))
+	obj.Set("lookups", jsonlib.NewJsonValue(b.lookups))
+	obj.Set("rejected_requests", jsonlib.NewJsonValue(b.denied))
+	return obj
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Runtime tuning of broadcasting for Espelho de São Miguel.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// maxPublishWorkers bounds the publish workers set through the admin API
+const maxPublishWorkers = 1024
+
+// broadcastRelays returns the top scored relays events are published to
+func (p *publisher) broadcastRelays() []string {
+	m := p.system.GetManager()
+	n := int(atomic.LoadInt64(&p.topN))
+	if p.regions != nil {
+		return p.regions.BroadcastRelays(m, n)
+	}
+	return topScoredRelays(m, n)
+}
+
+// topScoredRelays returns the n relays of m with the best score, ranked like
+// the manager ranks them but with n given per call, so it can change at
+// runtime. Relays never tested are left out.
+func topScoredRelays(m *manager.Manager, n int) []string {
+	type candidate struct {
+		url   string
+		score float64
+	}
+	var candidates []candidate
+	for _, url := range m.GetAllRelays() {
+		info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+		if !ok || info.TotalAttempts == 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{url: url, score: m.CalculateScore(info)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].url < candidates[j].url
+	})
+	urls := make([]string, 0, min(n, len(candidates)))
+	for _, c := range candidates[:min(n, len(candidates))] {
+		urls = append(urls, c.url)
+	}
+	return urls
+}
+
+// SetTopRelays changes how many of the top scored relays each event is
+// published to
+func (p *publisher) SetTopRelays(n int) {
+	atomic.StoreInt64(&p.topN, int64(n))
+}
+
+// SetWorkers resizes the pool of publish workers. New workers start at
+// once; surplus ones exit after the event they are publishing, so no event
+// is abandoned. The queue keeps the capacity it was created with.
+func (p *publisher) SetWorkers(n int) {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	n = max(n, 1)
+	if n < p.workerCount {
+		close(p.shrunk)
+		p.shrunk = make(chan struct{})
+	}
+	p.workerCount = n
+	for p.running < n {
+		p.running++
+		p.wg.Add(1)
+		go p.worker()
+	}
+}
+
+// Workers returns how many publish workers the pool is sized for
+func (p *publisher) Workers() int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return p.workerCount
+}
+
+// retiring tells a worker to exit when more are running than the pool is
+// sized for, and otherwise returns the channel closed when it shrinks
+func (p *publisher) retiring() (chan struct{}, bool) {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	if p.running > p.workerCount {
+		p.running--
+		return nil, true
+	}
+	return p.shrunk, false
+}
+
+// broadcastTuning adjusts the breadth and concurrency of publishing at
+// runtime, e.g. to narrow it during a flood, without a restart that would
+// lose the relay scores. The success rate decay and the initial health
+// check timeout are fixed when the broadcast system is created and are
+// only reported.
+type broadcastTuning struct {
+	pub *publisher
+	cfg *broadcast.Config
+}
+
+// newBroadcastTuning creates the tuning endpoint for pub, whose broadcast
+// system was created with cfg
+func newBroadcastTuning(pub *publisher, cfg *broadcast.Config) *broadcastTuning {
+	return &broadcastTuning{pub: pub, cfg: cfg}
+}
+
+// broadcastTuningRequest is the body accepted by POST
+// /api/v1/admin/broadcast; fields left out are not changed
+type broadcastTuningRequest struct {
+	TopNRelays       *int     `json:"top_n_relays"`
+	WorkerCount      *int     `json:"worker_count"`
+	SuccessRateDecay *float64 `json:"success_rate_decay"`
+	InitialTimeout   *string  `json:"initial_timeout"`
+}
+
+// HandleBroadcast serves GET (inspect) and POST (update) of the broadcast
+// configuration
+func (t *broadcastTuning) HandleBroadcast(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body broadcastTuningRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.SuccessRateDecay != nil || body.InitialTimeout != nil {
+			http.Error(w, "success_rate_decay and initial_timeout cannot be changed at runtime", http.StatusBadRequest)
+			return
+		}
+		if body.TopNRelays != nil && *body.TopNRelays < 1 {
+			http.Error(w, "invalid top_n_relays: must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if body.WorkerCount != nil && (*body.WorkerCount < 1 || *body.WorkerCount > maxPublishWorkers) {
+			http.Error(w, fmt.Sprintf("invalid worker_count: must be between 1 and %d", maxPublishWorkers), http.StatusBadRequest)
+			return
+		}
+		if body.TopNRelays != nil {
+			t.pub.SetTopRelays(*body.TopNRelays)
+		}
+		if body.WorkerCount != nil {
+			t.pub.SetWorkers(*body.WorkerCount)
+		}
+		logging.Info("broadcast configuration changed via admin API: %d top relays, %d workers", atomic.LoadInt64(&t.pub.topN), t.pub.Workers())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("top_n_relays", jsonlib.NewJsonValue(atomic.LoadInt64(&t.pub.topN)))
+	obj.Set("worker_count", jsonlib.NewJsonValue(t.pub.Workers()))
+	obj.Set("queue_capacity", jsonlib.NewJsonValue(cap(t.pub.queue)))
+	obj.Set("success_rate_decay", jsonlib.NewJsonValue(t.cfg.SuccessRateDecay))
+	obj.Set("initial_timeout", jsonlib.NewJsonValue(t.cfg.InitialTimeout.String()))
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
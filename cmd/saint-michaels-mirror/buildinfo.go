@@ -0,0 +1,46 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Build metadata for Espelho de São Miguel.
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// buildInfo describes how the running binary was built
+type buildInfo struct {
+	commit    string
+	date      string
+	modified  bool
+	goVersion string
+}
+
+// readBuildInfo combines the values set at build time with the VCS
+// information stamped by the Go toolchain
+func readBuildInfo() buildInfo {
+	info := buildInfo{commit: Commit, date: BuildDate, goVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.commit == "" {
+				info.commit = setting.Value
+			}
+		case "vcs.time":
+			if info.date == "" {
+				info.date = setting.Value
+			}
+		case "vcs.modified":
+			info.modified = setting.Value == "true"
+		}
+	}
+	return info
+}
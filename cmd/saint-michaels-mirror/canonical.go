@@ -0,0 +1,121 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Canonical event serialization check for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Canonicalization policies
+const (
+	// CanonicalFix lowercases non-canonical fields that do not affect the id
+	CanonicalFix = "fix"
+	// CanonicalReject rejects every non-canonical event
+	CanonicalReject = "reject"
+)
+
+// canonicalCheck re-serializes events before fanout and verifies that what
+// upstreams receive hashes to the event id. khatru checks ids against the
+// event as parsed, but buggy clients send JSON that only round-trips through
+// lenient parsers, e.g. invalid UTF-8 that gets replaced on the way out, so
+// some upstreams reject it and others accept it. Such events are rejected
+// with invalid:. Uppercase hex in the signature is not covered by the id and
+// can be fixed; uppercase hex in the pubkey is, and cannot.
+type canonicalCheck struct {
+	fix bool
+	// stats
+	checked  int64
+	fixed    int64
+	rejected int64
+}
+
+// newCanonicalCheck creates the check for a fix or reject policy
+func newCanonicalCheck(policy string) (*canonicalCheck, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", CanonicalFix:
+		return &canonicalCheck{fix: true}, nil
+	case CanonicalReject:
+		return &canonicalCheck{}, nil
+	}
+	return nil, fmt.Errorf("invalid CANONICAL_POLICY %q: must be fix or reject", policy)
+}
+
+// Apply installs the reject policy
+func (c *canonicalCheck) Apply(r *khatru.Relay) {
+	r.RejectEvent = append(r.RejectEvent, policyRejects.Event("canonical_json", c.RejectEvent))
+}
+
+// RejectEvent rejects events that do not survive re-serialization and fixes
+// or rejects the ones with non-canonical signatures
+func (c *canonicalCheck) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	atomic.AddInt64(&c.checked, 1)
+
+	if reason := canonicalProblem(evt); reason != "" {
+		atomic.AddInt64(&c.rejected, 1)
+		logging.DebugMethod("canonical", "RejectEvent", "event %s: %s", evt.ID, reason)
+		return true, "invalid: " + reason
+	}
+
+	if strings.ToLower(evt.Sig) != evt.Sig {
+		if !c.fix {
+			atomic.AddInt64(&c.rejected, 1)
+			return true, "invalid: signature must be lowercase hex"
+		}
+		evt.Sig = strings.ToLower(evt.Sig)
+		atomic.AddInt64(&c.fixed, 1)
+		logging.DebugMethod("canonical", "RejectEvent", "event %s: lowercased signature", evt.ID)
+	}
+	return false, ""
+}
+
+// canonicalProblem returns why evt is not canonical, or "" if it is
+func canonicalProblem(evt *nostr.Event) string {
+	if strings.ToLower(evt.PubKey) != evt.PubKey {
+		return "pubkey must be lowercase hex"
+	}
+	wire, err := json.Marshal(evt)
+	if err != nil {
+		return "event cannot be serialized"
+	}
+	var back nostr.Event
+	if err := json.Unmarshal(wire, &back); err != nil {
+		return "serialized event cannot be parsed"
+	}
+	if back.ID != evt.ID || !back.CheckID() {
+		return "event id does not match its canonical serialization"
+	}
+	return ""
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *canonicalCheck) GetStatsName() string {
+	return "canonical"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *canonicalCheck) GetStats() jsonlib.JsonEntity {
+	policy := CanonicalReject
+	if c.fix {
+		policy = CanonicalFix
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("policy", jsonlib.NewJsonValue(policy))
+	obj.Set("checked", jsonlib.NewJsonValue(atomic.LoadInt64(&c.checked)))
+	obj.Set("fixed", jsonlib.NewJsonValue(atomic.LoadInt64(&c.fixed)))
+	obj.Set("rejected", jsonlib.NewJsonValue(atomic.LoadInt64(&c.rejected)))
+	return obj
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Fault injection for exercising failure handling in staging for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+)
+
+// Faults that can be injected
+const (
+	// ChaosQueryTimeout makes an upstream query time out
+	ChaosQueryTimeout = "query_timeout"
+	// ChaosSlowEOSE holds back the EOSE of an upstream query
+	ChaosSlowEOSE = "slow_eose"
+	// ChaosPublishFailure fails a publish attempt with a transient error
+	ChaosPublishFailure = "publish_failure"
+	// ChaosPublishTimeout makes a publish attempt time out
+	ChaosPublishTimeout = "publish_timeout"
+	// ChaosMirrorDrop drops the connection to a mirrored relay
+	ChaosMirrorDrop = "mirror_drop"
+)
+
+// chaosFaults lists the faults in the order they are reported
+var chaosFaults = []string{ChaosQueryTimeout, ChaosSlowEOSE, ChaosPublishFailure, ChaosPublishTimeout, ChaosMirrorDrop}
+
+// ChaosMirrorDropInterval is how often each mirrored relay risks having its
+// connection dropped
+const ChaosMirrorDropInterval = 30 * time.Second
+
+// faultInjector simulates upstream failures at configurable rates, so the
+// health states, circuit breakers and retry paths can be exercised in
+// staging without breaking real relays: upstream queries time out or send
+// EOSE late, publish attempts fail or time out, and mirrored relays drop
+// their connections. Each rate is the fraction, 0 to 1, of queries, publish
+// attempts or mirror checks that fail. It only exists in binaries built with
+// the chaos tag, and rates can be changed at runtime through the admin API.
+type faultInjector struct {
+	mu        sync.RWMutex
+	rates     map[string]float64
+	eoseDelay time.Duration
+	// stats
+	injected map[string]int64 // by fault
+}
+
+// newFaultInjector creates the injector with rates, a comma-separated list
+// of fault:rate pairs, e.g. "query_timeout:0.1,mirror_drop:0.05"
+func newFaultInjector(rates string, eoseDelay time.Duration) (*faultInjector, error) {
+	parsed, err := parseFaultRates(rates)
+	if err != nil {
+		return nil, err
+	}
+	f := &faultInjector{rates: parsed, eoseDelay: eoseDelay, injected: map[string]int64{}}
+	if f.active() {
+		logging.Warn("fault injection enabled: %s", f.describe())
+	}
+	return f, nil
+}
+
+// parseFaultRates parses a comma-separated list of fault:rate pairs
+func parseFaultRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, item := range splitList(s) {
+		name, rateStr, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault rate %q: expected fault:rate", item)
+		}
+		name = strings.TrimSpace(name)
+		if !slices.Contains(chaosFaults, name) {
+			return nil, fmt.Errorf("unknown fault %q: must be one of %s", name, strings.Join(chaosFaults, ", "))
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate in %q: must be between 0 and 1", item)
+		}
+		rates[name] = rate
+	}
+	return rates, nil
+}
+
+// inject reports whether fault strikes this time, counting it if so
+func (f *faultInjector) inject(fault string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	rate := f.rates[fault]
+	f.mu.RUnlock()
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	f.mu.Lock()
+	f.injected[fault]++
+	f.mu.Unlock()
+	return true
+}
+
+// QueryFault decides the failure of the next upstream query to url
+func (f *faultInjector) QueryFault(url string) relaystore.QueryFault {
+	if f.inject(ChaosQueryTimeout) {
+		logging.DebugMethod("chaos", "QueryFault", "query to %s times out", url)
+		return relaystore.QueryFault{Timeout: true}
+	}
+	if f.inject(ChaosSlowEOSE) {
+		f.mu.RLock()
+		delay := f.eoseDelay
+		f.mu.RUnlock()
+		logging.DebugMethod("chaos", "QueryFault", "EOSE of %s delayed by %v", url, delay)
+		return relaystore.QueryFault{EOSEDelay: delay}
+	}
+	return relaystore.QueryFault{}
+}
+
+// PublishFault returns the error the next publish attempt to url fails
+// with, waiting out ctx for a timeout, or nil to publish normally. A nil
+// injector never fails.
+func (f *faultInjector) PublishFault(ctx context.Context, url string) error {
+	if f.inject(ChaosPublishTimeout) {
+		logging.DebugMethod("chaos", "PublishFault", "publish to %s times out", url)
+		<-ctx.Done()
+		return fmt.Errorf("error: chaos: injected timeout: %w", ctx.Err())
+	}
+	if f.inject(ChaosPublishFailure) {
+		logging.DebugMethod("chaos", "PublishFault", "publish to %s fails", url)
+		return fmt.Errorf("error: chaos: injected failure: %w", syscall.ECONNRESET)
+	}
+	return nil
+}
+
+// Start drops connections of mm's mirrored relays at the mirror_drop rate
+// every ChaosMirrorDropInterval until ctx is done
+func (f *faultInjector) Start(ctx context.Context, mm *mirror.MirrorManager) {
+	go func() {
+		ticker := time.NewTicker(ChaosMirrorDropInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, url := range mm.Remotes() {
+				if f.inject(ChaosMirrorDrop) && mm.DropConnection(url) {
+					logging.Info("chaos: dropped mirror connection to %s", url)
+				}
+			}
+		}
+	}()
+}
+
+// active reports whether any fault has a positive rate
+func (f *faultInjector) active() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, rate := range f.rates {
+		if rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// describe lists the positive rates for logging
+func (f *faultInjector) describe() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var parts []string
+	for _, fault := range chaosFaults {
+		if rate := f.rates[fault]; rate > 0 {
+			parts = append(parts, fmt.Sprintf("%s:%g", fault, rate))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// chaosRequest is the body accepted by POST /api/v1/admin/chaos
+type chaosRequest struct {
+	Rates     map[string]float64 `json:"rates"`
+	EOSEDelay string             `json:"eose_delay"`
+}
+
+// HandleChaos serves GET (inspect), POST (change the rates given) and
+// DELETE (stop injecting) of fault injection
+func (f *faultInjector) HandleChaos(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body chaosRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for fault, rate := range body.Rates {
+			if !slices.Contains(chaosFaults, fault) {
+				http.Error(w, fmt.Sprintf("unknown fault %q: must be one of %s", fault, strings.Join(chaosFaults, ", ")), http.StatusBadRequest)
+				return
+			}
+			if rate < 0 || rate > 1 {
+				http.Error(w, fmt.Sprintf("invalid rate for %s: must be between 0 and 1", fault), http.StatusBadRequest)
+				return
+			}
+		}
+		var delay time.Duration
+		if body.EOSEDelay != "" {
+			var err error
+			if delay, err = time.ParseDuration(body.EOSEDelay); err != nil || delay < 0 {
+				http.Error(w, "invalid eose_delay", http.StatusBadRequest)
+				return
+			}
+		}
+		f.mu.Lock()
+		for fault, rate := range body.Rates {
+			f.rates[fault] = rate
+		}
+		if body.EOSEDelay != "" {
+			f.eoseDelay = delay
+		}
+		f.mu.Unlock()
+		logging.Warn("fault injection changed through the admin API: %s", f.describe())
+	case http.MethodDelete:
+		f.mu.Lock()
+		f.rates = map[string]float64{}
+		f.mu.Unlock()
+		logging.Info("fault injection stopped through the admin API")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, f.GetStats())
+}
+
+// GetStatsName returns the name of this stats provider
+func (f *faultInjector) GetStatsName() string {
+	return "chaos"
+}
+
+// GetStats returns stats as JsonEntity
+func (f *faultInjector) GetStats() jsonlib.JsonEntity {
+	active := f.active()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rates := jsonlib.NewJsonObject()
+	injected := jsonlib.NewJsonObject()
+	for _, fault := range chaosFaults {
+		rates.Set(fault, jsonlib.NewJsonValue(f.rates[fault]))
+		injected.Set(fault, jsonlib.NewJsonValue(f.injected[fault]))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("active", jsonlib.NewJsonValue(active))
+	obj.Set("rates", rates)
+	obj.Set("eose_delay_seconds", jsonlib.NewJsonValue(f.eoseDelay.Seconds()))
+	obj.Set("injected", injected)
+	return obj
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Fault injection switch for staging builds.
+
+//go:build chaos
+
+package main
+
+// chaosAvailable enables fault injection in binaries built with -tags chaos
+const chaosAvailable = true
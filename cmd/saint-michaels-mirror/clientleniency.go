@@ -0,0 +1,290 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Leniency towards malformed client filters for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Client leniency modes
+const (
+	// LeniencyOff leaves client messages to khatru
+	LeniencyOff = "off"
+	// LeniencyNormalize fixes filters and accepts them
+	LeniencyNormalize = "normalize"
+	// LeniencyReject closes subscriptions with malformed filters with invalid:
+	LeniencyReject = "reject"
+)
+
+// Filter problems fixed or rejected
+const (
+	leniencyExtraFields  = "extra_fields"
+	leniencyUppercaseHex = "uppercase_hex"
+	leniencyStringKinds  = "string_kinds"
+)
+
+// leniencyFields are the filter keys go-nostr knows besides tag keys
+var leniencyFields = map[string]bool{
+	"ids": true, "authors": true, "kinds": true, "since": true, "until": true, "limit": true, "search": true,
+}
+
+// leniencyHexFields are the filter keys holding hex ids and pubkeys
+var leniencyHexFields = []string{"ids", "authors", "#e", "#p"}
+
+// filterProblem is one thing wrong with a client filter
+type filterProblem struct {
+	kind   string
+	reason string
+}
+
+// leniencyConnState holds the connection a handler reads frames of
+type leniencyConnState struct {
+	mu sync.Mutex
+	ws *khatru.WebSocket
+}
+
+// leniencyConnKey is the request context key of a leniencyConnState
+type leniencyConnKey struct{}
+
+// clientLeniency handles filters that are slightly off, as odd clients
+// send: fields no NIP defines, ids and pubkeys in uppercase hex, and kinds
+// given as numeric strings. khatru ignores unknown fields, matches uppercase
+// hex against nothing and refuses string kinds with a NOTICE that names no
+// subscription. REQ and COUNT frames are inspected before khatru reads them
+// and either fixed or answered with a CLOSED invalid: naming the problem, in
+// which case khatru is handed a frame it ignores instead.
+type clientLeniency struct {
+	reject bool
+	// stats
+	mu          sync.Mutex
+	normalized  map[string]int64 // filters by problem
+	rejected    map[string]int64 // subscriptions by problem
+	uninspected int64
+}
+
+// newClientLeniency creates the handler for mode, normalize or reject; off
+// returns nil
+func newClientLeniency(mode string) (*clientLeniency, error) {
+	l := &clientLeniency{normalized: map[string]int64{}, rejected: map[string]int64{}}
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", LeniencyOff:
+		return nil, nil
+	case LeniencyNormalize:
+	case LeniencyReject:
+		l.reject = true
+	default:
+		return nil, fmt.Errorf("invalid CLIENT_LENIENCY %q: must be off, normalize or reject", mode)
+	}
+	return l, nil
+}
+
+// Apply keeps each connection so rejections can be answered on it
+func (l *clientLeniency) Apply(r *khatru.Relay) {
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || ws.Request == nil {
+			return
+		}
+		if state, ok := ws.Request.Context().Value(leniencyConnKey{}).(*leniencyConnState); ok {
+			state.mu.Lock()
+			state.ws = ws
+			state.mu.Unlock()
+		}
+	})
+	action := "normalizing"
+	if l.reject {
+		action = "rejecting"
+	}
+	logging.Info("client leniency: %s malformed filters", action)
+}
+
+// WrapHandler inspects the frames of websocket connections. It must wrap
+// every other handler reading REQ frames, so they see the fixed filters.
+func (l *clientLeniency) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		state := &leniencyConnState{}
+		req = req.WithContext(context.WithValue(req.Context(), leniencyConnKey{}, state))
+		next.ServeHTTP(&frameHijacker{ResponseWriter: w, inspector: frameInspector{
+			inspect: func(msg []byte) []byte { return l.inspect(state, msg) },
+			skipped: func() { atomic.AddInt64(&l.uninspected, 1) },
+		}}, req)
+	})
+}
+
+// inspect returns msg with its filters fixed, a frame khatru ignores when
+// it was rejected, or nil when it is fine
+func (l *clientLeniency) inspect(state *leniencyConnState, msg []byte) []byte {
+	trimmed := bytes.TrimLeft(msg, " \t\r\n")
+	if !bytes.HasPrefix(trimmed, []byte(`["REQ"`)) && !bytes.HasPrefix(trimmed, []byte(`["COUNT"`)) {
+		return nil
+	}
+	var parts []json.RawMessage
+	var id string
+	if err := json.Unmarshal(msg, &parts); err != nil || len(parts) < 3 || json.Unmarshal(parts[1], &id) != nil {
+		// khatru explains what it cannot parse
+		return nil
+	}
+
+	changed := false
+	for i, raw := range parts[2:] {
+		fixed, problems := checkFilter(raw)
+		if len(problems) == 0 {
+			continue
+		}
+		if l.reject {
+			state.mu.Lock()
+			ws := state.ws
+			state.mu.Unlock()
+			if ws == nil {
+				return nil
+			}
+			l.count(l.rejected, problems[:1])
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: fmt.Sprintf("invalid: filter %d: %s", i, problems[0].reason)})
+			logging.DebugMethod("leniency", "inspect", "rejected subscription %s from %s: filter %d: %s", id, khatru.GetIPFromRequest(ws.Request), i, problems[0].reason)
+			return []byte(`["NOTICE",""]`)
+		}
+		l.count(l.normalized, problems)
+		parts[i+2] = fixed
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	out, err := json.Marshal(parts)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// count adds one per kind of problem to counters
+func (l *clientLeniency) count(counters map[string]int64, problems []filterProblem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := map[string]bool{}
+	for _, p := range problems {
+		if !seen[p.kind] {
+			seen[p.kind] = true
+			counters[p.kind]++
+		}
+	}
+}
+
+// checkFilter returns raw with its problems fixed, and the problems. A
+// filter that is not an object is left to khatru.
+func checkFilter(raw json.RawMessage) (json.RawMessage, []filterProblem) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return raw, nil
+	}
+	var problems []filterProblem
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		if !leniencyFields[key] && !strings.HasPrefix(key, "#") && !strings.HasPrefix(key, "&") {
+			problems = append(problems, filterProblem{leniencyExtraFields, fmt.Sprintf("unknown field %q", key)})
+			delete(fields, key)
+		}
+	}
+	for _, key := range leniencyHexFields {
+		var values []string
+		if fields[key] == nil || json.Unmarshal(fields[key], &values) != nil {
+			continue
+		}
+		upper := false
+		for i, v := range values {
+			if lower := strings.ToLower(v); lower != v {
+				if _, err := hex.DecodeString(v); err == nil {
+					values[i] = lower
+					upper = true
+				}
+			}
+		}
+		if upper {
+			problems = append(problems, filterProblem{leniencyUppercaseHex, key + " must be lowercase hex"})
+			fields[key], _ = json.Marshal(values)
+		}
+	}
+	if fields["kinds"] != nil {
+		var kinds []json.RawMessage
+		if json.Unmarshal(fields["kinds"], &kinds) == nil {
+			fixed := false
+			for i, k := range kinds {
+				var s string
+				if json.Unmarshal(k, &s) != nil {
+					continue
+				}
+				n, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil || n < 0 || n > 65535 {
+					continue
+				}
+				if !fixed {
+					problems = append(problems, filterProblem{leniencyStringKinds, fmt.Sprintf("kinds must be numbers, got %q", s)})
+				}
+				kinds[i] = json.RawMessage(strconv.Itoa(n))
+				fixed = true
+			}
+			if fixed {
+				fields["kinds"], _ = json.Marshal(kinds)
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return raw, nil
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return raw, nil
+	}
+	return out, problems
+}
+
+// GetStatsName returns the name of this stats provider
+func (l *clientLeniency) GetStatsName() string {
+	return "client_leniency"
+}
+
+// GetStats returns stats as JsonEntity
+func (l *clientLeniency) GetStats() jsonlib.JsonEntity {
+	mode := LeniencyNormalize
+	if l.reject {
+		mode = LeniencyReject
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	normalized := jsonlib.NewJsonObject()
+	rejected := jsonlib.NewJsonObject()
+	for _, kind := range []string{leniencyExtraFields, leniencyUppercaseHex, leniencyStringKinds} {
+		normalized.Set(kind, jsonlib.NewJsonValue(l.normalized[kind]))
+		rejected.Set(kind, jsonlib.NewJsonValue(l.rejected[kind]))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("mode", jsonlib.NewJsonValue(mode))
+	obj.Set("normalized_filters", normalized)
+	obj.Set("rejected_subscriptions", rejected)
+	obj.Set("uninspected_frames", jsonlib.NewJsonValue(atomic.LoadInt64(&l.uninspected)))
+	return obj
+}
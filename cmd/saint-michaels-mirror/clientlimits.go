@@ -0,0 +1,218 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Per-client query rate and filter limits for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// ClientRateInterval is the interval the filter rates are given per
+const ClientRateInterval = time.Minute
+
+// rateLimiter is a token bucket per key: every call takes a token, and
+// tokensPerInterval tokens are returned every interval, up to maxTokens
+type rateLimiter struct {
+	tokensPerInterval int
+	maxTokens         int
+	mu                sync.Mutex
+	used              map[string]int
+}
+
+// newRateLimiter creates a limiter and starts refilling it every interval
+func newRateLimiter(tokensPerInterval int, interval time.Duration, maxTokens int) *rateLimiter {
+	l := &rateLimiter{
+		tokensPerInterval: tokensPerInterval,
+		maxTokens:         maxTokens,
+		used:              map[string]int{},
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.refill()
+		}
+	}()
+	return l
+}
+
+// refill returns tokensPerInterval tokens to every bucket
+func (l *rateLimiter) refill() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, used := range l.used {
+		if used -= l.tokensPerInterval; used <= 0 {
+			delete(l.used, key)
+		} else {
+			l.used[key] = used
+		}
+	}
+}
+
+// Forget drops the bucket of key, reporting whether there was one
+func (l *rateLimiter) Forget(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.used[key]
+	delete(l.used, key)
+	return ok
+}
+
+// Limited takes a token for key and reports whether none was left
+func (l *rateLimiter) Limited(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.used[key] >= l.maxTokens {
+		return true
+	}
+	l.used[key]++
+	return false
+}
+
+// clientTier is a set of limits applied to a class of clients
+type clientTier struct {
+	name     string
+	rate     *rateLimiter
+	maxLimit int // largest filter limit served, 0 = unlimited
+	// stats
+	filters  int64
+	rejected int64
+	clamped  int64
+}
+
+// clientLimits rate-limits queries and caps filter limits per client.
+// Connections that completed NIP-42 AUTH as a trusted pubkey are keyed on the
+// pubkey and get relaxed limits; everyone else is keyed on the IP address.
+type clientLimits struct {
+	trusted   map[string]bool
+	anonymous *clientTier
+	relaxed   *clientTier
+}
+
+// newClientLimits creates the limits; rates are filters per minute and
+// bursts the number of filters a client may send at once
+func newClientLimits(trustedPubKeys []string, rate, burst, maxLimit, trustedRate, trustedBurst, trustedMaxLimit int) (*clientLimits, error) {
+	trusted := map[string]bool{}
+	for _, pk := range trustedPubKeys {
+		pubkey, err := parsePubKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("trusted pubkeys: %w", err)
+		}
+		trusted[pubkey] = true
+	}
+	c := &clientLimits{
+		trusted: trusted,
+		anonymous: &clientTier{
+			name:     "anonymous",
+			rate:     newRateLimiter(rate, ClientRateInterval, burst),
+			maxLimit: maxLimit,
+		},
+	}
+	if len(trusted) > 0 {
+		c.relaxed = &clientTier{
+			name:     "trusted",
+			rate:     newRateLimiter(trustedRate, ClientRateInterval, trustedBurst),
+			maxLimit: trustedMaxLimit,
+		}
+	}
+	return c, nil
+}
+
+// ForgetPubKey drops the rate limit bucket of pubkey, returning 1 if it had
+// one
+func (c *clientLimits) ForgetPubKey(pubkey string) int {
+	if c.relaxed != nil && c.relaxed.rate.Forget("pubkey:"+pubkey) {
+		return 1
+	}
+	return 0
+}
+
+// Apply installs the filter policies and advertises the anonymous filter
+// limit in NIP-11. Trusted clients are only told apart once they AUTH, so
+// connections should be sent a challenge when there are trusted pubkeys.
+func (c *clientLimits) Apply(r *khatru.Relay) {
+	if c.anonymous.maxLimit > 0 {
+		if r.Info.Limitation == nil {
+			r.Info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		r.Info.Limitation.MaxLimit = c.anonymous.maxLimit
+	}
+	r.RejectFilter = append(r.RejectFilter, policyRejects.Filter("filter_limits", c.RejectFilter))
+	r.OverwriteFilter = append(r.OverwriteFilter, c.OverwriteFilter)
+	if c.relaxed != nil {
+		logging.Info("relaxed query limits for %d trusted pubkeys", len(c.trusted))
+	}
+}
+
+// client returns the tier and rate-limit key of the connection in ctx
+func (c *clientLimits) client(ctx context.Context) (*clientTier, string) {
+	if c.relaxed != nil {
+		if pubkey := khatru.GetAuthed(ctx); pubkey != "" && c.trusted[pubkey] {
+			return c.relaxed, "pubkey:" + pubkey
+		}
+	}
+	return c.anonymous, "ip:" + khatru.GetIP(ctx)
+}
+
+// RejectFilter rate-limits the filters of each client
+func (c *clientLimits) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	tier, key := c.client(ctx)
+	atomic.AddInt64(&tier.filters, 1)
+	if tier.rate.Limited(key) {
+		atomic.AddInt64(&tier.rejected, 1)
+		logging.Warn("%s filter rate limiter: rejected %s", tier.name, key)
+		return true, "rate-limited: there is a bug in the client, no one should be making so many requests"
+	}
+	return false, ""
+}
+
+// OverwriteFilter caps the limit of a filter at the client's maximum
+func (c *clientLimits) OverwriteFilter(ctx context.Context, filter *nostr.Filter) {
+	tier, _ := c.client(ctx)
+	if tier.maxLimit > 0 && (filter.Limit <= 0 || filter.Limit > tier.maxLimit) && !filter.LimitZero {
+		atomic.AddInt64(&tier.clamped, 1)
+		filter.Limit = tier.maxLimit
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *clientLimits) GetStatsName() string {
+	return "client_limits"
+}
+
+// tierStats renders the stats of one tier
+func (t *clientTier) tierStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("filters_per_minute", jsonlib.NewJsonValue(t.rate.tokensPerInterval))
+	obj.Set("burst", jsonlib.NewJsonValue(t.rate.maxTokens))
+	obj.Set("max_limit", jsonlib.NewJsonValue(t.maxLimit))
+	obj.Set("filters", jsonlib.NewJsonValue(atomic.LoadInt64(&t.filters)))
+	obj.Set("rejected", jsonlib.NewJsonValue(atomic.LoadInt64(&t.rejected)))
+	obj.Set("clamped", jsonlib.NewJsonValue(atomic.LoadInt64(&t.clamped)))
+	return obj
+}
+
+// GetStats returns stats as JsonEntity
+func (c *clientLimits) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("trusted_pubkeys", jsonlib.NewJsonValue(len(c.trusted)))
+	obj.Set("anonymous", c.anonymous.tierStats())
+	if c.relaxed != nil {
+		obj.Set("trusted", c.relaxed.tierStats())
+	}
+	return obj
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Clock skew checks for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// ClockCheckTimeout bounds one clock check against every source
+const ClockCheckTimeout = 10 * time.Second
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970
+const ntpEpochOffset = 2208988800
+
+// clockCheck compares the local clock with an NTP server or, without one,
+// with the Date headers of the query remotes' NIP-11 responses. A skewed
+// clock breaks things silently: the mirror subscribes with since set to
+// now, so a clock running ahead misses events, and created_at policies
+// reject good events or accept stale ones. A skew beyond the threshold is
+// logged and turns the health YELLOW.
+type clockCheck struct {
+	ntpServer string
+	remotes   func() []string
+	threshold time.Duration
+	interval  time.Duration
+	client    *http.Client
+	mu        sync.Mutex
+	skew      time.Duration // local clock minus reference time
+	source    string
+	sources   int
+	checked   time.Time
+	lastErr   string
+	// stats
+	checks   int64
+	failures int64
+	warnings int64
+}
+
+// newClockCheck creates a check against ntpServer (host or host:port) or,
+// if it is empty, against the relays returned by remotes
+func newClockCheck(ntpServer string, remotes func() []string, threshold, interval time.Duration) *clockCheck {
+	if ntpServer != "" && !strings.Contains(ntpServer, ":") {
+		ntpServer = net.JoinHostPort(ntpServer, "123")
+	}
+	return &clockCheck{
+		ntpServer: ntpServer,
+		remotes:   remotes,
+		threshold: threshold,
+		interval:  interval,
+		client:    &http.Client{Timeout: ClockCheckTimeout},
+	}
+}
+
+// Start checks right away and then every interval until ctx is done
+func (c *clockCheck) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			c.check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// check measures the skew and warns when it exceeds the threshold
+func (c *clockCheck) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, ClockCheckTimeout)
+	defer cancel()
+	var skew time.Duration
+	var source string
+	var sources int
+	var err error
+	if c.ntpServer != "" {
+		source, sources = "ntp", 1
+		skew, err = c.queryNTP(ctx)
+	} else {
+		source = "http_date"
+		skew, sources, err = c.queryRemotes(ctx)
+	}
+
+	c.mu.Lock()
+	c.checks++
+	c.checked = time.Now()
+	if err != nil {
+		c.failures++
+		c.lastErr = err.Error()
+		c.mu.Unlock()
+		logging.DebugMethod("clockcheck", "check", "clock check failed: %v", err)
+		return
+	}
+	c.lastErr = ""
+	c.skew, c.source, c.sources = skew, source, sources
+	skewed := c.skewed()
+	if skewed {
+		c.warnings++
+	}
+	c.mu.Unlock()
+
+	if skewed {
+		logging.Warn("local clock is %v off (%s), beyond %v: the mirror and created_at policies may misbehave; sync the system clock", skew.Round(time.Millisecond), source, c.threshold)
+	} else {
+		logging.DebugMethod("clockcheck", "check", "local clock skew %v (%s, %d sources)", skew, source, sources)
+	}
+}
+
+// skewed reports whether the last skew exceeds the threshold; c.mu must be
+// held
+func (c *clockCheck) skewed() bool {
+	return c.skew > c.threshold || c.skew < -c.threshold
+}
+
+// queryNTP returns the skew measured with one SNTP (RFC 4330) request
+func (c *clockCheck) queryNTP(ctx context.Context) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.ntpServer)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := make([]byte, 48)
+	req[0] = 0x23 // no leap warning, version 4, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || resp[0]&0x07 != 4 {
+		return 0, errors.New("invalid NTP response")
+	}
+	if resp[1] == 0 {
+		return 0, errors.New("NTP server sent a kiss-o'-death")
+	}
+	serverReceived := ntpTime(resp[32:40])
+	serverSent := ntpTime(resp[40:48])
+	// offset of the server clock relative to ours
+	offset := (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2
+	return -offset, nil
+}
+
+// ntpTime decodes a 64-bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(seconds, fraction*int64(time.Second)>>32)
+}
+
+// queryRemotes returns the median skew against the Date headers of the
+// remotes that answered and how many did. Date headers have a resolution
+// of one second, so skews below that are noise.
+func (c *clockCheck) queryRemotes(ctx context.Context) (time.Duration, int, error) {
+	remotes := c.remotes()
+	if len(remotes) == 0 {
+		return 0, 0, errors.New("no query remotes to compare the clock with")
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	skews := []time.Duration{}
+	var lastErr error
+	for _, url := range remotes {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			skew, err := c.queryDate(ctx, url)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %w", url, err)
+				return
+			}
+			skews = append(skews, skew)
+		}(url)
+	}
+	wg.Wait()
+	if len(skews) == 0 {
+		return 0, 0, lastErr
+	}
+	slices.Sort(skews)
+	return skews[len(skews)/2], len(skews), nil
+}
+
+// queryDate returns the skew against the Date header of the NIP-11 response
+// of the relay at url
+func (c *clockCheck) queryDate(ctx context.Context, url string) (time.Duration, error) {
+	u := url
+	if strings.HasPrefix(u, "ws://") {
+		u = "http://" + strings.TrimPrefix(u, "ws://")
+	} else if strings.HasPrefix(u, "wss://") {
+		u = "https://" + strings.TrimPrefix(u, "wss://")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+	sent := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	received := time.Now()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, errors.New("no Date header")
+	}
+	// the header truncates the server time to the second it was written in,
+	// somewhere between sending the request and getting the answer
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return midpoint.Sub(date.Add(500 * time.Millisecond)), nil
+}
+
+// HealthState is YELLOW while the last skew measured exceeds the threshold
+func (c *clockCheck) HealthState() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.skewed() {
+		return HealthYellow
+	}
+	return HealthGreen
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *clockCheck) GetStatsName() string {
+	return "clock"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *clockCheck) GetStats() jsonlib.JsonEntity {
+	state := c.HealthState()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("health_state", jsonlib.NewJsonValue(state))
+	obj.Set("skew_ms", jsonlib.NewJsonValue(c.skew.Milliseconds()))
+	obj.Set("threshold", jsonlib.NewJsonValue(c.threshold.String()))
+	obj.Set("source", jsonlib.NewJsonValue(c.source))
+	obj.Set("sources", jsonlib.NewJsonValue(c.sources))
+	if !c.checked.IsZero() {
+		obj.Set("checked", jsonlib.NewJsonValue(c.checked.Unix()))
+	}
+	if c.lastErr != "" {
+		obj.Set("last_error", jsonlib.NewJsonValue(c.lastErr))
+	}
+	obj.Set("checks", jsonlib.NewJsonValue(c.checks))
+	obj.Set("failures", jsonlib.NewJsonValue(c.failures))
+	obj.Set("warnings", jsonlib.NewJsonValue(c.warnings))
+	return obj
+}
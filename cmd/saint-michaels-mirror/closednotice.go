@@ -0,0 +1,157 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Client notices about upstream CLOSED messages for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// upstreamClosed is what one query remote closed forwarded queries with
+type upstreamClosed struct {
+	byPrefix   map[string]int64
+	lastReason string
+	lastAt     time.Time
+}
+
+// closedNotices tells clients when a query remote closed the upstream side
+// of their subscription, e.g. with auth-required or rate-limited, so a
+// subscription that yields fewer results says why instead of staying
+// silent. Each subscription gets at most one NOTICE per upstream, starting
+// with the machine-readable flag "upstream-closed:", e.g.
+//
+//	upstream-closed: wss://relay.example.com rate-limited: slow down
+//
+// The reasons are counted per upstream and prefix in the stats either way.
+type closedNotices struct {
+	notify bool
+	mu     sync.Mutex
+	// per connection, the subscription last notified and the upstreams it
+	// was notified about
+	conns     map[*khatru.WebSocket]*closedNoticeState
+	upstreams map[string]*upstreamClosed
+	// stats
+	closed  int64
+	notices int64
+}
+
+// closedNoticeState is what one client connection was notified about
+type closedNoticeState struct {
+	subscription string
+	relays       map[string]bool
+}
+
+// newClosedNotices creates the tracker, sending notices when notify is set
+func newClosedNotices(notify bool) *closedNotices {
+	return &closedNotices{
+		notify:    notify,
+		conns:     map[*khatru.WebSocket]*closedNoticeState{},
+		upstreams: map[string]*upstreamClosed{},
+	}
+}
+
+// Apply forgets client connections when they go away
+func (c *closedNotices) Apply(r *khatru.Relay) {
+	r.OnDisconnect = append(r.OnDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			c.mu.Lock()
+			delete(c.conns, ws)
+			c.mu.Unlock()
+		}
+	})
+}
+
+// Observe records that relayURL closed the forwarded query of ctx with
+// reason and tells the client, once per subscription and upstream
+func (c *closedNotices) Observe(ctx context.Context, relayURL string, reason string) {
+	prefix := relayerrors.Prefix(errors.New(reason))
+	if prefix == "" {
+		prefix = "unknown"
+	}
+	c.mu.Lock()
+	c.closed++
+	up, ok := c.upstreams[relayURL]
+	if !ok {
+		up = &upstreamClosed{byPrefix: map[string]int64{}}
+		c.upstreams[relayURL] = up
+	}
+	up.byPrefix[prefix]++
+	up.lastReason, up.lastAt = reason, time.Now()
+
+	ws := khatru.GetConnection(ctx)
+	if !c.notify || ws == nil || !isExternalQuery(ctx) {
+		c.mu.Unlock()
+		return
+	}
+	id := khatru.GetSubscriptionID(ctx)
+	state, ok := c.conns[ws]
+	if !ok || state.subscription != id {
+		state = &closedNoticeState{subscription: id, relays: map[string]bool{}}
+		c.conns[ws] = state
+	}
+	if state.relays[relayURL] {
+		c.mu.Unlock()
+		return
+	}
+	state.relays[relayURL] = true
+	c.mu.Unlock()
+
+	notice := fmt.Sprintf("upstream-closed: %s %s", relayURL, reason)
+	if err := ws.WriteJSON(nostr.NoticeEnvelope(notice)); err != nil {
+		logging.DebugMethod("closednotice", "Observe", "failed to notify client of %s closing subscription %s: %v", relayURL, id, err)
+		return
+	}
+	c.mu.Lock()
+	c.notices++
+	c.mu.Unlock()
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *closedNotices) GetStatsName() string {
+	return "upstream_closed"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *closedNotices) GetStats() jsonlib.JsonEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	urls := make([]string, 0, len(c.upstreams))
+	for url := range c.upstreams {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	upstreams := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		up := c.upstreams[url]
+		byPrefix := jsonlib.NewJsonObject()
+		for prefix, n := range up.byPrefix {
+			byPrefix.Set(prefix, jsonlib.NewJsonValue(n))
+		}
+		u := jsonlib.NewJsonObject()
+		u.Set("by_prefix", byPrefix)
+		u.Set("last_reason", jsonlib.NewJsonValue(up.lastReason))
+		u.Set("last_at", jsonlib.NewJsonValue(up.lastAt.Unix()))
+		upstreams.Set(url, u)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("notify_clients", jsonlib.NewJsonValue(c.notify))
+	obj.Set("closed", jsonlib.NewJsonValue(c.closed))
+	obj.Set("notices", jsonlib.NewJsonValue(c.notices))
+	obj.Set("upstreams", upstreams)
+	return obj
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Aggregated stats of several mirror instances for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/nostr-lib/stats"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/statsclient"
+)
+
+// ClusterFetchTimeout bounds fetching the stats of one peer
+const ClusterFetchTimeout = 5 * time.Second
+
+// healthRank orders health states from best to worst
+var healthRank = map[string]int{HealthGreen: 0, HealthYellow: 1, "RED": 2}
+
+// clusterStats merges the stats of this instance with those of its peers so
+// an operator of several mirrors can watch the fleet from any node.
+type clusterStats struct {
+	peers []string
+	// stats
+	requests      int64
+	peerFailures  int64
+	lastFetchTook int64 // ms
+}
+
+// newClusterStats creates the aggregator for the given peer base URLs
+func newClusterStats(peers []string) *clusterStats {
+	return &clusterStats{peers: peers}
+}
+
+// clusterNode is the outcome of fetching one node's stats
+type clusterNode struct {
+	url      string
+	sections map[string]jsonlib.JsonEntity
+	err      error
+}
+
+// fetch collects the stats of every peer concurrently
+func (c *clusterStats) fetch(ctx context.Context) []clusterNode {
+	nodes := make([]clusterNode, len(c.peers))
+	var wg sync.WaitGroup
+	for i, peer := range c.peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			nodes[i] = clusterNode{url: peer}
+			fetchCtx, cancel := context.WithTimeout(ctx, ClusterFetchTimeout)
+			defer cancel()
+			peerStats, err := statsclient.New(peer).Fetch(fetchCtx)
+			if err != nil {
+				atomic.AddInt64(&c.peerFailures, 1)
+				logging.DebugMethod("cluster", "fetch", "failed fetching stats of %s: %v", peer, err)
+				nodes[i].err = err
+				return
+			}
+			nodes[i].sections = map[string]jsonlib.JsonEntity{}
+			for name, raw := range peerStats.Sections {
+				if entity, err := jsonlib.Unmarshal(raw); err == nil {
+					nodes[i].sections[name] = entity
+				}
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return nodes
+}
+
+// mergeStats combines two values of the same stat. Numbers are summed, except
+// averages and ratios, which are averaged over the nodes; health states keep
+// the worst; "is_" flags hold only if they hold everywhere and other flags if
+// they hold anywhere. Lists and differing strings are not merged.
+func mergeStats(key string, a, b jsonlib.JsonEntity, n int) jsonlib.JsonEntity {
+	switch av := a.(type) {
+	case *jsonlib.JsonObject:
+		bv, ok := b.(*jsonlib.JsonObject)
+		if !ok {
+			return a
+		}
+		out := jsonlib.NewJsonObject()
+		for _, k := range av.Keys() {
+			out.Set(k, av.GetOrNil(k))
+		}
+		for _, k := range bv.Keys() {
+			if existing, ok := out.Get(k); ok {
+				if merged := mergeStats(k, existing, bv.GetOrNil(k), n); merged != nil {
+					out.Set(k, merged)
+				} else {
+					out.Delete(k)
+				}
+			} else {
+				out.Set(k, bv.GetOrNil(k))
+			}
+		}
+		return out
+	case *jsonlib.JsonValue:
+		bv, ok := b.(*jsonlib.JsonValue)
+		if !ok {
+			return nil
+		}
+		return mergeValues(key, av, bv, n)
+	}
+	return nil
+}
+
+// isAverageStat reports whether a numeric stat is a mean or ratio rather
+// than a total
+func isAverageStat(key string) bool {
+	for _, marker := range []string{"average", "avg", "ewma", "_pct", "rate", "score", "alpha", "decay", "uptime"} {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeValues merges two leaf values; n is the number of nodes already
+// folded into a, used to keep averages as running means
+func mergeValues(key string, a, b *jsonlib.JsonValue, n int) jsonlib.JsonEntity {
+	af, aNum := numericValue(a)
+	bf, bNum := numericValue(b)
+	if aNum && bNum {
+		if isAverageStat(key) {
+			return jsonlib.NewJsonValue((af*float64(n) + bf) / float64(n+1))
+		}
+		if a.GetType() == "int" && b.GetType() == "int" {
+			return jsonlib.NewJsonValue(a.IntVal + b.IntVal)
+		}
+		return jsonlib.NewJsonValue(af + bf)
+	}
+	if a.GetType() == "bool" && b.GetType() == "bool" {
+		if strings.HasPrefix(key, "is_") {
+			return jsonlib.NewJsonValue(a.BoolVal && b.BoolVal)
+		}
+		return jsonlib.NewJsonValue(a.BoolVal || b.BoolVal)
+	}
+	as, aStr := a.GetString()
+	bs, bStr := b.GetString()
+	if aStr && bStr {
+		if ar, ok := healthRank[as]; ok {
+			if br, ok := healthRank[bs]; ok && br > ar {
+				return b
+			}
+			return a
+		}
+		if as == bs {
+			return a
+		}
+	}
+	return nil
+}
+
+// numericValue returns the value of an int or float
+func numericValue(v *jsonlib.JsonValue) (float64, bool) {
+	switch v.GetType() {
+	case "int":
+		return float64(v.IntVal), true
+	case "float":
+		return v.FloatVal, true
+	}
+	return 0, false
+}
+
+// mainHealth returns the main health state of a node's relay section
+func mainHealth(sections map[string]jsonlib.JsonEntity) string {
+	relay, ok := sections["relay"].(*jsonlib.JsonObject)
+	if !ok {
+		return ""
+	}
+	v, ok := relay.GetOrNil("main_health_state").(*jsonlib.JsonValue)
+	if !ok {
+		return ""
+	}
+	state, _ := v.GetString()
+	return state
+}
+
+// HandleCluster serves GET /api/v1/stats/cluster
+func (c *clusterStats) HandleCluster(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddInt64(&c.requests, 1)
+	start := time.Now()
+
+	local := clusterNode{url: "self", sections: map[string]jsonlib.JsonEntity{}}
+	all := stats.GetCollector().GetAllStats()
+	for _, name := range all.Keys() {
+		local.sections[name] = all.GetOrNil(name)
+	}
+	nodes := append([]clusterNode{local}, c.fetch(req.Context())...)
+	atomic.StoreInt64(&c.lastFetchTook, time.Since(start).Milliseconds())
+
+	merged := map[string]jsonlib.JsonEntity{}
+	order := []string{}
+	mergedNodes := map[string]int{}
+	worst := HealthGreen
+	nodeList := jsonlib.NewJsonList()
+	for _, node := range nodes {
+		obj := jsonlib.NewJsonObject()
+		obj.Set("url", jsonlib.NewJsonValue(node.url))
+		if node.err != nil {
+			obj.Set("status", jsonlib.NewJsonValue("unreachable"))
+			obj.Set("error", jsonlib.NewJsonValue(node.err.Error()))
+			// a node we cannot see is at least degraded
+			if healthRank[worst] < healthRank[HealthYellow] {
+				worst = HealthYellow
+			}
+			nodeList.Append(obj)
+			continue
+		}
+		state := mainHealth(node.sections)
+		obj.Set("status", jsonlib.NewJsonValue("ok"))
+		obj.Set("main_health_state", jsonlib.NewJsonValue(state))
+		if rank, ok := healthRank[state]; ok && rank > healthRank[worst] {
+			worst = state
+		}
+		nodeList.Append(obj)
+
+		for name, section := range node.sections {
+			existing, ok := merged[name]
+			if !ok {
+				merged[name] = section
+				order = append(order, name)
+				mergedNodes[name] = 1
+				continue
+			}
+			if result := mergeStats(name, existing, section, mergedNodes[name]); result != nil {
+				merged[name] = result
+			}
+			mergedNodes[name]++
+		}
+	}
+
+	sections := jsonlib.NewJsonObject()
+	for _, name := range order {
+		sections.Set(name, merged[name])
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("schema_version", jsonlib.NewJsonValue(statsclient.SchemaVersion))
+	obj.Set("main_health_state", jsonlib.NewJsonValue(worst))
+	obj.Set("nodes", nodeList)
+	obj.Set("stats", sections)
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *clusterStats) GetStatsName() string {
+	return "cluster"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *clusterStats) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("peers", jsonlib.NewJsonValue(len(c.peers)))
+	obj.Set("requests", jsonlib.NewJsonValue(atomic.LoadInt64(&c.requests)))
+	obj.Set("peer_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&c.peerFailures)))
+	obj.Set("last_fetch_ms", jsonlib.NewJsonValue(atomic.LoadInt64(&c.lastFetchTook)))
+	return obj
+}
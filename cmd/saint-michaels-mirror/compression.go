@@ -0,0 +1,264 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Websocket compression control for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CompressionSampleEvery is how many events are served per event deflated to
+// estimate the compression ratio of the traffic
+const CompressionSampleEvery = 16
+
+// wsCompression controls permessage-deflate (RFC 7692) on client and upstream
+// websockets and estimates the bandwidth it saves. khatru does not negotiate
+// compression unless told to, while go-nostr always offers it to upstreams;
+// compression trades CPU and memory per connection for bandwidth. Savings
+// are estimated from the ratio at which a sample of the events served to
+// clients deflates, applied to the traffic counted by the bandwidth meter;
+// upstreams keeping the deflate context across messages usually do better.
+type wsCompression struct {
+	clients  bool
+	upstream bool
+	bw       *bandwidthMeter
+	mu       sync.Mutex // guards the sampling writer
+	buf      bytes.Buffer
+	fw       *flate.Writer
+	// stats
+	served          int64
+	sampledRaw      int64
+	sampledDeflated int64
+	upgrades        int64
+	offered         int64 // client upgrades offering permessage-deflate
+	compressedConns int64
+	plainConns      int64
+	compressedWire  byteCounter // upstream bytes on compressed connections
+}
+
+// newWSCompression creates the control, enabling compression with clients
+// and upstreams as requested; savings are estimated from the traffic of bw
+func newWSCompression(clients, upstream bool, bw *bandwidthMeter) *wsCompression {
+	c := &wsCompression{clients: clients, upstream: upstream, bw: bw}
+	c.fw, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	return c
+}
+
+// Apply enables compression in r's websocket upgrader if requested, and
+// samples the events r serves
+func (c *wsCompression) Apply(r *khatru.Relay) {
+	if c.clients {
+		if err := enableClientCompression(r); err != nil {
+			logging.Warn("cannot enable client websocket compression: %v", err)
+			c.clients = false
+		}
+	}
+	r.OverwriteResponseEvent = append(r.OverwriteResponseEvent, c.sample)
+}
+
+// enableClientCompression makes khatru's websocket upgrader negotiate
+// permessage-deflate. khatru does not expose the upgrader, which it creates
+// with compression off, so the field is set through reflection.
+func enableClientCompression(r *khatru.Relay) error {
+	field := reflect.ValueOf(r).Elem().FieldByName("upgrader")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(websocket.Upgrader{}) {
+		return errors.New("khatru's websocket upgrader not found")
+	}
+	upgrader := (*websocket.Upgrader)(unsafe.Pointer(field.UnsafeAddr()))
+	upgrader.EnableCompression = true
+	return nil
+}
+
+// WrapHandler counts the client upgrades offering compression
+func (c *wsCompression) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") == "websocket" {
+			atomic.AddInt64(&c.upgrades, 1)
+			if offersDeflate(req.Header) {
+				atomic.AddInt64(&c.offered, 1)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// InstallUpstreamTransport wraps the transport of http.DefaultClient, which
+// go-nostr dials upstream websockets with, to withhold the compression offer
+// when upstream compression is disabled and to count the traffic of
+// connections that negotiated it.
+func (c *wsCompression) InstallUpstreamTransport() {
+	next := http.DefaultClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	http.DefaultClient.Transport = &compressionTransport{next: next, c: c}
+}
+
+// sample deflates one in CompressionSampleEvery served events
+func (c *wsCompression) sample(ctx context.Context, evt *nostr.Event) {
+	if atomic.AddInt64(&c.served, 1)%CompressionSampleEvery != 1 {
+		return
+	}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.buf.Reset()
+	c.fw.Reset(&c.buf)
+	c.fw.Write(data)
+	c.fw.Flush()
+	// permessage-deflate drops the 0x00 0x00 0xff 0xff tail of the flush
+	deflated := c.buf.Len() - 4
+	c.mu.Unlock()
+	atomic.AddInt64(&c.sampledRaw, int64(len(data)))
+	atomic.AddInt64(&c.sampledDeflated, int64(deflated))
+}
+
+// ratio returns the sampled compression ratio, 0 before any sample
+func (c *wsCompression) ratio() float64 {
+	raw, deflated := atomic.LoadInt64(&c.sampledRaw), atomic.LoadInt64(&c.sampledDeflated)
+	if deflated == 0 {
+		return 0
+	}
+	return float64(raw) / float64(deflated)
+}
+
+// offersDeflate reports whether a handshake header offers or accepts
+// permessage-deflate
+func offersDeflate(h http.Header) bool {
+	for _, value := range h.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(value, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionTransport withholds or observes the compression offer of
+// upstream websocket handshakes
+type compressionTransport struct {
+	next http.RoundTripper
+	c    *wsCompression
+}
+
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Upgrade") != "websocket" {
+		return t.next.RoundTrip(req)
+	}
+	if !t.c.upstream {
+		req = req.Clone(req.Context())
+		req.Header.Del("Sec-WebSocket-Extensions")
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	if !offersDeflate(resp.Header) {
+		atomic.AddInt64(&t.c.plainConns, 1)
+		return resp, nil
+	}
+	atomic.AddInt64(&t.c.compressedConns, 1)
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &countingStream{ReadWriteCloser: rwc, counter: &t.c.compressedWire}
+	}
+	return resp, nil
+}
+
+// countingStream counts the bytes of an upgraded connection
+type countingStream struct {
+	io.ReadWriteCloser
+	counter *byteCounter
+}
+
+func (s *countingStream) Read(b []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(b)
+	atomic.AddInt64(&s.counter.in, int64(n))
+	return n, err
+}
+
+func (s *countingStream) Write(b []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(b)
+	atomic.AddInt64(&s.counter.out, int64(n))
+	return n, err
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *wsCompression) GetStatsName() string {
+	return "ws_compression"
+}
+
+// GetStats returns stats as JsonEntity. With compression on, the saved bytes
+// are estimated as what the compressed traffic would have been uncompressed,
+// less what it was; with it off, as what compressing the traffic would save.
+// Small events may not deflate at all, in which case the estimate is negative.
+func (c *wsCompression) GetStats() jsonlib.JsonEntity {
+	ratio := c.ratio()
+	saved := func(compressed bool, n int64) int64 {
+		switch {
+		case ratio == 0:
+			return 0
+		case compressed:
+			return int64(float64(n) * (ratio - 1))
+		}
+		return int64(float64(n) * (1 - 1/ratio))
+	}
+	savedKey := func(compressed bool) string {
+		if compressed {
+			return "estimated_saved_bytes"
+		}
+		return "estimated_saving_if_enabled_bytes"
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("sampled_events", jsonlib.NewJsonValue((atomic.LoadInt64(&c.served)+CompressionSampleEvery-1)/CompressionSampleEvery))
+	obj.Set("estimated_ratio", jsonlib.NewJsonValue(ratio))
+
+	// client traffic is only compressed for clients offering it
+	upgrades, offered := atomic.LoadInt64(&c.upgrades), atomic.LoadInt64(&c.offered)
+	var clientBytes int64
+	if upgrades > 0 {
+		clientBytes = c.bw.ClientBytesOut() * offered / upgrades
+	}
+	clients := jsonlib.NewJsonObject()
+	clients.Set("enabled", jsonlib.NewJsonValue(c.clients))
+	clients.Set("upgrades", jsonlib.NewJsonValue(upgrades))
+	clients.Set("offering_compression", jsonlib.NewJsonValue(offered))
+	clients.Set(savedKey(c.clients), jsonlib.NewJsonValue(saved(c.clients, clientBytes)))
+	obj.Set("clients", clients)
+
+	upstream := jsonlib.NewJsonObject()
+	upstream.Set("enabled", jsonlib.NewJsonValue(c.upstream))
+	upstream.Set("compressed_connections", jsonlib.NewJsonValue(atomic.LoadInt64(&c.compressedConns)))
+	upstream.Set("plain_connections", jsonlib.NewJsonValue(atomic.LoadInt64(&c.plainConns)))
+	if c.upstream {
+		upstream.Set("compressed_bytes_in", jsonlib.NewJsonValue(atomic.LoadInt64(&c.compressedWire.in)))
+		upstream.Set("compressed_bytes_out", jsonlib.NewJsonValue(atomic.LoadInt64(&c.compressedWire.out)))
+		upstream.Set(savedKey(true), jsonlib.NewJsonValue(saved(true, atomic.LoadInt64(&c.compressedWire.in))))
+	} else {
+		upstream.Set(savedKey(false), jsonlib.NewJsonValue(saved(false, c.bw.UpstreamBytesIn())))
+	}
+	obj.Set("upstream", upstream)
+	return obj
+}
@@ -8,7 +8,9 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
 	"strconv"
@@ -16,6 +18,9 @@ import (
 	"time"
 
 	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 // getEnvOr returns the environment variable value or a default if not set
@@ -26,20 +31,243 @@ func getEnvOr(env, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvBoolOr returns the environment variable parsed as a bool or a default if not set or invalid
+func getEnvBoolOr(env string, defaultValue bool) bool {
+	if v := os.Getenv(env); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// getEnvIntOr returns the environment variable parsed as an int or a default if not set or invalid
+func getEnvIntOr(env string, defaultValue int) int {
+	if v := os.Getenv(env); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
+// getEnvDurationOr returns the environment variable parsed as a duration or a default if not set or invalid
+func getEnvDurationOr(env string, defaultValue time.Duration) time.Duration {
+	if v := os.Getenv(env); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// splitList splits a comma-separated list, trimming spaces and dropping empty entries
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseKindRates parses a comma-separated list of kind:rate pairs, e.g.
+// "7:0.1,6:0.5", where rate is the fraction of events of that kind to keep
+func parseKindRates(s string) (map[int]float64, error) {
+	rates := map[int]float64{}
+	for _, item := range splitList(s) {
+		kindStr, rateStr, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid kind rate %q: expected kind:rate", item)
+		}
+		kind, err := strconv.Atoi(strings.TrimSpace(kindStr))
+		if err != nil || kind < 0 {
+			return nil, fmt.Errorf("invalid kind in %q", item)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateStr), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate in %q: must be between 0 and 1", item)
+		}
+		rates[kind] = rate
+	}
+	return rates, nil
+}
+
+// parseTrustTiers parses a comma-separated list of url=tier pairs, e.g.
+// "wss://relay.damus.io=high,wss://relay.example.com=low"
+func parseTrustTiers(s string) (mirror.TrustTiers, error) {
+	tiers := mirror.TrustTiers{}
+	for _, item := range splitList(s) {
+		url, tier, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid trust tier %q: expected url=tier", item)
+		}
+		switch tier = strings.ToLower(strings.TrimSpace(tier)); tier {
+		case mirror.TrustHigh, mirror.TrustNormal, mirror.TrustLow:
+		default:
+			return nil, fmt.Errorf("invalid tier in %q: must be high, normal or low", item)
+		}
+		tiers[nostr.NormalizeURL(strings.TrimSpace(url))] = tier
+	}
+	return tiers, nil
+}
+
+// parseRelayLimits parses a comma-separated list of url=caps pairs, e.g.
+// "wss://x=2rps,wss://y=30rpm/4inflight", where caps are a rate in rps or
+// rpm, a number of attempts in flight, or both separated by a slash
+func parseRelayLimits(s string) (publishLimits, error) {
+	limits := publishLimits{}
+	for _, item := range splitList(s) {
+		url, caps, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid relay limit %q: expected url=caps", item)
+		}
+		var rate float64
+		var inFlight int
+		for _, c := range strings.Split(caps, "/") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			var err error
+			switch {
+			case strings.HasSuffix(c, "rps"):
+				rate, err = strconv.ParseFloat(strings.TrimSuffix(c, "rps"), 64)
+			case strings.HasSuffix(c, "rpm"):
+				rate, err = strconv.ParseFloat(strings.TrimSuffix(c, "rpm"), 64)
+				rate /= 60
+			case strings.HasSuffix(c, "inflight"):
+				inFlight, err = strconv.Atoi(strings.TrimSuffix(c, "inflight"))
+			default:
+				err = errors.New("unknown unit")
+			}
+			if err != nil || rate < 0 || inFlight < 0 {
+				return nil, fmt.Errorf("invalid cap %q in %q: expected <n>rps, <n>rpm or <n>inflight", c, item)
+			}
+		}
+		limits[nostr.NormalizeURL(strings.TrimSpace(url))] = newRelayPublishLimit(rate, inFlight)
+	}
+	return limits, nil
+}
+
+// parseQuotaOverrides parses a comma-separated list of pubkey=caps pairs,
+// e.g. "npub1...=5000events/50mb", where caps are a number of events and a
+// size in bytes, kb or mb, or both separated by a slash; 0 lifts a cap and a
+// cap left out is unlimited
+func parseQuotaOverrides(s string) (map[string]writeQuota, error) {
+	overrides := map[string]writeQuota{}
+	for _, item := range splitList(s) {
+		pk, caps, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota override %q: expected pubkey=caps", item)
+		}
+		pubkey, err := parsePubKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pubkey in %q: %w", item, err)
+		}
+		var quota writeQuota
+		for _, c := range strings.Split(caps, "/") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			var n int64
+			switch {
+			case strings.HasSuffix(c, "events"):
+				n, err = strconv.ParseInt(strings.TrimSuffix(c, "events"), 10, 64)
+				quota.events = n
+			case strings.HasSuffix(c, "kb"):
+				n, err = strconv.ParseInt(strings.TrimSuffix(c, "kb"), 10, 64)
+				quota.bytes = n << 10
+			case strings.HasSuffix(c, "mb"):
+				n, err = strconv.ParseInt(strings.TrimSuffix(c, "mb"), 10, 64)
+				quota.bytes = n << 20
+			case strings.HasSuffix(c, "bytes"):
+				n, err = strconv.ParseInt(strings.TrimSuffix(c, "bytes"), 10, 64)
+				quota.bytes = n
+			default:
+				err = errors.New("unknown unit")
+			}
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid cap %q in %q: expected <n>events, <n>bytes, <n>kb or <n>mb", c, item)
+			}
+		}
+		overrides[pubkey] = quota
+	}
+	return overrides, nil
+}
+
 // Config holds runtime configuration coming from environment and CLI flags.
 type Config struct {
 	Addr         string
 	QueryRemotes []string
 	Verbose      string
 
+	// MirrorRemotes are the relays mirrored to clients; set by the active
+	// profile and defaulting to QueryRemotes
+	MirrorRemotes []string
+
+	// Relay-set profiles
+	RelayProfilesFile string
+	Profile           string
+
+	// AdminToken protects the admin API; empty disables it
+	AdminToken string
+	// ForgetStateFile persists the pubkeys forgotten on request; empty keeps
+	// them in memory
+	ForgetStateFile string
+	// APIKeysFile persists the API keys issued through the admin API; empty
+	// keeps them in memory. APIKeyDefaultRate is the requests per minute of
+	// keys issued without a rate.
+	APIKeysFile       string
+	APIKeyDefaultRate int
+	// ExportMaxEvents caps the events of one export; 0 disables exports.
+	// ExportTimeout bounds how long one export may stream, overriding the
+	// HTTP write timeout for that response
+	ExportMaxEvents int
+	ExportTimeout   time.Duration
+	// QueryEndpointMaxEvents caps the events of one /api/v1/query; 0 disables it
+	QueryEndpointMaxEvents int
+	// ImportMaxEvents caps the events of one import; 0 disables imports
+	ImportMaxEvents int
+	// ImportRate is how many imported events are added per second
+	ImportRate int
+	// EventEndpoint serves POST /api/v1/event; EventEndpointWait is how long
+	// it waits for the broadcast results before answering
+	EventEndpoint     bool
+	EventEndpointWait time.Duration
+	// PinnedEvents are event ids or addresses re-broadcast every
+	// PinnedRebroadcastInterval
+	PinnedEvents              []string
+	PinnedRebroadcastInterval time.Duration
+
+	// StartDegraded starts the relay even when no upstream is reachable
+	StartDegraded bool
+	// InitialConnectDeadline bounds how long startup waits for upstreams to
+	// connect; InitialConnectJitter is the maximum random delay before each
+	// attempt
+	InitialConnectDeadline time.Duration
+	InitialConnectJitter   time.Duration
+	// SharedPool makes queries, mirroring and publishing share upstream
+	// connections
+	SharedPool bool
+
 	RelayServiceURL  string
+	TrustedProxies   []string
 	RelayName        string
 	RelayDescription string
 	RelayContact     string
 	RelaySecKey      string
+	// KeyRotationGrace is how long the previous key answers upstream AUTH
+	// challenges after a rotation
+	KeyRotationGrace time.Duration
 	RelayPubKey      string
 	RelayIcon        string
 	RelayBanner      string
+	// RelayInfoFile is a full or partial NIP-11 document merged over the
+	// generated one
+	RelayInfoFile string
+	// RelayRetentionInfo describes in NIP-11 that nothing is stored here
+	RelayRetentionInfo bool
+	// PolicyFile and TermsFile are Markdown documents served at /policy and
+	// /terms
+	PolicyFile string
+	TermsFile  string
 
 	// Broadcast settings
 	MaxPublishRelays         int
@@ -48,6 +276,301 @@ type Config struct {
 	BroadcastSeedRelays      []string
 	BroadcastMandatoryRelays []string
 	BroadcastRefreshInterval time.Duration
+	// RelayRetireDays retires broadcast relays unreachable for this many
+	// days; 0 disables
+	RelayRetireDays          int
+	RelayQuarantineStateFile string
+	// Limits on how discovery reshapes the broadcast pool; 0 disables each
+	BroadcastPoolMin         int
+	BroadcastPoolMax         int
+	DiscoveryMaxNewRelays    int
+	BroadcastPoolMaxChurn    int // percent of the pool per window
+	BroadcastPoolChurnWindow time.Duration
+	// DiscoveryFollowsPubkey, when set, seeds discovery with the write relays
+	// of the users it follows
+	DiscoveryFollowsPubkey    string
+	DiscoveryFollowsMaxRelays int
+	DiscoveryFollowsMinUsers  int
+	// Countries whose relays are preferred, or required, for broadcasting;
+	// query remotes outside them are asked last
+	PreferredCountries []string
+	RequiredCountries  []string
+	// RelayVetting probes newly discovered relays before they are admitted
+	RelayVetting        bool
+	RelayVettingTimeout time.Duration
+	// RelayAliases keeps one URL of broadcast relays found at several URLs
+	RelayAliases bool
+
+	// DNSRefreshInterval is how often upstream hosts are re-resolved; 0 disables
+	DNSRefreshInterval time.Duration
+
+	// Penalty box settings for upstream connections
+	PenaltyBoxBase      time.Duration
+	PenaltyBoxMax       time.Duration
+	PenaltyBoxThreshold int
+
+	// Publish retry settings
+	PublishRetryAttempts   int
+	PublishRetryBackoff    time.Duration
+	PublishRetryMaxBackoff time.Duration
+	// PublishWindow is how many events each broadcast relay has in flight
+	// on its connection; 0 publishes each event on its own goroutine
+	PublishWindow int
+	// RelayLimits is a url=caps list of publish rate and concurrency caps of
+	// strict relays, parsed by parseRelayLimits
+	RelayLimits string
+	// PublishMaxHintRelays is how many relay hints of an event are added to
+	// its publish targets; 0 disables hints
+	PublishMaxHintRelays int
+	// BroadcastEnrichment lists the stages that add tags to the broadcast
+	// events the mirror can sign (client, proxied_by, d_tag); empty disables
+	BroadcastEnrichment []string
+	// BroadcastClientTag is the value of the client tag added by enrichment
+	BroadcastClientTag string
+	// BroadcastLogSize is how many recently published events keep their
+	// per-relay results; 0 disables
+	BroadcastLogSize int
+
+	// Search settings
+	SearchEnabled bool
+	SearchRemotes []string
+
+	// Websocket settings
+	WSMaxMessageSize int64
+	WSWriteWait      time.Duration
+	WSPongWait       time.Duration
+	WSPingPeriod     time.Duration
+	// WSClientCompression negotiates permessage-deflate with clients
+	WSClientCompression bool
+	// WSUpstreamCompression offers permessage-deflate to upstream relays
+	WSUpstreamCompression bool
+	// Slow consumer detection; a stall of 0 disables it
+	SlowConsumerStall       time.Duration
+	SlowConsumerMaxStalls   int
+	SlowConsumerKeepPercent int
+
+	// Event limits, 0 disables
+	MaxEventSize int
+	MaxEventTags int
+
+	// Daily write quotas per pubkey, 0 disables each cap; QuotaOverrides is
+	// a pubkey=caps list parsed by parseQuotaOverrides and QuotaStateFile
+	// persists the usage of the day
+	QuotaDailyEvents int
+	QuotaDailyBytes  int64
+	QuotaOverrides   string
+	QuotaStateFile   string
+
+	// CanonicalPolicy is what to do with events whose signature is not
+	// canonical: fix or reject
+	CanonicalPolicy string
+
+	// Replay protection: events older than ReplayMaxAgeDays, 0 disables, are
+	// rejected or dropped from publishing unless of an exempt kind
+	ReplayMaxAgeDays  int
+	ReplayPolicy      string
+	ReplayExemptKinds string
+
+	// Duplicate content: notes of DuplicateContentKinds posted more than
+	// DuplicateContentMaxCopies times by one author within
+	// DuplicateContentWindow, 0 disables, are flagged or rejected
+	DuplicateContentWindow    time.Duration
+	DuplicateContentMaxCopies int
+	DuplicateContentPolicy    string
+	DuplicateContentKinds     string
+
+	// Fault injection, only honored by binaries built with -tags chaos
+	ChaosFaults    string
+	ChaosEOSEDelay time.Duration
+
+	// MirrorSampleRates is a kind:rate list of the fraction of mirrored events
+	// of each kind rebroadcast to clients, e.g. "7:0.1"
+	MirrorSampleRates string
+	// MirrorKindsWindow is the window of the mirrored kind histogram; 0 disables it
+	MirrorKindsWindow time.Duration
+
+	// RelayTrustTiers is a url=tier list of the trust tier (high, normal or
+	// low) of upstream relays; events mirrored from low-trust relays are
+	// rebroadcast only once RelayTrustLowQuorum relays delivered them
+	RelayTrustTiers     string
+	RelayTrustLowQuorum int
+	RelayTrustLowWindow time.Duration
+
+	// QueryHedgeDelay, when positive, queries the slower half of the query
+	// remotes only if the faster half has not answered within this delay
+	QueryHedgeDelay time.Duration
+
+	// QueryDeadline is how long client queries wait for the query remotes
+	// before they are answered with what arrived; QueryPartialNotices tells
+	// clients when their results were cut off by it
+	QueryDeadline       time.Duration
+	QueryPartialNotices bool
+
+	// QueryRoutesFile is a JSON list of rules restricting which upstreams
+	// receive which filter shapes; empty sends every filter to every query
+	// remote
+	QueryRoutesFile string
+
+	// QueryQuorum is the number of distinct upstreams that must return an event
+	// before it is served; 0 or 1 disables (clients may still ask per filter)
+	QueryQuorum int
+
+	// ShadowRemotes are candidate upstreams that get a copy of ShadowPercent
+	// percent of client queries, to evaluate them without serving their events
+	ShadowRemotes []string
+	ShadowPercent int
+
+	// MaxUpstreamSubscriptions caps the client queries forwarded upstream at
+	// once, evicting the least recently active one beyond it; 0 disables
+	MaxUpstreamSubscriptions int
+
+	// UpstreamSubMaxEvents, UpstreamSubMaxBytes and UpstreamSubMaxDuration
+	// close an upstream subscription of a forwarded query once exceeded; 0
+	// disables each
+	UpstreamSubMaxEvents   int
+	UpstreamSubMaxBytes    int64
+	UpstreamSubMaxDuration time.Duration
+
+	// DemotionThreshold is how many consecutive rejected queries or malformed
+	// NIP-11 probes demote a query remote; 0 disables demotion
+	DemotionThreshold     int
+	DemotionProbeInterval time.Duration
+
+	// AndTagFilters emulates NIP-119 AND tag filters ("&t")
+	AndTagFilters bool
+	// ClientLeniency is what to do with slightly malformed client filters:
+	// off, normalize or reject
+	ClientLeniency string
+
+	// HealthNotices sends clients a NOTICE when upstream health degrades
+	HealthNotices bool
+	// UpstreamClosedNotices forwards upstream CLOSED reasons to clients as NOTICEs
+	UpstreamClosedNotices bool
+
+	// ProvenanceCacheSize is how many recently seen events keep their upstream sources; 0 disables
+	ProvenanceCacheSize int
+
+	// Maintenance mode: MaintenanceSchedule lists recurring UTC windows such as
+	// "02:00-04:00" or "Sun 01:00-03:00"; MaintenanceEnabled starts in maintenance
+	MaintenanceSchedule string
+	MaintenanceEnabled  bool
+
+	// DryRun routes published and mirrored events as usual but only logs
+	// where they would have been sent
+	DryRun bool
+
+	// Paid access: when PaymentRequired only admitted pubkeys may publish
+	PaymentRequired          bool
+	PaymentsURL              string
+	AdmissionPubKeys         []string
+	AdmissionDefaultDuration time.Duration
+	AdmissionWebhookSecret   string
+	AdmissionStateFile       string
+
+	// Lightning-paid write access through an LNbits wallet; empty URL disables
+	LNbitsURL        string
+	LNbitsInvoiceKey string
+	AdmissionPrice   int64
+	// invoices per hour one IP or pubkey may request, and the most unpaid
+	// invoices held at once
+	InvoiceRate       int
+	InvoiceMaxPending int
+
+	// Push-based metrics export: statsd://host:port or graphite://host:port
+	MetricsExportURL      string
+	MetricsExportPrefix   string
+	MetricsExportInterval time.Duration
+
+	// InfluxDB line-protocol sink: an http(s) write URL or a file path
+	InfluxSink        string
+	InfluxToken       string
+	InfluxMeasurement string
+	InfluxInterval    time.Duration
+
+	// Release checks: UpdateCheck reads the latest release announced by
+	// UpdateCheckPubKey on UpdateCheckRelays every UpdateCheckInterval
+	UpdateCheck         bool
+	UpdateCheckRelays   []string
+	UpdateCheckPubKey   string
+	UpdateCheckInterval time.Duration
+
+	// Remote configuration: NIP-78 documents signed by RemoteConfigPubKey on
+	// RemoteConfigRelays, read every RemoteConfigInterval
+	RemoteConfigRelays   []string
+	RemoteConfigPubKey   string
+	RemoteConfigInterval time.Duration
+
+	// Clock checks: every ClockCheckInterval the local clock is compared with
+	// ClockNTPServer, or the Date headers of the query remotes without one
+	ClockCheckInterval time.Duration
+	ClockNTPServer     string
+	ClockSkewThreshold time.Duration
+
+	// Operator digest: every DigestInterval a summary is logged and, with
+	// DigestAdminPubkey, sent to the admin as a direct message
+	DigestInterval    time.Duration
+	DigestAdminPubkey string
+
+	// Profiling snapshots: goroutine and heap profiles written to ProfilingDir
+	// when health degrades, at most once per ProfilingCooldown, keeping the
+	// newest ProfilingMaxSnapshots
+	ProfilingDir          string
+	ProfilingMaxSnapshots int
+	ProfilingCooldown     time.Duration
+
+	// FederatedStatsPeers are base URLs of other mirror instances whose stats
+	// are merged into /api/v1/stats/cluster
+	FederatedStatsPeers []string
+
+	// Coordinator election: of the instances in CoordinatorPeers, the live
+	// one with the lowest InstanceID runs mirroring and broadcast discovery
+	CoordinatorPeers    []string
+	InstanceID          string
+	CoordinatorInterval time.Duration
+
+	// Per-client query limits: rates are filters per minute, bursts the
+	// filters a client may send at once and max limits cap the filter limit
+	// (0 = unlimited). Clients that AUTH as a TrustedPubKeys get the relaxed
+	// Trusted* limits.
+	FilterRate            int
+	FilterBurst           int
+	FilterMaxLimit        int
+	TrustedPubKeys        []string
+	TrustedFilterRate     int
+	TrustedFilterBurst    int
+	TrustedFilterMaxLimit int
+
+	// Mode restricts the relay to reads (read), writes (write) or neither
+	// (readwrite)
+	Mode string
+
+	// Members-only reads: when RestrictedReads only MemberPubKeys (or any
+	// authenticated pubkey without members) may query
+	RestrictedReads bool
+	MemberPubKeys   []string
+
+	// NIP-42 AUTH flow: whether to challenge on connect (auto, always or
+	// never), how long challenges last, whether AUTH may upgrade the
+	// access of a connection with open subscriptions and whether AUTH
+	// outcomes are counted
+	AuthChallengeOnConnect  string
+	AuthChallengeTTL        time.Duration
+	AuthDuringSubscriptions bool
+	AuthOutcomeStats        bool
+
+	// HTTP server settings
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+
+	// Restart settings
+	UpgradeDrainTimeout time.Duration
+	PIDFile             string
+	ShutdownTimeout     time.Duration
+
+	// HTTP API settings
+	CORSAllowedOrigins []string
+	StaticCacheMaxAge  time.Duration
 }
 
 // LoadConfig reads environment variables and flags. Flags override env values.
@@ -64,15 +587,39 @@ func LoadConfig() *Config {
 	queryRemotes := flag.String("query-remotes", envQueryRemotes, "comma-separated list of remote relay URLs to use for queries/subscriptions (env: QUERY_REMOTES)")
 	verbose := flag.String("verbose", envVerbose, "verbose logging control: '1'/'true' for all, 'relaystore' for module, 'relaystore.QueryEvents,mirror' for specific methods (env: VERBOSE)")
 
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required by /api/v1/admin/* endpoints; admin API is disabled when empty (env: ADMIN_TOKEN)")
+	forgetStateFile := flag.String("forget-state-file", os.Getenv("FORGET_STATE_FILE"), "JSON file where the hashes of pubkeys forgotten through the admin API are persisted; empty keeps them in memory (env: FORGET_STATE_FILE)")
+	apiKeysFile := flag.String("api-keys-file", os.Getenv("API_KEYS_FILE"), "JSON file where the API keys issued through the admin API are persisted, hashed; empty keeps them in memory (env: API_KEYS_FILE)")
+	apiKeyDefaultRate := flag.Int("api-key-default-rate", getEnvIntOr("API_KEY_DEFAULT_RATE", 60), "requests per minute allowed to API keys issued without a rate (env: API_KEY_DEFAULT_RATE)")
+	exportMaxEvents := flag.Int("export-max-events", getEnvIntOr("EXPORT_MAX_EVENTS", 0), "maximum events per /api/v1/export download, authenticated with NIP-98; 0, the default, disables exports (env: EXPORT_MAX_EVENTS)")
+	exportTimeout := flag.Duration("export-timeout", getEnvDurationOr("EXPORT_TIMEOUT", 10*time.Minute), "how long one /api/v1/export download may stream before it is cut; it replaces HTTP_WRITE_TIMEOUT for exports (env: EXPORT_TIMEOUT)")
+	queryEndpointMaxEvents := flag.Int("query-endpoint-max-events", getEnvIntOr("QUERY_ENDPOINT_MAX_EVENTS", 500), "maximum events returned by GET /api/v1/query, whatever the filter's limit; 0 disables the endpoint (env: QUERY_ENDPOINT_MAX_EVENTS)")
+	importMaxEvents := flag.Int("import-max-events", getEnvIntOr("IMPORT_MAX_EVENTS", 0), "maximum events per /api/v1/import upload, authenticated with NIP-98; 0, the default, disables imports (env: IMPORT_MAX_EVENTS)")
+	importRate := flag.Int("import-rate", getEnvIntOr("IMPORT_RATE", 10), "events per second added and broadcast by /api/v1/import; 0 means unpaced (env: IMPORT_RATE)")
+	eventEndpoint := flag.Bool("event-endpoint", getEnvBoolOr("EVENT_ENDPOINT", false), "accept signed events over HTTP with POST /api/v1/event (env: EVENT_ENDPOINT)")
+	eventEndpointWait := flag.Duration("event-endpoint-wait", getEnvDurationOr("EVENT_ENDPOINT_WAIT", 10*time.Second), "how long POST /api/v1/event waits for upstream relays to answer before responding (env: EVENT_ENDPOINT_WAIT)")
+	pinnedEvents := flag.String("pinned-events", os.Getenv("PINNED_EVENTS"), "comma-separated event ids (hex, note, nevent) or addresses (naddr, kind:pubkey:d) periodically re-fetched and re-broadcast (env: PINNED_EVENTS)")
+	pinnedRebroadcastInterval := flag.Duration("pinned-rebroadcast-interval", getEnvDurationOr("PINNED_REBROADCAST_INTERVAL", DefaultPinnedRebroadcastInterval), "interval between re-broadcasts of pinned events (env: PINNED_REBROADCAST_INTERVAL)")
+	startDegraded := flag.Bool("start-degraded", getEnvBoolOr("START_DEGRADED", false), "start with RED health and keep retrying when no query remote is reachable, instead of exiting (env: START_DEGRADED)")
+	initialConnectDeadline := flag.Duration("initial-connect-deadline", getEnvDurationOr("INITIAL_CONNECT_DEADLINE", mirror.DefaultInitialConnectDeadline), "how long startup waits for upstream relays to connect before deferring the rest to lazy reconnect (env: INITIAL_CONNECT_DEADLINE)")
+	initialConnectJitter := flag.Duration("initial-connect-jitter", getEnvDurationOr("INITIAL_CONNECT_JITTER", mirror.DefaultInitialConnectJitter), "maximum random delay before each initial upstream connection attempt, to stagger them (env: INITIAL_CONNECT_JITTER)")
+	sharedPool := flag.Bool("shared-pool", getEnvBoolOr("SHARED_POOL", true), "share one connection per upstream relay between queries, counts, search, quorum queries, mirroring and publishing (env: SHARED_POOL)")
+
 	// Relay identity settings
 	relayServiceURL := flag.String("relay-service-url", os.Getenv("RELAY_SERVICE_URL"), "service URL for relay (env: RELAY_SERVICE_URL)")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "comma-separated IPs/CIDRs whose X-Forwarded-Host/Proto headers are trusted when detecting the service URL; defaults to loopback and private networks (env: TRUSTED_PROXIES)")
 	relayName := flag.String("relay-name", os.Getenv("RELAY_NAME"), "relay name (env: RELAY_NAME)")
 	relayDescription := flag.String("relay-description", os.Getenv("RELAY_DESCRIPTION"), "relay description (env: RELAY_DESCRIPTION)")
 	relayContact := flag.String("relay-contact", os.Getenv("RELAY_CONTACT"), "relay contact (env: RELAY_CONTACT)")
 	relaySecKey := flag.String("relay-seckey", os.Getenv("RELAY_SECKEY"), "relay secret key (env: RELAY_SECKEY)")
+	keyRotationGrace := flag.Duration("key-rotation-grace", getEnvDurationOr("KEY_ROTATION_GRACE", DefaultKeyRotationGrace), "how long the previous relay key keeps answering upstream AUTH challenges after a rotation via the admin API (env: KEY_ROTATION_GRACE)")
 	relayPubKey := flag.String("relay-pubkey", os.Getenv("RELAY_PUBKEY"), "relay public key (env: RELAY_PUBKEY)")
 	relayIcon := flag.String("relay-icon", os.Getenv("RELAY_ICON"), "relay icon URL (env: RELAY_ICON)")
 	relayBanner := flag.String("relay-banner", os.Getenv("RELAY_BANNER"), "relay banner URL (env: RELAY_BANNER)")
+	policyFile := flag.String("policy-file", os.Getenv("POLICY_FILE"), "Markdown file served as the posting policy at /policy (env: POLICY_FILE)")
+	termsFile := flag.String("terms-file", os.Getenv("TERMS_FILE"), "Markdown file served as the terms of service at /terms (env: TERMS_FILE)")
+	relayInfoFile := flag.String("relay-info-file", os.Getenv("RELAY_INFO_FILE"), "JSON file with a full or partial NIP-11 document merged over the generated one (env: RELAY_INFO_FILE)")
+	relayRetentionInfo := flag.Bool("relay-retention-info", getEnvBoolOr("RELAY_RETENTION_INFO", true), "describe in the NIP-11 retention section that events are passed through to upstream relays and not stored here (env: RELAY_RETENTION_INFO)")
 
 	// Broadcast settings
 	envMaxPublishRelays := os.Getenv("MAX_PUBLISH_RELAYS")
@@ -104,7 +651,238 @@ func LoadConfig() *Config {
 		// Default to 24 hours if parsing fails
 		refreshIntervalVal = 24 * time.Hour
 	}
-	broadcastRefreshInterval := flag.Duration("broadcast-refresh-interval", refreshIntervalVal, "interval for periodic relay discovery refresh (env: BROADCAST_REFRESH_INTERVAL)")
+	broadcastRefreshInterval := flag.Duration("broadcast-refresh-interval", refreshIntervalVal, "interval for periodic relay discovery refresh, 0 to disable (env: BROADCAST_REFRESH_INTERVAL)")
+	relayRetireDays := flag.Int("relay-retire-days", getEnvIntOr("RELAY_RETIRE_DAYS", 0), "retire discovered broadcast relays that have been unreachable for this many days; 0, the default, disables (env: RELAY_RETIRE_DAYS)")
+	relayQuarantineStateFile := flag.String("relay-quarantine-state-file", os.Getenv("RELAY_QUARANTINE_STATE_FILE"), "JSON file where quarantined and retired broadcast relays are persisted; empty keeps them in memory (env: RELAY_QUARANTINE_STATE_FILE)")
+	broadcastPoolMin := flag.Int("broadcast-pool-min", getEnvIntOr("BROADCAST_POOL_MIN", 10), "discovered broadcast relays always admitted, and never retired below; 0 disables (env: BROADCAST_POOL_MIN)")
+	broadcastPoolMax := flag.Int("broadcast-pool-max", getEnvIntOr("BROADCAST_POOL_MAX", 0), "maximum discovered broadcast relays; 0 disables (env: BROADCAST_POOL_MAX)")
+	discoveryMaxNewRelays := flag.Int("discovery-max-new-relays", getEnvIntOr("DISCOVERY_MAX_NEW_RELAYS", 50), "maximum relays one discovery run may add to an existing broadcast pool; 0 disables (env: DISCOVERY_MAX_NEW_RELAYS)")
+	broadcastPoolMaxChurn := flag.Int("broadcast-pool-max-churn", getEnvIntOr("BROADCAST_POOL_MAX_CHURN", 50), "maximum relays added to or retired from the broadcast pool per churn window, in percent of its size; 0 disables (env: BROADCAST_POOL_MAX_CHURN)")
+	broadcastPoolChurnWindow := flag.Duration("broadcast-pool-churn-window", getEnvDurationOr("BROADCAST_POOL_CHURN_WINDOW", 24*time.Hour), "window over which broadcast pool churn is limited (env: BROADCAST_POOL_CHURN_WINDOW)")
+	discoveryFollowsPubkey := flag.String("discovery-follows-pubkey", os.Getenv("DISCOVERY_FOLLOWS_PUBKEY"), "npub or hex pubkey whose contacts' NIP-65 write relays seed broadcast discovery, most used first (env: DISCOVERY_FOLLOWS_PUBKEY)")
+	discoveryFollowsMaxRelays := flag.Int("discovery-follows-max-relays", getEnvIntOr("DISCOVERY_FOLLOWS_MAX_RELAYS", 30), "maximum relays of followed users added as discovery seeds; 0 disables the limit (env: DISCOVERY_FOLLOWS_MAX_RELAYS)")
+	discoveryFollowsMinUsers := flag.Int("discovery-follows-min-users", getEnvIntOr("DISCOVERY_FOLLOWS_MIN_USERS", 2), "minimum followed users writing to a relay for it to be added as a discovery seed (env: DISCOVERY_FOLLOWS_MIN_USERS)")
+	preferredCountries := flag.String("preferred-countries", os.Getenv("PREFERRED_COUNTRIES"), "comma-separated ISO country codes (NIP-11 relay_countries) whose relays are preferred as broadcast targets and queried first (env: PREFERRED_COUNTRIES)")
+	requiredCountries := flag.String("required-countries", os.Getenv("REQUIRED_COUNTRIES"), "comma-separated ISO country codes (NIP-11 relay_countries); only discovered relays in them are broadcast to, and query remotes elsewhere are queried last (env: REQUIRED_COUNTRIES)")
+	relayVetting := flag.Bool("relay-vetting", getEnvBoolOr("RELAY_VETTING", false), "check the NIP-11 document of newly discovered broadcast relays and publish a throwaway test event before admitting them (env: RELAY_VETTING)")
+	relayAliases := flag.Bool("relay-aliases", getEnvBoolOr("RELAY_ALIASES", true), "drop discovered broadcast relays whose NIP-11 document identifies them as another relay of the pool reached at a different URL (env: RELAY_ALIASES)")
+	relayVettingTimeout := flag.Duration("relay-vetting-timeout", getEnvDurationOr("RELAY_VETTING_TIMEOUT", 10*time.Second), "time a relay has to answer vetting (env: RELAY_VETTING_TIMEOUT)")
+
+	// DNS settings
+	dnsRefreshInterval := flag.Duration("dns-refresh-interval", getEnvDurationOr("DNS_REFRESH_INTERVAL", 5*time.Minute), "how often upstream relay hosts are re-resolved; connections are reopened when the resolved addresses change, 0 disables (env: DNS_REFRESH_INTERVAL)")
+
+	// Penalty box settings
+	penaltyBoxBase := flag.Duration("penalty-box-base", getEnvDurationOr("PENALTY_BOX_BASE", 30*time.Second), "how long an upstream that failed to connect is skipped, doubled for each further consecutive failure (env: PENALTY_BOX_BASE)")
+	penaltyBoxMax := flag.Duration("penalty-box-max", getEnvDurationOr("PENALTY_BOX_MAX", 10*time.Minute), "maximum time an upstream stays in the penalty box (env: PENALTY_BOX_MAX)")
+	penaltyBoxThreshold := flag.Int("penalty-box-threshold", getEnvIntOr("PENALTY_BOX_THRESHOLD", 1), "consecutive connection failures before an upstream is penalized (env: PENALTY_BOX_THRESHOLD)")
+
+	// Publish retry settings
+	publishRetryAttempts := flag.Int("publish-retry-attempts", getEnvIntOr("PUBLISH_RETRY_ATTEMPTS", 3), "attempts per relay for publishes failing with transient errors (timeouts, resets, rate-limited); permanent rejections are not retried (env: PUBLISH_RETRY_ATTEMPTS)")
+	publishRetryBackoff := flag.Duration("publish-retry-backoff", getEnvDurationOr("PUBLISH_RETRY_BACKOFF", time.Second), "initial backoff between publish retries, doubled after each attempt (env: PUBLISH_RETRY_BACKOFF)")
+	publishRetryMaxBackoff := flag.Duration("publish-retry-max-backoff", getEnvDurationOr("PUBLISH_RETRY_MAX_BACKOFF", 30*time.Second), "maximum backoff between publish retries, also caps retry-after hints (env: PUBLISH_RETRY_MAX_BACKOFF)")
+	publishWindow := flag.Int("publish-window", getEnvIntOr("PUBLISH_WINDOW", 16), "events pipelined to each broadcast relay over its connection, awaiting their OK at once; 0 publishes each event to each relay on its own goroutine (env: PUBLISH_WINDOW)")
+	relayLimits := flag.String("relay-limits", os.Getenv("RELAY_LIMITS"), "comma-separated url=caps publish caps for relays that rate-limit, caps being <n>rps, <n>rpm and/or <n>inflight joined by '/', e.g. wss://x=2rps,wss://y=30rpm/2inflight (env: RELAY_LIMITS)")
+	publishMaxHintRelays := flag.Int("publish-max-hint-relays", getEnvIntOr("PUBLISH_MAX_HINT_RELAYS", 5), "relay hints of an event (e/p/a/q tag hints, relays tags, NIP-65 lists) also published to, per event; 0 disables (env: PUBLISH_MAX_HINT_RELAYS)")
+	broadcastEnrichment := flag.String("broadcast-enrichment", os.Getenv("BROADCAST_ENRICHMENT"), "comma-separated stages adding tags to broadcast events signed by the relay key: client, proxied_by, d_tag; empty disables (env: BROADCAST_ENRICHMENT)")
+	broadcastClientTag := flag.String("broadcast-client-tag", getEnvOr("BROADCAST_CLIENT_TAG", ProjectName), "value of the client tag added by the client enrichment stage (env: BROADCAST_CLIENT_TAG)")
+	broadcastLogSize := flag.Int("broadcast-log-size", getEnvIntOr("BROADCAST_LOG_SIZE", 1000), "number of recently published events whose per-relay results are kept for the broadcast status API, 0 to disable (env: BROADCAST_LOG_SIZE)")
+
+	// Search settings
+	searchEnabled := flag.Bool("search-enabled", getEnvBoolOr("SEARCH_ENABLED", false), "enable NIP-50 search aggregation across upstreams (env: SEARCH_ENABLED)")
+	searchRemotes := flag.String("search-remotes", os.Getenv("SEARCH_REMOTES"), "comma-separated list of NIP-50 relays to search; defaults to query remotes advertising NIP-50 (env: SEARCH_REMOTES)")
+
+	// Websocket settings (defaults match khatru)
+	wsMaxMessageSize := flag.Int64("ws-max-message-size", int64(getEnvIntOr("WS_MAX_MESSAGE_SIZE", 512000)), "maximum size in bytes of a message read from a client websocket (env: WS_MAX_MESSAGE_SIZE)")
+	wsWriteWait := flag.Duration("ws-write-wait", getEnvDurationOr("WS_WRITE_WAIT", 10*time.Second), "time allowed to write a message to a client websocket (env: WS_WRITE_WAIT)")
+	wsPongWait := flag.Duration("ws-pong-wait", getEnvDurationOr("WS_PONG_WAIT", 60*time.Second), "time allowed to read the next pong from a client before disconnecting (env: WS_PONG_WAIT)")
+	wsPingPeriod := flag.Duration("ws-ping-period", getEnvDurationOr("WS_PING_PERIOD", 30*time.Second), "interval between pings sent to clients, must be less than ws-pong-wait (env: WS_PING_PERIOD)")
+	wsClientCompression := flag.Bool("ws-client-compression", getEnvBoolOr("WS_CLIENT_COMPRESSION", false), "negotiate permessage-deflate with clients that offer it (env: WS_CLIENT_COMPRESSION)")
+	wsUpstreamCompression := flag.Bool("ws-upstream-compression", getEnvBoolOr("WS_UPSTREAM_COMPRESSION", true), "offer permessage-deflate to upstream relays (env: WS_UPSTREAM_COMPRESSION)")
+	slowConsumerStall := flag.Duration("slow-consumer-stall", getEnvDurationOr("SLOW_CONSUMER_STALL", 2*time.Second), "time a write to a client may block before the client counts as slow, 0 disables slow consumer detection (env: SLOW_CONSUMER_STALL)")
+	slowConsumerMaxStalls := flag.Int("slow-consumer-max-stalls", getEnvIntOr("SLOW_CONSUMER_MAX_STALLS", 10), "stalled writes after which a slow client is disconnected, 0 only disconnects on write timeouts (env: SLOW_CONSUMER_MAX_STALLS)")
+	slowConsumerKeepPercent := flag.Int("slow-consumer-keep-percent", getEnvIntOr("SLOW_CONSUMER_KEEP_PERCENT", 100), "percentage of live events still sent to a client that stalled more than once, 100 keeps them all (env: SLOW_CONSUMER_KEEP_PERCENT)")
+
+	// Event limits
+	maxEventSize := flag.Int("max-event-size", getEnvIntOr("MAX_EVENT_SIZE", 0), "maximum serialized size in bytes of an accepted event, 0 for unlimited (env: MAX_EVENT_SIZE)")
+	maxEventTags := flag.Int("max-event-tags", getEnvIntOr("MAX_EVENT_TAGS", 0), "maximum number of tags in an accepted event, 0 for unlimited (env: MAX_EVENT_TAGS)")
+
+	// Write quotas
+	quotaDailyEvents := flag.Int("quota-daily-events", getEnvIntOr("QUOTA_DAILY_EVENTS", 0), "events each pubkey may write per UTC day, 0 for unlimited (env: QUOTA_DAILY_EVENTS)")
+	quotaDailyBytes := flag.Int64("quota-daily-bytes", int64(getEnvIntOr("QUOTA_DAILY_BYTES", 0)), "serialized bytes of events each pubkey may write per UTC day, 0 for unlimited (env: QUOTA_DAILY_BYTES)")
+	quotaOverrides := flag.String("quota-overrides", os.Getenv("QUOTA_OVERRIDES"), "comma-separated pubkey=caps daily quotas replacing the defaults for some pubkeys, caps being <n>events and/or <n>bytes, <n>kb or <n>mb joined by '/', 0 for unlimited, e.g. npub1...=5000events/50mb (env: QUOTA_OVERRIDES)")
+	quotaStateFile := flag.String("quota-state-file", os.Getenv("QUOTA_STATE_FILE"), "JSON file where the quota usage of the day is persisted; empty keeps it in memory (env: QUOTA_STATE_FILE)")
+
+	// Canonical serialization
+	canonicalPolicy := flag.String("canonical-policy", getEnvOr("CANONICAL_POLICY", CanonicalFix), "what to do with events whose non-canonical serialization can be fixed without changing their id: fix to forward the canonical form, reject to reject them with invalid (env: CANONICAL_POLICY)")
+
+	// Replay protection
+	replayMaxAgeDays := flag.Int("replay-max-age-days", getEnvIntOr("REPLAY_MAX_AGE_DAYS", 0), "refuse to publish events created more than this many days ago, 0 to disable (env: REPLAY_MAX_AGE_DAYS)")
+	replayPolicy := flag.String("replay-policy", getEnvOr("REPLAY_POLICY", ReplayReject), "what to do with events too old to publish: reject to reject them with invalid, drop to accept them without publishing them upstream (env: REPLAY_POLICY)")
+	replayExemptKinds := flag.String("replay-exempt-kinds", getEnvOr("REPLAY_EXEMPT_KINDS", "0,3,10000-19999,30000-39999"), "comma-separated kinds and kind ranges always published regardless of age (env: REPLAY_EXEMPT_KINDS)")
+
+	// Duplicate content
+	duplicateContentWindow := flag.Duration("duplicate-content-window", getEnvDurationOr("DUPLICATE_CONTENT_WINDOW", 0), "window within which one author posting the same note content under new ids is counted, 0 to disable (env: DUPLICATE_CONTENT_WINDOW)")
+	duplicateContentMaxCopies := flag.Int("duplicate-content-max-copies", getEnvIntOr("DUPLICATE_CONTENT_MAX_COPIES", 3), "copies of the same note an author may post within the window before further ones are flagged or rejected (env: DUPLICATE_CONTENT_MAX_COPIES)")
+	duplicateContentPolicy := flag.String("duplicate-content-policy", getEnvOr("DUPLICATE_CONTENT_POLICY", DuplicateFlag), "what to do with notes repeated beyond the allowed copies: flag to count and log them, reject to reject them with rate-limited (env: DUPLICATE_CONTENT_POLICY)")
+	duplicateContentKinds := flag.String("duplicate-content-kinds", getEnvOr("DUPLICATE_CONTENT_KINDS", "1"), "comma-separated kinds and kind ranges checked for repeated content (env: DUPLICATE_CONTENT_KINDS)")
+
+	// Fault injection
+	chaosFaults := flag.String("chaos-faults", os.Getenv("CHAOS_FAULTS"), "comma-separated fault:rate pairs of upstream failures to simulate, e.g. query_timeout:0.1,publish_failure:0.2; faults are query_timeout, slow_eose, publish_failure, publish_timeout and mirror_drop. Only honored by binaries built with -tags chaos (env: CHAOS_FAULTS)")
+	chaosEOSEDelay := flag.Duration("chaos-eose-delay", getEnvDurationOr("CHAOS_EOSE_DELAY", 3*time.Second), "how long the slow_eose fault holds back an upstream EOSE (env: CHAOS_EOSE_DELAY)")
+
+	// Relay-set profiles
+	relayProfilesFile := flag.String("relay-profiles-file", os.Getenv("RELAY_PROFILES_FILE"), "JSON file of named relay-set profiles (env: RELAY_PROFILES_FILE)")
+	profile := flag.String("profile", os.Getenv("PROFILE"), "name of the relay-set profile to start with (env: PROFILE)")
+
+	// Mirror sampling
+	mirrorSampleRates := flag.String("mirror-sample-rates", os.Getenv("MIRROR_SAMPLE_RATES"), "comma-separated kind:rate pairs, the fraction of mirrored events of each kind rebroadcast to clients, e.g. 7:0.1 (env: MIRROR_SAMPLE_RATES)")
+	mirrorKindsWindow := flag.Duration("mirror-kinds-window", getEnvDurationOr("MIRROR_KINDS_WINDOW", time.Hour), "window of the histogram of mirrored event kinds served at /api/v1/stats/mirror-kinds, 0 disables it (env: MIRROR_KINDS_WINDOW)")
+
+	// Relay trust tiers
+	relayTrustTiers := flag.String("relay-trust-tiers", os.Getenv("RELAY_TRUST_TIERS"), "comma-separated url=tier pairs giving upstream relays a trust tier: high skips signature verification, low needs other relays to deliver an event before it is rebroadcast; unlisted relays are normal (env: RELAY_TRUST_TIERS)")
+	relayTrustLowQuorum := flag.Int("relay-trust-low-quorum", getEnvIntOr("RELAY_TRUST_LOW_QUORUM", 2), "distinct relays that must deliver an event first delivered by a low-trust relay before it is rebroadcast; a normal or high-trust relay is always enough (env: RELAY_TRUST_LOW_QUORUM)")
+	relayTrustLowWindow := flag.Duration("relay-trust-low-window", getEnvDurationOr("RELAY_TRUST_LOW_WINDOW", 30*time.Second), "how long an event of a low-trust relay waits for other relays before it is dropped (env: RELAY_TRUST_LOW_WINDOW)")
+
+	// Query hedging
+	queryHedgeDelay := flag.Duration("query-hedge-delay", getEnvDurationOr("QUERY_HEDGE_DELAY", 0), "query the fastest half of the query remotes first and the rest only if they have not answered within this delay, 0 queries all at once (env: QUERY_HEDGE_DELAY)")
+
+	// Query deadline
+	queryDeadline := flag.Duration("query-deadline", getEnvDurationOr("QUERY_DEADLINE", relaystore.QueryTimeoutDuration), "how long a client query waits for the query remotes before EOSE is sent with the events received so far (env: QUERY_DEADLINE)")
+	queryPartialNotices := flag.Bool("query-partial-notices", getEnvBoolOr("QUERY_PARTIAL_NOTICES", false), "send clients a NOTICE starting with partial: before the EOSE of queries answered at QUERY_DEADLINE without some query remotes (env: QUERY_PARTIAL_NOTICES)")
+
+	// Query routing
+	queryRoutesFile := flag.String("query-routes-file", os.Getenv("QUERY_ROUTES_FILE"), "JSON list of rules sending filters of given kinds, tags or searches only to some relays (env: QUERY_ROUTES_FILE)")
+
+	// Upstream subscription cap
+	maxUpstreamSubscriptions := flag.Int("max-upstream-subscriptions", getEnvIntOr("MAX_UPSTREAM_SUBSCRIPTIONS", 0), "maximum client queries forwarded to the query remotes at once, each holding one subscription per remote; beyond it the least recently active query is closed with rate-limited, 0 for unlimited (env: MAX_UPSTREAM_SUBSCRIPTIONS)")
+	upstreamSubMaxEvents := flag.Int("upstream-sub-max-events", getEnvIntOr("UPSTREAM_SUB_MAX_EVENTS", 0), "events after which an upstream subscription of a forwarded query is closed, 0 for unlimited (env: UPSTREAM_SUB_MAX_EVENTS)")
+	upstreamSubMaxBytes := flag.Int64("upstream-sub-max-bytes", int64(getEnvIntOr("UPSTREAM_SUB_MAX_BYTES", 0)), "bytes of events after which an upstream subscription of a forwarded query is closed, 0 for unlimited (env: UPSTREAM_SUB_MAX_BYTES)")
+	upstreamSubMaxDuration := flag.Duration("upstream-sub-max-duration", getEnvDurationOr("UPSTREAM_SUB_MAX_DURATION", 0), "time after which an upstream subscription of a forwarded query is closed, 0 for the query timeout (env: UPSTREAM_SUB_MAX_DURATION)")
+
+	// Query remote demotion
+	demotionThreshold := flag.Int("demotion-threshold", getEnvIntOr("DEMOTION_THRESHOLD", 0), "consecutive rejected queries or malformed NIP-11 probes after which a query remote stops being queried, 0 to disable (env: DEMOTION_THRESHOLD)")
+	demotionProbeInterval := flag.Duration("demotion-probe-interval", getEnvDurationOr("DEMOTION_PROBE_INTERVAL", DefaultDemotionProbeInterval), "how often query remotes' NIP-11 is probed and demoted relays get a canary query (env: DEMOTION_PROBE_INTERVAL)")
+
+	// NIP-119 AND tag filters
+	andTagFilters := flag.Bool("and-tag-filters", getEnvBoolOr("AND_TAG_FILTERS", false), "support NIP-119 AND tag filters (\"&t\") by querying upstreams with one of the values and keeping only events with all of them (env: AND_TAG_FILTERS)")
+	clientLeniency := flag.String("client-leniency", getEnvOr("CLIENT_LENIENCY", LeniencyOff), "what to do with client filters with unknown fields, uppercase hex or numeric strings in kinds: off to leave them to khatru, normalize to fix and accept them, reject to close the subscription with invalid: (env: CLIENT_LENIENCY)")
+
+	// Degraded health notices
+	healthNotices := flag.Bool("health-notices", getEnvBoolOr("HEALTH_NOTICES", false), "send clients a NOTICE when upstream health drops to YELLOW or RED, and one before the EOSE of each subscription while degraded (env: HEALTH_NOTICES)")
+	upstreamClosedNotices := flag.Bool("upstream-closed-notices", getEnvBoolOr("UPSTREAM_CLOSED_NOTICES", true), "send clients a NOTICE when a query remote closes the upstream side of their subscription, e.g. with auth-required or rate-limited (env: UPSTREAM_CLOSED_NOTICES)")
+
+	// Query quorum
+	queryQuorum := flag.Int("query-quorum", getEnvIntOr("QUERY_QUORUM", 0), "only return events seen on at least this many distinct query remotes, 0 or 1 to disable; clients may request one per filter with the search extension quorum:N (env: QUERY_QUORUM)")
+
+	// Query shadowing
+	shadowRemotes := flag.String("shadow-remotes", os.Getenv("SHADOW_REMOTES"), "comma-separated candidate relays sent a copy of some client queries to measure their latency, coverage and errors; their events are never served (env: SHADOW_REMOTES)")
+	shadowPercent := flag.Int("shadow-percent", getEnvIntOr("SHADOW_PERCENT", 10), "percentage of client queries copied to the shadow remotes (env: SHADOW_PERCENT)")
+
+	// Provenance tracking
+	provenanceCacheSize := flag.Int("provenance-cache-size", getEnvIntOr("PROVENANCE_CACHE_SIZE", 10000), "number of recently seen events whose upstream sources are remembered, 0 to disable (env: PROVENANCE_CACHE_SIZE)")
+
+	// Maintenance mode
+	maintenanceSchedule := flag.String("maintenance-schedule", os.Getenv("MAINTENANCE_SCHEDULE"), "comma-separated recurring UTC maintenance windows, e.g. 02:00-04:00 or Sun 01:00-03:00, during which new events are rejected (env: MAINTENANCE_SCHEDULE)")
+	maintenanceEnabled := flag.Bool("maintenance", getEnvBoolOr("MAINTENANCE_ENABLED", false), "start in maintenance mode, rejecting new events until disabled through the admin API (env: MAINTENANCE_ENABLED)")
+
+	// Dry run
+	dryRun := flag.Bool("dry-run", getEnvBoolOr("DRY_RUN", false), "route published and mirrored events as usual, with stats, but only log where they would have been sent instead of sending them (env: DRY_RUN)")
+
+	// Paid access
+	paymentRequired := flag.Bool("payment-required", getEnvBoolOr("PAYMENT_REQUIRED", false), "only accept events from admitted pubkeys and advertise payment_required in NIP-11 (env: PAYMENT_REQUIRED)")
+	paymentsURL := flag.String("payments-url", os.Getenv("PAYMENTS_URL"), "URL where users pay for write access, advertised in NIP-11 (env: PAYMENTS_URL)")
+	admissionPubKeys := flag.String("admission-pubkeys", os.Getenv("ADMISSION_PUBKEYS"), "comma-separated hex or npub pubkeys that may always publish when payment is required (env: ADMISSION_PUBKEYS)")
+	admissionDefaultDuration := flag.Duration("admission-default-duration", getEnvDurationOr("ADMISSION_DEFAULT_DURATION", 30*24*time.Hour), "write access granted by an admission without an explicit duration (env: ADMISSION_DEFAULT_DURATION)")
+	admissionWebhookSecret := flag.String("admission-webhook-secret", os.Getenv("ADMISSION_WEBHOOK_SECRET"), "bearer token the payment service uses on the admission webhook; empty disables the webhook (env: ADMISSION_WEBHOOK_SECRET)")
+
+	admissionStateFile := flag.String("admission-state-file", os.Getenv("ADMISSION_STATE_FILE"), "JSON file where admitted pubkeys and paid invoices are persisted; empty keeps them in memory (env: ADMISSION_STATE_FILE)")
+
+	// Lightning-paid write access
+	lnbitsURL := flag.String("lnbits-url", os.Getenv("LNBITS_URL"), "base URL of the LNbits instance issuing write-access invoices; empty disables Lightning payments (env: LNBITS_URL)")
+	lnbitsInvoiceKey := flag.String("lnbits-invoice-key", os.Getenv("LNBITS_INVOICE_KEY"), "invoice/read API key of the LNbits wallet (env: LNBITS_INVOICE_KEY)")
+	admissionPrice := flag.Int64("admission-price", int64(getEnvIntOr("ADMISSION_PRICE", 1000)), "price in sats of write access for ADMISSION_DEFAULT_DURATION (env: ADMISSION_PRICE)")
+	invoiceRate := flag.Int("invoice-rate", getEnvIntOr("INVOICE_RATE", 10), "write-access invoices per hour each IP and each pubkey may request; 0 is unlimited (env: INVOICE_RATE)")
+	invoiceMaxPending := flag.Int("invoice-max-pending", getEnvIntOr("INVOICE_MAX_PENDING", 1000), "most unpaid write-access invoices held at once, refusing new requests beyond it; 0 is unlimited (env: INVOICE_MAX_PENDING)")
+
+	// Metrics export
+	metricsExportURL := flag.String("metrics-export-url", os.Getenv("METRICS_EXPORT_URL"), "push stats to statsd://host:port (UDP) or graphite://host:port (TCP plaintext); empty disables (env: METRICS_EXPORT_URL)")
+	metricsExportPrefix := flag.String("metrics-export-prefix", getEnvOr("METRICS_EXPORT_PREFIX", "saint_michaels_mirror"), "prefix of exported metric names (env: METRICS_EXPORT_PREFIX)")
+	metricsExportInterval := flag.Duration("metrics-export-interval", getEnvDurationOr("METRICS_EXPORT_INTERVAL", 10*time.Second), "interval between metrics pushes (env: METRICS_EXPORT_INTERVAL)")
+
+	// InfluxDB sink
+	influxSink := flag.String("influx-sink", os.Getenv("INFLUX_SINK"), "write stats in InfluxDB line protocol to this http(s) write URL or file path; empty disables (env: INFLUX_SINK)")
+	influxToken := flag.String("influx-token", os.Getenv("INFLUX_TOKEN"), "API token sent to the InfluxDB write endpoint (env: INFLUX_TOKEN)")
+	influxMeasurement := flag.String("influx-measurement", getEnvOr("INFLUX_MEASUREMENT", "saint_michaels_mirror"), "measurement name of the InfluxDB stats lines (env: INFLUX_MEASUREMENT)")
+	influxInterval := flag.Duration("influx-interval", getEnvDurationOr("INFLUX_INTERVAL", time.Minute), "interval between InfluxDB stats snapshots (env: INFLUX_INTERVAL)")
+
+	// Release checks
+	updateCheck := flag.Bool("update-check", getEnvBoolOr("UPDATE_CHECK", false), "periodically check the project's release announcements (NIP-78) and warn when a newer version is available (env: UPDATE_CHECK)")
+	updateCheckRelays := flag.String("update-check-relays", getEnvOr("UPDATE_CHECK_RELAYS", DefaultReleaseRelay), "comma-separated relays release announcements are read from (env: UPDATE_CHECK_RELAYS)")
+	updateCheckPubKey := flag.String("update-check-pubkey", getEnvOr("UPDATE_CHECK_PUBKEY", DefaultReleaseAnnouncer), "pubkey (hex or npub) that signs release announcements (env: UPDATE_CHECK_PUBKEY)")
+	updateCheckInterval := flag.Duration("update-check-interval", getEnvDurationOr("UPDATE_CHECK_INTERVAL", 24*time.Hour), "interval between release checks (env: UPDATE_CHECK_INTERVAL)")
+
+	// Remote configuration
+	remoteConfigRelays := flag.String("remote-config-relays", os.Getenv("REMOTE_CONFIG_RELAYS"), "comma-separated control relays the NIP-78 remote configuration is read from; empty disables it (env: REMOTE_CONFIG_RELAYS)")
+	remoteConfigPubKey := flag.String("remote-config-pubkey", os.Getenv("REMOTE_CONFIG_PUBKEY"), "pubkey (hex or npub) that signs the remote configuration (env: REMOTE_CONFIG_PUBKEY)")
+	remoteConfigInterval := flag.Duration("remote-config-interval", getEnvDurationOr("REMOTE_CONFIG_INTERVAL", 5*time.Minute), "interval between remote configuration refreshes (env: REMOTE_CONFIG_INTERVAL)")
+
+	// Clock checks
+	clockCheckInterval := flag.Duration("clock-check-interval", getEnvDurationOr("CLOCK_CHECK_INTERVAL", time.Hour), "interval between checks of the local clock skew, 0 disables them (env: CLOCK_CHECK_INTERVAL)")
+	clockNTPServer := flag.String("clock-ntp-server", os.Getenv("CLOCK_NTP_SERVER"), "NTP server (host or host:port) the local clock is compared with; empty uses the Date headers of the query remotes (env: CLOCK_NTP_SERVER)")
+	clockSkewThreshold := flag.Duration("clock-skew-threshold", getEnvDurationOr("CLOCK_SKEW_THRESHOLD", 5*time.Second), "clock skew beyond which a warning is logged and health turns YELLOW (env: CLOCK_SKEW_THRESHOLD)")
+
+	// Operator digest
+	digestInterval := flag.Duration("digest-interval", getEnvDurationOr("DIGEST_INTERVAL", 24*time.Hour), "interval between operator digests of events, duplicates, rejections and upstream availability, 0 disables them (env: DIGEST_INTERVAL)")
+	digestAdminPubkey := flag.String("digest-admin-pubkey", os.Getenv("DIGEST_ADMIN_PUBKEY"), "npub or hex pubkey the digest is also sent to as a NIP-17 direct message from the relay key (env: DIGEST_ADMIN_PUBKEY)")
+
+	// Profiling snapshots
+	profilingDir := flag.String("profiling-dir", os.Getenv("PROFILING_DIR"), "directory goroutine and heap profiles are written to when the goroutine count turns YELLOW or health turns RED; empty disables snapshots (env: PROFILING_DIR)")
+	profilingMaxSnapshots := flag.Int("profiling-max-snapshots", getEnvIntOr("PROFILING_MAX_SNAPSHOTS", 10), "profiling snapshots kept in PROFILING_DIR, the oldest being removed (env: PROFILING_MAX_SNAPSHOTS)")
+	profilingCooldown := flag.Duration("profiling-cooldown", getEnvDurationOr("PROFILING_COOLDOWN", 15*time.Minute), "minimum time between profiling snapshots (env: PROFILING_COOLDOWN)")
+
+	// Per-client query limits
+	filterRate := flag.Int("filter-rate", getEnvIntOr("FILTER_RATE", 20), "filters per minute accepted from each IP address (env: FILTER_RATE)")
+	filterBurst := flag.Int("filter-burst", getEnvIntOr("FILTER_BURST", 100), "filters an IP address may send at once before FILTER_RATE applies (env: FILTER_BURST)")
+	filterMaxLimit := flag.Int("filter-max-limit", getEnvIntOr("FILTER_MAX_LIMIT", 0), "largest filter limit served to anonymous clients, 0 for unlimited (env: FILTER_MAX_LIMIT)")
+	trustedPubKeys := flag.String("trusted-pubkeys", os.Getenv("TRUSTED_PUBKEYS"), "comma-separated hex or npub pubkeys that get the trusted query limits after NIP-42 AUTH (env: TRUSTED_PUBKEYS)")
+	trustedFilterRate := flag.Int("trusted-filter-rate", getEnvIntOr("TRUSTED_FILTER_RATE", 200), "filters per minute accepted from each trusted pubkey (env: TRUSTED_FILTER_RATE)")
+	trustedFilterBurst := flag.Int("trusted-filter-burst", getEnvIntOr("TRUSTED_FILTER_BURST", 1000), "filters a trusted pubkey may send at once before TRUSTED_FILTER_RATE applies (env: TRUSTED_FILTER_BURST)")
+	trustedFilterMaxLimit := flag.Int("trusted-filter-max-limit", getEnvIntOr("TRUSTED_FILTER_MAX_LIMIT", 0), "largest filter limit served to trusted pubkeys, 0 for unlimited (env: TRUSTED_FILTER_MAX_LIMIT)")
+
+	// Operation mode
+	mode := flag.String("mode", getEnvOr("MODE", ModeReadWrite), "read (reject all EVENTs), write (reject all REQs and COUNTs) or readwrite (env: MODE)")
+
+	// Members-only reads
+	restrictedReads := flag.Bool("restricted-reads", getEnvBoolOr("RESTRICTED_READS", false), "reject REQ and COUNT from connections that have not authenticated (NIP-42) as a member (env: RESTRICTED_READS)")
+	memberPubKeys := flag.String("member-pubkeys", os.Getenv("MEMBER_PUBKEYS"), "comma-separated hex or npub pubkeys that may read when RESTRICTED_READS is enabled; empty allows any authenticated pubkey (env: MEMBER_PUBKEYS)")
+
+	// NIP-42 AUTH flow
+	authChallengeOnConnect := flag.String("auth-challenge-on-connect", getEnvOr("AUTH_CHALLENGE_ON_CONNECT", AuthChallengeAuto), "send the NIP-42 AUTH challenge on connect: auto (when TRUSTED_PUBKEYS or RESTRICTED_READS is set), always or never (env: AUTH_CHALLENGE_ON_CONNECT)")
+	authChallengeTTL := flag.Duration("auth-challenge-ttl", getEnvDurationOr("AUTH_CHALLENGE_TTL", 0), "how long an AUTH challenge may be answered before a new one is sent, 0 for no expiry (env: AUTH_CHALLENGE_TTL)")
+	authDuringSubscriptions := flag.Bool("auth-during-subscriptions", getEnvBoolOr("AUTH_DURING_SUBSCRIPTIONS", true), "accept AUTH from connections with open subscriptions, upgrading their access (env: AUTH_DURING_SUBSCRIPTIONS)")
+	authOutcomeStats := flag.Bool("auth-outcome-stats", getEnvBoolOr("AUTH_OUTCOME_STATS", false), "count successful and failed AUTHs by reason, reading the AUTH frames of every connection before khatru (env: AUTH_OUTCOME_STATS)")
+
+	// Federated stats
+	federatedStatsPeers := flag.String("federated-stats-peers", os.Getenv("FEDERATED_STATS_PEERS"), "comma-separated base URLs of other mirror instances merged into /api/v1/stats/cluster (env: FEDERATED_STATS_PEERS)")
+
+	// Coordinator election
+	coordinatorPeers := flag.String("coordinator-peers", os.Getenv("COORDINATOR_PEERS"), "comma-separated base URLs of the other instances sharing the upstreams; only the elected one mirrors and runs broadcast discovery, empty disables the election (env: COORDINATOR_PEERS)")
+	instanceID := flag.String("instance-id", os.Getenv("INSTANCE_ID"), "ID of this instance in the coordinator election, the lowest live one leads; defaults to the host name (env: INSTANCE_ID)")
+	coordinatorInterval := flag.Duration("coordinator-interval", getEnvDurationOr("COORDINATOR_INTERVAL", 10*time.Second), "how often the coordinator peers are polled; a peer silent for 3 intervals is considered gone (env: COORDINATOR_INTERVAL)")
+
+	// HTTP server settings (defaults match khatru)
+	httpReadTimeout := flag.Duration("http-read-timeout", getEnvDurationOr("HTTP_READ_TIMEOUT", 2*time.Second), "HTTP server read timeout (env: HTTP_READ_TIMEOUT)")
+	httpWriteTimeout := flag.Duration("http-write-timeout", getEnvDurationOr("HTTP_WRITE_TIMEOUT", 2*time.Second), "HTTP server write timeout (env: HTTP_WRITE_TIMEOUT)")
+	httpIdleTimeout := flag.Duration("http-idle-timeout", getEnvDurationOr("HTTP_IDLE_TIMEOUT", 30*time.Second), "HTTP server keep-alive idle timeout (env: HTTP_IDLE_TIMEOUT)")
+
+	// Restart settings
+	upgradeDrainTimeout := flag.Duration("upgrade-drain-timeout", getEnvDurationOr("UPGRADE_DRAIN_TIMEOUT", 5*time.Minute), "how long the old process keeps serving existing connections after a SIGUSR2 listener handover (env: UPGRADE_DRAIN_TIMEOUT)")
+	pidFile := flag.String("pid-file", os.Getenv("PID_FILE"), "file to write the serving process pid to, updated on listener handover (env: PID_FILE)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", getEnvDurationOr("SHUTDOWN_TIMEOUT", 10*time.Second), "how long each step of the shutdown on SIGINT or SIGTERM may take (env: SHUTDOWN_TIMEOUT)")
+
+	// HTTP API settings
+	corsAllowedOrigins := flag.String("cors-allowed-origins", os.Getenv("CORS_ALLOWED_ORIGINS"), "comma-separated list of origins allowed to call /api/v1/* from a browser, * for any; empty allows same-origin pages only (env: CORS_ALLOWED_ORIGINS)")
+	staticCacheMaxAge := flag.Duration("static-cache-max-age", getEnvDurationOr("STATIC_CACHE_MAX_AGE", time.Hour), "Cache-Control max-age for /static/ assets (env: STATIC_CACHE_MAX_AGE)")
 
 	flag.Parse()
 
@@ -129,14 +907,40 @@ func LoadConfig() *Config {
 		QueryRemotes: qry,
 		Verbose:      *verbose,
 
-		RelayServiceURL:  *relayServiceURL,
-		RelayName:        *relayName,
-		RelayDescription: *relayDescription,
-		RelayContact:     *relayContact,
-		RelaySecKey:      *relaySecKey,
-		RelayPubKey:      *relayPubKey,
-		RelayIcon:        *relayIcon,
-		RelayBanner:      *relayBanner,
+		AdminToken:             *adminToken,
+		ForgetStateFile:        *forgetStateFile,
+		APIKeysFile:            *apiKeysFile,
+		APIKeyDefaultRate:      *apiKeyDefaultRate,
+		ExportMaxEvents:        *exportMaxEvents,
+		ExportTimeout:          *exportTimeout,
+		QueryEndpointMaxEvents: *queryEndpointMaxEvents,
+		ImportMaxEvents:        *importMaxEvents,
+		ImportRate:             *importRate,
+		EventEndpoint:          *eventEndpoint,
+		EventEndpointWait:      *eventEndpointWait,
+		StartDegraded:          *startDegraded,
+
+		PinnedEvents:              splitList(*pinnedEvents),
+		PinnedRebroadcastInterval: *pinnedRebroadcastInterval,
+
+		InitialConnectDeadline: *initialConnectDeadline,
+		InitialConnectJitter:   *initialConnectJitter,
+		SharedPool:             *sharedPool,
+
+		RelayServiceURL:    *relayServiceURL,
+		TrustedProxies:     splitList(*trustedProxies),
+		RelayName:          *relayName,
+		RelayDescription:   *relayDescription,
+		RelayContact:       *relayContact,
+		RelaySecKey:        *relaySecKey,
+		KeyRotationGrace:   *keyRotationGrace,
+		RelayPubKey:        *relayPubKey,
+		RelayIcon:          *relayIcon,
+		RelayBanner:        *relayBanner,
+		RelayInfoFile:      *relayInfoFile,
+		RelayRetentionInfo: *relayRetentionInfo,
+		PolicyFile:         *policyFile,
+		TermsFile:          *termsFile,
 
 		MaxPublishRelays:         *maxPublishRelays,
 		BroadcastWorkers:         *broadcastWorkers,
@@ -144,6 +948,190 @@ func LoadConfig() *Config {
 		BroadcastSeedRelays:      broadcastSeedList,
 		BroadcastMandatoryRelays: broadcastMandatoryList,
 		BroadcastRefreshInterval: *broadcastRefreshInterval,
+		RelayRetireDays:          *relayRetireDays,
+		RelayQuarantineStateFile: *relayQuarantineStateFile,
+		BroadcastPoolMin:         *broadcastPoolMin,
+		BroadcastPoolMax:         *broadcastPoolMax,
+		DiscoveryMaxNewRelays:    *discoveryMaxNewRelays,
+		BroadcastPoolMaxChurn:    *broadcastPoolMaxChurn,
+		BroadcastPoolChurnWindow: *broadcastPoolChurnWindow,
+
+		DiscoveryFollowsPubkey:    *discoveryFollowsPubkey,
+		DiscoveryFollowsMaxRelays: *discoveryFollowsMaxRelays,
+		DiscoveryFollowsMinUsers:  *discoveryFollowsMinUsers,
+		PreferredCountries:        splitList(*preferredCountries),
+		RequiredCountries:         splitList(*requiredCountries),
+		RelayVetting:              *relayVetting,
+		RelayVettingTimeout:       *relayVettingTimeout,
+		RelayAliases:              *relayAliases,
+
+		DNSRefreshInterval: *dnsRefreshInterval,
+
+		PenaltyBoxBase:      *penaltyBoxBase,
+		PenaltyBoxMax:       *penaltyBoxMax,
+		PenaltyBoxThreshold: *penaltyBoxThreshold,
+
+		PublishRetryAttempts:   *publishRetryAttempts,
+		PublishRetryBackoff:    *publishRetryBackoff,
+		PublishRetryMaxBackoff: *publishRetryMaxBackoff,
+		PublishWindow:          *publishWindow,
+		RelayLimits:            *relayLimits,
+		PublishMaxHintRelays:   *publishMaxHintRelays,
+		BroadcastEnrichment:    splitList(*broadcastEnrichment),
+		BroadcastClientTag:     *broadcastClientTag,
+		BroadcastLogSize:       *broadcastLogSize,
+
+		SearchEnabled: *searchEnabled,
+		SearchRemotes: splitList(*searchRemotes),
+
+		WSMaxMessageSize: *wsMaxMessageSize,
+		WSWriteWait:      *wsWriteWait,
+		WSPongWait:       *wsPongWait,
+		WSPingPeriod:     *wsPingPeriod,
+
+		WSClientCompression:   *wsClientCompression,
+		WSUpstreamCompression: *wsUpstreamCompression,
+
+		SlowConsumerStall:       *slowConsumerStall,
+		SlowConsumerMaxStalls:   *slowConsumerMaxStalls,
+		SlowConsumerKeepPercent: *slowConsumerKeepPercent,
+
+		MaxEventSize: *maxEventSize,
+		MaxEventTags: *maxEventTags,
+
+		QuotaDailyEvents: *quotaDailyEvents,
+		QuotaDailyBytes:  *quotaDailyBytes,
+		QuotaOverrides:   *quotaOverrides,
+		QuotaStateFile:   *quotaStateFile,
+
+		CanonicalPolicy: *canonicalPolicy,
+
+		ReplayMaxAgeDays:  *replayMaxAgeDays,
+		ReplayPolicy:      *replayPolicy,
+		ReplayExemptKinds: *replayExemptKinds,
+
+		DuplicateContentWindow:    *duplicateContentWindow,
+		DuplicateContentMaxCopies: *duplicateContentMaxCopies,
+		DuplicateContentPolicy:    *duplicateContentPolicy,
+		DuplicateContentKinds:     *duplicateContentKinds,
+
+		ChaosFaults:    *chaosFaults,
+		ChaosEOSEDelay: *chaosEOSEDelay,
+
+		RelayProfilesFile: *relayProfilesFile,
+		Profile:           *profile,
+
+		MirrorSampleRates: *mirrorSampleRates,
+		MirrorKindsWindow: *mirrorKindsWindow,
+
+		RelayTrustTiers:     *relayTrustTiers,
+		RelayTrustLowQuorum: *relayTrustLowQuorum,
+		RelayTrustLowWindow: *relayTrustLowWindow,
+
+		QueryHedgeDelay: *queryHedgeDelay,
+		QueryRoutesFile: *queryRoutesFile,
+		QueryQuorum:     *queryQuorum,
+
+		QueryDeadline:       *queryDeadline,
+		QueryPartialNotices: *queryPartialNotices,
+
+		ShadowRemotes: splitList(*shadowRemotes),
+		ShadowPercent: *shadowPercent,
+
+		MaxUpstreamSubscriptions: *maxUpstreamSubscriptions,
+		UpstreamSubMaxEvents:     *upstreamSubMaxEvents,
+		UpstreamSubMaxBytes:      *upstreamSubMaxBytes,
+		UpstreamSubMaxDuration:   *upstreamSubMaxDuration,
+		DemotionThreshold:        *demotionThreshold,
+		DemotionProbeInterval:    *demotionProbeInterval,
+		AndTagFilters:            *andTagFilters,
+		ClientLeniency:           *clientLeniency,
+		HealthNotices:            *healthNotices,
+		UpstreamClosedNotices:    *upstreamClosedNotices,
+
+		ProvenanceCacheSize: *provenanceCacheSize,
+
+		MaintenanceSchedule: *maintenanceSchedule,
+		MaintenanceEnabled:  *maintenanceEnabled,
+
+		DryRun: *dryRun,
+
+		PaymentRequired:          *paymentRequired,
+		PaymentsURL:              *paymentsURL,
+		AdmissionPubKeys:         splitList(*admissionPubKeys),
+		AdmissionDefaultDuration: *admissionDefaultDuration,
+		AdmissionWebhookSecret:   *admissionWebhookSecret,
+		AdmissionStateFile:       *admissionStateFile,
+
+		LNbitsURL:         *lnbitsURL,
+		LNbitsInvoiceKey:  *lnbitsInvoiceKey,
+		AdmissionPrice:    *admissionPrice,
+		InvoiceRate:       *invoiceRate,
+		InvoiceMaxPending: *invoiceMaxPending,
+
+		MetricsExportURL:      *metricsExportURL,
+		MetricsExportPrefix:   *metricsExportPrefix,
+		MetricsExportInterval: *metricsExportInterval,
+
+		InfluxSink:        *influxSink,
+		InfluxToken:       *influxToken,
+		InfluxMeasurement: *influxMeasurement,
+		InfluxInterval:    *influxInterval,
+
+		UpdateCheck:         *updateCheck,
+		UpdateCheckRelays:   splitList(*updateCheckRelays),
+		UpdateCheckPubKey:   *updateCheckPubKey,
+		UpdateCheckInterval: *updateCheckInterval,
+
+		RemoteConfigRelays:   splitList(*remoteConfigRelays),
+		RemoteConfigPubKey:   *remoteConfigPubKey,
+		RemoteConfigInterval: *remoteConfigInterval,
+
+		ClockCheckInterval: *clockCheckInterval,
+		ClockNTPServer:     *clockNTPServer,
+		ClockSkewThreshold: *clockSkewThreshold,
+
+		DigestInterval:    *digestInterval,
+		DigestAdminPubkey: *digestAdminPubkey,
+
+		ProfilingDir:          *profilingDir,
+		ProfilingMaxSnapshots: *profilingMaxSnapshots,
+		ProfilingCooldown:     *profilingCooldown,
+
+		FederatedStatsPeers: splitList(*federatedStatsPeers),
+
+		CoordinatorPeers:    splitList(*coordinatorPeers),
+		InstanceID:          *instanceID,
+		CoordinatorInterval: *coordinatorInterval,
+
+		FilterRate:            *filterRate,
+		FilterBurst:           *filterBurst,
+		FilterMaxLimit:        *filterMaxLimit,
+		TrustedPubKeys:        splitList(*trustedPubKeys),
+		TrustedFilterRate:     *trustedFilterRate,
+		TrustedFilterBurst:    *trustedFilterBurst,
+		TrustedFilterMaxLimit: *trustedFilterMaxLimit,
+
+		Mode: *mode,
+
+		RestrictedReads: *restrictedReads,
+		MemberPubKeys:   splitList(*memberPubKeys),
+
+		AuthChallengeOnConnect:  *authChallengeOnConnect,
+		AuthChallengeTTL:        *authChallengeTTL,
+		AuthDuringSubscriptions: *authDuringSubscriptions,
+		AuthOutcomeStats:        *authOutcomeStats,
+
+		HTTPReadTimeout:  *httpReadTimeout,
+		HTTPWriteTimeout: *httpWriteTimeout,
+		HTTPIdleTimeout:  *httpIdleTimeout,
+
+		UpgradeDrainTimeout: *upgradeDrainTimeout,
+		PIDFile:             *pidFile,
+		ShutdownTimeout:     *shutdownTimeout,
+
+		CORSAllowedOrigins: splitList(*corsAllowedOrigins),
+		StaticCacheMaxAge:  *staticCacheMaxAge,
 	}
 
 	return cfg
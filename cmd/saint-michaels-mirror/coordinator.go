@@ -0,0 +1,370 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Coordinator election among mirror instances for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+)
+
+// CoordinatorPollTimeout bounds asking one peer for its status
+const CoordinatorPollTimeout = 5 * time.Second
+
+// coordinatorPeerTTL is how many poll intervals a peer that stopped
+// answering still counts as alive
+const coordinatorPeerTTL = 3
+
+// coordinatorStatus is what an instance tells its peers
+type coordinatorStatus struct {
+	InstanceID string `json:"instance_id"`
+	Epoch      int64  `json:"epoch"`
+	Leading    bool   `json:"leading"`
+	Leader     string `json:"leader"`
+}
+
+// coordinatorPeer is what this instance knows about one peer
+type coordinatorPeer struct {
+	status    coordinatorStatus
+	lastSeen  time.Time
+	failures  int64
+	lastError string
+}
+
+// coordinatorTask is work only the coordinator runs
+type coordinatorTask struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// coordinator elects one of several instances serving the same upstreams to
+// run the work that must not be duplicated: the mirror subscription, whose
+// events every instance would otherwise rebroadcast, and the periodic
+// broadcast discovery. Every instance keeps serving queries and publishes.
+// Instances poll the status of their peers; the live instance with the
+// lowest ID, ties broken by a per-process epoch, leads. A peer that has not
+// answered for coordinatorPeerTTL intervals is considered gone, so the next
+// instance takes over. A starting instance does not lead before every peer
+// answered or they all had coordinatorPeerTTL intervals to, so instances
+// restarted together do not all lead at first. Partitioned instances may
+// both lead, which only brings back the duplicates of an uncoordinated
+// deployment.
+type coordinator struct {
+	id       string
+	epoch    int64
+	peers    []string
+	interval time.Duration
+	client   *http.Client
+	mu       sync.Mutex
+	state    map[string]*coordinatorPeer // by peer base URL
+	tasks    []coordinatorTask
+	leader   string
+	leading  bool
+	decided  bool
+	started  time.Time
+	cancel   context.CancelFunc // of the tasks, while leading
+	done     chan struct{}      // closed once the tasks of the last lead returned
+	stop     context.CancelFunc
+	// stats
+	polls       int64
+	transitions int64
+	leaderSince time.Time
+}
+
+// newCoordinator creates the election of instance id among peers, base URLs
+// of the other instances, polled every interval
+func newCoordinator(id string, peers []string, interval time.Duration) *coordinator {
+	c := &coordinator{
+		id:       id,
+		epoch:    time.Now().UnixNano() + rand.Int64N(1000),
+		interval: interval,
+		client:   &http.Client{Timeout: CoordinatorPollTimeout},
+		state:    map[string]*coordinatorPeer{},
+	}
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(peer, "/")
+		if _, ok := c.state[peer]; ok {
+			continue
+		}
+		c.peers = append(c.peers, peer)
+		c.state[peer] = &coordinatorPeer{}
+	}
+	return c
+}
+
+// Lead registers work run while this instance leads; ctx is cancelled when
+// it stops leading. Tasks must be registered before Start.
+func (c *coordinator) Lead(name string, run func(ctx context.Context)) {
+	c.tasks = append(c.tasks, coordinatorTask{name: name, run: run})
+}
+
+// Start polls the peers once, which may already elect a coordinator, then
+// again every interval until Close
+func (c *coordinator) Start() {
+	ctx, stop := context.WithCancel(context.Background())
+	c.stop = stop
+	c.started = time.Now()
+	logging.Info("coordinator election: instance %s with %d peers", c.id, len(c.peers))
+	c.poll(ctx)
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.poll(ctx)
+			}
+		}
+	}()
+}
+
+// Close stops polling and the tasks of the coordinator
+func (c *coordinator) Close() {
+	if c.stop != nil {
+		c.stop()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+}
+
+// poll asks every peer for its status and elects the coordinator
+func (c *coordinator) poll(ctx context.Context) {
+	atomic.AddInt64(&c.polls, 1)
+	statuses := make([]*coordinatorStatus, len(c.peers))
+	errs := make([]error, len(c.peers))
+	var wg sync.WaitGroup
+	for i, peer := range c.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], errs[i] = c.fetch(ctx, peer)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for i, peer := range c.peers {
+		ps := c.state[peer]
+		if errs[i] != nil {
+			ps.failures++
+			ps.lastError = errs[i].Error()
+			logging.DebugMethod("coordinator", "poll", "peer %s did not answer: %v", peer, errs[i])
+			continue
+		}
+		if statuses[i].InstanceID == c.id && statuses[i].Epoch == c.epoch {
+			// a peer URL pointing back at this instance
+			continue
+		}
+		if statuses[i].InstanceID == c.id && ps.status.Epoch != statuses[i].Epoch {
+			logging.Warn("peer %s has the same instance ID %s; set INSTANCE_ID on each instance", peer, c.id)
+		}
+		ps.status = *statuses[i]
+		ps.lastSeen = now
+	}
+
+	leader, leaderEpoch := c.id, c.epoch
+	for _, peer := range c.peers {
+		ps := c.state[peer]
+		if ps.lastSeen.IsZero() || now.Sub(ps.lastSeen) > coordinatorPeerTTL*c.interval {
+			continue
+		}
+		if ps.status.InstanceID < leader || (ps.status.InstanceID == leader && ps.status.Epoch < leaderEpoch) {
+			leader, leaderEpoch = ps.status.InstanceID, ps.status.Epoch
+		}
+	}
+	leading := leader == c.id && leaderEpoch == c.epoch
+	if leading && !c.decided && now.Sub(c.started) < coordinatorPeerTTL*c.interval {
+		for _, peer := range c.peers {
+			if c.state[peer].lastSeen.IsZero() {
+				// peers starting alongside this one may not answer yet
+				logging.DebugMethod("coordinator", "poll", "peer %s not heard from yet, waiting before leading", peer)
+				return
+			}
+		}
+	}
+	c.leader = leader
+	c.setLeadingLocked(leading)
+}
+
+// setLeadingLocked starts or stops the tasks when leadership changed; c.mu
+// must be held
+func (c *coordinator) setLeadingLocked(leading bool) {
+	if c.decided && leading == c.leading {
+		return
+	}
+	c.decided = true
+	c.leading = leading
+	c.leaderSince = time.Now()
+	atomic.AddInt64(&c.transitions, 1)
+	if !leading {
+		if c.cancel != nil {
+			c.cancel()
+			c.cancel = nil
+		}
+		logging.Info("coordinator: following %s", c.leader)
+		return
+	}
+	logging.Info("coordinator: this instance (%s) leads, running %d tasks", c.id, len(c.tasks))
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	previous, done := c.done, make(chan struct{})
+	c.done = done
+	go func() {
+		defer close(done)
+		// the tasks of a previous lead may still be stopping, e.g. the
+		// mirror, which would otherwise stop after being started again
+		if previous != nil {
+			<-previous
+		}
+		var wg sync.WaitGroup
+		for _, task := range c.tasks {
+			logging.DebugMethod("coordinator", "setLeadingLocked", "starting %s", task.name)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				task.run(ctx)
+			}()
+		}
+		wg.Wait()
+	}()
+}
+
+// fetch asks peer for its status
+func (c *coordinator) fetch(ctx context.Context, peer string) (*coordinatorStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+apiPathPrefix+"coordinator", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var status coordinatorStatus
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&status); err != nil {
+		return nil, fmt.Errorf("parsing status: %w", err)
+	}
+	if status.InstanceID == "" {
+		return nil, errors.New("status without instance_id")
+	}
+	return &status, nil
+}
+
+// HandleStatus serves GET of this instance's view of the election, polled
+// by the peers
+func (c *coordinator) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.Lock()
+	status := coordinatorStatus{InstanceID: c.id, Epoch: c.epoch, Leading: c.leading, Leader: c.leader}
+	c.mu.Unlock()
+	data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, data)
+}
+
+// leadMirroring returns the coordinator task mirroring into relay, retrying
+// with the degraded-mode backoff until the upstreams can be reached
+func leadMirroring(mm *mirror.MirrorManager, relay *khatru.Relay) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		backoff := DegradedRetryInitialBackoff
+		for {
+			err := mm.StartMirroring(relay)
+			if err == nil {
+				break
+			}
+			logging.Warn("coordinator: failed to start mirroring (retry in %v): %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, DegradedRetryMaxBackoff)
+		}
+		<-ctx.Done()
+		mm.StopMirroring()
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *coordinator) GetStatsName() string {
+	return "coordinator"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *coordinator) GetStats() jsonlib.JsonEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	list := jsonlib.NewJsonList()
+	for _, peer := range c.peers {
+		ps := c.state[peer]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("url", jsonlib.NewJsonValue(peer))
+		obj.Set("instance_id", jsonlib.NewJsonValue(ps.status.InstanceID))
+		obj.Set("alive", jsonlib.NewJsonValue(!ps.lastSeen.IsZero() && now.Sub(ps.lastSeen) <= coordinatorPeerTTL*c.interval))
+		obj.Set("leading", jsonlib.NewJsonValue(ps.status.Leading))
+		if !ps.lastSeen.IsZero() {
+			obj.Set("last_seen", jsonlib.NewJsonValue(ps.lastSeen.Unix()))
+		}
+		obj.Set("failures", jsonlib.NewJsonValue(ps.failures))
+		if ps.lastError != "" {
+			obj.Set("last_error", jsonlib.NewJsonValue(ps.lastError))
+		}
+		list.Append(obj)
+	}
+	tasks := jsonlib.NewJsonList()
+	for _, task := range c.tasks {
+		tasks.Append(jsonlib.NewJsonValue(task.name))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("instance_id", jsonlib.NewJsonValue(c.id))
+	obj.Set("leading", jsonlib.NewJsonValue(c.leading))
+	obj.Set("leader", jsonlib.NewJsonValue(c.leader))
+	if !c.leaderSince.IsZero() {
+		obj.Set("since", jsonlib.NewJsonValue(c.leaderSince.Unix()))
+	}
+	obj.Set("tasks", tasks)
+	obj.Set("polls", jsonlib.NewJsonValue(atomic.LoadInt64(&c.polls)))
+	obj.Set("transitions", jsonlib.NewJsonValue(atomic.LoadInt64(&c.transitions)))
+	obj.Set("peers", list)
+	return obj
+}
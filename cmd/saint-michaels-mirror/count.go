@@ -0,0 +1,188 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-45 HyperLogLog count aggregation for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// hllRegistersSize is the size of a serialized NIP-45 HyperLogLog
+const hllRegistersSize = 256
+
+// hllCounter answers HLL-eligible COUNT requests by collecting the raw
+// HyperLogLog registers from NIP-45 upstreams and merging them, so the merged
+// HLL can be passed through to clients that can keep merging it.
+type hllCounter struct {
+	relays    []string
+	relaysMu  sync.RWMutex
+	pool      *relaypool.Role
+	ownPool   bool // set when the pool is private to the counter
+	penalties *penaltyBox
+	// stats
+	requests          int64
+	internalRequests  int64
+	hllResponses      int64
+	scalarResponses   int64
+	upstreamFailures  int64
+	mergedHLLReturned int64
+}
+
+// newHLLCounter creates a counter for the given NIP-45 relays
+func newHLLCounter(relays []string, penalties *penaltyBox) *hllCounter {
+	return &hllCounter{relays: relays, penalties: penalties}
+}
+
+// SetPool makes the counter connect through a pool shared with other
+// components. It must be called before Init; without it Init creates a
+// private pool.
+func (h *hllCounter) SetPool(pool *relaypool.Role) {
+	h.pool = pool
+}
+
+// Init creates the connection pool used for counting, unless one was set
+func (h *hllCounter) Init() error {
+	if len(h.remotes()) == 0 {
+		return fmt.Errorf("no countable remotes provided - hll counter requires NIP-45 relays")
+	}
+	if h.pool == nil {
+		h.pool = relaypool.New(withBandwidthRole(context.Background(), bandwidthRoleCount)).Role(relaypool.RoleCount)
+		h.ownPool = true
+	}
+	logging.DebugMethod("count", "Init", "countable remotes (NIP-45): %v", h.remotes())
+	return nil
+}
+
+// Close closes the connections of a private pool; a shared pool is closed
+// by its owner
+func (h *hllCounter) Close() {
+	if h.ownPool {
+		h.pool.Pool().Close()
+	}
+}
+
+// SetRelays replaces the NIP-45 relays counted
+func (h *hllCounter) SetRelays(relays []string) {
+	h.relaysMu.Lock()
+	defer h.relaysMu.Unlock()
+	h.relays = relays
+}
+
+// remotes returns the current NIP-45 relays
+func (h *hllCounter) remotes() []string {
+	h.relaysMu.RLock()
+	defer h.relaysMu.RUnlock()
+	return h.relays
+}
+
+// CountEventsHLL counts events on all NIP-45 upstreams. When at least one
+// upstream returns HLL registers the merged HLL estimate is returned together
+// with the HLL itself; otherwise the largest scalar count is returned, since
+// scalar counts from different relays overlap and cannot be summed.
+func (h *hllCounter) CountEventsHLL(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+	atomic.AddInt64(&h.requests, 1)
+
+	if khatru.IsInternalCall(ctx) {
+		atomic.AddInt64(&h.internalRequests, 1)
+		logging.DebugMethod("count", "CountEventsHLL", "internal count short-circuited filter=%+v", filter)
+		return 0, nil, nil
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, relaystore.QueryTimeoutDuration)
+	defer cancel()
+
+	var mu sync.Mutex
+	var merged *hyperloglog.HyperLogLog
+	var maxScalar int64
+	var responses int
+	var errs relayerrors.MultiError
+
+	var wg sync.WaitGroup
+	for _, url := range h.remotes() {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := h.penalties.EnsureRelay(h.pool, url)
+			if err != nil {
+				atomic.AddInt64(&h.upstreamFailures, 1)
+				errs.Add(url, err)
+				logging.DebugMethod("count", "CountEventsHLL", "failed to ensure relay %s: %v", url, err)
+				return
+			}
+			count, registers, err := relay.Count(timeoutCtx, nostr.Filters{filter})
+			if err != nil {
+				atomic.AddInt64(&h.upstreamFailures, 1)
+				errs.Add(url, err)
+				logging.DebugMethod("count", "CountEventsHLL", "count on %s failed: %v", url, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			responses++
+			if count > maxScalar {
+				maxScalar = count
+			}
+			if len(registers) != hllRegistersSize {
+				atomic.AddInt64(&h.scalarResponses, 1)
+				return
+			}
+			atomic.AddInt64(&h.hllResponses, 1)
+			if merged == nil {
+				merged = hyperloglog.New(offset)
+			}
+			merged.MergeRegisters(registers)
+		}(url)
+	}
+	wg.Wait()
+
+	// only fail when no upstream answered, reporting every relay's reason
+	if responses == 0 && errs.Len() > 0 {
+		logging.DebugMethod("count", "CountEventsHLL", "all upstreams failed: %v", &errs)
+		return 0, nil, &errs
+	}
+
+	if merged == nil {
+		logging.DebugMethod("count", "CountEventsHLL", "no upstream returned HLL, using scalar count %d", maxScalar)
+		return maxScalar, nil, nil
+	}
+
+	atomic.AddInt64(&h.mergedHLLReturned, 1)
+	total := int64(merged.Count())
+	logging.DebugMethod("count", "CountEventsHLL", "merged HLL estimate %d (offset %d)", total, offset)
+	return total, merged, nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (h *hllCounter) GetStatsName() string {
+	return "count_hll"
+}
+
+// GetStats returns stats as JsonEntity
+func (h *hllCounter) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("requests", jsonlib.NewJsonValue(atomic.LoadInt64(&h.requests)))
+	obj.Set("internal_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&h.internalRequests)))
+	obj.Set("hll_responses", jsonlib.NewJsonValue(atomic.LoadInt64(&h.hllResponses)))
+	obj.Set("scalar_responses", jsonlib.NewJsonValue(atomic.LoadInt64(&h.scalarResponses)))
+	obj.Set("upstream_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&h.upstreamFailures)))
+	obj.Set("merged_hll_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&h.mergedHLLReturned)))
+	obj.Set("countable_relays", jsonlib.NewJsonValue(len(h.remotes())))
+	return obj
+}
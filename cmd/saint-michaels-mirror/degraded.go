@@ -0,0 +1,102 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Degraded startup and upstream recovery for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+)
+
+// Backoff bounds for retrying upstream connections while degraded
+const (
+	DegradedRetryInitialBackoff = 5 * time.Second
+	DegradedRetryMaxBackoff     = 2 * time.Minute
+)
+
+// upstreamRecovery keeps retrying to start mirroring when no upstream was
+// reachable at startup, reporting RED health until it succeeds.
+type upstreamRecovery struct {
+	mm    *mirror.MirrorManager
+	relay *khatru.Relay
+	// state
+	degraded      int32
+	retryAttempts int64
+	degradedSince int64
+	recoveredAt   int64
+}
+
+// newUpstreamRecovery creates a recovery loop for the mirror manager
+func newUpstreamRecovery(mm *mirror.MirrorManager, relay *khatru.Relay) *upstreamRecovery {
+	return &upstreamRecovery{mm: mm, relay: relay}
+}
+
+// Start marks the relay as degraded and retries mirroring in the background
+// until it starts or ctx is cancelled.
+func (u *upstreamRecovery) Start(ctx context.Context, cause error) {
+	atomic.StoreInt32(&u.degraded, 1)
+	atomic.StoreInt64(&u.degradedSince, time.Now().Unix())
+	logging.Warn("starting in degraded mode: %v", cause)
+
+	go func() {
+		backoff := DegradedRetryInitialBackoff
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			atomic.AddInt64(&u.retryAttempts, 1)
+			if err := u.mm.StartMirroring(u.relay); err != nil {
+				logging.DebugMethod("degraded", "Start", "upstreams still unavailable (retry in %v): %v", backoff, err)
+				backoff *= 2
+				if backoff > DegradedRetryMaxBackoff {
+					backoff = DegradedRetryMaxBackoff
+				}
+				continue
+			}
+
+			atomic.StoreInt32(&u.degraded, 0)
+			atomic.StoreInt64(&u.recoveredAt, time.Now().Unix())
+			logging.Info("upstreams reachable again after %d retries, leaving degraded mode", atomic.LoadInt64(&u.retryAttempts))
+			return
+		}
+	}()
+}
+
+// IsDegraded reports whether the relay is still waiting for upstreams
+func (u *upstreamRecovery) IsDegraded() bool {
+	return atomic.LoadInt32(&u.degraded) == 1
+}
+
+// GetStatsName returns the name of this stats provider
+func (u *upstreamRecovery) GetStatsName() string {
+	return "startup"
+}
+
+// GetStats returns stats as JsonEntity
+func (u *upstreamRecovery) GetStats() jsonlib.JsonEntity {
+	healthState := HealthGreen
+	if u.IsDegraded() {
+		healthState = HealthRed
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("degraded", jsonlib.NewJsonValue(u.IsDegraded()))
+	obj.Set("health_state", jsonlib.NewJsonValue(healthState))
+	obj.Set("retry_attempts", jsonlib.NewJsonValue(atomic.LoadInt64(&u.retryAttempts)))
+	obj.Set("degraded_since", jsonlib.NewJsonValue(atomic.LoadInt64(&u.degradedSince)))
+	obj.Set("recovered_at", jsonlib.NewJsonValue(atomic.LoadInt64(&u.recoveredAt)))
+	return obj
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Demotion of misbehaving query remotes for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultDemotionProbeInterval is how often query remotes are re-probed
+const DefaultDemotionProbeInterval = 10 * time.Minute
+
+// Demotion reasons
+const (
+	DemotionRejectsQueries = "rejects_queries"
+	DemotionMalformedInfo  = "malformed_nip11"
+	DemotionAuthRequired   = "auth_required"
+)
+
+// demotionEntry tracks the misbehaviour of one query remote
+type demotionEntry struct {
+	rejections     int // consecutive queries closed by the relay
+	malformedInfo  int // consecutive NIP-11 probes returning invalid JSON
+	reason         string
+	since          time.Time
+	lastCanary     time.Time
+	timesDemoted   int64
+	lastRejection  string
+	lastProbeError string
+}
+
+// relayDemoter stops querying query remotes that are useless to us: relays
+// that close every REQ, keep serving malformed NIP-11, or keep closing
+// queries with auth-required after the relaystore tried to authenticate.
+// Advertising auth_required in NIP-11 alone does not demote a relay, since
+// the relaystore answers its AUTH challenges. Demoted relays are left out of
+// the fanout, so they no longer count against query health, but keep being
+// probed: their NIP-11 every probe interval, and one real query per probe
+// interval as a canary. A demoted relay is restored as soon as it answers a
+// query or its NIP-11 is fixed.
+type relayDemoter struct {
+	rs            *relaystore.RelayStore
+	threshold     int
+	probeInterval time.Duration
+	mu            sync.Mutex
+	relays        map[string]*demotionEntry // by normalized URL
+	// stats
+	demotions    int64
+	restorations int64
+	probes       int64
+}
+
+// newRelayDemoter demotes relays after threshold consecutive rejected queries
+// or malformed NIP-11 probes
+func newRelayDemoter(rs *relaystore.RelayStore, threshold int, probeInterval time.Duration) *relayDemoter {
+	if probeInterval <= 0 {
+		probeInterval = DefaultDemotionProbeInterval
+	}
+	return &relayDemoter{
+		rs:            rs,
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		relays:        map[string]*demotionEntry{},
+	}
+}
+
+// entry returns the entry of url, creating it; callers hold d.mu
+func (d *relayDemoter) entry(url string) *demotionEntry {
+	e, ok := d.relays[url]
+	if !ok {
+		e = &demotionEntry{}
+		d.relays[url] = e
+	}
+	return e
+}
+
+// demote takes url out of the fanout; callers hold d.mu
+func (d *relayDemoter) demote(url string, e *demotionEntry, reason string) {
+	if e.reason == reason {
+		return
+	}
+	if e.reason == "" {
+		e.since = time.Now()
+		e.lastCanary = e.since
+		e.timesDemoted++
+		d.demotions++
+	}
+	e.reason = reason
+	logging.Warn("demoting query remote %s: %s", url, reason)
+}
+
+// restore puts url back in the fanout; callers hold d.mu
+func (d *relayDemoter) restore(url string, e *demotionEntry) {
+	if e.reason == "" {
+		return
+	}
+	logging.Info("restoring query remote %s, demoted for %s since %v", url, e.reason, e.since.Format(time.RFC3339))
+	e.reason = ""
+	d.restorations++
+}
+
+// Observe counts queries closed by the relay; a query reaching EOSE clears
+// the count and restores a relay demoted for rejecting queries. Queries the
+// relaystore could not authenticate for reach here still closed with
+// auth-required, and demote the relay for that reason. Connection failures
+// and timeouts are left to the penalty box and health checks.
+func (d *relayDemoter) Observe(url string, firstEvent, eose time.Duration, err error) {
+	url = nostr.NormalizeURL(url)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.entry(url)
+	switch {
+	case err == nil && eose > 0:
+		e.rejections = 0
+		if e.reason == DemotionRejectsQueries || e.reason == DemotionAuthRequired {
+			d.restore(url, e)
+		}
+	case errors.Is(err, relayerrors.ErrClosed):
+		e.rejections++
+		e.lastRejection = err.Error()
+		if e.rejections >= d.threshold && e.reason == "" {
+			reason := DemotionRejectsQueries
+			if relayerrors.Prefix(err) == relayerrors.PrefixAuthRequired {
+				reason = DemotionAuthRequired
+			}
+			d.demote(url, e, reason)
+		}
+	}
+}
+
+// Order drops demoted relays from urls, except for one canary query per
+// probe interval. If every relay is demoted all are kept, since queries
+// would otherwise have nowhere to go.
+func (d *relayDemoter) Order(urls []string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := make([]string, 0, len(urls))
+	for _, url := range urls {
+		e, ok := d.relays[nostr.NormalizeURL(url)]
+		if !ok || e.reason == "" {
+			kept = append(kept, url)
+			continue
+		}
+		if e.reason != DemotionMalformedInfo && time.Since(e.lastCanary) >= d.probeInterval {
+			e.lastCanary = time.Now()
+			kept = append(kept, url)
+		}
+	}
+	if len(kept) == 0 {
+		return urls
+	}
+	return kept
+}
+
+// Start probes the NIP-11 of every query remote each probe interval until
+// ctx is done
+func (d *relayDemoter) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.probeInterval)
+		defer ticker.Stop()
+		for {
+			d.probe(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probe fetches the NIP-11 of every query remote and demotes or restores
+// them on what it says. Unreachable relays are left to the penalty box.
+func (d *relayDemoter) probe(ctx context.Context) {
+	for _, url := range d.rs.QueryRemotes() {
+		url = nostr.NormalizeURL(url)
+		if url == "" {
+			continue
+		}
+		_, err := fetchRelayInfo(ctx, url)
+		d.mu.Lock()
+		d.probes++
+		e := d.entry(url)
+		switch {
+		case err != nil && strings.HasPrefix(err.Error(), "invalid json"):
+			e.malformedInfo++
+			e.lastProbeError = err.Error()
+			if e.malformedInfo >= d.threshold && e.reason == "" {
+				d.demote(url, e, DemotionMalformedInfo)
+			}
+		case err != nil:
+			logging.DebugMethod("demotion", "probe", "failed probing NIP-11 for %s: %v", url, err)
+		default:
+			e.malformedInfo = 0
+			if e.reason == DemotionMalformedInfo {
+				d.restore(url, e)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (d *relayDemoter) GetStatsName() string {
+	return "demotion"
+}
+
+// GetStats returns stats as JsonEntity
+func (d *relayDemoter) GetStats() jsonlib.JsonEntity {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	urls := make([]string, 0, len(d.relays))
+	for url := range d.relays {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	demoted := 0
+	list := jsonlib.NewJsonList()
+	for _, url := range urls {
+		e := d.relays[url]
+		if e.reason != "" {
+			demoted++
+		}
+		if e.reason == "" && e.timesDemoted == 0 && e.rejections == 0 && e.malformedInfo == 0 {
+			continue
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("relay", jsonlib.NewJsonValue(url))
+		obj.Set("demoted", jsonlib.NewJsonValue(e.reason != ""))
+		obj.Set("reason", jsonlib.NewJsonValue(e.reason))
+		if e.reason != "" {
+			obj.Set("demoted_since", jsonlib.NewJsonValue(e.since.Unix()))
+		}
+		obj.Set("times_demoted", jsonlib.NewJsonValue(e.timesDemoted))
+		obj.Set("consecutive_rejections", jsonlib.NewJsonValue(e.rejections))
+		obj.Set("consecutive_malformed_nip11", jsonlib.NewJsonValue(e.malformedInfo))
+		obj.Set("last_rejection", jsonlib.NewJsonValue(e.lastRejection))
+		obj.Set("last_probe_error", jsonlib.NewJsonValue(e.lastProbeError))
+		list.Append(obj)
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("threshold", jsonlib.NewJsonValue(d.threshold))
+	obj.Set("probe_interval", jsonlib.NewJsonValue(d.probeInterval.String()))
+	obj.Set("demoted", jsonlib.NewJsonValue(demoted))
+	obj.Set("demotions", jsonlib.NewJsonValue(d.demotions))
+	obj.Set("restorations", jsonlib.NewJsonValue(d.restorations))
+	obj.Set("probes", jsonlib.NewJsonValue(d.probes))
+	obj.Set("relays", list)
+	return obj
+}
@@ -0,0 +1,430 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Periodic operator digest for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip17"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Digest tuning
+const (
+	// DigestSampleInterval is how often upstream availability is sampled
+	// between two digests
+	DigestSampleInterval = time.Minute
+	// DigestTopAuthors is how many of the most rejected authors a digest lists
+	DigestTopAuthors = 10
+	// DigestDMTimeout bounds looking up the admin's DM relays and queueing
+	// the digest for them
+	DigestDMTimeout = 30 * time.Second
+)
+
+// digestCounters are the cumulative counters a digest reports the change of
+type digestCounters struct {
+	received      int64
+	mirrored      int64
+	duplicates    int64
+	published     int64
+	publishFailed int64
+	rejects       map[string]int64 // events by policy
+}
+
+// authorCount is how many events of one author were rejected
+type authorCount struct {
+	pubkey string
+	events int64
+}
+
+// digestReport is what happened during one digest period
+type digestReport struct {
+	from, to          time.Time
+	received          int64
+	mirrored          int64
+	duplicates        int64
+	rejected          int64
+	rejectsByPolicy   map[string]int64
+	topAuthors        []authorCount
+	authors           int   // distinct authors rejected
+	untrackedRejected int64 // rejections of authors beyond maxRejectedAuthors
+	published         int64
+	publishFailed     int64
+	querySamples      int64
+	queryAvailability float64 // percent of query remotes reachable, averaged
+	queryLowest       float64
+	mirrorLive        int64
+	mirrorDead        int64
+}
+
+// operatorDigest logs a summary of what the relay did every interval:
+// events received and mirrored, duplicates suppressed, events rejected by
+// each local policy and the authors rejected most, publishing outcomes and
+// how available the upstreams were. With an admin pubkey it also sends the
+// summary to the admin as a NIP-17 direct message from the relay key, so
+// operators get a digest without watching logs or dashboards.
+type operatorDigest struct {
+	interval time.Duration
+	admin    string // hex pubkey, empty for logs only
+	khatru   *khatruStats
+	mirror   *mirror.MirrorManager
+	pub      *publisher // nil without broadcasting
+	rs       *relaystore.RelayStore
+	identity *relayIdentity
+	query    queryFunc
+	mu       sync.Mutex
+	since    time.Time
+	base     digestCounters
+	// query remote availability samples of the current period
+	samples   int64
+	available float64 // sum of the sampled percentages
+	lowest    float64
+	last      *digestReport
+	// stats
+	reports  int64
+	dmSent   int64
+	dmFailed int64
+}
+
+// newOperatorDigest creates a digest every interval, sent to admin if it is
+// not empty
+func newOperatorDigest(interval time.Duration, admin string, ks *khatruStats, mm *mirror.MirrorManager, pub *publisher, rs *relaystore.RelayStore, identity *relayIdentity) (*operatorDigest, error) {
+	d := &operatorDigest{
+		interval: interval,
+		khatru:   ks,
+		mirror:   mm,
+		pub:      pub,
+		rs:       rs,
+		identity: identity,
+		query:    rs.QueryEvents,
+	}
+	if admin != "" {
+		pubkey, err := parsePubKey(admin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DIGEST_ADMIN_PUBKEY: %w", err)
+		}
+		d.admin = pubkey
+	}
+	policyRejects.TrackAuthors()
+	d.since = time.Now()
+	d.base = d.counters()
+	d.lowest = 100
+	return d, nil
+}
+
+// counters reads the cumulative counters
+func (d *operatorDigest) counters() digestCounters {
+	c := digestCounters{
+		received: atomic.LoadInt64(&d.khatru.eventsReceived),
+		mirrored: d.mirror.Stats().MirroredEvents,
+		rejects:  policyRejects.eventRejects(),
+	}
+	c.duplicates = c.rejects["recently_published"]
+	if d.pub != nil {
+		c.duplicates += atomic.LoadInt64(&d.pub.duplicates)
+		c.published = atomic.LoadInt64(&d.pub.eventsAccepted)
+		c.publishFailed = atomic.LoadInt64(&d.pub.eventsFailed)
+	}
+	return c
+}
+
+// Start samples upstream availability and sends a digest every interval
+// until ctx is done
+func (d *operatorDigest) Start(ctx context.Context) {
+	go func() {
+		sample := time.NewTicker(min(DigestSampleInterval, d.interval))
+		defer sample.Stop()
+		digest := time.NewTicker(d.interval)
+		defer digest.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sample.C:
+				d.sample()
+			case <-digest.C:
+				d.send(ctx, d.take())
+			}
+		}
+	}()
+}
+
+// sample records how many query remotes are reachable
+func (d *operatorDigest) sample() {
+	reachable, total := d.rs.Reachability()
+	if total == 0 {
+		return
+	}
+	percent := float64(reachable) * 100 / float64(total)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples++
+	d.available += percent
+	d.lowest = min(d.lowest, percent)
+}
+
+// take closes the current period and returns its report
+func (d *operatorDigest) take() *digestReport {
+	now := d.counters()
+	authors, untracked := policyRejects.TakeRejectedAuthors()
+	mirrorStats := d.mirror.Stats()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := &digestReport{
+		from:              d.since,
+		to:                time.Now(),
+		received:          now.received - d.base.received,
+		mirrored:          now.mirrored - d.base.mirrored,
+		duplicates:        now.duplicates - d.base.duplicates,
+		published:         now.published - d.base.published,
+		publishFailed:     now.publishFailed - d.base.publishFailed,
+		rejectsByPolicy:   map[string]int64{},
+		authors:           len(authors),
+		untrackedRejected: untracked,
+		querySamples:      d.samples,
+		mirrorLive:        mirrorStats.LiveRelays,
+		mirrorDead:        mirrorStats.DeadRelays,
+	}
+	for policy, n := range now.rejects {
+		if n -= d.base.rejects[policy]; n > 0 {
+			r.rejectsByPolicy[policy] = n
+			r.rejected += n
+		}
+	}
+	for pubkey, n := range authors {
+		r.topAuthors = append(r.topAuthors, authorCount{pubkey, n})
+	}
+	sort.Slice(r.topAuthors, func(i, j int) bool {
+		if r.topAuthors[i].events != r.topAuthors[j].events {
+			return r.topAuthors[i].events > r.topAuthors[j].events
+		}
+		return r.topAuthors[i].pubkey < r.topAuthors[j].pubkey
+	})
+	r.topAuthors = r.topAuthors[:min(len(r.topAuthors), DigestTopAuthors)]
+	if d.samples > 0 {
+		r.queryAvailability = float64(int64(d.available*10/float64(d.samples))) / 10
+		r.queryLowest = float64(int64(d.lowest*10)) / 10
+	}
+
+	d.since, d.base = r.to, now
+	d.samples, d.available, d.lowest = 0, 0, 100
+	d.last = r
+	d.reports++
+	return r
+}
+
+// ForgetPubKey drops pubkey from the rejections counted for the current
+// period and from the last report, returning how many entries there were
+func (d *operatorDigest) ForgetPubKey(pubkey string) int {
+	n := policyRejects.ForgetPubKey(pubkey)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last != nil {
+		kept := make([]authorCount, 0, len(d.last.topAuthors))
+		for _, a := range d.last.topAuthors {
+			if a.pubkey != pubkey {
+				kept = append(kept, a)
+			}
+		}
+		n += len(d.last.topAuthors) - len(kept)
+		d.last.topAuthors = kept
+	}
+	return n
+}
+
+// Text renders the report for logs and direct messages
+func (r *digestReport) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s digest for %s to %s\n", ProjectName, r.from.UTC().Format(time.RFC3339), r.to.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Events: %d received from clients, %d mirrored\n", r.received, r.mirrored)
+	fmt.Fprintf(&b, "Duplicates suppressed: %d\n", r.duplicates)
+	policies := make([]string, 0, len(r.rejectsByPolicy))
+	for policy := range r.rejectsByPolicy {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		a, b := r.rejectsByPolicy[policies[i]], r.rejectsByPolicy[policies[j]]
+		if a != b {
+			return a > b
+		}
+		return policies[i] < policies[j]
+	})
+	byPolicy := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		byPolicy = append(byPolicy, fmt.Sprintf("%s %d", policy, r.rejectsByPolicy[policy]))
+	}
+	if len(byPolicy) > 0 {
+		fmt.Fprintf(&b, "Rejected by policy: %d (%s)\n", r.rejected, strings.Join(byPolicy, ", "))
+	} else {
+		fmt.Fprintf(&b, "Rejected by policy: 0\n")
+	}
+	if len(r.topAuthors) > 0 {
+		top := make([]string, 0, len(r.topAuthors))
+		for _, a := range r.topAuthors {
+			npub, _ := nip19.EncodePublicKey(a.pubkey)
+			top = append(top, fmt.Sprintf("%s %d", npub, a.events))
+		}
+		fmt.Fprintf(&b, "Most rejected authors (%d in all): %s\n", r.authors, strings.Join(top, ", "))
+	}
+	if total := r.published + r.publishFailed; total > 0 {
+		fmt.Fprintf(&b, "Published upstream: %d accepted, %d failed (%.1f%% accepted)\n", r.published, r.publishFailed, percentOf(r.published, total))
+	}
+	if r.querySamples > 0 {
+		fmt.Fprintf(&b, "Query remotes reachable: %.1f%% on average, %.1f%% at worst\n", r.queryAvailability, r.queryLowest)
+	}
+	fmt.Fprintf(&b, "Mirror relays: %d live, %d dead", r.mirrorLive, r.mirrorDead)
+	return b.String()
+}
+
+// JSON renders the report for the stats
+func (r *digestReport) JSON() *jsonlib.JsonObject {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("from", jsonlib.NewJsonValue(r.from.Unix()))
+	obj.Set("to", jsonlib.NewJsonValue(r.to.Unix()))
+	obj.Set("events_received", jsonlib.NewJsonValue(r.received))
+	obj.Set("events_mirrored", jsonlib.NewJsonValue(r.mirrored))
+	obj.Set("duplicates_suppressed", jsonlib.NewJsonValue(r.duplicates))
+	obj.Set("rejected", jsonlib.NewJsonValue(r.rejected))
+	byPolicy := jsonlib.NewJsonObject()
+	policies := make([]string, 0, len(r.rejectsByPolicy))
+	for policy := range r.rejectsByPolicy {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+	for _, policy := range policies {
+		byPolicy.Set(policy, jsonlib.NewJsonValue(r.rejectsByPolicy[policy]))
+	}
+	obj.Set("rejected_by_policy", byPolicy)
+	top := jsonlib.NewJsonList()
+	for _, a := range r.topAuthors {
+		author := jsonlib.NewJsonObject()
+		author.Set("pubkey", jsonlib.NewJsonValue(a.pubkey))
+		author.Set("events", jsonlib.NewJsonValue(a.events))
+		top.Append(author)
+	}
+	obj.Set("top_rejected_authors", top)
+	obj.Set("rejected_authors", jsonlib.NewJsonValue(r.authors))
+	obj.Set("rejected_untracked_authors", jsonlib.NewJsonValue(r.untrackedRejected))
+	obj.Set("published", jsonlib.NewJsonValue(r.published))
+	obj.Set("publish_failed", jsonlib.NewJsonValue(r.publishFailed))
+	if r.querySamples > 0 {
+		obj.Set("query_availability_percent", jsonlib.NewJsonValue(r.queryAvailability))
+		obj.Set("query_availability_lowest_percent", jsonlib.NewJsonValue(r.queryLowest))
+	}
+	obj.Set("mirror_live_relays", jsonlib.NewJsonValue(r.mirrorLive))
+	obj.Set("mirror_dead_relays", jsonlib.NewJsonValue(r.mirrorDead))
+	return obj
+}
+
+// send logs r and sends it to the admin
+func (d *operatorDigest) send(ctx context.Context, r *digestReport) {
+	for _, line := range strings.Split(r.Text(), "\n") {
+		logging.Info("digest: %s", line)
+	}
+	if d.admin == "" {
+		return
+	}
+	if err := d.sendDM(ctx, r.Text()); err != nil {
+		atomic.AddInt64(&d.dmFailed, 1)
+		logging.Warn("failed to send the digest to the admin: %v", err)
+		return
+	}
+	atomic.AddInt64(&d.dmSent, 1)
+}
+
+// sendDM gift wraps text for the admin and publishes it to the broadcast
+// relays and, as a relay hint, the first of the admin's DM relays
+func (d *operatorDigest) sendDM(ctx context.Context, text string) error {
+	if d.pub == nil {
+		return errors.New("no broadcast relays configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, DigestDMTimeout)
+	defer cancel()
+	signer, err := d.identity.Keyer()
+	if err != nil {
+		return err
+	}
+	inbox := d.dmRelay(ctx)
+	_, toAdmin, err := nip17.PrepareMessage(ctx, text, nostr.Tags{}, signer, d.admin, func(wrap *nostr.Event) {
+		if inbox == "" {
+			return
+		}
+		for i, tag := range wrap.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				wrap.Tags[i] = nostr.Tag{"p", tag[1], inbox}
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return d.pub.SaveEvent(ctx, &toAdmin)
+}
+
+// dmRelay returns the first relay of the admin's NIP-17 DM relay list, or ""
+func (d *operatorDigest) dmRelay(ctx context.Context) string {
+	ch, err := d.query(withSubscriptionID(ctx, "digest-dm-relays"), nostr.Filter{
+		Kinds:   []int{nostr.KindDMRelayList},
+		Authors: []string{d.admin},
+		Limit:   1,
+	})
+	if err != nil {
+		return ""
+	}
+	var newest *nostr.Event
+	for evt := range ch {
+		if newest == nil || evt.CreatedAt > newest.CreatedAt {
+			newest = evt
+		}
+	}
+	if newest == nil {
+		return ""
+	}
+	for _, tag := range newest.Tags {
+		if len(tag) >= 2 && tag[0] == "relay" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// GetStatsName returns the name of this stats provider
+func (d *operatorDigest) GetStatsName() string {
+	return "digest"
+}
+
+// GetStats returns stats as JsonEntity
+func (d *operatorDigest) GetStats() jsonlib.JsonEntity {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("interval", jsonlib.NewJsonValue(d.interval.String()))
+	obj.Set("dm_admin", jsonlib.NewJsonValue(d.admin != ""))
+	obj.Set("period_start", jsonlib.NewJsonValue(d.since.Unix()))
+	obj.Set("reports", jsonlib.NewJsonValue(d.reports))
+	obj.Set("dm_sent", jsonlib.NewJsonValue(atomic.LoadInt64(&d.dmSent)))
+	obj.Set("dm_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&d.dmFailed)))
+	if d.last != nil {
+		obj.Set("last", d.last.JSON())
+	}
+	return obj
+}
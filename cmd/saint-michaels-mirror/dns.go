@@ -0,0 +1,316 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Periodic DNS re-resolution of upstream relays for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DNSLookupTimeout bounds a single host lookup
+const DNSLookupTimeout = 5 * time.Second
+
+// dnsRecord is the last resolution of one relay host
+type dnsRecord struct {
+	host         string
+	addresses    []string
+	lastResolved time.Time
+	lastChanged  time.Time
+	changes      int64
+	reconnects   int64
+	lastError    string
+}
+
+// dnsWatcher periodically re-resolves the hosts of upstream relays. Long-lived
+// websocket connections keep the address resolved when they were opened, so
+// when a host's address set no longer holds an address connections are open
+// to, the connections in the registered pools are closed and reopened against
+// the new addresses on next use. Hosts merely gaining addresses, or rotating
+// them as round-robin DNS does, keep their connections.
+type dnsWatcher struct {
+	interval time.Duration
+	resolver *net.Resolver
+	mu       sync.Mutex
+	relays   []string
+	pools    []*nostr.SimplePool
+	records  map[string]*dnsRecord     // by relay URL
+	peers    map[string]map[string]int // open connections by host and peer address
+	// stats
+	rounds int64
+}
+
+// newDNSWatcher creates a watcher that re-resolves every interval
+func newDNSWatcher(interval time.Duration) *dnsWatcher {
+	return &dnsWatcher{
+		interval: interval,
+		resolver: net.DefaultResolver,
+		records:  map[string]*dnsRecord{},
+		peers:    map[string]map[string]int{},
+	}
+}
+
+// InstallDialer makes outgoing connections of http.DefaultTransport, which
+// go-nostr uses for websocket dials, tell the watcher which address each host
+// is connected to. go-nostr does not expose the peer of a relay connection.
+func (d *dnsWatcher) InstallDialer() {
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		logging.Warn("cannot track upstream addresses: default transport is %T", http.DefaultTransport)
+		return
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = d.trackPeers(dial)
+}
+
+// trackPeers wraps dial so the connections it opens are counted by peer
+// address until closed
+func (d *dnsWatcher) trackPeers(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return conn, nil
+		}
+		peer, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		d.connected(host, peer, 1)
+		return &peerConn{Conn: conn, closed: func() { d.connected(host, peer, -1) }}, nil
+	}
+}
+
+// connected counts delta connections to host at peer
+func (d *dnsWatcher) connected(host, peer string, delta int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := d.peers[host]
+	if peers == nil {
+		peers = map[string]int{}
+		d.peers[host] = peers
+	}
+	if peers[peer] += delta; peers[peer] <= 0 {
+		delete(peers, peer)
+	}
+	if len(peers) == 0 {
+		delete(d.peers, host)
+	}
+}
+
+// peerConn reports its closing once
+type peerConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// Watch adds static relay URLs to re-resolve
+func (d *dnsWatcher) Watch(urls ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, url := range urls {
+		url = nostr.NormalizeURL(url)
+		if !slices.Contains(d.relays, url) {
+			d.relays = append(d.relays, url)
+		}
+	}
+}
+
+// WatchPool re-resolves every relay connected through pool and reconnects them on change
+func (d *dnsWatcher) WatchPool(pool *nostr.SimplePool) {
+	if pool == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pools = append(d.pools, pool)
+}
+
+// Start runs the re-resolution loop until ctx is cancelled
+func (d *dnsWatcher) Start(ctx context.Context) {
+	go func() {
+		d.refresh(ctx)
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.refresh(ctx)
+			}
+		}
+	}()
+}
+
+// urls returns the static relays plus every relay known to the pools
+func (d *dnsWatcher) urls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	urls := slices.Clone(d.relays)
+	for _, pool := range d.pools {
+		pool.Relays.Range(func(url string, _ *nostr.Relay) bool {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+			return true
+		})
+	}
+	return urls
+}
+
+// refresh resolves all relays once
+func (d *dnsWatcher) refresh(ctx context.Context) {
+	for _, url := range d.urls() {
+		parsed, err := neturl.Parse(url)
+		if err != nil || parsed.Hostname() == "" || net.ParseIP(parsed.Hostname()) != nil {
+			continue
+		}
+		host := parsed.Hostname()
+
+		lookupCtx, cancel := context.WithTimeout(ctx, DNSLookupTimeout)
+		addresses, err := d.resolver.LookupHost(lookupCtx, host)
+		cancel()
+		sort.Strings(addresses)
+
+		if d.record(url, host, addresses, err) {
+			d.reconnect(url)
+		}
+	}
+
+	d.mu.Lock()
+	d.rounds++
+	d.mu.Unlock()
+}
+
+// record stores a resolution and reports whether connections to url must be
+// reopened: the address set changed and no longer holds an address the host
+// is connected to. Without a known peer, e.g. when the dialer is not
+// installed, any change reopens them.
+func (d *dnsWatcher) record(url, host string, addresses []string, err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rec, ok := d.records[url]
+	if !ok {
+		rec = &dnsRecord{host: host}
+		d.records[url] = rec
+	}
+	now := time.Now()
+	if err != nil {
+		// keep the last good addresses, a failed lookup is not a change
+		rec.lastError = err.Error()
+		logging.DebugMethod("dns", "refresh", "lookup of %s failed: %v", host, err)
+		return false
+	}
+	rec.lastError = ""
+	rec.lastResolved = now
+	if slices.Equal(rec.addresses, addresses) {
+		return false
+	}
+	previous := rec.addresses
+	rec.addresses = addresses
+	rec.lastChanged = now
+	if previous == nil {
+		return false
+	}
+	rec.changes++
+	stale := len(d.peers[host]) == 0
+	for peer := range d.peers[host] {
+		if !slices.Contains(addresses, peer) {
+			stale = true
+		}
+	}
+	if !stale {
+		logging.Info("upstream %s moved from %v to %v, connections still valid", host, previous, addresses)
+		return false
+	}
+	logging.Info("upstream %s moved from %v to %v, reconnecting", host, previous, addresses)
+	return true
+}
+
+// reconnect closes the pooled connections to url so they are reopened
+func (d *dnsWatcher) reconnect(url string) {
+	d.mu.Lock()
+	pools := slices.Clone(d.pools)
+	d.mu.Unlock()
+
+	for _, pool := range pools {
+		relay, ok := pool.Relays.Load(url)
+		if !ok || relay == nil {
+			continue
+		}
+		relay.Close()
+		d.mu.Lock()
+		d.records[url].reconnects++
+		d.mu.Unlock()
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (d *dnsWatcher) GetStatsName() string {
+	return "dns"
+}
+
+// GetStats returns stats as JsonEntity
+func (d *dnsWatcher) GetStats() jsonlib.JsonEntity {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("refresh_interval", jsonlib.NewJsonValue(d.interval.String()))
+	obj.Set("rounds", jsonlib.NewJsonValue(d.rounds))
+
+	urls := make([]string, 0, len(d.records))
+	for url := range d.records {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	relays := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		rec := d.records[url]
+		addresses := jsonlib.NewJsonList()
+		for _, addr := range rec.addresses {
+			addresses.Append(jsonlib.NewJsonValue(addr))
+		}
+		relayObj := jsonlib.NewJsonObject()
+		relayObj.Set("host", jsonlib.NewJsonValue(rec.host))
+		relayObj.Set("addresses", addresses)
+		relayObj.Set("last_resolved", jsonlib.NewJsonValue(rec.lastResolved.Unix()))
+		relayObj.Set("last_changed", jsonlib.NewJsonValue(rec.lastChanged.Unix()))
+		relayObj.Set("changes", jsonlib.NewJsonValue(rec.changes))
+		relayObj.Set("reconnects", jsonlib.NewJsonValue(rec.reconnects))
+		if rec.lastError != "" {
+			relayObj.Set("last_error", jsonlib.NewJsonValue(rec.lastError))
+		}
+		relays.Set(url, relayObj)
+	}
+	obj.Set("relays", relays)
+	return obj
+}
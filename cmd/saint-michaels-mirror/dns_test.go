@@ -0,0 +1,98 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the DNS re-resolution of upstream relays for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSRecord(t *testing.T) {
+	const url, host = "wss://relay.example.com", "relay.example.com"
+	tests := []struct {
+		name      string
+		peers     []string
+		next      []string
+		err       error
+		reconnect bool
+		changes   int64
+	}{
+		{"unchanged", []string{"192.0.2.1"}, []string{"192.0.2.1", "192.0.2.2"}, nil, false, 0},
+		{"failed lookup", nil, nil, errors.New("no such host"), false, 0},
+		{"address added", []string{"192.0.2.1"}, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, nil, false, 1},
+		{"other address removed", []string{"192.0.2.1"}, []string{"192.0.2.1"}, nil, false, 1},
+		{"connected address removed", []string{"192.0.2.2"}, []string{"192.0.2.1"}, nil, true, 1},
+		{"one of the connected addresses removed", []string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.3"}, nil, true, 1},
+		{"moved", []string{"192.0.2.1"}, []string{"198.51.100.1"}, nil, true, 1},
+		{"no known peer", nil, []string{"192.0.2.1"}, nil, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDNSWatcher(time.Minute)
+			if d.record(url, host, []string{"192.0.2.1", "192.0.2.2"}, nil) {
+				t.Fatal("first resolution asked to reconnect")
+			}
+			for _, peer := range tt.peers {
+				d.connected(host, peer, 1)
+			}
+			if got := d.record(url, host, tt.next, tt.err); got != tt.reconnect {
+				t.Fatalf("record = %v, want %v", got, tt.reconnect)
+			}
+			rec := d.records[url]
+			if rec.changes != tt.changes {
+				t.Fatalf("%d changes recorded, want %d", rec.changes, tt.changes)
+			}
+			if tt.err != nil && (rec.lastError == "" || len(rec.addresses) != 2) {
+				t.Fatalf("failed lookup recorded %q and addresses %v", rec.lastError, rec.addresses)
+			}
+		})
+	}
+}
+
+func TestDNSTrackPeers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := newDNSWatcher(time.Minute)
+	dial := d.trackPeers((&net.Dialer{}).DialContext)
+	a, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.peers["127.0.0.1"]["127.0.0.1"]; n != 2 {
+		t.Fatalf("%d connections to 127.0.0.1 tracked, want 2", n)
+	}
+	a.Close()
+	a.Close()
+	if n := d.peers["127.0.0.1"]["127.0.0.1"]; n != 1 {
+		t.Fatalf("%d connections to 127.0.0.1 tracked after closing one twice, want 1", n)
+	}
+	b.Close()
+	if len(d.peers) != 0 {
+		t.Fatalf("peers = %v after closing every connection, want none", d.peers)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Near-duplicate note detection for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Duplicate content policies
+const (
+	// DuplicateFlag publishes repeated notes but counts and logs them
+	DuplicateFlag = "flag"
+	// DuplicateReject rejects repeated notes with rate-limited:
+	DuplicateReject = "reject"
+)
+
+// Duplicate content tuning
+const (
+	// maxDuplicateTracked bounds the notes remembered within the window
+	maxDuplicateTracked = 100000
+	// maxDuplicateOffenders bounds the authors whose repeats are counted
+	maxDuplicateOffenders = 1000
+)
+
+// duplicateNote is what is remembered of one note content of one author
+type duplicateNote struct {
+	author string
+	first  time.Time
+	copies int
+	lastID string
+}
+
+// duplicateContent catches the same note posted again and again under new
+// ids, which the id-based duplicate checks cannot see: events of the
+// checked kinds are keyed by a hash of their author and their content,
+// lower-cased with whitespace collapsed. Once an author posts more than
+// maxCopies of the same content within window, further copies are flagged,
+// i.e. counted and logged but published, or rejected with rate-limited:.
+type duplicateContent struct {
+	window    time.Duration
+	maxCopies int
+	reject    bool
+	kinds     []kindRange
+	mu        sync.Mutex
+	notes     map[[sha256.Size]byte]*duplicateNote
+	lastPrune time.Time
+	// stats
+	offenders map[string]int64 // repeats by author
+	checked   int64
+	flagged   int64
+	rejected  int64
+	untracked int64
+}
+
+// newDuplicateContent creates the check allowing maxCopies of a note per
+// window under the flag or reject policy; kinds is a comma-separated list
+// of kinds and kind ranges to check
+func newDuplicateContent(window time.Duration, maxCopies int, policy, kinds string) (*duplicateContent, error) {
+	d := &duplicateContent{
+		window:    window,
+		maxCopies: max(maxCopies, 1),
+		notes:     map[[sha256.Size]byte]*duplicateNote{},
+		offenders: map[string]int64{},
+		lastPrune: time.Now(),
+	}
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", DuplicateFlag:
+	case DuplicateReject:
+		d.reject = true
+	default:
+		return nil, fmt.Errorf("invalid DUPLICATE_CONTENT_POLICY %q: must be flag or reject", policy)
+	}
+	var err error
+	if d.kinds, err = parseKindRanges(kinds, "DUPLICATE_CONTENT_KINDS"); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Apply installs the check
+func (d *duplicateContent) Apply(r *khatru.Relay) {
+	r.RejectEvent = append(r.RejectEvent, policyRejects.Event("duplicate_content", d.RejectEvent))
+	action := "flagging"
+	if d.reject {
+		action = "rejecting"
+	}
+	logging.Info("duplicate content: %s notes posted more than %d times within %v", action, d.maxCopies, d.window)
+}
+
+// RejectEvent counts the copies of evt's content and flags or rejects those
+// beyond the allowed number
+func (d *duplicateContent) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !inKindRanges(d.kinds, evt.Kind) {
+		return false, ""
+	}
+	content := strings.Join(strings.Fields(strings.ToLower(evt.Content)), " ")
+	if content == "" {
+		return false, ""
+	}
+	key := sha256.Sum256([]byte(evt.PubKey + "\n" + content))
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checked++
+	if now.Sub(d.lastPrune) > d.window {
+		d.prune(now)
+	}
+	note, ok := d.notes[key]
+	if !ok || now.Sub(note.first) > d.window {
+		if !ok && len(d.notes) >= maxDuplicateTracked {
+			d.untracked++
+			return false, ""
+		}
+		d.notes[key] = &duplicateNote{author: evt.PubKey, first: now, copies: 1, lastID: evt.ID}
+		return false, ""
+	}
+	if evt.ID == note.lastID {
+		// the same event sent again, which the id checks deal with
+		return false, ""
+	}
+	note.copies++
+	note.lastID = evt.ID
+	if note.copies <= d.maxCopies {
+		return false, ""
+	}
+
+	if _, ok := d.offenders[evt.PubKey]; ok || len(d.offenders) < maxDuplicateOffenders {
+		d.offenders[evt.PubKey]++
+	}
+	if !d.reject {
+		d.flagged++
+		logging.DebugMethod("dupcontent", "RejectEvent", "event %s of %s repeats a note posted %d times within %v, from %s", evt.ID, evt.PubKey, note.copies, d.window, khatru.GetIP(ctx))
+		return false, ""
+	}
+	d.rejected++
+	logging.DebugMethod("dupcontent", "RejectEvent", "rejecting event %s of %s: note posted %d times within %v, from %s", evt.ID, evt.PubKey, note.copies, d.window, khatru.GetIP(ctx))
+	return true, fmt.Sprintf("rate-limited: the same note may be posted at most %d times in %v", d.maxCopies, d.window)
+}
+
+// prune forgets the notes first seen more than a window ago; d.mu must be
+// held
+func (d *duplicateContent) prune(now time.Time) {
+	for key, note := range d.notes {
+		if now.Sub(note.first) > d.window {
+			delete(d.notes, key)
+		}
+	}
+	d.lastPrune = now
+}
+
+// ForgetPubKey drops the notes and the repeat count of pubkey, returning how
+// many entries there were
+func (d *duplicateContent) ForgetPubKey(pubkey string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for key, note := range d.notes {
+		if note.author == pubkey {
+			delete(d.notes, key)
+			n++
+		}
+	}
+	if _, ok := d.offenders[pubkey]; ok {
+		delete(d.offenders, pubkey)
+		n++
+	}
+	return n
+}
+
+// GetStatsName returns the name of this stats provider
+func (d *duplicateContent) GetStatsName() string {
+	return "duplicate_content"
+}
+
+// GetStats returns stats as JsonEntity
+func (d *duplicateContent) GetStats() jsonlib.JsonEntity {
+	policy := DuplicateFlag
+	if d.reject {
+		policy = DuplicateReject
+	}
+	d.mu.Lock()
+	type offender struct {
+		pubkey string
+		copies int64
+	}
+	offenders := make([]offender, 0, len(d.offenders))
+	for pubkey, copies := range d.offenders {
+		offenders = append(offenders, offender{pubkey, copies})
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("policy", jsonlib.NewJsonValue(policy))
+	obj.Set("window_seconds", jsonlib.NewJsonValue(int64(d.window.Seconds())))
+	obj.Set("max_copies", jsonlib.NewJsonValue(d.maxCopies))
+	obj.Set("kinds", kindRangesJSON(d.kinds))
+	obj.Set("checked", jsonlib.NewJsonValue(d.checked))
+	obj.Set("tracked", jsonlib.NewJsonValue(len(d.notes)))
+	obj.Set("untracked", jsonlib.NewJsonValue(d.untracked))
+	obj.Set("flagged", jsonlib.NewJsonValue(d.flagged))
+	obj.Set("rejected", jsonlib.NewJsonValue(d.rejected))
+	d.mu.Unlock()
+
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].copies != offenders[j].copies {
+			return offenders[i].copies > offenders[j].copies
+		}
+		return offenders[i].pubkey < offenders[j].pubkey
+	})
+	top := jsonlib.NewJsonObject()
+	for _, o := range offenders[:min(len(offenders), 10)] {
+		top.Set(o.pubkey, jsonlib.NewJsonValue(o.copies))
+	}
+	obj.Set("top_authors", top)
+	return obj
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Enrichment of broadcast events for Espelho de São Miguel.
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eventEnricher is a stage of the enrichment pipeline. Enrich changes evt in
+// place and reports whether it did; tags must be replaced, not modified,
+// since they are shared with the event as received.
+type eventEnricher interface {
+	Name() string
+	Enrich(evt *nostr.Event) bool
+}
+
+// enrichPipeline runs the events the publisher broadcasts through its
+// stages. An enriched event has a new id and needs a new signature, so only
+// events the mirror can sign, those authored by its own key, are enriched;
+// the others are broadcast as they were received.
+type enrichPipeline struct {
+	stages []eventEnricher
+	sign   func(evt *nostr.Event) bool
+	// stats
+	enriched  int64
+	unsigned  int64
+	unchanged int64
+	byStage   []int64 // per stage, in order
+}
+
+// newEnrichPipeline builds the pipeline from BROADCAST_ENRICHMENT stage
+// names; sign signs an event again, reporting whether the mirror holds the
+// key of its author
+func newEnrichPipeline(names []string, clientTag, relayURL string, sign func(evt *nostr.Event) bool) (*enrichPipeline, error) {
+	p := &enrichPipeline{sign: sign}
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "client":
+			p.stages = append(p.stages, clientTagEnricher{name: clientTag})
+		case "proxied_by":
+			if relayURL == "" {
+				return nil, fmt.Errorf("BROADCAST_ENRICHMENT proxied_by requires RELAY_SERVICE_URL")
+			}
+			p.stages = append(p.stages, proxiedByEnricher{url: httpToWebsocketURL(relayURL)})
+		case "d_tag":
+			p.stages = append(p.stages, dTagEnricher{})
+		case "":
+		default:
+			return nil, fmt.Errorf("invalid BROADCAST_ENRICHMENT stage %q: must be client, proxied_by or d_tag", name)
+		}
+	}
+	p.byStage = make([]int64, len(p.stages))
+	return p, nil
+}
+
+// Apply returns evt enriched and signed again, or evt itself when no stage
+// changed it or the mirror cannot sign it. evt is never modified.
+func (p *enrichPipeline) Apply(evt *nostr.Event) *nostr.Event {
+	if p == nil || len(p.stages) == 0 {
+		return evt
+	}
+	enriched := *evt
+	enriched.Tags = slices.Clone(evt.Tags)
+	changed := make([]int, 0, len(p.stages))
+	for i, stage := range p.stages {
+		if stage.Enrich(&enriched) {
+			changed = append(changed, i)
+		}
+	}
+	switch {
+	case len(changed) == 0:
+		atomic.AddInt64(&p.unchanged, 1)
+		return evt
+	case !p.sign(&enriched):
+		atomic.AddInt64(&p.unsigned, 1)
+		return evt
+	}
+	atomic.AddInt64(&p.enriched, 1)
+	for _, i := range changed {
+		atomic.AddInt64(&p.byStage[i], 1)
+	}
+	return &enriched
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *enrichPipeline) GetStatsName() string {
+	return "broadcast_enrichment"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *enrichPipeline) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("enriched_events", jsonlib.NewJsonValue(atomic.LoadInt64(&p.enriched)))
+	obj.Set("unchanged_events", jsonlib.NewJsonValue(atomic.LoadInt64(&p.unchanged)))
+	obj.Set("foreign_events", jsonlib.NewJsonValue(atomic.LoadInt64(&p.unsigned)))
+	stages := jsonlib.NewJsonObject()
+	for i, stage := range p.stages {
+		stages.Set(stage.Name(), jsonlib.NewJsonValue(atomic.LoadInt64(&p.byStage[i])))
+	}
+	obj.Set("stages", stages)
+	return obj
+}
+
+// clientTagEnricher adds a NIP-89 client tag naming the mirror to events
+// without one
+type clientTagEnricher struct {
+	name string
+}
+
+func (e clientTagEnricher) Name() string {
+	return "client"
+}
+
+func (e clientTagEnricher) Enrich(evt *nostr.Event) bool {
+	if evt.Tags.Find("client") != nil {
+		return false
+	}
+	evt.Tags = append(evt.Tags, nostr.Tag{"client", e.name})
+	return true
+}
+
+// proxiedByEnricher adds a proxied-by tag with the URL of the mirror to
+// events without one
+type proxiedByEnricher struct {
+	url string
+}
+
+func (e proxiedByEnricher) Name() string {
+	return "proxied_by"
+}
+
+func (e proxiedByEnricher) Enrich(evt *nostr.Event) bool {
+	if evt.Tags.Find("proxied-by") != nil {
+		return false
+	}
+	evt.Tags = append(evt.Tags, nostr.Tag{"proxied-by", e.url})
+	return true
+}
+
+// dTagEnricher gives addressable events exactly one d tag, with surrounding
+// whitespace trimmed, adding an empty one when missing
+type dTagEnricher struct{}
+
+func (e dTagEnricher) Name() string {
+	return "d_tag"
+}
+
+func (e dTagEnricher) Enrich(evt *nostr.Event) bool {
+	if !nostr.IsAddressableKind(evt.Kind) {
+		return false
+	}
+	changed := false
+	found := false
+	tags := evt.Tags[:0:0]
+	for _, tag := range evt.Tags {
+		if len(tag) < 1 || tag[0] != "d" {
+			tags = append(tags, tag)
+			continue
+		}
+		if found {
+			changed = true
+			continue
+		}
+		found = true
+		value := ""
+		if len(tag) > 1 {
+			value = tag[1]
+		}
+		if trimmed := strings.TrimSpace(value); len(tag) < 2 || trimmed != value {
+			tag = append(nostr.Tag{"d", trimmed}, tag[min(len(tag), 2):]...)
+			changed = true
+		}
+		tags = append(tags, tag)
+	}
+	if !found {
+		tags = append(tags, nostr.Tag{"d", ""})
+		changed = true
+	}
+	if changed {
+		evt.Tags = tags
+	}
+	return changed
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Event export endpoint for Espelho de São Miguel.
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ExportPageSize is how many events each page of an export asks upstreams for
+const ExportPageSize = 500
+
+// eventExporter serves GET /api/v1/export?filter=<json>&format=jsonl|gz,
+// streaming the events matching filter as JSON lines. Events are pulled
+// through the same query pipeline as REQs, page by page going back in time,
+// so users can back up their notes through the aggregator. Requests are
+// authenticated with NIP-98 and may only export events authored by the
+// signer; the admin token, or an API key with the export scope, lifts that
+// restriction.
+type eventExporter struct {
+	query      queryFunc
+	adminToken string
+	serviceURL *serviceURLResolver
+	maxEvents  int
+	timeout    time.Duration
+	// stats
+	exports        int64
+	exportedEvents int64
+	rejected       int64
+}
+
+// newEventExporter creates an exporter answering from query, capped at
+// maxEvents per export and streaming each for at most timeout
+func newEventExporter(query queryFunc, adminToken string, serviceURL *serviceURLResolver, maxEvents int, timeout time.Duration) *eventExporter {
+	return &eventExporter{query: query, adminToken: adminToken, serviceURL: serviceURL, maxEvents: maxEvents, timeout: timeout}
+}
+
+// HandleExport serves the export endpoint
+func (e *eventExporter) HandleExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin := hasAdminToken(req, e.adminToken) || hasAPIKey(req)
+	var pubkey string
+	if !admin {
+		var err error
+		if pubkey, err = verifyHTTPAuth(req, e.serviceURL, nil); err != nil {
+			atomic.AddInt64(&e.rejected, 1)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var filter nostr.Filter
+	if raw := req.URL.Query().Get("filter"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !admin {
+		if len(filter.Authors) == 0 {
+			filter.Authors = []string{pubkey}
+		}
+		for _, author := range filter.Authors {
+			if author != pubkey {
+				atomic.AddInt64(&e.rejected, 1)
+				http.Error(w, "forbidden: you can only export your own events", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	limit := e.maxEvents
+	if filter.Limit > 0 && filter.Limit < limit {
+		limit = filter.Limit
+	}
+
+	compressed := false
+	extension := "jsonl"
+	switch req.URL.Query().Get("format") {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case "gz", "jsonl.gz":
+		compressed = true
+		extension = "jsonl.gz"
+		w.Header().Set("Content-Type", "application/gzip")
+	default:
+		http.Error(w, "invalid format: must be jsonl or gz", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%d.%s"`, time.Now().Unix(), extension))
+
+	// exports outlive the server's write timeout, so give this response its
+	// own deadline and stop querying when it passes
+	ctx := req.Context()
+	flusher := http.NewResponseController(w)
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+		if err := flusher.SetWriteDeadline(time.Now().Add(e.timeout)); err != nil {
+			logging.DebugMethod("export", "HandleExport", "cannot extend write deadline: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compressed {
+		gz = gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	atomic.AddInt64(&e.exports, 1)
+
+	count, err := e.export(ctx, filter, limit, func(evt *nostr.Event) error {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(line, '\n'))
+		return err
+	}, func() {
+		if gz != nil {
+			gz.Flush()
+		}
+		flusher.Flush()
+	})
+	atomic.AddInt64(&e.exportedEvents, int64(count))
+	if err != nil {
+		logging.DebugMethod("export", "HandleExport", "export stopped after %d events: %v", count, err)
+		return
+	}
+	logging.DebugMethod("export", "HandleExport", "exported %d events matching %v", count, filter)
+}
+
+// export passes up to limit events matching filter to emit, newest first,
+// calling flush after each page. Each page asks for the events older than
+// the oldest of the previous one; events sharing that timestamp are asked
+// again and skipped, and a page with nothing new moves past its timestamp.
+func (e *eventExporter) export(ctx context.Context, filter nostr.Filter, limit int, emit func(*nostr.Event) error, flush func()) (int, error) {
+	ctx = withSubscriptionID(ctx, "export")
+	seen := map[string]struct{}{}
+	count := 0
+	for count < limit {
+		page := filter.Clone()
+		page.Limit = min(ExportPageSize, limit-count)
+		ch, err := e.query(ctx, page)
+		if err != nil {
+			return count, err
+		}
+		got, fresh := 0, 0
+		var oldest nostr.Timestamp
+		for evt := range ch {
+			got++
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			if _, dup := seen[evt.ID]; dup || count >= limit {
+				continue
+			}
+			seen[evt.ID] = struct{}{}
+			if err := emit(evt); err != nil {
+				return count, err
+			}
+			count++
+			fresh++
+		}
+		flush()
+		if got == 0 || ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		until := oldest
+		if fresh == 0 {
+			if oldest == 0 {
+				break
+			}
+			until = oldest - 1
+		}
+		filter.Until = &until
+	}
+	return count, nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (e *eventExporter) GetStatsName() string {
+	return "export"
+}
+
+// GetStats returns stats as JsonEntity
+func (e *eventExporter) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_events", jsonlib.NewJsonValue(e.maxEvents))
+	obj.Set("timeout", jsonlib.NewJsonValue(e.timeout.String()))
+	obj.Set("exports", jsonlib.NewJsonValue(atomic.LoadInt64(&e.exports)))
+	obj.Set("exported_events", jsonlib.NewJsonValue(atomic.LoadInt64(&e.exportedEvents)))
+	obj.Set("rejected_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&e.rejected)))
+	return obj
+}
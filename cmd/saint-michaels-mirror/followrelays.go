@@ -0,0 +1,216 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Broadcast relay discovery from followed users' relay lists for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Follow discovery tuning
+const (
+	// FollowsFetchTimeout bounds each upstream query of one discovery run
+	FollowsFetchTimeout = 30 * time.Second
+	// followsAuthorsPerQuery is how many contacts one relay list query asks for
+	followsAuthorsPerQuery = 500
+)
+
+// relayWeight is a relay and how many contacts write to it
+type relayWeight struct {
+	url   string
+	users int
+}
+
+// followRelays finds the relays a user's community writes to: it reads the
+// user's contact list (kind 3), fetches every contact's NIP-65 relay list
+// (kind 10002) and counts, per relay, how many contacts list it for writing.
+// The relays used by at least minUsers contacts are offered to discovery as
+// extra seeds, most used first and at most maxRelays of them, so the
+// broadcast pool follows where the community actually is.
+type followRelays struct {
+	query     queryFunc
+	pubkey    string
+	maxRelays int
+	minUsers  int
+	mu        sync.Mutex
+	contacts  int
+	lists     int
+	weights   []relayWeight // of the last run, most used first
+	lastRun   time.Time
+	lastError string
+	// stats
+	runs     int64
+	failures int64
+}
+
+// newFollowRelays creates the discovery source for the contacts of pubkey,
+// a hex or npub public key
+func newFollowRelays(query queryFunc, pubkey string, maxRelays, minUsers int) (*followRelays, error) {
+	hex, err := parsePubKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return &followRelays{query: query, pubkey: hex, maxRelays: maxRelays, minUsers: max(minUsers, 1)}, nil
+}
+
+// Relays returns the relays the contacts write to, most used first. A nil
+// source returns none.
+func (f *followRelays) Relays(ctx context.Context) []string {
+	if f == nil {
+		return nil
+	}
+	atomic.AddInt64(&f.runs, 1)
+	contacts, weights, lists, err := f.discover(ctx)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastRun = time.Now()
+	if err != nil {
+		atomic.AddInt64(&f.failures, 1)
+		f.lastError = err.Error()
+		logging.Warn("follow discovery failed, keeping the relays of the last run: %v", err)
+	} else {
+		f.contacts, f.lists, f.weights, f.lastError = contacts, lists, weights, ""
+		logging.Info("follow discovery: %d contacts, %d relay lists, %d relays used by at least %d contacts", contacts, lists, len(weights), f.minUsers)
+	}
+
+	urls := make([]string, 0, len(f.weights))
+	for _, w := range f.weights {
+		if f.maxRelays > 0 && len(urls) >= f.maxRelays {
+			break
+		}
+		urls = append(urls, w.url)
+	}
+	return urls
+}
+
+// discover walks the contact list and weighs the contacts' write relays
+func (f *followRelays) discover(ctx context.Context) (contacts int, weights []relayWeight, lists int, err error) {
+	follows, err := f.newest(ctx, nostr.Filter{Kinds: []int{nostr.KindFollowList}, Authors: []string{f.pubkey}})
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	var authors []string
+	if contactList := follows[f.pubkey]; contactList != nil {
+		seen := map[string]bool{}
+		for _, tag := range contactList.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValid32ByteHex(tag[1]) && !seen[tag[1]] {
+				seen[tag[1]] = true
+				authors = append(authors, tag[1])
+			}
+		}
+	}
+
+	users := map[string]int{}
+	for start := 0; start < len(authors); start += followsAuthorsPerQuery {
+		chunk := authors[start:min(start+followsAuthorsPerQuery, len(authors))]
+		relayLists, err := f.newest(ctx, nostr.Filter{Kinds: []int{nostr.KindRelayListMetadata}, Authors: chunk})
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		for _, evt := range relayLists {
+			lists++
+			for _, url := range writeRelays(evt) {
+				users[url]++
+			}
+		}
+	}
+
+	for url, n := range users {
+		if n >= f.minUsers {
+			weights = append(weights, relayWeight{url: url, users: n})
+		}
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		if weights[i].users != weights[j].users {
+			return weights[i].users > weights[j].users
+		}
+		return weights[i].url < weights[j].url
+	})
+	return len(authors), weights, lists, nil
+}
+
+// newest queries the upstreams and keeps the newest event of each author
+func (f *followRelays) newest(ctx context.Context, filter nostr.Filter) (map[string]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(withSubscriptionID(ctx, "follow-discovery"), FollowsFetchTimeout)
+	defer cancel()
+	ch, err := f.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	newest := map[string]*nostr.Event{}
+	for evt := range ch {
+		if cur := newest[evt.PubKey]; cur == nil || evt.CreatedAt > cur.CreatedAt {
+			newest[evt.PubKey] = evt
+		}
+	}
+	return newest, nil
+}
+
+// writeRelays returns the public relays a NIP-65 relay list marks for
+// writing, i.e. those without a marker or marked "write"
+func writeRelays(evt *nostr.Event) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "r" || (len(tag) >= 3 && tag[2] != "" && tag[2] != "write") {
+			continue
+		}
+		if !isPublicRelayURL(tag[1]) {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// GetStatsName returns the name of this stats provider
+func (f *followRelays) GetStatsName() string {
+	return "follow_discovery"
+}
+
+// GetStats returns stats as JsonEntity
+func (f *followRelays) GetStats() jsonlib.JsonEntity {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkey", jsonlib.NewJsonValue(f.pubkey))
+	obj.Set("runs", jsonlib.NewJsonValue(atomic.LoadInt64(&f.runs)))
+	obj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&f.failures)))
+	if !f.lastRun.IsZero() {
+		obj.Set("last_run", jsonlib.NewJsonValue(f.lastRun.Unix()))
+	}
+	if f.lastError != "" {
+		obj.Set("last_error", jsonlib.NewJsonValue(f.lastError))
+	}
+	obj.Set("contacts", jsonlib.NewJsonValue(f.contacts))
+	obj.Set("relay_lists", jsonlib.NewJsonValue(f.lists))
+	relays := jsonlib.NewJsonList()
+	for i, w := range f.weights {
+		if f.maxRelays > 0 && i >= f.maxRelays {
+			break
+		}
+		r := jsonlib.NewJsonObject()
+		r.Set("url", jsonlib.NewJsonValue(w.url))
+		r.Set("users", jsonlib.NewJsonValue(w.users))
+		relays.Append(r)
+	}
+	obj.Set("relays", relays)
+	return obj
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Right-to-be-forgotten purges for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// forgetStore is local state that can drop what it holds about a pubkey.
+// Stores keyed by event id only get the ids attributed to the pubkey.
+type forgetStore struct {
+	name         string
+	forgetPubKey func(pubkey string) int
+	forgetEvents func(ids []string) int
+}
+
+// forgetList purges a pubkey from every piece of local state on request and
+// keeps it on a do-not-cache list afterwards. The relay does not store events,
+// but it remembers recently published events and their authors, where events
+// came from, paid admissions and per-pubkey rate limits. Stores that only
+// know event ids are purged of the ids the broadcast log attributes to the
+// pubkey, and of every event of a listed pubkey later served to clients.
+// The list holds SHA-256 hashes of the pubkeys, so it does not name them.
+type forgetList struct {
+	stateFile string
+	mu        sync.RWMutex
+	hashes    map[string]time.Time // pubkey hash -> when it was forgotten
+	// events removes the events of a pubkey from the broadcast log and
+	// returns their ids, when set
+	events func(pubkey string) []string
+	stores []forgetStore
+	// stats
+	purges  int64
+	purged  int64
+	dropped int64
+}
+
+// forgetState is the persisted form of the list
+type forgetState struct {
+	PubKeyHashes map[string]time.Time `json:"pubkey_hashes"`
+}
+
+// newForgetList creates the list, restoring it from stateFile if there is one
+func newForgetList(stateFile string) (*forgetList, error) {
+	f := &forgetList{stateFile: stateFile, hashes: map[string]time.Time{}}
+	if stateFile == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state forgetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", stateFile, err)
+	}
+	for hash, at := range state.PubKeyHashes {
+		f.hashes[hash] = at
+	}
+	logging.Info("restored %d forgotten pubkeys from %s", len(f.hashes), stateFile)
+	return f, nil
+}
+
+// SetEventSource sets where the ids of the events of a pubkey come from
+func (f *forgetList) SetEventSource(events func(pubkey string) []string) {
+	f.events = events
+}
+
+// AddPubKeyStore registers state keyed by pubkey
+func (f *forgetList) AddPubKeyStore(name string, forget func(pubkey string) int) {
+	f.stores = append(f.stores, forgetStore{name: name, forgetPubKey: forget})
+}
+
+// AddEventStore registers state keyed by event id
+func (f *forgetList) AddEventStore(name string, forget func(ids []string) int) {
+	f.stores = append(f.stores, forgetStore{name: name, forgetEvents: forget})
+}
+
+// Apply drops the events of listed pubkeys from the event stores as they are
+// served to clients, stored or live
+func (f *forgetList) Apply(r *khatru.Relay) {
+	r.OverwriteResponseEvent = append(r.OverwriteResponseEvent, func(ctx context.Context, evt *nostr.Event) {
+		f.drop(evt)
+	})
+	r.PreventBroadcast = append(r.PreventBroadcast, func(ws *khatru.WebSocket, evt *nostr.Event) bool {
+		f.drop(evt)
+		return false
+	})
+}
+
+// drop removes evt from the event stores if its author is listed
+func (f *forgetList) drop(evt *nostr.Event) {
+	if !f.Forgotten(evt.PubKey) {
+		return
+	}
+	ids := []string{evt.ID}
+	for _, store := range f.stores {
+		if store.forgetEvents != nil {
+			store.forgetEvents(ids)
+		}
+	}
+	atomic.AddInt64(&f.dropped, 1)
+}
+
+// pubkeyHash returns the hash pubkey is listed under
+func pubkeyHash(pubkey string) string {
+	sum := sha256.Sum256([]byte(pubkey))
+	return hex.EncodeToString(sum[:])
+}
+
+// Forgotten reports whether pubkey is on the do-not-cache list
+func (f *forgetList) Forgotten(pubkey string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.hashes) == 0 {
+		return false
+	}
+	_, ok := f.hashes[pubkeyHash(pubkey)]
+	return ok
+}
+
+// Forget purges pubkey from every store, lists it and returns how many items
+// each store removed
+func (f *forgetList) Forget(pubkey string) map[string]int64 {
+	f.mu.Lock()
+	f.hashes[pubkeyHash(pubkey)] = time.Now()
+	f.saveLocked()
+	f.mu.Unlock()
+
+	removed := map[string]int64{}
+	var ids []string
+	if f.events != nil {
+		ids = f.events(pubkey)
+		removed["broadcast_log"] = int64(len(ids))
+	}
+	for _, store := range f.stores {
+		if store.forgetPubKey != nil {
+			removed[store.name] = int64(store.forgetPubKey(pubkey))
+		} else {
+			removed[store.name] = int64(store.forgetEvents(ids))
+		}
+	}
+	var total int64
+	for _, n := range removed {
+		total += n
+	}
+	atomic.AddInt64(&f.purges, 1)
+	atomic.AddInt64(&f.purged, total)
+	logging.Info("forgot a pubkey on request, %d local items removed", total)
+	return removed
+}
+
+// Unlist takes pubkey off the do-not-cache list, reporting whether it was on it
+func (f *forgetList) Unlist(pubkey string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hash := pubkeyHash(pubkey)
+	if _, ok := f.hashes[hash]; !ok {
+		return false
+	}
+	delete(f.hashes, hash)
+	f.saveLocked()
+	return true
+}
+
+// saveLocked persists the list; f.mu must be held
+func (f *forgetList) saveLocked() {
+	if f.stateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(forgetState{PubKeyHashes: f.hashes}, "", "  ")
+	if err != nil {
+		logging.Error("failed to encode forgotten pubkeys: %v", err)
+		return
+	}
+	if err := writeFileAtomic(f.stateFile, data); err != nil {
+		logging.Error("failed to save forgotten pubkeys to %s: %v", f.stateFile, err)
+	}
+}
+
+// forgetRequest is the body of POST and DELETE /api/v1/admin/forget
+type forgetRequest struct {
+	PubKey string `json:"pubkey"`
+}
+
+// HandleForget serves POST (purge and list a pubkey), DELETE (take it off the
+// list) and GET (size of the list) of the do-not-cache list
+func (f *forgetList) HandleForget(w http.ResponseWriter, req *http.Request) {
+	obj := jsonlib.NewJsonObject()
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var body forgetRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		pubkey, err := parsePubKey(body.PubKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Method == http.MethodDelete {
+			if !f.Unlist(pubkey) {
+				http.Error(w, "pubkey not forgotten", http.StatusNotFound)
+				return
+			}
+			break
+		}
+		obj.Set("removed", prefixCountsToJSON(f.Forget(pubkey)))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f.mu.RLock()
+	obj.Set("forgotten_pubkeys", jsonlib.NewJsonValue(len(f.hashes)))
+	f.mu.RUnlock()
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (f *forgetList) GetStatsName() string {
+	return "forget"
+}
+
+// GetStats returns stats as JsonEntity
+func (f *forgetList) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	f.mu.RLock()
+	obj.Set("forgotten_pubkeys", jsonlib.NewJsonValue(len(f.hashes)))
+	f.mu.RUnlock()
+	obj.Set("purges", jsonlib.NewJsonValue(atomic.LoadInt64(&f.purges)))
+	obj.Set("purged_items", jsonlib.NewJsonValue(atomic.LoadInt64(&f.purged)))
+	obj.Set("dropped_events", jsonlib.NewJsonValue(atomic.LoadInt64(&f.dropped)))
+	return obj
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Listener handover for zero-downtime restarts of Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// Environment variables used to hand the listening socket to a new process.
+// The listener is passed as fd 3 and a readiness pipe as fd 4.
+const (
+	handoverEnv      = "SAINT_MICHAELS_HANDOVER"
+	handoverListenFD = 3
+	handoverReadyFD  = 4
+)
+
+// handover tracks client connections and hands the listening socket over to
+// a freshly started binary, after which this process stops accepting and
+// drains its existing websocket connections.
+type handover struct {
+	relay        *khatru.Relay
+	server       *http.Server
+	listener     net.Listener
+	drainTimeout time.Duration
+	pidFile      string
+	// active websocket connections; khatru runs OnDisconnect more than once
+	// per connection, so they are tracked by connection rather than counted
+	mu      sync.Mutex
+	clients map[*khatru.WebSocket]struct{}
+	// set once the listener was handed to a new process
+	handedOver int32
+}
+
+// newHandover creates a handover manager and starts counting connections
+func newHandover(r *khatru.Relay, drainTimeout time.Duration, pidFile string) *handover {
+	h := &handover{
+		relay:        r,
+		drainTimeout: drainTimeout,
+		pidFile:      pidFile,
+		clients:      map[*khatru.WebSocket]struct{}{},
+	}
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.clients[khatru.GetConnection(ctx)] = struct{}{}
+	})
+	r.OnDisconnect = append(r.OnDisconnect, func(ctx context.Context) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.clients, khatru.GetConnection(ctx))
+	})
+	return h
+}
+
+// connections returns the number of active websocket connections
+func (h *handover) connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Listen returns the listener inherited from a previous process, or a new one
+func (h *handover) Listen(addr string) (net.Listener, error) {
+	if os.Getenv(handoverEnv) == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(handoverListenFD, "listener")
+	if f == nil {
+		return nil, fmt.Errorf("handover requested but fd %d is not available", handoverListenFD)
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inheriting listener: %w", err)
+	}
+	logging.Info("inherited listening socket %s from previous process", ln.Addr())
+	return ln, nil
+}
+
+// Ready tells the previous process (if any) that this one is serving, and
+// records our pid so process supervisors can follow the handover.
+func (h *handover) Ready() {
+	if h.pidFile != "" {
+		if err := os.WriteFile(h.pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			logging.Warn("failed to write pid file %s: %v", h.pidFile, err)
+		}
+	}
+	if os.Getenv(handoverEnv) == "" {
+		return
+	}
+	if ready := os.NewFile(handoverReadyFD, "ready"); ready != nil {
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+	os.Unsetenv(handoverEnv)
+}
+
+// Serve serves the relay on the listener, wrapped by wrap when it is not nil.
+// When the listener is handed over it waits for existing connections to drain
+// before returning.
+func (h *handover) Serve(server *http.Server, ln net.Listener, wrap func(net.Listener) net.Listener) error {
+	h.server = server
+	h.listener = ln
+	h.watch()
+	h.Ready()
+
+	if wrap != nil {
+		ln = wrap(ln)
+	}
+	err := server.Serve(ln)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	if atomic.LoadInt32(&h.handedOver) == 1 {
+		h.drain()
+	}
+	return err
+}
+
+// drain waits until all websocket connections are gone or the timeout expires
+func (h *handover) drain() {
+	deadline := time.Now().Add(h.drainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		remaining := h.connections()
+		if remaining <= 0 {
+			logging.Info("all client connections drained")
+			return
+		}
+		if time.Now().After(deadline) {
+			logging.Warn("drain timeout reached with %d client connections still open", remaining)
+			return
+		}
+		logging.DebugMethod("handover", "drain", "waiting for %d client connections to drain", remaining)
+	}
+}
+
+// stopAccepting stops serving new requests after a successful handover
+func (h *handover) stopAccepting() {
+	atomic.StoreInt32(&h.handedOver, 1)
+	logging.Info("listener handed over, draining %d client connections (timeout %v)", h.connections(), h.drainTimeout)
+	// Shutdown does not wait for hijacked websocket connections, they are drained separately
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	h.server.Shutdown(ctx)
+}
+
+// CloseClients tells every client websocket the relay is going away and
+// waits until they are closed or ctx is done. Closing a connection ends its
+// subscriptions.
+func (h *handover) CloseClients(ctx context.Context) error {
+	h.mu.Lock()
+	clients := make([]*khatru.WebSocket, 0, len(h.clients))
+	for ws := range h.clients {
+		clients = append(clients, ws)
+	}
+	h.mu.Unlock()
+	if len(clients) == 0 {
+		return nil
+	}
+	logging.Info("closing %d client connections", len(clients))
+	goingAway := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay shutting down")
+	for _, ws := range clients {
+		ws.WriteMessage(websocket.CloseMessage, goingAway)
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining := h.connections()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d client connections still open", remaining)
+		case <-ticker.C:
+		}
+	}
+}
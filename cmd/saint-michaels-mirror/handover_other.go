@@ -0,0 +1,14 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Listener handover stub for platforms without fd passing.
+
+//go:build !unix
+
+package main
+
+// watch is a no-op: listener handover requires unix fd passing
+func (h *handover) watch() {}
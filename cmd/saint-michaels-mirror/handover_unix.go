@@ -0,0 +1,102 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Listener handover signal handling on unix systems.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// handoverReadyTimeout bounds how long we wait for the new process to serve
+const handoverReadyTimeout = 60 * time.Second
+
+// watch starts the new binary on SIGUSR2 and hands it the listening socket
+func (h *handover) watch() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	go func() {
+		for range sigs {
+			logging.Info("received SIGUSR2, starting new process for listener handover")
+			if err := h.upgrade(); err != nil {
+				logging.Error("listener handover failed, continuing to serve: %v", err)
+				continue
+			}
+			signal.Stop(sigs)
+			h.stopAccepting()
+			return
+		}
+	}()
+}
+
+// upgrade starts the current executable with the listener and waits for it
+// to report that it is serving
+func (h *handover) upgrade() error {
+	tcpListener, ok := h.listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("listener %T cannot be handed over", h.listener)
+	}
+	lnFile, err := tcpListener.File()
+	if err != nil {
+		return fmt.Errorf("duplicating listener: %w", err)
+	}
+	defer lnFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("creating readiness pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("locating executable: %w", err)
+	}
+
+	attr := &os.ProcAttr{
+		Env:   append(os.Environ(), handoverEnv+"=1"),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, lnFile, readyW},
+	}
+	proc, err := os.StartProcess(executable, os.Args, attr)
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("starting new process: %w", err)
+	}
+	logging.Info("started new process pid %d, waiting for it to become ready", proc.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			proc.Kill()
+			return fmt.Errorf("new process exited before becoming ready: %w", err)
+		}
+		logging.Info("new process pid %d is serving", proc.Pid)
+		proc.Release()
+		return nil
+	case <-time.After(handoverReadyTimeout):
+		proc.Kill()
+		return fmt.Errorf("new process did not become ready within %v", handoverReadyTimeout)
+	}
+}
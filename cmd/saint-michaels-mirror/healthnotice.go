@@ -0,0 +1,181 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Client notices about degraded upstream health for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HealthNoticeInterval is how often upstream health is checked for drops
+const HealthNoticeInterval = 10 * time.Second
+
+// healthNotices tells clients when results may be incomplete. Every connected
+// client gets a NOTICE when the upstream health drops to YELLOW or RED, and
+// while degraded each subscription gets one right before its EOSE. Notices
+// start with the machine-readable flag "degraded: <STATE>", e.g.
+//
+//	degraded: YELLOW 3 of 5 upstream relays unreachable, results may be incomplete
+type healthNotices struct {
+	rs *relaystore.RelayStore
+	mu sync.Mutex
+	// connected clients and the last subscription each was notified on
+	conns map[*khatru.WebSocket]string
+	state string
+	// stats
+	broadcastNotices int64
+	queryNotices     int64
+}
+
+// newHealthNotices creates the notifier for the query remotes of rs
+func newHealthNotices(rs *relaystore.RelayStore) *healthNotices {
+	return &healthNotices{
+		rs:    rs,
+		conns: map[*khatru.WebSocket]string{},
+		state: HealthGreen,
+	}
+}
+
+// Apply tracks client connections
+func (h *healthNotices) Apply(r *khatru.Relay) {
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			h.mu.Lock()
+			h.conns[ws] = ""
+			h.mu.Unlock()
+		}
+	})
+	r.OnDisconnect = append(r.OnDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			h.mu.Lock()
+			delete(h.conns, ws)
+			h.mu.Unlock()
+		}
+	})
+}
+
+// health returns the upstream health state and the notice describing it
+func (h *healthNotices) health() (string, string) {
+	state := h.rs.QueryHealthState()
+	reachable, total := h.rs.Reachability()
+	if total > 0 && reachable == 0 {
+		state = HealthRed
+	} else if reachable*2 < total && state == HealthGreen {
+		state = HealthYellow
+	}
+	if state == HealthGreen {
+		return state, ""
+	}
+	return state, fmt.Sprintf("degraded: %s %d of %d upstream relays unreachable, results may be incomplete", state, total-reachable, total)
+}
+
+// Start checks upstream health every HealthNoticeInterval until ctx is done
+func (h *healthNotices) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(HealthNoticeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.check()
+			}
+		}
+	}()
+}
+
+// check sends the degradation notice to every client when health drops
+func (h *healthNotices) check() {
+	state, notice := h.health()
+	h.mu.Lock()
+	dropped := healthRank[state] > healthRank[h.state]
+	h.state = state
+	conns := make([]*khatru.WebSocket, 0, len(h.conns))
+	for ws := range h.conns {
+		conns = append(conns, ws)
+	}
+	h.mu.Unlock()
+	if !dropped {
+		return
+	}
+
+	logging.Warn("upstream health dropped to %s, notifying %d clients", state, len(conns))
+	for _, ws := range conns {
+		if err := ws.WriteJSON(nostr.NoticeEnvelope(notice)); err == nil {
+			atomic.AddInt64(&h.broadcastNotices, 1)
+		}
+	}
+}
+
+// Wrap sends the degradation notice after the events of each client query,
+// ahead of khatru's EOSE, once per subscription
+func (h *healthNotices) Wrap(next queryFunc) queryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := next(ctx, filter)
+		if err != nil || !isExternalQuery(ctx) {
+			return ch, err
+		}
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return ch, nil
+		}
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				out <- evt
+			}
+			_, notice := h.health()
+			if notice == "" {
+				return
+			}
+			id := khatru.GetSubscriptionID(ctx)
+			h.mu.Lock()
+			last, connected := h.conns[ws]
+			if connected {
+				h.conns[ws] = id
+			}
+			h.mu.Unlock()
+			if !connected || last == id {
+				return
+			}
+			if err := ws.WriteJSON(nostr.NoticeEnvelope(notice)); err == nil {
+				atomic.AddInt64(&h.queryNotices, 1)
+			}
+		}()
+		return out, nil
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (h *healthNotices) GetStatsName() string {
+	return "health_notices"
+}
+
+// GetStats returns stats as JsonEntity
+func (h *healthNotices) GetStats() jsonlib.JsonEntity {
+	h.mu.Lock()
+	state, connections := h.state, len(h.conns)
+	h.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("health_state", jsonlib.NewJsonValue(state))
+	obj.Set("connections", jsonlib.NewJsonValue(connections))
+	obj.Set("broadcast_notices", jsonlib.NewJsonValue(atomic.LoadInt64(&h.broadcastNotices)))
+	obj.Set("query_notices", jsonlib.NewJsonValue(atomic.LoadInt64(&h.queryNotices)))
+	return obj
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Relay hints of published events for Espelho de São Miguel.
+package main
+
+import (
+	"net"
+	neturl "net/url"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayHints returns the relays an event points at, in tag order: the
+// relay hints of its e, p, a and q tags, the urls of a "relays" tag, and for
+// NIP-65 relay lists the listed relays themselves. Hints that are not
+// public websocket urls are counted in invalid and skipped, and at most
+// limit relays are returned.
+func relayHints(evt *nostr.Event, limit int) (hints []string, invalid int) {
+	seen := map[string]bool{}
+	add := func(url string) {
+		if url == "" || len(hints) >= limit {
+			return
+		}
+		if !isPublicRelayURL(url) {
+			invalid++
+			return
+		}
+		url = nostr.NormalizeURL(url)
+		if !seen[url] {
+			seen[url] = true
+			hints = append(hints, url)
+		}
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch {
+		case tag[0] == "relays":
+			for _, url := range tag[1:] {
+				add(url)
+			}
+		case tag[0] == "r" && evt.Kind == nostr.KindRelayListMetadata:
+			add(tag[1])
+		case len(tag) >= 3 && (tag[0] == "e" || tag[0] == "p" || tag[0] == "a" || tag[0] == "q"):
+			add(tag[2])
+		}
+	}
+	return hints, invalid
+}
+
+// isPublicRelayURL reports whether url is a websocket url whose host is not
+// a loopback, private or link-local address, so that hints from clients
+// cannot make us connect into our own network
+func isPublicRelayURL(url string) bool {
+	u, err := neturl.Parse(strings.TrimSpace(url))
+	if err != nil || (u.Scheme != "wss" && u.Scheme != "ws") || u.User != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !ip.IsMulticast()
+	}
+	// a bare name without a dot is most likely an internal host
+	return strings.Contains(host, ".")
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-98 HTTP authentication for Espelho de São Miguel.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindHTTPAuth is the kind of NIP-98 authorization events
+const KindHTTPAuth = 27235
+
+// HTTPAuthMaxSkew is how far the created_at of a NIP-98 event may be from now
+const HTTPAuthMaxSkew = 60
+
+// verifyHTTPAuth checks the NIP-98 "Authorization: Nostr <base64 event>"
+// header of req and returns the pubkey that signed it. The u tag must match
+// the path and query of the request, and its scheme and host those of the
+// service URL serviceURL resolves for req, since a proxy may have rewritten
+// the request's own. When body is not nil it must be signed with a payload tag
+// holding its SHA-256, so a captured header cannot be replayed with another
+// body; only an empty body may go without one.
+func verifyHTTPAuth(req *http.Request, serviceURL *serviceURLResolver, body []byte) (string, error) {
+	encoded, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", errors.New("missing NIP-98 authorization")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", errors.New("invalid base64 in authorization")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return "", errors.New("invalid authorization event")
+	}
+	if evt.Kind != KindHTTPAuth {
+		return "", errors.New("authorization event must be of kind 27235")
+	}
+	if !evt.CheckID() {
+		return "", errors.New("authorization event id does not match")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", errors.New("invalid authorization signature")
+	}
+	if skew := nostr.Now() - evt.CreatedAt; skew > HTTPAuthMaxSkew || skew < -HTTPAuthMaxSkew {
+		return "", errors.New("authorization event is too old or in the future")
+	}
+
+	method := evt.Tags.Find("method")
+	if method == nil || !strings.EqualFold(method[1], req.Method) {
+		return "", errors.New("authorization method tag does not match")
+	}
+	u := evt.Tags.Find("u")
+	if u == nil {
+		return "", errors.New("authorization event has no u tag")
+	}
+	signed, err := neturl.Parse(u[1])
+	if err != nil || signed.Path != req.URL.Path || signed.RawQuery != req.URL.RawQuery {
+		return "", errors.New("authorization u tag does not match the request")
+	}
+	service, err := neturl.Parse(serviceURL.BaseURL(req))
+	if err != nil || !strings.EqualFold(signed.Scheme, service.Scheme) || !strings.EqualFold(canonicalHost(signed), canonicalHost(service)) {
+		return "", errors.New("authorization u tag is not for this relay")
+	}
+	if body != nil {
+		payload := evt.Tags.Find("payload")
+		if payload == nil && len(body) > 0 {
+			return "", errors.New("authorization event has no payload tag for the body")
+		}
+		if payload != nil {
+			sum := sha256.Sum256(body)
+			if !strings.EqualFold(payload[1], hex.EncodeToString(sum[:])) {
+				return "", errors.New("authorization payload hash does not match the body")
+			}
+		}
+	}
+	return evt.PubKey, nil
+}
+
+// canonicalHost returns the host of u without the default port of its scheme
+func canonicalHost(u *neturl.URL) string {
+	port := u.Port()
+	if (port == "443" && strings.EqualFold(u.Scheme, "https")) || (port == "80" && strings.EqualFold(u.Scheme, "http")) {
+		return strings.TrimSuffix(u.Host, ":"+port)
+	}
+	return u.Host
+}
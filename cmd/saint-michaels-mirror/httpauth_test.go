@@ -0,0 +1,124 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the NIP-98 HTTP authorization for Espelho de São Miguel.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// signedRequest returns a POST to path authorized with a NIP-98 event for
+// https://relay.example.com carrying tags besides u and method
+func signedRequest(t *testing.T, path string, tags ...nostr.Tag) (*http.Request, string) {
+	t.Helper()
+	return signedRequestFor(t, "https://relay.example.com"+path, path, tags...)
+}
+
+// signedRequestFor returns a POST to path authorized with a NIP-98 event
+// whose u tag is u
+func signedRequestFor(t *testing.T, u, path string, tags ...nostr.Tag) (*http.Request, string) {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	auth := nostr.Event{
+		Kind:      KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"u", u}, {"method", http.MethodPost}}, tags...),
+	}
+	if err := auth.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(auth.String())))
+	return req, auth.PubKey
+}
+
+func TestVerifyHTTPAuthPayload(t *testing.T) {
+	body := []byte(`{"kind":1}`)
+	sum := sha256.Sum256(body)
+	other := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name string
+		body []byte
+		tags []nostr.Tag
+		ok   bool
+	}{
+		{"body with payload", body, []nostr.Tag{{"payload", hex.EncodeToString(sum[:])}}, true},
+		{"body without payload", body, nil, false},
+		{"body with another payload", body, []nostr.Tag{{"payload", hex.EncodeToString(other[:])}}, false},
+		{"empty body without payload", []byte{}, nil, true},
+		{"no body", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, pubkey := signedRequest(t, "/api/v1/import", tt.tags...)
+			got, err := verifyHTTPAuth(req, newServiceURLResolver("https://relay.example.com", nil), tt.body)
+			if tt.ok && (err != nil || got != pubkey) {
+				t.Fatalf("verifyHTTPAuth = %q, %v; want %q", got, err, pubkey)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("verifyHTTPAuth accepted the request")
+			}
+		})
+	}
+}
+
+func TestVerifyHTTPAuthURL(t *testing.T) {
+	configured := newServiceURLResolver("https://relay.example.com", nil)
+	detected := newServiceURLResolver("", nil)
+
+	tests := []struct {
+		name       string
+		serviceURL *serviceURLResolver
+		u          string
+		path       string
+		setup      func(*http.Request)
+		ok         bool
+	}{
+		{"service URL", configured, "https://relay.example.com/api/v1/export?format=gz", "/api/v1/export?format=gz", nil, true},
+		{"default port", configured, "https://relay.example.com:443/api/v1/export", "/api/v1/export", nil, true},
+		{"host case", configured, "https://Relay.Example.com/api/v1/export", "/api/v1/export", nil, true},
+		{"other host", configured, "https://evil.example.com/api/v1/export", "/api/v1/export", nil, false},
+		{"other scheme", configured, "http://relay.example.com/api/v1/export", "/api/v1/export", nil, false},
+		{"other port", configured, "https://relay.example.com:8443/api/v1/export", "/api/v1/export", nil, false},
+		{"other path", configured, "https://relay.example.com/api/v1/import", "/api/v1/export", nil, false},
+		{"other query", configured, "https://relay.example.com/api/v1/export", "/api/v1/export?format=gz", nil, false},
+		{"request host", detected, "http://example.com/api/v1/export", "/api/v1/export", nil, true},
+		{"forwarded by a trusted proxy", detected, "https://relay.example.com/api/v1/export", "/api/v1/export", func(req *http.Request) {
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("X-Forwarded-Host", "relay.example.com")
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}, true},
+		{"forwarded by anyone", detected, "https://relay.example.com/api/v1/export", "/api/v1/export", func(req *http.Request) {
+			req.RemoteAddr = "203.0.113.1:1234"
+			req.Header.Set("X-Forwarded-Host", "relay.example.com")
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, pubkey := signedRequestFor(t, tt.u, tt.path)
+			if tt.setup != nil {
+				tt.setup(req)
+			}
+			got, err := verifyHTTPAuth(req, tt.serviceURL, nil)
+			if tt.ok && (err != nil || got != pubkey) {
+				t.Fatalf("verifyHTTPAuth = %q, %v; want %q", got, err, pubkey)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("verifyHTTPAuth accepted the request")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// HTTP query endpoint for Espelho de São Miguel.
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// httpQuery serves GET /api/v1/query?filter=<json>, answering one filter
+// with a JSON array of events, newest first, so curl, cron jobs and static
+// site generators can read through the aggregator without a websocket
+// library. The filter takes the path of a REQ: the connection rate limit, or
+// the rate of its API key, the filter policies and the query pipeline down to the upstreams, with
+// its limit capped at maxEvents, and answers within the query deadline plus
+// writeDeadlineMargin, whatever the server's write timeout. A NIP-98 Authorization header is optional
+// and counts as AUTH when present, e.g. for members-only reads.
+type httpQuery struct {
+	relay      *khatru.Relay
+	serviceURL *serviceURLResolver
+	maxEvents  int
+	deadline   time.Duration
+	// stats
+	queries  int64
+	returned int64
+	capped   int64
+	rejected int64
+}
+
+// newHTTPQuery creates the endpoint, returning at most maxEvents per query;
+// deadline is the QUERY_DEADLINE of the upstream queries
+func newHTTPQuery(relay *khatru.Relay, serviceURL *serviceURLResolver, maxEvents int, deadline time.Duration) *httpQuery {
+	return &httpQuery{relay: relay, serviceURL: serviceURL, maxEvents: maxEvents, deadline: deadline}
+}
+
+// HandleQuery serves the query endpoint
+func (q *httpQuery) HandleQuery(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, reject := range q.relay.RejectConnection {
+		if !hasAPIKey(req) && reject(req) {
+			atomic.AddInt64(&q.rejected, 1)
+			http.Error(w, "rate-limited: too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+	raw := req.URL.Query().Get("filter")
+	if raw == "" {
+		http.Error(w, "missing filter", http.StatusBadRequest)
+		return
+	}
+	var filter nostr.Filter
+	if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	if req.Header.Get("Authorization") != "" {
+		pubkey, err := verifyHTTPAuth(req, q.serviceURL, nil)
+		if err != nil {
+			atomic.AddInt64(&q.rejected, 1)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx = context.WithValue(ctx, khatruHTTPAuthKey, pubkey)
+	}
+	atomic.AddInt64(&q.queries, 1)
+
+	// upstreams are waited on for up to the query deadline, which may be
+	// longer than the server's write timeout; the margin covers the time
+	// spent queueing for a query slot
+	extendWriteDeadline(w, q.deadline+writeDeadlineMargin)
+	ctx, cancel := context.WithTimeout(ctx, q.deadline+writeDeadlineMargin)
+	defer cancel()
+	events, err := q.query(withSubscriptionID(ctx, "http-query"), filter)
+	if err != nil {
+		atomic.AddInt64(&q.rejected, 1)
+		http.Error(w, err.Error(), rejectionStatus(relayerrors.Prefix(err)))
+		return
+	}
+	atomic.AddInt64(&q.returned, int64(len(events)))
+	data, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, "failed to encode events", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, data)
+}
+
+// query runs filter through the relay's filter hooks and query functions the
+// way khatru handles a REQ, returning up to maxEvents distinct events
+func (q *httpQuery) query(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	for _, ovw := range q.relay.OverwriteFilter {
+		ovw(ctx, &filter)
+	}
+	if filter.LimitZero {
+		return []*nostr.Event{}, nil
+	}
+	if filter.Limit <= 0 || filter.Limit > q.maxEvents {
+		atomic.AddInt64(&q.capped, 1)
+		filter.Limit = q.maxEvents
+	}
+	for _, reject := range q.relay.RejectFilter {
+		if reject, msg := reject(ctx, filter); reject {
+			return nil, errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	events := []*nostr.Event{}
+	for _, query := range q.relay.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			logging.DebugMethod("httpquery", "query", "query of %v failed: %v", filter, err)
+			continue
+		} else if ch == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for evt := range ch {
+				for _, ovw := range q.relay.OverwriteResponseEvent {
+					ovw(ctx, evt)
+				}
+				mu.Lock()
+				if !seen[evt.ID] {
+					seen[evt.ID] = true
+					events = append(events, evt)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(events, func(a, b *nostr.Event) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (q *httpQuery) GetStatsName() string {
+	return "query_endpoint"
+}
+
+// GetStats returns stats as JsonEntity
+func (q *httpQuery) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_events", jsonlib.NewJsonValue(q.maxEvents))
+	obj.Set("queries", jsonlib.NewJsonValue(atomic.LoadInt64(&q.queries)))
+	obj.Set("returned_events", jsonlib.NewJsonValue(atomic.LoadInt64(&q.returned)))
+	obj.Set("capped_limits", jsonlib.NewJsonValue(atomic.LoadInt64(&q.capped)))
+	obj.Set("rejected_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&q.rejected)))
+	return obj
+}
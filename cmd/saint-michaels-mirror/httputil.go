@@ -0,0 +1,111 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// HTTP helpers (CORS, compression, static caching) for Espelho de São Miguel.
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/rs/cors"
+)
+
+// gzipMinSize is the smallest JSON response worth compressing
+const gzipMinSize = 1024
+
+// apiPathPrefix is the path prefix of the JSON API
+const apiPathPrefix = "/api/v1/"
+
+// writeDeadlineMargin is the time left to write a response after an endpoint
+// is done waiting on upstreams
+const writeDeadlineMargin = 5 * time.Second
+
+// newRootHandler builds the top-level HTTP handler. API requests get the
+// configured CORS policy, and no CORS headers when no origin is configured;
+// everything else (websocket upgrades, NIP-11, pages)
+// goes through khatru with its default permissive CORS, wrapped by wraps in
+// order, e.g. to merge an override into NIP-11 responses.
+func newRootHandler(r *khatru.Relay, cfg *Config, wraps ...func(http.Handler) http.Handler) http.Handler {
+	var api http.Handler = r.Router()
+	// cors treats an empty list as every origin
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		api = cors.New(cors.Options{
+			AllowedOrigins: cfg.CORSAllowedOrigins,
+			AllowedMethods: []string{http.MethodHead, http.MethodGet, http.MethodPost},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			MaxAge:         86400,
+		}).Handler(api)
+	}
+	var relay http.Handler = cors.Default().Handler(r)
+	for _, wrap := range wraps {
+		relay = wrap(relay)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, apiPathPrefix) && req.Header.Get("Upgrade") != "websocket" {
+			api.ServeHTTP(w, req)
+			return
+		}
+		relay.ServeHTTP(w, req)
+	})
+}
+
+// writeJSON writes a JSON response, gzip-compressing it when it is large
+// enough and the client accepts gzip.
+func writeJSON(w http.ResponseWriter, req *http.Request, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if len(data) < gzipMinSize || !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(status)
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	if _, err := gz.Write(data); err != nil {
+		logging.DebugMethod("http", "writeJSON", "failed writing gzip response: %v", err)
+	}
+}
+
+// extendWriteDeadline lets the response of w be written for d plus
+// writeDeadlineMargin from now, for endpoints that wait longer than the
+// server's write timeout
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + writeDeadlineMargin)); err != nil {
+		logging.DebugMethod("http", "extendWriteDeadline", "cannot extend write deadline: %v", err)
+	}
+}
+
+// newStaticHandler serves static assets from dir with Cache-Control and ETag
+// headers. The ETag is derived from the file size and modification time, and
+// conditional requests are answered by http.FileServer.
+func newStaticHandler(dir string, maxAge time.Duration) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+req.URL.Path)))
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		fs.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Relay identity and key rotation for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// DefaultKeyRotationGrace is how long the previous key keeps answering
+// upstream AUTH challenges after a rotation
+const DefaultKeyRotationGrace = 72 * time.Hour
+
+// IdentityAuthTimeout bounds each upstream AUTH attempt
+const IdentityAuthTimeout = 10 * time.Second
+
+// parseSecretKey accepts a secret key as nsec or hex and returns it as hex
+func parseSecretKey(sec string) (string, error) {
+	sec = strings.TrimSpace(sec)
+	if strings.HasPrefix(sec, "nsec") {
+		_, val, err := nip19.Decode(sec)
+		if err != nil {
+			return "", fmt.Errorf("invalid nsec: %w", err)
+		}
+		s, ok := val.(string)
+		if !ok {
+			return "", fmt.Errorf("invalid nsec")
+		}
+		sec = s
+	}
+	if b, err := hex.DecodeString(sec); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("secret key must be an nsec or 64 hex characters")
+	}
+	if _, err := nostr.GetPublicKey(sec); err != nil {
+		return "", err
+	}
+	return strings.ToLower(sec), nil
+}
+
+// relayIdentity holds the key the relay signs with: AUTH to upstreams and
+// the transition events of a key rotation. After a rotation the previous key
+// stays around for a grace period, so upstreams that only know the old
+// pubkey keep letting us in until they learn the new one.
+type relayIdentity struct {
+	relay *khatru.Relay
+	grace time.Duration
+	mu    sync.RWMutex
+	// current and previous key pairs, in hex
+	secret     string
+	pubkey     string
+	prevSecret string
+	prevPubkey string
+	graceUntil time.Time
+	rotatedAt  time.Time
+	// upstream connections we authenticated on, re-authenticated on rotation
+	authed map[string]*nostr.Relay
+	// publish sends the transition events upstream, when set
+	publish func(ctx context.Context, evt *nostr.Event) error
+	// stats
+	rotations       int64
+	authentications int64
+	authFallbacks   int64
+	authFailures    int64
+}
+
+// newRelayIdentity loads sec, generating a key when it is empty or invalid
+func newRelayIdentity(r *khatru.Relay, sec string, grace time.Duration) *relayIdentity {
+	if grace <= 0 {
+		grace = DefaultKeyRotationGrace
+	}
+	secret, err := parseSecretKey(sec)
+	if err != nil {
+		if sec != "" {
+			logging.Warn("invalid RELAY_SECKEY, using an ephemeral key instead: %v", err)
+		}
+		secret = nostr.GeneratePrivateKey()
+		logging.DebugMethod("identity", "newRelayIdentity", "generated new relay secret key")
+	}
+	pubkey, _ := nostr.GetPublicKey(secret)
+	return &relayIdentity{
+		relay:  r,
+		grace:  grace,
+		secret: secret,
+		pubkey: pubkey,
+		authed: map[string]*nostr.Relay{},
+	}
+}
+
+// SetPublisher sets how the transition events of a rotation are published
+func (id *relayIdentity) SetPublisher(publish func(ctx context.Context, evt *nostr.Event) error) {
+	id.publish = publish
+}
+
+// PubKey returns the current public key
+func (id *relayIdentity) PubKey() string {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return id.pubkey
+}
+
+// Keyer returns a signer holding the current key, e.g. to send direct
+// messages as the relay
+func (id *relayIdentity) Keyer() (nostr.Keyer, error) {
+	id.mu.RLock()
+	secret := id.secret
+	id.mu.RUnlock()
+	signer, err := keyer.NewPlainKeySigner(secret)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// SignOwn signs evt again if it was authored by the current key, reporting
+// whether it was
+func (id *relayIdentity) SignOwn(evt *nostr.Event) bool {
+	id.mu.RLock()
+	secret, pubkey := id.secret, id.pubkey
+	id.mu.RUnlock()
+	return evt.PubKey == pubkey && evt.Sign(secret) == nil
+}
+
+// keys returns the secrets to try on upstream AUTH, current first
+func (id *relayIdentity) keys() []string {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	keys := []string{id.secret}
+	if id.prevSecret != "" && time.Now().Before(id.graceUntil) {
+		keys = append(keys, id.prevSecret)
+	}
+	return keys
+}
+
+// AuthHandler signs the AUTH events of pool-level subscriptions with the
+// current key; it is meant for nostr.WithAuthHandler
+func (id *relayIdentity) AuthHandler(ctx context.Context, ie nostr.RelayEvent) error {
+	id.remember(ie.Relay)
+	atomic.AddInt64(&id.authentications, 1)
+	return ie.Event.Sign(id.keys()[0])
+}
+
+// remember records relay as authenticated
+func (id *relayIdentity) remember(relay *nostr.Relay) {
+	if relay == nil {
+		return
+	}
+	id.mu.Lock()
+	id.authed[relay.URL] = relay
+	id.mu.Unlock()
+}
+
+// Authenticate answers relay's AUTH challenge with the current key, falling
+// back to the previous one during the grace period
+func (id *relayIdentity) Authenticate(ctx context.Context, relay *nostr.Relay) error {
+	var err error
+	for i, secret := range id.keys() {
+		authCtx, cancel := context.WithTimeout(ctx, IdentityAuthTimeout)
+		err = relay.Auth(authCtx, func(evt *nostr.Event) error { return evt.Sign(secret) })
+		cancel()
+		if err == nil {
+			atomic.AddInt64(&id.authentications, 1)
+			if i > 0 {
+				atomic.AddInt64(&id.authFallbacks, 1)
+				logging.Warn("%s only accepted the previous relay key", relay.URL)
+			}
+			id.remember(relay)
+			return nil
+		}
+	}
+	atomic.AddInt64(&id.authFailures, 1)
+	return err
+}
+
+// Rotate switches to secret, or to a fresh key when empty, keeping the
+// current key for the grace period. It publishes the transition events and
+// re-authenticates every upstream connection we authenticated on. It
+// returns the new secret in hex and the ids of the published events.
+func (id *relayIdentity) Rotate(ctx context.Context, secret string, grace time.Duration) (string, []string, error) {
+	if secret == "" {
+		secret = nostr.GeneratePrivateKey()
+	} else {
+		var err error
+		if secret, err = parseSecretKey(secret); err != nil {
+			return "", nil, err
+		}
+	}
+	if grace <= 0 {
+		grace = id.grace
+	}
+	pubkey, err := nostr.GetPublicKey(secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id.mu.Lock()
+	if pubkey == id.pubkey {
+		id.mu.Unlock()
+		return "", nil, errors.New("new key is the current key")
+	}
+	oldPubkey := id.pubkey
+	id.prevSecret, id.prevPubkey = id.secret, id.pubkey
+	id.secret, id.pubkey = secret, pubkey
+	id.rotatedAt = time.Now()
+	id.graceUntil = id.rotatedAt.Add(grace)
+	authed := make([]*nostr.Relay, 0, len(id.authed))
+	for _, relay := range id.authed {
+		authed = append(authed, relay)
+	}
+	id.mu.Unlock()
+	atomic.AddInt64(&id.rotations, 1)
+
+	if id.relay.Info.PubKey == oldPubkey {
+		id.relay.Info.PubKey = pubkey
+	}
+	logging.Info("relay key rotated from %s to %s, previous key accepted until %s; update RELAY_SECKEY to keep it across restarts",
+		oldPubkey, pubkey, id.graceUntil.Format(time.RFC3339))
+
+	reauthed := 0
+	for _, relay := range authed {
+		if !relay.IsConnected() {
+			continue
+		}
+		if err := id.Authenticate(ctx, relay); err != nil {
+			logging.Warn("failed to re-authenticate to %s with the new key: %v", relay.URL, err)
+			continue
+		}
+		reauthed++
+	}
+	logging.Info("re-authenticated %d of %d upstream connections with the new key", reauthed, len(authed))
+
+	ids, err := id.announce(ctx, oldPubkey, secret)
+	return secret, ids, err
+}
+
+// announce publishes the relay profile under the new key and a note linking
+// the old key to it
+func (id *relayIdentity) announce(ctx context.Context, oldPubkey, secret string) ([]string, error) {
+	if id.publish == nil {
+		return nil, errors.New("transition events not published: no broadcast relays configured")
+	}
+	metadata, _ := json.Marshal(map[string]string{
+		"name":    id.relay.Info.Name,
+		"about":   id.relay.Info.Description,
+		"picture": id.relay.Info.Icon,
+	})
+	oldNpub, _ := nip19.EncodePublicKey(oldPubkey)
+	newPubkey, _ := nostr.GetPublicKey(secret)
+	newNpub, _ := nip19.EncodePublicKey(newPubkey)
+	events := []*nostr.Event{
+		{Kind: nostr.KindProfileMetadata, Content: string(metadata)},
+		{
+			Kind:    nostr.KindTextNote,
+			Tags:    nostr.Tags{{"p", oldPubkey}},
+			Content: fmt.Sprintf("This relay's key moved from nostr:%s to nostr:%s.", oldNpub, newNpub),
+		},
+	}
+	ids := []string{}
+	for _, evt := range events {
+		evt.CreatedAt = nostr.Now()
+		if err := evt.Sign(secret); err != nil {
+			return ids, err
+		}
+		if err := id.publish(ctx, evt); err != nil {
+			return ids, fmt.Errorf("publishing transition event: %w", err)
+		}
+		ids = append(ids, evt.ID)
+	}
+	return ids, nil
+}
+
+// rotateRequest is the body of POST /api/v1/admin/identity
+type rotateRequest struct {
+	// SecretKey is the new key as nsec or hex; empty generates one
+	SecretKey   string `json:"secret_key"`
+	GracePeriod string `json:"grace_period"`
+}
+
+// HandleIdentity serves GET (inspect) and POST (rotate) of the relay key
+func (id *relayIdentity) HandleIdentity(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSONEntity(w, req, http.StatusOK, id.GetStats())
+	case http.MethodPost:
+		var body rotateRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var grace time.Duration
+		if body.GracePeriod != "" {
+			var err error
+			if grace, err = time.ParseDuration(body.GracePeriod); err != nil || grace <= 0 {
+				http.Error(w, "invalid grace_period", http.StatusBadRequest)
+				return
+			}
+		}
+		secret, ids, err := id.Rotate(req.Context(), body.SecretKey, grace)
+		if secret == "" {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj := id.GetStats().(*jsonlib.JsonObject)
+		if body.SecretKey == "" {
+			// the only copy of a generated key; the operator must save it
+			nsec, _ := nip19.EncodePrivateKey(secret)
+			obj.Set("secret_key", jsonlib.NewJsonValue(nsec))
+		}
+		list := jsonlib.NewJsonList()
+		for _, eventID := range ids {
+			list.Append(jsonlib.NewJsonValue(eventID))
+		}
+		obj.Set("transition_events", list)
+		if err != nil {
+			obj.Set("error", jsonlib.NewJsonValue(err.Error()))
+		}
+		writeJSONEntity(w, req, http.StatusOK, obj)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (id *relayIdentity) GetStatsName() string {
+	return "identity"
+}
+
+// GetStats returns stats as JsonEntity
+func (id *relayIdentity) GetStats() jsonlib.JsonEntity {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkey", jsonlib.NewJsonValue(id.pubkey))
+	if id.prevPubkey != "" {
+		obj.Set("previous_pubkey", jsonlib.NewJsonValue(id.prevPubkey))
+		obj.Set("rotated_at", jsonlib.NewJsonValue(id.rotatedAt.Unix()))
+		obj.Set("grace_until", jsonlib.NewJsonValue(id.graceUntil.Unix()))
+		obj.Set("in_grace_period", jsonlib.NewJsonValue(time.Now().Before(id.graceUntil)))
+	}
+	obj.Set("authenticated_relays", jsonlib.NewJsonValue(len(id.authed)))
+	obj.Set("rotations", jsonlib.NewJsonValue(atomic.LoadInt64(&id.rotations)))
+	obj.Set("authentications", jsonlib.NewJsonValue(atomic.LoadInt64(&id.authentications)))
+	obj.Set("fallback_authentications", jsonlib.NewJsonValue(atomic.LoadInt64(&id.authFallbacks)))
+	obj.Set("auth_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&id.authFailures)))
+	return obj
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Bulk event import endpoint for Espelho de São Miguel.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Import tuning
+const (
+	// ImportMaxBodySize caps the JSONL body of one import
+	ImportMaxBodySize = 64 << 20
+	// ImportProgressInterval is how many events are processed between
+	// progress lines
+	ImportProgressInterval = 100
+	// importMaxReportedErrors caps the per-event errors in the summary
+	importMaxReportedErrors = 50
+)
+
+// importSummary is the progress and result of one import
+type importSummary struct {
+	Done       bool          `json:"done"`
+	Received   int           `json:"received"`
+	Accepted   int           `json:"accepted"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   int           `json:"rejected"`
+	Invalid    int           `json:"invalid"`
+	Errors     []importError `json:"errors,omitempty"`
+}
+
+// importError reports why one line of an import was not accepted
+type importError struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// fail records a line that was not accepted
+func (s *importSummary) fail(line int, id string, reason string) {
+	if len(s.Errors) < importMaxReportedErrors {
+		s.Errors = append(s.Errors, importError{Line: line, ID: id, Reason: reason})
+	}
+}
+
+// eventImporter serves POST /api/v1/import, taking a JSONL body of signed
+// events and feeding them one by one through the relay's normal write path,
+// reject policies and broadcasting included, at a fixed rate. It is meant
+// for users moving their notes from a relay that is going away. Requests
+// are authenticated with NIP-98 and may only carry events authored by the
+// signer; the admin token, or an API key with the import scope, lifts that
+// restriction. The response streams
+// progress as JSON lines, the last one with "done": true.
+type eventImporter struct {
+	relay      *khatru.Relay
+	adminToken string
+	serviceURL *serviceURLResolver
+	maxEvents  int
+	interval   time.Duration
+	// stats
+	imports  int64
+	accepted int64
+	rejected int64
+	denied   int64
+}
+
+// newEventImporter creates an importer accepting up to maxEvents per request
+// at rate events per second
+func newEventImporter(relay *khatru.Relay, adminToken string, serviceURL *serviceURLResolver, maxEvents int, rate int) *eventImporter {
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+	return &eventImporter{relay: relay, adminToken: adminToken, serviceURL: serviceURL, maxEvents: maxEvents, interval: interval}
+}
+
+// HandleImport serves the import endpoint
+func (im *eventImporter) HandleImport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, ImportMaxBodySize))
+	if err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	admin := hasAdminToken(req, im.adminToken) || hasAPIKey(req)
+	var pubkey string
+	if !admin {
+		if pubkey, err = verifyHTTPAuth(req, im.serviceURL, body); err != nil {
+			atomic.AddInt64(&im.denied, 1)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	// a paced import outlives the server's write timeout, so each progress
+	// line gives the response time for the next batch of events
+	batch := ImportProgressInterval * im.interval
+	extendWriteDeadline(w, batch)
+	report := func(s *importSummary) {
+		line, _ := json.Marshal(s)
+		w.Write(append(line, '\n'))
+		flusher.Flush()
+		extendWriteDeadline(w, batch)
+	}
+	atomic.AddInt64(&im.imports, 1)
+
+	summary := im.run(req, body, pubkey, report)
+	summary.Done = true
+	report(summary)
+	logging.Info("import from %s: %d received, %d accepted, %d duplicates, %d rejected, %d invalid",
+		khatru.GetIPFromRequest(req), summary.Received, summary.Accepted, summary.Duplicates, summary.Rejected, summary.Invalid)
+}
+
+// run validates and adds every event of body, calling report with the
+// progress every ImportProgressInterval events
+func (im *eventImporter) run(req *http.Request, body []byte, pubkey string, report func(*importSummary)) *importSummary {
+	ctx := req.Context()
+	summary := &importSummary{}
+	var pace <-chan time.Time
+	if im.interval > 0 {
+		ticker := time.NewTicker(im.interval)
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), ImportMaxBodySize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if summary.Received >= im.maxEvents {
+			summary.fail(line, "", fmt.Sprintf("too many events, at most %d per import", im.maxEvents))
+			break
+		}
+		summary.Received++
+
+		var evt nostr.Event
+		if err := json.Unmarshal(raw, &evt); err != nil {
+			summary.Invalid++
+			summary.fail(line, "", "invalid event json")
+			continue
+		}
+		if err := validateImportedEvent(&evt); err != nil {
+			summary.Invalid++
+			summary.fail(line, evt.ID, err.Error())
+			continue
+		}
+		if pubkey != "" && evt.PubKey != pubkey {
+			summary.Rejected++
+			atomic.AddInt64(&im.rejected, 1)
+			summary.fail(line, evt.ID, "restricted: you can only import your own events")
+			continue
+		}
+
+		if pace != nil {
+			select {
+			case <-pace:
+			case <-ctx.Done():
+				summary.fail(line, evt.ID, "import canceled")
+				return summary
+			}
+		}
+		skipBroadcast, err := im.relay.AddEvent(ctx, &evt)
+		switch {
+		case err == nil:
+			summary.Accepted++
+			atomic.AddInt64(&im.accepted, 1)
+			if !skipBroadcast {
+				im.relay.BroadcastEvent(&evt)
+			}
+		case relayerrors.Prefix(err) == relayerrors.PrefixDuplicate:
+			summary.Duplicates++
+		default:
+			summary.Rejected++
+			atomic.AddInt64(&im.rejected, 1)
+			summary.fail(line, evt.ID, err.Error())
+		}
+		if summary.Received%ImportProgressInterval == 0 {
+			report(summary)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		summary.fail(line, "", "reading body: "+err.Error())
+	}
+	return summary
+}
+
+// validateImportedEvent checks the id and signature of evt
+func validateImportedEvent(evt *nostr.Event) error {
+	if !evt.CheckID() {
+		return errors.New("invalid: event id does not match")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return errors.New("invalid: bad signature")
+	}
+	return nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (im *eventImporter) GetStatsName() string {
+	return "import"
+}
+
+// GetStats returns stats as JsonEntity
+func (im *eventImporter) GetStats() jsonlib.JsonEntity {
+	rate := 0.0
+	if im.interval > 0 {
+		rate = float64(time.Second) / float64(im.interval)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_events", jsonlib.NewJsonValue(im.maxEvents))
+	obj.Set("rate", jsonlib.NewJsonValue(rate))
+	obj.Set("imports", jsonlib.NewJsonValue(atomic.LoadInt64(&im.imports)))
+	obj.Set("accepted_events", jsonlib.NewJsonValue(atomic.LoadInt64(&im.accepted)))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&im.rejected)))
+	obj.Set("rejected_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&im.denied)))
+	return obj
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// InfluxDB line-protocol stats sink for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/nostr-lib/stats"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// influxSink periodically writes stats snapshots in InfluxDB line protocol to
+// an HTTP write endpoint or appends them to a file. Each subsystem becomes one
+// line tagged with the relay URL and the subsystem name; lists of per-upstream
+// objects become one line per upstream, also tagged with its URL.
+type influxSink struct {
+	target      string // http(s) write URL or file path
+	isHTTP      bool
+	token       string
+	measurement string
+	relayURL    string
+	interval    time.Duration
+	client      *http.Client
+	// stats
+	writes    int64
+	failures  int64
+	lastLines int64
+	lastWrite int64
+}
+
+// newInfluxSink creates a sink writing to target, an http(s) URL such as
+// http://influx:8086/api/v2/write?org=o&bucket=b&precision=s or a file path
+func newInfluxSink(target, token, measurement, relayURL string, interval time.Duration) *influxSink {
+	s := &influxSink{
+		target:      target,
+		token:       token,
+		measurement: influxEscape(measurement, true),
+		relayURL:    relayURL,
+		interval:    interval,
+		client:      &http.Client{Timeout: interval},
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		s.isHTTP = true
+	} else {
+		s.target = strings.TrimPrefix(target, "file://")
+	}
+	return s
+}
+
+// Start writes a snapshot every interval until ctx is cancelled
+func (s *influxSink) Start(ctx context.Context) {
+	logging.Info("writing InfluxDB stats to %s every %v", s.displayTarget(), s.interval)
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.write(now); err != nil {
+					atomic.AddInt64(&s.failures, 1)
+					logging.Warn("InfluxDB stats write to %s failed: %v", s.displayTarget(), err)
+				}
+			}
+		}
+	}()
+}
+
+// write renders and sends one snapshot of the collector
+func (s *influxSink) write(now time.Time) error {
+	all := stats.GetCollector().GetAllStats()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	lines := []string{}
+	for _, subsystem := range all.Keys() {
+		tags := map[string]string{"relay": s.relayURL, "subsystem": subsystem}
+		lines = s.appendLines(lines, all.GetOrNil(subsystem), tags, timestamp)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	body := strings.Join(lines, "\n") + "\n"
+
+	var err error
+	if s.isHTTP {
+		err = s.post(body)
+	} else {
+		err = s.appendFile(body)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.writes, 1)
+	atomic.StoreInt64(&s.lastLines, int64(len(lines)))
+	atomic.StoreInt64(&s.lastWrite, now.Unix())
+	logging.DebugMethod("influx", "write", "wrote %d lines to %s", len(lines), s.displayTarget())
+	return nil
+}
+
+// appendLines renders entity as one line with the given tags, plus one line
+// per upstream found in its lists
+func (s *influxSink) appendLines(lines []string, entity jsonlib.JsonEntity, tags map[string]string, timestamp string) []string {
+	fields := []string{}
+	nested := []string{}
+	var walk func(entity jsonlib.JsonEntity, path string)
+	walk = func(entity jsonlib.JsonEntity, path string) {
+		switch e := entity.(type) {
+		case *jsonlib.JsonObject:
+			for _, key := range e.Keys() {
+				name := key
+				if path != "" {
+					name = path + "." + key
+				}
+				walk(e.GetOrNil(key), name)
+			}
+		case *jsonlib.JsonList:
+			for _, item := range e.ToSlice() {
+				obj, ok := item.(*jsonlib.JsonObject)
+				if !ok {
+					continue
+				}
+				upstream := influxUpstream(obj)
+				if upstream == "" {
+					continue
+				}
+				itemTags := map[string]string{"upstream": upstream, "list": path}
+				for k, v := range tags {
+					itemTags[k] = v
+				}
+				nested = s.appendLines(nested, obj, itemTags, timestamp)
+			}
+		case *jsonlib.JsonValue:
+			if field, ok := influxField(e); ok && path != "" {
+				fields = append(fields, influxEscape(path, false)+"="+field)
+			}
+		}
+	}
+	walk(entity, "")
+
+	if len(fields) > 0 {
+		lines = append(lines, s.measurement+influxTags(tags)+" "+strings.Join(fields, ",")+" "+timestamp)
+	}
+	return append(lines, nested...)
+}
+
+// influxUpstream returns the relay URL an object of a list describes, if any
+func influxUpstream(obj *jsonlib.JsonObject) string {
+	for _, key := range []string{"relay", "url"} {
+		if v, ok := obj.GetOrNil(key).(*jsonlib.JsonValue); ok {
+			if s, ok := v.GetString(); ok && s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// influxField renders a value as a line-protocol field value
+func influxField(v *jsonlib.JsonValue) (string, bool) {
+	switch v.GetType() {
+	case "int":
+		return strconv.FormatInt(v.IntVal, 10) + "i", true
+	case "float":
+		return strconv.FormatFloat(v.FloatVal, 'f', -1, 64), true
+	case "bool":
+		return strconv.FormatBool(v.BoolVal), true
+	case "string":
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v.StringVal) + `"`, true
+	}
+	return "", false
+}
+
+// influxTags renders tags in sorted key order, skipping empty values
+func influxTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString("," + influxEscape(k, false) + "=" + influxEscape(tags[k], false))
+	}
+	return b.String()
+}
+
+// influxEscape escapes commas, equals signs and spaces in tag keys, tag
+// values and field keys; measurements only need commas and spaces escaped
+func influxEscape(s string, measurement bool) string {
+	if measurement {
+		return strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s)
+	}
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// post sends lines to the InfluxDB write endpoint
+func (s *influxSink) post(body string) error {
+	req, err := http.NewRequest(http.MethodPost, s.target, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// appendFile appends lines to the target file
+func (s *influxSink) appendFile(body string) error {
+	f, err := os.OpenFile(s.target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// displayTarget returns the target without the query string, which may carry
+// credentials
+func (s *influxSink) displayTarget() string {
+	target, _, _ := strings.Cut(s.target, "?")
+	return target
+}
+
+// GetStatsName returns the name of this stats provider
+func (s *influxSink) GetStatsName() string {
+	return "influx"
+}
+
+// GetStats returns stats as JsonEntity
+func (s *influxSink) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("target", jsonlib.NewJsonValue(s.displayTarget()))
+	obj.Set("interval_seconds", jsonlib.NewJsonValue(int64(s.interval.Seconds())))
+	obj.Set("writes", jsonlib.NewJsonValue(atomic.LoadInt64(&s.writes)))
+	obj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&s.failures)))
+	obj.Set("last_lines", jsonlib.NewJsonValue(atomic.LoadInt64(&s.lastLines)))
+	obj.Set("last_write", jsonlib.NewJsonValue(atomic.LoadInt64(&s.lastWrite)))
+	return obj
+}
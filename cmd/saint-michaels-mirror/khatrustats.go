@@ -0,0 +1,198 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Client-facing relay statistics for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// khatruStats reports the client-facing side of the relay, which the stores
+// and the mirror don't see: connected clients, live subscriptions, what
+// clients send and are sent, and what the reject hooks turned down, by the
+// prefix of the reason. Everything is taken from khatru's hooks, so the
+// HTTP event and query endpoints are counted along with websockets.
+type khatruStats struct {
+	relay *khatru.Relay
+	// clients holds the connected websockets; khatru may call the
+	// OnDisconnect hooks more than once per connection
+	clients sync.Map
+	// stats
+	connected           int64
+	peakConnected       int64
+	connections         int64
+	rejectedConnections int64
+	eventsReceived      int64
+	filtersReceived     int64
+	countsReceived      int64
+	storedEventsSent    int64
+	liveEventsSent      int64
+	mu                  sync.Mutex
+	rejectedEvents      map[string]int64 // by reason prefix
+	rejectedFilters     map[string]int64
+	rejectedCounts      map[string]int64
+}
+
+// newKhatruStats creates the provider
+func newKhatruStats() *khatruStats {
+	return &khatruStats{
+		rejectedEvents:  map[string]int64{},
+		rejectedFilters: map[string]int64{},
+		rejectedCounts:  map[string]int64{},
+	}
+}
+
+// Apply hooks the counters into r. It must be called after every other hook
+// is installed, since it wraps the reject hooks present at the time and
+// counts live events only once no PreventBroadcast hook held them back.
+func (k *khatruStats) Apply(r *khatru.Relay) {
+	k.relay = r
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		k.clients.Store(khatru.GetConnection(ctx), struct{}{})
+		atomic.AddInt64(&k.connections, 1)
+		n := atomic.AddInt64(&k.connected, 1)
+		for {
+			peak := atomic.LoadInt64(&k.peakConnected)
+			if n <= peak || atomic.CompareAndSwapInt64(&k.peakConnected, peak, n) {
+				break
+			}
+		}
+	})
+	r.OnDisconnect = append(r.OnDisconnect, func(ctx context.Context) {
+		if _, ok := k.clients.LoadAndDelete(khatru.GetConnection(ctx)); ok {
+			atomic.AddInt64(&k.connected, -1)
+		}
+	})
+
+	for i, reject := range r.RejectConnection {
+		r.RejectConnection[i] = func(req *http.Request) bool {
+			if reject(req) {
+				atomic.AddInt64(&k.rejectedConnections, 1)
+				return true
+			}
+			return false
+		}
+	}
+	for i, reject := range r.RejectEvent {
+		r.RejectEvent[i] = func(ctx context.Context, evt *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, evt)
+			if rejected {
+				k.rejected(k.rejectedEvents, msg)
+			}
+			return rejected, msg
+		}
+	}
+	for i, reject := range r.RejectFilter {
+		r.RejectFilter[i] = k.wrapFilterHook(reject, k.rejectedFilters)
+	}
+	for i, reject := range r.RejectCountFilter {
+		r.RejectCountFilter[i] = k.wrapFilterHook(reject, k.rejectedCounts)
+	}
+
+	// count what arrives before any reject hook runs
+	r.RejectEvent = slices.Insert(r.RejectEvent, 0, func(ctx context.Context, evt *nostr.Event) (bool, string) {
+		atomic.AddInt64(&k.eventsReceived, 1)
+		return false, ""
+	})
+	r.RejectFilter = slices.Insert(r.RejectFilter, 0, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		atomic.AddInt64(&k.filtersReceived, 1)
+		return false, ""
+	})
+	r.RejectCountFilter = slices.Insert(r.RejectCountFilter, 0, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		atomic.AddInt64(&k.countsReceived, 1)
+		return false, ""
+	})
+
+	r.OverwriteResponseEvent = append(r.OverwriteResponseEvent, func(ctx context.Context, evt *nostr.Event) {
+		atomic.AddInt64(&k.storedEventsSent, 1)
+	})
+	r.PreventBroadcast = append(r.PreventBroadcast, func(ws *khatru.WebSocket, evt *nostr.Event) bool {
+		atomic.AddInt64(&k.liveEventsSent, 1)
+		return false
+	})
+}
+
+// wrapFilterHook counts the filters reject turns down in counts
+func (k *khatruStats) wrapFilterHook(reject func(context.Context, nostr.Filter) (bool, string), counts map[string]int64) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		rejected, msg := reject(ctx, filter)
+		if rejected {
+			k.rejected(counts, msg)
+		}
+		return rejected, msg
+	}
+}
+
+// rejected counts a rejection with reason msg in counts
+func (k *khatruStats) rejected(counts map[string]int64, msg string) {
+	prefix := relayerrors.Prefix(errors.New(nostr.NormalizeOKMessage(msg, "blocked")))
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	counts[prefix]++
+}
+
+// GetStatsName returns the name of this stats provider
+func (k *khatruStats) GetStatsName() string {
+	return "khatru"
+}
+
+// GetStats returns stats as JsonEntity
+func (k *khatruStats) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("connected_clients", jsonlib.NewJsonValue(atomic.LoadInt64(&k.connected)))
+	obj.Set("peak_connected_clients", jsonlib.NewJsonValue(atomic.LoadInt64(&k.peakConnected)))
+	obj.Set("connections", jsonlib.NewJsonValue(atomic.LoadInt64(&k.connections)))
+	obj.Set("rejected_connections", jsonlib.NewJsonValue(atomic.LoadInt64(&k.rejectedConnections)))
+	if k.relay != nil {
+		obj.Set("subscriptions", jsonlib.NewJsonValue(len(k.relay.GetListeningFilters())))
+	}
+
+	received := jsonlib.NewJsonObject()
+	received.Set("events", jsonlib.NewJsonValue(atomic.LoadInt64(&k.eventsReceived)))
+	received.Set("filters", jsonlib.NewJsonValue(atomic.LoadInt64(&k.filtersReceived)))
+	received.Set("count_filters", jsonlib.NewJsonValue(atomic.LoadInt64(&k.countsReceived)))
+	obj.Set("received", received)
+
+	sent := jsonlib.NewJsonObject()
+	sent.Set("stored_events", jsonlib.NewJsonValue(atomic.LoadInt64(&k.storedEventsSent)))
+	sent.Set("live_events", jsonlib.NewJsonValue(atomic.LoadInt64(&k.liveEventsSent)))
+	obj.Set("sent", sent)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rejected := jsonlib.NewJsonObject()
+	rejected.Set("events", prefixCountsToJSON(k.rejectedEvents))
+	rejected.Set("filters", prefixCountsToJSON(k.rejectedFilters))
+	rejected.Set("count_filters", prefixCountsToJSON(k.rejectedCounts))
+	obj.Set("rejected", rejected)
+	return obj
+}
+
+// prefixCountsToJSON renders counts sorted by prefix
+func prefixCountsToJSON(counts map[string]int64) *jsonlib.JsonObject {
+	prefixes := make([]string, 0, len(counts))
+	for prefix := range counts {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	obj := jsonlib.NewJsonObject()
+	for _, prefix := range prefixes {
+		obj.Set(prefix, jsonlib.NewJsonValue(counts[prefix]))
+	}
+	return obj
+}
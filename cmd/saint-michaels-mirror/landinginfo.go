@@ -0,0 +1,56 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Machine-readable landing page data for Espelho de São Miguel.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/girino/nostr-lib/eventstore/broadcaststore"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+)
+
+// upstreamSummary tells how many upstreams of each kind the relay works
+// with, for the landing page data
+type upstreamSummary struct {
+	Profile               string `json:"profile,omitempty"`
+	QueryRemotes          int    `json:"query_remotes"`
+	ReachableQueryRemotes int    `json:"reachable_query_remotes"`
+	MirrorRemotes         int    `json:"mirror_remotes"`
+	BroadcastRelays       int    `json:"broadcast_relays"`
+	MandatoryRelays       int    `json:"mandatory_relays"`
+}
+
+// newUpstreamSummary counts the relays of the active profile; bs is nil
+// without broadcasting
+func newUpstreamSummary(profiles *profileController, rs *relaystore.RelayStore, bs *broadcaststore.BroadcastStore) upstreamSummary {
+	current := profiles.Current()
+	reachable, _ := rs.Reachability()
+	summary := upstreamSummary{
+		Profile:               profiles.Active(),
+		QueryRemotes:          len(current.Query),
+		ReachableQueryRemotes: reachable,
+		MirrorRemotes:         len(current.Mirror),
+		MandatoryRelays:       len(current.BroadcastMandatory),
+	}
+	if bs != nil {
+		summary.BroadcastRelays = bs.GetBroadcastSystem().GetRelayCount()
+	}
+	return summary
+}
+
+// writeInfo serves vm, the view model the HTML pages are rendered from, as
+// JSON at /api/v1/info, so status pages and bots need not scrape HTML
+func writeInfo(w http.ResponseWriter, req *http.Request, vm any) {
+	data, err := json.MarshalIndent(vm, "", "  ")
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, data)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream latency ranking for Espelho de São Miguel.
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// LatencyEWMAAlpha is the weight of the newest sample in the moving averages
+const LatencyEWMAAlpha = 0.3
+
+// relayLatency holds the moving averages of one upstream
+type relayLatency struct {
+	firstEvent  float64 // ms, EWMA over queries that returned events
+	eose        float64 // ms, EWMA over queries that reached EOSE
+	samples     int64
+	failures    int64
+	lastEOSE    time.Duration
+	lastUpdated time.Time
+}
+
+// latencyRanker measures how fast each upstream answers queries and ranks
+// them by the moving average of their EOSE time.
+type latencyRanker struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	relays  map[string]*relayLatency // by normalized URL
+}
+
+// newLatencyRanker creates a ranker; timeout is the penalty sample for
+// queries that fail or time out
+func newLatencyRanker(timeout time.Duration) *latencyRanker {
+	return &latencyRanker{
+		timeout: timeout,
+		relays:  map[string]*relayLatency{},
+	}
+}
+
+// Observe records the timing of one query to url. Queries that fail or never
+// reach EOSE count as taking the whole query timeout.
+func (l *latencyRanker) Observe(url string, firstEvent, eose time.Duration, err error) {
+	url = nostr.NormalizeURL(url)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.relays[url]
+	if !ok {
+		rl = &relayLatency{}
+		l.relays[url] = rl
+	}
+	if err != nil || eose == 0 {
+		rl.failures++
+		eose = l.timeout
+	}
+	rl.samples++
+	rl.lastEOSE = eose
+	rl.lastUpdated = time.Now()
+	rl.eose = ewma(rl.eose, float64(eose.Milliseconds()), rl.samples == 1)
+	if firstEvent > 0 {
+		rl.firstEvent = ewma(rl.firstEvent, float64(firstEvent.Milliseconds()), rl.firstEvent == 0)
+	}
+	logging.DebugMethod("latency", "Observe", "%s eose %v (ewma %.0fms)", url, eose, rl.eose)
+}
+
+// ewma folds sample into avg
+func ewma(avg, sample float64, first bool) float64 {
+	if first {
+		return sample
+	}
+	return LatencyEWMAAlpha*sample + (1-LatencyEWMAAlpha)*avg
+}
+
+// Order sorts urls fastest first. Relays without samples go first so they
+// get measured.
+func (l *latencyRanker) Order(urls []string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	score := func(url string) float64 {
+		if rl, ok := l.relays[nostr.NormalizeURL(url)]; ok {
+			return rl.eose
+		}
+		return -1
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return score(urls[i]) < score(urls[j])
+	})
+	return urls
+}
+
+// Snapshot returns a copy of the measurements of url, if any
+func (l *latencyRanker) Snapshot(url string) (relayLatency, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.relays[nostr.NormalizeURL(url)]
+	if !ok {
+		return relayLatency{}, false
+	}
+	return *rl, true
+}
+
+// Restore seeds the measurements of url with rl unless it has been measured
+// already, and tells if it did
+func (l *latencyRanker) Restore(url string, rl relayLatency) bool {
+	url = nostr.NormalizeURL(url)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.relays[url]; ok {
+		return false
+	}
+	l.relays[url] = &rl
+	return true
+}
+
+// URLs returns the relays measured so far
+func (l *latencyRanker) URLs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	urls := make([]string, 0, len(l.relays))
+	for url := range l.relays {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// GetStatsName returns the name of this stats provider
+func (l *latencyRanker) GetStatsName() string {
+	return "latency"
+}
+
+// GetStats returns stats as JsonEntity
+func (l *latencyRanker) GetStats() jsonlib.JsonEntity {
+	l.mu.Lock()
+	urls := make([]string, 0, len(l.relays))
+	for url := range l.relays {
+		urls = append(urls, url)
+	}
+	l.mu.Unlock()
+	ranked := l.Order(slices.Clone(urls))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := jsonlib.NewJsonList()
+	for i, url := range ranked {
+		rl := l.relays[url]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("relay", jsonlib.NewJsonValue(url))
+		obj.Set("rank", jsonlib.NewJsonValue(i+1))
+		obj.Set("ewma_eose_ms", jsonlib.NewJsonValue(int64(rl.eose)))
+		obj.Set("ewma_first_event_ms", jsonlib.NewJsonValue(int64(rl.firstEvent)))
+		obj.Set("last_eose_ms", jsonlib.NewJsonValue(rl.lastEOSE.Milliseconds()))
+		obj.Set("samples", jsonlib.NewJsonValue(rl.samples))
+		obj.Set("failures", jsonlib.NewJsonValue(rl.failures))
+		obj.Set("last_updated", jsonlib.NewJsonValue(rl.lastUpdated.Unix()))
+		list.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("ewma_alpha", jsonlib.NewJsonValue(LatencyEWMAAlpha))
+	obj.Set("relays", list)
+	return obj
+}
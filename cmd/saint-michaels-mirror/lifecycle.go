@@ -0,0 +1,132 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Ordered shutdown for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// shutdownPhase is a step of the shutdown; phases run in the order below
+type shutdownPhase int
+
+const (
+	// phaseStopAccepting stops accepting connections and requests
+	phaseStopAccepting shutdownPhase = iota
+	// phaseCloseClients closes client websockets, ending their subscriptions
+	phaseCloseClients
+	// phaseStopMirror stops mirroring events from the query remotes
+	phaseStopMirror
+	// phaseDrainBroadcast publishes the events still queued
+	phaseDrainBroadcast
+	// phaseClosePools closes the upstream connections
+	phaseClosePools
+	// phaseFlush writes out stats
+	phaseFlush
+	shutdownPhases
+)
+
+// shutdownPhaseNames names the phases in logs
+var shutdownPhaseNames = [shutdownPhases]string{
+	"stop accepting",
+	"close clients",
+	"stop mirror",
+	"drain broadcast",
+	"close pools",
+	"flush",
+}
+
+// shutdownHook is a step of a shutdown phase
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// lifecycle shuts the relay down in a fixed order, so nothing is closed
+// while something that depends on it is still running: clients are gone
+// before the mirror stops, the mirror stops before the broadcast queue is
+// drained, the queue is drained before the pools close and stats are
+// flushed last. Components register their steps as they start.
+type lifecycle struct {
+	phaseTimeout time.Duration
+	mu           sync.Mutex
+	hooks        [shutdownPhases][]shutdownHook
+	once         sync.Once
+	done         chan struct{}
+}
+
+// newLifecycle creates a lifecycle giving each phase up to phaseTimeout
+func newLifecycle(phaseTimeout time.Duration) *lifecycle {
+	return &lifecycle{phaseTimeout: phaseTimeout, done: make(chan struct{})}
+}
+
+// OnShutdown registers fn to run in phase, after the steps registered before
+// it. fn should give up when ctx is done.
+func (l *lifecycle) OnShutdown(phase shutdownPhase, name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks[phase] = append(l.hooks[phase], shutdownHook{name: name, fn: fn})
+}
+
+// OnClose registers fn, which neither fails nor takes a deadline, to run
+// in phase
+func (l *lifecycle) OnClose(phase shutdownPhase, name string, fn func()) {
+	l.OnShutdown(phase, name, func(ctx context.Context) error {
+		fn()
+		return nil
+	})
+}
+
+// Watch shuts down on SIGINT or SIGTERM; a second signal exits at once
+func (l *lifecycle) Watch() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logging.Info("received %v, shutting down", sig)
+		go func() {
+			<-sigs
+			logging.Warn("received a second signal, exiting before the shutdown is done")
+			os.Exit(1)
+		}()
+		l.Shutdown()
+	}()
+}
+
+// Shutdown runs the phases once; every call returns when they are done
+func (l *lifecycle) Shutdown() {
+	l.once.Do(func() {
+		defer close(l.done)
+		for phase := range shutdownPhases {
+			l.mu.Lock()
+			hooks := slices.Clone(l.hooks[phase])
+			l.mu.Unlock()
+			if len(hooks) == 0 {
+				continue
+			}
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), l.phaseTimeout)
+			for _, hook := range hooks {
+				if err := hook.fn(ctx); err != nil {
+					logging.Warn("shutdown: %s: %s: %v", shutdownPhaseNames[phase], hook.name, err)
+				}
+			}
+			cancel()
+			logging.DebugMethod("lifecycle", "Shutdown", "%s done in %v", shutdownPhaseNames[phase], time.Since(start))
+		}
+		logging.Info("shutdown complete")
+	})
+	<-l.done
+}
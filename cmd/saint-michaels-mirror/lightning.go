@@ -0,0 +1,387 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Lightning-paid write access for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// LightningRequestTimeout bounds a single call to the Lightning backend
+	LightningRequestTimeout = 10 * time.Second
+	// LightningInvoiceTTL is how long invoices are remembered
+	LightningInvoiceTTL = 24 * time.Hour
+	// LightningStatusInterval is how long the backend's answer that an
+	// invoice is unpaid is reused for status polls
+	LightningStatusInterval = 10 * time.Second
+)
+
+// invoiceBackend creates and checks Lightning invoices
+type invoiceBackend interface {
+	// CreateInvoice returns the payment hash and bolt11 of a new invoice;
+	// webhookURL is called by the backend once it is paid
+	CreateInvoice(ctx context.Context, amountSat int64, memo, webhookURL string) (string, string, error)
+	// Paid reports whether the invoice with the given payment hash is settled
+	Paid(ctx context.Context, hash string) (bool, error)
+}
+
+// lnbitsBackend issues invoices from an LNbits wallet using its invoice key
+type lnbitsBackend struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// newLNbitsBackend creates a backend for the LNbits instance at url
+func newLNbitsBackend(url, apiKey string) *lnbitsBackend {
+	return &lnbitsBackend{
+		url:    strings.TrimSuffix(url, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: LightningRequestTimeout},
+	}
+}
+
+// do sends a request to the LNbits API and decodes the JSON response into out
+func (b *lnbitsBackend) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", b.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("lnbits %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(out)
+}
+
+// CreateInvoice creates an incoming payment in the LNbits wallet
+func (b *lnbitsBackend) CreateInvoice(ctx context.Context, amountSat int64, memo, webhookURL string) (string, string, error) {
+	var resp struct {
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+		Bolt11         string `json:"bolt11"`
+	}
+	body := map[string]any{
+		"out":     false,
+		"amount":  amountSat,
+		"memo":    memo,
+		"webhook": webhookURL,
+	}
+	if err := b.do(ctx, http.MethodPost, "/api/v1/payments", body, &resp); err != nil {
+		return "", "", err
+	}
+	// newer LNbits versions return the invoice as bolt11
+	bolt11 := resp.PaymentRequest
+	if bolt11 == "" {
+		bolt11 = resp.Bolt11
+	}
+	if resp.PaymentHash == "" || bolt11 == "" {
+		return "", "", fmt.Errorf("lnbits returned no invoice")
+	}
+	return resp.PaymentHash, bolt11, nil
+}
+
+// Paid checks the payment status with LNbits
+func (b *lnbitsBackend) Paid(ctx context.Context, hash string) (bool, error) {
+	var resp struct {
+		Paid bool `json:"paid"`
+	}
+	if err := b.do(ctx, http.MethodGet, "/api/v1/payments/"+hash, nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Paid, nil
+}
+
+// lightningAdmission sells write access: it issues invoices for a pubkey and
+// admits the pubkey once the backend reports the invoice as paid. Payment
+// callbacks are never trusted on their own; the backend is always asked.
+type lightningAdmission struct {
+	backend    invoiceBackend
+	admissions *admissionList
+	priceSat   int64
+	duration   time.Duration
+	serviceURL *serviceURLResolver
+	rate       *rateLimiter // invoices per IP and per pubkey, nil = unlimited
+	maxPending int          // unpaid invoices held at once, 0 = unlimited
+	mu         sync.Mutex
+	checked    map[string]time.Time // payment hash -> last unpaid answer
+	// stats
+	invoicesCreated int64
+	invoicesPaid    int64
+	callbacks       int64
+	backendErrors   int64
+	rateLimited     int64
+	pendingFull     int64
+	statusCached    int64
+}
+
+// newLightningAdmission creates the gate; paid invoices admit for duration.
+// Each IP and each pubkey may request ratePerHour invoices per hour, or any
+// number when it is 0.
+func newLightningAdmission(backend invoiceBackend, admissions *admissionList, priceSat int64, duration time.Duration, serviceURL *serviceURLResolver, ratePerHour, maxPending int) *lightningAdmission {
+	l := &lightningAdmission{
+		backend:    backend,
+		admissions: admissions,
+		priceSat:   priceSat,
+		duration:   duration,
+		serviceURL: serviceURL,
+		maxPending: maxPending,
+		checked:    map[string]time.Time{},
+	}
+	if ratePerHour > 0 {
+		l.rate = newRateLimiter(ratePerHour, time.Hour, ratePerHour)
+	}
+	return l
+}
+
+// Start prunes old invoices until ctx is cancelled
+func (l *lightningAdmission) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				l.admissions.PruneInvoices(now.Add(-LightningInvoiceTTL))
+				l.pruneChecked(now.Add(-LightningStatusInterval))
+			}
+		}
+	}()
+}
+
+// recentlyUnpaid reports whether the backend said hash was unpaid less than
+// LightningStatusInterval ago
+func (l *lightningAdmission) recentlyUnpaid(hash string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	at, ok := l.checked[hash]
+	return ok && time.Since(at) < LightningStatusInterval
+}
+
+// pruneChecked forgets unpaid answers older than cutoff
+func (l *lightningAdmission) pruneChecked(cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for hash, at := range l.checked {
+		if at.Before(cutoff) {
+			delete(l.checked, hash)
+		}
+	}
+}
+
+// settle asks the backend whether a known invoice is paid and admits its
+// pubkey the first time it is
+func (l *lightningAdmission) settle(ctx context.Context, hash string, inv admissionInvoice) (bool, error) {
+	if inv.Paid {
+		return true, nil
+	}
+	paid, err := l.backend.Paid(ctx, hash)
+	if err != nil {
+		atomic.AddInt64(&l.backendErrors, 1)
+		return false, err
+	}
+	if !paid {
+		l.mu.Lock()
+		l.checked[hash] = time.Now()
+		l.mu.Unlock()
+		return false, nil
+	}
+	if pubkey, ok := l.admissions.SettleInvoice(hash, l.duration); ok {
+		atomic.AddInt64(&l.invoicesPaid, 1)
+		logging.Info("invoice %s paid, admitted %s", hash, pubkey)
+	}
+	return true, nil
+}
+
+// invoiceRequest is the body accepted by POST /api/v1/admission/invoice
+type invoiceRequest struct {
+	PubKey string `json:"pubkey"`
+}
+
+// HandleInvoice serves POST /api/v1/admission/invoice, creating an invoice
+// that admits the given pubkey
+func (l *lightningAdmission) HandleInvoice(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body invoiceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pubkey, err := parsePubKey(body.PubKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := khatru.GetIPFromRequest(req)
+	if l.rate != nil && (l.rate.Limited("ip:"+ip) || l.rate.Limited("pubkey:"+pubkey)) {
+		atomic.AddInt64(&l.rateLimited, 1)
+		logging.Warn("invoice rate limiter: rejected %s for %s", ip, pubkey)
+		http.Error(w, "too many invoices requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+	if l.maxPending > 0 && l.admissions.PendingInvoices() >= l.maxPending {
+		atomic.AddInt64(&l.pendingFull, 1)
+		logging.Warn("refused invoice for %s: %d unpaid invoices pending", pubkey, l.maxPending)
+		http.Error(w, "too many unpaid invoices, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	webhookURL := l.serviceURL.BaseURL(req) + apiPathPrefix + "admission/lightning"
+	memo := fmt.Sprintf("write access for %s", pubkey)
+	hash, bolt11, err := l.backend.CreateInvoice(req.Context(), l.priceSat, memo, webhookURL)
+	if err != nil {
+		atomic.AddInt64(&l.backendErrors, 1)
+		logging.Warn("failed to create invoice: %v", err)
+		http.Error(w, "failed to create invoice", http.StatusBadGateway)
+		return
+	}
+	l.admissions.AddInvoice(hash, admissionInvoice{
+		PubKey:    pubkey,
+		Bolt11:    bolt11,
+		AmountSat: l.priceSat,
+		Created:   time.Now(),
+	})
+	atomic.AddInt64(&l.invoicesCreated, 1)
+	logging.DebugMethod("lightning", "HandleInvoice", "invoice %s for %s", hash, pubkey)
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("payment_hash", jsonlib.NewJsonValue(hash))
+	obj.Set("bolt11", jsonlib.NewJsonValue(bolt11))
+	obj.Set("amount_sat", jsonlib.NewJsonValue(l.priceSat))
+	obj.Set("duration", jsonlib.NewJsonValue(l.duration.String()))
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// HandleInvoiceStatus serves GET /api/v1/admission/invoice/{hash}, which the
+// landing page polls until the invoice is paid
+func (l *lightningAdmission) HandleInvoiceStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := req.PathValue("hash")
+	if !nostr.IsValid32ByteHex(hash) {
+		http.Error(w, "invalid payment hash", http.StatusBadRequest)
+		return
+	}
+	inv, ok := l.admissions.Invoice(hash)
+	if !ok {
+		http.Error(w, "unknown invoice", http.StatusNotFound)
+		return
+	}
+	// polls reuse a recent unpaid answer; the payment callback always asks
+	// the backend, so a paid invoice is still noticed right away
+	if !inv.Paid && l.recentlyUnpaid(hash) {
+		atomic.AddInt64(&l.statusCached, 1)
+		obj := jsonlib.NewJsonObject()
+		obj.Set("paid", jsonlib.NewJsonValue(false))
+		writeJSONEntity(w, req, http.StatusOK, obj)
+		return
+	}
+	paid, err := l.settle(req.Context(), hash, inv)
+	if err != nil {
+		logging.Warn("failed to check invoice %s: %v", hash, err)
+		http.Error(w, "failed to check invoice", http.StatusBadGateway)
+		return
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("paid", jsonlib.NewJsonValue(paid))
+	if expires, ok := l.admissions.Expires(inv.PubKey); paid && ok && !expires.IsZero() {
+		obj.Set("expires_at", jsonlib.NewJsonValue(expires.Unix()))
+	}
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// HandleCallback serves POST /api/v1/admission/lightning, called by the
+// backend when an invoice is paid. The payment is verified with the backend.
+func (l *lightningAdmission) HandleCallback(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddInt64(&l.callbacks, 1)
+	var body struct {
+		PaymentHash string `json:"payment_hash"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil || !nostr.IsValid32ByteHex(body.PaymentHash) {
+		http.Error(w, "invalid payment callback", http.StatusBadRequest)
+		return
+	}
+	inv, ok := l.admissions.Invoice(body.PaymentHash)
+	if !ok {
+		http.Error(w, "unknown invoice", http.StatusNotFound)
+		return
+	}
+	paid, err := l.settle(req.Context(), body.PaymentHash, inv)
+	if err != nil {
+		logging.Warn("failed to verify payment %s: %v", body.PaymentHash, err)
+		http.Error(w, "failed to verify payment", http.StatusBadGateway)
+		return
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("paid", jsonlib.NewJsonValue(paid))
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (l *lightningAdmission) GetStatsName() string {
+	return "lightning"
+}
+
+// GetStats returns stats as JsonEntity
+func (l *lightningAdmission) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("price_sat", jsonlib.NewJsonValue(l.priceSat))
+	obj.Set("duration", jsonlib.NewJsonValue(l.duration.String()))
+	obj.Set("invoices_created", jsonlib.NewJsonValue(atomic.LoadInt64(&l.invoicesCreated)))
+	obj.Set("invoices_paid", jsonlib.NewJsonValue(atomic.LoadInt64(&l.invoicesPaid)))
+	obj.Set("callbacks", jsonlib.NewJsonValue(atomic.LoadInt64(&l.callbacks)))
+	obj.Set("backend_errors", jsonlib.NewJsonValue(atomic.LoadInt64(&l.backendErrors)))
+	if l.rate != nil {
+		obj.Set("invoice_rate_per_hour", jsonlib.NewJsonValue(l.rate.tokensPerInterval))
+	}
+	obj.Set("max_pending_invoices", jsonlib.NewJsonValue(l.maxPending))
+	obj.Set("rate_limited", jsonlib.NewJsonValue(atomic.LoadInt64(&l.rateLimited)))
+	obj.Set("pending_full", jsonlib.NewJsonValue(atomic.LoadInt64(&l.pendingFull)))
+	obj.Set("status_cached", jsonlib.NewJsonValue(atomic.LoadInt64(&l.statusCached)))
+	return obj
+}
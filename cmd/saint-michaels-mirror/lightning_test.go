@@ -0,0 +1,165 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of Lightning-paid write access for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeBackend issues numbered invoices and counts payment checks
+type fakeBackend struct {
+	mu     sync.Mutex
+	issued int
+	checks int
+	paid   map[string]bool
+}
+
+func (b *fakeBackend) CreateInvoice(ctx context.Context, amountSat int64, memo, webhookURL string) (string, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.issued++
+	return fmt.Sprintf("%064x", b.issued), fmt.Sprintf("lnbc%d", b.issued), nil
+}
+
+func (b *fakeBackend) Paid(ctx context.Context, hash string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checks++
+	return b.paid[hash], nil
+}
+
+// newTestLightning returns a gate over a fake backend persisting to a
+// temporary state file
+func newTestLightning(t *testing.T, rate, maxPending int) (*lightningAdmission, *fakeBackend, string) {
+	t.Helper()
+	stateFile := filepath.Join(t.TempDir(), "admission.json")
+	admissions, err := newAdmissionList("", 0, "", stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &fakeBackend{paid: map[string]bool{}}
+	return newLightningAdmission(backend, admissions, 1000, 0, newServiceURLResolver("", nil), rate, maxPending), backend, stateFile
+}
+
+// requestInvoice posts an invoice request for pubkey from ip
+func requestInvoice(l *lightningAdmission, ip, pubkey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, apiPathPrefix+"admission/invoice", strings.NewReader(`{"pubkey":"`+pubkey+`"}`))
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	l.HandleInvoice(w, req)
+	return w
+}
+
+func TestHandleInvoiceLimits(t *testing.T) {
+	pk1 := nostr.GeneratePrivateKey()
+	pubkey1, _ := nostr.GetPublicKey(pk1)
+	pk2 := nostr.GeneratePrivateKey()
+	pubkey2, _ := nostr.GetPublicKey(pk2)
+
+	t.Run("per ip", func(t *testing.T) {
+		l, _, _ := newTestLightning(t, 2, 0)
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			pubkey := pubkey1
+			if i%2 == 1 {
+				pubkey = pubkey2
+			}
+			if w := requestInvoice(l, "192.0.2.1", pubkey); w.Code != want {
+				t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+			}
+		}
+	})
+	t.Run("per pubkey", func(t *testing.T) {
+		l, _, _ := newTestLightning(t, 2, 0)
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			if w := requestInvoice(l, fmt.Sprintf("192.0.2.%d", i+1), pubkey1); w.Code != want {
+				t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+			}
+		}
+	})
+	t.Run("pending cap", func(t *testing.T) {
+		l, backend, _ := newTestLightning(t, 0, 2)
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable} {
+			if w := requestInvoice(l, fmt.Sprintf("192.0.2.%d", i+1), pubkey1); w.Code != want {
+				t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+			}
+		}
+		if backend.issued != 2 {
+			t.Fatalf("backend issued %d invoices, want 2", backend.issued)
+		}
+	})
+}
+
+func TestInvoicePersistence(t *testing.T) {
+	l, backend, stateFile := newTestLightning(t, 0, 0)
+	pk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(pk)
+
+	w := requestInvoice(l, "192.0.2.1", pubkey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var resp struct {
+		PaymentHash string `json:"payment_hash"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("unpaid invoice was written to the state file: %v", err)
+	}
+
+	status := func() bool {
+		req := httptest.NewRequest(http.MethodGet, apiPathPrefix+"admission/invoice/"+resp.PaymentHash, nil)
+		req.SetPathValue("hash", resp.PaymentHash)
+		w := httptest.NewRecorder()
+		l.HandleInvoiceStatus(w, req)
+		var body struct {
+			Paid bool `json:"paid"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("status %d: %v", w.Code, err)
+		}
+		return body.Paid
+	}
+	if status() || status() {
+		t.Fatal("unpaid invoice reported paid")
+	}
+	if backend.checks != 1 {
+		t.Fatalf("backend checked %d times, want 1", backend.checks)
+	}
+
+	// the callback always asks the backend, even while polls are cached
+	backend.paid[resp.PaymentHash] = true
+	req := httptest.NewRequest(http.MethodPost, apiPathPrefix+"admission/lightning", strings.NewReader(`{"payment_hash":"`+resp.PaymentHash+`"}`))
+	l.HandleCallback(httptest.NewRecorder(), req)
+	if !l.admissions.Admitted(pubkey) || !status() {
+		t.Fatal("paid invoice did not admit its pubkey")
+	}
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state admissionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if inv, ok := state.Invoices[resp.PaymentHash]; !ok || !inv.Paid {
+		t.Fatalf("paid invoice not persisted: %s", data)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Event size and tag count limits for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// eventLimits rejects events whose serialized size or tag count exceed the
+// configured maximums before they are fanned out to upstream relays.
+type eventLimits struct {
+	maxSize int
+	maxTags int
+	// stats
+	checked         int64
+	rejectedBySize  int64
+	rejectedByTags  int64
+	largestAccepted int64
+}
+
+// newEventLimits creates the limits; zero disables a limit
+func newEventLimits(maxSize, maxTags int) *eventLimits {
+	return &eventLimits{maxSize: maxSize, maxTags: maxTags}
+}
+
+// Apply advertises the limits in NIP-11 and installs the reject policy ahead
+// of every other RejectEvent hook. khatru verifies IDs and signatures before
+// any RejectEvent hook runs; raw messages are already capped by
+// WS_MAX_MESSAGE_SIZE before they are parsed.
+func (l *eventLimits) Apply(r *khatru.Relay, maxMessageLength int64) {
+	if r.Info.Limitation == nil {
+		r.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	r.Info.Limitation.MaxMessageLength = int(maxMessageLength)
+	r.Info.Limitation.MaxEventTags = l.maxTags
+
+	if l.maxSize <= 0 && l.maxTags <= 0 {
+		return
+	}
+	r.RejectEvent = slices.Insert(r.RejectEvent, 0, policyRejects.Event("event_size", l.RejectEvent))
+	logging.Info("event limits: max size %d bytes, max tags %d (0 = unlimited)", l.maxSize, l.maxTags)
+}
+
+// RejectEvent rejects events over the size or tag limits
+func (l *eventLimits) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	atomic.AddInt64(&l.checked, 1)
+
+	if l.maxTags > 0 && len(evt.Tags) > l.maxTags {
+		atomic.AddInt64(&l.rejectedByTags, 1)
+		logging.DebugMethod("limits", "RejectEvent", "event %s has %d tags, limit %d", evt.ID, len(evt.Tags), l.maxTags)
+		return true, fmt.Sprintf("invalid: event has %d tags, maximum is %d", len(evt.Tags), l.maxTags)
+	}
+
+	size := len(evt.String())
+	if l.maxSize > 0 && size > l.maxSize {
+		atomic.AddInt64(&l.rejectedBySize, 1)
+		logging.DebugMethod("limits", "RejectEvent", "event %s is %d bytes, limit %d", evt.ID, size, l.maxSize)
+		return true, fmt.Sprintf("invalid: event is %d bytes, maximum is %d", size, l.maxSize)
+	}
+
+	for {
+		largest := atomic.LoadInt64(&l.largestAccepted)
+		if int64(size) <= largest || atomic.CompareAndSwapInt64(&l.largestAccepted, largest, int64(size)) {
+			break
+		}
+	}
+	return false, ""
+}
+
+// GetStatsName returns the name of this stats provider
+func (l *eventLimits) GetStatsName() string {
+	return "event_limits"
+}
+
+// GetStats returns stats as JsonEntity
+func (l *eventLimits) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_event_size", jsonlib.NewJsonValue(l.maxSize))
+	obj.Set("max_event_tags", jsonlib.NewJsonValue(l.maxTags))
+	obj.Set("checked", jsonlib.NewJsonValue(atomic.LoadInt64(&l.checked)))
+	obj.Set("rejected_by_size", jsonlib.NewJsonValue(atomic.LoadInt64(&l.rejectedBySize)))
+	obj.Set("rejected_by_tags", jsonlib.NewJsonValue(atomic.LoadInt64(&l.rejectedByTags)))
+	obj.Set("largest_accepted", jsonlib.NewJsonValue(atomic.LoadInt64(&l.largestAccepted)))
+	return obj
+}
@@ -9,11 +9,14 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
+	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,11 +25,13 @@ import (
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/girino/nostr-lib/broadcast"
 	"github.com/girino/nostr-lib/eventstore/broadcaststore"
-	"github.com/girino/nostr-lib/eventstore/relaystore"
 	jsonlib "github.com/girino/nostr-lib/json"
-	"github.com/girino/nostr-lib/logging"
-	"github.com/girino/nostr-lib/mirror"
 	"github.com/girino/nostr-lib/stats"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/girino/saint-michaels-mirror/statsclient"
 	"github.com/nbd-wtf/go-nostr"
 	nip11 "github.com/nbd-wtf/go-nostr/nip11"
 	nip19 "github.com/nbd-wtf/go-nostr/nip19"
@@ -59,6 +64,9 @@ func getGoroutineHealthState(goroutineCount int) string {
 type appStatsProvider struct {
 	startTime time.Time
 	version   string
+	build     buildInfo
+	// features tells which optional subsystems are active in this instance
+	features map[string]bool
 }
 
 func (p *appStatsProvider) GetStatsName() string {
@@ -79,6 +87,24 @@ func (p *appStatsProvider) GetStats() jsonlib.JsonEntity {
 	appObj.Set("version", jsonlib.NewJsonValue(p.version))
 	appObj.Set("uptime", jsonlib.NewJsonValue(time.Since(p.startTime).Seconds()))
 
+	buildObj := jsonlib.NewJsonObject()
+	buildObj.Set("commit", jsonlib.NewJsonValue(p.build.commit))
+	buildObj.Set("date", jsonlib.NewJsonValue(p.build.date))
+	buildObj.Set("modified", jsonlib.NewJsonValue(p.build.modified))
+	buildObj.Set("go_version", jsonlib.NewJsonValue(p.build.goVersion))
+	appObj.Set("build", buildObj)
+
+	names := make([]string, 0, len(p.features))
+	for name := range p.features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	featuresObj := jsonlib.NewJsonObject()
+	for _, name := range names {
+		featuresObj.Set(name, jsonlib.NewJsonValue(p.features[name]))
+	}
+	appObj.Set("features", featuresObj)
+
 	goroutineObj := jsonlib.NewJsonObject()
 	goroutineObj.Set("count", jsonlib.NewJsonValue(goroutineCount))
 	goroutineObj.Set("health_state", jsonlib.NewJsonValue(goroutineHealthState))
@@ -118,7 +144,48 @@ func main() {
 	//   - VERBOSE=relaystore: enable verbose for relaystore module only
 	//   - VERBOSE=relaystore.QueryEvents,mirror: enable specific method + module
 	//   - VERBOSE=: disable all verbose logging (default)
-	logging.SetVerbose(cfg.Verbose)
+	//
+	// The filters can be changed at runtime via POST /api/v1/admin/logging.
+	logController := newLoggingController(cfg.Verbose)
+
+	// shut down in order on SIGINT or SIGTERM; components register the steps
+	// of the shutdown as they start
+	life := newLifecycle(cfg.ShutdownTimeout)
+
+	// load relay-set profiles and switch to the startup profile, if any
+	profiles, err := loadRelayProfiles(cfg.RelayProfilesFile)
+	if err != nil {
+		logging.Fatal("loading relay profiles: %v", err)
+	}
+	configuredRelays := baseProfile(cfg)
+	if cfg.Profile != "" {
+		if err := applyProfile(cfg, profiles, cfg.Profile); err != nil {
+			logging.Fatal("selecting relay profile: %v", err)
+		}
+		logging.Info("using relay profile %q", cfg.Profile)
+	}
+	if len(cfg.MirrorRemotes) == 0 {
+		cfg.MirrorRemotes = slices.Clone(cfg.QueryRemotes)
+	}
+
+	// account client and upstream traffic; installed before any upstream is dialed
+	bw := newBandwidthMeter()
+	bw.InstallUpstreamDialer()
+	bw.Start(context.Background())
+	stats.GetCollector().RegisterProvider(bw)
+
+	// learn which addresses upstream connections go to, so DNS changes only
+	// reopen those whose address is gone; installed before any upstream is dialed
+	var dw *dnsWatcher
+	if cfg.DNSRefreshInterval > 0 {
+		dw = newDNSWatcher(cfg.DNSRefreshInterval)
+		dw.InstallDialer()
+	}
+
+	// control websocket compression; the upstream offer is set before any dial
+	compression := newWSCompression(cfg.WSClientCompression, cfg.WSUpstreamCompression, bw)
+	compression.InstallUpstreamTransport()
+	stats.GetCollector().RegisterProvider(compression)
 
 	// create a basic khatru relay instance
 	r := khatru.NewRelay()
@@ -126,38 +193,111 @@ func main() {
 	// apply NIP-11 fields from config
 	ApplyToRelay(r, cfg)
 
-	// handle RELAY_SECKEY: accept nsec bech32 or raw hex; derive pubkey and set Info.PubKey if not provided
-	sec := cfg.RelaySecKey
-	if sec == "" {
-		// attempt to generate a new secret if none provided
-		s := nostr.GeneratePrivateKey()
-		if s != "" {
-			sec = s
-			logging.DebugMethod("main", "main", "generated new relay secret key")
-		}
-	}
-
-	// Derive relay pubkey if not already set
-	if sec != "" {
-		if strings.HasPrefix(sec, "nsec") {
-			// Decode nsec
-			if _, val, err := nip19.Decode(sec); err == nil {
-				if s, ok := val.(string); ok {
-					// derive pubkey
-					if pk, err := nostr.GetPublicKey(s); err == nil && r.Info.PubKey == "" {
-						r.Info.PubKey = pk
-					}
-				}
-			}
-		} else {
-			// assume it's hex
-			if _, err := hex.DecodeString(sec); err == nil {
-				if pk, err := nostr.GetPublicKey(sec); err == nil && r.Info.PubKey == "" {
-					r.Info.PubKey = pk
-				}
-			}
+	// apply websocket limits from config
+	applyServerLimits(r, cfg)
+	compression.Apply(r)
+
+	// time writes to clients and drop the ones that cannot keep up
+	var slow *slowConsumers
+	if cfg.SlowConsumerStall > 0 {
+		slow = newSlowConsumers(cfg.SlowConsumerStall, cfg.WSWriteWait, cfg.SlowConsumerMaxStalls, cfg.SlowConsumerKeepPercent)
+		slow.Apply(r)
+		stats.GetCollector().RegisterProvider(slow)
+	}
+
+	// reject oversized events before any other policy and before fanout
+	limits := newEventLimits(cfg.MaxEventSize, cfg.MaxEventTags)
+	limits.Apply(r, cfg.WSMaxMessageSize)
+	stats.GetCollector().RegisterProvider(limits)
+
+	// make sure upstreams receive events that hash to their id
+	canonical, err := newCanonicalCheck(cfg.CanonicalPolicy)
+	if err != nil {
+		logging.Fatal("%v", err)
+	}
+	canonical.Apply(r)
+	stats.GetCollector().RegisterProvider(canonical)
+
+	// keep archives of old events from being replayed to upstreams
+	var replay *replayProtection
+	if cfg.ReplayMaxAgeDays > 0 {
+		replay, err = newReplayProtection(time.Duration(cfg.ReplayMaxAgeDays)*24*time.Hour, cfg.ReplayPolicy, cfg.ReplayExemptKinds)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		replay.Apply(r)
+		stats.GetCollector().RegisterProvider(replay)
+	}
+
+	// catch the same note posted again and again under new ids
+	var duplicates *duplicateContent
+	if cfg.DuplicateContentWindow > 0 {
+		duplicates, err = newDuplicateContent(cfg.DuplicateContentWindow, cfg.DuplicateContentMaxCopies, cfg.DuplicateContentPolicy, cfg.DuplicateContentKinds)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		duplicates.Apply(r)
+		stats.GetCollector().RegisterProvider(duplicates)
+	}
+
+	// only admitted pubkeys may publish when payment is required
+	var admissions *admissionList
+	if cfg.PaymentRequired {
+		admissions, err = newAdmissionList(cfg.PaymentsURL, cfg.AdmissionDefaultDuration, cfg.AdmissionWebhookSecret, cfg.AdmissionStateFile, cfg.AdmissionPubKeys)
+		if err != nil {
+			logging.Fatal("failed to set up admissions: %v", err)
+		}
+		admissions.Apply(r)
+	}
+
+	// detect the advertised service URL from requests when not configured
+	serviceURL := newServiceURLResolver(cfg.RelayServiceURL, cfg.TrustedProxies)
+	r.OverwriteRelayInformation = append(r.OverwriteRelayInformation, serviceURL.OverwriteRelayInformation(r))
+
+	// the relay key pair, RELAY_SECKEY as nsec or hex; rotated via the admin API
+	identity := newRelayIdentity(r, cfg.RelaySecKey, cfg.KeyRotationGrace)
+
+	// trust tiers of upstream relays
+	trustTiers, err := parseTrustTiers(cfg.RelayTrustTiers)
+	if err != nil {
+		logging.Fatal("invalid RELAY_TRUST_TIERS: %v", err)
+	}
+
+	// remember which upstreams delivered recently seen events
+	var provenance *provenanceLog
+	if cfg.ProvenanceCacheSize > 0 {
+		provenance = newProvenanceLog(cfg.ProvenanceCacheSize)
+		if len(trustTiers) > 0 {
+			provenance.SetTrustTiers(trustTiers)
 		}
-		// do not log secrets
+	}
+
+	// one upstream pool for queries, counts, search, quorum, mirroring and
+	// publishing, so relays used in several roles get a single connection.
+	// go-nostr's penalty box then also applies to publishing, on top of our
+	// own.
+	var sharedPool *relaypool.Pool
+	if cfg.SharedPool {
+		opts := []nostr.PoolOption{nostr.WithPenaltyBox(), nostr.WithAuthHandler(identity.AuthHandler)}
+		if len(trustTiers) > 0 {
+			// skip signature verification on connections to high-trust relays
+			opts = append(opts, nostr.WithRelayOptions(trustTiers))
+		}
+		sharedPool = relaypool.New(withBandwidthRole(context.Background(), bandwidthRoleShared), opts...)
+		stats.GetCollector().RegisterProvider(sharedPool)
+		life.OnClose(phaseClosePools, "shared_pool", sharedPool.Close)
+	}
+
+	// simulate upstream failures in staging builds
+	var chaos *faultInjector
+	if chaosAvailable {
+		chaos, err = newFaultInjector(cfg.ChaosFaults, cfg.ChaosEOSEDelay)
+		if err != nil {
+			logging.Fatal("invalid CHAOS_FAULTS: %v", err)
+		}
+		stats.GetCollector().RegisterProvider(chaos)
+	} else if cfg.ChaosFaults != "" {
+		logging.Warn("CHAOS_FAULTS is ignored: fault injection needs a binary built with -tags chaos")
 	}
 
 	// initialize relaystore with mandatory query relays
@@ -169,17 +309,195 @@ func main() {
 		// No query remotes provided - fail
 		logging.Fatal("no query remotes provided - relaystore requires query remotes")
 	}
+	if provenance != nil {
+		rs.SetEventObserver(provenance.Observer(provenanceRoleQuery))
+	}
+	// rank query remotes by how fast they answer and fan out fastest first
+	latency := newLatencyRanker(relaystore.QueryTimeoutDuration)
+	observe, order := latency.Observe, latency.Order
+	var demoter *relayDemoter
+	if cfg.DemotionThreshold > 0 {
+		// leave query remotes that reject us or serve broken NIP-11 out of the fanout
+		demoter = newRelayDemoter(rs, cfg.DemotionThreshold, cfg.DemotionProbeInterval)
+		observe = func(url string, firstEvent, eose time.Duration, err error) {
+			latency.Observe(url, firstEvent, eose, err)
+			demoter.Observe(url, firstEvent, eose, err)
+		}
+		order = func(urls []string) []string {
+			return latency.Order(demoter.Order(urls))
+		}
+	}
+	// tell TLS failures of upstreams apart from other connection errors
+	tlsDiag := newTLSDiagnostics()
+	stats.GetCollector().RegisterProvider(tlsDiag)
+	observeLatency := observe
+	observe = func(url string, firstEvent, eose time.Duration, err error) {
+		observeLatency(url, firstEvent, eose, err)
+		tlsDiag.Observe(url, err)
+	}
+	var regions *relayRegions
+	if len(cfg.PreferredCountries) > 0 || len(cfg.RequiredCountries) > 0 {
+		// ask query remotes in the configured countries first
+		regions = newRelayRegions(cfg.PreferredCountries, cfg.RequiredCountries, cfg.QueryRemotes)
+		byLatency := order
+		order = func(urls []string) []string {
+			return regions.Order(byLatency(urls))
+		}
+	}
+	var routes *queryRoutes
+	if cfg.QueryRoutesFile != "" {
+		// send filters of some shapes only to the relays that serve them
+		routes, err = loadQueryRoutes(cfg.QueryRoutesFile)
+		if err != nil {
+			logging.Fatal("invalid QUERY_ROUTES_FILE: %v", err)
+		}
+		rs.SetQueryRouter(routes.Route)
+		stats.GetCollector().RegisterProvider(routes)
+		logging.Info("query routing: %d rules from %s", len(routes.routes), cfg.QueryRoutesFile)
+	}
+	rs.SetLatencyObserver(observe)
+	rs.SetRelayOrder(order, cfg.QueryHedgeDelay)
+	if cfg.MaxUpstreamSubscriptions > 0 {
+		// tell clients whose query was evicted that it will get no more events
+		rs.SetMaxSubscriptions(cfg.MaxUpstreamSubscriptions, func(ctx context.Context, reason string) {
+			if ws := khatru.GetConnection(ctx); ws != nil {
+				ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: khatru.GetSubscriptionID(ctx), Reason: reason})
+			}
+		})
+	}
+	// answer queries with what arrived by the deadline instead of waiting for
+	// hung upstreams, optionally telling the client ahead of the EOSE
+	if cfg.QueryDeadline <= 0 {
+		logging.Fatal("invalid QUERY_DEADLINE %v: must be positive", cfg.QueryDeadline)
+	}
+	var onPartial relaystore.PartialHandler
+	if cfg.QueryPartialNotices {
+		onPartial = func(ctx context.Context, pending []string) {
+			if ws := khatru.GetConnection(ctx); ws != nil {
+				ws.WriteJSON(nostr.NoticeEnvelope(fmt.Sprintf("partial: %d upstream relays did not answer within %v, results may be incomplete: %s", len(pending), cfg.QueryDeadline, strings.Join(pending, " "))))
+			}
+		}
+	}
+	rs.SetQueryDeadline(cfg.QueryDeadline, onPartial)
+	// close upstream legs of forwarded queries that would not stop on their own
+	rs.SetSubscriptionBudget(relaystore.SubscriptionBudget{
+		MaxEvents:   cfg.UpstreamSubMaxEvents,
+		MaxBytes:    cfg.UpstreamSubMaxBytes,
+		MaxDuration: cfg.UpstreamSubMaxDuration,
+	})
+	if sharedPool != nil {
+		rs.SetPool(sharedPool.Role(relaypool.RoleQuery))
+	}
+	rs.SetAuthenticator(identity.Authenticate)
+	if chaos != nil {
+		rs.SetFaultInjector(chaos.QueryFault)
+	}
+	// record why query remotes close forwarded queries and tell the clients
+	closed := newClosedNotices(cfg.UpstreamClosedNotices)
+	closed.Apply(r)
+	rs.SetClosedObserver(closed.Observe)
 	if err := rs.Init(); err != nil {
 		logging.Fatal("initializing relaystore: %v", err)
 	}
+	life.OnClose(phaseClosePools, "relaystore", rs.Close)
+	if demoter != nil {
+		demoter.Start(context.Background())
+	}
+
+	// penalty box shared by our own upstream pools (count, search, publish)
+	penalties := newPenaltyBox(cfg.PenaltyBoxBase, cfg.PenaltyBoxMax, cfg.PenaltyBoxThreshold)
+	penalties.SetFailureObserver(tlsDiag.DialFailure)
+	stats.GetCollector().RegisterProvider(penalties)
+
+	// initialize NIP-45 HLL counter from query remotes advertising NIP-45
+	var hc *hllCounter
+	if countRemotes := filterRelaysByNIP(context.Background(), cfg.QueryRemotes, 45); len(countRemotes) > 0 {
+		hc = newHLLCounter(countRemotes, penalties)
+		if sharedPool != nil {
+			hc.SetPool(sharedPool.Role(relaypool.RoleCount))
+		}
+		if err := hc.Init(); err != nil {
+			logging.Fatal("initializing hll counter: %v", err)
+		}
+		life.OnClose(phaseClosePools, "hll_counter", hc.Close)
+	}
+
+	// initialize NIP-50 search aggregator if enabled
+	var sa *searchAggregator
+	if cfg.SearchEnabled {
+		searchRemotes := cfg.SearchRemotes
+		if len(searchRemotes) == 0 {
+			// probe query remotes for NIP-50 support
+			searchRemotes = filterRelaysByNIP(context.Background(), cfg.QueryRemotes, 50)
+		}
+		if len(searchRemotes) == 0 {
+			logging.Warn("search enabled but no NIP-50 capable upstreams found - search aggregation disabled")
+		} else {
+			sa = newSearchAggregator(searchRemotes, penalties)
+			if provenance != nil {
+				sa.SetEventObserver(provenance.Observer(provenanceRoleSearch))
+			}
+			if sharedPool != nil {
+				sa.SetPool(sharedPool.Role(relaypool.RoleSearch))
+			}
+			if err := sa.Init(); err != nil {
+				logging.Fatal("initializing search aggregator: %v", err)
+			}
+			life.OnClose(phaseClosePools, "search", sa.Close)
+			logging.Info("search aggregator initialized with %d NIP-50 upstreams", len(searchRemotes))
+		}
+	}
+
+	// initialize quorum queries over the query remotes; the per-filter quorum:N
+	// search extension is always available, QUERY_QUORUM applies it to every query
+	qq := newQuorumQuery(cfg.QueryRemotes, cfg.QueryQuorum, cfg.QueryDeadline, penalties)
+	if provenance != nil {
+		qq.SetEventObserver(provenance.Observer(provenanceRoleQuery))
+	}
+	if sharedPool != nil {
+		qq.SetPool(sharedPool.Role(relaypool.RoleQuorum))
+	}
+	if err := qq.Init(); err != nil {
+		logging.Fatal("initializing quorum queries: %v", err)
+	}
+	life.OnClose(phaseClosePools, "quorum", qq.Close)
+	if cfg.QueryQuorum > 1 {
+		logging.Info("query quorum enabled: events must be returned by %d distinct query remotes", cfg.QueryQuorum)
+	}
 
 	// initialize mirror manager with query remotes or fail
 	var mm *mirror.MirrorManager
-	if len(cfg.QueryRemotes) > 0 {
-		mm = mirror.NewMirrorManager(cfg.QueryRemotes)
+	var mirrorKindStats *mirrorKinds
+	if len(cfg.MirrorRemotes) > 0 {
+		mm = mirror.NewMirrorManager(cfg.MirrorRemotes)
+		if provenance != nil {
+			mm.SetEventObserver(provenance.Observer(provenanceRoleMirror))
+		}
+		sampleRates, err := parseKindRates(cfg.MirrorSampleRates)
+		if err != nil {
+			logging.Fatal("invalid MIRROR_SAMPLE_RATES: %v", err)
+		}
+		if len(sampleRates) > 0 {
+			mm.SetSampleRates(sampleRates)
+			logging.Info("mirror sampling by kind: %v", sampleRates)
+		}
+		if len(trustTiers) > 0 {
+			mm.SetTrust(trustTiers, cfg.RelayTrustLowQuorum, cfg.RelayTrustLowWindow)
+			logging.Info("relay trust tiers: %v", trustTiers)
+		}
+		mm.SetInitialConnect(cfg.InitialConnectDeadline, cfg.InitialConnectJitter)
+		mm.SetDryRun(cfg.DryRun)
+		if cfg.MirrorKindsWindow > 0 {
+			mirrorKindStats = newMirrorKinds(cfg.MirrorKindsWindow)
+			mm.SetMirroredObserver(mirrorKindStats.Observe)
+		}
+		if sharedPool != nil {
+			mm.SetPool(sharedPool.Role(relaypool.RoleMirror))
+		}
 		if err := mm.Init(); err != nil {
 			logging.Fatal("initializing mirror manager: %v", err)
 		}
+		life.OnClose(phaseClosePools, "mirror", mm.Close)
 	} else {
 		// No query remotes provided - fail
 		logging.Fatal("no query remotes provided - mirror manager requires query remotes")
@@ -199,6 +517,9 @@ func main() {
 	}
 	// ensure SupportedNIPs contains 11, 42, and 45 (we add 45 in case a store/feature needs it)
 	ensureSupportedNips(r, []int{11, 42, 45})
+	if sa != nil {
+		ensureSupportedNips(r, []int{50})
+	}
 
 	// populate other NIP-11 fields from config if provided (explicitly override)
 	if cfg.RelayName != "" {
@@ -220,54 +541,101 @@ func main() {
 		r.Info.PubKey = cfg.RelayPubKey
 	}
 
-	// If we derived a secret earlier and didn't set the pubkey via config,
-	// try to set it here as a final step.
-	if r.Info.PubKey == "" && sec != "" {
-		if strings.HasPrefix(sec, "nsec") {
-			if _, val, err := nip19.Decode(sec); err == nil {
-				if s, ok := val.(string); ok {
-					if pk, err := nostr.GetPublicKey(s); err == nil {
-						r.Info.PubKey = pk
-					}
-				}
-			}
-		} else {
-			if _, err := hex.DecodeString(sec); err == nil {
-				if pk, err := nostr.GetPublicKey(sec); err == nil {
-					r.Info.PubKey = pk
-				}
-			}
+	// advertise the relay key unless the operator set a pubkey
+	if r.Info.PubKey == "" {
+		r.Info.PubKey = identity.PubKey()
+	}
+
+	// merge the operator's NIP-11 document over the generated one
+	var infoOverride *relayInfoOverride
+	if cfg.RelayInfoFile != "" {
+		if infoOverride, err = loadRelayInfoOverride(cfg.RelayInfoFile); err != nil {
+			logging.Fatal("loading relay info file: %v", err)
 		}
+		if err := infoOverride.Apply(r.Info); err != nil {
+			logging.Fatal("applying relay info file: %v", err)
+		}
+		logging.Info("merged NIP-11 document from %s", cfg.RelayInfoFile)
 	}
 
-	// Apply custom connection and filter policies for upstream relay protection
-	filterIpRateLimiter := policies.FilterIPRateLimiter(20, time.Minute, 100)
-	r.RejectFilter = append(r.RejectFilter,
-		// Restrictive filter rate limiting to prevent upstream overload
-		func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
-			reject, msg = filterIpRateLimiter(ctx, filter)
-			if reject {
-				logging.Warn("filter IP rate limiter: %v, %s, from: %s", reject, msg, khatru.GetIP(ctx))
-			}
-			return reject, msg
-		},
-	)
+	// Apply custom connection and filter policies for upstream relay protection.
+	// Filters are rate-limited per IP, or per pubkey for trusted clients, to
+	// prevent upstream overload
+	clientLimits, err := newClientLimits(cfg.TrustedPubKeys, cfg.FilterRate, cfg.FilterBurst, cfg.FilterMaxLimit,
+		cfg.TrustedFilterRate, cfg.TrustedFilterBurst, cfg.TrustedFilterMaxLimit)
+	if err != nil {
+		logging.Fatal("%v", err)
+	}
+	clientLimits.Apply(r)
+	stats.GetCollector().RegisterProvider(clientLimits)
+
+	// serve reads only to authenticated members
+	if cfg.RestrictedReads {
+		reads, err := newReadAccess(cfg.MemberPubKeys)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		reads.Apply(r)
+		stats.GetCollector().RegisterProvider(reads)
+	}
+
+	// restrict the relay to reads or writes
+	mode, err := newRelayMode(cfg.Mode)
+	if err != nil {
+		logging.Fatal("%v", err)
+	}
+	mode.Apply(r)
+	stats.GetCollector().RegisterProvider(mode)
+	// and tell NIP-11 readers that events are passed through, not kept
+	var retention *relayInfoOverride
+	if cfg.RelayRetentionInfo {
+		retention = newRetentionInfo(mode)
+	}
+
+	// NIP-42 AUTH flow: by default the challenge is sent on connect when who
+	// the client is matters; installed with the stats once every filter hook is
+	authFlow, err := newAuthFlow(cfg.AuthChallengeOnConnect, len(cfg.TrustedPubKeys) > 0 || cfg.RestrictedReads,
+		cfg.AuthChallengeTTL, cfg.AuthDuringSubscriptions, cfg.AuthOutcomeStats)
+	if err != nil {
+		logging.Fatal("%v", err)
+	}
 
 	// Strict connection rate limiting to prevent bot abuse
 	connectionRateLimiter := policies.ConnectionRateLimiter(1, time.Minute*5, 100)
 	r.RejectConnection = append(r.RejectConnection,
 		// Strict connection limiting to prevent bot abuse
-		func(req *http.Request) (reject bool) {
+		policyRejects.Connection("connection_rate_limit", func(req *http.Request) (reject bool) {
 			reject = connectionRateLimiter(req)
 			if reject {
 				logging.Warn("connection rate limiter: %v, from: %s", reject, khatru.GetIPFromRequest(req))
 			}
 			return reject
-		},
+		}),
 	)
 
+	// elect one of the instances sharing the upstreams to mirror and run
+	// broadcast discovery, so a scaled deployment does not do it once per
+	// instance
+	var coord *coordinator
+	if len(cfg.CoordinatorPeers) > 0 {
+		if cfg.CoordinatorInterval <= 0 {
+			logging.Fatal("invalid COORDINATOR_INTERVAL %v: must be positive", cfg.CoordinatorInterval)
+		}
+		id := cfg.InstanceID
+		if id == "" {
+			id, _ = os.Hostname()
+		}
+		coord = newCoordinator(id, cfg.CoordinatorPeers, cfg.CoordinatorInterval)
+	}
+
 	// initialize broadcaststore if seed relays are configured
 	var bs *broadcaststore.BroadcastStore
+	var pub *publisher
+	var broadcastResults *broadcastLog
+	var pinned *pinnedEvents
+	var quarantine *relayQuarantine
+	var poolGuard *poolGuard
+	var tuning *broadcastTuning
 	if len(cfg.BroadcastSeedRelays) > 0 {
 		// Create broadcast config
 		broadcastConfig := &broadcast.Config{
@@ -276,7 +644,7 @@ func main() {
 			MandatoryRelays:  cfg.BroadcastMandatoryRelays,
 			WorkerCount:      cfg.BroadcastWorkers,
 			CacheTTL:         5 * time.Minute,
-			InitialTimeout:   7 * time.Second,
+			InitialTimeout:   cfg.InitialConnectDeadline,
 		}
 
 		// Create broadcaststore
@@ -284,11 +652,31 @@ func main() {
 		if err := bs.Init(); err != nil {
 			logging.Fatal("initializing broadcaststore: %v", err)
 		}
-		defer bs.Close()
+		life.OnClose(phaseClosePools, "broadcaststore", bs.Close)
 
-		// Perform discovery from seed relays
+		// Perform discovery from seed relays, within the pool size and churn limits
 		ctx := context.Background()
-		bs.GetBroadcastSystem().DiscoverFromSeeds(ctx, cfg.BroadcastSeedRelays)
+		poolGuard = newPoolGuard(bs.GetBroadcastSystem(), cfg.BroadcastPoolMin, cfg.BroadcastPoolMax, cfg.DiscoveryMaxNewRelays, cfg.BroadcastPoolMaxChurn, cfg.BroadcastPoolChurnWindow)
+		if cfg.DiscoveryFollowsPubkey != "" {
+			follows, err := newFollowRelays(rs.QueryEvents, cfg.DiscoveryFollowsPubkey, cfg.DiscoveryFollowsMaxRelays, cfg.DiscoveryFollowsMinUsers)
+			if err != nil {
+				logging.Fatal("invalid DISCOVERY_FOLLOWS_PUBKEY: %v", err)
+			}
+			poolGuard.SetFollowRelays(follows)
+			stats.GetCollector().RegisterProvider(follows)
+		}
+		if cfg.RelayVetting {
+			vetter := newRelayVetter(cfg.RelayVettingTimeout)
+			poolGuard.SetVetter(vetter)
+			stats.GetCollector().RegisterProvider(vetter)
+		}
+		if cfg.RelayAliases {
+			aliases := newRelayAliases(cfg.RelayVettingTimeout)
+			poolGuard.SetAliases(aliases)
+			stats.GetCollector().RegisterProvider(aliases)
+		}
+		poolGuard.Discover(ctx, cfg.BroadcastSeedRelays)
+		stats.GetCollector().RegisterProvider(poolGuard)
 		bs.GetBroadcastSystem().MarkInitialized()
 
 		// Add mandatory relays to the manager for tracking
@@ -302,36 +690,321 @@ func main() {
 		// Register broadcaststore stats provider
 		stats.GetCollector().RegisterProvider(bs)
 
-		// Start periodic refresh
-		logging.Info("Starting periodic refresh background task...")
-		go startPeriodicRefresh(ctx, cfg, bs.GetBroadcastSystem())
+		// Publish through our own publisher so transient failures are retried
+		var publishPool *relaypool.Role
+		if sharedPool != nil {
+			publishPool = sharedPool.Role(relaypool.RolePublish)
+		}
+		pub = newPublisher(bs.GetBroadcastSystem(), cfg, publishPool, penalties)
+		pub.SetAuthenticator(identity.Authenticate)
+		pub.SetDryRun(cfg.DryRun)
+		relayLimits, err := parseRelayLimits(cfg.RelayLimits)
+		if err != nil {
+			logging.Fatal("invalid RELAY_LIMITS: %v", err)
+		}
+		pub.SetLimits(relayLimits)
+		pub.SetFaults(chaos)
+		if regions != nil {
+			regions.SetBroadcastSystem(bs.GetBroadcastSystem())
+			pub.SetRegions(regions)
+		}
+		if cfg.BroadcastLogSize > 0 {
+			broadcastResults = newBroadcastLog(cfg.BroadcastLogSize, cfg.AdminToken, serviceURL)
+			pub.SetResultLog(broadcastResults)
+		}
+		if len(cfg.BroadcastEnrichment) > 0 {
+			enrichment, err := newEnrichPipeline(cfg.BroadcastEnrichment, cfg.BroadcastClientTag, cfg.RelayServiceURL, identity.SignOwn)
+			if err != nil {
+				logging.Fatal("%v", err)
+			}
+			pub.SetEnrichment(enrichment)
+			stats.GetCollector().RegisterProvider(enrichment)
+		}
+		pub.Start()
+		identity.SetPublisher(pub.SaveEvent)
+		life.OnShutdown(phaseDrainBroadcast, "publisher", func(ctx context.Context) error {
+			err := pub.Drain(ctx)
+			pub.Close()
+			return err
+		})
+		stats.GetCollector().RegisterProvider(pub)
+		// let operators narrow or widen publishing without losing the scores
+		tuning = newBroadcastTuning(pub, broadcastConfig)
+
+		// keep pinned events replicated; the list is managed through the admin API
+		pinned, err = newPinnedEvents(rs.QueryEvents, pub.Republish, cfg.PinnedRebroadcastInterval, cfg.PinnedEvents)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		pinned.Start(ctx)
+		stats.GetCollector().RegisterProvider(pinned)
+
+		// retire discovered relays that stay unreachable for days
+		if cfg.RelayRetireDays > 0 {
+			quarantine, err = newRelayQuarantine(bs.GetBroadcastSystem(), time.Duration(cfg.RelayRetireDays)*24*time.Hour, cfg.RelayQuarantineStateFile)
+			if err != nil {
+				logging.Fatal("failed to set up relay quarantine: %v", err)
+			}
+			quarantine.SetPoolGuard(poolGuard)
+			quarantine.Start(ctx)
+			stats.GetCollector().RegisterProvider(quarantine)
+		}
+
+		// re-run discovery periodically from the seeds of the active profile;
+		// with an election only while this instance coordinates
+		if coord != nil && cfg.BroadcastRefreshInterval > 0 {
+			coord.Lead("discovery", func(ctx context.Context) {
+				poolGuard.StartRefresh(ctx, cfg.BroadcastRefreshInterval)
+			})
+		} else {
+			poolGuard.StartRefresh(ctx, cfg.BroadcastRefreshInterval)
+		}
+	}
+
+	// learn the countries of query remotes and broadcast relays
+	if regions != nil {
+		regions.Start(context.Background())
+		stats.GetCollector().RegisterProvider(regions)
+	}
+
+	// periodically re-resolve upstream hosts and reconnect when they move
+	if dw != nil {
+		dw.Watch(cfg.QueryRemotes...)
+		dw.Watch(cfg.BroadcastMandatoryRelays...)
+		// pools shared with the relaystore are watched once below
+		if hc != nil && hc.ownPool {
+			dw.WatchPool(hc.pool.SimplePool())
+		}
+		if sa != nil && sa.ownPool {
+			dw.WatchPool(sa.pool.SimplePool())
+		}
+		if qq.ownPool {
+			dw.WatchPool(qq.pool.SimplePool())
+		}
+		if sharedPool != nil {
+			dw.WatchPool(sharedPool.SimplePool())
+		} else if pub != nil {
+			dw.WatchPool(pub.pool.SimplePool())
+		}
+		dw.Start(context.Background())
+		stats.GetCollector().RegisterProvider(dw)
 	}
 
 	// hook store functions into relay
-	// Use broadcaststore for SaveEvent if available, otherwise use relaystore
-	if bs != nil {
-		r.StoreEvent = append(r.StoreEvent, bs.SaveEvent)
-		r.RejectEvent = append(r.RejectEvent, bs.RejectEvent)
-	} else {
-		r.StoreEvent = append(r.StoreEvent, rs.SaveEvent)
+	// Use the broadcast publisher for SaveEvent if available, otherwise use relaystore
+	saveEvent := rs.SaveEvent
+	if pub != nil {
+		saveEvent = pub.SaveEvent
+		r.RejectEvent = append(r.RejectEvent, policyRejects.Event("recently_published", pub.RejectEvent))
+	}
+	if replay != nil {
+		saveEvent = replay.Wrap(saveEvent)
+	}
+	r.StoreEvent = append(r.StoreEvent, saveEvent)
+
+	// read the blocklist, pinned events and relay profiles the admin
+	// publishes as NIP-78 documents; started once the profiles are set up
+	var remote *remoteConfig
+	if len(cfg.RemoteConfigRelays) > 0 {
+		remote, err = newRemoteConfig(cfg.RemoteConfigPubKey, cfg.RemoteConfigRelays, cfg.RemoteConfigInterval)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		remote.Apply(r)
+	}
+
+	// cap what each pubkey writes per day, charging only events the other
+	// policies accepted
+	var quotas *writeQuotas
+	if cfg.QuotaDailyEvents > 0 || cfg.QuotaDailyBytes > 0 || cfg.QuotaOverrides != "" {
+		overrides, err := parseQuotaOverrides(cfg.QuotaOverrides)
+		if err != nil {
+			logging.Fatal("invalid QUOTA_OVERRIDES: %v", err)
+		}
+		quotas, err = newWriteQuotas(writeQuota{events: int64(cfg.QuotaDailyEvents), bytes: cfg.QuotaDailyBytes}, overrides, cfg.QuotaStateFile, cfg.AdminToken, serviceURL)
+		if err != nil {
+			logging.Fatal("loading QUOTA_STATE_FILE: %v", err)
+		}
+		quotas.Apply(r)
+		quotas.Start(context.Background())
+		life.OnClose(phaseFlush, "write_quotas", quotas.Save)
+		stats.GetCollector().RegisterProvider(quotas)
+	}
+
+	// reject new events and pause publishing during maintenance
+	maintenanceWindows, err := parseMaintenanceSchedule(cfg.MaintenanceSchedule)
+	if err != nil {
+		logging.Fatal("invalid MAINTENANCE_SCHEDULE: %v", err)
+	}
+	maintenance := newMaintenanceMode(maintenanceWindows, pub)
+	if cfg.MaintenanceEnabled {
+		maintenance.SetEnabled(true)
+	}
+	maintenance.Start(context.Background())
+	r.RejectEvent = slices.Insert(r.RejectEvent, 0, policyRejects.Event("maintenance", maintenance.RejectEvent))
+	queryEvents := queryFunc(rs.QueryEvents)
+	var shadow *shadowQueries
+	if len(cfg.ShadowRemotes) > 0 && cfg.ShadowPercent > 0 {
+		// evaluate candidate upstreams with a copy of real queries
+		shadow = newShadowQueries(cfg.ShadowRemotes, cfg.ShadowPercent)
+		shadow.Init()
+		life.OnClose(phaseClosePools, "shadow", shadow.Close)
+		queryEvents = shadow.Wrap(queryEvents)
+		stats.GetCollector().RegisterProvider(shadow)
+	}
+	if sa != nil {
+		queryEvents = sa.Wrap(queryEvents)
+	}
+	queryEvents = qq.Wrap(queryEvents)
+	var andTags *andTagFilters
+	if cfg.AndTagFilters {
+		// NIP-119: AND tag filters are emulated on top of OR upstream queries
+		andTags = newAndTagFilters()
+		andTags.Apply(r)
+		queryEvents = andTags.Wrap(queryEvents)
+		stats.GetCollector().RegisterProvider(andTags)
+	}
+	// fix or reject slightly malformed client filters
+	leniency, err := newClientLeniency(cfg.ClientLeniency)
+	if err != nil {
+		logging.Fatal("%v", err)
+	}
+	if leniency != nil {
+		leniency.Apply(r)
+		stats.GetCollector().RegisterProvider(leniency)
 	}
-	r.QueryEvents = append(r.QueryEvents, rs.QueryEvents)
+	var hn *healthNotices
+	if cfg.HealthNotices {
+		// tell clients when results may be incomplete
+		hn = newHealthNotices(rs)
+		hn.Apply(r)
+		hn.Start(context.Background())
+		queryEvents = hn.Wrap(queryEvents)
+	}
+	r.QueryEvents = append(r.QueryEvents, queryEvents)
 	r.CountEvents = append(r.CountEvents, rs.CountEvents)
+	if hc != nil {
+		// HLL-eligible COUNT filters are answered with the merged upstream HLL
+		r.CountEventsHLL = append(r.CountEventsHLL, hc.CountEventsHLL)
+	}
 
-	// start event mirroring from query relays
-	if err := mm.StartMirroring(r); err != nil {
-		logging.Fatal("[mirror] failed to start mirroring: %v", err)
+	// start event mirroring from query relays; in degraded mode keep retrying
+	// in the background instead of exiting. Nobody can subscribe to mirrored
+	// events in write-only mode.
+	mirrorCtx, stopMirror := context.WithCancel(context.Background())
+	var recovery *upstreamRecovery
+	if !mode.Reads() {
+		logging.Info("not mirroring events in write-only mode")
+	} else if coord != nil {
+		// only the coordinator mirrors, retrying until upstreams are reachable
+		coord.Lead("mirror", leadMirroring(mm, r))
+	} else if err := mm.StartMirroring(r); err != nil {
+		if !cfg.StartDegraded {
+			logging.Fatal("[mirror] failed to start mirroring: %v", err)
+		}
+		recovery = newUpstreamRecovery(mm, r)
+		recovery.Start(mirrorCtx, err)
+	}
+	life.OnClose(phaseStopMirror, "mirror", func() {
+		stopMirror()
+		mm.StopMirroring()
+	})
+	if coord != nil {
+		coord.Start()
+		life.OnClose(phaseStopMirror, "coordinator", coord.Close)
+		stats.GetCollector().RegisterProvider(coord)
+	}
+	if chaos != nil {
+		chaos.Start(mirrorCtx, mm)
 	}
-	defer mm.StopMirroring()
 
 	// register stats providers with global collector
 	stats.GetCollector().RegisterProvider(rs)
 	if mm != nil {
 		stats.GetCollector().RegisterProvider(mm)
 	}
+	if sa != nil {
+		stats.GetCollector().RegisterProvider(sa)
+	}
+	stats.GetCollector().RegisterProvider(qq)
+	if hn != nil {
+		stats.GetCollector().RegisterProvider(hn)
+	}
+	stats.GetCollector().RegisterProvider(closed)
+	stats.GetCollector().RegisterProvider(latency)
+	if demoter != nil {
+		stats.GetCollector().RegisterProvider(demoter)
+	}
+	if hc != nil {
+		stats.GetCollector().RegisterProvider(hc)
+	}
+	if recovery != nil {
+		stats.GetCollector().RegisterProvider(recovery)
+	}
+	if cfg.UpdateCheck {
+		// warn when a newer release has been announced
+		updates, err := newUpdateChecker(Version, cfg.UpdateCheckPubKey, cfg.UpdateCheckRelays, cfg.UpdateCheckInterval)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		updates.Start(context.Background())
+		stats.GetCollector().RegisterProvider(updates)
+	}
+	if cfg.ClockCheckInterval > 0 {
+		// warn when the local clock drifts, which breaks since: now and created_at policies
+		clock := newClockCheck(cfg.ClockNTPServer, rs.QueryRemotes, cfg.ClockSkewThreshold, cfg.ClockCheckInterval)
+		clock.Start(context.Background())
+		stats.GetCollector().RegisterProvider(clock)
+	}
+	// optional subsystems active in this instance, in the app stats and at
+	// /api/v1/version
+	features := map[string]bool{
+		"broadcast":               bs != nil,
+		"broadcast_log":           broadcastResults != nil,
+		"mirroring":               mode.Reads(),
+		"search":                  sa != nil,
+		"hll_count":               hc != nil,
+		"query_quorum":            cfg.QueryQuorum > 1,
+		"query_partial_notices":   cfg.QueryPartialNotices,
+		"query_shadowing":         shadow != nil,
+		"client_auth":             cfg.RestrictedReads || len(cfg.TrustedPubKeys) > 0,
+		"restricted_reads":        cfg.RestrictedReads,
+		"paid_access":             admissions != nil,
+		"lightning":               cfg.LNbitsURL != "",
+		"replay_protection":       replay != nil,
+		"write_quotas":            quotas != nil,
+		"coordinator_election":    coord != nil,
+		"remote_config":           remote != nil,
+		"duplicate_content":       duplicates != nil,
+		"provenance":              provenance != nil,
+		"relay_trust_tiers":       len(trustTiers) > 0,
+		"relay_aliases":           bs != nil && cfg.RelayAliases,
+		"mirror_kinds":            mirrorKindStats != nil,
+		"api_keys":                cfg.AdminToken != "",
+		"shared_pool":             sharedPool != nil,
+		"demotion":                demoter != nil,
+		"regions":                 regions != nil,
+		"query_routes":            routes != nil,
+		"and_tag_filters":         andTags != nil,
+		"client_leniency":         leniency != nil,
+		"health_notices":          hn != nil,
+		"upstream_closed_notices": cfg.UpstreamClosedNotices,
+		"broadcast_enrichment":    bs != nil && len(cfg.BroadcastEnrichment) > 0,
+		"update_check":            cfg.UpdateCheck,
+		"clock_check":             cfg.ClockCheckInterval > 0,
+		"digest":                  cfg.DigestInterval > 0,
+		"profiling_snapshots":     cfg.ProfilingDir != "",
+		"client_compression":      cfg.WSClientCompression,
+		"upstream_compression":    cfg.WSUpstreamCompression,
+		"slow_consumers":          slow != nil,
+		"dry_run":                 cfg.DryRun,
+		"fault_injection":         chaos != nil,
+	}
 	stats.GetCollector().RegisterProvider(&appStatsProvider{
 		startTime: startTime,
 		version:   Version,
+		build:     readBuildInfo(),
+		features:  features,
 	})
 
 	// expose stats endpoint using the relay's router
@@ -339,6 +1012,7 @@ func main() {
 	mux.HandleFunc("/api/v1/stats", func(w http.ResponseWriter, req *http.Request) {
 		// Get stats from global collector
 		allStats := stats.GetCollector().GetAllStats()
+		allStats.Set("schema_version", jsonlib.NewJsonValue(statsclient.SchemaVersion))
 
 		// Marshal to JSON
 		jsonData, err := jsonlib.MarshalIndent(allStats, "", "  ")
@@ -347,148 +1021,210 @@ func main() {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonData)
+		writeJSON(w, req, http.StatusOK, jsonData)
 	})
 
-	// expose health endpoint for docker healthchecks
-	mux.HandleFunc("/api/v1/health", func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+	// merge the stats of other instances
+	if len(cfg.FederatedStatsPeers) > 0 {
+		cluster := newClusterStats(cfg.FederatedStatsPeers)
+		stats.GetCollector().RegisterProvider(cluster)
+		mux.HandleFunc(apiPathPrefix+"stats/cluster", cluster.HandleCluster)
+	}
 
-		// Get stats from global collector
-		allStats := stats.GetCollector().GetAllStats()
-		relayStatsEntity, _ := allStats.Get("relay")
-		mirrorStatsEntity, _ := allStats.Get("mirror")
-		broadcastStatsEntity, _ := allStats.Get("broadcaststore")
-		appStatsEntity, _ := allStats.Get("app")
-		relayStatsObj, _ := relayStatsEntity.(*jsonlib.JsonObject)
-		mirrorStatsObj, _ := mirrorStatsEntity.(*jsonlib.JsonObject)
-		broadcastStatsObj, _ := broadcastStatsEntity.(*jsonlib.JsonObject)
-		appStatsObj, _ := appStatsEntity.(*jsonlib.JsonObject)
-
-		// Extract health states
-		var mainHealthState string
-		var publishHealthState string
-		var queryHealthState string
-		var mirrorHealthState string
-		var broadcastHealthState string
-		var goroutineHealthState string
-		var consecutivePublishFailures int64
-		var consecutiveQueryFailures int64
-		var consecutiveMirrorFailures int64
-		var consecutiveBroadcastFailures int64
-
-		if relayStatsObj != nil {
-			if mainHealthStateVal, ok := relayStatsObj.Get("main_health_state"); ok {
-				if val, ok := mainHealthStateVal.(*jsonlib.JsonValue); ok {
-					mainHealthState, _ = val.GetString()
-				}
-			}
-			if state, ok := relayStatsObj.Get("publish_health_state"); ok {
-				if val, ok := state.(*jsonlib.JsonValue); ok {
-					publishHealthState, _ = val.GetString()
-				}
-			}
-			if state, ok := relayStatsObj.Get("query_health_state"); ok {
-				if val, ok := state.(*jsonlib.JsonValue); ok {
-					queryHealthState, _ = val.GetString()
-				}
-			}
-			if failures, ok := relayStatsObj.Get("consecutive_publish_failures"); ok {
-				if val, ok := failures.(*jsonlib.JsonValue); ok {
-					consecutivePublishFailures, _ = val.GetInt()
-				}
-			}
-			if failures, ok := relayStatsObj.Get("consecutive_query_failures"); ok {
-				if val, ok := failures.(*jsonlib.JsonValue); ok {
-					consecutiveQueryFailures, _ = val.GetInt()
-				}
-			}
-		}
+	// tell the other instances who coordinates
+	if coord != nil {
+		mux.HandleFunc(apiPathPrefix+"coordinator", coord.HandleStatus)
+	}
 
-		if mirrorStatsObj != nil {
-			if state, ok := mirrorStatsObj.Get("mirror_health_state"); ok {
-				if val, ok := state.(*jsonlib.JsonValue); ok {
-					mirrorHealthState, _ = val.GetString()
-				}
-			}
-			if failures, ok := mirrorStatsObj.Get("consecutive_mirror_failures"); ok {
-				if val, ok := failures.(*jsonlib.JsonValue); ok {
-					consecutiveMirrorFailures, _ = val.GetInt()
-				}
-			}
-			// Use mirror health state if it's worse
-			if mirrorHealthState == "RED" || (mirrorHealthState == "YELLOW" && mainHealthState == "GREEN") {
-				mainHealthState = mirrorHealthState
-			}
+	// expose the kinds and sizes of mirrored events
+	if mirrorKindStats != nil {
+		mux.HandleFunc(apiPathPrefix+"stats/mirror-kinds", mirrorKindStats.HandleMirrorKinds)
+	}
+
+	// expose event provenance
+	if provenance != nil {
+		stats.GetCollector().RegisterProvider(provenance)
+		mux.HandleFunc(apiPathPrefix+"events/{id}/provenance", provenance.HandleProvenance)
+	}
+
+	// expose where recently published events were sent
+	if broadcastResults != nil {
+		stats.GetCollector().RegisterProvider(broadcastResults)
+		mux.HandleFunc(apiPathPrefix+"events/{id}/broadcast-status", broadcastResults.HandleBroadcastStatus)
+	}
+
+	// switch relay-set profiles at runtime
+	profileController := newProfileController(profiles, configuredRelays, cfg.Profile, baseProfile(cfg))
+	profileController.rs = rs
+	profileController.mm = mm
+	profileController.qq = qq
+	profileController.hc = hc
+	if bs != nil {
+		profileController.system = bs.GetBroadcastSystem()
+		profileController.guard = poolGuard
+		profileController.pub = pub
+	}
+	stats.GetCollector().RegisterProvider(profileController)
+	if remote != nil {
+		remote.pinned = pinned
+		remote.profiles = profileController
+		remote.Start(context.Background())
+		stats.GetCollector().RegisterProvider(remote)
+	}
+	stats.GetCollector().RegisterProvider(maintenance)
+
+	// browse the upstream relays
+	var broadcastSystem *broadcast.BroadcastSystem
+	if bs != nil {
+		broadcastSystem = bs.GetBroadcastSystem()
+	}
+	relays := newRelayBrowser(profileController, broadcastSystem, latency, penalties)
+	stats.GetCollector().RegisterProvider(relays)
+	mux.HandleFunc(apiPathPrefix+"relays", relays.HandleRelays)
+
+	// grant third-party services scoped, rate-limited access to the HTTP API
+	var keys *apiKeys
+	if cfg.AdminToken != "" {
+		keys, err = newAPIKeys(cfg.APIKeysFile, cfg.APIKeyDefaultRate)
+		if err != nil {
+			logging.Fatal("failed to load API keys: %v", err)
 		}
+		stats.GetCollector().RegisterProvider(keys)
+		mux.HandleFunc(adminPathPrefix+"apikeys", adminHandler(cfg.AdminToken, keys.HandleAPIKeys))
+	}
 
-		if broadcastStatsObj != nil {
-			if state, ok := broadcastStatsObj.Get("health_state"); ok {
-				if val, ok := state.(*jsonlib.JsonValue); ok {
-					broadcastHealthState, _ = val.GetString()
-				}
-			}
-			if failures, ok := broadcastStatsObj.Get("consecutive_failures"); ok {
-				if val, ok := failures.(*jsonlib.JsonValue); ok {
-					consecutiveBroadcastFailures, _ = val.GetInt()
-				}
-			}
-			// Use broadcast health state if it's worse
-			if broadcastHealthState == "RED" || (broadcastHealthState == "YELLOW" && mainHealthState == "GREEN") {
-				mainHealthState = broadcastHealthState
-			}
+	// let users download their own events, authenticated with NIP-98
+	if cfg.ExportMaxEvents > 0 && mode.Reads() {
+		exporter := newEventExporter(queryEvents, cfg.AdminToken, serviceURL, cfg.ExportMaxEvents, cfg.ExportTimeout)
+		mux.HandleFunc(apiPathPrefix+"export", keys.Handler(apiScopeExport, exporter.HandleExport))
+		stats.GetCollector().RegisterProvider(exporter)
+	}
+	// and upload them when moving from another relay
+	if cfg.ImportMaxEvents > 0 && mode.Writes() {
+		importer := newEventImporter(r, cfg.AdminToken, serviceURL, cfg.ImportMaxEvents, cfg.ImportRate)
+		mux.HandleFunc(apiPathPrefix+"import", keys.Handler(apiScopeImport, importer.HandleImport))
+		stats.GetCollector().RegisterProvider(importer)
+	}
+	// and publish single events without a websocket
+	if cfg.EventEndpoint && mode.Writes() {
+		submitter := newEventSubmitter(r, serviceURL, broadcastResults, cfg.EventEndpointWait)
+		mux.HandleFunc(apiPathPrefix+"event", keys.Handler(apiScopeEvent, submitter.HandleSubmit))
+		stats.GetCollector().RegisterProvider(submitter)
+	}
+	// and check how much of their daily write quota is left
+	if quotas != nil {
+		mux.HandleFunc(apiPathPrefix+"quota", quotas.HandleQuota)
+	}
+	// and answer single filters for clients without a websocket library
+	if cfg.QueryEndpointMaxEvents > 0 && mode.Reads() {
+		httpQuery := newHTTPQuery(r, serviceURL, cfg.QueryEndpointMaxEvents, cfg.QueryDeadline)
+		mux.HandleFunc(apiPathPrefix+"query", keys.Handler(apiScopeQuery, httpQuery.HandleQuery))
+		stats.GetCollector().RegisterProvider(httpQuery)
+	}
+
+	// push stats to StatsD or Graphite
+	if cfg.MetricsExportURL != "" {
+		exporter, err := newMetricsExporter(cfg.MetricsExportURL, cfg.MetricsExportPrefix, cfg.MetricsExportInterval)
+		if err != nil {
+			logging.Fatal("%v", err)
 		}
+		stats.GetCollector().RegisterProvider(exporter)
+		exporter.Start(context.Background())
+		life.OnShutdown(phaseFlush, "metrics_export", func(ctx context.Context) error {
+			return exporter.push(time.Now())
+		})
+	}
 
-		if appStatsObj != nil {
-			if goroutinesObj, ok := appStatsObj.Get("goroutines"); ok {
-				if goroutinesVal, ok := goroutinesObj.(*jsonlib.JsonObject); ok {
-					if state, ok := goroutinesVal.Get("health_state"); ok {
-						if val, ok := state.(*jsonlib.JsonValue); ok {
-							goroutineHealthState, _ = val.GetString()
-							// Use goroutine health state if it's worse
-							if goroutineHealthState == "RED" || (goroutineHealthState == "YELLOW" && mainHealthState == "GREEN") {
-								mainHealthState = goroutineHealthState
-							}
-						}
-					}
-				}
-			}
+	// write stats snapshots in InfluxDB line protocol
+	if cfg.InfluxSink != "" {
+		relayURL := cfg.RelayServiceURL
+		if relayURL == "" {
+			relayURL, _ = os.Hostname()
 		}
+		influx := newInfluxSink(cfg.InfluxSink, cfg.InfluxToken, cfg.InfluxMeasurement, relayURL, cfg.InfluxInterval)
+		stats.GetCollector().RegisterProvider(influx)
+		influx.Start(context.Background())
+		life.OnShutdown(phaseFlush, "influx", func(ctx context.Context) error {
+			return influx.write(time.Now())
+		})
+	}
+
+	// purge pubkeys from local state on request and stop remembering them
+	forget, err := newForgetList(cfg.ForgetStateFile)
+	if err != nil {
+		logging.Fatal("failed to load forgotten pubkeys: %v", err)
+	}
+	if broadcastResults != nil {
+		broadcastResults.SetExclude(forget.Forgotten)
+		forget.SetEventSource(broadcastResults.ForgetPubKey)
+	}
+	if provenance != nil {
+		forget.AddEventStore("provenance", provenance.ForgetEvents)
+	}
+	if pub != nil {
+		forget.AddEventStore("publisher", pub.ForgetEvents)
+	}
+	if admissions != nil {
+		forget.AddPubKeyStore("admission", admissions.ForgetPubKey)
+	}
+	if pinned != nil {
+		forget.AddPubKeyStore("pinned", pinned.ForgetPubKey)
+	}
+	forget.AddPubKeyStore("client_limits", clientLimits.ForgetPubKey)
+	if quotas != nil {
+		forget.AddPubKeyStore("write_quotas", quotas.ForgetPubKey)
+	}
+	if duplicates != nil {
+		forget.AddPubKeyStore("duplicate_content", duplicates.ForgetPubKey)
+	}
+	forget.Apply(r)
+	stats.GetCollector().RegisterProvider(forget)
+	mux.HandleFunc(adminPathPrefix+"forget", adminHandler(cfg.AdminToken, forget.HandleForget))
+
+	// expose admin endpoints (disabled unless ADMIN_TOKEN is set)
+	mux.HandleFunc(adminPathPrefix+"logging", adminHandler(cfg.AdminToken, logController.HandleLogging))
+	mux.HandleFunc(adminPathPrefix+"profile", adminHandler(cfg.AdminToken, profileController.HandleProfile))
+	mux.HandleFunc(adminPathPrefix+"maintenance", adminHandler(cfg.AdminToken, maintenance.HandleMaintenance))
+	mux.HandleFunc(adminPathPrefix+"identity", adminHandler(cfg.AdminToken, identity.HandleIdentity))
+	if pinned != nil {
+		mux.HandleFunc(adminPathPrefix+"pinned", adminHandler(cfg.AdminToken, pinned.HandlePinned))
+	}
+	if tuning != nil {
+		mux.HandleFunc(adminPathPrefix+"broadcast", adminHandler(cfg.AdminToken, tuning.HandleBroadcast))
+	}
+	if chaos != nil {
+		mux.HandleFunc(adminPathPrefix+"chaos", adminHandler(cfg.AdminToken, chaos.HandleChaos))
+	}
+	if quarantine != nil {
+		mux.HandleFunc(adminPathPrefix+"quarantine", adminHandler(cfg.AdminToken, quarantine.HandleQuarantine))
+	}
+	reputation := newRelayReputation(broadcastSystem, latency)
+	mux.HandleFunc(adminPathPrefix+"reputation", adminHandler(cfg.AdminToken, reputation.HandleReputation))
+	mux.HandleFunc(adminPathPrefix+"tlsprobe", adminHandler(cfg.AdminToken, tlsDiag.HandleProbe))
+	stats.GetCollector().RegisterProvider(identity)
+	if admissions != nil {
+		stats.GetCollector().RegisterProvider(admissions)
+		mux.HandleFunc(adminPathPrefix+"admission", adminHandler(cfg.AdminToken, admissions.HandleAdmission))
+		mux.HandleFunc(apiPathPrefix+"admission/webhook", admissions.HandleWebhook)
+	}
 
-		// Determine HTTP status
-		var httpStatus int
-		var status string
-		switch mainHealthState {
-		case "GREEN":
-			httpStatus = http.StatusOK
-			status = "healthy"
-		case "YELLOW":
-			httpStatus = http.StatusOK
-			status = "degraded"
-		case "RED":
-			httpStatus = http.StatusServiceUnavailable
-			status = "unhealthy"
-		default:
-			httpStatus = http.StatusInternalServerError
-			status = "unknown"
-		}
-
-		// Build health response as JsonObject
-		health := jsonlib.NewJsonObject()
-		health.Set("status", jsonlib.NewJsonValue(status))
-		health.Set("service", jsonlib.NewJsonValue(r.Info.Name))
-		health.Set("version", jsonlib.NewJsonValue(Version))
-		health.Set("main_health_state", jsonlib.NewJsonValue(mainHealthState))
-		health.Set("publish_health_state", jsonlib.NewJsonValue(publishHealthState))
-		health.Set("query_health_state", jsonlib.NewJsonValue(queryHealthState))
-		health.Set("mirror_health_state", jsonlib.NewJsonValue(mirrorHealthState))
-		health.Set("broadcast_health_state", jsonlib.NewJsonValue(broadcastHealthState))
-		health.Set("goroutine_health_state", jsonlib.NewJsonValue(goroutineHealthState))
-		health.Set("consecutive_publish_failures", jsonlib.NewJsonValue(consecutivePublishFailures))
-		health.Set("consecutive_query_failures", jsonlib.NewJsonValue(consecutiveQueryFailures))
-		health.Set("consecutive_mirror_failures", jsonlib.NewJsonValue(consecutiveMirrorFailures))
-		health.Set("consecutive_broadcast_failures", jsonlib.NewJsonValue(consecutiveBroadcastFailures))
+	// sell write access for Lightning payments
+	var lightning *lightningAdmission
+	if admissions != nil && cfg.LNbitsURL != "" {
+		lightning = newLightningAdmission(newLNbitsBackend(cfg.LNbitsURL, cfg.LNbitsInvoiceKey), admissions, cfg.AdmissionPrice, cfg.AdmissionDefaultDuration, serviceURL, cfg.InvoiceRate, cfg.InvoiceMaxPending)
+		lightning.Start(context.Background())
+		stats.GetCollector().RegisterProvider(lightning)
+		mux.HandleFunc(apiPathPrefix+"admission/invoice", lightning.HandleInvoice)
+		mux.HandleFunc(apiPathPrefix+"admission/invoice/{hash}", lightning.HandleInvoiceStatus)
+		mux.HandleFunc(apiPathPrefix+"admission/lightning", lightning.HandleCallback)
+		logging.Info("selling write access for %d sats per %v through LNbits at %s", cfg.AdmissionPrice, cfg.AdmissionDefaultDuration, cfg.LNbitsURL)
+	} else if cfg.LNbitsURL != "" {
+		logging.Warn("LNBITS_URL is ignored unless PAYMENT_REQUIRED is enabled")
+	}
+
+	// expose health endpoint for docker healthchecks
+	mux.HandleFunc("/api/v1/health", func(w http.ResponseWriter, req *http.Request) {
+		_, httpStatus, health := healthStatus(r.Info.Name)
 
 		// Marshal to JSON
 		jsonData, err := jsonlib.MarshalIndent(health, "", "  ")
@@ -497,33 +1233,63 @@ func main() {
 			return
 		}
 
-		w.WriteHeader(httpStatus)
-		w.Write(jsonData)
+		writeJSON(w, req, httpStatus, jsonData)
 	})
 
-	// Define view model struct for templates
+	// load the posting policy and terms of service pages
+	var policyPage, termsPage *markdownPage
+	if cfg.PolicyFile != "" {
+		if policyPage, err = loadMarkdownPage("Posting Policy", "/policy", cfg.PolicyFile); err != nil {
+			logging.Fatal("loading posting policy: %v", err)
+		}
+	}
+	if cfg.TermsFile != "" {
+		if termsPage, err = loadMarkdownPage("Terms of Service", "/terms", cfg.TermsFile); err != nil {
+			logging.Fatal("loading terms of service: %v", err)
+		}
+	}
+	if policyPage != nil || termsPage != nil {
+		r.OverwriteRelayInformation = append(r.OverwriteRelayInformation, policyInfoOverwriter(serviceURL, policyPage, termsPage))
+	}
+
+	// Define view model struct for templates, also served as JSON at
+	// /api/v1/info; page-specific fields are left out there
 	type ViewModel struct {
-		Name           string
-		Description    string
-		PubKey         string
-		PubKeyNPub     string
-		Contact        string
-		ContactHref    string
-		ContactIsLink  bool
-		SoftwareHref   string
-		SoftwareIsLink bool
-		SupportedNIPs  []any
-		Software       string
-		Version        string
-		Icon           string
-		Banner         string
-		ServiceURL     string
-		ShowBackLink   bool
-		ProjectName    string
+		Name           string `json:"name"`
+		Description    string `json:"description"`
+		PubKey         string `json:"pubkey"`
+		PubKeyNPub     string `json:"npub"`
+		Contact        string `json:"contact"`
+		ContactHref    string `json:"contact_href,omitempty"`
+		ContactIsLink  bool   `json:"-"`
+		SoftwareHref   string `json:"software_href,omitempty"`
+		SoftwareIsLink bool   `json:"-"`
+		SupportedNIPs  []any  `json:"supported_nips"`
+		Software       string `json:"software"`
+		Version        string `json:"version"`
+		Icon           string `json:"icon,omitempty"`
+		Banner         string `json:"banner,omitempty"`
+		ServiceURL     string `json:"service_url"`
+		RelayURL       string `json:"relay_url"`
+		ShowBackLink   bool   `json:"-"`
+		ProjectName    string `json:"project_name"`
+		// paid write access
+		PaymentRequired  bool   `json:"payment_required"`
+		PaymentsURL      string `json:"payments_url,omitempty"`
+		LightningEnabled bool   `json:"lightning_enabled"`
+		AdmissionPrice   int64  `json:"admission_price,omitempty"`
+		AdmissionPeriod  string `json:"admission_period,omitempty"`
+		// posting policy and terms pages
+		HasPolicy     bool          `json:"has_policy"`
+		HasTerms      bool          `json:"has_terms"`
+		DocumentTitle string        `json:"-"`
+		Document      template.HTML `json:"-"`
+		// upstream relays in use, for /api/v1/info only
+		Upstreams upstreamSummary `json:"upstreams"`
 	}
 
 	// buildViewModel creates a view model from relay info
-	buildViewModel := func(showBackLink bool) ViewModel {
+	buildViewModel := func(req *http.Request, showBackLink bool) ViewModel {
 		vm := ViewModel{
 			Name:           r.Info.Name,
 			Description:    r.Info.Description,
@@ -539,9 +1305,19 @@ func main() {
 			Version:        r.Info.Version,
 			Icon:           r.Info.Icon,
 			Banner:         r.Info.Banner,
-			ServiceURL:     r.ServiceURL,
+			ServiceURL:     serviceURL.BaseURL(req),
+			RelayURL:       serviceURL.RelayURL(req),
 			ShowBackLink:   showBackLink,
 			ProjectName:    ProjectName,
+			HasPolicy:      policyPage != nil,
+			HasTerms:       termsPage != nil,
+		}
+		if admissions != nil {
+			vm.PaymentRequired = true
+			vm.PaymentsURL = cfg.PaymentsURL
+			vm.LightningEnabled = lightning != nil
+			vm.AdmissionPrice = cfg.AdmissionPrice
+			vm.AdmissionPeriod = cfg.AdmissionDefaultDuration.String()
 		}
 
 		// compute contact link if it's an email or nostr nip19 pub/profile
@@ -584,56 +1360,60 @@ func main() {
 		return vm
 	}
 
-	// renderTemplate is a helper function to render templates with error handling
-	renderTemplate := func(w http.ResponseWriter, tpl *template.Template, vm ViewModel, pageName string) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if err := tpl.Execute(w, vm); err != nil {
-			http.Error(w, "template render error", http.StatusInternalServerError)
-			logging.Error("%s template execute error: %v", pageName, err)
-		}
-	}
-
 	// khatru will serve NIP-11 itself; we only expose metrics here.
-	// parse templates with inheritance (base template + page templates)
-	baseTplPath := "cmd/saint-michaels-mirror/templates/base.html"
-
-	// parse main page template
-	mainTplPath := "cmd/saint-michaels-mirror/templates/index.html"
-	mainTpl, err := template.ParseFiles(baseTplPath, mainTplPath)
-	if err != nil {
-		logging.Fatal("failed to parse main template %s: %v", mainTplPath, err)
-	}
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		vm := buildViewModel(false) // Main page doesn't show back link
-		renderTemplate(w, mainTpl, vm, "main")
-	})
-
-	// parse stats page template
-	statsTplPath := "cmd/saint-michaels-mirror/templates/stats.html"
-	statsTpl, err := template.ParseFiles(baseTplPath, statsTplPath)
-	if err != nil {
-		logging.Fatal("failed to parse stats template %s: %v", statsTplPath, err)
+	// pages are parsed with inheritance (base template + page templates)
+	pages := newWebPages("cmd/saint-michaels-mirror/templates/base.html")
+	for _, page := range []struct {
+		route, file  string
+		showBackLink bool
+	}{
+		{"/", "index.html", false}, // main page doesn't show back link
+		{"/stats", "stats.html", true},
+		{"/health", "health.html", true},
+		{"/relays", "relays.html", true},
+	} {
+		handler, err := pages.Page(page.route, "cmd/saint-michaels-mirror/templates/"+page.file, func(req *http.Request) (any, error) {
+			return buildViewModel(req, page.showBackLink), nil
+		})
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		mux.HandleFunc(page.route, handler)
 	}
-	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-		vm := buildViewModel(true) // Stats page shows back link
-		renderTemplate(w, statsTpl, vm, "stats")
+	mux.HandleFunc(apiPathPrefix+"info", func(w http.ResponseWriter, req *http.Request) {
+		vm := buildViewModel(req, false)
+		vm.Upstreams = newUpstreamSummary(profileController, rs, bs)
+		writeInfo(w, req, vm)
 	})
+	mux.HandleFunc(apiPathPrefix+"version", newVersionHandler(r, features))
 
-	// parse health page template
-	healthTplPath := "cmd/saint-michaels-mirror/templates/health.html"
-	healthTpl, err := template.ParseFiles(baseTplPath, healthTplPath)
-	if err != nil {
-		logging.Fatal("failed to parse health template %s: %v", healthTplPath, err)
+	// posting policy and terms pages
+	for _, page := range []*markdownPage{policyPage, termsPage} {
+		if page == nil {
+			continue
+		}
+		pages.AddDocument(page)
+		handler, err := pages.Page(page.Path, "cmd/saint-michaels-mirror/templates/document.html", func(req *http.Request) (any, error) {
+			vm := buildViewModel(req, true) // Document pages show back link
+			document, err := page.Render(vm)
+			if err != nil {
+				return nil, err
+			}
+			vm.DocumentTitle = page.Title
+			vm.Document = document
+			return vm, nil
+		})
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		mux.HandleFunc(page.Path, handler)
 	}
-	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
-		vm := buildViewModel(true) // Health page shows back link
-		renderTemplate(w, healthTpl, vm, "health")
-	})
 
 	// serve static assets (icon/banner) from ./cmd/saint-michaels-mirror/static
-	fs := http.FileServer(http.Dir("cmd/saint-michaels-mirror/static"))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+	fs := newStaticHandler("cmd/saint-michaels-mirror/static", cfg.StaticCacheMaxAge)
+	mux.Handle("/static/", pages.Static("/static/", http.StripPrefix("/static/", fs)))
+	pages.Start(context.Background())
+	stats.GetCollector().RegisterProvider(pages)
 
 	// parse addr into host and port
 	host, portStr, err := net.SplitHostPort(cfg.Addr)
@@ -652,36 +1432,256 @@ func main() {
 		logging.Fatal("invalid port: %v", err)
 	}
 
+	authFlow.Apply(r)
+	stats.GetCollector().RegisterProvider(authFlow)
+
+	// count the client-facing side once every hook is installed
+	ks := newKhatruStats()
+	ks.Apply(r)
+	stats.GetCollector().RegisterProvider(ks)
+	stats.GetCollector().RegisterProvider(policyRejects)
+
+	if cfg.DigestInterval > 0 {
+		// summarize the period for the operator
+		digest, err := newOperatorDigest(cfg.DigestInterval, cfg.DigestAdminPubkey, ks, mm, pub, rs, identity)
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		digest.Start(context.Background())
+		stats.GetCollector().RegisterProvider(digest)
+		forget.AddPubKeyStore("digest", digest.ForgetPubKey)
+	}
+
+	if cfg.ProfilingDir != "" {
+		// keep profiles of degraded moments for post-incident analysis
+		profiling, err := newProfilingSnapshots(cfg.ProfilingDir, cfg.ProfilingMaxSnapshots, cfg.ProfilingCooldown, func() string {
+			state, _, _ := healthStatus(r.Info.Name)
+			return state
+		})
+		if err != nil {
+			logging.Fatal("profiling snapshots: %v", err)
+		}
+		profiling.Start(context.Background())
+		stats.GetCollector().RegisterProvider(profiling)
+	}
+
 	logging.Info("Starting %s on %s", ProjectName, cfg.Addr)
-	if err := r.Start(host, port); err != nil {
+	if cfg.DryRun {
+		logging.Warn("DRY_RUN enabled: events are routed and counted but not published upstream, and mirrored events are not sent to clients")
+	}
+	wraps := []func(http.Handler) http.Handler{compression.WrapHandler}
+	if retention != nil {
+		wraps = append(wraps, retention.Wrap)
+	}
+	if infoOverride != nil {
+		wraps = append(wraps, infoOverride.Wrap)
+	}
+	if andTags != nil {
+		wraps = append(wraps, andTags.WrapHandler)
+	}
+	if slow != nil {
+		wraps = append(wraps, slow.WrapHandler)
+	}
+	if leniency != nil {
+		// outside the NIP-119 rewriting, which parses filters strictly
+		wraps = append(wraps, leniency.WrapHandler)
+	}
+	wraps = append(wraps, authFlow.WrapHandler)
+	life.Watch()
+	if err := startServer(r, cfg, host, port, bw, life, wraps...); err != nil {
 		logging.Fatal("relay exited: %v", err)
 	}
+	// the server stops on shutdown or after a listener handover
+	life.Shutdown()
 }
 
-func startPeriodicRefresh(ctx context.Context, cfg *Config, broadcastSystem *broadcast.BroadcastSystem) {
-	ticker := time.NewTicker(cfg.BroadcastRefreshInterval)
-	defer ticker.Stop()
+// healthStatus combines the health states of the subsystems into the main
+// health state, returned with the HTTP status and the body of /api/v1/health
+func healthStatus(service string) (string, int, *jsonlib.JsonObject) {
+	// Get stats from global collector
+	allStats := stats.GetCollector().GetAllStats()
+	relayStatsEntity, _ := allStats.Get("relay")
+	mirrorStatsEntity, _ := allStats.Get("mirror")
+	broadcastStatsEntity, _ := allStats.Get("broadcaststore")
+	appStatsEntity, _ := allStats.Get("app")
+	startupStatsEntity, _ := allStats.Get("startup")
+	maintenanceStatsEntity, _ := allStats.Get("maintenance")
+	clockStatsEntity, _ := allStats.Get("clock")
+	relayStatsObj, _ := relayStatsEntity.(*jsonlib.JsonObject)
+	mirrorStatsObj, _ := mirrorStatsEntity.(*jsonlib.JsonObject)
+	broadcastStatsObj, _ := broadcastStatsEntity.(*jsonlib.JsonObject)
+	appStatsObj, _ := appStatsEntity.(*jsonlib.JsonObject)
+	startupStatsObj, _ := startupStatsEntity.(*jsonlib.JsonObject)
+	maintenanceStatsObj, _ := maintenanceStatsEntity.(*jsonlib.JsonObject)
+	clockStatsObj, _ := clockStatsEntity.(*jsonlib.JsonObject)
+
+	// Extract health states
+	var mainHealthState string
+	var publishHealthState string
+	var queryHealthState string
+	var mirrorHealthState string
+	var broadcastHealthState string
+	var goroutineHealthState string
+	var startupHealthState string
+	var maintenanceHealthState string
+	var clockHealthState string
+	var consecutivePublishFailures int64
+	var consecutiveQueryFailures int64
+	var consecutiveMirrorFailures int64
+	var consecutiveBroadcastFailures int64
+
+	if relayStatsObj != nil {
+		if mainHealthStateVal, ok := relayStatsObj.Get("main_health_state"); ok {
+			if val, ok := mainHealthStateVal.(*jsonlib.JsonValue); ok {
+				mainHealthState, _ = val.GetString()
+			}
+		}
+		if state, ok := relayStatsObj.Get("publish_health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				publishHealthState, _ = val.GetString()
+			}
+		}
+		if state, ok := relayStatsObj.Get("query_health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				queryHealthState, _ = val.GetString()
+			}
+		}
+		if failures, ok := relayStatsObj.Get("consecutive_publish_failures"); ok {
+			if val, ok := failures.(*jsonlib.JsonValue); ok {
+				consecutivePublishFailures, _ = val.GetInt()
+			}
+		}
+		if failures, ok := relayStatsObj.Get("consecutive_query_failures"); ok {
+			if val, ok := failures.(*jsonlib.JsonValue); ok {
+				consecutiveQueryFailures, _ = val.GetInt()
+			}
+		}
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			logging.Debug("")
-			logging.Debug("==============================================================")
-			logging.Info("Starting periodic relay refresh...")
-			logging.Debug("==============================================================")
+	if mirrorStatsObj != nil {
+		if state, ok := mirrorStatsObj.Get("mirror_health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				mirrorHealthState, _ = val.GetString()
+			}
+		}
+		if failures, ok := mirrorStatsObj.Get("consecutive_mirror_failures"); ok {
+			if val, ok := failures.(*jsonlib.JsonValue); ok {
+				consecutiveMirrorFailures, _ = val.GetInt()
+			}
+		}
+		// Use mirror health state if it's worse
+		if mirrorHealthState == "RED" || (mirrorHealthState == "YELLOW" && mainHealthState == "GREEN") {
+			mainHealthState = mirrorHealthState
+		}
+	}
 
-			broadcastSystem.DiscoverFromSeeds(ctx, cfg.BroadcastSeedRelays)
+	if broadcastStatsObj != nil {
+		if state, ok := broadcastStatsObj.Get("health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				broadcastHealthState, _ = val.GetString()
+			}
+		}
+		if failures, ok := broadcastStatsObj.Get("consecutive_failures"); ok {
+			if val, ok := failures.(*jsonlib.JsonValue); ok {
+				consecutiveBroadcastFailures, _ = val.GetInt()
+			}
+		}
+		// Use broadcast health state if it's worse
+		if broadcastHealthState == "RED" || (broadcastHealthState == "YELLOW" && mainHealthState == "GREEN") {
+			mainHealthState = broadcastHealthState
+		}
+	}
 
-			topRelays := broadcastSystem.GetTopRelays()
-			logging.Info("Refresh complete: %d top relays from %d total relays", len(topRelays), broadcastSystem.GetRelayCount())
-			logging.Debug("==============================================================")
-			logging.Debug("")
+	if appStatsObj != nil {
+		if goroutinesObj, ok := appStatsObj.Get("goroutines"); ok {
+			if goroutinesVal, ok := goroutinesObj.(*jsonlib.JsonObject); ok {
+				if state, ok := goroutinesVal.Get("health_state"); ok {
+					if val, ok := state.(*jsonlib.JsonValue); ok {
+						goroutineHealthState, _ = val.GetString()
+						// Use goroutine health state if it's worse
+						if goroutineHealthState == "RED" || (goroutineHealthState == "YELLOW" && mainHealthState == "GREEN") {
+							mainHealthState = goroutineHealthState
+						}
+					}
+				}
+			}
+		}
+	}
 
-		case <-ctx.Done():
-			logging.Debug("Periodic refresh stopped")
-			return
+	if startupStatsObj != nil {
+		if state, ok := startupStatsObj.Get("health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				startupHealthState, _ = val.GetString()
+			}
+		}
+		// Use startup health state if it's worse (RED while waiting for upstreams)
+		if startupHealthState == "RED" || (startupHealthState == "YELLOW" && mainHealthState == "GREEN") {
+			mainHealthState = startupHealthState
 		}
 	}
+
+	if maintenanceStatsObj != nil {
+		if state, ok := maintenanceStatsObj.Get("health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				maintenanceHealthState, _ = val.GetString()
+			}
+		}
+		// Report YELLOW while new events are rejected for maintenance
+		if maintenanceHealthState == "YELLOW" && mainHealthState == "GREEN" {
+			mainHealthState = maintenanceHealthState
+		}
+	}
+
+	if clockStatsObj != nil {
+		if state, ok := clockStatsObj.Get("health_state"); ok {
+			if val, ok := state.(*jsonlib.JsonValue); ok {
+				clockHealthState, _ = val.GetString()
+			}
+		}
+		// Report YELLOW while the local clock is skewed
+		if clockHealthState == "YELLOW" && mainHealthState == "GREEN" {
+			mainHealthState = clockHealthState
+		}
+	}
+
+	// Determine HTTP status
+	var httpStatus int
+	var status string
+	switch mainHealthState {
+	case "GREEN":
+		httpStatus = http.StatusOK
+		status = "healthy"
+	case "YELLOW":
+		httpStatus = http.StatusOK
+		status = "degraded"
+	case "RED":
+		httpStatus = http.StatusServiceUnavailable
+		status = "unhealthy"
+	default:
+		httpStatus = http.StatusInternalServerError
+		status = "unknown"
+	}
+
+	// Build health response as JsonObject
+	health := jsonlib.NewJsonObject()
+	health.Set("status", jsonlib.NewJsonValue(status))
+	health.Set("service", jsonlib.NewJsonValue(service))
+	health.Set("version", jsonlib.NewJsonValue(Version))
+	health.Set("main_health_state", jsonlib.NewJsonValue(mainHealthState))
+	health.Set("publish_health_state", jsonlib.NewJsonValue(publishHealthState))
+	health.Set("query_health_state", jsonlib.NewJsonValue(queryHealthState))
+	health.Set("mirror_health_state", jsonlib.NewJsonValue(mirrorHealthState))
+	health.Set("broadcast_health_state", jsonlib.NewJsonValue(broadcastHealthState))
+	health.Set("goroutine_health_state", jsonlib.NewJsonValue(goroutineHealthState))
+	health.Set("startup_health_state", jsonlib.NewJsonValue(startupHealthState))
+	health.Set("maintenance_health_state", jsonlib.NewJsonValue(maintenanceHealthState))
+	health.Set("clock_health_state", jsonlib.NewJsonValue(clockHealthState))
+	health.Set("consecutive_publish_failures", jsonlib.NewJsonValue(consecutivePublishFailures))
+	health.Set("consecutive_query_failures", jsonlib.NewJsonValue(consecutiveQueryFailures))
+	health.Set("consecutive_mirror_failures", jsonlib.NewJsonValue(consecutiveMirrorFailures))
+	health.Set("consecutive_broadcast_failures", jsonlib.NewJsonValue(consecutiveBroadcastFailures))
+
+	return mainHealthState, httpStatus, health
 }
 
 func ensureSupportedNips(r *khatru.Relay, nips []int) {
@@ -0,0 +1,264 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Maintenance mode for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MaintenanceCheckInterval is how often the schedule is evaluated
+const MaintenanceCheckInterval = 30 * time.Second
+
+// maintenanceWindow is a recurring UTC time range, daily or on one weekday
+type maintenanceWindow struct {
+	weekday time.Weekday
+	daily   bool
+	start   time.Duration // since midnight
+	end     time.Duration // since midnight, before start when crossing midnight
+	spec    string
+}
+
+// contains reports whether t falls inside the window
+func (w maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return (w.daily || t.Weekday() == w.weekday) && offset >= w.start && offset < w.end
+	}
+	// crosses midnight: the part before midnight belongs to the window's day,
+	// the part after it to the following day
+	if offset >= w.start {
+		return w.daily || t.Weekday() == w.weekday
+	}
+	return offset < w.end && (w.daily || t.Weekday() == (w.weekday+1)%7)
+}
+
+// parseMaintenanceSchedule parses comma-separated windows such as
+// "02:00-04:00" (daily) or "Sun 01:30-03:00", in UTC
+func parseMaintenanceSchedule(s string) ([]maintenanceWindow, error) {
+	windows := []maintenanceWindow{}
+	for _, item := range splitList(s) {
+		w := maintenanceWindow{daily: true, spec: item}
+		rangeSpec := item
+		if day, rest, ok := strings.Cut(item, " "); ok {
+			weekday, err := parseWeekday(day)
+			if err != nil {
+				return nil, err
+			}
+			w.daily = false
+			w.weekday = weekday
+			rangeSpec = strings.TrimSpace(rest)
+		}
+		startSpec, endSpec, ok := strings.Cut(rangeSpec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid maintenance window %q: expected HH:MM-HH:MM", item)
+		}
+		var err error
+		if w.start, err = parseClock(startSpec); err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", item, err)
+		}
+		if w.end, err = parseClock(endSpec); err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", item, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseWeekday parses a three-letter English weekday name
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// parseClock parses HH:MM into the time since midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// maintenanceMode rejects new events and pauses publishing while enabled by
+// an operator or while a scheduled window is open. Reads are still served.
+type maintenanceMode struct {
+	windows []maintenanceWindow
+	pub     *publisher // may be nil
+	manual  int32
+	mu      sync.Mutex
+	active  bool
+	since   time.Time
+	// stats
+	rejected int64
+	periods  int64
+}
+
+// newMaintenanceMode creates a maintenance mode with the given schedule
+func newMaintenanceMode(windows []maintenanceWindow, pub *publisher) *maintenanceMode {
+	return &maintenanceMode{windows: windows, pub: pub}
+}
+
+// scheduled reports whether a maintenance window is open at t
+func (m *maintenanceMode) scheduled(t time.Time) bool {
+	for _, w := range m.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether maintenance mode is on
+func (m *maintenanceMode) Active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// SetEnabled turns manual maintenance mode on or off
+func (m *maintenanceMode) SetEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&m.manual, 1)
+	} else {
+		atomic.StoreInt32(&m.manual, 0)
+	}
+	m.update(time.Now())
+}
+
+// update enters or leaves maintenance mode according to the manual switch
+// and the schedule
+func (m *maintenanceMode) update(now time.Time) {
+	manual := atomic.LoadInt32(&m.manual) == 1
+	active := manual || m.scheduled(now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if active == m.active {
+		return
+	}
+	m.active = active
+	m.since = now
+	if active {
+		m.periods++
+		logging.Warn("entering maintenance mode (manual=%v): rejecting new events, publishing paused", manual)
+		if m.pub != nil {
+			m.pub.Pause()
+		}
+	} else {
+		logging.Info("leaving maintenance mode")
+		if m.pub != nil {
+			m.pub.Resume()
+		}
+	}
+}
+
+// Start evaluates the schedule until ctx is cancelled
+func (m *maintenanceMode) Start(ctx context.Context) {
+	m.update(time.Now())
+	if len(m.windows) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(MaintenanceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.update(now)
+			}
+		}
+	}()
+}
+
+// RejectEvent rejects every event while maintenance mode is on
+func (m *maintenanceMode) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !m.Active() {
+		return false, ""
+	}
+	atomic.AddInt64(&m.rejected, 1)
+	return true, "blocked: maintenance, try again later"
+}
+
+// maintenanceRequest is the body accepted by POST /api/v1/admin/maintenance
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// HandleMaintenance serves GET (inspect) and POST (toggle) of maintenance mode
+func (m *maintenanceMode) HandleMaintenance(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body maintenanceRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Enabled == nil {
+			http.Error(w, "missing enabled", http.StatusBadRequest)
+			return
+		}
+		m.SetEnabled(*body.Enabled)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, m.GetStats())
+}
+
+// GetStatsName returns the name of this stats provider
+func (m *maintenanceMode) GetStatsName() string {
+	return "maintenance"
+}
+
+// GetStats returns stats as JsonEntity
+func (m *maintenanceMode) GetStats() jsonlib.JsonEntity {
+	m.mu.Lock()
+	active, since := m.active, m.since
+	periods := m.periods
+	m.mu.Unlock()
+
+	healthState := HealthGreen
+	if active {
+		healthState = HealthYellow
+	}
+	schedule := jsonlib.NewJsonList()
+	for _, w := range m.windows {
+		schedule.Append(jsonlib.NewJsonValue(w.spec))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("active", jsonlib.NewJsonValue(active))
+	obj.Set("manual", jsonlib.NewJsonValue(atomic.LoadInt32(&m.manual) == 1))
+	obj.Set("scheduled", jsonlib.NewJsonValue(m.scheduled(time.Now())))
+	obj.Set("schedule", schedule)
+	if !since.IsZero() {
+		obj.Set("since", jsonlib.NewJsonValue(since.Unix()))
+	}
+	obj.Set("periods", jsonlib.NewJsonValue(periods))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&m.rejected)))
+	obj.Set("health_state", jsonlib.NewJsonValue(healthState))
+	return obj
+}
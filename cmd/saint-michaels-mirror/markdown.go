@@ -0,0 +1,174 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Minimal Markdown to HTML conversion for Espelho de São Miguel pages.
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdHeadingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRe     = regexp.MustCompile(`^\s*([-*_])(\s*([-*_]))+\s*$`)
+	mdBulletRe   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrderedRe  = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdCodeSpanRe = regexp.MustCompile("`([^`]+)`")
+	mdLinkRe     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdAutoLinkRe = regexp.MustCompile(`&lt;((?:https?://|mailto:)[^\s&]+)&gt;`)
+	mdBoldRe     = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdItalicRe   = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	mdHoleRe     = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+// renderMarkdown converts the common subset of Markdown used for policy
+// documents (headings, paragraphs, lists, block quotes, code, rules, links
+// and emphasis) to HTML. Raw HTML in the source is escaped.
+func renderMarkdown(src string) template.HTML {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	renderMarkdownBlocks(&b, lines)
+	return template.HTML(b.String())
+}
+
+// renderMarkdownBlocks renders lines as a sequence of blocks
+func renderMarkdownBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			i++
+		case strings.HasPrefix(trimmed, "```"):
+			i++
+			b.WriteString("<pre><code>")
+			for ; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				b.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+			i++ // closing fence
+		case mdHeadingRe.MatchString(trimmed):
+			m := mdHeadingRe.FindStringSubmatch(trimmed)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), renderMarkdownInline(m[2]), len(m[1]))
+			i++
+		case mdRuleRe.MatchString(trimmed) && strings.Count(strings.ReplaceAll(trimmed, " ", ""), trimmed[:1]) >= 3:
+			b.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			quoted := []string{}
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				inner := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quoted = append(quoted, strings.TrimPrefix(inner, " "))
+			}
+			b.WriteString("<blockquote>\n")
+			renderMarkdownBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+		case mdBulletRe.MatchString(line) || mdOrderedRe.MatchString(line):
+			i = renderMarkdownList(b, lines, i)
+		default:
+			para := []string{}
+			for ; i < len(lines) && isMarkdownParagraphLine(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			b.WriteString("<p>" + renderMarkdownInline(strings.Join(para, " ")) + "</p>\n")
+		}
+	}
+}
+
+// isMarkdownParagraphLine reports whether line continues a paragraph
+func isMarkdownParagraphLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed != "" &&
+		!strings.HasPrefix(trimmed, "```") &&
+		!strings.HasPrefix(trimmed, ">") &&
+		!mdHeadingRe.MatchString(trimmed) &&
+		!mdBulletRe.MatchString(line) &&
+		!mdOrderedRe.MatchString(line)
+}
+
+// renderMarkdownList renders the list starting at lines[start] and returns
+// the index of the first line after it. Indented lines continue an item.
+func renderMarkdownList(b *strings.Builder, lines []string, start int) int {
+	ordered := !mdBulletRe.MatchString(lines[start])
+	itemRe, tag := mdBulletRe, "ul"
+	if ordered {
+		itemRe, tag = mdOrderedRe, "ol"
+	}
+	items := []string{}
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if m := itemRe.FindStringSubmatch(line); m != nil {
+			items = append(items, strings.TrimSpace(m[1]))
+			continue
+		}
+		if strings.TrimSpace(line) != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(items) > 0 {
+			items[len(items)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		break
+	}
+	b.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		b.WriteString("<li>" + renderMarkdownInline(item) + "</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// safeMarkdownURL reports whether a link target may be rendered
+func safeMarkdownURL(url string) bool {
+	for _, prefix := range []string{"http://", "https://", "mailto:", "/", "#"} {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderMarkdownInline escapes text and renders code spans, links and
+// emphasis. Code spans and links are set aside first so emphasis markers
+// inside them are kept literally.
+func renderMarkdownInline(text string) string {
+	holes := []string{}
+	hole := func(s string) string {
+		holes = append(holes, s)
+		return "\x00" + strconv.Itoa(len(holes)-1) + "\x00"
+	}
+
+	text = mdCodeSpanRe.ReplaceAllStringFunc(text, func(m string) string {
+		return hole("<code>" + html.EscapeString(m[1:len(m)-1]) + "</code>")
+	})
+	text = html.EscapeString(text)
+	text = mdLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdLinkRe.FindStringSubmatch(m)
+		label, url := parts[1], parts[2]
+		if !safeMarkdownURL(html.UnescapeString(url)) {
+			return label
+		}
+		return hole(`<a href="` + url + `" rel="noopener">` + label + `</a>`)
+	})
+	text = mdAutoLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+		url := mdAutoLinkRe.FindStringSubmatch(m)[1]
+		return hole(`<a href="` + url + `" rel="noopener">` + url + `</a>`)
+	})
+	text = mdBoldRe.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = mdItalicRe.ReplaceAllString(text, "<em>$1$2</em>")
+
+	// restore until no holes are left, since link labels may hold code spans
+	for mdHoleRe.MatchString(text) {
+		text = mdHoleRe.ReplaceAllStringFunc(text, func(m string) string {
+			n, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+			return holes[n]
+		})
+	}
+	return text
+}
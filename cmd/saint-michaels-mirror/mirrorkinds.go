@@ -0,0 +1,157 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Mirrored event kind histogram for Espelho de São Miguel.
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mirrorKindBuckets is how many buckets the window of the histogram is
+// split into; the oldest bucket is dropped as a whole
+const mirrorKindBuckets = 60
+
+// kindCount counts the mirrored events of one kind
+type kindCount struct {
+	events      int64
+	bytes       int64
+	rebroadcast int64
+}
+
+// kindBucket counts the events mirrored in one slice of the window
+type kindBucket struct {
+	start time.Time
+	kinds map[int]*kindCount
+}
+
+// mirrorKinds keeps a rolling histogram of the kinds of the events the
+// mirror receives and of their serialized size, so operators can see which
+// kinds take the bandwidth and tune MIRROR_SAMPLE_RATES.
+type mirrorKinds struct {
+	window  time.Duration
+	bucket  time.Duration
+	mu      sync.Mutex
+	buckets []*kindBucket // oldest first
+}
+
+// newMirrorKinds creates a histogram over the last window
+func newMirrorKinds(window time.Duration) *mirrorKinds {
+	return &mirrorKinds{window: window, bucket: max(window/mirrorKindBuckets, time.Second)}
+}
+
+// Observe counts evt; rebroadcast tells whether it passed sampling
+func (m *mirrorKinds) Observe(evt *nostr.Event, rebroadcast bool) {
+	size := int64(len(evt.String()))
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(now)
+	if n := len(m.buckets); n == 0 || now.Sub(m.buckets[n-1].start) >= m.bucket {
+		m.buckets = append(m.buckets, &kindBucket{start: now, kinds: map[int]*kindCount{}})
+	}
+	b := m.buckets[len(m.buckets)-1]
+	c, ok := b.kinds[evt.Kind]
+	if !ok {
+		c = &kindCount{}
+		b.kinds[evt.Kind] = c
+	}
+	c.events++
+	c.bytes += size
+	if rebroadcast {
+		c.rebroadcast++
+	}
+}
+
+// expire drops the buckets that started before the window; m.mu must be held
+func (m *mirrorKinds) expire(now time.Time) {
+	cutoff := now.Add(-m.window)
+	i := 0
+	for i < len(m.buckets) && m.buckets[i].start.Before(cutoff) {
+		i++
+	}
+	m.buckets = m.buckets[i:]
+}
+
+// HandleMirrorKinds serves GET /api/v1/stats/mirror-kinds
+func (m *mirrorKinds) HandleMirrorKinds(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	m.expire(now)
+	since := now
+	if len(m.buckets) > 0 {
+		since = m.buckets[0].start
+	}
+	totals := map[int]*kindCount{}
+	var events, bytes int64
+	for _, b := range m.buckets {
+		for kind, c := range b.kinds {
+			t, ok := totals[kind]
+			if !ok {
+				t = &kindCount{}
+				totals[kind] = t
+			}
+			t.events += c.events
+			t.bytes += c.bytes
+			t.rebroadcast += c.rebroadcast
+			events += c.events
+			bytes += c.bytes
+		}
+	}
+	m.mu.Unlock()
+
+	kinds := make([]int, 0, len(totals))
+	for kind := range totals {
+		kinds = append(kinds, kind)
+	}
+	// largest share of the bandwidth first
+	sort.Slice(kinds, func(i, j int) bool {
+		a, b := totals[kinds[i]], totals[kinds[j]]
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		return kinds[i] < kinds[j]
+	})
+	list := jsonlib.NewJsonList()
+	for _, kind := range kinds {
+		c := totals[kind]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("kind", jsonlib.NewJsonValue(kind))
+		obj.Set("events", jsonlib.NewJsonValue(c.events))
+		obj.Set("bytes", jsonlib.NewJsonValue(c.bytes))
+		obj.Set("rebroadcast", jsonlib.NewJsonValue(c.rebroadcast))
+		obj.Set("events_percent", jsonlib.NewJsonValue(percentOf(c.events, events)))
+		obj.Set("bytes_percent", jsonlib.NewJsonValue(percentOf(c.bytes, bytes)))
+		list.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("window", jsonlib.NewJsonValue(m.window.String()))
+	obj.Set("since", jsonlib.NewJsonValue(since.Unix()))
+	obj.Set("events", jsonlib.NewJsonValue(events))
+	obj.Set("bytes", jsonlib.NewJsonValue(bytes))
+	obj.Set("kinds", list)
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// percentOf returns n as a percentage of total, rounded to one decimal
+func percentOf(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n*1000/total) / 10
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Read-only and write-only operation modes for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+const (
+	// ModeReadWrite serves queries and accepts events
+	ModeReadWrite = "readwrite"
+	// ModeRead is a pure query and mirror aggregator that rejects every event
+	ModeRead = "read"
+	// ModeWrite is a pure broadcast gateway that rejects every query
+	ModeWrite = "write"
+)
+
+// readNIPs are the NIPs only meaningful to clients that can query
+var readNIPs = []int{45, 50}
+
+// relayMode restricts the relay to reads or writes
+type relayMode struct {
+	mode string
+	// stats
+	rejectedEvents  int64
+	rejectedFilters int64
+}
+
+// newRelayMode parses MODE; the empty string means readwrite
+func newRelayMode(mode string) (*relayMode, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		mode = ModeReadWrite
+	case ModeReadWrite, ModeRead, ModeWrite:
+	default:
+		return nil, fmt.Errorf("invalid MODE %q: must be read, write or readwrite", mode)
+	}
+	return &relayMode{mode: mode}, nil
+}
+
+// Reads reports whether queries are served
+func (m *relayMode) Reads() bool {
+	return m.mode != ModeWrite
+}
+
+// Writes reports whether events are accepted
+func (m *relayMode) Writes() bool {
+	return m.mode != ModeRead
+}
+
+// Apply installs the reject policies ahead of every other hook and adjusts
+// NIP-11: read-only relays advertise restricted_writes and write-only relays
+// stop advertising COUNT and search
+func (m *relayMode) Apply(r *khatru.Relay) {
+	if !m.Writes() {
+		if r.Info.Limitation == nil {
+			r.Info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		r.Info.Limitation.RestrictedWrites = true
+		r.RejectEvent = slices.Insert(r.RejectEvent, 0, policyRejects.Event("mode", m.RejectEvent))
+	}
+	if !m.Reads() {
+		r.RejectFilter = slices.Insert(r.RejectFilter, 0, policyRejects.Filter("mode", m.RejectFilter))
+		r.RejectCountFilter = slices.Insert(r.RejectCountFilter, 0, policyRejects.CountFilter("mode", m.RejectFilter))
+		// khatru adds NIP-45 itself when COUNT handlers are set
+		r.OverwriteRelayInformation = append(r.OverwriteRelayInformation, func(ctx context.Context, req *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			info.SupportedNIPs = slices.DeleteFunc(slices.Clone(info.SupportedNIPs), func(v any) bool {
+				n, ok := nipNumber(v)
+				return ok && slices.Contains(readNIPs, n)
+			})
+			return info
+		})
+	}
+	if m.mode != ModeReadWrite {
+		logging.Info("running in %s-only mode", m.mode)
+	}
+}
+
+// RejectEvent rejects every event in read-only mode
+func (m *relayMode) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	atomic.AddInt64(&m.rejectedEvents, 1)
+	return true, "blocked: this relay is read-only"
+}
+
+// RejectFilter rejects every query in write-only mode
+func (m *relayMode) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	atomic.AddInt64(&m.rejectedFilters, 1)
+	return true, "blocked: this relay is write-only"
+}
+
+// GetStatsName returns the name of this stats provider
+func (m *relayMode) GetStatsName() string {
+	return "mode"
+}
+
+// GetStats returns stats as JsonEntity
+func (m *relayMode) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("mode", jsonlib.NewJsonValue(m.mode))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&m.rejectedEvents)))
+	obj.Set("rejected_filters", jsonlib.NewJsonValue(atomic.LoadInt64(&m.rejectedFilters)))
+	return obj
+}
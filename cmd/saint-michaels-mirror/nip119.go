@@ -0,0 +1,293 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-119 AND tag filters for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// andTagFilter is a filter of a client subscription as khatru sees it, with
+// the NIP-119 AND tags it was rewritten from
+type andTagFilter struct {
+	filter nostr.Filter
+	and    nostr.TagMap // tag name -> values that must all be present
+}
+
+// matches reports whether evt satisfies both the filter and its AND tags
+func (f andTagFilter) matches(evt *nostr.Event) bool {
+	return f.filter.Matches(evt) && andTagsMatch(f.and, evt)
+}
+
+// andTagsMatch reports whether evt has every value of every AND tag
+func andTagsMatch(and nostr.TagMap, evt *nostr.Event) bool {
+	for name, values := range and {
+		for _, value := range values {
+			if evt.Tags.FindWithValue(name, value) == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// andConnState holds the subscriptions of one client connection
+type andConnState struct {
+	mu   sync.Mutex
+	subs map[string][]andTagFilter // by subscription id
+	// set when a REQ could not be inspected, so live events are never held back
+	untracked bool
+}
+
+// andConnKey is the request context key of a connection's andConnState
+type andConnKey struct{}
+
+// andTagFilters implements NIP-119 for every upstream. go-nostr drops
+// "&"-prefixed filter keys when parsing, so REQ frames are rewritten before
+// khatru sees them: each "&t": [a, b] becomes "#t": [a] (unless the filter
+// has "#t" already), which returns a superset from any upstream, and the AND
+// is applied locally to stored events and to live events. Upstreams that
+// advertise NIP-119 get the same OR filter, since go-nostr cannot send "&"
+// keys either. COUNT is not rewritten.
+type andTagFilters struct {
+	// stats
+	rewrittenFilters int64
+	droppedStored    int64
+	droppedLive      int64
+	untrackedFrames  int64
+}
+
+// newAndTagFilters creates the NIP-119 emulation
+func newAndTagFilters() *andTagFilters {
+	return &andTagFilters{}
+}
+
+// Apply advertises NIP-119 and holds back live events that fail the AND tags
+func (a *andTagFilters) Apply(r *khatru.Relay) {
+	r.Info.AddSupportedNIP(119)
+	r.PreventBroadcast = append(r.PreventBroadcast, a.PreventBroadcast)
+}
+
+// WrapHandler rewrites the frames of websocket connections
+func (a *andTagFilters) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		state := &andConnState{subs: map[string][]andTagFilter{}}
+		req = req.WithContext(context.WithValue(req.Context(), andConnKey{}, state))
+		next.ServeHTTP(&frameHijacker{ResponseWriter: w, inspector: frameInspector{
+			inspect: func(msg []byte) []byte { return a.rewrite(state, msg) },
+			skipped: func() { a.untrack(state) },
+		}}, req)
+	})
+}
+
+// connState returns the state of the connection ws, if any
+func connState(ws *khatru.WebSocket) *andConnState {
+	if ws == nil || ws.Request == nil {
+		return nil
+	}
+	state, _ := ws.Request.Context().Value(andConnKey{}).(*andConnState)
+	return state
+}
+
+// Wrap drops stored events that fail the AND tags of the filter they answer
+func (a *andTagFilters) Wrap(next queryFunc) queryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := next(ctx, filter)
+		if err != nil || !isExternalQuery(ctx) {
+			return ch, err
+		}
+		state := connState(khatru.GetConnection(ctx))
+		if state == nil {
+			return ch, nil
+		}
+		and := state.andTags(khatru.GetSubscriptionID(ctx), filter)
+		if len(and) == 0 {
+			return ch, nil
+		}
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if !andTagsMatch(and, evt) {
+					atomic.AddInt64(&a.droppedStored, 1)
+					continue
+				}
+				out <- evt
+			}
+		}()
+		return out, nil
+	}
+}
+
+// andTags returns the AND tags of the filter of subscription id that filter
+// was derived from. OverwriteFilter hooks may change limits but not tags.
+func (s *andConnState) andTags(id string, filter nostr.Filter) nostr.TagMap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.subs[id] {
+		if len(f.and) > 0 && maps.EqualFunc(f.filter.Tags, filter.Tags, slices.Equal[[]string]) {
+			return f.and
+		}
+	}
+	return nil
+}
+
+// PreventBroadcast holds back a live event from a connection when no filter
+// of its subscriptions matches it including the AND tags. khatru only tells
+// us the connection, so an event matching another subscription of the same
+// connection still reaches the AND subscription.
+func (a *andTagFilters) PreventBroadcast(ws *khatru.WebSocket, evt *nostr.Event) bool {
+	state := connState(ws)
+	if state == nil {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.untracked {
+		return false
+	}
+	hasAnd := false
+	for _, filters := range state.subs {
+		for _, f := range filters {
+			if f.matches(evt) {
+				return false
+			}
+			hasAnd = hasAnd || len(f.and) > 0
+		}
+	}
+	if hasAnd {
+		atomic.AddInt64(&a.droppedLive, 1)
+	}
+	return hasAnd
+}
+
+// rewrite tracks the subscriptions opened and closed by a client message and
+// returns it with AND tag filters rewritten, or nil if it is unchanged
+func (a *andTagFilters) rewrite(state *andConnState, msg []byte) []byte {
+	trimmed := bytes.TrimLeft(msg, " \t\r\n")
+	isReq := bytes.HasPrefix(trimmed, []byte(`["REQ"`))
+	if !isReq && !bytes.HasPrefix(trimmed, []byte(`["CLOSE"`)) {
+		return nil
+	}
+	var parts []json.RawMessage
+	var id string
+	if err := json.Unmarshal(msg, &parts); err != nil || len(parts) < 2 || json.Unmarshal(parts[1], &id) != nil {
+		a.untrack(state)
+		return nil
+	}
+	if !isReq {
+		state.mu.Lock()
+		delete(state.subs, id)
+		state.mu.Unlock()
+		return nil
+	}
+
+	filters := make([]andTagFilter, 0, len(parts)-2)
+	changed := false
+	for i, raw := range parts[2:] {
+		f := andTagFilter{}
+		if bytes.Contains(raw, []byte(`"&`)) {
+			rewritten, and, err := rewriteAndFilter(raw)
+			if err != nil {
+				a.untrack(state)
+				return nil
+			}
+			if len(and) > 0 {
+				parts[i+2] = rewritten
+				f.and = and
+				changed = true
+				atomic.AddInt64(&a.rewrittenFilters, 1)
+			}
+		}
+		if err := json.Unmarshal(parts[i+2], &f.filter); err != nil {
+			a.untrack(state)
+			return nil
+		}
+		filters = append(filters, f)
+	}
+	state.mu.Lock()
+	state.subs[id] = filters
+	state.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	out, err := json.Marshal(parts)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// untrack records that a subscription of the connection is unknown
+func (a *andTagFilters) untrack(state *andConnState) {
+	atomic.AddInt64(&a.untrackedFrames, 1)
+	state.mu.Lock()
+	state.untracked = true
+	state.mu.Unlock()
+}
+
+// rewriteAndFilter replaces the "&" keys of a filter with "#" keys holding
+// their first value and returns the AND tags
+func rewriteAndFilter(raw json.RawMessage) (json.RawMessage, nostr.TagMap, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, nil, err
+	}
+	and := nostr.TagMap{}
+	for key, value := range fields {
+		name, ok := strings.CutPrefix(key, "&")
+		if !ok || name == "" {
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(value, &values); err != nil {
+			return nil, nil, err
+		}
+		delete(fields, key)
+		if len(values) == 0 {
+			continue
+		}
+		and[name] = values
+		if _, ok := fields["#"+name]; !ok {
+			first, _ := json.Marshal(values[:1])
+			fields["#"+name] = first
+		}
+	}
+	out, err := json.Marshal(fields)
+	return out, and, err
+}
+
+// GetStatsName returns the name of this stats provider
+func (a *andTagFilters) GetStatsName() string {
+	return "and_tag_filters"
+}
+
+// GetStats returns stats as JsonEntity
+func (a *andTagFilters) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("rewritten_filters", jsonlib.NewJsonValue(atomic.LoadInt64(&a.rewrittenFilters)))
+	obj.Set("dropped_stored_events", jsonlib.NewJsonValue(atomic.LoadInt64(&a.droppedStored)))
+	obj.Set("dropped_live_events", jsonlib.NewJsonValue(atomic.LoadInt64(&a.droppedLive)))
+	obj.Set("untracked_frames", jsonlib.NewJsonValue(atomic.LoadInt64(&a.untrackedFrames)))
+	return obj
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Operator-supplied NIP-11 document overrides for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/girino/saint-michaels-mirror/logging"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// relayInfoOverride is a full or partial NIP-11 document deep-merged over the
+// generated one. Objects are merged key by key, any other value replaces the
+// generated one and null removes it. Fields the relay does not model, such as
+// terms_of_service, are passed through untouched.
+type relayInfoOverride struct {
+	path string
+	doc  map[string]any
+}
+
+// loadRelayInfoOverride reads the JSON object in path
+func loadRelayInfoOverride(path string) (*relayInfoOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid NIP-11 document %s: %w", path, err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("invalid NIP-11 document %s: not a JSON object", path)
+	}
+	return &relayInfoOverride{path: path, doc: doc}, nil
+}
+
+// mergeRelayInfo deep-merges src into dst
+func mergeRelayInfo(dst, src map[string]any) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		if srcObj, ok := value.(map[string]any); ok {
+			if dstObj, ok := dst[key].(map[string]any); ok {
+				mergeRelayInfo(dstObj, srcObj)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// Apply merges the override into info, so the fields the relay models are
+// also used by the landing page and the other NIP-11 hooks
+func (o *relayInfoOverride) Apply(info *nip11.RelayInformationDocument) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	mergeRelayInfo(doc, o.doc)
+	// go-nostr only models retention kinds as ranges, not as the plain kind
+	// numbers NIP-11 also allows; retention is served by Wrap as written
+	delete(doc, "retention")
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	merged := nip11.RelayInformationDocument{}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return fmt.Errorf("invalid NIP-11 document %s: %w", o.path, err)
+	}
+	*info = merged
+	return nil
+}
+
+// bufferedResponse holds a response so it can be rewritten before sending
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+// Wrap merges the override into the NIP-11 responses of next once the
+// per-request hooks have run, so unmodeled fields are served as well
+func (o *relayInfoOverride) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept") != "application/nostr+json" || req.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(resp, req)
+
+		body := resp.body.Bytes()
+		var doc map[string]any
+		if resp.status == http.StatusOK && json.Unmarshal(body, &doc) == nil && doc != nil {
+			mergeRelayInfo(doc, o.doc)
+			if merged, err := json.Marshal(doc); err == nil {
+				body = merged
+			} else {
+				logging.DebugMethod("nip11override", "Wrap", "failed encoding merged NIP-11 document: %v", err)
+			}
+		}
+		for key, values := range resp.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.status)
+		w.Write(body)
+	})
+}
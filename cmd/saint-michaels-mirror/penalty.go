@@ -0,0 +1,192 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream relay penalty box for Espelho de São Miguel.
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// penaltyEntry tracks the failures of one relay
+type penaltyEntry struct {
+	failures       int
+	timesPenalized int64
+	until          time.Time
+	lastFailure    time.Time
+	lastError      string
+}
+
+// penaltyBox keeps relays that fail to connect out of rotation for an
+// exponentially growing period. It replaces go-nostr's WithPenaltyBox, whose
+// durations are fixed and whose state cannot be inspected.
+type penaltyBox struct {
+	mu         sync.Mutex
+	base       time.Duration
+	max        time.Duration
+	threshold  int
+	relays     map[string]*penaltyEntry
+	rejections int64
+	penalties  int64
+	// observer, when set, sees every failed connection
+	observer func(url string, err error)
+}
+
+// newPenaltyBox creates a penalty box; relays are penalized once they reach
+// threshold consecutive failures, for base doubled per extra failure, capped
+// at max.
+func newPenaltyBox(base, max time.Duration, threshold int) *penaltyBox {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if max < base {
+		max = base
+	}
+	return &penaltyBox{
+		base:      base,
+		max:       max,
+		threshold: threshold,
+		relays:    map[string]*penaltyEntry{},
+	}
+}
+
+// SetFailureObserver registers fn to be told why connections failed
+func (p *penaltyBox) SetFailureObserver(fn func(url string, err error)) {
+	p.observer = fn
+}
+
+// relayEnsurer opens or reuses relay connections, like a SimplePool
+type relayEnsurer interface {
+	EnsureRelay(url string) (*nostr.Relay, error)
+}
+
+// EnsureRelay connects to url through pool unless the relay is penalized
+func (p *penaltyBox) EnsureRelay(pool relayEnsurer, url string) (*nostr.Relay, error) {
+	url = nostr.NormalizeURL(url)
+	if remaining := p.Remaining(url); remaining > 0 {
+		p.mu.Lock()
+		p.rejections++
+		p.mu.Unlock()
+		return nil, relayerrors.New(relayerrors.PrefixError, "relay "+url+" in penalty box, "+remaining.Round(time.Second).String()+" remaining")
+	}
+	relay, err := pool.EnsureRelay(url)
+	if err != nil {
+		p.Failure(url, err)
+		return nil, err
+	}
+	p.Success(url)
+	return relay, nil
+}
+
+// Remaining returns how long url stays penalized, or 0
+func (p *penaltyBox) Remaining(url string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.relays[url]
+	if !ok {
+		return 0
+	}
+	if remaining := entry.until.Sub(time.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Failure records a failed connection and penalizes the relay when the
+// threshold is reached
+func (p *penaltyBox) Failure(url string, err error) {
+	if p.observer != nil {
+		p.observer(url, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.relays[url]
+	if !ok {
+		entry = &penaltyEntry{}
+		p.relays[url] = entry
+	}
+	now := time.Now()
+	entry.failures++
+	entry.lastFailure = now
+	if err != nil {
+		entry.lastError = err.Error()
+	}
+	if entry.failures < p.threshold {
+		return
+	}
+
+	duration := p.base
+	for i := p.threshold; i < entry.failures && duration < p.max; i++ {
+		duration *= 2
+	}
+	if duration > p.max {
+		duration = p.max
+	}
+	entry.until = now.Add(duration)
+	entry.timesPenalized++
+	p.penalties++
+	logging.DebugMethod("penalty", "Failure", "%s penalized for %v after %d consecutive failures: %v", url, duration, entry.failures, err)
+}
+
+// Success clears the failures of a relay
+func (p *penaltyBox) Success(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry, ok := p.relays[url]; ok && entry.failures > 0 {
+		entry.failures = 0
+		entry.until = time.Time{}
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *penaltyBox) GetStatsName() string {
+	return "penalty_box"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *penaltyBox) GetStats() jsonlib.JsonEntity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("base_duration", jsonlib.NewJsonValue(p.base.String()))
+	obj.Set("max_duration", jsonlib.NewJsonValue(p.max.String()))
+	obj.Set("failure_threshold", jsonlib.NewJsonValue(p.threshold))
+	obj.Set("total_penalties", jsonlib.NewJsonValue(p.penalties))
+	obj.Set("rejected_connections", jsonlib.NewJsonValue(p.rejections))
+
+	urls := make([]string, 0, len(p.relays))
+	for url, entry := range p.relays {
+		if entry.until.After(now) {
+			urls = append(urls, url)
+		}
+	}
+	sort.Strings(urls)
+
+	penalized := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		entry := p.relays[url]
+		relayObj := jsonlib.NewJsonObject()
+		relayObj.Set("until", jsonlib.NewJsonValue(entry.until.Unix()))
+		relayObj.Set("remaining_seconds", jsonlib.NewJsonValue(int64(entry.until.Sub(now).Seconds())))
+		relayObj.Set("consecutive_failures", jsonlib.NewJsonValue(entry.failures))
+		relayObj.Set("times_penalized", jsonlib.NewJsonValue(entry.timesPenalized))
+		relayObj.Set("last_failure", jsonlib.NewJsonValue(entry.lastFailure.Unix()))
+		relayObj.Set("last_error", jsonlib.NewJsonValue(entry.lastError))
+		penalized.Set(url, relayObj)
+	}
+	obj.Set("penalized_count", jsonlib.NewJsonValue(len(urls)))
+	obj.Set("penalized", penalized)
+	return obj
+}
@@ -0,0 +1,396 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Scheduled re-broadcast of pinned events for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	nip19 "github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Pinned event tuning
+const (
+	DefaultPinnedRebroadcastInterval = 6 * time.Hour
+	// PinnedFetchTimeout bounds the upstream query for one pinned event
+	PinnedFetchTimeout = 15 * time.Second
+)
+
+// pinnedEvent is one event kept replicated, by id or by address
+type pinnedEvent struct {
+	ref     string
+	pointer nostr.Pointer
+	source  string // config, admin or remote
+	added   time.Time
+	// last refresh
+	fetched     time.Time
+	broadcast   time.Time
+	eventID     string
+	lastError   string
+	broadcasts  int64
+	failedFetch int64
+}
+
+// pinnedEvents periodically fetches a list of important events from the
+// query remotes and publishes them again to the broadcast relays, so
+// community events such as calendars or group metadata stay widely
+// replicated. Events are pinned by id (hex, note or nevent) or by address
+// (kind:pubkey:d or naddr, kind:pubkey: for replaceable kinds); for addresses the newest version found is
+// re-broadcast. Pins from configuration are fixed, pins added through the
+// admin API last until removed or restart, and pins from remote configuration
+// follow the admin's published list.
+type pinnedEvents struct {
+	query     queryFunc
+	republish func(*nostr.Event) error
+	interval  time.Duration
+	mu        sync.Mutex
+	pins      map[string]*pinnedEvent
+	// stats
+	rounds     int64
+	broadcasts int64
+	failures   int64
+}
+
+// newPinnedEvents creates the re-broadcaster for refs, fetching through
+// query and publishing through republish every interval
+func newPinnedEvents(query queryFunc, republish func(*nostr.Event) error, interval time.Duration, refs []string) (*pinnedEvents, error) {
+	if interval <= 0 {
+		interval = DefaultPinnedRebroadcastInterval
+	}
+	p := &pinnedEvents{
+		query:     query,
+		republish: republish,
+		interval:  interval,
+		pins:      map[string]*pinnedEvent{},
+	}
+	for _, ref := range refs {
+		if _, err := p.Pin(ref, "config"); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parsePinnedRef decodes a pinned event reference into a pointer
+func parsePinnedRef(ref string) (nostr.Pointer, error) {
+	ref = strings.TrimSpace(ref)
+	switch {
+	case nostr.IsValid32ByteHex(strings.ToLower(ref)):
+		return nostr.EventPointer{ID: strings.ToLower(ref)}, nil
+	case strings.HasPrefix(ref, "note1"), strings.HasPrefix(ref, "nevent1"), strings.HasPrefix(ref, "naddr1"):
+		prefix, val, err := nip19.Decode(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned event %q: %w", ref, err)
+		}
+		switch prefix {
+		case "note":
+			return nostr.EventPointer{ID: val.(string)}, nil
+		case "nevent":
+			return val.(nostr.EventPointer), nil
+		case "naddr":
+			return val.(nostr.EntityPointer), nil
+		}
+	case strings.Count(ref, ":") >= 2:
+		ptr, err := nostr.EntityPointerFromTag(nostr.Tag{"a", ref})
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned event %q: %w", ref, err)
+		}
+		return ptr, nil
+	}
+	return nil, fmt.Errorf("invalid pinned event %q: expected an event id, note, nevent, naddr or kind:pubkey:d", ref)
+}
+
+// Pin adds an event to the list and returns its canonical reference, the
+// event id or the kind:pubkey:d address
+func (p *pinnedEvents) Pin(ref, source string) (string, error) {
+	pointer, err := parsePinnedRef(ref)
+	if err != nil {
+		return "", err
+	}
+	key := pointer.AsTagReference()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[key]; !ok {
+		p.pins[key] = &pinnedEvent{ref: key, pointer: pointer, source: source, added: time.Now()}
+	}
+	return key, nil
+}
+
+// Unpin removes an event from the list, reporting whether it was pinned
+func (p *pinnedEvents) Unpin(ref string) (bool, error) {
+	pointer, err := parsePinnedRef(ref)
+	if err != nil {
+		return false, err
+	}
+	key := pointer.AsTagReference()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[key]; !ok {
+		return false, nil
+	}
+	delete(p.pins, key)
+	return true, nil
+}
+
+// Replace makes refs the pins of source, unpinning the ones of source not in
+// refs; pins of other sources are left alone. Nothing changes when a ref is
+// invalid. Newly pinned events are re-broadcast right away.
+func (p *pinnedEvents) Replace(source string, refs []string) error {
+	pointers := map[string]nostr.Pointer{}
+	for _, ref := range refs {
+		pointer, err := parsePinnedRef(ref)
+		if err != nil {
+			return err
+		}
+		pointers[pointer.AsTagReference()] = pointer
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, pin := range p.pins {
+		if _, ok := pointers[key]; !ok && pin.source == source {
+			delete(p.pins, key)
+		}
+	}
+	for key, pointer := range pointers {
+		if _, ok := p.pins[key]; ok {
+			continue
+		}
+		pin := &pinnedEvent{ref: key, pointer: pointer, source: source, added: time.Now()}
+		p.pins[key] = pin
+		go p.refresh(context.Background(), pin)
+	}
+	return nil
+}
+
+// ForgetPubKey unpins the events that name pubkey as their author, returning
+// how many there were. Pins from configuration return on restart.
+func (p *pinnedEvents) ForgetPubKey(pubkey string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for key, pin := range p.pins {
+		var author string
+		switch pointer := pin.pointer.(type) {
+		case nostr.EventPointer:
+			author = pointer.Author
+		case nostr.EntityPointer:
+			author = pointer.PublicKey
+		}
+		if author == pubkey {
+			delete(p.pins, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Start re-broadcasts every pinned event now and then every interval until
+// ctx is done
+func (p *pinnedEvents) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			p.refreshAll(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshAll re-broadcasts every pinned event, one at a time
+func (p *pinnedEvents) refreshAll(ctx context.Context) {
+	p.mu.Lock()
+	pins := make([]*pinnedEvent, 0, len(p.pins))
+	for _, pin := range p.pins {
+		pins = append(pins, pin)
+	}
+	p.mu.Unlock()
+	if len(pins) == 0 {
+		return
+	}
+	atomic.AddInt64(&p.rounds, 1)
+	ok := 0
+	for _, pin := range pins {
+		if ctx.Err() != nil {
+			return
+		}
+		if p.refresh(ctx, pin) {
+			ok++
+		}
+	}
+	logging.Info("re-broadcast %d of %d pinned events", ok, len(pins))
+}
+
+// refresh fetches the newest version of a pinned event and publishes it
+// again, reporting whether it succeeded
+func (p *pinnedEvents) refresh(ctx context.Context, pin *pinnedEvent) bool {
+	evt, err := p.fetch(ctx, pin.pointer)
+	if err == nil {
+		err = p.republish(evt)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pin.fetched = time.Now()
+	if err != nil {
+		atomic.AddInt64(&p.failures, 1)
+		pin.failedFetch++
+		pin.lastError = err.Error()
+		logging.DebugMethod("pinned", "refresh", "failed to re-broadcast %s: %v", pin.ref, err)
+		return false
+	}
+	atomic.AddInt64(&p.broadcasts, 1)
+	pin.broadcasts++
+	pin.broadcast = pin.fetched
+	pin.eventID = evt.ID
+	pin.lastError = ""
+	logging.DebugMethod("pinned", "refresh", "re-broadcast %s as event %s", pin.ref, evt.ID)
+	return true
+}
+
+// fetch queries the upstreams for the newest event matching pointer
+func (p *pinnedEvents) fetch(ctx context.Context, pointer nostr.Pointer) (*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(withSubscriptionID(ctx, "pinned"), PinnedFetchTimeout)
+	defer cancel()
+	filter := pointer.AsFilter()
+	if ep, ok := pointer.(nostr.EntityPointer); ok && nostr.IsReplaceableKind(ep.Kind) {
+		// replaceable events such as profiles have no d tag to filter on
+		filter.Tags = nil
+	}
+	ch, err := p.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var newest *nostr.Event
+	for evt := range ch {
+		if !pointer.MatchesEvent(*evt) {
+			continue
+		}
+		if newest == nil || evt.CreatedAt > newest.CreatedAt {
+			newest = evt
+		}
+	}
+	if newest == nil {
+		return nil, errors.New("not found on any query remote")
+	}
+	return newest, nil
+}
+
+// pinnedRequest is the body of POST and DELETE /api/v1/admin/pinned
+type pinnedRequest struct {
+	Event string `json:"event"`
+}
+
+// HandlePinned serves GET (list), POST (pin and re-broadcast now) and DELETE
+// (unpin) of pinned events
+func (p *pinnedEvents) HandlePinned(w http.ResponseWriter, req *http.Request) {
+	var body pinnedRequest
+	if req.Method == http.MethodPost || req.Method == http.MethodDelete {
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		key, err := p.Pin(body.Event, "admin")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		pin := p.pins[key]
+		p.mu.Unlock()
+		p.refresh(req.Context(), pin)
+	case http.MethodDelete:
+		removed, err := p.Unpin(body.Event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !removed {
+			http.Error(w, "event not pinned", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, p.list())
+}
+
+// list renders every pinned event, oldest pin first
+func (p *pinnedEvents) list() *jsonlib.JsonObject {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pins := make([]*pinnedEvent, 0, len(p.pins))
+	for _, pin := range p.pins {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if !pins[i].added.Equal(pins[j].added) {
+			return pins[i].added.Before(pins[j].added)
+		}
+		return pins[i].ref < pins[j].ref
+	})
+
+	arr := jsonlib.NewJsonList()
+	for _, pin := range pins {
+		obj := jsonlib.NewJsonObject()
+		obj.Set("event", jsonlib.NewJsonValue(pin.ref))
+		obj.Set("source", jsonlib.NewJsonValue(pin.source))
+		obj.Set("added_at", jsonlib.NewJsonValue(pin.added.Unix()))
+		obj.Set("broadcasts", jsonlib.NewJsonValue(pin.broadcasts))
+		obj.Set("failures", jsonlib.NewJsonValue(pin.failedFetch))
+		if !pin.fetched.IsZero() {
+			obj.Set("last_attempt", jsonlib.NewJsonValue(pin.fetched.Unix()))
+		}
+		if !pin.broadcast.IsZero() {
+			obj.Set("last_broadcast", jsonlib.NewJsonValue(pin.broadcast.Unix()))
+			obj.Set("event_id", jsonlib.NewJsonValue(pin.eventID))
+		}
+		if pin.lastError != "" {
+			obj.Set("last_error", jsonlib.NewJsonValue(pin.lastError))
+		}
+		arr.Append(obj)
+	}
+	result := jsonlib.NewJsonObject()
+	result.Set("interval_seconds", jsonlib.NewJsonValue(int64(p.interval.Seconds())))
+	result.Set("pinned", arr)
+	return result
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *pinnedEvents) GetStatsName() string {
+	return "pinned_events"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *pinnedEvents) GetStats() jsonlib.JsonEntity {
+	obj := p.list()
+	obj.Set("rounds", jsonlib.NewJsonValue(atomic.LoadInt64(&p.rounds)))
+	obj.Set("broadcasts", jsonlib.NewJsonValue(atomic.LoadInt64(&p.broadcasts)))
+	obj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&p.failures)))
+	return obj
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Posting policy and terms of service pages for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// markdownPage is an operator-supplied Markdown document. The source is a
+// text/template executed with the page's view model, so documents can refer
+// to the relay's name, contact or URL, e.g. {{.Name}} or {{.ServiceURL}}.
+type markdownPage struct {
+	Title string
+	Path  string // URL path the page is served at
+	file  string
+	mu    sync.RWMutex
+	tpl   *texttemplate.Template
+}
+
+// loadMarkdownPage reads and parses the Markdown template in file
+func loadMarkdownPage(title, path, file string) (*markdownPage, error) {
+	tpl, err := parseMarkdownPage(file)
+	if err != nil {
+		return nil, err
+	}
+	return &markdownPage{Title: title, Path: path, file: file, tpl: tpl}, nil
+}
+
+// parseMarkdownPage reads and parses the Markdown template in file
+func parseMarkdownPage(file string) (*texttemplate.Template, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := texttemplate.New(file).Option("missingkey=zero").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template in %s: %w", file, err)
+	}
+	return tpl, nil
+}
+
+// Reload reads the file again; on error the page is left as it was
+func (p *markdownPage) Reload() error {
+	tpl, err := parseMarkdownPage(p.file)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.tpl = tpl
+	p.mu.Unlock()
+	return nil
+}
+
+// Render executes the template with data and converts the result to HTML
+func (p *markdownPage) Render(data any) (template.HTML, error) {
+	p.mu.RLock()
+	tpl := p.tpl
+	p.mu.RUnlock()
+	var b strings.Builder
+	if err := tpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return renderMarkdown(b.String()), nil
+}
+
+// policyInfoOverwriter points NIP-11 posting_policy at the first page
+// available, unless the operator set one already
+func policyInfoOverwriter(serviceURL *serviceURLResolver, pages ...*markdownPage) func(context.Context, *http.Request, nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	return func(ctx context.Context, req *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+		if info.PostingPolicy != "" {
+			return info
+		}
+		for _, page := range pages {
+			if page != nil {
+				info.PostingPolicy = serviceURL.BaseURL(req) + page.Path
+				break
+			}
+		}
+		return info
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Per-policy reject statistics for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// policyRejects counts what each local policy rejected, so operators can
+// tell whether their own policies or the upstream relays are behind the
+// complaints of users. Policies wrap their reject hooks when installing them;
+// the khatru stats break the same rejections down by reason instead.
+var policyRejects = newPolicyRejectCounters()
+
+// maxRejectedAuthors bounds how many authors of rejected events are counted
+// between two TakeRejectedAuthors; rejections of further authors are only
+// counted in total
+const maxRejectedAuthors = 10000
+
+// policyRejectCounters counts rejections by hook type and policy
+type policyRejectCounters struct {
+	mu          sync.Mutex
+	events      map[string]*int64
+	filters     map[string]*int64
+	countFilter map[string]*int64
+	connections map[string]*int64
+	// authors counts rejected events by pubkey once TrackAuthors was called
+	authors         map[string]int64
+	untrackedAuthor int64
+}
+
+// newPolicyRejectCounters creates empty counters
+func newPolicyRejectCounters() *policyRejectCounters {
+	return &policyRejectCounters{
+		events:      map[string]*int64{},
+		filters:     map[string]*int64{},
+		countFilter: map[string]*int64{},
+		connections: map[string]*int64{},
+	}
+}
+
+// counter returns the counter of policy in m, so installed policies are
+// listed before they reject anything
+func (p *policyRejectCounters) counter(m map[string]*int64, policy string) *int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := m[policy]
+	if !ok {
+		c = new(int64)
+		m[policy] = c
+	}
+	return c
+}
+
+// Event counts the events hook rejects under policy
+func (p *policyRejectCounters) Event(policy string, hook func(context.Context, *nostr.Event) (bool, string)) func(context.Context, *nostr.Event) (bool, string) {
+	c := p.counter(p.events, policy)
+	return func(ctx context.Context, evt *nostr.Event) (bool, string) {
+		reject, msg := hook(ctx, evt)
+		if reject {
+			atomic.AddInt64(c, 1)
+			p.rejectedAuthor(evt.PubKey)
+		}
+		return reject, msg
+	}
+}
+
+// TrackAuthors starts counting rejected events by author
+func (p *policyRejectCounters) TrackAuthors() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.authors == nil {
+		p.authors = map[string]int64{}
+	}
+}
+
+// rejectedAuthor counts a rejected event of pubkey, if authors are tracked
+func (p *policyRejectCounters) rejectedAuthor(pubkey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.authors == nil {
+		return
+	}
+	if _, ok := p.authors[pubkey]; !ok && len(p.authors) >= maxRejectedAuthors {
+		p.untrackedAuthor++
+		return
+	}
+	p.authors[pubkey]++
+}
+
+// TakeRejectedAuthors returns the rejected events counted by author since
+// the last call, and those of authors beyond maxRejectedAuthors, and starts
+// counting again
+func (p *policyRejectCounters) TakeRejectedAuthors() (map[string]int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	authors, untracked := p.authors, p.untrackedAuthor
+	p.authors, p.untrackedAuthor = map[string]int64{}, 0
+	return authors, untracked
+}
+
+// ForgetPubKey drops the rejections counted for pubkey, returning 1 if
+// there were any
+func (p *policyRejectCounters) ForgetPubKey(pubkey string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.authors[pubkey]; !ok {
+		return 0
+	}
+	delete(p.authors, pubkey)
+	return 1
+}
+
+// eventRejects returns the events rejected so far by each policy
+func (p *policyRejectCounters) eventRejects() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[string]int64, len(p.events))
+	for policy, c := range p.events {
+		counts[policy] = atomic.LoadInt64(c)
+	}
+	return counts
+}
+
+// Filter counts the filters hook rejects under policy
+func (p *policyRejectCounters) Filter(policy string, hook func(context.Context, nostr.Filter) (bool, string)) func(context.Context, nostr.Filter) (bool, string) {
+	return p.filter(p.filters, policy, hook)
+}
+
+// CountFilter counts the COUNT filters hook rejects under policy
+func (p *policyRejectCounters) CountFilter(policy string, hook func(context.Context, nostr.Filter) (bool, string)) func(context.Context, nostr.Filter) (bool, string) {
+	return p.filter(p.countFilter, policy, hook)
+}
+
+func (p *policyRejectCounters) filter(m map[string]*int64, policy string, hook func(context.Context, nostr.Filter) (bool, string)) func(context.Context, nostr.Filter) (bool, string) {
+	c := p.counter(m, policy)
+	return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		reject, msg := hook(ctx, filter)
+		if reject {
+			atomic.AddInt64(c, 1)
+		}
+		return reject, msg
+	}
+}
+
+// Connection counts the connections hook rejects under policy
+func (p *policyRejectCounters) Connection(policy string, hook func(*http.Request) bool) func(*http.Request) bool {
+	c := p.counter(p.connections, policy)
+	return func(req *http.Request) bool {
+		if hook(req) {
+			atomic.AddInt64(c, 1)
+			return true
+		}
+		return false
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *policyRejectCounters) GetStatsName() string {
+	return "policy_rejects"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *policyRejectCounters) GetStats() jsonlib.JsonEntity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("events", policyCountersToJSON(p.events))
+	obj.Set("filters", policyCountersToJSON(p.filters))
+	obj.Set("count_filters", policyCountersToJSON(p.countFilter))
+	obj.Set("connections", policyCountersToJSON(p.connections))
+	return obj
+}
+
+// policyCountersToJSON renders counters sorted by policy
+func policyCountersToJSON(m map[string]*int64) *jsonlib.JsonObject {
+	policies := make([]string, 0, len(m))
+	for policy := range m {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+	obj := jsonlib.NewJsonObject()
+	for _, policy := range policies {
+		obj.Set(policy, jsonlib.NewJsonValue(atomic.LoadInt64(m[policy])))
+	}
+	return obj
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Size and churn limits of the broadcast relay pool for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// poolGuard keeps discovery from reshaping the broadcast pool too fast.
+// Newly discovered relays start with an optimistic score and outrank the
+// established ones, so a single discovery run from a poisoned seed could
+// otherwise replace every publish target. After each discovery the guard
+// keeps at most maxNew of the relays it added, and no more than the churn
+// budget left in the window, preferring those that passed their first
+// check; the rest are dropped again. With a vetter, only relays that pass
+// vetting are kept, and with an alias check, a relay reachable at several URLs
+// is kept at one of them. The pool never grows past maxSize,
+// and while it holds fewer than minSize relays the per-run and churn limits are
+// lifted until it gets there. Removals by retirement also count as churn
+// and are deferred while they would shrink the pool below minSize. Seeds and
+// mandatory relays are never limited, and neither are the relays of followed
+// users, which are seeds too. Zero disables each limit.
+type poolGuard struct {
+	system       *broadcast.BroadcastSystem
+	minSize      int
+	maxSize      int
+	maxNew       int
+	churnPercent int
+	churnWindow  time.Duration
+	// follows, when set, adds the relays of followed users to the seeds
+	follows *followRelays
+	// vetter, when set, must pass every relay before it is admitted
+	vetter *relayVetter
+	// aliases, when set, drops the other URLs of relays already in the pool
+	aliases *relayAliases
+	mu      sync.Mutex
+	// seeds of the last discovery run, not counted in the pool, and those
+	// it was asked for, which periodic refreshes reuse
+	seeds     []string
+	requested []string
+	// last summarizes the latest discovery run
+	last            discoveryRun
+	refreshInterval time.Duration
+	nextRefresh     time.Time
+	// changes holds the time of every addition and removal in the window
+	changes []time.Time
+	// stats
+	runs             int64
+	admitted         int64
+	droppedNew       int64
+	droppedMax       int64
+	droppedChurn     int64
+	removals         int64
+	deferredRemovals int64
+}
+
+// discoveryRun summarizes one discovery run
+type discoveryRun struct {
+	at         time.Time
+	duration   time.Duration
+	seeds      int
+	found      int // relays discovery added to the pool
+	aliases    int // URLs dropped as aliases of other relays
+	rejected   int // of those, failed vetting
+	admitted   int
+	poolBefore int
+	poolAfter  int
+}
+
+// newPoolGuard creates the guard for the pool of system
+func newPoolGuard(system *broadcast.BroadcastSystem, minSize, maxSize, maxNew, churnPercent int, churnWindow time.Duration) *poolGuard {
+	return &poolGuard{
+		system:       system,
+		minSize:      minSize,
+		maxSize:      maxSize,
+		maxNew:       maxNew,
+		churnPercent: churnPercent,
+		churnWindow:  churnWindow,
+	}
+}
+
+// SetFollowRelays adds the relays follows finds to the seeds of every
+// discovery run. It must be called before the first Discover.
+func (g *poolGuard) SetFollowRelays(follows *followRelays) {
+	g.follows = follows
+}
+
+// SetVetter makes newly discovered relays pass vetter before they are
+// admitted. It must be called before the first Discover.
+func (g *poolGuard) SetVetter(vetter *relayVetter) {
+	g.vetter = vetter
+}
+
+// SetAliases makes discovery drop the URLs that lead to a relay already in
+// the pool. It must be called before the first Discover.
+func (g *poolGuard) SetAliases(aliases *relayAliases) {
+	g.aliases = aliases
+}
+
+// pool returns the relays of the pool that are neither seeds nor mandatory,
+// keyed by url
+func (g *poolGuard) pool(m *manager.Manager, seeds []string) map[string]*manager.RelayInfo {
+	isSeed := map[string]bool{}
+	for _, url := range seeds {
+		isSeed[url] = true
+	}
+	relays := map[string]*manager.RelayInfo{}
+	for _, url := range m.GetAllRelays() {
+		info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+		if ok && !info.IsMandatory && !isSeed[url] {
+			relays[url] = info
+		}
+	}
+	return relays
+}
+
+// churnLeftLocked returns how many more changes the churn budget allows for
+// a pool of size relays, or -1 when churn is not limited; g.mu must be held
+func (g *poolGuard) churnLeftLocked(size int, now time.Time) int {
+	if g.churnPercent <= 0 || g.churnWindow <= 0 {
+		return -1
+	}
+	cutoff := now.Add(-g.churnWindow)
+	i := 0
+	for i < len(g.changes) && g.changes[i].Before(cutoff) {
+		i++
+	}
+	g.changes = g.changes[i:]
+	return max(size*g.churnPercent/100-len(g.changes), 0)
+}
+
+// Discover runs discovery from seeds and trims the relays it added to the
+// pool limits
+func (g *poolGuard) Discover(ctx context.Context, seeds []string) {
+	requested := seeds
+	if followed := g.follows.Relays(ctx); len(followed) > 0 {
+		seeds = append(slices.Clone(seeds), followed...)
+	}
+	g.mu.Lock()
+	g.seeds = seeds
+	g.requested = requested
+	g.mu.Unlock()
+	m := g.system.GetManager()
+	before := g.pool(m, seeds)
+	run := discoveryRun{at: time.Now(), seeds: len(seeds), poolBefore: len(before)}
+	defer g.record(m, seeds, &run)
+	g.system.DiscoverFromSeeds(ctx, seeds)
+	atomic.AddInt64(&g.runs, 1)
+
+	// one relay at several URLs would take several slots and be published
+	// to once per URL
+	if g.aliases != nil {
+		isSeed := map[string]bool{}
+		for _, url := range seeds {
+			isSeed[url] = true
+		}
+		protected := func(url string) bool {
+			info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+			return isSeed[url] || (ok && info.IsMandatory)
+		}
+		run.aliases = len(g.aliases.Collapse(ctx, m, protected, before))
+	}
+
+	var added []*manager.RelayInfo
+	for url, info := range g.pool(m, seeds) {
+		if _, known := before[url]; !known {
+			added = append(added, info)
+		}
+	}
+	run.found = len(added)
+	if len(added) == 0 {
+		return
+	}
+	// keep the relays that did best on their first check
+	sort.Slice(added, func(i, j int) bool {
+		if added[i].SuccessRate != added[j].SuccessRate {
+			return added[i].SuccessRate > added[j].SuccessRate
+		}
+		return added[i].URL < added[j].URL
+	})
+
+	g.mu.Lock()
+	now := time.Now()
+	size := len(before)
+	keep := len(added)
+	dropped := &g.droppedMax
+	if size > 0 {
+		if g.maxNew > 0 && keep > g.maxNew {
+			keep, dropped = g.maxNew, &g.droppedNew
+		}
+		if left := g.churnLeftLocked(size, now); left >= 0 && keep > left {
+			keep, dropped = left, &g.droppedChurn
+		}
+		// below the minimum, fill up regardless
+		keep = max(keep, min(g.minSize-size, len(added)))
+	}
+	if g.maxSize > 0 && size+keep > g.maxSize {
+		keep, dropped = max(g.maxSize-size, 0), &g.droppedMax
+	}
+	g.mu.Unlock()
+
+	// relays failing vetting never enter rotation; the next ones in line
+	// take their places
+	if g.vetter != nil {
+		added, keep = g.vetter.Select(ctx, m, added, keep)
+		run.rejected = run.found - len(added)
+	}
+	for _, info := range added[keep:] {
+		m.RemoveRelay(info.URL)
+	}
+	run.admitted = keep
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if size > 0 {
+		// filling an empty pool is not churn
+		for range keep {
+			g.changes = append(g.changes, now)
+		}
+	}
+	atomic.AddInt64(&g.admitted, int64(keep))
+	if keep < len(added) {
+		atomic.AddInt64(dropped, int64(len(added)-keep))
+		logging.Warn("discovery found %d new broadcast relays, admitted %d to stay within the pool limits", len(added), keep)
+	}
+}
+
+// record logs how a discovery run changed the pool and keeps it for stats
+func (g *poolGuard) record(m *manager.Manager, seeds []string, run *discoveryRun) {
+	run.duration = time.Since(run.at)
+	run.poolAfter = len(g.pool(m, seeds))
+	g.mu.Lock()
+	g.last = *run
+	g.mu.Unlock()
+	logging.Info("discovery from %d seeds found %d new broadcast relays (%d failed vetting, %d aliases dropped), admitted %d; pool %d -> %d relays in %v",
+		run.seeds, run.found, run.rejected, run.aliases, run.admitted, run.poolBefore, run.poolAfter, run.duration.Round(time.Millisecond))
+}
+
+// StartRefresh runs discovery again every interval, from the seeds of the
+// latest run, until ctx is done. A zero interval disables refreshes.
+func (g *poolGuard) StartRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		logging.Info("periodic broadcast discovery disabled")
+		return
+	}
+	g.mu.Lock()
+	g.refreshInterval = interval
+	g.nextRefresh = time.Now().Add(interval)
+	g.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				logging.Debug("Periodic refresh stopped")
+				return
+			case <-ticker.C:
+			}
+			g.mu.Lock()
+			seeds := g.requested
+			g.nextRefresh = time.Now().Add(interval)
+			g.mu.Unlock()
+			logging.Info("Starting periodic relay refresh...")
+			g.Discover(ctx, seeds)
+		}
+	}()
+}
+
+// AllowRemoval reports whether a relay may leave the pool now, recording
+// the change when it may. Removals that would shrink the pool below minSize or
+// exceed the churn budget are deferred.
+func (g *poolGuard) AllowRemoval() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	size := len(g.pool(g.system.GetManager(), g.seeds))
+	if size <= g.minSize || g.churnLeftLocked(size, time.Now()) == 0 {
+		atomic.AddInt64(&g.deferredRemovals, 1)
+		return false
+	}
+	g.changes = append(g.changes, time.Now())
+	atomic.AddInt64(&g.removals, 1)
+	return true
+}
+
+// GetStatsName returns the name of this stats provider
+func (g *poolGuard) GetStatsName() string {
+	return "broadcast_pool"
+}
+
+// GetStats returns stats as JsonEntity
+func (g *poolGuard) GetStats() jsonlib.JsonEntity {
+	g.mu.Lock()
+	size := len(g.pool(g.system.GetManager(), g.seeds))
+	churnLeft := g.churnLeftLocked(size, time.Now())
+	recent := len(g.changes)
+	last := g.last
+	refreshInterval, nextRefresh := g.refreshInterval, g.nextRefresh
+	g.mu.Unlock()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("size", jsonlib.NewJsonValue(size))
+	obj.Set("min", jsonlib.NewJsonValue(g.minSize))
+	obj.Set("max", jsonlib.NewJsonValue(g.maxSize))
+	obj.Set("max_new_per_run", jsonlib.NewJsonValue(g.maxNew))
+	obj.Set("recent_changes", jsonlib.NewJsonValue(recent))
+	if churnLeft >= 0 {
+		obj.Set("churn_left", jsonlib.NewJsonValue(churnLeft))
+	}
+	obj.Set("discovery_runs", jsonlib.NewJsonValue(atomic.LoadInt64(&g.runs)))
+	obj.Set("admitted", jsonlib.NewJsonValue(atomic.LoadInt64(&g.admitted)))
+	obj.Set("dropped_over_run_limit", jsonlib.NewJsonValue(atomic.LoadInt64(&g.droppedNew)))
+	obj.Set("dropped_over_churn", jsonlib.NewJsonValue(atomic.LoadInt64(&g.droppedChurn)))
+	obj.Set("dropped_over_max", jsonlib.NewJsonValue(atomic.LoadInt64(&g.droppedMax)))
+	obj.Set("removals", jsonlib.NewJsonValue(atomic.LoadInt64(&g.removals)))
+	obj.Set("deferred_removals", jsonlib.NewJsonValue(atomic.LoadInt64(&g.deferredRemovals)))
+	obj.Set("refresh_interval_seconds", jsonlib.NewJsonValue(int64(refreshInterval.Seconds())))
+	if !nextRefresh.IsZero() {
+		obj.Set("next_refresh", jsonlib.NewJsonValue(nextRefresh.Unix()))
+	}
+	if !last.at.IsZero() {
+		run := jsonlib.NewJsonObject()
+		run.Set("at", jsonlib.NewJsonValue(last.at.Unix()))
+		run.Set("duration_ms", jsonlib.NewJsonValue(last.duration.Milliseconds()))
+		run.Set("seeds", jsonlib.NewJsonValue(last.seeds))
+		run.Set("found", jsonlib.NewJsonValue(last.found))
+		run.Set("failed_vetting", jsonlib.NewJsonValue(last.rejected))
+		run.Set("dropped_aliases", jsonlib.NewJsonValue(last.aliases))
+		run.Set("admitted", jsonlib.NewJsonValue(last.admitted))
+		run.Set("pool_before", jsonlib.NewJsonValue(last.poolBefore))
+		run.Set("pool_after", jsonlib.NewJsonValue(last.poolAfter))
+		obj.Set("last_discovery", run)
+	}
+	return obj
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Named relay-set profiles for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/girino/nostr-lib/broadcast"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+)
+
+// relayProfile is a named set of upstream relays. Empty sets fall back to the
+// relays configured with QUERY_REMOTES, BROADCAST_SEED_RELAYS and
+// BROADCAST_MANDATORY_RELAYS; an empty mirror set mirrors the query set.
+type relayProfile struct {
+	Query              []string `json:"query"`
+	Mirror             []string `json:"mirror,omitempty"`
+	BroadcastSeeds     []string `json:"broadcast_seeds,omitempty"`
+	BroadcastMandatory []string `json:"broadcast_mandatory,omitempty"`
+}
+
+// UnmarshalJSON accepts either a full profile object or a plain list of
+// relays, which is used as the query (and mirror) set
+func (p *relayProfile) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*p = relayProfile{Query: list}
+		return nil
+	}
+	type plain relayProfile
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// withDefaults fills the empty sets of p from base
+func (p relayProfile) withDefaults(base relayProfile) relayProfile {
+	if len(p.Query) == 0 {
+		p.Query = base.Query
+	}
+	if len(p.Mirror) == 0 {
+		p.Mirror = slices.Clone(p.Query)
+	}
+	if len(p.BroadcastSeeds) == 0 {
+		p.BroadcastSeeds = base.BroadcastSeeds
+	}
+	if len(p.BroadcastMandatory) == 0 {
+		p.BroadcastMandatory = base.BroadcastMandatory
+	}
+	return p
+}
+
+// equal reports whether p and o name the same relays
+func (p relayProfile) equal(o relayProfile) bool {
+	return slices.Equal(p.Query, o.Query) && slices.Equal(p.Mirror, o.Mirror) &&
+		slices.Equal(p.BroadcastSeeds, o.BroadcastSeeds) && slices.Equal(p.BroadcastMandatory, o.BroadcastMandatory)
+}
+
+// toJSON renders the profile
+func (p relayProfile) toJSON() *jsonlib.JsonObject {
+	list := func(urls []string) *jsonlib.JsonList {
+		l := jsonlib.NewJsonList()
+		for _, url := range urls {
+			l.Append(jsonlib.NewJsonValue(url))
+		}
+		return l
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("query", list(p.Query))
+	obj.Set("mirror", list(p.Mirror))
+	obj.Set("broadcast_seeds", list(p.BroadcastSeeds))
+	obj.Set("broadcast_mandatory", list(p.BroadcastMandatory))
+	return obj
+}
+
+// loadRelayProfiles reads a JSON object mapping profile names to profiles
+func loadRelayProfiles(path string) (map[string]relayProfile, error) {
+	profiles := map[string]relayProfile{}
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// applyProfile replaces the relay lists of cfg with the named profile
+func applyProfile(cfg *Config, profiles map[string]relayProfile, name string) error {
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	resolved := profile.withDefaults(baseProfile(cfg))
+	cfg.QueryRemotes = resolved.Query
+	cfg.MirrorRemotes = resolved.Mirror
+	cfg.BroadcastSeedRelays = resolved.BroadcastSeeds
+	cfg.BroadcastMandatoryRelays = resolved.BroadcastMandatory
+	return nil
+}
+
+// baseProfile returns the relay sets configured in cfg
+func baseProfile(cfg *Config) relayProfile {
+	return relayProfile{
+		Query:              cfg.QueryRemotes,
+		Mirror:             cfg.MirrorRemotes,
+		BroadcastSeeds:     cfg.BroadcastSeedRelays,
+		BroadcastMandatory: cfg.BroadcastMandatoryRelays,
+	}
+}
+
+// profileController switches the active relay sets at runtime
+type profileController struct {
+	mu         sync.Mutex
+	profiles   map[string]relayProfile
+	configured map[string]relayProfile // from RELAY_PROFILES_FILE
+	base       relayProfile
+	active     string
+	current    relayProfile
+	// components whose relays are switched; hc, system, guard and pub may
+	// be nil
+	rs     *relaystore.RelayStore
+	mm     *mirror.MirrorManager
+	qq     *quorumQuery
+	hc     *hllCounter
+	system *broadcast.BroadcastSystem
+	guard  *poolGuard
+	pub    *publisher
+}
+
+// newProfileController creates a controller; base holds the relays
+// configured without a profile and current the relays in use
+func newProfileController(profiles map[string]relayProfile, base relayProfile, active string, current relayProfile) *profileController {
+	return &profileController{
+		profiles:   profiles,
+		configured: profiles,
+		base:       base,
+		active:     active,
+		current:    current,
+	}
+}
+
+// Switch makes the named profile active. The empty name restores the
+// configured relays.
+func (c *profileController) Switch(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	profile := relayProfile{}
+	if name != "" {
+		var ok bool
+		if profile, ok = c.profiles[name]; !ok {
+			return fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	next := profile.withDefaults(c.base)
+	previous := c.current
+
+	c.rs.SetQueryRemotes(next.Query)
+	c.qq.SetRelays(next.Query)
+	if c.hc != nil {
+		c.hc.SetRelays(filterRelaysByNIP(context.Background(), next.Query, 45))
+	}
+	if err := c.mm.SetQueryRemotes(next.Mirror); err != nil {
+		logging.Warn("profile %q: restarting mirroring failed: %v", name, err)
+	}
+
+	if c.system != nil {
+		for _, url := range previous.BroadcastMandatory {
+			if !slices.Contains(next.BroadcastMandatory, url) {
+				c.system.GetManager().RemoveRelay(url)
+			}
+		}
+		c.system.AddMandatoryRelays(next.BroadcastMandatory)
+		if c.pub != nil {
+			c.pub.SetMandatory(next.BroadcastMandatory)
+		}
+		go c.guard.Discover(context.Background(), next.BroadcastSeeds)
+	}
+
+	c.active = name
+	c.current = next
+	logging.Info("switched to relay profile %q: %d query, %d mirror, %d seed, %d mandatory relays",
+		name, len(next.Query), len(next.Mirror), len(next.BroadcastSeeds), len(next.BroadcastMandatory))
+	return nil
+}
+
+// SetRemoteProfiles replaces the profiles from remote configuration, which
+// take precedence over those of RELAY_PROFILES_FILE with the same name. The
+// active profile is switched to again when its relays changed; when it was
+// removed its relays stay in use.
+func (c *profileController) SetRemoteProfiles(remote map[string]relayProfile) error {
+	c.mu.Lock()
+	profiles := maps.Clone(c.configured)
+	maps.Copy(profiles, remote)
+	active := c.active
+	previous, had := c.profiles[active]
+	next, has := profiles[active]
+	c.profiles = profiles
+	c.mu.Unlock()
+	if active == "" || !has || (had && previous.equal(next)) {
+		return nil
+	}
+	return c.Switch(active)
+}
+
+// HasConfigured reports whether RELAY_PROFILES_FILE defines the named profile
+func (c *profileController) HasConfigured(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.configured[name]
+	return ok
+}
+
+// Current returns the relay sets in use
+func (c *profileController) Current() relayProfile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// Active returns the name of the active profile, empty for the configured
+// relays
+func (c *profileController) Active() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// profileRequest is the body accepted by POST /api/v1/admin/profile
+type profileRequest struct {
+	Profile *string `json:"profile"`
+}
+
+// HandleProfile serves GET (inspect) and POST (switch) of the active profile
+func (c *profileController) HandleProfile(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body profileRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Profile == nil {
+			http.Error(w, "missing profile", http.StatusBadRequest)
+			return
+		}
+		if err := c.Switch(*body.Profile); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, c.GetStats())
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *profileController) GetStatsName() string {
+	return "profiles"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *profileController) GetStats() jsonlib.JsonEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.profiles))
+	for name := range c.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	available := jsonlib.NewJsonList()
+	for _, name := range names {
+		available.Append(jsonlib.NewJsonValue(name))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("active", jsonlib.NewJsonValue(c.active))
+	obj.Set("available", available)
+	obj.Set("relays", c.current.toJSON())
+	return obj
+}
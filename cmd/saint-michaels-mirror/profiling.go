@@ -0,0 +1,257 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Profiling snapshots on health degradation for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// ProfilingCheckInterval is how often health is checked for degradation
+const ProfilingCheckInterval = 10 * time.Second
+
+// Reasons a snapshot is taken for
+const (
+	profilingReasonGoroutines = "goroutines"
+	profilingReasonHealthRed  = "health_red"
+)
+
+// profilingFiles are the profiles written per snapshot, by file suffix
+var profilingFiles = []struct{ suffix, profile string }{
+	{".goroutine.pb.gz", "goroutine"},
+	{".heap.pb.gz", "heap"},
+}
+
+// profilingTimeLayout names snapshots so they sort by time
+const profilingTimeLayout = "20060102T150405Z"
+
+// profilingSnapshots writes goroutine and heap profiles to a directory when
+// the goroutine count reaches GoroutineYellowThreshold or the main health
+// state turns RED, so incidents nobody watched live can be analyzed later
+// with go tool pprof. A snapshot is taken when one of these conditions
+// starts to hold, at most once per cooldown, and only the newest
+// maxSnapshots are kept in the directory.
+type profilingSnapshots struct {
+	dir          string
+	maxSnapshots int
+	cooldown     time.Duration
+	health       func() string // main health state
+	mu           sync.Mutex
+	reasons      []string  // conditions that held at the last check
+	last         time.Time // of the last snapshot attempt
+	lastName     string
+	lastTaken    time.Time
+	lastReason   string
+	lastError    string
+	kept         int
+	// stats
+	taken    int64
+	skipped  int64
+	failures int64
+}
+
+// newProfilingSnapshots creates the snapshots in dir, creating it if needed,
+// of the health state returned by health
+func newProfilingSnapshots(dir string, maxSnapshots int, cooldown time.Duration, health func() string) (*profilingSnapshots, error) {
+	if maxSnapshots <= 0 {
+		return nil, fmt.Errorf("invalid PROFILING_MAX_SNAPSHOTS %d: must be positive", maxSnapshots)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	p := &profilingSnapshots{
+		dir:          dir,
+		maxSnapshots: maxSnapshots,
+		cooldown:     cooldown,
+		health:       health,
+	}
+	// apply the retention to snapshots of previous runs
+	kept, err := p.prune()
+	if err != nil {
+		return nil, err
+	}
+	p.kept = kept
+	return p, nil
+}
+
+// Start checks health every ProfilingCheckInterval until ctx is done
+func (p *profilingSnapshots) Start(ctx context.Context) {
+	logging.Info("profiling snapshots: up to %d in %s on degraded health", p.maxSnapshots, p.dir)
+	go func() {
+		ticker := time.NewTicker(ProfilingCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// check takes a snapshot when a degradation condition started to hold
+func (p *profilingSnapshots) check() {
+	var reasons []string
+	if getGoroutineHealthState(runtime.NumGoroutine()) != HealthGreen {
+		reasons = append(reasons, profilingReasonGoroutines)
+	}
+	if p.health() == HealthRed {
+		reasons = append(reasons, profilingReasonHealthRed)
+	}
+
+	p.mu.Lock()
+	var started []string
+	for _, reason := range reasons {
+		if !slices.Contains(p.reasons, reason) {
+			started = append(started, reason)
+		}
+	}
+	p.reasons = reasons
+	if len(started) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if !p.last.IsZero() && now.Sub(p.last) < p.cooldown {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.skipped, 1)
+		logging.DebugMethod("profiling", "check", "%s: last snapshot was taken %v ago, skipping", strings.Join(started, ","), now.Sub(p.last).Round(time.Second))
+		return
+	}
+	p.last = now
+	p.mu.Unlock()
+
+	p.snapshot(now, strings.Join(started, "+"))
+}
+
+// snapshot writes the profiles of one snapshot taken for reason
+func (p *profilingSnapshots) snapshot(now time.Time, reason string) {
+	name := now.UTC().Format(profilingTimeLayout) + "-" + reason
+	var errs []error
+	for _, f := range profilingFiles {
+		if err := p.writeProfile(filepath.Join(p.dir, name+f.suffix), f.profile); err != nil {
+			errs = append(errs, fmt.Errorf("%s profile: %w", f.profile, err))
+		}
+	}
+	kept, pruneErr := p.prune()
+	err := errors.Join(append(errs, pruneErr)...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pruneErr == nil {
+		p.kept = kept
+	}
+	if err != nil {
+		atomic.AddInt64(&p.failures, 1)
+		p.lastError = err.Error()
+		logging.Error("profiling snapshot %s: %v", name, err)
+	}
+	if len(errs) < len(profilingFiles) {
+		atomic.AddInt64(&p.taken, 1)
+		p.lastName = name
+		p.lastReason = reason
+		p.lastTaken = now
+		logging.Warn("health degraded (%s): profiling snapshot %s written to %s", reason, name, p.dir)
+	}
+}
+
+// writeProfile writes the named runtime profile to path
+func (p *profilingSnapshots) writeProfile(path, profile string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup(profile).WriteTo(f, 0); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// prune removes the oldest snapshots beyond maxSnapshots, returning how many
+// are kept
+func (p *profilingSnapshots) prune() (int, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return 0, err
+	}
+	// files by snapshot name; names sort by time
+	files := map[string][]string{}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		for _, f := range profilingFiles {
+			name, ok := strings.CutSuffix(entry.Name(), f.suffix)
+			if !ok {
+				continue
+			}
+			if _, seen := files[name]; !seen {
+				names = append(names, name)
+			}
+			files[name] = append(files[name], entry.Name())
+		}
+	}
+	slices.Sort(names)
+	var errs []error
+	for _, name := range names[:max(len(names)-p.maxSnapshots, 0)] {
+		for _, file := range files[name] {
+			if err := os.Remove(filepath.Join(p.dir, file)); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		logging.DebugMethod("profiling", "prune", "removed snapshot %s", name)
+	}
+	return min(len(names), p.maxSnapshots), errors.Join(errs...)
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *profilingSnapshots) GetStatsName() string {
+	return "profiling"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *profilingSnapshots) GetStats() jsonlib.JsonEntity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("dir", jsonlib.NewJsonValue(p.dir))
+	obj.Set("max_snapshots", jsonlib.NewJsonValue(p.maxSnapshots))
+	obj.Set("kept", jsonlib.NewJsonValue(p.kept))
+	obj.Set("taken", jsonlib.NewJsonValue(atomic.LoadInt64(&p.taken)))
+	obj.Set("skipped_cooldown", jsonlib.NewJsonValue(atomic.LoadInt64(&p.skipped)))
+	obj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&p.failures)))
+	if p.lastName != "" {
+		last := jsonlib.NewJsonObject()
+		last.Set("name", jsonlib.NewJsonValue(p.lastName))
+		last.Set("reason", jsonlib.NewJsonValue(p.lastReason))
+		last.Set("taken_at", jsonlib.NewJsonValue(p.lastTaken.Unix()))
+		obj.Set("last_snapshot", last)
+	}
+	if p.lastError != "" {
+		obj.Set("last_error", jsonlib.NewJsonValue(p.lastError))
+	}
+	return obj
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Event provenance tracking for Espelho de São Miguel.
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/mirror"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Provenance roles: how an upstream relay handed us an event
+const (
+	provenanceRoleMirror = "mirror"
+	provenanceRoleQuery  = "query"
+	provenanceRoleSearch = "search"
+)
+
+// provenanceSource is one relay that delivered an event in one role
+type provenanceSource struct {
+	relay     string
+	role      string
+	firstSeen time.Time
+	lastSeen  time.Time
+	count     int64
+}
+
+// provenanceEntry lists every source of a single event
+type provenanceEntry struct {
+	id      string
+	sources []*provenanceSource
+}
+
+// provenanceLog remembers which upstream relays delivered each recently seen
+// event, evicting the least recently seen events beyond its capacity.
+type provenanceLog struct {
+	capacity int
+	mu       sync.Mutex
+	order    *list.List               // of *provenanceEntry, most recent first
+	entries  map[string]*list.Element // by event id
+	// tiers, when set, splits the recorded deliveries by relay trust tier
+	tiers mirror.TrustTiers
+	// stats
+	recorded int64
+	byTier   map[string]int64
+	evicted  int64
+	lookups  int64
+	hits     int64
+}
+
+// newProvenanceLog creates a log holding up to capacity events
+func newProvenanceLog(capacity int) *provenanceLog {
+	return &provenanceLog{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// SetTrustTiers makes the log count deliveries by the trust tier of their
+// relay and show the tier of each source
+func (p *provenanceLog) SetTrustTiers(tiers mirror.TrustTiers) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tiers = tiers
+	p.byTier = map[string]int64{}
+}
+
+// Observer returns a callback recording deliveries in the given role
+func (p *provenanceLog) Observer(role string) func(relayURL string, id string) {
+	return func(relayURL string, id string) {
+		p.Record(id, relayURL, role)
+	}
+}
+
+// Record notes that relay delivered event id in role
+func (p *provenanceLog) Record(id, relay, role string) {
+	relay = nostr.NormalizeURL(relay)
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorded++
+	if p.tiers != nil {
+		p.byTier[p.tiers.Tier(relay)]++
+	}
+
+	var entry *provenanceEntry
+	if elem, ok := p.entries[id]; ok {
+		p.order.MoveToFront(elem)
+		entry = elem.Value.(*provenanceEntry)
+	} else {
+		entry = &provenanceEntry{id: id}
+		p.entries[id] = p.order.PushFront(entry)
+		for p.order.Len() > p.capacity {
+			oldest := p.order.Back()
+			p.order.Remove(oldest)
+			delete(p.entries, oldest.Value.(*provenanceEntry).id)
+			p.evicted++
+		}
+	}
+
+	for _, src := range entry.sources {
+		if src.relay == relay && src.role == role {
+			src.lastSeen = now
+			src.count++
+			return
+		}
+	}
+	entry.sources = append(entry.sources, &provenanceSource{
+		relay:     relay,
+		role:      role,
+		firstSeen: now,
+		lastSeen:  now,
+		count:     1,
+	})
+}
+
+// ForgetEvents drops the sources of ids, returning how many were known
+func (p *provenanceLog) ForgetEvents(ids []string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, id := range ids {
+		if elem, ok := p.entries[id]; ok {
+			p.order.Remove(elem)
+			delete(p.entries, id)
+			n++
+		}
+	}
+	return n
+}
+
+// tierOf returns the trust tier of relay, "" without tiers
+func (p *provenanceLog) tierOf(relay string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tiers == nil {
+		return ""
+	}
+	return p.tiers.Tier(relay)
+}
+
+// Lookup returns the sources of event id ordered by first sighting
+func (p *provenanceLog) Lookup(id string) ([]provenanceSource, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lookups++
+	elem, ok := p.entries[id]
+	if !ok {
+		return nil, false
+	}
+	p.hits++
+	entry := elem.Value.(*provenanceEntry)
+	sources := make([]provenanceSource, len(entry.sources))
+	for i, src := range entry.sources {
+		sources[i] = *src
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].firstSeen.Before(sources[j].firstSeen)
+	})
+	return sources, true
+}
+
+// HandleProvenance serves GET /api/v1/events/{id}/provenance
+func (p *provenanceLog) HandleProvenance(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := req.PathValue("id")
+	if !nostr.IsValid32ByteHex(id) {
+		http.Error(w, "invalid event id", http.StatusBadRequest)
+		return
+	}
+	sources, ok := p.Lookup(id)
+	if !ok {
+		http.Error(w, "event not seen recently", http.StatusNotFound)
+		return
+	}
+
+	relays := jsonlib.NewJsonList()
+	for _, src := range sources {
+		obj := jsonlib.NewJsonObject()
+		obj.Set("relay", jsonlib.NewJsonValue(src.relay))
+		obj.Set("role", jsonlib.NewJsonValue(src.role))
+		if tier := p.tierOf(src.relay); tier != "" {
+			obj.Set("tier", jsonlib.NewJsonValue(tier))
+		}
+		obj.Set("first_seen", jsonlib.NewJsonValue(src.firstSeen.Unix()))
+		obj.Set("last_seen", jsonlib.NewJsonValue(src.lastSeen.Unix()))
+		obj.Set("count", jsonlib.NewJsonValue(src.count))
+		relays.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("id", jsonlib.NewJsonValue(id))
+	obj.Set("relays", relays)
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *provenanceLog) GetStatsName() string {
+	return "provenance"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *provenanceLog) GetStats() jsonlib.JsonEntity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("capacity", jsonlib.NewJsonValue(p.capacity))
+	obj.Set("events", jsonlib.NewJsonValue(p.order.Len()))
+	obj.Set("recorded", jsonlib.NewJsonValue(p.recorded))
+	obj.Set("evicted", jsonlib.NewJsonValue(p.evicted))
+	obj.Set("lookups", jsonlib.NewJsonValue(p.lookups))
+	obj.Set("hits", jsonlib.NewJsonValue(p.hits))
+	if p.tiers != nil {
+		byTier := jsonlib.NewJsonObject()
+		for _, tier := range []string{mirror.TrustHigh, mirror.TrustNormal, mirror.TrustLow} {
+			byTier.Set(tier, jsonlib.NewJsonValue(p.byTier[tier]))
+		}
+		obj.Set("recorded_by_tier", byTier)
+	}
+	return obj
+}
@@ -0,0 +1,737 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Event publishing with retries for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Publish tuning
+const (
+	PublishAttemptTimeout = 10 * time.Second
+	publishQueuePerWorker = 10
+)
+
+// retryAfterPattern finds retry hints like "retry after 30s" or "retry-after: 5"
+var retryAfterPattern = regexp.MustCompile(`(?i)retry[- ]?after:?\s*(\d+)\s*(ms|s|m)?`)
+
+// publishRelayStats holds per-relay publish counters
+type publishRelayStats struct {
+	attempts          int64
+	successes         int64
+	failures          int64
+	retries           int64
+	transientFailures int64
+	permanentFailures int64
+	duplicates        int64
+	// sends skipped in dry-run mode
+	dryRuns int64
+	// attempts aborted by shutdown or the attempt timeout
+	canceled  int64
+	timeouts  int64
+	lastError atomic.Value // string
+}
+
+// publisher sends accepted events to the broadcast relays selected by the
+// broadcast system. Transient failures (timeouts, resets, rate limits) are
+// retried with exponential backoff while permanent rejections fail fast;
+// every outcome is reported back to the broadcast manager for scoring. With
+// a window, the events for each relay go through its publish lane, so bursts
+// are pipelined over one connection per relay.
+type publisher struct {
+	system      *broadcast.BroadcastSystem
+	mandatory   []string
+	mandatoryMu sync.RWMutex
+	pool        *relaypool.Role
+	penalties   *penaltyBox
+	// authenticate, when set, answers the AUTH challenge of relays that
+	// refuse events with auth-required
+	authenticate func(ctx context.Context, relay *nostr.Relay) error
+	attempts     int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	queue        chan *nostr.Event
+	pending      int64 // events queued or being published
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	// workerCount is how many workers should run and running how many do;
+	// shrunk is closed when the pool shrinks, to wake idle workers
+	workersMu   sync.Mutex
+	workerCount int
+	running     int
+	shrunk      chan struct{}
+	// topN is how many of the top scored relays each event goes to
+	topN int64
+	// window is how many events each relay has in flight; 0 publishes
+	// every event to every relay on a goroutine of its own
+	window int
+	lanes  sync.Map // url -> *publishLane
+	// maxHints is how many relay hints of an event are added to its targets
+	maxHints int
+	// results, when set, keeps the per-relay outcome of recent events
+	results *broadcastLog
+	// regions, when set, picks the broadcast relays by country
+	regions *relayRegions
+	// dryRun routes events as usual but only logs the sends
+	dryRun bool
+	// limits caps the rate and concurrency of attempts to some relays
+	limits publishLimits
+	// faults, when set, fails publish attempts for testing
+	faults *faultInjector
+	// enrichment, when set, adds tags to the events the mirror can sign
+	enrichment *enrichPipeline
+	// resumed is non-nil while the workers are paused and closed on resume
+	pauseMu sync.Mutex
+	resumed chan struct{}
+	// recently published event IDs
+	seenMu  sync.Mutex
+	seen    map[string]time.Time
+	seenTTL time.Duration
+	// stats
+	relays         sync.Map // url -> *publishRelayStats
+	events         int64
+	duplicates     int64
+	dropped        int64
+	eventsAccepted int64
+	eventsFailed   int64
+	eventsCanceled int64
+	// relay hints, with one set of counters for all hinted relays
+	hintStats    publishRelayStats
+	hintedEvents int64
+	hintRelays   int64
+	hintsInvalid int64
+}
+
+// newPublisher creates a publisher on top of the broadcast system
+func newPublisher(system *broadcast.BroadcastSystem, cfg *Config, pool *relaypool.Role, penalties *penaltyBox) *publisher {
+	seenTTL, err := time.ParseDuration(cfg.BroadcastCacheTTL)
+	if err != nil || seenTTL <= 0 {
+		seenTTL = time.Hour
+	}
+	workers := cfg.BroadcastWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	attempts := cfg.PublishRetryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	ctx, cancel := context.WithCancel(withBandwidthRole(context.Background(), bandwidthRolePublish))
+	return &publisher{
+		system:      system,
+		mandatory:   cfg.BroadcastMandatoryRelays,
+		pool:        pool,
+		penalties:   penalties,
+		attempts:    attempts,
+		backoff:     cfg.PublishRetryBackoff,
+		maxBackoff:  cfg.PublishRetryMaxBackoff,
+		workerCount: workers,
+		shrunk:      make(chan struct{}),
+		topN:        int64(cfg.MaxPublishRelays),
+		window:      max(cfg.PublishWindow, 0),
+		maxHints:    cfg.PublishMaxHintRelays,
+		queue:       make(chan *nostr.Event, workers*publishQueuePerWorker),
+		ctx:         ctx,
+		cancel:      cancel,
+		seen:        map[string]time.Time{},
+		seenTTL:     seenTTL,
+	}
+}
+
+// Start launches the publish workers
+func (p *publisher) Start() {
+	if p.pool == nil {
+		p.pool = relaypool.New(p.ctx).Role(relaypool.RolePublish)
+	}
+	p.SetWorkers(p.workerCount)
+	p.wg.Add(1)
+	go p.cleanupSeen()
+	logging.Info("publisher started with %d workers, %d attempts per relay", p.workerCount, p.attempts)
+}
+
+// Close stops the workers, abandoning pending retries
+func (p *publisher) Close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// Drain waits until every queued event, including those queued meanwhile,
+// has been published, or ctx is done
+func (p *publisher) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := atomic.LoadInt64(&p.pending)
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d events still queued", pending)
+		case <-ticker.C:
+		}
+	}
+}
+
+// RejectEvent rejects events that were published recently
+func (p *publisher) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if p.isSeen(evt.ID) {
+		logging.DebugMethod("publisher", "RejectEvent", "event %s was published recently, rejecting as duplicate", evt.ID)
+		return true, "duplicate: event already exists"
+	}
+	return false, ""
+}
+
+// SaveEvent queues an event for publishing
+func (p *publisher) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if !p.markSeen(evt.ID) {
+		atomic.AddInt64(&p.duplicates, 1)
+		return nil
+	}
+	return p.enqueue(evt)
+}
+
+// Republish queues an event for publishing again even if it was published
+// recently, e.g. to keep it replicated
+func (p *publisher) Republish(evt *nostr.Event) error {
+	p.markSeen(evt.ID)
+	return p.enqueue(evt)
+}
+
+// enqueue hands an event marked as seen to the workers, enriched if the
+// pipeline changes it
+func (p *publisher) enqueue(evt *nostr.Event) error {
+	original := evt.ID
+	if enriched := p.enrichment.Apply(evt); enriched != evt {
+		evt = enriched
+		p.markSeen(evt.ID)
+	}
+	atomic.AddInt64(&p.events, 1)
+	p.results.Queued(evt)
+	atomic.AddInt64(&p.pending, 1)
+	select {
+	case p.queue <- evt:
+		return nil
+	default:
+		atomic.AddInt64(&p.pending, -1)
+		atomic.AddInt64(&p.dropped, 1)
+		p.forget(original)
+		p.forget(evt.ID)
+		p.results.Dropped(evt.ID, "publish queue full")
+		logging.Warn("publish queue full, dropping event %s", evt.ID)
+		return relayerrors.New(relayerrors.PrefixRateLimited, "relay is busy publishing, try again later")
+	}
+}
+
+// Pause stops the workers from publishing until Resume; queued events wait
+func (p *publisher) Pause() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+		logging.Info("publisher paused")
+	}
+}
+
+// Resume restarts paused workers
+func (p *publisher) Resume() {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		logging.Info("publisher resumed")
+	}
+}
+
+// pausedChan returns a channel closed on resume, or nil when not paused
+func (p *publisher) pausedChan() chan struct{} {
+	p.pauseMu.Lock()
+	defer p.pauseMu.Unlock()
+	return p.resumed
+}
+
+// worker publishes queued events
+func (p *publisher) worker() {
+	defer p.wg.Done()
+	for {
+		shrunk, retire := p.retiring()
+		if retire {
+			return
+		}
+		if resumed := p.pausedChan(); resumed != nil {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-shrunk:
+			case <-resumed:
+			}
+			continue
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-shrunk:
+		case evt := <-p.queue:
+			p.publish(evt, func() { atomic.AddInt64(&p.pending, -1) })
+		}
+	}
+}
+
+// SetMandatory replaces the relays every event is published to
+func (p *publisher) SetMandatory(urls []string) {
+	p.mandatoryMu.Lock()
+	defer p.mandatoryMu.Unlock()
+	p.mandatory = urls
+}
+
+// targets returns the mandatory relays plus the top scored relays
+func (p *publisher) targets() []string {
+	unique := map[string]bool{}
+	p.mandatoryMu.RLock()
+	for _, url := range p.mandatory {
+		unique[nostr.NormalizeURL(url)] = true
+	}
+	p.mandatoryMu.RUnlock()
+	for _, url := range p.broadcastRelays() {
+		unique[nostr.NormalizeURL(url)] = true
+	}
+	urls := make([]string, 0, len(unique))
+	for url := range unique {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// publish sends an event to all target relays concurrently, calling finished
+// when they all answered
+func (p *publisher) publish(evt *nostr.Event, finished func()) {
+	urls := p.targets()
+	hinted := p.hintedTargets(evt, urls)
+	urls = append(urls, hinted...)
+	if len(urls) == 0 {
+		logging.Warn("no relays available for publishing event %s (kind %d)", evt.ID, evt.Kind)
+		atomic.AddInt64(&p.eventsFailed, 1)
+		p.results.Dropped(evt.ID, "no relays available")
+		finished()
+		return
+	}
+	p.results.Started(evt.ID, urls, len(hinted))
+	if p.dryRun {
+		logging.Info("dry run: would publish event %s (kind %d) to %d relays: %s", evt.ID, evt.Kind, len(urls), strings.Join(urls, ", "))
+	}
+	if p.window > 0 {
+		p.dispatch(evt, urls, len(hinted), finished)
+		return
+	}
+
+	defer finished()
+	var errs relayerrors.MultiError
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(url string, hint bool) {
+			defer wg.Done()
+			errs.Add(url, p.publishToRelay(url, evt, hint))
+		}(url, i >= len(urls)-len(hinted))
+	}
+	wg.Wait()
+	p.finish(evt, len(urls), &errs)
+}
+
+// finish records the outcome of publishing evt to targets relays, errs
+// holding the relays that did not take it
+func (p *publisher) finish(evt *nostr.Event, targets int, errs *relayerrors.MultiError) {
+	p.results.Finished(evt.ID)
+
+	if errs.Len() > 0 && p.ctx.Err() != nil {
+		// shutting down; the relays did not get a fair chance
+		atomic.AddInt64(&p.eventsCanceled, 1)
+		logging.DebugMethod("publisher", "publish", "publishing %s canceled: %v", evt.ID, errs)
+		return
+	}
+	if errs.Len() == targets {
+		atomic.AddInt64(&p.eventsFailed, 1)
+		logging.DebugMethod("publisher", "publish", "event %s rejected by all %d relays: %v", evt.ID, targets, errs)
+		return
+	}
+	atomic.AddInt64(&p.eventsAccepted, 1)
+	logging.DebugMethod("publisher", "publish", "event %s published to %d/%d relays", evt.ID, targets-errs.Len(), targets)
+}
+
+// hintedTargets returns the relay hints of evt that are not among targets
+func (p *publisher) hintedTargets(evt *nostr.Event, targets []string) []string {
+	if p.maxHints <= 0 {
+		return nil
+	}
+	hints, invalid := relayHints(evt, p.maxHints)
+	atomic.AddInt64(&p.hintsInvalid, int64(invalid))
+	var extra []string
+	for _, url := range hints {
+		if !slices.Contains(targets, url) {
+			extra = append(extra, url)
+		}
+	}
+	if len(extra) > 0 {
+		atomic.AddInt64(&p.hintedEvents, 1)
+		atomic.AddInt64(&p.hintRelays, int64(len(extra)))
+		logging.DebugMethod("publisher", "hintedTargets", "event %s also goes to hinted relays %v", evt.ID, extra)
+	}
+	return extra
+}
+
+// publishToRelay publishes to a single relay, retrying transient failures.
+// Relays only targeted because of a hint share one set of counters and are
+// not reported to the broadcast manager, so clients cannot grow either.
+func (p *publisher) publishToRelay(url string, evt *nostr.Event, hint bool) error {
+	rs := &p.hintStats
+	if !hint {
+		rs = p.relayStats(url)
+	}
+	backoff := p.backoff
+	if p.dryRun {
+		// nothing is sent, so the relay scores are left alone
+		atomic.AddInt64(&rs.dryRuns, 1)
+		p.results.Attempt(evt.ID, url, 0, broadcastDryRun, nil)
+		return nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= p.attempts; attempt++ {
+		if attempt > 1 {
+			atomic.AddInt64(&rs.retries, 1)
+			delay := backoff
+			if hint, ok := retryAfter(err); ok {
+				delay = hint
+			}
+			if delay > p.maxBackoff {
+				delay = p.maxBackoff
+			}
+			logging.DebugMethod("publisher", "publishToRelay", "retrying %s on %s in %v (attempt %d/%d): %v", evt.ID, url, delay, attempt, p.attempts, err)
+			select {
+			case <-p.ctx.Done():
+				atomic.AddInt64(&rs.canceled, 1)
+				p.results.Attempt(evt.ID, url, attempt-1, broadcastCanceled, err)
+				return relayerrors.Wrap(url, err)
+			case <-time.After(delay):
+			}
+			backoff *= 2
+		}
+
+		release, waitErr := p.limits.acquire(p.ctx, url)
+		if errors.Is(waitErr, errPublishCapped) {
+			// over the relay's own cap, which says nothing about its health
+			p.results.Attempt(evt.ID, url, attempt-1, broadcastFailed, waitErr)
+			return relayerrors.Wrap(url, waitErr)
+		}
+		if waitErr != nil {
+			atomic.AddInt64(&rs.canceled, 1)
+			p.results.Attempt(evt.ID, url, attempt-1, broadcastCanceled, waitErr)
+			return relayerrors.Wrap(url, waitErr)
+		}
+		atomic.AddInt64(&rs.attempts, 1)
+		start := time.Now()
+		err = p.publishOnce(url, evt)
+		release()
+		if err != nil && p.ctx.Err() != nil {
+			// aborted by shutdown, which says nothing about the relay
+			atomic.AddInt64(&rs.canceled, 1)
+			p.results.Attempt(evt.ID, url, attempt, broadcastCanceled, err)
+			return relayerrors.Wrap(url, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			atomic.AddInt64(&rs.timeouts, 1)
+		}
+		if !hint {
+			p.system.GetManager().TrackPublishResult(url, err == nil, time.Since(start), err)
+		}
+		if err == nil {
+			atomic.AddInt64(&rs.successes, 1)
+			p.results.Attempt(evt.ID, url, attempt, broadcastAccepted, nil)
+			return nil
+		}
+
+		switch relayerrors.Classify(err) {
+		case relayerrors.ClassDuplicate:
+			// the relay already has it, which is as good as accepted
+			atomic.AddInt64(&rs.duplicates, 1)
+			p.results.Attempt(evt.ID, url, attempt, broadcastDuplicate, err)
+			return nil
+		case relayerrors.ClassTransient:
+			atomic.AddInt64(&rs.transientFailures, 1)
+			rs.lastError.Store(err.Error())
+			status := broadcastRetrying
+			if attempt == p.attempts {
+				status = broadcastFailed
+			}
+			p.results.Attempt(evt.ID, url, attempt, status, err)
+			continue
+		default:
+			atomic.AddInt64(&rs.permanentFailures, 1)
+			atomic.AddInt64(&rs.failures, 1)
+			rs.lastError.Store(err.Error())
+			p.results.Attempt(evt.ID, url, attempt, broadcastRejected, err)
+			logging.DebugMethod("publisher", "publishToRelay", "%s permanently rejected %s: %v", url, evt.ID, err)
+			return relayerrors.Wrap(url, err)
+		}
+	}
+
+	atomic.AddInt64(&rs.failures, 1)
+	return relayerrors.Wrap(url, err)
+}
+
+// publishOnce makes a single publish attempt
+func (p *publisher) publishOnce(url string, evt *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(p.ctx, PublishAttemptTimeout)
+	defer cancel()
+
+	if err := p.faults.PublishFault(ctx, url); err != nil {
+		return err
+	}
+	relay, err := p.penalties.EnsureRelay(p.pool, url)
+	if err != nil {
+		return err
+	}
+	err = relay.Publish(ctx, *evt)
+	if p.authenticate != nil && relayerrors.Prefix(err) == relayerrors.PrefixAuthRequired {
+		if authErr := p.authenticate(ctx, relay); authErr != nil {
+			logging.DebugMethod("publisher", "publishOnce", "failed to authenticate to %s: %v", url, authErr)
+			return err
+		}
+		return relay.Publish(ctx, *evt)
+	}
+	return err
+}
+
+// SetAuthenticator makes publishes refused with auth-required authenticate
+// and retry. It must be called before Start.
+func (p *publisher) SetAuthenticator(fn func(ctx context.Context, relay *nostr.Relay) error) {
+	p.authenticate = fn
+}
+
+// SetFaults makes publish attempts fail as f decides. It must be called
+// before Start.
+func (p *publisher) SetFaults(f *faultInjector) {
+	p.faults = f
+}
+
+// SetLimits caps the rate and concurrency of publish attempts to the relays
+// in limits. It must be called before Start.
+func (p *publisher) SetLimits(limits publishLimits) {
+	p.limits = limits
+}
+
+// SetDryRun makes the publisher route events as usual, with stats and
+// result log, but only log where they would have been sent. It must be
+// called before Start.
+func (p *publisher) SetDryRun(dryRun bool) {
+	p.dryRun = dryRun
+}
+
+// SetEnrichment runs the events published through pipeline. It must be
+// called before Start.
+func (p *publisher) SetEnrichment(pipeline *enrichPipeline) {
+	p.enrichment = pipeline
+}
+
+// SetRegions picks the broadcast relays by the countries they are in. It
+// must be called before Start.
+func (p *publisher) SetRegions(regions *relayRegions) {
+	p.regions = regions
+}
+
+// SetResultLog records the per-relay outcome of every event published in
+// log. It must be called before Start.
+func (p *publisher) SetResultLog(log *broadcastLog) {
+	p.results = log
+}
+
+// retryAfter extracts a retry delay hinted by a rate-limited relay
+func retryAfter(err error) (time.Duration, bool) {
+	if err == nil || relayerrors.Prefix(err) != relayerrors.PrefixRateLimited {
+		return 0, false
+	}
+	m := retryAfterPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	n, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return 0, false
+	}
+	switch m[2] {
+	case "ms":
+		return time.Duration(n) * time.Millisecond, true
+	case "m":
+		return time.Duration(n) * time.Minute, true
+	default:
+		return time.Duration(n) * time.Second, true
+	}
+}
+
+// relayStats returns the counters for a relay, creating them on first use
+func (p *publisher) relayStats(url string) *publishRelayStats {
+	if rs, ok := p.relays.Load(url); ok {
+		return rs.(*publishRelayStats)
+	}
+	rs, _ := p.relays.LoadOrStore(url, &publishRelayStats{})
+	return rs.(*publishRelayStats)
+}
+
+// markSeen records an event ID and reports whether it was new
+func (p *publisher) markSeen(id string) bool {
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	if t, ok := p.seen[id]; ok && time.Since(t) < p.seenTTL {
+		return false
+	}
+	p.seen[id] = time.Now()
+	return true
+}
+
+// isSeen reports whether an event ID was published within the TTL
+func (p *publisher) isSeen(id string) bool {
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	t, ok := p.seen[id]
+	return ok && time.Since(t) < p.seenTTL
+}
+
+// forget removes an event ID so it can be submitted again
+func (p *publisher) forget(id string) {
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	delete(p.seen, id)
+}
+
+// ForgetEvents drops ids from the recently published events, returning how
+// many were there
+func (p *publisher) ForgetEvents(ids []string) int {
+	p.seenMu.Lock()
+	defer p.seenMu.Unlock()
+	n := 0
+	for _, id := range ids {
+		if _, ok := p.seen[id]; ok {
+			delete(p.seen, id)
+			n++
+		}
+	}
+	return n
+}
+
+// cleanupSeen periodically drops expired event IDs
+func (p *publisher) cleanupSeen() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.seenMu.Lock()
+			for id, t := range p.seen {
+				if time.Since(t) >= p.seenTTL {
+					delete(p.seen, id)
+				}
+			}
+			p.seenMu.Unlock()
+		}
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *publisher) GetStatsName() string {
+	return "publisher"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *publisher) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("events", jsonlib.NewJsonValue(atomic.LoadInt64(&p.events)))
+	obj.Set("events_accepted", jsonlib.NewJsonValue(atomic.LoadInt64(&p.eventsAccepted)))
+	obj.Set("events_failed", jsonlib.NewJsonValue(atomic.LoadInt64(&p.eventsFailed)))
+	obj.Set("events_canceled", jsonlib.NewJsonValue(atomic.LoadInt64(&p.eventsCanceled)))
+	obj.Set("duplicates", jsonlib.NewJsonValue(atomic.LoadInt64(&p.duplicates)))
+	obj.Set("dropped", jsonlib.NewJsonValue(atomic.LoadInt64(&p.dropped)))
+	obj.Set("queue_size", jsonlib.NewJsonValue(len(p.queue)))
+	obj.Set("queue_capacity", jsonlib.NewJsonValue(cap(p.queue)))
+	obj.Set("workers", jsonlib.NewJsonValue(p.Workers()))
+	obj.Set("top_n_relays", jsonlib.NewJsonValue(atomic.LoadInt64(&p.topN)))
+	obj.Set("max_attempts", jsonlib.NewJsonValue(p.attempts))
+	obj.Set("paused", jsonlib.NewJsonValue(p.pausedChan() != nil))
+	obj.Set("dry_run", jsonlib.NewJsonValue(p.dryRun))
+	if p.window > 0 {
+		obj.Set("batching", p.lanesStats())
+	}
+	if len(p.limits) > 0 {
+		obj.Set("relay_limits", p.limits.stats())
+	}
+
+	hints := publishRelayStatsJSON(&p.hintStats)
+	hints.Set("max_per_event", jsonlib.NewJsonValue(p.maxHints))
+	hints.Set("hinted_events", jsonlib.NewJsonValue(atomic.LoadInt64(&p.hintedEvents)))
+	hints.Set("hinted_relays", jsonlib.NewJsonValue(atomic.LoadInt64(&p.hintRelays)))
+	hints.Set("invalid_hints", jsonlib.NewJsonValue(atomic.LoadInt64(&p.hintsInvalid)))
+	obj.Set("hints", hints)
+
+	var totalRetries int64
+	relays := jsonlib.NewJsonObject()
+	urls := []string{}
+	p.relays.Range(func(key, value any) bool {
+		urls = append(urls, key.(string))
+		return true
+	})
+	sort.Strings(urls)
+	for _, url := range urls {
+		rs := p.relayStats(url)
+		totalRetries += atomic.LoadInt64(&rs.retries)
+		relays.Set(url, publishRelayStatsJSON(rs))
+	}
+	obj.Set("retries", jsonlib.NewJsonValue(totalRetries))
+	obj.Set("relays", relays)
+	return obj
+}
+
+// publishRelayStatsJSON renders one set of per-relay counters
+func publishRelayStatsJSON(rs *publishRelayStats) *jsonlib.JsonObject {
+	relayObj := jsonlib.NewJsonObject()
+	relayObj.Set("attempts", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.attempts)))
+	relayObj.Set("successes", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.successes)))
+	relayObj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.failures)))
+	relayObj.Set("retries", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.retries)))
+	relayObj.Set("transient_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.transientFailures)))
+	relayObj.Set("permanent_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.permanentFailures)))
+	relayObj.Set("duplicates", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.duplicates)))
+	relayObj.Set("dry_runs", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.dryRuns)))
+	relayObj.Set("canceled", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.canceled)))
+	relayObj.Set("timeouts", jsonlib.NewJsonValue(atomic.LoadInt64(&rs.timeouts)))
+	if lastError, ok := rs.lastError.Load().(string); ok {
+		relayObj.Set("last_error", jsonlib.NewJsonValue(lastError))
+	}
+	return relayObj
+}
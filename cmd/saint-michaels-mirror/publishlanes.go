@@ -0,0 +1,219 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Pipelined per-relay publishing for Espelho de São Miguel.
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Publish lane tuning
+const (
+	// PublishLaneIdle is how long a lane sender waits for an event before
+	// it exits
+	PublishLaneIdle = time.Minute
+	// publishLaneQueuePerSlot is how many events a lane queues per slot of
+	// its window before dispatching blocks
+	publishLaneQueuePerSlot = 4
+)
+
+// publishJob is one event to send to one relay
+type publishJob struct {
+	evt  *nostr.Event
+	hint bool
+	done func(err error)
+}
+
+// publishLane sends the events for one relay. Up to window senders publish
+// concurrently over the relay's single connection, so EVENT frames are
+// pipelined and several wait for their OK at once, instead of one goroutine
+// and timeout per event. Senders live as long as the lane is busy and exit
+// after PublishLaneIdle without events.
+type publishLane struct {
+	p       *publisher
+	url     string
+	window  int
+	capped  *relayPublishLimit // the relay's publish caps, if any
+	queue   chan *publishJob
+	mu      sync.Mutex
+	senders int
+	// stats
+	inFlight    int64
+	maxInFlight int64
+	frames      int64
+	pipelined   int64 // frames sent while others were awaiting their OK
+	depthSum    int64 // frames in flight summed over every send
+	started     int64 // senders started
+}
+
+// lane returns the lane of url, creating it on first use
+func (p *publisher) lane(url string) *publishLane {
+	if l, ok := p.lanes.Load(url); ok {
+		return l.(*publishLane)
+	}
+	l, _ := p.lanes.LoadOrStore(url, &publishLane{
+		p:      p,
+		url:    url,
+		window: p.limits.window(url, p.window),
+		capped: p.limits.limit(url),
+		queue:  make(chan *publishJob, p.window*publishLaneQueuePerSlot),
+	})
+	return l.(*publishLane)
+}
+
+// add queues job, blocking while the lane is full, and starts a sender if
+// the window has room for one. The lane of a capped relay skips the job
+// instead of blocking, so its backlog does not hold up the other relays.
+func (l *publishLane) add(job *publishJob) {
+	if l.capped != nil {
+		select {
+		case l.queue <- job:
+		default:
+			atomic.AddInt64(&l.capped.skipped, 1)
+			l.p.results.Attempt(job.evt.ID, l.url, 0, broadcastFailed, errPublishCapped)
+			job.done(errPublishCapped)
+			return
+		}
+	} else {
+		select {
+		case l.queue <- job:
+		case <-l.p.ctx.Done():
+			job.done(l.p.ctx.Err())
+			return
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.senders < l.window {
+		l.senders++
+		atomic.AddInt64(&l.started, 1)
+		go l.send()
+	}
+}
+
+// send publishes queued events until the lane stays idle
+func (l *publishLane) send() {
+	idle := time.NewTimer(PublishLaneIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case job := <-l.queue:
+			depth := atomic.AddInt64(&l.inFlight, 1)
+			atomic.AddInt64(&l.frames, 1)
+			atomic.AddInt64(&l.depthSum, depth)
+			if depth > 1 {
+				atomic.AddInt64(&l.pipelined, 1)
+			}
+			for {
+				top := atomic.LoadInt64(&l.maxInFlight)
+				if depth <= top || atomic.CompareAndSwapInt64(&l.maxInFlight, top, depth) {
+					break
+				}
+			}
+			err := l.p.publishToRelay(l.url, job.evt, job.hint)
+			atomic.AddInt64(&l.inFlight, -1)
+			job.done(err)
+			idle.Reset(PublishLaneIdle)
+		case <-idle.C:
+			l.mu.Lock()
+			// an event may have been queued after this sender was counted
+			if len(l.queue) > 0 {
+				l.mu.Unlock()
+				idle.Reset(PublishLaneIdle)
+				continue
+			}
+			l.senders--
+			l.mu.Unlock()
+			return
+		case <-l.p.ctx.Done():
+			l.mu.Lock()
+			l.senders--
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// dispatch hands evt to the lane of every relay in urls and returns at once;
+// finished is called when every relay answered. The relays at the end of
+// urls, hinted of them, are hint targets.
+func (p *publisher) dispatch(evt *nostr.Event, urls []string, hinted int, finished func()) {
+	errs := &relayerrors.MultiError{}
+	left := int64(len(urls))
+	for i, url := range urls {
+		p.lane(url).add(&publishJob{evt: evt, hint: i >= len(urls)-hinted, done: func(err error) {
+			errs.Add(url, err)
+			if atomic.AddInt64(&left, -1) == 0 {
+				p.finish(evt, len(urls), errs)
+				finished()
+			}
+		}})
+	}
+}
+
+// lanesStats renders how well sends to each relay were pipelined
+func (p *publisher) lanesStats() jsonlib.JsonEntity {
+	var lanes, senders int
+	var frames, pipelined, depthSum, started, maxInFlight int64
+	p.lanes.Range(func(key, value any) bool {
+		l := value.(*publishLane)
+		lanes++
+		l.mu.Lock()
+		senders += l.senders
+		l.mu.Unlock()
+		frames += atomic.LoadInt64(&l.frames)
+		pipelined += atomic.LoadInt64(&l.pipelined)
+		depthSum += atomic.LoadInt64(&l.depthSum)
+		started += atomic.LoadInt64(&l.started)
+		maxInFlight = max(maxInFlight, atomic.LoadInt64(&l.maxInFlight))
+		return true
+	})
+	obj := jsonlib.NewJsonObject()
+	obj.Set("window", jsonlib.NewJsonValue(p.window))
+	obj.Set("lanes", jsonlib.NewJsonValue(lanes))
+	obj.Set("senders", jsonlib.NewJsonValue(senders))
+	obj.Set("senders_started", jsonlib.NewJsonValue(started))
+	obj.Set("frames", jsonlib.NewJsonValue(frames))
+	obj.Set("pipelined_frames", jsonlib.NewJsonValue(pipelined))
+	obj.Set("pipelined_percent", jsonlib.NewJsonValue(percentOf(pipelined, frames)))
+	obj.Set("max_in_flight", jsonlib.NewJsonValue(maxInFlight))
+	if frames > 0 {
+		obj.Set("avg_in_flight", jsonlib.NewJsonValue(float64(depthSum*10/frames)/10))
+		obj.Set("frames_per_sender", jsonlib.NewJsonValue(float64(frames*10/max(started, 1))/10))
+	}
+
+	// the busiest relays
+	type laneDepth struct {
+		url string
+		max int64
+	}
+	var busiest []laneDepth
+	p.lanes.Range(func(key, value any) bool {
+		l := value.(*publishLane)
+		busiest = append(busiest, laneDepth{l.url, atomic.LoadInt64(&l.maxInFlight)})
+		return true
+	})
+	sort.Slice(busiest, func(i, j int) bool {
+		if busiest[i].max != busiest[j].max {
+			return busiest[i].max > busiest[j].max
+		}
+		return busiest[i].url < busiest[j].url
+	})
+	maxByRelay := jsonlib.NewJsonObject()
+	for _, b := range busiest[:min(len(busiest), 10)] {
+		maxByRelay.Set(b.url, jsonlib.NewJsonValue(b.max))
+	}
+	obj.Set("max_in_flight_by_relay", maxByRelay)
+	return obj
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Per-relay publish rate and concurrency caps for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// errPublishCapped skips an attempt that would wait too long for its relay's
+// cap
+var errPublishCapped = relayerrors.New(relayerrors.PrefixRateLimited, "publish cap of this relay reached, event skipped")
+
+// relayPublishLimit caps the publish attempts to one relay, for upstreams
+// that rate-limit aggressively: attempts are paced to rate per second and
+// at most inFlight run at once. Waiting for a slot happens before an attempt
+// starts, so it counts neither against the attempt timeout nor in the
+// relay's response time. An attempt that would wait more than
+// PublishAttemptTimeout is skipped instead, so a backlog for one strict relay
+// never holds up the others.
+type relayPublishLimit struct {
+	rate     float64 // attempts per second, 0 for no pacing
+	inFlight int     // attempts at once, 0 for no cap
+	sem      chan struct{}
+	mu       sync.Mutex
+	next     time.Time // when the next attempt may start
+	// stats
+	attempts int64
+	paced    int64
+	waited   int64 // nanoseconds
+	skipped  int64
+}
+
+// publishLimits holds the caps of the limited relays, by normalized URL
+type publishLimits map[string]*relayPublishLimit
+
+// newRelayPublishLimit creates a cap of rate attempts per second and
+// inFlight at once; zero leaves either unlimited
+func newRelayPublishLimit(rate float64, inFlight int) *relayPublishLimit {
+	l := &relayPublishLimit{rate: rate, inFlight: inFlight}
+	if inFlight > 0 {
+		l.sem = make(chan struct{}, inFlight)
+	}
+	return l
+}
+
+// limit returns the cap of the relay at url, or nil
+func (p publishLimits) limit(url string) *relayPublishLimit {
+	return p[nostr.NormalizeURL(url)]
+}
+
+// acquire waits until the relay at url may take another attempt and returns
+// the function that ends it
+func (p publishLimits) acquire(ctx context.Context, url string) (func(), error) {
+	l := p.limit(url)
+	if l == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	if l.sem != nil {
+		timeout := time.NewTimer(PublishAttemptTimeout)
+		defer timeout.Stop()
+		select {
+		case l.sem <- struct{}{}:
+		case <-timeout.C:
+			atomic.AddInt64(&l.skipped, 1)
+			return nil, errPublishCapped
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+	if l.rate > 0 {
+		// reserve the next slot of the pace
+		l.mu.Lock()
+		at := time.Now()
+		if l.next.After(at) {
+			at = l.next
+		}
+		if time.Until(at) > PublishAttemptTimeout {
+			l.mu.Unlock()
+			release()
+			atomic.AddInt64(&l.skipped, 1)
+			return nil, errPublishCapped
+		}
+		l.next = at.Add(time.Duration(float64(time.Second) / l.rate))
+		l.mu.Unlock()
+		if wait := time.Until(at); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	atomic.AddInt64(&l.attempts, 1)
+	if waited := time.Since(start); waited > time.Millisecond {
+		atomic.AddInt64(&l.paced, 1)
+		atomic.AddInt64(&l.waited, int64(waited))
+	}
+	return release, nil
+}
+
+// window returns how many events a lane for url may have in flight, capping
+// window at the relay's concurrency
+func (p publishLimits) window(url string, window int) int {
+	if l := p.limit(url); l != nil && l.inFlight > 0 {
+		return min(window, l.inFlight)
+	}
+	return window
+}
+
+// stats renders the caps and how often they made attempts wait
+func (p publishLimits) stats() jsonlib.JsonEntity {
+	urls := make([]string, 0, len(p))
+	for url := range p {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	obj := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		l := p[url]
+		r := jsonlib.NewJsonObject()
+		r.Set("rate_per_second", jsonlib.NewJsonValue(l.rate))
+		r.Set("max_in_flight", jsonlib.NewJsonValue(l.inFlight))
+		r.Set("in_flight", jsonlib.NewJsonValue(len(l.sem)))
+		r.Set("attempts", jsonlib.NewJsonValue(atomic.LoadInt64(&l.attempts)))
+		r.Set("waited_attempts", jsonlib.NewJsonValue(atomic.LoadInt64(&l.paced)))
+		r.Set("waited_ms", jsonlib.NewJsonValue(time.Duration(atomic.LoadInt64(&l.waited)).Milliseconds()))
+		r.Set("skipped", jsonlib.NewJsonValue(atomic.LoadInt64(&l.skipped)))
+		obj.Set(url, r)
+	}
+	return obj
+}
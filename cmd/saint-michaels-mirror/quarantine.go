@@ -0,0 +1,330 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Long-term quarantine and retirement of dead broadcast relays for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QuarantineSweepInterval is how often broadcast relay availability is
+// sampled
+const QuarantineSweepInterval = time.Minute
+
+// relayAvailability is the long-term availability of one broadcast relay
+type relayAvailability struct {
+	// attempt counters of the broadcast manager at the last sweep
+	attempts  int64
+	successes int64
+	// lastSuccess is the last sweep that saw a new success
+	lastSuccess time.Time
+	// downSince is when the relay was first seen failing after its last
+	// success; zero while it is reachable
+	downSince time.Time
+	retired   time.Time
+}
+
+// quarantineRecord is the persisted form of a relayAvailability
+type quarantineRecord struct {
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	DownSince   time.Time `json:"down_since,omitzero"`
+	Retired     time.Time `json:"retired,omitzero"`
+}
+
+// relayQuarantine retires broadcast relays that have been unreachable for
+// days. Unlike the broadcast manager's score, which decays within hours and
+// lets a relay come back on its next good check, it follows availability
+// over the long run: a relay whose attempts, publishes and health checks
+// alike, keep failing is quarantined from its first failure after the last
+// success and retired once that lasts retireAfter. Retired relays are
+// removed from the discovered pool and removed again whenever discovery
+// finds them, until un-retired through the admin API. Mandatory relays are
+// never retired.
+type relayQuarantine struct {
+	system      *broadcast.BroadcastSystem
+	retireAfter time.Duration
+	stateFile   string // empty keeps state in memory only
+	// guard, when set, may defer retirements to limit pool churn
+	guard  *poolGuard
+	mu     sync.Mutex
+	relays map[string]*relayAvailability
+	// stats
+	retirements int64
+	removals    int64
+	unretired   int64
+}
+
+// newRelayQuarantine creates the quarantine for the relays of system,
+// restoring stateFile when it exists
+func newRelayQuarantine(system *broadcast.BroadcastSystem, retireAfter time.Duration, stateFile string) (*relayQuarantine, error) {
+	q := &relayQuarantine{
+		system:      system,
+		retireAfter: retireAfter,
+		stateFile:   stateFile,
+		relays:      map[string]*relayAvailability{},
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetPoolGuard defers retirements the guard does not allow yet
+func (q *relayQuarantine) SetPoolGuard(guard *poolGuard) {
+	q.guard = guard
+}
+
+// load restores the persisted state, if any
+func (q *relayQuarantine) load() error {
+	if q.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state map[string]quarantineRecord
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parsing %s: %w", q.stateFile, err)
+	}
+	for url, rec := range state {
+		// attempt counters restart with the manager, so the first sweep
+		// only records the baseline
+		q.relays[url] = &relayAvailability{attempts: -1, lastSuccess: rec.LastSuccess, downSince: rec.DownSince, retired: rec.Retired}
+	}
+	logging.Info("restored availability of %d broadcast relays from %s", len(q.relays), q.stateFile)
+	return nil
+}
+
+// saveLocked persists the state; q.mu must be held
+func (q *relayQuarantine) saveLocked() {
+	if q.stateFile == "" {
+		return
+	}
+	state := make(map[string]quarantineRecord, len(q.relays))
+	for url, ra := range q.relays {
+		if !ra.downSince.IsZero() || !ra.retired.IsZero() {
+			state[url] = quarantineRecord{LastSuccess: ra.lastSuccess, DownSince: ra.downSince, Retired: ra.retired}
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logging.Error("failed to encode quarantine state: %v", err)
+		return
+	}
+	if err := writeFileAtomic(q.stateFile, data); err != nil {
+		logging.Error("failed to save quarantine state to %s: %v", q.stateFile, err)
+	}
+}
+
+// Start samples relay availability every QuarantineSweepInterval until ctx
+// is done
+func (q *relayQuarantine) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(QuarantineSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.sweep(time.Now())
+			}
+		}
+	}()
+}
+
+// sweep compares the manager's attempt counters with the last sweep,
+// tracking when each relay went down, and retires the relays down for
+// longer than retireAfter
+func (q *relayQuarantine) sweep(now time.Time) {
+	m := q.system.GetManager()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	changed := false
+	tracked := map[string]bool{}
+	for _, url := range m.GetAllRelays() {
+		info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+		if !ok || info.IsMandatory {
+			continue
+		}
+		tracked[url] = true
+		ra := q.relays[url]
+		if ra == nil {
+			ra = &relayAvailability{attempts: -1}
+			q.relays[url] = ra
+		}
+		if !ra.retired.IsZero() {
+			// rediscovered since it was retired
+			m.RemoveRelay(url)
+			atomic.AddInt64(&q.removals, 1)
+			continue
+		}
+
+		baseline := ra.attempts < 0
+		newAttempts := info.TotalAttempts > ra.attempts
+		newSuccesses := info.SuccessfulAttempts > ra.successes
+		ra.attempts, ra.successes = info.TotalAttempts, info.SuccessfulAttempts
+		switch {
+		case baseline && info.TotalAttempts == 0:
+			// not checked yet
+		case (baseline && info.SuccessfulAttempts > 0) || (!baseline && newSuccesses):
+			ra.lastSuccess = now
+			if !ra.downSince.IsZero() {
+				logging.Info("broadcast relay %s is reachable again after %v", url, now.Sub(ra.downSince).Round(time.Minute))
+				ra.downSince = time.Time{}
+				changed = true
+			}
+		case (baseline || newAttempts) && ra.downSince.IsZero():
+			ra.downSince = now
+			changed = true
+			logging.DebugMethod("quarantine", "sweep", "broadcast relay %s quarantined", url)
+		}
+
+		if !ra.downSince.IsZero() && now.Sub(ra.downSince) >= q.retireAfter && (q.guard == nil || q.guard.AllowRemoval()) {
+			ra.retired = now
+			m.RemoveRelay(url)
+			atomic.AddInt64(&q.retirements, 1)
+			changed = true
+			logging.Warn("retired broadcast relay %s, unreachable since %s", url, ra.downSince.Format(time.RFC3339))
+		}
+	}
+	// forget relays dropped from the pool otherwise, e.g. by a profile switch
+	for url, ra := range q.relays {
+		if !tracked[url] && ra.retired.IsZero() {
+			delete(q.relays, url)
+			changed = changed || !ra.downSince.IsZero()
+		}
+	}
+	if changed {
+		q.saveLocked()
+	}
+}
+
+// Unretire puts a retired relay back into the discovered pool, where it is
+// tested again like a newly discovered one
+func (q *relayQuarantine) Unretire(url string) bool {
+	q.mu.Lock()
+	ra, ok := q.relays[url]
+	if !ok {
+		url = nostr.NormalizeURL(url)
+		ra, ok = q.relays[url]
+	}
+	if !ok || ra.retired.IsZero() {
+		q.mu.Unlock()
+		return false
+	}
+	delete(q.relays, url)
+	q.saveLocked()
+	q.mu.Unlock()
+
+	atomic.AddInt64(&q.unretired, 1)
+	q.system.AddRelayIfNew(url)
+	logging.Info("un-retired broadcast relay %s", url)
+	return true
+}
+
+// quarantineRequest is the body of DELETE /api/v1/admin/quarantine
+type quarantineRequest struct {
+	Relay string `json:"relay"`
+}
+
+// HandleQuarantine serves GET (list) and DELETE (un-retire a relay)
+func (q *relayQuarantine) HandleQuarantine(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		var body quarantineRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !q.Unretire(body.Relay) {
+			http.Error(w, "relay not retired", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONEntity(w, req, http.StatusOK, q.list())
+}
+
+// list renders the quarantined and retired relays, longest down first
+func (q *relayQuarantine) list() *jsonlib.JsonObject {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	urls := make([]string, 0, len(q.relays))
+	for url := range q.relays {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		a, b := q.relays[urls[i]], q.relays[urls[j]]
+		if !a.downSince.Equal(b.downSince) {
+			return a.downSince.Before(b.downSince)
+		}
+		return urls[i] < urls[j]
+	})
+
+	quarantined := jsonlib.NewJsonList()
+	retired := jsonlib.NewJsonList()
+	for _, url := range urls {
+		ra := q.relays[url]
+		if ra.downSince.IsZero() {
+			continue
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("url", jsonlib.NewJsonValue(url))
+		obj.Set("down_since", jsonlib.NewJsonValue(ra.downSince.Unix()))
+		if !ra.lastSuccess.IsZero() {
+			obj.Set("last_success", jsonlib.NewJsonValue(ra.lastSuccess.Unix()))
+		}
+		if ra.retired.IsZero() {
+			obj.Set("retire_at", jsonlib.NewJsonValue(ra.downSince.Add(q.retireAfter).Unix()))
+			quarantined.Append(obj)
+		} else {
+			obj.Set("retired_at", jsonlib.NewJsonValue(ra.retired.Unix()))
+			retired.Append(obj)
+		}
+	}
+	result := jsonlib.NewJsonObject()
+	result.Set("retire_after_hours", jsonlib.NewJsonValue(int64(q.retireAfter.Hours())))
+	result.Set("quarantined", quarantined)
+	result.Set("retired", retired)
+	return result
+}
+
+// GetStatsName returns the name of this stats provider
+func (q *relayQuarantine) GetStatsName() string {
+	return "relay_quarantine"
+}
+
+// GetStats returns stats as JsonEntity
+func (q *relayQuarantine) GetStats() jsonlib.JsonEntity {
+	obj := q.list()
+	obj.Set("retirements", jsonlib.NewJsonValue(atomic.LoadInt64(&q.retirements)))
+	obj.Set("rediscovered_removals", jsonlib.NewJsonValue(atomic.LoadInt64(&q.removals)))
+	obj.Set("unretired", jsonlib.NewJsonValue(atomic.LoadInt64(&q.unretired)))
+	return obj
+}
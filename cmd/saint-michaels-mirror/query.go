@@ -0,0 +1,53 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Query pipeline helpers for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// queryFunc matches the signature of khatru's QueryEvents hooks. Optional
+// query features wrap a queryFunc and fall through to the next one for
+// filters they don't handle.
+type queryFunc func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+
+// isExternalQuery reports whether a query comes from a client subscription.
+// It mirrors the relaystore short-circuit rules: khatru internal calls and
+// queries without a subscription id (e.g. kind 5 handling) are not forwarded.
+func isExternalQuery(ctx context.Context) bool {
+	return !khatru.IsInternalCall(ctx) && subscriptionID(ctx) != ""
+}
+
+// subscriptionID is khatru.GetSubscriptionID without its panic on contexts
+// that carry no subscription id
+func subscriptionID(ctx context.Context) string {
+	id, _ := ctx.Value(khatruSubscriptionIDKey).(string)
+	return id
+}
+
+// khatruSubscriptionIDKey is the context key khatru keeps subscription ids
+// under. khatru does not export it, so TestKhatruContextKeys pins it to the
+// khatru version of go.mod: queries without one are treated as internal and
+// never reach upstreams, so a silent change would stop all forwarding.
+const khatruSubscriptionIDKey = 1
+
+// withSubscriptionID marks ctx as a client subscription named id, so queries
+// made on behalf of HTTP clients take the same path as REQs
+func withSubscriptionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, khatruSubscriptionIDKey, id)
+}
+
+// closedEventChannel returns an empty, closed event channel
+func closedEventChannel() chan *nostr.Event {
+	ch := make(chan *nostr.Event)
+	close(ch)
+	return ch
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the query pipeline helpers for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// TestKhatruContextKeys pins khatruSubscriptionIDKey and khatruHTTPAuthKey
+// to the keys khatru reads subscription ids and HTTP signers from
+func TestKhatruContextKeys(t *testing.T) {
+	ctx := withSubscriptionID(context.Background(), "http")
+	if got := khatru.GetSubscriptionID(ctx); got != "http" {
+		t.Fatalf("khatru.GetSubscriptionID = %q, want http", got)
+	}
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if got := khatru.GetAuthed(context.WithValue(context.Background(), khatruHTTPAuthKey, pubkey)); got != pubkey {
+		t.Fatalf("khatru.GetAuthed = %q, want %q", got, pubkey)
+	}
+	if isExternalQuery(context.Background()) {
+		t.Fatal("a context without subscription id is external")
+	}
+	if !isExternalQuery(ctx) {
+		t.Fatal("a context with subscription id is not external")
+	}
+
+	// a REQ served by khatru must reach the hooks as an external query
+	relay := khatru.NewRelay()
+	seen := make(chan string, 1)
+	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if isExternalQuery(ctx) {
+			seen <- subscriptionID(ctx)
+		} else {
+			seen <- ""
+		}
+		return closedEventChannel(), nil
+	})
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	// canceling ctx closes the connection; Relay.Close races with its
+	// writer goroutine in go-nostr
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindTextNote}}}, nostr.WithLabel("pin")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-seen:
+		if !strings.Contains(id, "pin") {
+			t.Fatalf("REQ reached the hooks with subscription id %q", id)
+		}
+	case <-ctx.Done():
+		t.Fatal("REQ never reached the hooks")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Query routing by filter shape for Espelho de São Miguel.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// queryRoute is one rule of the routing table. A filter matches when every
+// kind it asks for is in Kinds, it has every tag of Tags and, with Search
+// set, whether it is a NIP-50 search agrees; unset conditions match
+// anything, but a rule needs at least one. A matching filter is sent to
+// Relays instead of the query remotes, then Exclude is left out.
+type queryRoute struct {
+	Name    string   `json:"name,omitempty"`
+	Kinds   []int    `json:"kinds,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Search  *bool    `json:"search,omitempty"`
+	Relays  []string `json:"relays,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// stats
+	hits int64
+}
+
+// matches tells if filter has the shape of the rule
+func (q *queryRoute) matches(filter nostr.Filter) bool {
+	if len(q.Kinds) > 0 {
+		if len(filter.Kinds) == 0 {
+			return false
+		}
+		for _, kind := range filter.Kinds {
+			if !slices.Contains(q.Kinds, kind) {
+				return false
+			}
+		}
+	}
+	for _, tag := range q.Tags {
+		if len(filter.Tags[tag]) == 0 {
+			return false
+		}
+	}
+	if q.Search != nil && *q.Search != (filter.Search != "") {
+		return false
+	}
+	return true
+}
+
+// queryRoutes is a table of rules restricting which upstreams receive which
+// filter shapes, e.g. DM kinds only to relays that serve them or profile
+// lookups to indexers. It is consulted before every forwarded query; the
+// first matching rule decides and filters matching none go to every query
+// remote. A rule leaving no relay at all is ignored, so a filter is never
+// sent nowhere.
+type queryRoutes struct {
+	routes []*queryRoute
+	// stats
+	unmatched int64
+	empty     int64
+}
+
+// loadQueryRoutes reads the JSON list of rules at path
+func loadQueryRoutes(path string) (*queryRoutes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*queryRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, q := range routes {
+		if q.Name == "" {
+			q.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(q.Kinds) == 0 && len(q.Tags) == 0 && q.Search == nil {
+			return nil, fmt.Errorf("%s: %s matches every filter: set kinds, tags or search", path, q.Name)
+		}
+		if len(q.Relays) == 0 && len(q.Exclude) == 0 {
+			return nil, fmt.Errorf("%s: %s routes nowhere: set relays or exclude", path, q.Name)
+		}
+		for j, url := range q.Relays {
+			q.Relays[j] = nostr.NormalizeURL(url)
+		}
+		for j, url := range q.Exclude {
+			q.Exclude[j] = nostr.NormalizeURL(url)
+		}
+	}
+	if len(routes) == 0 {
+		return nil, errors.New(path + ": no rules")
+	}
+	return &queryRoutes{routes: routes}, nil
+}
+
+// Route returns the relays that should receive filter out of the query
+// remotes in urls
+func (r *queryRoutes) Route(filter nostr.Filter, urls []string) []string {
+	for _, q := range r.routes {
+		if !q.matches(filter) {
+			continue
+		}
+		atomic.AddInt64(&q.hits, 1)
+		routed := urls
+		if len(q.Relays) > 0 {
+			routed = q.Relays
+		}
+		routed = slices.DeleteFunc(slices.Clone(routed), func(url string) bool {
+			return slices.Contains(q.Exclude, nostr.NormalizeURL(url))
+		})
+		if len(routed) == 0 {
+			atomic.AddInt64(&r.empty, 1)
+			return urls
+		}
+		return routed
+	}
+	atomic.AddInt64(&r.unmatched, 1)
+	return urls
+}
+
+// GetStatsName returns the name of this stats provider
+func (r *queryRoutes) GetStatsName() string {
+	return "query_routes"
+}
+
+// GetStats returns stats as JsonEntity
+func (r *queryRoutes) GetStats() jsonlib.JsonEntity {
+	rules := jsonlib.NewJsonList()
+	for _, q := range r.routes {
+		obj := jsonlib.NewJsonObject()
+		obj.Set("name", jsonlib.NewJsonValue(q.Name))
+		obj.Set("hits", jsonlib.NewJsonValue(atomic.LoadInt64(&q.hits)))
+		rules.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("rules", rules)
+	obj.Set("unmatched", jsonlib.NewJsonValue(atomic.LoadInt64(&r.unmatched)))
+	obj.Set("left_no_relay", jsonlib.NewJsonValue(atomic.LoadInt64(&r.empty)))
+	return obj
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Quorum-verified queries for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// quorumExtension is the NIP-50 search extension clients use to request a
+// quorum for a single query, e.g. {"kinds":[1],"search":"quorum:2"}. It is
+// removed from the search string before the filter is sent upstream; a
+// search extension is used rather than a tag because clients drop events
+// that do not match the tags of their filter.
+const quorumExtension = "quorum:"
+
+// quorumQuery answers queries with only the events returned by at least a
+// quorum of distinct upstream relays, so a single upstream cannot inject
+// events into aggregate feeds on its own.
+type quorumQuery struct {
+	relays    []string
+	relaysMu  sync.RWMutex
+	quorum    int // deployment-wide quorum, 0 when only requested per filter
+	deadline  time.Duration
+	pool      *relaypool.Role
+	ownPool   bool // set when the pool is private to the quorum query
+	penalties *penaltyBox
+	// observer, when set, sees every event returned by an upstream
+	observer func(relayURL string, id string)
+	// stats
+	requests         int64
+	filterRequests   int64
+	upstreamFailures int64
+	eventsReturned   int64
+	suppressed       int64
+}
+
+// newQuorumQuery creates a quorum query over relays; quorum <= 1 only enables
+// per-filter quorum requests. Queries are answered with the events that
+// reached quorum by deadline, or by QueryTimeoutDuration when it is 0.
+func newQuorumQuery(relays []string, quorum int, deadline time.Duration, penalties *penaltyBox) *quorumQuery {
+	if quorum <= 1 {
+		quorum = 0
+	}
+	if deadline <= 0 {
+		deadline = relaystore.QueryTimeoutDuration
+	}
+	return &quorumQuery{
+		relays:    relays,
+		quorum:    quorum,
+		deadline:  deadline,
+		penalties: penalties,
+	}
+}
+
+// SetEventObserver registers fn to be told which upstream returned which event
+func (q *quorumQuery) SetEventObserver(fn func(relayURL string, id string)) {
+	q.observer = fn
+}
+
+// SetRelays replaces the relays queried
+func (q *quorumQuery) SetRelays(relays []string) {
+	q.relaysMu.Lock()
+	defer q.relaysMu.Unlock()
+	q.relays = relays
+}
+
+// remotes returns the current relays
+func (q *quorumQuery) remotes() []string {
+	q.relaysMu.RLock()
+	defer q.relaysMu.RUnlock()
+	return q.relays
+}
+
+// SetPool makes quorum queries connect through a pool shared with other
+// components. It must be called before Init; without it Init creates a
+// private pool.
+func (q *quorumQuery) SetPool(pool *relaypool.Role) {
+	q.pool = pool
+}
+
+// Init creates the connection pool used for quorum queries, unless one was set
+func (q *quorumQuery) Init() error {
+	if len(q.relays) == 0 {
+		return fmt.Errorf("no query remotes provided - quorum queries require query relays")
+	}
+	if q.pool == nil {
+		q.pool = relaypool.New(withBandwidthRole(context.Background(), bandwidthRoleQuorum), nostr.WithPenaltyBox()).Role(relaypool.RoleQuorum)
+		q.ownPool = true
+	}
+	logging.DebugMethod("quorum", "Init", "quorum %d over %d query remotes", q.quorum, len(q.relays))
+	return nil
+}
+
+// Close closes the connections of a private pool; a shared pool is closed
+// by its owner
+func (q *quorumQuery) Close() {
+	if q.ownPool {
+		q.pool.Pool().Close()
+	}
+}
+
+// Wrap routes filters that need a quorum to the quorum query and everything
+// else to next. Search filters are ranked per upstream and never need a quorum.
+func (q *quorumQuery) Wrap(next queryFunc) queryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		quorum, requested, err := q.quorumFor(&filter)
+		if err != nil {
+			return nil, err
+		}
+		if requested {
+			atomic.AddInt64(&q.filterRequests, 1)
+		}
+		if quorum <= 1 || filter.Search != "" {
+			return next(ctx, filter)
+		}
+		return q.QueryEvents(ctx, filter, quorum)
+	}
+}
+
+// quorumFor returns the quorum that applies to filter and whether the filter
+// asked for it explicitly, removing the quorum extension from its search.
+// Search results are ranked per upstream and cannot be counted across them,
+// so the extension may not be combined with search terms.
+func (q *quorumQuery) quorumFor(filter *nostr.Filter) (int, bool, error) {
+	if !strings.Contains(filter.Search, quorumExtension) {
+		return q.quorum, false, nil
+	}
+	quorum := 0
+	terms := []string{}
+	for _, term := range strings.Fields(filter.Search) {
+		value, ok := strings.CutPrefix(term, quorumExtension)
+		if !ok {
+			terms = append(terms, term)
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, true, fmt.Errorf("invalid: %sN must be a positive integer", quorumExtension)
+		}
+		quorum = max(quorum, n)
+	}
+	if len(terms) > 0 {
+		return 0, true, fmt.Errorf("invalid: %sN cannot be combined with search terms", quorumExtension)
+	}
+	filter.Search = ""
+	// a client may raise the deployment quorum but not lower it
+	return max(quorum, q.quorum), true, nil
+}
+
+// QueryEvents queries every relay and streams each event once it has been
+// returned by quorum distinct relays.
+func (q *quorumQuery) QueryEvents(ctx context.Context, filter nostr.Filter, quorum int) (chan *nostr.Event, error) {
+	atomic.AddInt64(&q.requests, 1)
+
+	if !isExternalQuery(ctx) {
+		logging.DebugMethod("quorum", "QueryEvents", "internal query short-circuited filter=%+v", filter)
+		return closedEventChannel(), nil
+	}
+
+	relays := q.remotes()
+	logging.DebugMethod("quorum", "QueryEvents", "quorum %d across %d upstreams filter=%+v", quorum, len(relays), filter)
+
+	maxEvents := 100
+	if filter.Limit > 0 {
+		maxEvents = filter.Limit
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, q.deadline)
+		defer cancel()
+
+		var mu sync.Mutex
+		seen := map[string]map[string]struct{}{} // event id -> relays
+		returned := 0
+
+		// accept records that url returned evt and reports whether it just reached quorum
+		accept := func(url string, evt *nostr.Event) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			relays, ok := seen[evt.ID]
+			if !ok {
+				relays = map[string]struct{}{}
+				seen[evt.ID] = relays
+			}
+			relays[url] = struct{}{}
+			if len(relays) != quorum || returned >= maxEvents {
+				return false
+			}
+			returned++
+			return true
+		}
+
+		var wg sync.WaitGroup
+		for _, url := range relays {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				relay, err := q.penalties.EnsureRelay(q.pool, url)
+				if err != nil {
+					atomic.AddInt64(&q.upstreamFailures, 1)
+					logging.DebugMethod("quorum", "QueryEvents", "failed to ensure relay %s: %v", url, err)
+					return
+				}
+				ch, err := relay.QueryEvents(timeoutCtx, filter)
+				if err != nil {
+					atomic.AddInt64(&q.upstreamFailures, 1)
+					logging.DebugMethod("quorum", "QueryEvents", "query on %s failed: %v", url, err)
+					return
+				}
+				for evt := range ch {
+					if q.observer != nil {
+						q.observer(url, evt.ID)
+					}
+					if !accept(url, evt) {
+						continue
+					}
+					select {
+					case out <- evt:
+					case <-timeoutCtx.Done():
+						return
+					}
+				}
+			}(url)
+		}
+		wg.Wait()
+
+		var suppressed int64
+		for _, relays := range seen {
+			if len(relays) < quorum {
+				suppressed++
+			}
+		}
+		atomic.AddInt64(&q.suppressed, suppressed)
+		atomic.AddInt64(&q.eventsReturned, int64(returned))
+		logging.DebugMethod("quorum", "QueryEvents", "returned %d events, suppressed %d below quorum %d", returned, suppressed, quorum)
+	}()
+
+	return out, nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (q *quorumQuery) GetStatsName() string {
+	return "quorum"
+}
+
+// GetStats returns stats as JsonEntity
+func (q *quorumQuery) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("quorum", jsonlib.NewJsonValue(q.quorum))
+	obj.Set("upstreams", jsonlib.NewJsonValue(len(q.remotes())))
+	obj.Set("requests", jsonlib.NewJsonValue(atomic.LoadInt64(&q.requests)))
+	obj.Set("filter_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&q.filterRequests)))
+	obj.Set("upstream_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&q.upstreamFailures)))
+	obj.Set("events_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&q.eventsReturned)))
+	obj.Set("quorum_suppressed", jsonlib.NewJsonValue(atomic.LoadInt64(&q.suppressed)))
+	return obj
+}
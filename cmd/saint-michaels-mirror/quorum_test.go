@@ -0,0 +1,58 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of quorum queries for Espelho de São Miguel.
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQuorumFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment int
+		search     string
+		quorum     int
+		requested  bool
+		invalid    bool
+	}{
+		{"no extension", 2, "", 2, false, false},
+		{"plain search keeps the deployment quorum", 2, "bitcoin", 2, false, false},
+		{"requested", 0, "quorum:3", 3, true, false},
+		{"cannot lower the deployment quorum", 3, "quorum:2", 3, true, false},
+		{"highest of several", 0, "quorum:2 quorum:4", 4, true, false},
+		{"not a number", 0, "quorum:x", 0, true, true},
+		{"not positive", 0, "quorum:0", 0, true, true},
+		{"combined with search terms", 0, "bitcoin quorum:2", 0, true, true},
+		{"combined with other extensions", 0, "quorum:2 include:spam", 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuorumQuery([]string{"wss://a", "wss://b"}, tt.deployment, 0, nil)
+			filter := nostr.Filter{Search: tt.search}
+			quorum, requested, err := q.quorumFor(&filter)
+			if tt.invalid {
+				if err == nil || !strings.HasPrefix(err.Error(), "invalid: ") {
+					t.Fatalf("quorumFor(%q) = %v, want an invalid: error", tt.search, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quorum != tt.quorum || requested != tt.requested {
+				t.Fatalf("quorumFor(%q) = %d, %v; want %d, %v", tt.search, quorum, requested, tt.quorum, tt.requested)
+			}
+			if requested && filter.Search != "" {
+				t.Fatalf("search left as %q", filter.Search)
+			}
+		})
+	}
+}
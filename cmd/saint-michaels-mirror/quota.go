@@ -0,0 +1,318 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Daily write quotas per pubkey for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QuotaSaveInterval is how often changed quota usage is persisted
+const QuotaSaveInterval = time.Minute
+
+// quotaDayLayout formats the UTC day usage is counted for
+const quotaDayLayout = "2006-01-02"
+
+// writeQuota caps what a pubkey may write per day; 0 disables a cap
+type writeQuota struct {
+	events int64
+	bytes  int64
+}
+
+// quotaUsage is what a pubkey wrote on the current day
+type quotaUsage struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// quotaState is the persisted form of the usage
+type quotaState struct {
+	Day   string                 `json:"day"`
+	Usage map[string]*quotaUsage `json:"usage"`
+}
+
+// writeQuotas caps the events and bytes each pubkey may write per UTC day.
+// Writes are charged to the pubkey the connection authenticated as with
+// NIP-42 or NIP-98, or else to the author of the event. They are charged
+// once every other local policy accepted them, whether or not the upstreams
+// do. Usage is persisted in the state file every QuotaSaveInterval and on
+// shutdown, so restarts do not reset it.
+type writeQuotas struct {
+	defaults   writeQuota
+	overrides  map[string]writeQuota // by hex pubkey
+	stateFile  string
+	adminToken string
+	serviceURL *serviceURLResolver
+	mu         sync.Mutex
+	day        string
+	usage      map[string]*quotaUsage // by hex pubkey
+	dirty      bool
+	// stats
+	accepted       int64
+	rejectedEvents int64
+	rejectedBytes  int64
+}
+
+// newWriteQuotas creates the quotas, restoring today's usage from stateFile
+// if there is one
+func newWriteQuotas(defaults writeQuota, overrides map[string]writeQuota, stateFile, adminToken string, serviceURL *serviceURLResolver) (*writeQuotas, error) {
+	q := &writeQuotas{
+		defaults:   defaults,
+		overrides:  overrides,
+		stateFile:  stateFile,
+		adminToken: adminToken,
+		serviceURL: serviceURL,
+		day:        time.Now().UTC().Format(quotaDayLayout),
+		usage:      map[string]*quotaUsage{},
+	}
+	if stateFile == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", stateFile, err)
+	}
+	if state.Day == q.day {
+		for pubkey, u := range state.Usage {
+			if u != nil {
+				q.usage[pubkey] = u
+			}
+		}
+		logging.Info("restored quota usage of %d pubkeys from %s", len(q.usage), stateFile)
+	}
+	return q, nil
+}
+
+// Apply installs the quota check after the other event policies, so only
+// events they accept are charged
+func (q *writeQuotas) Apply(r *khatru.Relay) {
+	r.RejectEvent = append(r.RejectEvent, policyRejects.Event("write_quota", q.RejectEvent))
+	logging.Info("write quotas: %d events and %d bytes per day (0 = unlimited), %d overrides", q.defaults.events, q.defaults.bytes, len(q.overrides))
+}
+
+// Start persists changed usage every QuotaSaveInterval until ctx is done
+func (q *writeQuotas) Start(ctx context.Context) {
+	if q.stateFile == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(QuotaSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.Save()
+			}
+		}
+	}()
+}
+
+// quotaOf returns the quota of pubkey
+func (q *writeQuotas) quotaOf(pubkey string) writeQuota {
+	if quota, ok := q.overrides[pubkey]; ok {
+		return quota
+	}
+	return q.defaults
+}
+
+// rollLocked starts a new day of usage when the UTC day changed; q.mu must
+// be held
+func (q *writeQuotas) rollLocked(now time.Time) {
+	if day := now.UTC().Format(quotaDayLayout); day != q.day {
+		q.day = day
+		clear(q.usage)
+		q.dirty = true
+	}
+}
+
+// RejectEvent charges evt to its pubkey, rejecting it when that would
+// exceed the pubkey's quota
+func (q *writeQuotas) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	pubkey := khatru.GetAuthed(ctx)
+	if pubkey == "" {
+		pubkey = evt.PubKey
+	}
+	quota := q.quotaOf(pubkey)
+	size := int64(len(evt.String()))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(time.Now())
+	u := q.usage[pubkey]
+	if u == nil {
+		u = &quotaUsage{}
+	}
+	if quota.events > 0 && u.Events+1 > quota.events {
+		atomic.AddInt64(&q.rejectedEvents, 1)
+		logging.DebugMethod("quota", "RejectEvent", "event %s: %s reached its quota of %d events", evt.ID, pubkey, quota.events)
+		return true, fmt.Sprintf("rate-limited: daily quota of %d events reached, resets at 00:00 UTC", quota.events)
+	}
+	if quota.bytes > 0 && u.Bytes+size > quota.bytes {
+		atomic.AddInt64(&q.rejectedBytes, 1)
+		logging.DebugMethod("quota", "RejectEvent", "event %s: %s would exceed its quota of %d bytes", evt.ID, pubkey, quota.bytes)
+		return true, fmt.Sprintf("rate-limited: daily quota of %d bytes reached, resets at 00:00 UTC", quota.bytes)
+	}
+	u.Events++
+	u.Bytes += size
+	q.usage[pubkey] = u
+	q.dirty = true
+	atomic.AddInt64(&q.accepted, 1)
+	return false, ""
+}
+
+// Save persists the usage if it changed since the last save
+func (q *writeQuotas) Save() {
+	if q.stateFile == "" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty {
+		return
+	}
+	data, err := json.MarshalIndent(quotaState{Day: q.day, Usage: q.usage}, "", "  ")
+	if err != nil {
+		logging.Error("failed to encode quota usage: %v", err)
+		return
+	}
+	if err := writeFileAtomic(q.stateFile, data); err != nil {
+		logging.Error("failed to save quota usage to %s: %v", q.stateFile, err)
+		return
+	}
+	q.dirty = false
+}
+
+// ForgetPubKey drops the usage of pubkey, returning 1 if it had any
+func (q *writeQuotas) ForgetPubKey(pubkey string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.usage[pubkey]; !ok {
+		return 0
+	}
+	delete(q.usage, pubkey)
+	q.dirty = true
+	return 1
+}
+
+// usageOf renders the usage and quota of pubkey; q.mu must be held
+func (q *writeQuotas) usageOf(pubkey string) jsonlib.JsonEntity {
+	quota := q.quotaOf(pubkey)
+	u := q.usage[pubkey]
+	if u == nil {
+		u = &quotaUsage{}
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkey", jsonlib.NewJsonValue(pubkey))
+	obj.Set("events", jsonlib.NewJsonValue(u.Events))
+	obj.Set("events_limit", jsonlib.NewJsonValue(quota.events))
+	obj.Set("bytes", jsonlib.NewJsonValue(u.Bytes))
+	obj.Set("bytes_limit", jsonlib.NewJsonValue(quota.bytes))
+	_, override := q.overrides[pubkey]
+	obj.Set("override", jsonlib.NewJsonValue(override))
+	return obj
+}
+
+// HandleQuota serves GET of the quota usage: NIP-98 authenticated callers
+// get their own, the admin token that of ?pubkey= or of every pubkey that
+// wrote today
+func (q *writeQuotas) HandleQuota(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var pubkey string
+	admin := hasAdminToken(req, q.adminToken)
+	if admin {
+		if p := req.URL.Query().Get("pubkey"); p != "" {
+			var err error
+			if pubkey, err = parsePubKey(p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	} else {
+		var err error
+		if pubkey, err = verifyHTTPAuth(req, q.serviceURL, nil); err != nil {
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.rollLocked(now)
+	day, _ := time.Parse(quotaDayLayout, q.day)
+	obj := jsonlib.NewJsonObject()
+	obj.Set("day", jsonlib.NewJsonValue(q.day))
+	obj.Set("resets_at", jsonlib.NewJsonValue(day.AddDate(0, 0, 1).Unix()))
+	if pubkey != "" {
+		obj.Set("usage", q.usageOf(pubkey))
+		writeJSONEntity(w, req, http.StatusOK, obj)
+		return
+	}
+	pubkeys := make([]string, 0, len(q.usage))
+	for pk := range q.usage {
+		pubkeys = append(pubkeys, pk)
+	}
+	sort.Slice(pubkeys, func(i, j int) bool {
+		if bi, bj := q.usage[pubkeys[i]].Bytes, q.usage[pubkeys[j]].Bytes; bi != bj {
+			return bi > bj
+		}
+		return pubkeys[i] < pubkeys[j]
+	})
+	list := jsonlib.NewJsonList()
+	for _, pk := range pubkeys {
+		list.Append(q.usageOf(pk))
+	}
+	obj.Set("pubkeys", list)
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (q *writeQuotas) GetStatsName() string {
+	return "write_quotas"
+}
+
+// GetStats returns stats as JsonEntity
+func (q *writeQuotas) GetStats() jsonlib.JsonEntity {
+	q.mu.Lock()
+	day, pubkeys := q.day, len(q.usage)
+	q.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("day", jsonlib.NewJsonValue(day))
+	obj.Set("daily_events", jsonlib.NewJsonValue(q.defaults.events))
+	obj.Set("daily_bytes", jsonlib.NewJsonValue(q.defaults.bytes))
+	obj.Set("overrides", jsonlib.NewJsonValue(len(q.overrides)))
+	obj.Set("pubkeys_today", jsonlib.NewJsonValue(pubkeys))
+	obj.Set("accepted", jsonlib.NewJsonValue(atomic.LoadInt64(&q.accepted)))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&q.rejectedEvents)))
+	obj.Set("rejected_bytes", jsonlib.NewJsonValue(atomic.LoadInt64(&q.rejectedBytes)))
+	return obj
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Members-only (auth-required) reads for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// readAccess turns the mirror into a private relay: REQ and COUNT from
+// connections that have not completed NIP-42 AUTH are rejected with
+// auth-required, and only member pubkeys may read. Without members any
+// authenticated pubkey may read.
+type readAccess struct {
+	members map[string]bool
+	// stats
+	allowed           int64
+	rejectedAnonymous int64
+	rejectedNonMember int64
+}
+
+// newReadAccess creates the gate for the given hex or npub member pubkeys
+func newReadAccess(memberPubKeys []string) (*readAccess, error) {
+	members := map[string]bool{}
+	for _, pk := range memberPubKeys {
+		pubkey, err := parsePubKey(pk)
+		if err != nil {
+			return nil, fmt.Errorf("member pubkeys: %w", err)
+		}
+		members[pubkey] = true
+	}
+	return &readAccess{members: members}, nil
+}
+
+// Apply advertises auth_required in NIP-11 and installs the reject policies
+// ahead of every other filter hook, so anonymous filters do not use up rate
+// limits
+func (a *readAccess) Apply(r *khatru.Relay) {
+	if r.Info.Limitation == nil {
+		r.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	r.Info.Limitation.AuthRequired = true
+	r.RejectFilter = slices.Insert(r.RejectFilter, 0, policyRejects.Filter("read_access", a.RejectFilter))
+	r.RejectCountFilter = slices.Insert(r.RejectCountFilter, 0, policyRejects.CountFilter("read_access", a.RejectFilter))
+	logging.Info("reads restricted to %d member pubkeys (0 = any authenticated pubkey)", len(a.members))
+}
+
+// RejectFilter asks anonymous connections to authenticate and rejects
+// filters from pubkeys that are not members
+func (a *readAccess) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	pubkey := khatru.GetAuthed(ctx)
+	if pubkey == "" {
+		atomic.AddInt64(&a.rejectedAnonymous, 1)
+		if khatru.GetConnection(ctx) != nil {
+			khatru.RequestAuth(ctx)
+		}
+		return true, "auth-required: this relay only serves its members"
+	}
+	if len(a.members) > 0 && !a.members[pubkey] {
+		atomic.AddInt64(&a.rejectedNonMember, 1)
+		logging.DebugMethod("readaccess", "RejectFilter", "rejected filter from non-member %s", pubkey)
+		return true, "restricted: this relay only serves its members"
+	}
+	atomic.AddInt64(&a.allowed, 1)
+	return false, ""
+}
+
+// GetStatsName returns the name of this stats provider
+func (a *readAccess) GetStatsName() string {
+	return "read_access"
+}
+
+// GetStats returns stats as JsonEntity
+func (a *readAccess) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("members", jsonlib.NewJsonValue(len(a.members)))
+	obj.Set("allowed", jsonlib.NewJsonValue(atomic.LoadInt64(&a.allowed)))
+	obj.Set("rejected_anonymous", jsonlib.NewJsonValue(atomic.LoadInt64(&a.rejectedAnonymous)))
+	obj.Set("rejected_non_member", jsonlib.NewJsonValue(atomic.LoadInt64(&a.rejectedNonMember)))
+	return obj
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Country-aware relay preferences for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Region tuning
+const (
+	// RegionRefreshInterval is how often relays without a recent NIP-11
+	// document are probed for their relay_countries
+	RegionRefreshInterval = 10 * time.Minute
+	// RegionInfoTTL is how long the countries of a relay are trusted
+	RegionInfoTTL = 6 * time.Hour
+	// regionProbeConcurrency is how many NIP-11 documents are fetched at once
+	regionProbeConcurrency = 8
+)
+
+// relayCountries is what a relay's NIP-11 says about its jurisdictions
+type relayCountries struct {
+	countries []string // upper-case ISO 3166 codes
+	fetched   time.Time
+	failed    bool
+}
+
+// relayRegions steers relay selection by the relay_countries of upstream
+// NIP-11 documents. Broadcast targets are picked from the relays in the
+// preferred countries first, and only from relays in the required ones when
+// any are set; mandatory relays are always kept. Query remotes outside the
+// configured countries are moved to the end of the fanout, so with hedging
+// they are only asked when the others are slow. Relays whose countries are
+// unknown count as outside.
+type relayRegions struct {
+	preferred map[string]bool
+	required  map[string]bool
+	remotes   []string                   // query remotes, always probed
+	system    *broadcast.BroadcastSystem // nil without broadcasting
+	mu        sync.RWMutex
+	relays    map[string]*relayCountries // by normalized URL
+	// stats
+	probes          int64
+	probeFailures   int64
+	lastTargets     int64
+	lastInRegion    int64
+	lastRefreshUnix int64
+}
+
+// newRelayRegions creates the preferences for the given country codes,
+// probing remotes in addition to the broadcast pool
+func newRelayRegions(preferred, required, remotes []string) *relayRegions {
+	set := func(codes []string) map[string]bool {
+		m := map[string]bool{}
+		for _, code := range codes {
+			if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+				m[code] = true
+			}
+		}
+		return m
+	}
+	return &relayRegions{
+		preferred: set(preferred),
+		required:  set(required),
+		remotes:   remotes,
+		relays:    map[string]*relayCountries{},
+	}
+}
+
+// SetBroadcastSystem makes the regions steer the broadcast targets of system
+func (r *relayRegions) SetBroadcastSystem(system *broadcast.BroadcastSystem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.system = system
+}
+
+// Start probes the countries of relays now and then every
+// RegionRefreshInterval until ctx is done
+func (r *relayRegions) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(RegionRefreshInterval)
+		defer ticker.Stop()
+		for {
+			r.refresh(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refresh fetches the NIP-11 documents of the relays whose countries are
+// unknown or stale
+func (r *relayRegions) refresh(ctx context.Context) {
+	urls := append([]string{}, r.remotes...)
+	r.mu.RLock()
+	system := r.system
+	r.mu.RUnlock()
+	if system != nil {
+		urls = append(urls, system.GetManager().GetAllRelays()...)
+	}
+
+	now := time.Now()
+	stale := map[string]bool{}
+	r.mu.RLock()
+	for _, url := range urls {
+		url = nostr.NormalizeURL(url)
+		if rc, ok := r.relays[url]; !ok || now.Sub(rc.fetched) >= RegionInfoTTL {
+			stale[url] = true
+		}
+	}
+	r.mu.RUnlock()
+
+	sem := make(chan struct{}, regionProbeConcurrency)
+	var wg sync.WaitGroup
+	for url := range stale {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			atomic.AddInt64(&r.probes, 1)
+			rc := &relayCountries{fetched: time.Now()}
+			info, err := fetchRelayInfo(ctx, url)
+			if err != nil {
+				atomic.AddInt64(&r.probeFailures, 1)
+				rc.failed = true
+			}
+			for _, code := range info.RelayCountries {
+				if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+					rc.countries = append(rc.countries, code)
+				}
+			}
+			r.mu.Lock()
+			r.relays[url] = rc
+			r.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt64(&r.lastRefreshUnix, time.Now().Unix())
+	if len(stale) > 0 {
+		logging.DebugMethod("regions", "refresh", "probed the countries of %d relays", len(stale))
+	}
+}
+
+// in reports whether url lists one of codes among its countries; the
+// global "*" matches no particular country
+func (r *relayRegions) in(url string, codes map[string]bool) bool {
+	rc, ok := r.relays[nostr.NormalizeURL(url)]
+	if !ok {
+		return false
+	}
+	for _, code := range rc.countries {
+		if codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// inRegion reports whether url is in a preferred or required country
+func (r *relayRegions) inRegion(url string) bool {
+	return r.in(url, r.preferred) || r.in(url, r.required)
+}
+
+// BroadcastRelays returns up to n broadcast targets of m, chosen from the
+// required countries, if any, preferred countries first and by score after
+// that
+func (r *relayRegions) BroadcastRelays(m *manager.Manager, n int) []string {
+	type candidate struct {
+		url       string
+		preferred bool
+		score     float64
+	}
+	var candidates []candidate
+	r.mu.RLock()
+	for _, url := range m.GetAllRelays() {
+		info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+		if !ok || info.IsMandatory || info.TotalAttempts == 0 {
+			continue
+		}
+		if len(r.required) > 0 && !r.in(url, r.required) {
+			continue
+		}
+		candidates = append(candidates, candidate{url: url, preferred: r.in(url, r.preferred), score: m.CalculateScore(info)})
+	}
+	r.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].preferred != candidates[j].preferred {
+			return candidates[i].preferred
+		}
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].url < candidates[j].url
+	})
+
+	urls := make([]string, 0, min(n, len(candidates)))
+	inRegion := 0
+	for _, c := range candidates {
+		if len(urls) >= n {
+			break
+		}
+		urls = append(urls, c.url)
+		if c.preferred || len(r.required) > 0 {
+			inRegion++
+		}
+	}
+	atomic.StoreInt64(&r.lastTargets, int64(len(urls)))
+	atomic.StoreInt64(&r.lastInRegion, int64(inRegion))
+	return urls
+}
+
+// Order moves the query remotes outside the configured countries behind
+// the others, keeping the order within each group
+func (r *relayRegions) Order(urls []string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ordered := make([]string, 0, len(urls))
+	var outside []string
+	for _, url := range urls {
+		if r.inRegion(url) {
+			ordered = append(ordered, url)
+		} else {
+			outside = append(outside, url)
+		}
+	}
+	return append(ordered, outside...)
+}
+
+// GetStatsName returns the name of this stats provider
+func (r *relayRegions) GetStatsName() string {
+	return "relay_regions"
+}
+
+// GetStats returns stats as JsonEntity
+func (r *relayRegions) GetStats() jsonlib.JsonEntity {
+	codes := func(set map[string]bool) *jsonlib.JsonList {
+		sorted := make([]string, 0, len(set))
+		for code := range set {
+			sorted = append(sorted, code)
+		}
+		sort.Strings(sorted)
+		list := jsonlib.NewJsonList()
+		for _, code := range sorted {
+			list.Append(jsonlib.NewJsonValue(code))
+		}
+		return list
+	}
+
+	r.mu.RLock()
+	known, unknown := 0, 0
+	byCountry := map[string]int{}
+	for _, rc := range r.relays {
+		if rc.failed || len(rc.countries) == 0 {
+			unknown++
+			continue
+		}
+		known++
+		for _, code := range rc.countries {
+			byCountry[code]++
+		}
+	}
+	r.mu.RUnlock()
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("preferred", codes(r.preferred))
+	obj.Set("required", codes(r.required))
+	obj.Set("relays_with_countries", jsonlib.NewJsonValue(known))
+	obj.Set("relays_without_countries", jsonlib.NewJsonValue(unknown))
+	countries := jsonlib.NewJsonObject()
+	for code, n := range byCountry {
+		countries.Set(code, jsonlib.NewJsonValue(n))
+	}
+	obj.Set("relays_by_country", countries)
+	obj.Set("broadcast_targets", jsonlib.NewJsonValue(atomic.LoadInt64(&r.lastTargets)))
+	obj.Set("broadcast_targets_in_region", jsonlib.NewJsonValue(atomic.LoadInt64(&r.lastInRegion)))
+	obj.Set("probes", jsonlib.NewJsonValue(atomic.LoadInt64(&r.probes)))
+	obj.Set("probe_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&r.probeFailures)))
+	if last := atomic.LoadInt64(&r.lastRefreshUnix); last > 0 {
+		obj.Set("last_refresh", jsonlib.NewJsonValue(last))
+	}
+	return obj
+}
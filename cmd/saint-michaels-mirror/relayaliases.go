@@ -0,0 +1,236 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Collapsing of broadcast relay aliases for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Relay alias tuning
+const (
+	// AliasRetryAfter is how long the NIP-11 identity of a relay is reused
+	// before it is fetched again
+	AliasRetryAfter = 24 * time.Hour
+	// aliasConcurrency is how many NIP-11 documents are fetched at once
+	aliasConcurrency = 16
+)
+
+// claimedIdentity is who a relay's NIP-11 document says it is
+type claimedIdentity struct {
+	key string // empty when the document does not identify the relay
+	at  time.Time
+}
+
+// relayAliases finds broadcast relays reachable at several URLs, such as
+// ws:// and wss:// of the same host or a relay behind two domains, and keeps
+// one of them in the pool. Each would otherwise get every event published
+// twice and split the health score of one relay. Two URLs are the same relay
+// when their NIP-11 documents list the same operator pubkey under the same
+// name, or, without a pubkey, carry the same name, description, contact,
+// software, version and icon. Documents without a pubkey that leave the
+// name, description or contact empty are too generic to tell relays apart
+// and are ignored. Seeds and mandatory relays are never dropped, and a relay
+// already in the pool wins over a newly discovered URL claiming to be it.
+type relayAliases struct {
+	timeout    time.Duration
+	mu         sync.Mutex
+	identities map[string]*claimedIdentity // by url
+	groups     [][]string                  // aliases found by the last run, kept URL first
+	// stats
+	fetched   int64
+	failed    int64
+	collapsed int64
+}
+
+// newRelayAliases creates the alias check giving each relay timeout to
+// serve its NIP-11 document
+func newRelayAliases(timeout time.Duration) *relayAliases {
+	return &relayAliases{timeout: timeout, identities: map[string]*claimedIdentity{}}
+}
+
+// identityKey returns the identity info claims, or "" if it is too generic
+func identityKey(info *nip11.RelayInformationDocument) string {
+	var parts []string
+	switch {
+	case info.PubKey != "":
+		parts = []string{"pubkey", info.PubKey, info.Name}
+	case info.Name != "" && info.Description != "" && info.Contact != "":
+		parts = []string{"document", info.Name, info.Description, info.Contact, info.Software, info.Version, info.Icon}
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// identify fetches the identities of urls not known recently
+func (a *relayAliases) identify(ctx context.Context, urls []string) {
+	var missing []string
+	a.mu.Lock()
+	for _, url := range urls {
+		if id, ok := a.identities[url]; !ok || time.Since(id.at) >= AliasRetryAfter {
+			missing = append(missing, url)
+		}
+	}
+	a.mu.Unlock()
+
+	sem := make(chan struct{}, aliasConcurrency)
+	var wg sync.WaitGroup
+	for _, url := range missing {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fetchCtx, cancel := context.WithTimeout(ctx, a.timeout)
+			defer cancel()
+			id := &claimedIdentity{at: time.Now()}
+			info, err := nip11.Fetch(fetchCtx, url)
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if err != nil {
+				a.failed++
+				logging.DebugMethod("aliases", "identify", "no NIP-11 document from %s: %v", url, err)
+			} else {
+				a.fetched++
+				id.key = identityKey(&info)
+			}
+			a.identities[url] = id
+		}()
+	}
+	wg.Wait()
+
+	// forget relays no longer asked about
+	keep := map[string]bool{}
+	for _, url := range urls {
+		keep[url] = true
+	}
+	a.mu.Lock()
+	for url := range a.identities {
+		if !keep[url] {
+			delete(a.identities, url)
+		}
+	}
+	a.mu.Unlock()
+}
+
+// Collapse removes from m every relay that is an alias of another one,
+// except protected ones, and returns the URLs it removed. Relays in
+// established are preferred over new ones when choosing which URL stays.
+func (a *relayAliases) Collapse(ctx context.Context, m *manager.Manager, protected func(url string) bool, established map[string]*manager.RelayInfo) []string {
+	urls := m.GetAllRelays()
+	a.identify(ctx, urls)
+
+	a.mu.Lock()
+	byIdentity := map[string][]string{}
+	for _, url := range urls {
+		if id, ok := a.identities[url]; ok && id.key != "" {
+			byIdentity[id.key] = append(byIdentity[id.key], url)
+		}
+	}
+	a.mu.Unlock()
+
+	rank := func(url string) (int, float64) {
+		r := 0
+		if protected(url) {
+			r += 4
+		}
+		if _, ok := established[url]; ok {
+			r += 2
+		}
+		if strings.HasPrefix(url, "wss://") {
+			r++
+		}
+		var success float64
+		if info, ok := m.GetRelayInfo(url).(*manager.RelayInfo); ok {
+			success = info.SuccessRate
+		}
+		return r, success
+	}
+	var groups [][]string
+	var removed []string
+	for _, group := range byIdentity {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool {
+			ri, si := rank(group[i])
+			rj, sj := rank(group[j])
+			if ri != rj {
+				return ri > rj
+			}
+			if si != sj {
+				return si > sj
+			}
+			return group[i] < group[j]
+		})
+		groups = append(groups, group)
+		for _, url := range group[1:] {
+			if protected(url) {
+				continue
+			}
+			m.RemoveRelay(url)
+			removed = append(removed, url)
+			logging.Info("dropping broadcast relay %s: alias of %s", url, group[0])
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+	a.mu.Lock()
+	a.groups = groups
+	a.collapsed += int64(len(removed))
+	a.mu.Unlock()
+	return removed
+}
+
+// GetStatsName returns the name of this stats provider
+func (a *relayAliases) GetStatsName() string {
+	return "relay_aliases"
+}
+
+// GetStats returns stats as JsonEntity
+func (a *relayAliases) GetStats() jsonlib.JsonEntity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	identified := 0
+	for _, id := range a.identities {
+		if id.key != "" {
+			identified++
+		}
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("known", jsonlib.NewJsonValue(len(a.identities)))
+	obj.Set("identified", jsonlib.NewJsonValue(identified))
+	obj.Set("fetched", jsonlib.NewJsonValue(a.fetched))
+	obj.Set("fetch_failures", jsonlib.NewJsonValue(a.failed))
+	obj.Set("collapsed", jsonlib.NewJsonValue(a.collapsed))
+	groups := jsonlib.NewJsonList()
+	for _, group := range a.groups {
+		aliases := jsonlib.NewJsonList()
+		for _, url := range group[1:] {
+			aliases.Append(jsonlib.NewJsonValue(url))
+		}
+		g := jsonlib.NewJsonObject()
+		g.Set("url", jsonlib.NewJsonValue(group[0]))
+		g.Set("aliases", aliases)
+		groups.Append(g)
+	}
+	obj.Set("groups", groups)
+	return obj
+}
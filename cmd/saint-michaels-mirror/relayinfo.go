@@ -0,0 +1,152 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream NIP-11 probing helpers for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/logging"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// RelayInfoProbeTimeout bounds a single NIP-11 probe against an upstream relay
+const RelayInfoProbeTimeout = 4 * time.Second
+
+// fetchRelayInfo fetches the NIP-11 document of an upstream relay
+func fetchRelayInfo(ctx context.Context, url string) (nip11.RelayInformationDocument, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, RelayInfoProbeTimeout)
+	defer cancel()
+	return nip11.Fetch(probeCtx, url)
+}
+
+// relayInfoEntry is a cached NIP-11 probe; done is closed once it finished
+type relayInfoEntry struct {
+	done    chan struct{}
+	info    nip11.RelayInformationDocument
+	err     error
+	fetched time.Time
+}
+
+// relayInfoCache shares NIP-11 probes between the startup selections of
+// count and search upstreams and profile switches, so each upstream is
+// probed once instead of once per feature. Concurrent lookups of the same
+// relay wait for a single probe; failed probes are not cached.
+type relayInfoCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*relayInfoEntry
+}
+
+// relayInfoProbes is the NIP-11 cache used by filterRelaysByNIP
+var relayInfoProbes = &relayInfoCache{ttl: RelayInfoCacheTTL, entries: map[string]*relayInfoEntry{}}
+
+// Get returns the NIP-11 document of url, probing it when not cached or expired
+func (c *relayInfoCache) Get(ctx context.Context, url string) (nip11.RelayInformationDocument, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[url]
+	if ok {
+		select {
+		case <-entry.done:
+			if time.Since(entry.fetched) > c.ttl {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		entry = &relayInfoEntry{done: make(chan struct{})}
+		c.entries[url] = entry
+		c.mu.Unlock()
+		entry.info, entry.err = fetchRelayInfo(ctx, url)
+		entry.fetched = time.Now()
+		close(entry.done)
+		if entry.err != nil {
+			// failed probes are shared with the lookups waiting on them,
+			// but not cached
+			c.mu.Lock()
+			if c.entries[url] == entry {
+				delete(c.entries, url)
+			}
+			c.mu.Unlock()
+		}
+		return entry.info, entry.err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.done:
+		return entry.info, entry.err
+	case <-ctx.Done():
+		return nip11.RelayInformationDocument{}, ctx.Err()
+	}
+}
+
+// nipNumber returns the number of a supported_nips entry. JSON numbers
+// decode to float64, so all numeric types are accepted.
+func nipNumber(v any) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// infoSupportsNIP reports whether a NIP-11 document advertises the given NIP
+func infoSupportsNIP(info nip11.RelayInformationDocument, nip int) bool {
+	for _, v := range info.SupportedNIPs {
+		if n, ok := nipNumber(v); ok && n == nip {
+			return true
+		}
+	}
+	return false
+}
+
+// filterRelaysByNIP probes each relay's NIP-11 in parallel, through the shared
+// cache, and returns the subset that advertises the given NIP, in the order
+// of urls. Relays whose probe fails are skipped.
+func filterRelaysByNIP(ctx context.Context, urls []string, nip int) []string {
+	matches := make([]bool, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := relayInfoProbes.Get(ctx, u)
+			if err != nil {
+				logging.DebugMethod("relayinfo", "filterRelaysByNIP", "failed probing NIP-11 for %s: %v", u, err)
+				return
+			}
+			if infoSupportsNIP(info, nip) {
+				logging.DebugMethod("relayinfo", "filterRelaysByNIP", "relay %s advertises NIP-%02d", u, nip)
+				matches[i] = true
+			} else {
+				logging.DebugMethod("relayinfo", "filterRelaysByNIP", "relay %s does not advertise NIP-%02d", u, nip)
+			}
+		}()
+	}
+	wg.Wait()
+
+	supported := []string{}
+	for i, u := range urls {
+		if matches[i] {
+			supported = append(supported, strings.TrimSpace(u))
+		}
+	}
+	return supported
+}
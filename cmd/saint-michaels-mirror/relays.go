@@ -0,0 +1,283 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream relay browser for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// RelayInfoCacheTTL is how long fetched NIP-11 documents are reused
+const RelayInfoCacheTTL = time.Hour
+
+// relayRoles lists the roles in the order they are reported
+var relayRoles = []string{"query", "mirror", "seed", "mandatory", "broadcast", "discovered"}
+
+// cachedRelayInfo is a NIP-11 document, or the error fetching it
+type cachedRelayInfo struct {
+	info    nip11.RelayInformationDocument
+	err     error
+	fetched time.Time
+}
+
+// relayBrowser describes every configured and discovered upstream relay:
+// its NIP-11 identity, the roles it plays and how well it is doing.
+type relayBrowser struct {
+	profiles  *profileController
+	system    *broadcast.BroadcastSystem // nil without broadcasting
+	latency   *latencyRanker
+	penalties *penaltyBox
+
+	mu    sync.Mutex
+	infos map[string]cachedRelayInfo // by normalized URL
+	// stats
+	requests   int64
+	infoProbes int64
+}
+
+// newRelayBrowser creates a browser; system may be nil
+func newRelayBrowser(profiles *profileController, system *broadcast.BroadcastSystem, latency *latencyRanker, penalties *penaltyBox) *relayBrowser {
+	return &relayBrowser{
+		profiles:  profiles,
+		system:    system,
+		latency:   latency,
+		penalties: penalties,
+		infos:     map[string]cachedRelayInfo{},
+	}
+}
+
+// roles maps every known upstream to the roles it plays
+func (b *relayBrowser) roles() map[string][]string {
+	roles := map[string][]string{}
+	add := func(role string, urls ...string) {
+		for _, url := range urls {
+			url = nostr.NormalizeURL(url)
+			if url != "" && !slices.Contains(roles[url], role) {
+				roles[url] = append(roles[url], role)
+			}
+		}
+	}
+	current := b.profiles.Current()
+	add("query", current.Query...)
+	add("mirror", current.Mirror...)
+	add("seed", current.BroadcastSeeds...)
+	add("mandatory", current.BroadcastMandatory...)
+	if b.system != nil {
+		m := b.system.GetManager()
+		for _, info := range m.GetMandatoryRelays() {
+			add("mandatory", info.URL)
+		}
+		add("broadcast", m.GetBroadcastRelays()...)
+		for _, url := range m.GetAllRelays() {
+			if _, ok := roles[nostr.NormalizeURL(url)]; !ok {
+				add("discovered", url)
+			}
+		}
+	}
+	for url, rs := range roles {
+		sort.Slice(rs, func(i, j int) bool {
+			return slices.Index(relayRoles, rs[i]) < slices.Index(relayRoles, rs[j])
+		})
+		roles[url] = rs
+	}
+	return roles
+}
+
+// relayInfos returns the NIP-11 documents of urls, fetching the missing or
+// stale ones concurrently
+func (b *relayBrowser) relayInfos(ctx context.Context, urls []string) map[string]cachedRelayInfo {
+	now := time.Now()
+	result := make(map[string]cachedRelayInfo, len(urls))
+	missing := []string{}
+	b.mu.Lock()
+	for _, url := range urls {
+		if cached, ok := b.infos[url]; ok && now.Sub(cached.fetched) < RelayInfoCacheTTL {
+			result[url] = cached
+		} else {
+			missing = append(missing, url)
+		}
+	}
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	for _, url := range missing {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			atomic.AddInt64(&b.infoProbes, 1)
+			info, err := fetchRelayInfo(ctx, url)
+			cached := cachedRelayInfo{info: info, err: err, fetched: time.Now()}
+			b.mu.Lock()
+			b.infos[url] = cached
+			b.mu.Unlock()
+			resultMu.Lock()
+			result[url] = cached
+			resultMu.Unlock()
+		}(url)
+	}
+	wg.Wait()
+	return result
+}
+
+// penalty returns how long url stays in the penalty box
+func (b *relayBrowser) penalty(url string) time.Duration {
+	if b.penalties == nil {
+		return 0
+	}
+	return b.penalties.Remaining(url)
+}
+
+// broadcastInfo returns the broadcast manager's view of url, if any
+func (b *relayBrowser) broadcastInfo(url string) *manager.RelayInfo {
+	if b.system == nil {
+		return nil
+	}
+	info, _ := b.system.GetManager().GetRelayInfo(url).(*manager.RelayInfo)
+	return info
+}
+
+// relayHealth grades an upstream: RED while penalized, YELLOW when most of
+// its queries or broadcasts fail, GREEN otherwise
+func relayHealth(penalty time.Duration, latency relayLatency, broadcastInfo *manager.RelayInfo) string {
+	if penalty > 0 {
+		return "RED"
+	}
+	if latency.samples > 0 && latency.failures*2 > latency.samples {
+		return HealthYellow
+	}
+	if broadcastInfo != nil && broadcastInfo.TotalAttempts > 0 && broadcastInfo.SuccessRate < 0.5 {
+		return HealthYellow
+	}
+	return HealthGreen
+}
+
+// describe renders one upstream
+func (b *relayBrowser) describe(url string, roles []string, cached cachedRelayInfo) *jsonlib.JsonObject {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("url", jsonlib.NewJsonValue(url))
+
+	roleList := jsonlib.NewJsonList()
+	for _, role := range roles {
+		roleList.Append(jsonlib.NewJsonValue(role))
+	}
+	obj.Set("roles", roleList)
+
+	info := jsonlib.NewJsonObject()
+	if cached.err != nil {
+		info.Set("error", jsonlib.NewJsonValue(cached.err.Error()))
+	} else {
+		info.Set("name", jsonlib.NewJsonValue(cached.info.Name))
+		info.Set("description", jsonlib.NewJsonValue(cached.info.Description))
+		info.Set("icon", jsonlib.NewJsonValue(cached.info.Icon))
+		info.Set("software", jsonlib.NewJsonValue(cached.info.Software))
+		info.Set("version", jsonlib.NewJsonValue(cached.info.Version))
+		nips := jsonlib.NewJsonList()
+		for _, v := range cached.info.SupportedNIPs {
+			if n, ok := v.(float64); ok {
+				nips.Append(jsonlib.NewJsonValue(int64(n)))
+			}
+		}
+		info.Set("supported_nips", nips)
+		countries := jsonlib.NewJsonList()
+		for _, code := range cached.info.RelayCountries {
+			countries.Append(jsonlib.NewJsonValue(code))
+		}
+		info.Set("relay_countries", countries)
+		info.Set("payment_required", jsonlib.NewJsonValue(cached.info.Limitation != nil && cached.info.Limitation.PaymentRequired))
+		info.Set("auth_required", jsonlib.NewJsonValue(cached.info.Limitation != nil && cached.info.Limitation.AuthRequired))
+	}
+	info.Set("fetched_at", jsonlib.NewJsonValue(cached.fetched.Unix()))
+	obj.Set("nip11", info)
+
+	penalty := b.penalty(url)
+	latency, measured := b.latency.Snapshot(url)
+	broadcastInfo := b.broadcastInfo(url)
+	obj.Set("health_state", jsonlib.NewJsonValue(relayHealth(penalty, latency, broadcastInfo)))
+	obj.Set("penalty_seconds", jsonlib.NewJsonValue(int64(penalty.Seconds())))
+
+	if measured {
+		lat := jsonlib.NewJsonObject()
+		lat.Set("ewma_eose_ms", jsonlib.NewJsonValue(int64(latency.eose)))
+		lat.Set("ewma_first_event_ms", jsonlib.NewJsonValue(int64(latency.firstEvent)))
+		lat.Set("samples", jsonlib.NewJsonValue(latency.samples))
+		lat.Set("failures", jsonlib.NewJsonValue(latency.failures))
+		obj.Set("latency", lat)
+	}
+	if broadcastInfo != nil {
+		bc := jsonlib.NewJsonObject()
+		bc.Set("success_rate", jsonlib.NewJsonValue(broadcastInfo.SuccessRate))
+		bc.Set("avg_response_ms", jsonlib.NewJsonValue(broadcastInfo.AvgResponseTime.Milliseconds()))
+		bc.Set("attempts", jsonlib.NewJsonValue(broadcastInfo.TotalAttempts))
+		bc.Set("last_checked", jsonlib.NewJsonValue(broadcastInfo.LastChecked.Unix()))
+		obj.Set("broadcast", bc)
+	}
+	return obj
+}
+
+// HandleRelays serves GET /api/v1/relays
+func (b *relayBrowser) HandleRelays(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddInt64(&b.requests, 1)
+
+	roles := b.roles()
+	urls := make([]string, 0, len(roles))
+	for url := range roles {
+		urls = append(urls, url)
+	}
+	// configured relays first, then those only discovered
+	sort.Slice(urls, func(i, j int) bool {
+		di := slices.Equal(roles[urls[i]], []string{"discovered"})
+		dj := slices.Equal(roles[urls[j]], []string{"discovered"})
+		if di != dj {
+			return dj
+		}
+		return urls[i] < urls[j]
+	})
+	infos := b.relayInfos(req.Context(), urls)
+
+	list := jsonlib.NewJsonList()
+	for _, url := range urls {
+		list.Append(b.describe(url, roles[url], infos[url]))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("count", jsonlib.NewJsonValue(len(urls)))
+	obj.Set("relays", list)
+	writeJSONEntity(w, req, http.StatusOK, obj)
+}
+
+// GetStatsName returns the name of this stats provider
+func (b *relayBrowser) GetStatsName() string {
+	return "relay_browser"
+}
+
+// GetStats returns stats as JsonEntity
+func (b *relayBrowser) GetStats() jsonlib.JsonEntity {
+	b.mu.Lock()
+	cached := len(b.infos)
+	b.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("requests", jsonlib.NewJsonValue(atomic.LoadInt64(&b.requests)))
+	obj.Set("nip11_probes", jsonlib.NewJsonValue(atomic.LoadInt64(&b.infoProbes)))
+	obj.Set("nip11_cached", jsonlib.NewJsonValue(cached))
+	return obj
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Vetting of newly discovered broadcast relays for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Relay vetting tuning
+const (
+	// VettingEventKind is the ephemeral kind of the test event, which relays
+	// relay to subscribers but do not store
+	VettingEventKind = 20555
+	// VettingRetryAfter is how long a vetting outcome is reused before the
+	// relay is vetted again
+	VettingRetryAfter = 24 * time.Hour
+	// vettingConcurrency is how many relays are vetted at once
+	vettingConcurrency = 16
+	// vettingRecentRejections is how many rejections are listed in stats
+	vettingRecentRejections = 20
+)
+
+// Vetting rejection reasons
+const (
+	vetUnreachable      = "unreachable"
+	vetPaymentRequired  = "payment_required"
+	vetAuthRequired     = "auth_required"
+	vetRestrictedWrites = "restricted_writes"
+	vetWriteRejected    = "write_rejected"
+)
+
+// vetResult is the outcome of vetting one relay
+type vetResult struct {
+	url    string
+	reason string // empty when the relay passed
+	detail string
+	at     time.Time
+}
+
+// relayVetter decides whether a newly discovered relay may join the
+// broadcast pool. It reads the relay's NIP-11 document, rejecting relays that
+// advertise payment, auth or restricted writes, and publishes a throwaway
+// ephemeral event signed with a one-off key, rejecting relays that cannot be
+// reached or refuse it. Outcomes are reused for VettingRetryAfter, so a relay
+// that keeps being discovered is not probed on every run.
+type relayVetter struct {
+	timeout time.Duration
+	secret  string
+	mu      sync.Mutex
+	results map[string]*vetResult
+	recent  []*vetResult // latest rejections, newest last
+	// stats
+	vetted   int64
+	passed   int64
+	cached   int64
+	rejected map[string]int64 // by reason
+}
+
+// newRelayVetter creates a vetter giving each relay timeout to answer
+func newRelayVetter(timeout time.Duration) *relayVetter {
+	return &relayVetter{
+		timeout:  timeout,
+		secret:   nostr.GeneratePrivateKey(),
+		results:  map[string]*vetResult{},
+		rejected: map[string]int64{},
+	}
+}
+
+// Select vets candidates in order until want of them passed, removing the
+// rejected ones from m. It returns the candidates that passed first,
+// followed by those left unvetted, and how many passed.
+func (v *relayVetter) Select(ctx context.Context, m *manager.Manager, candidates []*manager.RelayInfo, want int) ([]*manager.RelayInfo, int) {
+	var passed, rest []*manager.RelayInfo
+	for start := 0; start < len(candidates); start += vettingConcurrency {
+		batch := candidates[start:min(start+vettingConcurrency, len(candidates))]
+		if len(passed) >= want || ctx.Err() != nil {
+			rest = append(rest, batch...)
+			continue
+		}
+		ok := make([]bool, len(batch))
+		var wg sync.WaitGroup
+		for i, info := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok[i] = v.vet(ctx, info.URL)
+			}()
+		}
+		wg.Wait()
+		for i, info := range batch {
+			switch {
+			case !ok[i]:
+				m.RemoveRelay(info.URL)
+			case len(passed) < want:
+				passed = append(passed, info)
+			default:
+				rest = append(rest, info)
+			}
+		}
+	}
+	return append(passed, rest...), len(passed)
+}
+
+// vet reports whether url passed, reusing a recent outcome
+func (v *relayVetter) vet(ctx context.Context, url string) bool {
+	v.mu.Lock()
+	if res, ok := v.results[url]; ok && time.Since(res.at) < VettingRetryAfter {
+		v.cached++
+		v.mu.Unlock()
+		return res.reason == ""
+	}
+	v.mu.Unlock()
+
+	reason, err := v.probe(ctx, url)
+	res := &vetResult{url: url, reason: reason, at: time.Now()}
+	if err != nil {
+		res.detail = err.Error()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.vetted++
+	v.results[url] = res
+	// forget outcomes too old to be reused
+	for u, old := range v.results {
+		if time.Since(old.at) >= VettingRetryAfter {
+			delete(v.results, u)
+		}
+	}
+	if reason == "" {
+		v.passed++
+		return true
+	}
+	v.rejected[reason]++
+	v.recent = append(v.recent, res)
+	if len(v.recent) > vettingRecentRejections {
+		v.recent = v.recent[1:]
+	}
+	logging.DebugMethod("vetting", "vet", "rejected broadcast relay %s: %s: %v", url, reason, err)
+	return false
+}
+
+// probe checks the NIP-11 document of url and publishes the test event,
+// returning the rejection reason, if any
+func (v *relayVetter) probe(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	// a relay without a NIP-11 document may still accept events
+	if info, err := nip11.Fetch(ctx, url); err == nil && info.Limitation != nil {
+		switch {
+		case info.Limitation.PaymentRequired:
+			return vetPaymentRequired, errors.New("NIP-11 advertises payment_required")
+		case info.Limitation.AuthRequired:
+			return vetAuthRequired, errors.New("NIP-11 advertises auth_required")
+		case info.Limitation.RestrictedWrites:
+			return vetRestrictedWrites, errors.New("NIP-11 advertises restricted_writes")
+		}
+	}
+
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return vetUnreachable, err
+	}
+	defer relay.Close()
+	evt := nostr.Event{
+		Kind:      VettingEventKind,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{},
+		Content:   "relay vetting probe",
+	}
+	if err := evt.Sign(v.secret); err != nil {
+		return vetWriteRejected, fmt.Errorf("signing test event: %w", err)
+	}
+	// relays may answer an ephemeral event nobody subscribed to with
+	// "mute:", having accepted it all the same
+	if err := relay.Publish(ctx, evt); err != nil && relayerrors.Prefix(err) != relayerrors.PrefixMute {
+		return vetWriteRejected, err
+	}
+	return "", nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (v *relayVetter) GetStatsName() string {
+	return "relay_vetting"
+}
+
+// GetStats returns stats as JsonEntity
+func (v *relayVetter) GetStats() jsonlib.JsonEntity {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("vetted", jsonlib.NewJsonValue(v.vetted))
+	obj.Set("passed", jsonlib.NewJsonValue(v.passed))
+	obj.Set("cached", jsonlib.NewJsonValue(v.cached))
+	rejected := jsonlib.NewJsonObject()
+	for _, reason := range []string{vetUnreachable, vetPaymentRequired, vetAuthRequired, vetRestrictedWrites, vetWriteRejected} {
+		rejected.Set(reason, jsonlib.NewJsonValue(v.rejected[reason]))
+	}
+	obj.Set("rejected", rejected)
+	recent := jsonlib.NewJsonList()
+	for i := len(v.recent) - 1; i >= 0; i-- {
+		res := v.recent[i]
+		r := jsonlib.NewJsonObject()
+		r.Set("url", jsonlib.NewJsonValue(res.url))
+		r.Set("reason", jsonlib.NewJsonValue(res.reason))
+		if res.detail != "" {
+			r.Set("detail", jsonlib.NewJsonValue(res.detail))
+		}
+		r.Set("at", jsonlib.NewJsonValue(res.at.Unix()))
+		recent.Append(r)
+	}
+	obj.Set("recent_rejections", recent)
+	return obj
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Remote configuration over NIP-78 for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Remote configuration documents are NIP-78 application data events, one per
+// part of the configuration, told apart by their d tag
+const (
+	RemoteConfigBlocklistD = "saint-michaels-mirror/blocklist"
+	RemoteConfigPinnedD    = "saint-michaels-mirror/pinned"
+	RemoteConfigProfilesD  = "saint-michaels-mirror/profiles"
+	// RemoteConfigTimeout bounds one refresh against all control relays
+	RemoteConfigTimeout = 30 * time.Second
+)
+
+// remoteConfigDs lists the documents read, in stats order
+var remoteConfigDs = []string{RemoteConfigBlocklistD, RemoteConfigPinnedD, RemoteConfigProfilesD}
+
+// remoteBlocklist is the content of the blocklist document
+type remoteBlocklist struct {
+	PubKeys []string `json:"pubkeys"`
+}
+
+// remotePinned is the content of the pinned events document
+type remotePinned struct {
+	Events []string `json:"events"`
+}
+
+// remoteProfiles is the content of the relay profiles document
+type remoteProfiles struct {
+	Profiles map[string]relayProfile `json:"profiles"`
+	Active   *string                 `json:"active,omitempty"`
+}
+
+// remoteConfigDoc is the state of one document
+type remoteConfigDoc struct {
+	eventID   string
+	createdAt nostr.Timestamp
+	applied   time.Time
+	lastError string
+}
+
+// remoteConfig reads parts of the configuration from NIP-78 application data
+// (kind 30078) events the admin publishes on control relays, so the policy of
+// a fleet of mirrors can be updated by publishing one event. Each document is
+// an addressable event whose d tag names the part it replaces and whose
+// content is JSON:
+//
+//   - saint-michaels-mirror/blocklist: {"pubkeys":["npub1...", "<hex>"]},
+//     authors whose events are rejected
+//   - saint-michaels-mirror/pinned: {"events":["nevent1...", "30023:<hex>:d"]},
+//     pinned events besides those of PINNED_EVENTS and the admin API
+//   - saint-michaels-mirror/profiles: {"profiles":{...},"active":"name"},
+//     relay profiles as in RELAY_PROFILES_FILE, and optionally the one to use
+//
+// Only events signed by the configured pubkey are considered, and of those
+// the newest of each document, which is applied when it is newer than the
+// one in use. A document that fails to parse or apply leaves the previous
+// one in use.
+type remoteConfig struct {
+	pubkey   string
+	relays   []string
+	interval time.Duration
+	pinned   *pinnedEvents      // nil without broadcast relays
+	profiles *profileController // set before Start
+	mu       sync.Mutex
+	blocked  map[string]struct{}
+	docs     map[string]*remoteConfigDoc // by d tag
+	checked  time.Time
+	lastErr  string
+	// stats
+	checks   int64
+	failures int64
+	rejected int64
+}
+
+// newRemoteConfig creates the reader of the documents signed by pubkey (hex
+// or npub) on relays, refreshed every interval
+func newRemoteConfig(pubkey string, relays []string, interval time.Duration) (*remoteConfig, error) {
+	hex, err := parsePubKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REMOTE_CONFIG_PUBKEY: %w", err)
+	}
+	if len(relays) == 0 {
+		return nil, errors.New("REMOTE_CONFIG_RELAYS is empty")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid REMOTE_CONFIG_INTERVAL %v: must be positive", interval)
+	}
+	return &remoteConfig{
+		pubkey:   hex,
+		relays:   relays,
+		interval: interval,
+		blocked:  map[string]struct{}{},
+		docs:     map[string]*remoteConfigDoc{},
+	}, nil
+}
+
+// Apply installs the blocklist ahead of the other event policies
+func (c *remoteConfig) Apply(r *khatru.Relay) {
+	r.RejectEvent = slices.Insert(r.RejectEvent, 0, policyRejects.Event("blocklist", c.RejectEvent))
+	logging.Info("remote configuration: documents of %s from %d control relays every %v", c.pubkey, len(c.relays), c.interval)
+}
+
+// RejectEvent rejects events by blocked authors
+func (c *remoteConfig) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	c.mu.Lock()
+	_, blocked := c.blocked[evt.PubKey]
+	c.mu.Unlock()
+	if !blocked {
+		return false, ""
+	}
+	atomic.AddInt64(&c.rejected, 1)
+	return true, "blocked: pubkey is blocked on this relay"
+}
+
+// Start refreshes right away and then every interval until ctx is done
+func (c *remoteConfig) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			c.refresh(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refresh fetches the documents and applies those that changed
+func (c *remoteConfig) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, RemoteConfigTimeout)
+	defer cancel()
+	newest, err := c.fetch(ctx)
+
+	c.mu.Lock()
+	c.checks++
+	c.checked = time.Now()
+	if err != nil {
+		c.failures++
+		c.lastErr = err.Error()
+		c.mu.Unlock()
+		logging.DebugMethod("remoteconfig", "refresh", "fetching remote configuration failed: %v", err)
+		return
+	}
+	c.lastErr = ""
+	c.mu.Unlock()
+
+	for _, d := range remoteConfigDs {
+		evt, ok := newest[d]
+		if !ok {
+			continue
+		}
+		c.mu.Lock()
+		doc, ok := c.docs[d]
+		if !ok {
+			doc = &remoteConfigDoc{}
+			c.docs[d] = doc
+		}
+		current := evt.ID == doc.eventID || evt.CreatedAt < doc.createdAt
+		c.mu.Unlock()
+		if current {
+			continue
+		}
+
+		err := c.apply(d, evt)
+		c.mu.Lock()
+		if err != nil {
+			// warn once per failure, not on every refresh
+			if msg := fmt.Sprintf("event %s: %v", evt.ID, err); msg != doc.lastError {
+				doc.lastError = msg
+				logging.Warn("remote configuration %s not applied: %s", d, msg)
+			}
+		} else {
+			doc.eventID = evt.ID
+			doc.createdAt = evt.CreatedAt
+			doc.applied = time.Now()
+			doc.lastError = ""
+			logging.Info("applied remote configuration %s from event %s", d, evt.ID)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fetch returns the newest valid event of each document found on any relay
+func (c *remoteConfig) fetch(ctx context.Context) (map[string]*nostr.Event, error) {
+	filter := nostr.Filter{
+		Kinds:   []int{KindAppData},
+		Authors: []string{c.pubkey},
+		Tags:    nostr.TagMap{"d": remoteConfigDs},
+	}
+	newest := map[string]*nostr.Event{}
+	var lastErr error
+	reached := 0
+	for _, url := range c.relays {
+		relay, err := nostr.RelayConnect(ctx, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		events, err := relay.QuerySync(ctx, filter)
+		relay.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reached++
+		for _, evt := range events {
+			d := evt.Tags.GetD()
+			if evt.Kind != KindAppData || evt.PubKey != c.pubkey || !slices.Contains(remoteConfigDs, d) {
+				continue
+			}
+			if prev, ok := newest[d]; ok && prev.CreatedAt >= evt.CreatedAt {
+				continue
+			}
+			if !evt.CheckID() {
+				logging.Warn("ignoring remote configuration event %s from %s: id does not match", evt.ID, url)
+				continue
+			}
+			if ok, _ := evt.CheckSignature(); !ok {
+				logging.Warn("ignoring remote configuration event %s from %s: invalid signature", evt.ID, url)
+				continue
+			}
+			newest[d] = evt
+		}
+	}
+	if reached == 0 {
+		return nil, lastErr
+	}
+	return newest, nil
+}
+
+// apply parses the document d held by evt and replaces that part of the
+// configuration with it
+func (c *remoteConfig) apply(d string, evt *nostr.Event) error {
+	switch d {
+	case RemoteConfigBlocklistD:
+		var doc remoteBlocklist
+		if err := json.Unmarshal([]byte(evt.Content), &doc); err != nil {
+			return fmt.Errorf("parsing blocklist: %w", err)
+		}
+		blocked := map[string]struct{}{}
+		for _, pk := range doc.PubKeys {
+			pubkey, err := parsePubKey(pk)
+			if err != nil {
+				return err
+			}
+			blocked[pubkey] = struct{}{}
+		}
+		c.mu.Lock()
+		c.blocked = blocked
+		c.mu.Unlock()
+	case RemoteConfigPinnedD:
+		if c.pinned == nil {
+			return errors.New("pinned events need BROADCAST_SEED_RELAYS")
+		}
+		var doc remotePinned
+		if err := json.Unmarshal([]byte(evt.Content), &doc); err != nil {
+			return fmt.Errorf("parsing pinned events: %w", err)
+		}
+		return c.pinned.Replace("remote", doc.Events)
+	case RemoteConfigProfilesD:
+		var doc remoteProfiles
+		if err := json.Unmarshal([]byte(evt.Content), &doc); err != nil {
+			return fmt.Errorf("parsing relay profiles: %w", err)
+		}
+		if doc.Active != nil && *doc.Active != "" {
+			if _, ok := doc.Profiles[*doc.Active]; !ok && !c.profiles.HasConfigured(*doc.Active) {
+				return fmt.Errorf("unknown active profile %q", *doc.Active)
+			}
+		}
+		if err := c.profiles.SetRemoteProfiles(doc.Profiles); err != nil {
+			return err
+		}
+		if doc.Active != nil && *doc.Active != c.profiles.Active() {
+			return c.profiles.Switch(*doc.Active)
+		}
+	}
+	return nil
+}
+
+// GetStatsName returns the name of this stats provider
+func (c *remoteConfig) GetStatsName() string {
+	return "remote_config"
+}
+
+// GetStats returns stats as JsonEntity
+func (c *remoteConfig) GetStats() jsonlib.JsonEntity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	docs := jsonlib.NewJsonList()
+	for _, d := range remoteConfigDs {
+		doc, ok := c.docs[d]
+		if !ok {
+			continue
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("d", jsonlib.NewJsonValue(d))
+		if doc.eventID != "" {
+			obj.Set("event_id", jsonlib.NewJsonValue(doc.eventID))
+			obj.Set("created_at", jsonlib.NewJsonValue(int64(doc.createdAt)))
+			obj.Set("applied_at", jsonlib.NewJsonValue(doc.applied.Unix()))
+		}
+		if doc.lastError != "" {
+			obj.Set("last_error", jsonlib.NewJsonValue(doc.lastError))
+		}
+		docs.Append(obj)
+	}
+	relayList := jsonlib.NewJsonList()
+	for _, url := range c.relays {
+		relayList.Append(jsonlib.NewJsonValue(url))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("pubkey", jsonlib.NewJsonValue(c.pubkey))
+	obj.Set("relays", relayList)
+	obj.Set("checks", jsonlib.NewJsonValue(c.checks))
+	obj.Set("failures", jsonlib.NewJsonValue(c.failures))
+	if !c.checked.IsZero() {
+		obj.Set("last_check", jsonlib.NewJsonValue(c.checked.Unix()))
+	}
+	if c.lastErr != "" {
+		obj.Set("last_error", jsonlib.NewJsonValue(c.lastErr))
+	}
+	obj.Set("blocked_pubkeys", jsonlib.NewJsonValue(len(c.blocked)))
+	obj.Set("rejected_events", jsonlib.NewJsonValue(atomic.LoadInt64(&c.rejected)))
+	obj.Set("documents", docs)
+	return obj
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Replay protection against re-published old events for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Replay policies
+const (
+	// ReplayReject rejects old events with invalid:
+	ReplayReject = "reject"
+	// ReplayDrop accepts old events but does not publish them upstream
+	ReplayDrop = "drop"
+)
+
+// kindRange is an inclusive range of event kinds
+type kindRange struct {
+	from, to int
+}
+
+// parseKindRanges parses a comma-separated list of kinds and kind ranges,
+// e.g. "0,3,10000-19999"; env names the setting in errors
+func parseKindRanges(list, env string) ([]kindRange, error) {
+	var ranges []kindRange
+	for _, item := range splitList(list) {
+		fromStr, toStr, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(fromStr))
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid kind in %s %q", env, item)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(strings.TrimSpace(toStr)); err != nil || to < from {
+				return nil, fmt.Errorf("invalid kind range in %s %q", env, item)
+			}
+		}
+		ranges = append(ranges, kindRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+// inKindRanges reports whether kind is in any of ranges
+func inKindRanges(ranges []kindRange, kind int) bool {
+	for _, kr := range ranges {
+		if kind >= kr.from && kind <= kr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// kindRangesJSON renders ranges as a list of kinds and kind ranges
+func kindRangesJSON(ranges []kindRange) *jsonlib.JsonList {
+	list := jsonlib.NewJsonList()
+	for _, kr := range ranges {
+		if kr.from == kr.to {
+			list.Append(jsonlib.NewJsonValue(strconv.Itoa(kr.from)))
+		} else {
+			list.Append(jsonlib.NewJsonValue(fmt.Sprintf("%d-%d", kr.from, kr.to)))
+		}
+	}
+	return list
+}
+
+// replayProtection keeps old events from being fanned out again. Replaying
+// archives of ancient events through a relay is a cheap way to flood the
+// upstreams with events they already have or no longer want, so events whose
+// created_at is more than maxAge in the past are either rejected or, with the
+// drop policy, answered with OK but never published. Exempt kinds, e.g.
+// profiles and relay lists that are legitimately re-sent to new relays, are
+// always let through.
+type replayProtection struct {
+	maxAge time.Duration
+	drop   bool
+	exempt []kindRange
+	// stats
+	checked  int64
+	exempted int64
+	rejected int64
+	dropped  int64
+}
+
+// newReplayProtection creates the protection for events older than maxAge
+// with the reject or drop policy; exempt is a comma-separated list of kinds
+// and kind ranges, e.g. "0,3,10000-19999"
+func newReplayProtection(maxAge time.Duration, policy, exempt string) (*replayProtection, error) {
+	rp := &replayProtection{maxAge: maxAge}
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "", ReplayReject:
+	case ReplayDrop:
+		rp.drop = true
+	default:
+		return nil, fmt.Errorf("invalid REPLAY_POLICY %q: must be reject or drop", policy)
+	}
+	var err error
+	if rp.exempt, err = parseKindRanges(exempt, "REPLAY_EXEMPT_KINDS"); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// Apply installs the reject policy; the drop policy is applied by wrapping
+// the store function with Wrap instead
+func (rp *replayProtection) Apply(r *khatru.Relay) {
+	if rp.drop {
+		logging.Info("replay protection: not publishing events older than %s", formatAge(rp.maxAge))
+		return
+	}
+	r.RejectEvent = append(r.RejectEvent, policyRejects.Event("replay_protection", rp.RejectEvent))
+	logging.Info("replay protection: rejecting events older than %s", formatAge(rp.maxAge))
+}
+
+// RejectEvent rejects events too old to be published again
+func (rp *replayProtection) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !rp.tooOld(evt) {
+		return false, ""
+	}
+	atomic.AddInt64(&rp.rejected, 1)
+	logging.DebugMethod("replay", "RejectEvent", "event %s (kind %d) created at %s is too old", evt.ID, evt.Kind, evt.CreatedAt.Time().UTC().Format(time.RFC3339))
+	return true, fmt.Sprintf("invalid: event is older than %s and will not be published again", formatAge(rp.maxAge))
+}
+
+// Wrap makes save accept events too old to be published again without
+// passing them on
+func (rp *replayProtection) Wrap(save func(context.Context, *nostr.Event) error) func(context.Context, *nostr.Event) error {
+	if !rp.drop {
+		return save
+	}
+	return func(ctx context.Context, evt *nostr.Event) error {
+		if rp.tooOld(evt) {
+			atomic.AddInt64(&rp.dropped, 1)
+			logging.DebugMethod("replay", "Wrap", "not publishing event %s (kind %d) created at %s", evt.ID, evt.Kind, evt.CreatedAt.Time().UTC().Format(time.RFC3339))
+			return nil
+		}
+		return save(ctx, evt)
+	}
+}
+
+// tooOld reports whether evt is older than maxAge and not of an exempt kind
+func (rp *replayProtection) tooOld(evt *nostr.Event) bool {
+	atomic.AddInt64(&rp.checked, 1)
+	if time.Since(evt.CreatedAt.Time()) <= rp.maxAge {
+		return false
+	}
+	if inKindRanges(rp.exempt, evt.Kind) {
+		atomic.AddInt64(&rp.exempted, 1)
+		return false
+	}
+	return true
+}
+
+// formatAge renders whole days as such and anything else as a duration
+func formatAge(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// GetStatsName returns the name of this stats provider
+func (rp *replayProtection) GetStatsName() string {
+	return "replay_protection"
+}
+
+// GetStats returns stats as JsonEntity
+func (rp *replayProtection) GetStats() jsonlib.JsonEntity {
+	policy := ReplayReject
+	if rp.drop {
+		policy = ReplayDrop
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("policy", jsonlib.NewJsonValue(policy))
+	obj.Set("max_age_seconds", jsonlib.NewJsonValue(int64(rp.maxAge.Seconds())))
+	obj.Set("exempt_kinds", kindRangesJSON(rp.exempt))
+	obj.Set("checked", jsonlib.NewJsonValue(atomic.LoadInt64(&rp.checked)))
+	obj.Set("exempted", jsonlib.NewJsonValue(atomic.LoadInt64(&rp.exempted)))
+	obj.Set("rejected", jsonlib.NewJsonValue(atomic.LoadInt64(&rp.rejected)))
+	obj.Set("dropped", jsonlib.NewJsonValue(atomic.LoadInt64(&rp.dropped)))
+	return obj
+}
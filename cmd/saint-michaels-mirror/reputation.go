@@ -0,0 +1,240 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Relay reputation export and import for Espelho de São Miguel.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/broadcast/manager"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ReputationFormat is the version of the reputation document
+const ReputationFormat = 1
+
+// Reputation import limits
+const (
+	// maxReputationBody bounds the size of an imported document
+	maxReputationBody = 8 << 20
+	// maxReputationReplay bounds the publish outcomes replayed per relay
+	maxReputationReplay = 200
+)
+
+// reputationDocument is what an instance has learned about its upstreams:
+// the broadcast score of each relay and the query latency of each upstream
+type reputationDocument struct {
+	Format     int                   `json:"format"`
+	ExportedAt time.Time             `json:"exported_at"`
+	Broadcast  []broadcastReputation `json:"broadcast"`
+	Query      []queryReputation     `json:"query"`
+}
+
+// broadcastReputation is the score of one broadcast relay
+type broadcastReputation struct {
+	URL                string    `json:"url"`
+	SuccessRate        float64   `json:"success_rate"`
+	AvgResponseMs      int64     `json:"avg_response_ms"`
+	TotalAttempts      int64     `json:"total_attempts"`
+	SuccessfulAttempts int64     `json:"successful_attempts"`
+	LastChecked        time.Time `json:"last_checked"`
+	Mandatory          bool      `json:"mandatory,omitempty"`
+}
+
+// queryReputation is the measured latency of one query upstream
+type queryReputation struct {
+	URL              string    `json:"url"`
+	EWMAEOSEMs       float64   `json:"ewma_eose_ms"`
+	EWMAFirstEventMs float64   `json:"ewma_first_event_ms"`
+	LastEOSEMs       int64     `json:"last_eose_ms"`
+	Samples          int64     `json:"samples"`
+	Failures         int64     `json:"failures"`
+	LastUpdated      time.Time `json:"last_updated"`
+}
+
+// relayReputation exports what this instance has learned about its relays
+// and imports what another one has, so a new instance or a staging
+// environment starts with production's knowledge instead of testing every
+// relay from scratch. Only relays without local data are imported: what
+// this instance measured itself always wins. The broadcast library has no
+// way to set a score, so each imported relay is added to the pool and up to
+// maxReputationReplay publish outcomes are replayed into the manager, mixed
+// to approximate the exported success rate, with the exported average
+// response time; the attempt counters therefore restart small. Mandatory
+// flags are not imported, as they come from the configuration.
+type relayReputation struct {
+	system  *broadcast.BroadcastSystem // nil without broadcasting
+	latency *latencyRanker
+}
+
+// newRelayReputation creates the endpoint for the scores of system, if any,
+// and the query latencies in latency
+func newRelayReputation(system *broadcast.BroadcastSystem, latency *latencyRanker) *relayReputation {
+	return &relayReputation{system: system, latency: latency}
+}
+
+// Export returns the current reputation of every known relay
+func (r *relayReputation) Export() reputationDocument {
+	doc := reputationDocument{
+		Format:     ReputationFormat,
+		ExportedAt: time.Now().UTC(),
+		Broadcast:  []broadcastReputation{},
+		Query:      []queryReputation{},
+	}
+	if r.system != nil {
+		m := r.system.GetManager()
+		for _, url := range m.GetAllRelays() {
+			info, ok := m.GetRelayInfo(url).(*manager.RelayInfo)
+			if !ok || info.TotalAttempts == 0 {
+				continue
+			}
+			doc.Broadcast = append(doc.Broadcast, broadcastReputation{
+				URL:                url,
+				SuccessRate:        info.SuccessRate,
+				AvgResponseMs:      info.AvgResponseTime.Milliseconds(),
+				TotalAttempts:      info.TotalAttempts,
+				SuccessfulAttempts: info.SuccessfulAttempts,
+				LastChecked:        info.LastChecked.UTC(),
+				Mandatory:          info.IsMandatory,
+			})
+		}
+	}
+	for _, url := range r.latency.URLs() {
+		rl, ok := r.latency.Snapshot(url)
+		if !ok || rl.samples == 0 {
+			continue
+		}
+		doc.Query = append(doc.Query, queryReputation{
+			URL:              url,
+			EWMAEOSEMs:       rl.eose,
+			EWMAFirstEventMs: rl.firstEvent,
+			LastEOSEMs:       rl.lastEOSE.Milliseconds(),
+			Samples:          rl.samples,
+			Failures:         rl.failures,
+			LastUpdated:      rl.lastUpdated.UTC(),
+		})
+	}
+	return doc
+}
+
+// reputationImport counts what an import did
+type reputationImport struct {
+	broadcastImported, broadcastSkipped int
+	queryImported, querySkipped         int
+}
+
+// Import seeds the relays of doc that have no local data
+func (r *relayReputation) Import(doc reputationDocument) (reputationImport, error) {
+	var result reputationImport
+	if doc.Format != ReputationFormat {
+		return result, fmt.Errorf("unsupported format %d: expected %d", doc.Format, ReputationFormat)
+	}
+	for _, b := range doc.Broadcast {
+		if b.SuccessRate < 0 || b.SuccessRate > 1 || b.AvgResponseMs < 0 {
+			return result, fmt.Errorf("invalid broadcast reputation of %s", b.URL)
+		}
+	}
+	for _, q := range doc.Query {
+		if q.EWMAEOSEMs < 0 || q.EWMAFirstEventMs < 0 || q.Samples < 0 || q.Failures < 0 {
+			return result, fmt.Errorf("invalid query reputation of %s", q.URL)
+		}
+	}
+
+	if r.system != nil {
+		m := r.system.GetManager()
+		for _, b := range doc.Broadcast {
+			if b.TotalAttempts <= 0 || !r.replay(m, b) {
+				result.broadcastSkipped++
+				continue
+			}
+			result.broadcastImported++
+		}
+	} else {
+		result.broadcastSkipped = len(doc.Broadcast)
+	}
+	for _, q := range doc.Query {
+		if q.Samples <= 0 || !r.latency.Restore(q.URL, relayLatency{
+			firstEvent:  q.EWMAFirstEventMs,
+			eose:        q.EWMAEOSEMs,
+			samples:     q.Samples,
+			failures:    q.Failures,
+			lastEOSE:    time.Duration(q.LastEOSEMs) * time.Millisecond,
+			lastUpdated: q.LastUpdated,
+		}) {
+			result.querySkipped++
+			continue
+		}
+		result.queryImported++
+	}
+	return result, nil
+}
+
+// replay adds b to the manager unless it has been tried already, and feeds
+// it outcomes spread evenly to average b's success rate
+func (r *relayReputation) replay(m *manager.Manager, b broadcastReputation) bool {
+	url := nostr.NormalizeURL(b.URL)
+	if url == "" {
+		return false
+	}
+	if info, ok := m.GetRelayInfo(url).(*manager.RelayInfo); ok && info.TotalAttempts > 0 {
+		return false
+	}
+	m.AddRelay(url)
+	rtt := time.Duration(b.AvgResponseMs) * time.Millisecond
+	n := min(b.TotalAttempts, maxReputationReplay)
+	var successes int64
+	for i := int64(1); i <= n; i++ {
+		success := float64(successes) < b.SuccessRate*float64(i)
+		if success {
+			successes++
+		}
+		m.UpdateHealth(url, success, rtt)
+	}
+	return true
+}
+
+// HandleReputation serves GET (export) and POST (import) of the relay
+// reputation document
+func (r *relayReputation) HandleReputation(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		data, err := json.MarshalIndent(r.Export(), "", "  ")
+		if err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="relay-reputation.json"`)
+		writeJSON(w, req, http.StatusOK, data)
+	case http.MethodPost:
+		var doc reputationDocument
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxReputationBody)).Decode(&doc); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := r.Import(doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Info("relay reputation imported via admin API (exported %v): %d broadcast relays (%d skipped), %d query upstreams (%d skipped)",
+			doc.ExportedAt, result.broadcastImported, result.broadcastSkipped, result.queryImported, result.querySkipped)
+		obj := jsonlib.NewJsonObject()
+		obj.Set("broadcast_imported", jsonlib.NewJsonValue(result.broadcastImported))
+		obj.Set("broadcast_skipped", jsonlib.NewJsonValue(result.broadcastSkipped))
+		obj.Set("query_imported", jsonlib.NewJsonValue(result.queryImported))
+		obj.Set("query_skipped", jsonlib.NewJsonValue(result.querySkipped))
+		writeJSONEntity(w, req, http.StatusOK, obj)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
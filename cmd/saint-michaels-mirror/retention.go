@@ -0,0 +1,39 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-11 retention hints for Espelho de São Miguel.
+package main
+
+// newRetentionInfo describes in the NIP-11 retention section that the relay
+// keeps nothing: with a time of 0 for every kind, clients following NIP-11
+// know not to count on it to hold their events. Each entry also carries a
+// description of what happens to the kinds it covers, since events are
+// still published upstream and queried from there. The section is served
+// like an operator override, so one in RELAY_INFO_FILE replaces it.
+func newRetentionInfo(mode *relayMode) *relayInfoOverride {
+	var passThrough string
+	switch {
+	case !mode.Writes():
+		passThrough = "not stored: queried from upstream relays on every request, publishing is not accepted"
+	case !mode.Reads():
+		passThrough = "not stored: published to upstream relays, not served here"
+	default:
+		passThrough = "not stored: published to upstream relays and queried from them on every request"
+	}
+	retention := []any{}
+	if mode.Writes() {
+		retention = append(retention, map[string]any{
+			"kinds":       []any{[]int{20000, 29999}},
+			"time":        0,
+			"description": "ephemeral: only delivered to clients subscribed here at the time, never published upstream",
+		})
+	}
+	retention = append(retention, map[string]any{
+		"time":        0,
+		"description": passThrough,
+	})
+	return &relayInfoOverride{path: "retention", doc: map[string]any{"retention": retention}}
+}
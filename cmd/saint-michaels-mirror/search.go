@@ -0,0 +1,283 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// NIP-50 search aggregation for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// searchRankConstant is the k constant used for reciprocal rank fusion.
+// Upstreams rank results with incomparable scoring functions, so only the
+// position of each event in an upstream's answer is used when merging.
+const searchRankConstant = 60
+
+// searchDefaultLimit is the number of results returned when the filter has no limit
+const searchDefaultLimit = 100
+
+// searchUpstreamStats holds per-upstream search counters
+type searchUpstreamStats struct {
+	requests       int64
+	failures       int64
+	eventsReturned int64
+	totalLatencyNs int64
+	lastLatencyNs  int64
+}
+
+// searchResult is the ordered answer of a single upstream
+type searchResult struct {
+	url    string
+	events []*nostr.Event
+}
+
+// searchAggregator fans NIP-50 search filters out to search-capable upstreams
+// and merges their answers into a single relevance-ordered result list.
+type searchAggregator struct {
+	relays    []string
+	pool      *relaypool.Role
+	ownPool   bool // set when the pool is private to the aggregator
+	penalties *penaltyBox
+	// observer, when set, sees every result returned by an upstream
+	observer func(relayURL string, id string)
+	// per-upstream stats, keys are fixed at construction
+	upstreams map[string]*searchUpstreamStats
+	// stats
+	requests       int64
+	eventsReturned int64
+	duplicates     int64
+}
+
+// newSearchAggregator creates a search aggregator for the given NIP-50 relays
+func newSearchAggregator(relays []string, penalties *penaltyBox) *searchAggregator {
+	upstreams := make(map[string]*searchUpstreamStats, len(relays))
+	for _, url := range relays {
+		upstreams[url] = &searchUpstreamStats{}
+	}
+	return &searchAggregator{
+		relays:    relays,
+		penalties: penalties,
+		upstreams: upstreams,
+	}
+}
+
+// SetEventObserver registers fn to be told which upstream returned which result
+func (s *searchAggregator) SetEventObserver(fn func(relayURL string, id string)) {
+	s.observer = fn
+}
+
+// SetPool makes the aggregator connect through a pool shared with other
+// components. It must be called before Init; without it Init creates a
+// private pool.
+func (s *searchAggregator) SetPool(pool *relaypool.Role) {
+	s.pool = pool
+}
+
+// Init creates the connection pool used for search queries, unless one was set
+func (s *searchAggregator) Init() error {
+	if len(s.relays) == 0 {
+		return fmt.Errorf("no search remotes provided - search aggregator requires NIP-50 relays")
+	}
+	if s.pool == nil {
+		s.pool = relaypool.New(withBandwidthRole(context.Background(), bandwidthRoleSearch)).Role(relaypool.RoleSearch)
+		s.ownPool = true
+	}
+	logging.DebugMethod("search", "Init", "search remotes: %v", s.relays)
+	return nil
+}
+
+// Close closes the connections of a private pool; a shared pool is closed
+// by its owner
+func (s *searchAggregator) Close() {
+	if s.ownPool {
+		s.pool.Pool().Close()
+	}
+}
+
+// Wrap routes search filters to the aggregator and everything else to next
+func (s *searchAggregator) Wrap(next queryFunc) queryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Search == "" {
+			return next(ctx, filter)
+		}
+		return s.QueryEvents(ctx, filter)
+	}
+}
+
+// QueryEvents queries all search upstreams in parallel and returns the merged,
+// de-duplicated results ordered by fused relevance.
+func (s *searchAggregator) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	atomic.AddInt64(&s.requests, 1)
+
+	if !isExternalQuery(ctx) {
+		logging.DebugMethod("search", "QueryEvents", "internal search short-circuited filter=%+v", filter)
+		return closedEventChannel(), nil
+	}
+
+	logging.DebugMethod("search", "QueryEvents", "search %q across %d upstreams", filter.Search, len(s.relays))
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, relaystore.QueryTimeoutDuration)
+		defer cancel()
+
+		results := make(chan searchResult, len(s.relays))
+		var wg sync.WaitGroup
+		for _, url := range s.relays {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				results <- searchResult{url: url, events: s.queryUpstream(timeoutCtx, url, filter)}
+			}(url)
+		}
+		wg.Wait()
+		close(results)
+
+		merged := s.merge(results, filter)
+		atomic.AddInt64(&s.eventsReturned, int64(len(merged)))
+		for _, evt := range merged {
+			select {
+			case out <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// queryUpstream runs the search against a single upstream and returns its
+// events in the order the upstream sent them.
+func (s *searchAggregator) queryUpstream(ctx context.Context, url string, filter nostr.Filter) []*nostr.Event {
+	us := s.upstreams[url]
+	atomic.AddInt64(&us.requests, 1)
+
+	startTime := time.Now()
+	defer func() {
+		latency := time.Since(startTime).Nanoseconds()
+		atomic.AddInt64(&us.totalLatencyNs, latency)
+		atomic.StoreInt64(&us.lastLatencyNs, latency)
+	}()
+
+	relay, err := s.penalties.EnsureRelay(s.pool, url)
+	if err != nil {
+		atomic.AddInt64(&us.failures, 1)
+		logging.DebugMethod("search", "queryUpstream", "failed to ensure search relay %s: %v", url, err)
+		return nil
+	}
+
+	ch, err := relay.QueryEvents(ctx, filter)
+	if err != nil {
+		atomic.AddInt64(&us.failures, 1)
+		logging.DebugMethod("search", "queryUpstream", "search on %s failed: %v", url, err)
+		return nil
+	}
+
+	events := []*nostr.Event{}
+	for evt := range ch {
+		if s.observer != nil {
+			s.observer(url, evt.ID)
+		}
+		events = append(events, evt)
+	}
+	atomic.AddInt64(&us.eventsReturned, int64(len(events)))
+	logging.DebugMethod("search", "queryUpstream", "%s returned %d results in %v", url, len(events), time.Since(startTime))
+	return events
+}
+
+// merge fuses the per-upstream rankings, removes duplicates and applies the limit
+func (s *searchAggregator) merge(results <-chan searchResult, filter nostr.Filter) []*nostr.Event {
+	type scored struct {
+		evt   *nostr.Event
+		score float64
+	}
+	byID := map[string]*scored{}
+	for res := range results {
+		for rank, evt := range res.events {
+			contribution := 1.0 / float64(searchRankConstant+rank+1)
+			if entry, ok := byID[evt.ID]; ok {
+				atomic.AddInt64(&s.duplicates, 1)
+				entry.score += contribution
+				continue
+			}
+			byID[evt.ID] = &scored{evt: evt, score: contribution}
+		}
+	}
+
+	ranked := make([]*scored, 0, len(byID))
+	for _, entry := range byID {
+		ranked = append(ranked, entry)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].evt.CreatedAt > ranked[j].evt.CreatedAt
+	})
+
+	limit := searchDefaultLimit
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	events := make([]*nostr.Event, len(ranked))
+	for i, entry := range ranked {
+		events[i] = entry.evt
+	}
+	return events
+}
+
+// GetStatsName returns the name of this stats provider
+func (s *searchAggregator) GetStatsName() string {
+	return "search"
+}
+
+// GetStats returns stats as JsonEntity
+func (s *searchAggregator) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("requests", jsonlib.NewJsonValue(atomic.LoadInt64(&s.requests)))
+	obj.Set("events_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&s.eventsReturned)))
+	obj.Set("duplicates_merged", jsonlib.NewJsonValue(atomic.LoadInt64(&s.duplicates)))
+
+	upstreamsObj := jsonlib.NewJsonObject()
+	for _, url := range s.relays {
+		us := s.upstreams[url]
+		requests := atomic.LoadInt64(&us.requests)
+		totalLatencyNs := atomic.LoadInt64(&us.totalLatencyNs)
+
+		var averageLatencyMs float64
+		if requests > 0 {
+			averageLatencyMs = float64(totalLatencyNs) / float64(requests) / 1e6
+		}
+
+		usObj := jsonlib.NewJsonObject()
+		usObj.Set("requests", jsonlib.NewJsonValue(requests))
+		usObj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&us.failures)))
+		usObj.Set("events_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&us.eventsReturned)))
+		usObj.Set("average_latency_ms", jsonlib.NewJsonValue(averageLatencyMs))
+		usObj.Set("last_latency_ms", jsonlib.NewJsonValue(atomic.LoadInt64(&us.lastLatencyNs)/1e6))
+		upstreamsObj.Set(url, usObj)
+	}
+	obj.Set("upstreams", upstreamsObj)
+	return obj
+}
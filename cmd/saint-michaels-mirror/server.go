@@ -0,0 +1,66 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// HTTP server and websocket settings for Espelho de São Miguel.
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// applyServerLimits applies websocket-level settings from config to the relay,
+// replacing khatru's defaults.
+func applyServerLimits(r *khatru.Relay, cfg *Config) {
+	r.MaxMessageSize = cfg.WSMaxMessageSize
+	r.WriteWait = cfg.WSWriteWait
+	r.PongWait = cfg.WSPongWait
+	r.PingPeriod = cfg.WSPingPeriod
+
+	// pings must be sent before the peer's read deadline expires, otherwise
+	// every idle connection is dropped after PongWait
+	if r.PingPeriod >= r.PongWait {
+		r.PingPeriod = r.PongWait * 9 / 10
+		logging.Warn("WS_PING_PERIOD (%v) must be shorter than WS_PONG_WAIT (%v); using %v", cfg.WSPingPeriod, cfg.WSPongWait, r.PingPeriod)
+	}
+
+	logging.DebugMethod("server", "applyServerLimits", "max_message_size=%d write_wait=%v pong_wait=%v ping_period=%v",
+		r.MaxMessageSize, r.WriteWait, r.PongWait, r.PingPeriod)
+}
+
+// startServer starts the HTTP server for the relay. It does the same as
+// khatru's Relay.Start, but uses the configured HTTP timeouts instead of the
+// hardcoded ones and the configured CORS policy for the API. Sending SIGUSR2
+// hands the listening socket to a new process of the same binary. Client
+// traffic is accounted in bw and the relay handler is wrapped by wraps. It
+// returns once life shuts the server down, which also closes the clients.
+func startServer(r *khatru.Relay, cfg *Config, host string, port int, bw *bandwidthMeter, life *lifecycle, wraps ...func(http.Handler) http.Handler) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	h := newHandover(r, cfg.UpgradeDrainTimeout, cfg.PIDFile)
+	ln, err := h.Listen(addr)
+	if err != nil {
+		return err
+	}
+	r.Addr = ln.Addr().String()
+
+	server := &http.Server{
+		Handler:      newRootHandler(r, cfg, wraps...),
+		Addr:         addr,
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
+	logging.DebugMethod("server", "startServer", "read_timeout=%v write_timeout=%v idle_timeout=%v",
+		server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+
+	life.OnShutdown(phaseStopAccepting, "http_server", server.Shutdown)
+	life.OnShutdown(phaseCloseClients, "client_connections", h.CloseClients)
+	return h.Serve(server, ln, bw.WrapListener)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Service URL detection for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/logging"
+	nip11 "github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// defaultTrustedProxies are trusted when TRUSTED_PROXIES is not set:
+// loopback and private networks, where reverse proxies usually live.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// serviceURLResolver derives the public base URL of the relay. A configured
+// RELAY_SERVICE_URL always wins; otherwise the URL is built from the request
+// Host, honoring X-Forwarded-Host/Proto only from trusted proxies.
+type serviceURLResolver struct {
+	configured     string
+	trustedProxies []*net.IPNet
+}
+
+// newServiceURLResolver parses the trusted proxy list (IPs or CIDRs)
+func newServiceURLResolver(configured string, trustedProxies []string) *serviceURLResolver {
+	if len(trustedProxies) == 0 {
+		trustedProxies = defaultTrustedProxies
+	}
+	s := &serviceURLResolver{configured: strings.TrimSuffix(configured, "/")}
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			logging.Warn("ignoring invalid trusted proxy %q: %v", p, err)
+			continue
+		}
+		s.trustedProxies = append(s.trustedProxies, ipnet)
+	}
+	return s
+}
+
+// isTrustedProxy reports whether the request's direct peer is a trusted proxy
+func (s *serviceURLResolver) isTrustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range s.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseURL returns the http(s):// base URL for the request
+func (s *serviceURLResolver) BaseURL(req *http.Request) string {
+	if s.configured != "" {
+		return s.configured
+	}
+
+	host := req.Host
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if s.isTrustedProxy(req) {
+		if fwdHost := req.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = strings.TrimSpace(strings.Split(fwdHost, ",")[0])
+		}
+		if fwdProto := req.Header.Get("X-Forwarded-Proto"); fwdProto != "" {
+			proto = strings.ToLower(strings.TrimSpace(strings.Split(fwdProto, ",")[0]))
+		}
+	}
+	return proto + "://" + host
+}
+
+// RelayURL returns the ws(s):// address clients should connect to
+func (s *serviceURLResolver) RelayURL(req *http.Request) string {
+	return httpToWebsocketURL(s.BaseURL(req))
+}
+
+// httpToWebsocketURL converts an http(s):// URL to its ws(s):// equivalent
+func httpToWebsocketURL(u string) string {
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	if strings.HasPrefix(u, "http://") {
+		return "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	return u
+}
+
+// OverwriteRelayInformation resolves relative icon and banner URLs against the
+// detected base URL. khatru resolves them with its own untrusted header guess
+// when ServiceURL is empty, so they are recomputed from the configured values.
+func (s *serviceURLResolver) OverwriteRelayInformation(r *khatru.Relay) func(context.Context, *http.Request, nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	return func(ctx context.Context, req *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+		if s.configured != "" {
+			return info
+		}
+		baseURL := s.BaseURL(req)
+		info.Icon = resolveAgainst(baseURL, r.Info.Icon)
+		info.Banner = resolveAgainst(baseURL, r.Info.Banner)
+		return info
+	}
+}
+
+// resolveAgainst resolves a relative asset path against a base URL
+func resolveAgainst(baseURL string, asset string) string {
+	if asset == "" || strings.HasPrefix(asset, "http://") || strings.HasPrefix(asset, "https://") {
+		return asset
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(asset, "/")
+}
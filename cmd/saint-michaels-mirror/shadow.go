@@ -0,0 +1,305 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Query shadowing to candidate upstreams for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Shadow query limits
+const (
+	// ShadowMaxInFlight bounds the shadowed queries running at once; queries
+	// sampled beyond it are not shadowed
+	ShadowMaxInFlight = 32
+	// shadowMaxIDs bounds the event ids compared per query and relay
+	shadowMaxIDs = 1000
+)
+
+// shadowResult is what one candidate returned for one query
+type shadowResult struct {
+	ids        map[string]struct{}
+	truncated  bool
+	firstEvent time.Duration
+	eose       time.Duration // 0 when the query did not reach EOSE
+	err        error
+}
+
+// shadowRemoteStats are the measurements of one candidate
+type shadowRemoteStats struct {
+	queries         int64
+	errors          int64
+	timeouts        int64
+	events          int64
+	eoses           int64
+	eoseTotal       time.Duration
+	firstEvents     int64
+	firstEventTotal time.Duration
+	// comparisons with the served results
+	compared  int64
+	expected  int64 // served events
+	matched   int64 // served events the candidate returned too
+	extra     int64 // candidate events that were not served
+	lastError string
+}
+
+// shadowQueries copies a share of client queries to candidate upstreams,
+// so relays considered for QUERY_REMOTES can be evaluated with real traffic
+// before being promoted. The candidates are queried alongside the query
+// remotes with the same filter and their events are only counted, never
+// served. Each gets its latency to the first event and to EOSE, its errors
+// and timeouts, and its coverage: the share of the events served to the
+// client that it returned as well, and the events it returned that were not
+// served. Comparisons are skipped when the client closed the subscription
+// before the query remotes were done, or when either side returned more
+// than shadowMaxIDs events.
+type shadowQueries struct {
+	remotes []string
+	percent int
+	pool    *nostr.SimplePool
+	slots   chan struct{}
+	mu      sync.Mutex
+	relays  map[string]*shadowRemoteStats // by normalized URL
+	// stats
+	sampled    int64
+	busy       int64
+	incomplete int64
+}
+
+// newShadowQueries creates shadowing of percent percent of queries to remotes
+func newShadowQueries(remotes []string, percent int) *shadowQueries {
+	s := &shadowQueries{
+		percent: min(max(percent, 0), 100),
+		slots:   make(chan struct{}, ShadowMaxInFlight),
+		relays:  map[string]*shadowRemoteStats{},
+	}
+	for _, url := range remotes {
+		url = nostr.NormalizeURL(url)
+		if _, ok := s.relays[url]; ok {
+			continue
+		}
+		s.remotes = append(s.remotes, url)
+		s.relays[url] = &shadowRemoteStats{}
+	}
+	return s
+}
+
+// Init creates the connection pool of the candidates. It stays private even
+// with SHARED_POOL: candidates are by definition relays not in use yet, so
+// sharing would save no connection, and a private pool keeps their trial
+// traffic under its own bandwidth role and out of the shared pool's stats.
+func (s *shadowQueries) Init() {
+	s.pool = nostr.NewSimplePool(withBandwidthRole(context.Background(), bandwidthRoleShadow))
+	logging.Info("query shadowing: %d%% of queries copied to %d candidate relays", s.percent, len(s.remotes))
+}
+
+// Close closes the connections to the candidates
+func (s *shadowQueries) Close() {
+	s.pool.Close("shutting down")
+}
+
+// Wrap copies a sample of the client queries answered by next to the
+// candidates, and watches the events next serves to compare them with
+func (s *shadowQueries) Wrap(next queryFunc) queryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := next(ctx, filter)
+		if err != nil || !isExternalQuery(ctx) || rand.IntN(100) >= s.percent {
+			return ch, err
+		}
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			atomic.AddInt64(&s.busy, 1)
+			return ch, nil
+		}
+		atomic.AddInt64(&s.sampled, 1)
+
+		// ids of the served events, nil when they cannot be compared
+		served := make(chan map[string]struct{}, 1)
+		go s.shadow(filter, served)
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			ids := map[string]struct{}{}
+			for evt := range ch {
+				if ids != nil {
+					if len(ids) < shadowMaxIDs {
+						ids[evt.ID] = struct{}{}
+					} else {
+						ids = nil
+					}
+				}
+				out <- evt
+			}
+			if ctx.Err() != nil {
+				ids = nil
+			}
+			served <- ids
+		}()
+		return out, nil
+	}
+}
+
+// shadow queries every candidate with filter and compares what they return
+// with the ids received on served
+func (s *shadowQueries) shadow(filter nostr.Filter, served <-chan map[string]struct{}) {
+	defer func() { <-s.slots }()
+
+	results := make([]shadowResult, len(s.remotes))
+	var wg sync.WaitGroup
+	for i, url := range s.remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.query(url, filter)
+		}()
+	}
+	wg.Wait()
+	ids := <-served
+	if ids == nil {
+		atomic.AddInt64(&s.incomplete, 1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, url := range s.remotes {
+		rs, res := s.relays[url], results[i]
+		rs.queries++
+		rs.events += int64(len(res.ids))
+		if res.firstEvent > 0 {
+			rs.firstEvents++
+			rs.firstEventTotal += res.firstEvent
+		}
+		switch {
+		case errors.Is(res.err, context.DeadlineExceeded):
+			rs.timeouts++
+		case res.err != nil:
+			rs.errors++
+			rs.lastError = res.err.Error()
+		default:
+			rs.eoses++
+			rs.eoseTotal += res.eose
+		}
+		if ids == nil || res.err != nil || res.truncated {
+			continue
+		}
+		rs.compared++
+		rs.expected += int64(len(ids))
+		for id := range res.ids {
+			if _, ok := ids[id]; ok {
+				rs.matched++
+			} else {
+				rs.extra++
+			}
+		}
+	}
+}
+
+// query runs filter on the candidate url until EOSE or the query timeout
+func (s *shadowQueries) query(url string, filter nostr.Filter) shadowResult {
+	res := shadowResult{ids: map[string]struct{}{}}
+	ctx, cancel := context.WithTimeout(context.Background(), relaystore.QueryTimeoutDuration)
+	defer cancel()
+	start := time.Now()
+
+	relay, err := s.pool.EnsureRelay(url)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	sub, err := relay.Subscribe(ctx, nostr.Filters{filter})
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer sub.Unsub()
+	for {
+		select {
+		case evt, ok := <-sub.Events:
+			if !ok {
+				res.err = errors.New("subscription ended before EOSE")
+				return res
+			}
+			if res.firstEvent == 0 {
+				res.firstEvent = time.Since(start)
+			}
+			if len(res.ids) < shadowMaxIDs {
+				res.ids[evt.ID] = struct{}{}
+			} else {
+				res.truncated = true
+			}
+		case <-sub.EndOfStoredEvents:
+			res.eose = time.Since(start)
+			return res
+		case reason := <-sub.ClosedReason:
+			res.err = errors.New("closed: " + reason)
+			return res
+		case <-ctx.Done():
+			res.err = ctx.Err()
+			return res
+		}
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (s *shadowQueries) GetStatsName() string {
+	return "shadow"
+}
+
+// GetStats returns stats as JsonEntity
+func (s *shadowQueries) GetStats() jsonlib.JsonEntity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := jsonlib.NewJsonList()
+	for _, url := range s.remotes {
+		rs := s.relays[url]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("relay", jsonlib.NewJsonValue(url))
+		obj.Set("queries", jsonlib.NewJsonValue(rs.queries))
+		obj.Set("errors", jsonlib.NewJsonValue(rs.errors))
+		obj.Set("timeouts", jsonlib.NewJsonValue(rs.timeouts))
+		if rs.queries > 0 {
+			obj.Set("error_rate", jsonlib.NewJsonValue(float64(rs.errors+rs.timeouts)/float64(rs.queries)))
+		}
+		if rs.eoses > 0 {
+			obj.Set("avg_eose_ms", jsonlib.NewJsonValue(rs.eoseTotal.Milliseconds()/rs.eoses))
+		}
+		if rs.firstEvents > 0 {
+			obj.Set("avg_first_event_ms", jsonlib.NewJsonValue(rs.firstEventTotal.Milliseconds()/rs.firstEvents))
+		}
+		obj.Set("events", jsonlib.NewJsonValue(rs.events))
+		obj.Set("compared_queries", jsonlib.NewJsonValue(rs.compared))
+		obj.Set("served_events", jsonlib.NewJsonValue(rs.expected))
+		obj.Set("matched_events", jsonlib.NewJsonValue(rs.matched))
+		obj.Set("extra_events", jsonlib.NewJsonValue(rs.extra))
+		if rs.expected > 0 {
+			obj.Set("coverage", jsonlib.NewJsonValue(float64(rs.matched)/float64(rs.expected)))
+		}
+		if rs.lastError != "" {
+			obj.Set("last_error", jsonlib.NewJsonValue(rs.lastError))
+		}
+		list.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("percent", jsonlib.NewJsonValue(s.percent))
+	obj.Set("sampled_queries", jsonlib.NewJsonValue(atomic.LoadInt64(&s.sampled)))
+	obj.Set("skipped_busy", jsonlib.NewJsonValue(atomic.LoadInt64(&s.busy)))
+	obj.Set("incomplete_comparisons", jsonlib.NewJsonValue(atomic.LoadInt64(&s.incomplete)))
+	obj.Set("remotes", list)
+	return obj
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Slow consumer detection for Espelho de São Miguel.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// slowConsumerNotice is sent to a client the first time it falls behind
+const slowConsumerNotice = "slow consumer: you are not reading fast enough; live events may be skipped and the connection closed"
+
+// slowConsumers finds clients that do not read what they subscribed to fast
+// enough. khatru writes each live event to every matching subscription in
+// turn, without a deadline, so a client whose socket buffer stays full stalls
+// the broadcast for everyone. Writes to clients are timed on the connection:
+// a write blocked for the stall time marks a stall. The first stall gets the
+// client a NOTICE, later ones sample the live events it gets, and a client
+// that stalls maxStalls times or blocks a write for the write timeout is
+// disconnected. While a write of a stalled client is blocked, live events
+// for it are skipped instead of waited for.
+type slowConsumers struct {
+	stall     time.Duration
+	timeout   time.Duration // 0 for writes without a deadline
+	maxStalls int64         // 0 never disconnects for stalls alone
+	keep      float64       // fraction of live events kept for slow clients
+	// stats
+	stalls       int64
+	notices      int64
+	downgraded   int64
+	skipped      int64
+	sampledOut   int64
+	disconnected int64
+	timeouts     int64
+}
+
+// slowConn times the writes to one client connection
+type slowConn struct {
+	net.Conn
+	s          *slowConsumers
+	ws         atomic.Pointer[khatru.WebSocket]
+	writeStart atomic.Int64 // unix nanoseconds, 0 when not writing
+	stalls     atomic.Int64
+	closed     atomic.Bool
+}
+
+// slowConnKey is the request context key of the slowConn
+type slowConnKey struct{}
+
+// newSlowConsumers creates the detector; keepPercent is the share of live
+// events kept for slow clients, 100 keeps them all
+func newSlowConsumers(stall, timeout time.Duration, maxStalls, keepPercent int) *slowConsumers {
+	keepPercent = max(0, min(keepPercent, 100))
+	return &slowConsumers{stall: stall, timeout: timeout, maxStalls: int64(maxStalls), keep: float64(keepPercent) / 100}
+}
+
+// Apply links connections to their websockets and skips or samples live
+// events for slow clients
+func (s *slowConsumers) Apply(r *khatru.Relay) {
+	r.OnConnect = append(r.OnConnect, func(ctx context.Context) {
+		ws := khatru.GetConnection(ctx)
+		if c := slowConnOf(ws); c != nil {
+			c.ws.Store(ws)
+		}
+	})
+	r.PreventBroadcast = append(r.PreventBroadcast, s.preventBroadcast)
+}
+
+// WrapHandler times the writes to websocket connections
+func (s *slowConsumers) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		c := &slowConn{s: s}
+		req = req.WithContext(context.WithValue(req.Context(), slowConnKey{}, c))
+		next.ServeHTTP(&slowHijacker{ResponseWriter: w, conn: c}, req)
+	})
+}
+
+// slowConnOf returns the slowConn of the connection ws, if any
+func slowConnOf(ws *khatru.WebSocket) *slowConn {
+	if ws == nil || ws.Request == nil {
+		return nil
+	}
+	c, _ := ws.Request.Context().Value(slowConnKey{}).(*slowConn)
+	return c
+}
+
+// preventBroadcast skips live events for a client blocked in a stalled
+// write and samples them for a client that stalled before
+func (s *slowConsumers) preventBroadcast(ws *khatru.WebSocket, evt *nostr.Event) bool {
+	c := slowConnOf(ws)
+	if c == nil {
+		return false
+	}
+	if start := c.writeStart.Load(); start != 0 && time.Since(time.Unix(0, start)) >= s.stall {
+		atomic.AddInt64(&s.skipped, 1)
+		return true
+	}
+	if c.stalls.Load() > 1 && !keepSample(evt.ID, s.keep) {
+		atomic.AddInt64(&s.sampledOut, 1)
+		return true
+	}
+	return false
+}
+
+// keepSample reports whether the event with id is in the kept fraction;
+// sampling is keyed on the id so every client keeps the same events
+func keepSample(id string, keep float64) bool {
+	if keep >= 1 {
+		return true
+	}
+	if keep > 0 && len(id) >= 8 {
+		if prefix, err := strconv.ParseUint(id[:8], 16, 32); err == nil && float64(prefix) < keep*(1<<32) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes to the client, noting stalls and disconnecting it when a
+// write does not finish within the timeout
+func (c *slowConn) Write(p []byte) (int, error) {
+	if c.s.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.s.timeout))
+	}
+	start := time.Now()
+	c.writeStart.Store(start.UnixNano())
+	n, err := c.Conn.Write(p)
+	c.writeStart.Store(0)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		atomic.AddInt64(&c.s.timeouts, 1)
+		c.disconnect("a write timed out")
+		return n, err
+	}
+	if err == nil && time.Since(start) >= c.s.stall {
+		c.stalled()
+	}
+	return n, err
+}
+
+// stalled escalates after a write that blocked for the stall time
+func (c *slowConn) stalled() {
+	atomic.AddInt64(&c.s.stalls, 1)
+	stalls := c.stalls.Add(1)
+	switch {
+	case c.s.maxStalls > 0 && stalls >= c.s.maxStalls:
+		c.disconnect("too many stalled writes")
+	case stalls == 1:
+		atomic.AddInt64(&c.s.notices, 1)
+		if ws := c.ws.Load(); ws != nil {
+			// the write lock is held by the write that stalled
+			go ws.WriteJSON(nostr.NoticeEnvelope(slowConsumerNotice))
+		}
+	case stalls == 2 && c.s.keep < 1:
+		atomic.AddInt64(&c.s.downgraded, 1)
+	}
+}
+
+// disconnect closes the connection, which makes khatru drop the client
+func (c *slowConn) disconnect(why string) {
+	if !c.closed.CompareAndSwap(false, true) {
+		return
+	}
+	atomic.AddInt64(&c.s.disconnected, 1)
+	addr := "unknown"
+	if ws := c.ws.Load(); ws != nil {
+		addr = khatru.GetIPFromRequest(ws.Request)
+	}
+	logging.Info("disconnecting slow client %s: %s", addr, why)
+	c.Conn.Close()
+}
+
+// slowHijacker hands khatru's websocket upgrader a connection whose writes
+// are timed
+type slowHijacker struct {
+	http.ResponseWriter
+	conn *slowConn
+}
+
+// Hijack wraps the hijacked connection; reads still go through brw
+func (h *slowHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.conn.Conn = conn
+	return h.conn, brw, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (h *slowHijacker) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// GetStatsName returns the name of this stats provider
+func (s *slowConsumers) GetStatsName() string {
+	return "slow_consumers"
+}
+
+// GetStats returns stats as JsonEntity
+func (s *slowConsumers) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("stall_threshold", jsonlib.NewJsonValue(s.stall.String()))
+	obj.Set("stalled_writes", jsonlib.NewJsonValue(atomic.LoadInt64(&s.stalls)))
+	obj.Set("notices", jsonlib.NewJsonValue(atomic.LoadInt64(&s.notices)))
+	obj.Set("downgraded", jsonlib.NewJsonValue(atomic.LoadInt64(&s.downgraded)))
+	obj.Set("skipped_events", jsonlib.NewJsonValue(atomic.LoadInt64(&s.skipped)))
+	obj.Set("sampled_out_events", jsonlib.NewJsonValue(atomic.LoadInt64(&s.sampledOut)))
+	obj.Set("write_timeouts", jsonlib.NewJsonValue(atomic.LoadInt64(&s.timeouts)))
+	obj.Set("disconnected", jsonlib.NewJsonValue(atomic.LoadInt64(&s.disconnected)))
+	return obj
+}
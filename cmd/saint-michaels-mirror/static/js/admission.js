@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2025 Girino Vey.
+
+This software is licensed under Girino's Anarchist License (GAL).
+See LICENSE file for full license text.
+License available at: https://license.girino.org/
+
+Lightning write-access purchase for Espelho de São Miguel web interface.
+*/
+
+// Request an invoice for the given pubkey and poll until it is paid
+document.getElementById('admission-form').addEventListener('submit', async function(e){
+  e.preventDefault();
+  const status = document.getElementById('admission-status');
+  const pubkey = document.getElementById('admission-pubkey').value.trim();
+  status.textContent = 'creating invoice...';
+  let invoice;
+  try{
+    const resp = await fetch('/api/v1/admission/invoice', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ pubkey: pubkey })
+    });
+    if(!resp.ok) throw new Error((await resp.text()).trim());
+    invoice = await resp.json();
+  }catch(err){
+    status.textContent = 'failed to create invoice: '+err.message;
+    return;
+  }
+
+  document.getElementById('admission-invoice').style.display = '';
+  document.getElementById('admission-invoice-link').href = 'lightning:'+invoice.bolt11;
+  document.getElementById('admission-bolt11').textContent = invoice.bolt11;
+  status.textContent = 'waiting for payment of '+invoice.amount_sat+' sats...';
+
+  const poll = async function(){
+    try{
+      const resp = await fetch('/api/v1/admission/invoice/'+invoice.payment_hash);
+      if(resp.ok){
+        const data = await resp.json();
+        if(data.paid){
+          document.getElementById('admission-invoice').style.display = 'none';
+          status.textContent = 'paid! you can publish'+(data.expires_at ? ' until '+new Date(data.expires_at*1000).toLocaleString() : '')+'.';
+          return;
+        }
+      }
+    }catch(err){
+      // keep polling through transient errors
+    }
+    setTimeout(poll, 3000);
+  };
+  setTimeout(poll, 3000);
+});
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2025 Girino Vey.
+
+This software is licensed under Girino's Anarchist License (GAL).
+See LICENSE file for full license text.
+License available at: https://license.girino.org/
+
+Upstream relay browser functionality for Espelho de São Miguel web interface.
+*/
+
+// Relays page JavaScript
+let refreshInterval;
+
+function getHealthClass(state) {
+  switch(state) {
+    case 'GREEN': return 'health-green';
+    case 'YELLOW': return 'health-yellow';
+    case 'RED': return 'health-red';
+    default: return 'health-gray';
+  }
+}
+
+function escapeHtml(text) {
+  const div = document.createElement('div');
+  div.textContent = text == null ? '' : String(text);
+  return div.innerHTML;
+}
+
+function updateLastUpdated() {
+  const now = new Date();
+  document.getElementById('last-updated').textContent = now.toLocaleTimeString();
+}
+
+function showError(message) {
+  document.getElementById('relays-content').style.display = 'none';
+  document.getElementById('loading').style.display = 'none';
+  document.getElementById('error').style.display = 'block';
+  document.getElementById('error-message').textContent = message;
+}
+
+function showRelays() {
+  document.getElementById('relays-content').style.display = 'block';
+  document.getElementById('loading').style.display = 'none';
+  document.getElementById('error').style.display = 'none';
+}
+
+function renderItem(label, value) {
+  return `
+    <div class="health-item">
+      <span class="health-label">${escapeHtml(label)}</span>
+      <span class="health-value">${value}</span>
+    </div>`;
+}
+
+function renderRelay(relay) {
+  const info = relay.nip11 || {};
+  const name = info.name || relay.url;
+  const icon = info.icon && /^https?:\/\//.test(info.icon)
+    ? `<img class="relay-icon" src="${escapeHtml(info.icon)}" alt="">`
+    : '';
+  const roles = (relay.roles || [])
+    .map(role => `<span class="nip">${escapeHtml(role)}</span>`).join('');
+  const nips = (info.supported_nips || [])
+    .map(nip => `<a class="nip" href="https://github.com/nostr-protocol/nips/blob/master/${String(nip).padStart(2, '0')}.md" target="_blank" rel="noopener">${nip}</a>`)
+    .join('');
+
+  let items = renderItem('Health',
+    `<span class="health-indicator ${getHealthClass(relay.health_state)}">${escapeHtml(relay.health_state)}</span>`);
+  if (relay.penalty_seconds > 0) {
+    items += renderItem('Penalized for', `${relay.penalty_seconds}s`);
+  }
+  if (relay.latency) {
+    items += renderItem('EOSE latency (EWMA)', `${relay.latency.ewma_eose_ms} ms`);
+    items += renderItem('Query failures', `${relay.latency.failures} / ${relay.latency.samples}`);
+  }
+  if (relay.broadcast) {
+    items += renderItem('Broadcast success', `${(relay.broadcast.success_rate * 100).toFixed(1)}%`);
+    items += renderItem('Broadcast response', `${relay.broadcast.avg_response_ms} ms`);
+  }
+  if (info.software) {
+    items += renderItem('Software', escapeHtml(`${info.software} ${info.version || ''}`));
+  }
+  if (info.error) {
+    items += renderItem('NIP-11', escapeHtml(info.error));
+  }
+
+  return `
+    <div class="card">
+      <div class="relay-header">
+        ${icon}
+        <div>
+          <div class="v"><strong>${escapeHtml(name)}</strong></div>
+          <div class="k">${escapeHtml(relay.url)}</div>
+        </div>
+      </div>
+      <div class="nips">${roles}</div>
+      ${info.description ? `<p class="k">${escapeHtml(info.description)}</p>` : ''}
+      ${items}
+      ${nips ? `<div class="nips">${nips}</div>` : ''}
+    </div>`;
+}
+
+function populateRelays(data) {
+  document.getElementById('relay-count').textContent = data.count;
+  document.getElementById('relay-list').innerHTML = (data.relays || []).map(renderRelay).join('');
+}
+
+async function fetchRelays() {
+  try {
+    const response = await fetch('/api/v1/relays');
+    if (!response.ok) {
+      throw new Error(`HTTP ${response.status}: ${response.statusText}`);
+    }
+    const data = await response.json();
+    populateRelays(data);
+    showRelays();
+    updateLastUpdated();
+  } catch (error) {
+    console.error('Error fetching relays:', error);
+    showError(`Failed to load upstream relays: ${error.message}`);
+  }
+}
+
+// Load relays immediately
+fetchRelays();
+
+// Set up auto-refresh every 60 seconds; NIP-11 documents are cached server side
+refreshInterval = setInterval(fetchRelays, 60000);
+
+// Clean up on page unload
+window.addEventListener('beforeunload', () => {
+  if (refreshInterval) {
+    clearInterval(refreshInterval);
+  }
+});
@@ -11,6 +11,9 @@ Statistics page functionality for Espelho de São Miguel web interface.
 // Stats page JavaScript
 let refreshInterval;
 
+// Version of the /api/v1/stats schema this page was written for
+const STATS_SCHEMA_VERSION = 1;
+
 function formatBytes(bytes) {
   if (bytes === 0) return '0 B';
   const k = 1024;
@@ -62,6 +65,20 @@ function populateStats(data) {
   // Application stats
   document.getElementById('app-version').textContent = data.app?.version || '-';
   document.getElementById('app-uptime').textContent = `${Math.floor((data.app?.uptime || 0) / 60)}m ${Math.floor((data.app?.uptime || 0) % 60)}s`;
+
+  // Release check, when enabled
+  const updates = data.update_check;
+  document.getElementById('app-latest-release-item').style.display = updates ? '' : 'none';
+  if (updates) {
+    const latest = document.getElementById('app-latest-release');
+    latest.textContent = updates.latest_version || '-';
+    if (updates.update_available) {
+      latest.textContent += ' (update available)';
+      latest.className = 'stat-value health-indicator status-degraded';
+    } else {
+      latest.className = 'stat-value';
+    }
+  }
   
   // Fix goroutines access - it's nested as an object with count and health_state
   const goroutineCount = data.app?.goroutines?.count ?? 0;
@@ -145,6 +162,9 @@ async function loadStats() {
     const response = await fetch('/api/v1/stats');
     if (!response.ok) throw new Error('Failed to fetch stats');
     const data = await response.json();
+    if (data.schema_version !== undefined && data.schema_version !== STATS_SCHEMA_VERSION) {
+      console.warn(`stats schema version ${data.schema_version}, dashboard expects ${STATS_SCHEMA_VERSION}`);
+    }
     
     populateStats(data);
     showStats();
@@ -0,0 +1,229 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Push-based StatsD and Graphite metrics export for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/nostr-lib/stats"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// MetricsDialTimeout bounds connecting to the metrics endpoint
+const MetricsDialTimeout = 5 * time.Second
+
+// statsdMaxPacket keeps StatsD datagrams below common MTUs
+const statsdMaxPacket = 1400
+
+// healthStateValue maps health states to numbers so they can be graphed
+var healthStateValue = map[string]float64{
+	HealthGreen:  0,
+	HealthYellow: 1,
+	"RED":        2,
+}
+
+// flattenStats walks a stats tree and calls fn with the dotted path and value
+// of every number and boolean, and of every health state. Lists are skipped.
+func flattenStats(entity jsonlib.JsonEntity, path string, fn func(name string, value float64)) {
+	switch e := entity.(type) {
+	case *jsonlib.JsonObject:
+		for _, key := range e.Keys() {
+			name := sanitizeMetricName(key)
+			if path != "" {
+				name = path + "." + name
+			}
+			flattenStats(e.GetOrNil(key), name, fn)
+		}
+	case *jsonlib.JsonValue:
+		switch e.GetType() {
+		case "int":
+			fn(path, float64(e.IntVal))
+		case "float":
+			fn(path, e.FloatVal)
+		case "bool":
+			if e.BoolVal {
+				fn(path, 1)
+			} else {
+				fn(path, 0)
+			}
+		case "string":
+			if v, ok := healthStateValue[e.StringVal]; ok && strings.HasSuffix(path, "health_state") {
+				fn(path, v)
+			}
+		}
+	}
+}
+
+// sanitizeMetricName replaces characters StatsD and Graphite treat specially
+func sanitizeMetricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// formatMetricValue renders a value without exponent notation
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// metricsExporter periodically pushes every stat to a StatsD (UDP) or
+// Graphite plaintext (TCP) endpoint. StatsD receives every value as a gauge,
+// since the collector only knows running totals.
+type metricsExporter struct {
+	protocol string // statsd or graphite
+	addr     string
+	prefix   string
+	interval time.Duration
+	// stats
+	pushes      int64
+	failures    int64
+	lastMetrics int64
+	lastPush    int64
+}
+
+// newMetricsExporter parses an endpoint like statsd://host:8125 or
+// graphite://host:2003
+func newMetricsExporter(endpoint, prefix string, interval time.Duration) (*metricsExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "statsd" && u.Scheme != "graphite" {
+		return nil, fmt.Errorf("invalid metrics endpoint %q: scheme must be statsd or graphite", endpoint)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid metrics endpoint %q: missing host:port", endpoint)
+	}
+	return &metricsExporter{
+		protocol: u.Scheme,
+		addr:     u.Host,
+		prefix:   strings.Trim(prefix, "."),
+		interval: interval,
+	}, nil
+}
+
+// Start pushes metrics every interval until ctx is cancelled
+func (m *metricsExporter) Start(ctx context.Context) {
+	logging.Info("exporting metrics to %s://%s every %v", m.protocol, m.addr, m.interval)
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := m.push(now); err != nil {
+					atomic.AddInt64(&m.failures, 1)
+					logging.Warn("metrics export to %s failed: %v", m.addr, err)
+				}
+			}
+		}
+	}()
+}
+
+// push sends one snapshot of the collector
+func (m *metricsExporter) push(now time.Time) error {
+	lines := []string{}
+	flattenStats(stats.GetCollector().GetAllStats(), m.prefix, func(name string, value float64) {
+		switch m.protocol {
+		case "statsd":
+			lines = append(lines, name+":"+formatMetricValue(value)+"|g")
+		case "graphite":
+			lines = append(lines, name+" "+formatMetricValue(value)+" "+strconv.FormatInt(now.Unix(), 10))
+		}
+	})
+
+	var err error
+	if m.protocol == "statsd" {
+		err = m.sendStatsD(lines)
+	} else {
+		err = m.sendGraphite(lines)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.pushes, 1)
+	atomic.StoreInt64(&m.lastMetrics, int64(len(lines)))
+	atomic.StoreInt64(&m.lastPush, now.Unix())
+	logging.DebugMethod("statsexport", "push", "pushed %d metrics to %s", len(lines), m.addr)
+	return nil
+}
+
+// sendStatsD sends lines as UDP datagrams of at most statsdMaxPacket bytes
+func (m *metricsExporter) sendStatsD(lines []string) error {
+	conn, err := net.DialTimeout("udp", m.addr, MetricsDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// sendGraphite sends lines over one TCP connection
+func (m *metricsExporter) sendGraphite(lines []string) error {
+	conn, err := net.DialTimeout("tcp", m.addr, MetricsDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(m.interval))
+	_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	return err
+}
+
+// GetStatsName returns the name of this stats provider
+func (m *metricsExporter) GetStatsName() string {
+	return "metrics_export"
+}
+
+// GetStats returns stats as JsonEntity
+func (m *metricsExporter) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("protocol", jsonlib.NewJsonValue(m.protocol))
+	obj.Set("endpoint", jsonlib.NewJsonValue(m.addr))
+	obj.Set("interval_seconds", jsonlib.NewJsonValue(int64(m.interval.Seconds())))
+	obj.Set("pushes", jsonlib.NewJsonValue(atomic.LoadInt64(&m.pushes)))
+	obj.Set("failures", jsonlib.NewJsonValue(atomic.LoadInt64(&m.failures)))
+	obj.Set("last_metrics", jsonlib.NewJsonValue(atomic.LoadInt64(&m.lastMetrics)))
+	obj.Set("last_push", jsonlib.NewJsonValue(atomic.LoadInt64(&m.lastPush)))
+	return obj
+}
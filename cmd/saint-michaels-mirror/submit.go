@@ -0,0 +1,239 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// HTTP event submission endpoint for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip70"
+)
+
+// Event submission tuning
+const (
+	// EventSubmitMaxBodySize caps the body of one submission, matching
+	// khatru's default websocket message size
+	EventSubmitMaxBodySize = 512000
+	// eventSubmitPollInterval is how often the broadcast results are checked
+	// while waiting for them
+	eventSubmitPollInterval = 200 * time.Millisecond
+)
+
+// khatruHTTPAuthKey is the context key khatru reads the pubkey of HTTP
+// authenticated requests from. khatru does not export it, but GetAuthed
+// falls back to it when there is no websocket connection, so policies see
+// NIP-98 signers as authenticated. TestKhatruContextKeys pins it.
+const khatruHTTPAuthKey = 2
+
+// eventSubmitter serves POST /api/v1/event, taking one signed event as JSON
+// and handing it to the relay exactly as if it had arrived in an EVENT over
+// a websocket: the connection rate limit, or the rate of its API key, NIP-70,
+// every reject policy and SaveEvent, then delivery to subscribed clients. It is meant for serverless
+// publishers and webhooks that cannot hold a websocket. A NIP-98
+// Authorization header is optional and counts as AUTH when present. The
+// response tells whether the event was accepted and, when broadcast results
+// are logged, how each upstream relay answered, waiting up to maxWait for
+// them. Submitting the same event again is safe: it is answered as a
+// duplicate with the results of the first submission.
+type eventSubmitter struct {
+	relay      *khatru.Relay
+	serviceURL *serviceURLResolver
+	results    *broadcastLog
+	maxWait    time.Duration
+	// stats
+	submitted    int64
+	accepted     int64
+	duplicates   int64
+	rejected     int64
+	invalid      int64
+	unauthorized int64
+}
+
+// newEventSubmitter creates the endpoint, reporting results from the
+// broadcast log if not nil
+func newEventSubmitter(relay *khatru.Relay, serviceURL *serviceURLResolver, results *broadcastLog, maxWait time.Duration) *eventSubmitter {
+	return &eventSubmitter{relay: relay, serviceURL: serviceURL, results: results, maxWait: maxWait}
+}
+
+// HandleSubmit serves the submission endpoint; ?wait=<duration> shortens how
+// long it waits for the broadcast results, 0 not to wait at all
+func (s *eventSubmitter) HandleSubmit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, reject := range s.relay.RejectConnection {
+		if !hasAPIKey(req) && reject(req) {
+			atomic.AddInt64(&s.rejected, 1)
+			http.Error(w, "rate-limited: too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+	wait := s.maxWait
+	if raw := req.URL.Query().Get("wait"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, s.maxWait)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, EventSubmitMaxBodySize))
+	if err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	atomic.AddInt64(&s.submitted, 1)
+
+	ctx := req.Context()
+	if req.Header.Get("Authorization") != "" {
+		pubkey, err := verifyHTTPAuth(req, s.serviceURL, body)
+		if err != nil {
+			atomic.AddInt64(&s.unauthorized, 1)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx = context.WithValue(ctx, khatruHTTPAuthKey, pubkey)
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(body, &evt); err != nil {
+		atomic.AddInt64(&s.invalid, 1)
+		s.respond(w, req, evt.ID, errors.New("invalid: event json could not be parsed"), 0)
+		return
+	}
+	if err := validateImportedEvent(&evt); err != nil {
+		atomic.AddInt64(&s.invalid, 1)
+		s.respond(w, req, evt.ID, err, 0)
+		return
+	}
+	s.respond(w, req, evt.ID, s.add(ctx, &evt), wait)
+}
+
+// add runs evt through the relay's write path
+func (s *eventSubmitter) add(ctx context.Context, evt *nostr.Event) error {
+	if nip70.IsProtected(*evt) {
+		switch khatru.GetAuthed(ctx) {
+		case "":
+			atomic.AddInt64(&s.rejected, 1)
+			return errors.New("auth-required: must be published by authenticated event author")
+		case evt.PubKey:
+		default:
+			atomic.AddInt64(&s.rejected, 1)
+			return errors.New("blocked: must be published by event author")
+		}
+	} else if nip70.HasEmbeddedProtected(*evt) {
+		atomic.AddInt64(&s.rejected, 1)
+		return errors.New("blocked: can't repost nip70 protected")
+	}
+
+	skipBroadcast, err := s.relay.AddEvent(ctx, evt)
+	switch {
+	case err == nil:
+		atomic.AddInt64(&s.accepted, 1)
+		if !skipBroadcast {
+			s.relay.BroadcastEvent(evt)
+		}
+	case relayerrors.Prefix(err) == relayerrors.PrefixDuplicate:
+		atomic.AddInt64(&s.duplicates, 1)
+	default:
+		atomic.AddInt64(&s.rejected, 1)
+		logging.DebugMethod("submit", "add", "event %s rejected: %v", evt.ID, err)
+	}
+	return err
+}
+
+// respond writes the outcome of submitting event id, waiting up to wait for
+// the broadcast results of accepted events
+func (s *eventSubmitter) respond(w http.ResponseWriter, req *http.Request, id string, err error, wait time.Duration) {
+	ok, status := true, http.StatusOK
+	obj := jsonlib.NewJsonObject()
+	obj.Set("id", jsonlib.NewJsonValue(id))
+	if err != nil {
+		obj.Set("message", jsonlib.NewJsonValue(err.Error()))
+		if prefix := relayerrors.Prefix(err); prefix != relayerrors.PrefixDuplicate {
+			ok, status = false, rejectionStatus(prefix)
+		}
+	}
+	obj.Set("ok", jsonlib.NewJsonValue(ok))
+	if ok {
+		if wait > 0 {
+			extendWriteDeadline(w, wait)
+		}
+		if result := s.waitResult(req.Context(), id, wait); result != nil {
+			obj.Set("broadcast", result)
+		}
+	}
+	writeJSONEntity(w, req, status, obj)
+}
+
+// waitResult returns the broadcast results of event id once publishing it is
+// done, or as they stand after wait; nil if they are not logged
+func (s *eventSubmitter) waitResult(ctx context.Context, id string, wait time.Duration) *jsonlib.JsonObject {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(eventSubmitPollInterval)
+	defer ticker.Stop()
+	for {
+		result, done, ok := s.results.Result(id)
+		if !ok || done {
+			return result
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return result
+		case <-ctx.Done():
+			return result
+		}
+	}
+}
+
+// rejectionStatus maps the prefix of a rejected event or filter to an HTTP
+// status
+func rejectionStatus(prefix string) int {
+	switch prefix {
+	case relayerrors.PrefixInvalid:
+		return http.StatusBadRequest
+	case relayerrors.PrefixAuthRequired:
+		return http.StatusUnauthorized
+	case relayerrors.PrefixRateLimited:
+		return http.StatusTooManyRequests
+	case relayerrors.PrefixError:
+		return http.StatusBadGateway
+	}
+	return http.StatusForbidden
+}
+
+// GetStatsName returns the name of this stats provider
+func (s *eventSubmitter) GetStatsName() string {
+	return "event_endpoint"
+}
+
+// GetStats returns stats as JsonEntity
+func (s *eventSubmitter) GetStats() jsonlib.JsonEntity {
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_wait_seconds", jsonlib.NewJsonValue(s.maxWait.Seconds()))
+	obj.Set("submitted", jsonlib.NewJsonValue(atomic.LoadInt64(&s.submitted)))
+	obj.Set("accepted", jsonlib.NewJsonValue(atomic.LoadInt64(&s.accepted)))
+	obj.Set("duplicates", jsonlib.NewJsonValue(atomic.LoadInt64(&s.duplicates)))
+	obj.Set("rejected", jsonlib.NewJsonValue(atomic.LoadInt64(&s.rejected)))
+	obj.Set("invalid", jsonlib.NewJsonValue(atomic.LoadInt64(&s.invalid)))
+	obj.Set("unauthorized", jsonlib.NewJsonValue(atomic.LoadInt64(&s.unauthorized)))
+	return obj
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream TLS diagnostics for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// TLSProbeTimeout bounds the connection and handshake of a TLS probe
+const TLSProbeTimeout = 10 * time.Second
+
+// tlsCauses lists the causes reported by relayerrors.TLSCause, in stats order
+var tlsCauses = []string{
+	relayerrors.TLSExpired,
+	relayerrors.TLSNotYetValid,
+	relayerrors.TLSHostnameMismatch,
+	relayerrors.TLSUnknownAuthority,
+	relayerrors.TLSInvalidCertificate,
+	relayerrors.TLSProtocol,
+}
+
+// tlsRelayFailures are the TLS failures of one upstream
+type tlsRelayFailures struct {
+	failures    int64
+	lastCause   string
+	lastError   string
+	lastFailure time.Time
+}
+
+// tlsDiagnostics tells TLS failures of upstream connections apart from other
+// connection errors: an expired certificate or one served for the wrong name
+// won't go away by retrying, unlike a refused connection, and needs the relay
+// operator told. Failures are counted by cause and by relay, and logged as a
+// warning whenever a relay fails with a new cause. Probe performs a one-off
+// handshake with a relay to see its certificates.
+type tlsDiagnostics struct {
+	mu           sync.Mutex
+	causes       map[string]int64
+	relays       map[string]*tlsRelayFailures // by normalized URL
+	dialFailures int64                        // connection failures not caused by TLS
+	probes       int64
+}
+
+// newTLSDiagnostics creates empty diagnostics
+func newTLSDiagnostics() *tlsDiagnostics {
+	return &tlsDiagnostics{causes: map[string]int64{}, relays: map[string]*tlsRelayFailures{}}
+}
+
+// Observe records err when it is a TLS failure talking to url, and tells if
+// it was
+func (t *tlsDiagnostics) Observe(url string, err error) bool {
+	cause := relayerrors.TLSCause(err)
+	if cause == "" {
+		return false
+	}
+	url = nostr.NormalizeURL(url)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.causes[cause]++
+	rf, ok := t.relays[url]
+	if !ok {
+		rf = &tlsRelayFailures{}
+		t.relays[url] = rf
+	}
+	rf.failures++
+	rf.lastError = err.Error()
+	rf.lastFailure = time.Now()
+	if rf.lastCause != cause {
+		rf.lastCause = cause
+		logging.Warn("TLS failure connecting to %s (%s): %v", url, cause, err)
+		return true
+	}
+	logging.DebugMethod("tlsdiag", "Observe", "TLS failure connecting to %s (%s): %v", url, cause, err)
+	return true
+}
+
+// DialFailure records a failed connection to url, TLS or not
+func (t *tlsDiagnostics) DialFailure(url string, err error) {
+	if t.Observe(url, err) {
+		return
+	}
+	t.mu.Lock()
+	t.dialFailures++
+	t.mu.Unlock()
+}
+
+// tlsProbeCertificate is one certificate of the chain a relay presented
+type tlsProbeCertificate struct {
+	Subject       string    `json:"subject"`
+	Issuer        string    `json:"issuer"`
+	DNSNames      []string  `json:"dns_names,omitempty"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	ExpiresInDays int       `json:"expires_in_days"`
+}
+
+// tlsProbeResult is the outcome of a TLS probe
+type tlsProbeResult struct {
+	Relay           string                `json:"relay"`
+	Address         string                `json:"address"`
+	ServerName      string                `json:"server_name"`
+	OK              bool                  `json:"ok"`
+	Stage           string                `json:"stage,omitempty"` // dial or handshake, when failed
+	Cause           string                `json:"cause,omitempty"`
+	Error           string                `json:"error,omitempty"`
+	HandshakeMs     int64                 `json:"handshake_ms,omitempty"`
+	Version         string                `json:"version,omitempty"`
+	CipherSuite     string                `json:"cipher_suite,omitempty"`
+	ALPN            string                `json:"alpn,omitempty"`
+	HostnameMatches *bool                 `json:"hostname_matches,omitempty"`
+	Certificates    []tlsProbeCertificate `json:"certificates,omitempty"`
+}
+
+// Probe connects to relay, a wss:// URL, and performs a TLS handshake with
+// it. When the certificate fails verification, a second handshake without
+// verification fetches the chain so the result shows what is wrong with it.
+func (t *tlsDiagnostics) Probe(ctx context.Context, relay string) (tlsProbeResult, error) {
+	u, err := neturl.Parse(nostr.NormalizeURL(relay))
+	if err != nil || u.Hostname() == "" {
+		return tlsProbeResult{}, errors.New("invalid relay URL")
+	}
+	if u.Scheme != "wss" {
+		return tlsProbeResult{}, errors.New("not a wss:// relay URL")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	result := tlsProbeResult{
+		Relay:      u.String(),
+		Address:    net.JoinHostPort(u.Hostname(), port),
+		ServerName: u.Hostname(),
+	}
+	t.mu.Lock()
+	t.probes++
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, TLSProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	state, stage, err := tlsHandshake(ctx, result.Address, &tls.Config{ServerName: result.ServerName, NextProtos: []string{"http/1.1"}})
+	result.HandshakeMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Stage = stage
+		result.Cause = relayerrors.TLSCause(err)
+		result.Error = err.Error()
+		if stage == "dial" || result.Cause == relayerrors.TLSProtocol {
+			return result, nil
+		}
+		// see the certificates that failed verification
+		state, _, err = tlsHandshake(ctx, result.Address, &tls.Config{ServerName: result.ServerName, NextProtos: []string{"http/1.1"}, InsecureSkipVerify: true})
+		if err != nil {
+			return result, nil
+		}
+	} else {
+		result.OK = true
+	}
+
+	result.Version = tls.VersionName(state.Version)
+	result.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	result.ALPN = state.NegotiatedProtocol
+	if len(state.PeerCertificates) > 0 {
+		matches := state.PeerCertificates[0].VerifyHostname(result.ServerName) == nil
+		result.HostnameMatches = &matches
+	}
+	now := time.Now()
+	for _, cert := range state.PeerCertificates {
+		result.Certificates = append(result.Certificates, tlsProbeCertificateOf(cert, now))
+	}
+	return result, nil
+}
+
+// tlsHandshake dials address and performs a handshake with config. On
+// failure it tells the stage that failed, dial or handshake.
+func tlsHandshake(ctx context.Context, address string, config *tls.Config) (tls.ConnectionState, string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return tls.ConnectionState{}, "dial", err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, "handshake", err
+	}
+	return tlsConn.ConnectionState(), "", nil
+}
+
+// tlsProbeCertificateOf describes cert as of now
+func tlsProbeCertificateOf(cert *x509.Certificate, now time.Time) tlsProbeCertificate {
+	return tlsProbeCertificate{
+		Subject:       cert.Subject.String(),
+		Issuer:        cert.Issuer.String(),
+		DNSNames:      cert.DNSNames,
+		NotBefore:     cert.NotBefore.UTC(),
+		NotAfter:      cert.NotAfter.UTC(),
+		ExpiresInDays: int(cert.NotAfter.Sub(now).Hours() / 24),
+	}
+}
+
+// HandleProbe serves GET ?relay=wss://... with a TLS probe of the relay
+func (t *tlsDiagnostics) HandleProbe(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relay := req.URL.Query().Get("relay")
+	if relay == "" {
+		http.Error(w, "missing relay parameter", http.StatusBadRequest)
+		return
+	}
+	result, err := t.Probe(req.Context(), relay)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, data)
+}
+
+// GetStatsName returns the name of this stats provider
+func (t *tlsDiagnostics) GetStatsName() string {
+	return "upstream_tls"
+}
+
+// GetStats returns stats as JsonEntity
+func (t *tlsDiagnostics) GetStats() jsonlib.JsonEntity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	causes := jsonlib.NewJsonObject()
+	total := int64(0)
+	for _, cause := range tlsCauses {
+		causes.Set(cause, jsonlib.NewJsonValue(t.causes[cause]))
+		total += t.causes[cause]
+	}
+	urls := make([]string, 0, len(t.relays))
+	for url := range t.relays {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	list := jsonlib.NewJsonList()
+	for _, url := range urls {
+		rf := t.relays[url]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("relay", jsonlib.NewJsonValue(url))
+		obj.Set("failures", jsonlib.NewJsonValue(rf.failures))
+		obj.Set("last_cause", jsonlib.NewJsonValue(rf.lastCause))
+		obj.Set("last_error", jsonlib.NewJsonValue(rf.lastError))
+		obj.Set("last_failure", jsonlib.NewJsonValue(rf.lastFailure.Unix()))
+		list.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("tls_failures", jsonlib.NewJsonValue(total))
+	obj.Set("by_cause", causes)
+	obj.Set("other_dial_failures", jsonlib.NewJsonValue(t.dialFailures))
+	obj.Set("probes", jsonlib.NewJsonValue(t.probes))
+	obj.Set("relays", list)
+	return obj
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Release announcement checks for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Release announcements are NIP-78 application data events
+const (
+	// KindAppData is the kind of NIP-78 application data
+	KindAppData = 30078
+	// ReleaseAnnouncementD is the d tag of the release announcement
+	ReleaseAnnouncementD = "saint-michaels-mirror/release"
+	// DefaultReleaseAnnouncer is the npub that signs the project's releases
+	DefaultReleaseAnnouncer = "npub18lav8fkgt8424rxamvk8qq4xuy9n8mltjtgztv2w44hc5tt9vets0hcfsz"
+	// DefaultReleaseRelay is where release announcements are published
+	DefaultReleaseRelay = "wss://relay.ngit.dev"
+	// UpdateCheckTimeout bounds one check against all announcement relays
+	UpdateCheckTimeout = 30 * time.Second
+)
+
+// releaseAnnouncement is the content of a release announcement
+type releaseAnnouncement struct {
+	Version string `json:"version"`
+	URL     string `json:"url,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+}
+
+// updateChecker periodically reads the latest release announced by the
+// project's key and compares it with the running Version. Announcements are
+// NIP-78 application data (kind 30078, d tag "saint-michaels-mirror/release")
+// whose content is {"version":"v1.2.3","url":"...","notes":"..."}, so the
+// check only needs Nostr relays, not GitHub. Development builds are never
+// reported as outdated.
+type updateChecker struct {
+	current  string
+	pubkey   string
+	relays   []string
+	interval time.Duration
+	mu       sync.Mutex
+	latest   *releaseAnnouncement
+	checked  time.Time
+	lastErr  string
+	// stats
+	checks   int64
+	failures int64
+}
+
+// newUpdateChecker creates a checker of the releases announced by pubkey (hex
+// or npub) on relays, every interval
+func newUpdateChecker(current, pubkey string, relays []string, interval time.Duration) (*updateChecker, error) {
+	hex, err := parsePubKey(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPDATE_CHECK_PUBKEY: %w", err)
+	}
+	if len(relays) == 0 {
+		return nil, errors.New("UPDATE_CHECK_RELAYS is empty")
+	}
+	return &updateChecker{current: current, pubkey: hex, relays: relays, interval: interval}, nil
+}
+
+// Start checks right away and then every interval until ctx is done
+func (u *updateChecker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+		for {
+			u.check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// check fetches the newest announcement and warns when it is newer than the
+// running version
+func (u *updateChecker) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, UpdateCheckTimeout)
+	defer cancel()
+	latest, err := u.fetch(ctx)
+
+	u.mu.Lock()
+	u.checks++
+	u.checked = time.Now()
+	if err != nil {
+		u.failures++
+		u.lastErr = err.Error()
+		u.mu.Unlock()
+		logging.DebugMethod("updatecheck", "check", "release check failed: %v", err)
+		return
+	}
+	u.lastErr = ""
+	u.latest = latest
+	u.mu.Unlock()
+
+	if isNewerVersion(latest.Version, u.current) {
+		logging.Warn("running %s, but %s %s is available: %s", u.current, ProjectName, latest.Version, latest.URL)
+	}
+}
+
+// fetch returns the newest valid announcement found on any relay
+func (u *updateChecker) fetch(ctx context.Context) (*releaseAnnouncement, error) {
+	filter := nostr.Filter{
+		Kinds:   []int{KindAppData},
+		Authors: []string{u.pubkey},
+		Tags:    nostr.TagMap{"d": []string{ReleaseAnnouncementD}},
+	}
+	var newest *nostr.Event
+	var lastErr error
+	for _, url := range u.relays {
+		relay, err := nostr.RelayConnect(ctx, url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		events, err := relay.QuerySync(ctx, filter)
+		relay.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, evt := range events {
+			if ok, _ := evt.CheckSignature(); ok && (newest == nil || evt.CreatedAt > newest.CreatedAt) {
+				newest = evt
+			}
+		}
+	}
+	if newest == nil {
+		if lastErr == nil {
+			lastErr = errors.New("no release announcement found")
+		}
+		return nil, lastErr
+	}
+	var latest releaseAnnouncement
+	if err := json.Unmarshal([]byte(newest.Content), &latest); err != nil || latest.Version == "" {
+		return nil, fmt.Errorf("invalid release announcement %s", newest.ID)
+	}
+	return &latest, nil
+}
+
+// UpdateAvailable reports whether a newer release than the running one was
+// announced
+func (u *updateChecker) UpdateAvailable() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.latest != nil && isNewerVersion(u.latest.Version, u.current)
+}
+
+// parseVersion splits a version such as "v1.2.3-rc1" into its numbers and
+// pre-release suffix; ok is false for anything else, e.g. "dev"
+func parseVersion(v string) (numbers []int, pre string, ok bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, pre, _ = strings.Cut(v, "-")
+	if v == "" {
+		return nil, "", false
+	}
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, pre, true
+}
+
+// isNewerVersion reports whether candidate is a later release than current;
+// unparseable versions, such as development builds, are never older
+func isNewerVersion(candidate, current string) bool {
+	cand, candPre, ok := parseVersion(candidate)
+	if !ok {
+		return false
+	}
+	cur, curPre, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := 0; i < max(len(cand), len(cur)); i++ {
+		var a, b int
+		if i < len(cand) {
+			a = cand[i]
+		}
+		if i < len(cur) {
+			b = cur[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	// a release is newer than its pre-releases
+	switch {
+	case candPre == curPre:
+		return false
+	case candPre == "":
+		return true
+	case curPre == "":
+		return false
+	}
+	return candPre > curPre
+}
+
+// GetStatsName returns the name of this stats provider
+func (u *updateChecker) GetStatsName() string {
+	return "update_check"
+}
+
+// GetStats returns stats as JsonEntity
+func (u *updateChecker) GetStats() jsonlib.JsonEntity {
+	available := u.UpdateAvailable()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("current_version", jsonlib.NewJsonValue(u.current))
+	obj.Set("update_available", jsonlib.NewJsonValue(available))
+	if u.latest != nil {
+		obj.Set("latest_version", jsonlib.NewJsonValue(u.latest.Version))
+		if u.latest.URL != "" {
+			obj.Set("latest_url", jsonlib.NewJsonValue(u.latest.URL))
+		}
+	}
+	if !u.checked.IsZero() {
+		obj.Set("checked_at", jsonlib.NewJsonValue(u.checked.Unix()))
+	}
+	if u.lastErr != "" {
+		obj.Set("last_error", jsonlib.NewJsonValue(u.lastErr))
+	}
+	obj.Set("checks", jsonlib.NewJsonValue(u.checks))
+	obj.Set("failures", jsonlib.NewJsonValue(u.failures))
+	return obj
+}
@@ -17,3 +17,18 @@ const ProjectName = "Espelho de São Miguel"
 //
 // Default value is for non-ldflags development builds.
 var Version = "dev"
+
+// Commit and BuildDate identify the build. They can be set at build time
+// like Version; when empty they are read from the VCS information the Go
+// toolchain stamps into binaries built from a git checkout.
+var (
+	Commit    = ""
+	BuildDate = ""
+)
+
+// License is the license the software is distributed under, and LicenseURL
+// where its text is published
+const (
+	License    = "Girino's Anarchist License (GAL)"
+	LicenseURL = "https://license.girino.org/"
+)
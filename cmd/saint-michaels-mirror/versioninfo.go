@@ -0,0 +1,118 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Version and behavior changelog endpoint for Espelho de São Miguel.
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// changelogJSON lists the changes of each release that affect how the relay
+// behaves towards clients, newest first
+//
+//go:embed changelog.json
+var changelogJSON []byte
+
+// changelogChange is one behavior-affecting change: a NIP added, a policy
+// added, or a setting whose default or meaning changed
+type changelogChange struct {
+	Type    string  `json:"type"`
+	NIP     int     `json:"nip,omitempty"`
+	Policy  string  `json:"policy,omitempty"`
+	Setting string  `json:"setting,omitempty"`
+	Default *string `json:"default,omitempty"`
+	Summary string  `json:"summary"`
+}
+
+// changelogRelease is the changes of one release
+type changelogRelease struct {
+	Version string            `json:"version"`
+	Date    string            `json:"date,omitempty"`
+	Changes []changelogChange `json:"changes"`
+}
+
+// versionInfo is served at /api/v1/version
+type versionInfo struct {
+	Name          string             `json:"name"`
+	Version       string             `json:"version"`
+	Commit        string             `json:"commit"`
+	BuildDate     string             `json:"build_date"`
+	Modified      bool               `json:"modified"`
+	GoVersion     string             `json:"go_version"`
+	License       string             `json:"license"`
+	LicenseURL    string             `json:"license_url"`
+	SupportedNIPs []any              `json:"supported_nips"`
+	Features      map[string]bool    `json:"features"`
+	Changelog     []changelogRelease `json:"changelog"`
+}
+
+// loadChangelog parses the embedded changelog
+func loadChangelog() []changelogRelease {
+	var doc struct {
+		Releases []changelogRelease `json:"releases"`
+	}
+	if err := json.Unmarshal(changelogJSON, &doc); err != nil {
+		// the file ships with the binary, so this is a build mistake
+		logging.Fatal("parsing embedded changelog: %v", err)
+	}
+	return doc.Releases
+}
+
+// newVersionHandler serves GET of the version, build, license, supported
+// NIPs and active features of the relay, with the changelog of behavior
+// changes, so client developers can tell which behavior a mirror runs.
+// ?since=<version> only lists the releases after that one.
+func newVersionHandler(r *khatru.Relay, features map[string]bool) http.HandlerFunc {
+	changelog := loadChangelog()
+	build := readBuildInfo()
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		releases := changelog
+		if since := req.URL.Query().Get("since"); since != "" {
+			i := slices.IndexFunc(changelog, func(release changelogRelease) bool { return release.Version == since })
+			if i < 0 {
+				http.Error(w, "unknown version "+since, http.StatusBadRequest)
+				return
+			}
+			releases = changelog[:i]
+		}
+		// the NIPs of the NIP-11 document as served, after the overwrites of
+		// the operation mode
+		relayInfo := *r.Info
+		for _, overwrite := range r.OverwriteRelayInformation {
+			relayInfo = overwrite(req.Context(), req, relayInfo)
+		}
+		info := versionInfo{
+			Name:          ProjectName,
+			Version:       Version,
+			Commit:        build.commit,
+			BuildDate:     build.date,
+			Modified:      build.modified,
+			GoVersion:     build.goVersion,
+			License:       License,
+			LicenseURL:    LicenseURL,
+			SupportedNIPs: relayInfo.SupportedNIPs,
+			Features:      features,
+			Changelog:     releases,
+		}
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, req, http.StatusOK, data)
+	}
+}
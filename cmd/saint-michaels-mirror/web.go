@@ -0,0 +1,286 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// HTML pages and static assets for Espelho de São Miguel.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+)
+
+// webCacheMaxEntries bounds the rendered variants cached per page, e.g. one
+// per host name the relay is reached at
+const webCacheMaxEntries = 64
+
+// webRouteStats counts the requests of one route
+type webRouteStats struct {
+	requests   int64
+	cacheHits  int64
+	errors     int64 // answered with 5xx
+	totalNanos int64
+	maxNanos   int64
+}
+
+// observe records one request that took elapsed and was answered with status
+func (s *webRouteStats) observe(elapsed time.Duration, status int) {
+	atomic.AddInt64(&s.requests, 1)
+	if status >= http.StatusInternalServerError {
+		atomic.AddInt64(&s.errors, 1)
+	}
+	atomic.AddInt64(&s.totalNanos, int64(elapsed))
+	for {
+		prev := atomic.LoadInt64(&s.maxNanos)
+		if int64(elapsed) <= prev || atomic.CompareAndSwapInt64(&s.maxNanos, prev, int64(elapsed)) {
+			return
+		}
+	}
+}
+
+// webPage is one page rendered from a template on top of the base template
+type webPage struct {
+	route string
+	file  string
+	build func(req *http.Request) (any, error)
+	stats *webRouteStats
+	// guarded by webPages.mu
+	tpl   *template.Template
+	cache map[[sha256.Size]byte][]byte // by view model fingerprint
+}
+
+// webPages serves the HTML pages and static assets. Rendered pages are
+// cached by a fingerprint of their view model, so a page is only executed
+// again when something it shows changes, e.g. the host it is reached at or
+// the relay identity. On SIGHUP the templates and the Markdown documents are
+// parsed again and the cache is dropped, so page edits need no restart; a
+// template that fails to parse leaves the previous one in use.
+type webPages struct {
+	baseFile  string
+	mu        sync.RWMutex
+	pages     []*webPage
+	documents []*markdownPage
+	routes    map[string]*webRouteStats
+	// stats
+	reloads      int64
+	reloadErrors int64
+	lastReload   time.Time
+}
+
+// newWebPages creates the pages, all based on the template in baseFile
+func newWebPages(baseFile string) *webPages {
+	return &webPages{baseFile: baseFile, routes: map[string]*webRouteStats{}}
+}
+
+// route returns the stats of route, creating them; w.mu must be held
+func (w *webPages) route(route string) *webRouteStats {
+	s, ok := w.routes[route]
+	if !ok {
+		s = &webRouteStats{}
+		w.routes[route] = s
+	}
+	return s
+}
+
+// Page parses the page template in file and returns the handler of route,
+// rendering the view model returned by build
+func (w *webPages) Page(route, file string, build func(req *http.Request) (any, error)) (http.HandlerFunc, error) {
+	tpl, err := template.ParseFiles(w.baseFile, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template %s: %w", file, err)
+	}
+	w.mu.Lock()
+	p := &webPage{route: route, file: file, build: build, stats: w.route(route), tpl: tpl, cache: map[[sha256.Size]byte][]byte{}}
+	w.pages = append(w.pages, p)
+	w.mu.Unlock()
+	return func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		status := w.serve(rw, req, p)
+		p.stats.observe(time.Since(start), status)
+	}, nil
+}
+
+// serve renders p, or writes its cached rendering, and returns the status
+func (w *webPages) serve(rw http.ResponseWriter, req *http.Request, p *webPage) int {
+	vm, err := p.build(req)
+	if err != nil {
+		http.Error(rw, "template render error", http.StatusInternalServerError)
+		logging.Error("%s template execute error: %v", p.route, err)
+		return http.StatusInternalServerError
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%#v", vm)))
+
+	w.mu.RLock()
+	body, ok := p.cache[key]
+	tpl := p.tpl
+	w.mu.RUnlock()
+	if ok {
+		atomic.AddInt64(&p.stats.cacheHits, 1)
+	} else {
+		var b bytes.Buffer
+		if err := tpl.Execute(&b, vm); err != nil {
+			http.Error(rw, "template render error", http.StatusInternalServerError)
+			logging.Error("%s template execute error: %v", p.route, err)
+			return http.StatusInternalServerError
+		}
+		body = b.Bytes()
+		w.mu.Lock()
+		if p.tpl == tpl {
+			if len(p.cache) >= webCacheMaxEntries {
+				clear(p.cache)
+			}
+			p.cache[key] = body
+		}
+		w.mu.Unlock()
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write(body)
+	return http.StatusOK
+}
+
+// AddDocument reloads the Markdown document p with the templates
+func (w *webPages) AddDocument(p *markdownPage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.documents = append(w.documents, p)
+}
+
+// webStatusRecorder remembers the status of a response
+type webStatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records status
+func (s *webStatusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *webStatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Static counts the requests h serves as route
+func (w *webPages) Static(route string, h http.Handler) http.Handler {
+	w.mu.Lock()
+	stats := w.route(route)
+	w.mu.Unlock()
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &webStatusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		stats.observe(time.Since(start), rec.status)
+	})
+}
+
+// Reload parses every template and document again and drops the cached
+// pages. Those failing to parse are kept as they were.
+func (w *webPages) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for _, p := range w.pages {
+		tpl, err := template.ParseFiles(w.baseFile, p.file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse template %s: %w", p.file, err))
+			continue
+		}
+		p.tpl = tpl
+		clear(p.cache)
+	}
+	for _, d := range w.documents {
+		if err := d.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	w.reloads++
+	w.lastReload = time.Now()
+	if len(errs) > 0 {
+		w.reloadErrors++
+	}
+	return errors.Join(errs...)
+}
+
+// Start reloads the templates on SIGHUP until ctx is done
+func (w *webPages) Start(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				if err := w.Reload(); err != nil {
+					logging.Error("reloading page templates: %v", err)
+					continue
+				}
+				logging.Info("page templates reloaded")
+			}
+		}
+	}()
+}
+
+// GetStatsName returns the name of this stats provider
+func (w *webPages) GetStatsName() string {
+	return "web"
+}
+
+// GetStats returns stats as JsonEntity
+func (w *webPages) GetStats() jsonlib.JsonEntity {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	cached := map[string]int{}
+	for _, p := range w.pages {
+		cached[p.route] = len(p.cache)
+	}
+	list := jsonlib.NewJsonList()
+	for _, route := range slices.Sorted(maps.Keys(w.routes)) {
+		s := w.routes[route]
+		requests := atomic.LoadInt64(&s.requests)
+		avg := int64(0)
+		if requests > 0 {
+			avg = atomic.LoadInt64(&s.totalNanos) / requests
+		}
+		obj := jsonlib.NewJsonObject()
+		obj.Set("route", jsonlib.NewJsonValue(route))
+		obj.Set("requests", jsonlib.NewJsonValue(requests))
+		obj.Set("errors", jsonlib.NewJsonValue(atomic.LoadInt64(&s.errors)))
+		obj.Set("avg_latency_ms", jsonlib.NewJsonValue(float64(avg)/float64(time.Millisecond)))
+		obj.Set("max_latency_ms", jsonlib.NewJsonValue(float64(atomic.LoadInt64(&s.maxNanos))/float64(time.Millisecond)))
+		if n, ok := cached[route]; ok {
+			obj.Set("cache_hits", jsonlib.NewJsonValue(atomic.LoadInt64(&s.cacheHits)))
+			obj.Set("cached_variants", jsonlib.NewJsonValue(n))
+		}
+		list.Append(obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("routes", list)
+	obj.Set("reloads", jsonlib.NewJsonValue(w.reloads))
+	obj.Set("reload_errors", jsonlib.NewJsonValue(w.reloadErrors))
+	if !w.lastReload.IsZero() {
+		obj.Set("last_reload", jsonlib.NewJsonValue(w.lastReload.Unix()))
+	}
+	return obj
+}
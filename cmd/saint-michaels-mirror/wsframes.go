@@ -0,0 +1,175 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Client websocket frame inspection for Espelho de São Miguel.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+)
+
+// clientFrameMaxInspect is the largest websocket frame inspected; larger
+// frames are passed through unchanged
+const clientFrameMaxInspect = 64 << 10
+
+// frameInspector sees every single-frame text message a client sends before
+// khatru does and returns a replacement, or nil to pass it on unchanged.
+// skipped is called for text messages it cannot see: fragmented or too large.
+type frameInspector struct {
+	inspect func(msg []byte) []byte
+	skipped func()
+}
+
+// frameHijacker hands khatru's websocket upgrader a connection whose incoming
+// frames go through an inspector. Hijackers stack, each reading the stream
+// of the one it wraps.
+type frameHijacker struct {
+	http.ResponseWriter
+	inspector frameInspector
+}
+
+// Hijack wraps the hijacked connection
+func (h *frameHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	fc := &clientFrameConn{Conn: conn, src: brw.Reader, inspector: h.inspector}
+	return fc, bufio.NewReadWriter(bufio.NewReader(fc), brw.Writer), nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (h *frameHijacker) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// clientFrameConn reads client websocket frames one at a time and hands
+// single-frame text messages to its inspector, inflating compressed ones.
+// Everything else is passed through unchanged.
+type clientFrameConn struct {
+	net.Conn
+	src         *bufio.Reader
+	inspector   frameInspector
+	pending     []byte
+	passthrough int64 // payload bytes left of a frame passed through
+}
+
+// Read returns the next bytes of the inspected stream
+func (c *clientFrameConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// next fills pending with the next frame, or the next chunk of a frame
+// passed through
+func (c *clientFrameConn) next() error {
+	if c.passthrough > 0 {
+		buf := make([]byte, min(c.passthrough, 32<<10))
+		n, err := c.src.Read(buf)
+		c.passthrough -= int64(n)
+		c.pending = buf[:n]
+		if n > 0 {
+			return nil
+		}
+		return err
+	}
+
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(c.src, header); err != nil {
+		return err
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.src, ext); err != nil {
+			return err
+		}
+		header = append(header, ext...)
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.src, ext); err != nil {
+			return err
+		}
+		header = append(header, ext...)
+		length = int64(binary.BigEndian.Uint64(ext) & (1<<63 - 1))
+	}
+	masked := header[1]&0x80 != 0
+	if masked {
+		key := make([]byte, 4)
+		if _, err := io.ReadFull(c.src, key); err != nil {
+			return err
+		}
+		header = append(header, key...)
+	}
+
+	fin, compressed, opcode := header[0]&0x80 != 0, header[0]&0x40 != 0, header[0]&0x0f
+	if !fin || opcode != 1 || !masked || length > clientFrameMaxInspect {
+		if (opcode == 1 || opcode == 0) && c.inspector.skipped != nil {
+			c.inspector.skipped()
+		}
+		c.pending = header
+		c.passthrough = length
+		return nil
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.src, payload); err != nil {
+		return err
+	}
+	key := header[len(header)-4:]
+	msg := make([]byte, length)
+	for i := range payload {
+		msg[i] = payload[i] ^ key[i%4]
+	}
+	if compressed {
+		// the upgrader only agrees to client_no_context_takeover, so each
+		// message inflates on its own; one that does not is passed through
+		inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(io.MultiReader(bytes.NewReader(msg), bytes.NewReader([]byte{0, 0, 0xff, 0xff}))), clientFrameMaxInspect+1))
+		if (err != nil && err != io.ErrUnexpectedEOF) || len(inflated) > clientFrameMaxInspect {
+			if c.inspector.skipped != nil {
+				c.inspector.skipped()
+			}
+			c.pending = append(header, payload...)
+			return nil
+		}
+		msg = inflated
+	}
+	rewritten := c.inspector.inspect(msg)
+	if rewritten == nil {
+		c.pending = append(header, payload...)
+		return nil
+	}
+
+	// sent uncompressed; a zero mask key leaves the payload as is
+	frame := []byte{header[0] &^ 0x40}
+	switch n := len(rewritten); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	c.pending = append(frame, rewritten...)
+	return nil
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the client websocket frame inspection for Espelho de São Miguel.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Websocket opcodes used by the tests
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+)
+
+// testFrame is a decoded client frame
+type testFrame struct {
+	fin        bool
+	compressed bool
+	opcode     byte
+	key        [4]byte
+	payload    []byte // unmasked
+}
+
+// encode returns f as a masked client frame
+func (f testFrame) encode() []byte {
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	if f.compressed {
+		b0 |= 0x40
+	}
+	frame := []byte{b0}
+	switch n := len(f.payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, f.key[:]...)
+	for i, b := range f.payload {
+		frame = append(frame, b^f.key[i%4])
+	}
+	return frame
+}
+
+// decodeFrames splits a stream of masked client frames
+func decodeFrames(t *testing.T, stream []byte) []testFrame {
+	t.Helper()
+	var frames []testFrame
+	for len(stream) > 0 {
+		if len(stream) < 2 || stream[1]&0x80 == 0 {
+			t.Fatalf("truncated or unmasked frame: %x", stream)
+		}
+		f := testFrame{fin: stream[0]&0x80 != 0, compressed: stream[0]&0x40 != 0, opcode: stream[0] & 0x0f}
+		length, offset := int(stream[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, offset = int(binary.BigEndian.Uint16(stream[2:])), 4
+		case 127:
+			length, offset = int(binary.BigEndian.Uint64(stream[2:])), 10
+		}
+		copy(f.key[:], stream[offset:offset+4])
+		offset += 4
+		if len(stream) < offset+length {
+			t.Fatalf("frame payload truncated: want %d bytes, have %d", length, len(stream)-offset)
+		}
+		for i, b := range stream[offset : offset+length] {
+			f.payload = append(f.payload, b^f.key[i%4])
+		}
+		frames = append(frames, f)
+		stream = stream[offset+length:]
+	}
+	return frames
+}
+
+// deflateMessage compresses msg as permessage-deflate without context
+// takeover does
+func deflateMessage(t *testing.T, msg []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(msg)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+}
+
+// recordingInspector records what it is shown and rewrites messages with
+// rewrite, when set
+type recordingInspector struct {
+	seen    []string
+	skipped int
+	rewrite func(msg string) string
+}
+
+// inspector returns the frameInspector of r
+func (r *recordingInspector) inspector() frameInspector {
+	return frameInspector{
+		inspect: func(msg []byte) []byte {
+			r.seen = append(r.seen, string(msg))
+			if r.rewrite == nil {
+				return nil
+			}
+			if rewritten := r.rewrite(string(msg)); rewritten != "" {
+				return []byte(rewritten)
+			}
+			return nil
+		},
+		skipped: func() { r.skipped++ },
+	}
+}
+
+// readThrough returns the stream as clientFrameConn hands it on
+func readThrough(t *testing.T, stream []byte, inspector frameInspector) []byte {
+	t.Helper()
+	conn := &clientFrameConn{src: bufio.NewReader(bytes.NewReader(stream)), inspector: inspector}
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading through clientFrameConn: %v", err)
+	}
+	return out
+}
+
+func TestClientFrameConnPassesFramesThrough(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	var stream []byte
+	for _, f := range []testFrame{
+		{fin: true, opcode: opText, key: key, payload: []byte(`["REQ","a",{}]`)},
+		{fin: true, opcode: opPing, key: key, payload: []byte("ping")},
+		// a fragmented message with a control frame between its fragments
+		{fin: false, opcode: opText, key: key, payload: []byte(`["REQ","b",`)},
+		{fin: true, opcode: opPing, key: key},
+		{fin: true, opcode: opContinuation, key: key, payload: []byte(`{}]`)},
+		{fin: true, opcode: opBinary, key: key, payload: []byte{0, 1, 2}},
+		{fin: true, opcode: opClose, key: key, payload: []byte{0x03, 0xe8}},
+	} {
+		stream = append(stream, f.encode()...)
+	}
+
+	rec := &recordingInspector{}
+	out := readThrough(t, stream, rec.inspector())
+	if !bytes.Equal(out, stream) {
+		t.Fatalf("stream changed without rewrites:\n got %x\nwant %x", out, stream)
+	}
+	if len(rec.seen) != 1 || rec.seen[0] != `["REQ","a",{}]` {
+		t.Errorf("inspected %q, want only the single-frame text message", rec.seen)
+	}
+	if rec.skipped != 2 {
+		t.Errorf("skipped %d frames, want the 2 fragments", rec.skipped)
+	}
+}
+
+func TestClientFrameConnRewritesTextFrames(t *testing.T) {
+	key := [4]byte{0xa1, 0xb2, 0xc3, 0xd4}
+	long := `["REQ","long",{"search":"` + strings.Repeat("x", 300) + `"}]`
+	var stream []byte
+	for _, f := range []testFrame{
+		{fin: true, opcode: opText, key: key, payload: []byte(`["REQ","a",{"&t":["x"]}]`)},
+		{fin: true, opcode: opPing, key: key, payload: []byte("p")},
+		{fin: true, opcode: opText, key: key, payload: []byte(long)},
+		{fin: true, opcode: opText, key: key, payload: []byte(`["CLOSE","a"]`)},
+	} {
+		stream = append(stream, f.encode()...)
+	}
+
+	rec := &recordingInspector{rewrite: func(msg string) string {
+		if strings.HasPrefix(msg, `["REQ"`) {
+			return strings.Replace(msg, `"REQ"`, `"REQ" `, 1) + strings.Repeat(" ", 200)
+		}
+		return ""
+	}}
+	frames := decodeFrames(t, readThrough(t, stream, rec.inspector()))
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want 4", len(frames))
+	}
+	for i, want := range []string{
+		strings.Replace(`["REQ","a",{"&t":["x"]}]`, `"REQ"`, `"REQ" `, 1) + strings.Repeat(" ", 200),
+		"p",
+		strings.Replace(long, `"REQ"`, `"REQ" `, 1) + strings.Repeat(" ", 200),
+		`["CLOSE","a"]`,
+	} {
+		if got := string(frames[i].payload); got != want {
+			t.Errorf("frame %d payload %q, want %q", i, got, want)
+		}
+		if !frames[i].fin {
+			t.Errorf("frame %d lost its FIN bit", i)
+		}
+	}
+	if frames[0].opcode != opText || frames[1].opcode != opPing || frames[2].opcode != opText {
+		t.Errorf("opcodes changed: %d %d %d", frames[0].opcode, frames[1].opcode, frames[2].opcode)
+	}
+	if frames[3].key != key {
+		t.Errorf("frame not rewritten was re-masked with %x", frames[3].key)
+	}
+}
+
+func TestClientFrameConnInflatesCompressedFrames(t *testing.T) {
+	key := [4]byte{9, 8, 7, 6}
+	first := `["REQ","a",{"kinds":[1]}]`
+	second := `["REQ","b",{"kinds":[1]}]`
+	var stream []byte
+	for _, f := range []testFrame{
+		{fin: true, compressed: true, opcode: opText, key: key, payload: deflateMessage(t, []byte(first))},
+		{fin: true, compressed: true, opcode: opText, key: key, payload: deflateMessage(t, []byte(second))},
+		// a compressed message split in fragments is not inspected
+		{fin: false, compressed: true, opcode: opText, key: key, payload: deflateMessage(t, []byte(first))},
+		{fin: true, opcode: opContinuation, key: key},
+		// not valid deflate data: passed through as received
+		{fin: true, compressed: true, opcode: opText, key: key, payload: []byte{0xff, 0xff, 0xff}},
+	} {
+		stream = append(stream, f.encode()...)
+	}
+
+	rec := &recordingInspector{rewrite: func(msg string) string {
+		if strings.Contains(msg, `"b"`) {
+			return strings.Replace(msg, `"b"`, `"rewritten"`, 1)
+		}
+		return ""
+	}}
+	out := readThrough(t, stream, rec.inspector())
+	if len(rec.seen) != 2 || rec.seen[0] != first || rec.seen[1] != second {
+		t.Fatalf("inspected %q, want the two inflated single-frame messages", rec.seen)
+	}
+	if rec.skipped != 3 {
+		t.Errorf("skipped %d frames, want the 2 fragments and the invalid frame", rec.skipped)
+	}
+
+	frames := decodeFrames(t, out)
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5", len(frames))
+	}
+	want := decodeFrames(t, stream)
+	if !bytes.Equal(frames[0].encode(), want[0].encode()) {
+		t.Errorf("compressed frame not rewritten was changed")
+	}
+	if frames[1].compressed || string(frames[1].payload) != `["REQ","rewritten",{"kinds":[1]}]` {
+		t.Errorf("rewritten frame is compressed=%v with payload %q, want it uncompressed", frames[1].compressed, frames[1].payload)
+	}
+	for i := 2; i < 5; i++ {
+		if !bytes.Equal(frames[i].encode(), want[i].encode()) {
+			t.Errorf("frame %d was changed", i)
+		}
+	}
+}
+
+// TestClientFrameConnWithContextTakeover covers clients compressing with
+// context takeover: the upgrader only agrees to client_no_context_takeover,
+// and a message that still refers back to an earlier one cannot be inflated
+// on its own, so it is passed through as received instead of being
+// inspected as garbage.
+func TestClientFrameConnWithContextTakeover(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	rec := &recordingInspector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(&frameHijacker{ResponseWriter: w, inspector: rec.inspector()}, req, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	// offered without client_no_context_takeover, so the client may keep
+	// its context unless the server says otherwise
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upgrade request: %v", err)
+	}
+	resp.Body.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") || !strings.Contains(ext, "client_no_context_takeover") {
+		t.Fatalf("upgrader answered extensions %q, want client_no_context_takeover", ext)
+	}
+
+	// a client ignoring that keeps one compressor for every message; at
+	// this level the second message refers back to the first
+	key := [4]byte{1, 2, 3, 4}
+	msg := `["REQ","sub",{"kinds":[1],"authors":["` + strings.Repeat("ab", 32) + `"]}]`
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	var stream []byte
+	for range 2 {
+		buf.Reset()
+		w.Write([]byte(msg))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		payload := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+		stream = append(stream, testFrame{fin: true, compressed: true, opcode: opText, key: key, payload: slices.Clone(payload)}.encode()...)
+	}
+
+	rec = &recordingInspector{rewrite: func(string) string { return "rewritten" }}
+	out := readThrough(t, stream, rec.inspector())
+	if len(rec.seen) != 1 || rec.seen[0] != msg {
+		t.Fatalf("inspected %q, want only the first message", rec.seen)
+	}
+	if rec.skipped != 1 {
+		t.Errorf("skipped %d frames, want the one relying on the previous message", rec.skipped)
+	}
+	frames, want := decodeFrames(t, out), decodeFrames(t, stream)
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	if !bytes.Equal(frames[1].encode(), want[1].encode()) {
+		t.Error("frame relying on the previous message was changed")
+	}
+}
+
+func TestClientFrameConnPassesLargeFramesThrough(t *testing.T) {
+	key := [4]byte{5, 5, 5, 5}
+	large := testFrame{fin: true, opcode: opText, key: key, payload: bytes.Repeat([]byte("a"), clientFrameMaxInspect+1)}
+	medium := testFrame{fin: true, opcode: opText, key: key, payload: bytes.Repeat([]byte("b"), 1000)}
+	stream := append(large.encode(), medium.encode()...)
+
+	rec := &recordingInspector{}
+	out := readThrough(t, stream, rec.inspector())
+	if !bytes.Equal(out, stream) {
+		t.Fatalf("stream changed without rewrites")
+	}
+	if rec.skipped != 1 || len(rec.seen) != 1 || len(rec.seen[0]) != 1000 {
+		t.Errorf("skipped %d and inspected %d messages, want the large one skipped and the other inspected", rec.skipped, len(rec.seen))
+	}
+}
+
+// TestFrameHijackerWithUpgrader runs clients through the websocket upgrader
+// khatru uses, with and without permessage-deflate and with messages
+// fragmented, and checks the server reads every message, rewritten or not,
+// intact.
+func TestFrameHijackerWithUpgrader(t *testing.T) {
+	for _, compression := range []bool{true, false} {
+		name := "uncompressed"
+		if compression {
+			name = "compressed"
+		}
+		t.Run(name, func(t *testing.T) { testFrameHijackerWithUpgrader(t, compression) })
+	}
+}
+
+func testFrameHijackerWithUpgrader(t *testing.T, compression bool) {
+	rec := &recordingInspector{rewrite: func(msg string) string {
+		if strings.HasPrefix(msg, "rewrite ") {
+			return "rewritten " + strings.TrimPrefix(msg, "rewrite ")
+		}
+		return ""
+	}}
+	received := make(chan string, 16)
+	pings := make(chan string, 4)
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(&frameHijacker{ResponseWriter: w, inspector: rec.inspector()}, req, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(data string) error {
+			pings <- data
+			return nil
+		})
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	}))
+	defer server.Close()
+
+	// a small write buffer splits long messages in fragments
+	dialer := websocket.Dialer{EnableCompression: compression, WriteBufferSize: 256}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); negotiated != compression {
+		t.Fatalf("permessage-deflate negotiated=%v, want %v", negotiated, compression)
+	}
+
+	// hex of a hash chain, which deflate cannot shrink below the buffer
+	var long strings.Builder
+	sum := sha256.Sum256([]byte("seed"))
+	for long.Len() < 4000 {
+		long.WriteString(hex.EncodeToString(sum[:]))
+		sum = sha256.Sum256(sum[:])
+	}
+	fragmented := "rewrite " + long.String()
+	messages := []string{"plain", "rewrite me", fragmented, "after the rewrite", "rewrite again"}
+	want := []string{"plain", "rewritten me", fragmented, "after the rewrite", "rewritten again"}
+	for i, msg := range messages {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if i == 2 {
+			if err := conn.WriteControl(websocket.PingMessage, []byte("are you there"), time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("ping: %v", err)
+			}
+		}
+	}
+	for i, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("message %d: server read %.40q, want %.40q", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server read %d of %d messages", i, len(want))
+		}
+	}
+	select {
+	case got := <-pings:
+		if got != "are you there" {
+			t.Errorf("ping payload %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping not received")
+	}
+	if rec.skipped == 0 {
+		t.Error("the fragmented message was not skipped")
+	}
+}
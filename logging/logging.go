@@ -0,0 +1,122 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package logging is the logging of Espelho de São Miguel. It keeps the API
+// of nostr-lib's logging package, but holds the verbose filters in an
+// immutable configuration swapped atomically, so they can be changed at
+// runtime while every goroutine checks them. nostr-lib's logging keeps its
+// filters in unsynchronized globals, so it is only configured once, at
+// startup, with SetLibraryVerbose; nostr-lib's own packages keep that
+// setting.
+package logging
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+
+	nostrlogging "github.com/girino/nostr-lib/logging"
+)
+
+// verboseConfig is a parsed VERBOSE setting; it is never modified once stored
+type verboseConfig struct {
+	all     bool
+	filters map[string]bool
+}
+
+// config is the active verbose configuration, nil while verbose logging is off
+var config atomic.Pointer[verboseConfig]
+
+// SetVerbose sets the verbose logging mode with granular filtering, with the
+// syntax of nostr-lib's logging.SetVerbose:
+//   - "" or "false": disable all verbose logging
+//   - "true" or "all": enable all verbose logging
+//   - "relaystore,mirror": enable verbose for the relaystore and mirror modules
+//   - "relaystore.QueryEvents,main": enable one method and all of main
+//
+// It is safe to call while other goroutines log.
+func SetVerbose(verboseStr string) {
+	if verboseStr == "" || verboseStr == "false" {
+		config.Store(nil)
+		return
+	}
+	if verboseStr == "true" || verboseStr == "all" {
+		config.Store(&verboseConfig{all: true})
+		return
+	}
+	filters := map[string]bool{}
+	for _, filter := range strings.Split(verboseStr, ",") {
+		if filter = strings.TrimSpace(filter); filter != "" {
+			filters[filter] = true
+		}
+	}
+	if len(filters) == 0 {
+		config.Store(nil)
+		return
+	}
+	config.Store(&verboseConfig{filters: filters})
+}
+
+// SetLibraryVerbose configures the verbose logging of nostr-lib's packages.
+// It is not safe for concurrent use and must only be called at startup,
+// before any nostr-lib component runs.
+func SetLibraryVerbose(verboseStr string) {
+	nostrlogging.SetVerbose(verboseStr)
+}
+
+// Enabled reports whether verbose logging is enabled for any module
+func Enabled() bool {
+	return config.Load() != nil
+}
+
+// IsVerbose checks if verbose logging is enabled for a specific module or method
+func IsVerbose(module string, method string) bool {
+	c := config.Load()
+	if c == nil {
+		return false
+	}
+	if c.all {
+		return true
+	}
+	if method != "" && c.filters[module+"."+method] {
+		return true
+	}
+	return c.filters[module]
+}
+
+// DebugMethod logs debug messages for a specific module.method (only in verbose mode)
+func DebugMethod(module string, method string, format string, v ...interface{}) {
+	if IsVerbose(module, method) {
+		log.Printf("[DEBUG] "+module+"."+method+": "+format, v...)
+	}
+}
+
+// Debug logs debug messages when all verbose logging is enabled
+func Debug(format string, v ...interface{}) {
+	if c := config.Load(); c != nil && c.all {
+		log.Printf("[DEBUG] "+format, v...)
+	}
+}
+
+// Info logs informational messages (always shown)
+func Info(format string, v ...interface{}) {
+	nostrlogging.Info(format, v...)
+}
+
+// Warn logs warning messages (always shown)
+func Warn(format string, v ...interface{}) {
+	nostrlogging.Warn(format, v...)
+}
+
+// Error logs error messages (always shown)
+func Error(format string, v ...interface{}) {
+	nostrlogging.Error(format, v...)
+}
+
+// Fatal logs error messages and exits with status code 1
+func Fatal(format string, v ...interface{}) {
+	nostrlogging.Fatal(format, v...)
+}
@@ -0,0 +1,505 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Mirror - Nostr relay mirroring functionality.
+//
+// This package started as a copy of the mirror package of
+// github.com/girino/nostr-lib v0.0.0-20251027142055-a7108048b09e, vendored to
+// add the observer hooks the relay needs, and has diverged since. Fixes made
+// to it upstream must be ported here by hand.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MirrorManager handles continuous mirroring of events from query relays to the khatru relay
+type MirrorManager struct {
+	// queryUrls are the remotes used for mirroring events
+	queryUrls []string
+	urlsMu    sync.RWMutex
+	// pool manages connections for query remotes
+	pool *relaypool.Role
+	// ownPool is set when the pool is private to the mirror
+	ownPool bool
+	// observer, when set, sees every event delivered by query remotes
+	observer EventObserver
+	// sampleRates is the fraction of events of each kind that is rebroadcast;
+	// kinds not listed are always rebroadcast
+	sampleRates map[int]float64
+	sampledMu   sync.Mutex
+	sampledOut  map[int]int64 // by kind
+	// mirrored, when set, sees every event considered for rebroadcast
+	mirrored MirroredObserver
+	// trust, when set, holds back the events of low-trust relays
+	trust *trustGate
+	// dryRun counts mirrored events without rebroadcasting them to clients
+	dryRun        bool
+	dryRunSkipped int64
+	// mirroring state; lifecycleMu guards relay, mirrorCtx and mirrorCancel
+	// and serializes starting and stopping
+	lifecycleMu    sync.Mutex
+	relay          *khatru.Relay
+	mirrorCtx      context.Context
+	mirrorCancel   context.CancelFunc
+	mirroredEvents int64
+	// mirroring health tracking
+	mirrorSuccesses           int64
+	mirrorFailures            int64
+	consecutiveMirrorFailures int64
+	// relay health tracking
+	liveRelays int64
+	deadRelays int64
+	// initial connections
+	connectDeadline time.Duration
+	connectJitter   time.Duration
+	startupMu       sync.Mutex
+	startup         StartupStats
+}
+
+// MirrorStats holds runtime counters for mirroring operations
+type MirrorStats struct {
+	MirroredEvents            int64  `json:"mirrored_events"`
+	MirrorSuccesses           int64  `json:"mirror_successes"`
+	MirrorFailures            int64  `json:"mirror_failures"`
+	ConsecutiveMirrorFailures int64  `json:"consecutive_mirror_failures"`
+	MirrorHealthState         string `json:"mirror_health_state"`
+	// Relay health statistics
+	LiveRelays int64 `json:"live_relays"`
+	DeadRelays int64 `json:"dead_relays"`
+	// Events not rebroadcast because of kind sampling
+	SampledOut       int64         `json:"sampled_out"`
+	SampledOutByKind map[int]int64 `json:"sampled_out_by_kind"`
+}
+
+// Health state constants
+const (
+	HealthGreen  = "GREEN"
+	HealthYellow = "YELLOW"
+	HealthRed    = "RED"
+)
+
+// EventObserver is notified of every event id an upstream relay delivers,
+// including copies of an event already delivered by another relay.
+type EventObserver func(relayURL string, id string)
+
+// MirroredObserver is told of every event considered for rebroadcast and
+// whether it passed kind sampling
+type MirroredObserver func(evt *nostr.Event, rebroadcast bool)
+
+// NewMirrorManager creates a new MirrorManager with the provided query URLs
+func NewMirrorManager(queryUrls []string) *MirrorManager {
+	return &MirrorManager{
+		queryUrls:  slices.Clone(queryUrls),
+		sampledOut: map[int]int64{},
+	}
+}
+
+// SetEventObserver registers fn to be told which relay delivered which event.
+// It must be called before Init.
+func (m *MirrorManager) SetEventObserver(fn EventObserver) {
+	m.observer = fn
+}
+
+// SetMirroredObserver registers fn to see the events considered for
+// rebroadcast. It must be called before StartMirroring.
+func (m *MirrorManager) SetMirroredObserver(fn MirroredObserver) {
+	m.mirrored = fn
+}
+
+// SetPool makes the mirror connect through a pool shared with other
+// components. It must be called before Init, which otherwise creates a
+// private pool.
+func (m *MirrorManager) SetPool(pool *relaypool.Role) {
+	m.pool = pool
+}
+
+// SetDryRun makes the mirror count and log the events it would rebroadcast
+// without sending them to clients. It must be called before StartMirroring.
+func (m *MirrorManager) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+// SetSampleRates makes the mirror rebroadcast only the given fraction
+// (0 to 1) of the events of each listed kind. Sampling is keyed on the event
+// id, so every instance with the same rates keeps the same events.
+func (m *MirrorManager) SetSampleRates(rates map[int]float64) {
+	m.sampleRates = rates
+}
+
+// sampled reports whether evt passes kind sampling, counting those that don't
+func (m *MirrorManager) sampled(evt *nostr.Event) bool {
+	rate, ok := m.sampleRates[evt.Kind]
+	if !ok || rate >= 1 {
+		return true
+	}
+	if rate > 0 && len(evt.ID) >= 8 {
+		if prefix, err := strconv.ParseUint(evt.ID[:8], 16, 32); err == nil && float64(prefix) < rate*(1<<32) {
+			return true
+		}
+	}
+	m.sampledMu.Lock()
+	m.sampledOut[evt.Kind]++
+	m.sampledMu.Unlock()
+	return false
+}
+
+// Init initializes the mirror manager
+func (m *MirrorManager) Init() error {
+	// No default query remotes - must be provided
+	if len(m.queryUrls) == 0 {
+		return fmt.Errorf("no query remotes provided - mirror manager requires query remotes")
+	}
+
+	// create a private pool unless one is shared with other components
+	if m.pool == nil {
+		opts := []nostr.PoolOption{nostr.WithPenaltyBox()}
+		if m.trust != nil {
+			opts = append(opts, nostr.WithRelayOptions(m.trust.tiers))
+		}
+		m.pool = relaypool.New(context.Background(), opts...).Role(relaypool.RoleMirror)
+		m.ownPool = true
+	}
+	if m.observer != nil {
+		m.pool.Pool().SetEventObserver(relaypool.EventObserver(m.observer))
+	}
+
+	logging.DebugMethod("mirror", "Init", "query remotes: %v", m.queryUrls)
+	return nil
+}
+
+// Close stops mirroring and closes the connections of a private pool; a
+// shared pool is closed by its owner
+func (m *MirrorManager) Close() {
+	m.StopMirroring()
+	if m.ownPool {
+		m.pool.Pool().Close()
+	}
+}
+
+// GetStatsName returns the name of this stats provider
+func (m *MirrorManager) GetStatsName() string {
+	return "mirror"
+}
+
+// GetStats returns stats as JsonEntity
+func (m *MirrorManager) GetStats() jsonlib.JsonEntity {
+	s := m.Stats()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("mirrored_events", jsonlib.NewJsonValue(s.MirroredEvents))
+	obj.Set("mirror_successes", jsonlib.NewJsonValue(s.MirrorSuccesses))
+	obj.Set("mirror_failures", jsonlib.NewJsonValue(s.MirrorFailures))
+	obj.Set("consecutive_mirror_failures", jsonlib.NewJsonValue(s.ConsecutiveMirrorFailures))
+	obj.Set("mirror_health_state", jsonlib.NewJsonValue(s.MirrorHealthState))
+	obj.Set("live_relays", jsonlib.NewJsonValue(s.LiveRelays))
+	obj.Set("dead_relays", jsonlib.NewJsonValue(s.DeadRelays))
+	obj.Set("sampled_out", jsonlib.NewJsonValue(s.SampledOut))
+	if m.dryRun {
+		obj.Set("dry_run_skipped", jsonlib.NewJsonValue(atomic.LoadInt64(&m.dryRunSkipped)))
+	}
+	m.startupMu.Lock()
+	startup := jsonlib.NewJsonObject()
+	startup.Set("connected", jsonlib.NewJsonValue(m.startup.Connected))
+	startup.Set("deferred", jsonlib.NewJsonValue(m.startup.Deferred))
+	startup.Set("took_ms", jsonlib.NewJsonValue(m.startup.Took.Milliseconds()))
+	m.startupMu.Unlock()
+	obj.Set("startup_connections", startup)
+	kinds := make([]int, 0, len(s.SampledOutByKind))
+	for kind := range s.SampledOutByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+	byKind := jsonlib.NewJsonObject()
+	for _, kind := range kinds {
+		byKind.Set(strconv.Itoa(kind), jsonlib.NewJsonValue(s.SampledOutByKind[kind]))
+	}
+	obj.Set("sampled_out_by_kind", byKind)
+	if m.trust != nil {
+		obj.Set("trust", m.trust.stats())
+	}
+	return obj
+}
+
+// Stats returns a snapshot of the MirrorManager counters (kept for backward compatibility)
+func (m *MirrorManager) Stats() MirrorStats {
+	consecutiveMirrorFailures := atomic.LoadInt64(&m.consecutiveMirrorFailures)
+	mirrorHealthState := m.getHealthState(consecutiveMirrorFailures)
+
+	m.sampledMu.Lock()
+	var sampledOut int64
+	sampledOutByKind := make(map[int]int64, len(m.sampledOut))
+	for kind, n := range m.sampledOut {
+		sampledOut += n
+		sampledOutByKind[kind] = n
+	}
+	m.sampledMu.Unlock()
+
+	return MirrorStats{
+		MirroredEvents:            atomic.LoadInt64(&m.mirroredEvents),
+		MirrorSuccesses:           atomic.LoadInt64(&m.mirrorSuccesses),
+		MirrorFailures:            atomic.LoadInt64(&m.mirrorFailures),
+		ConsecutiveMirrorFailures: consecutiveMirrorFailures,
+		MirrorHealthState:         mirrorHealthState,
+		LiveRelays:                atomic.LoadInt64(&m.liveRelays),
+		DeadRelays:                atomic.LoadInt64(&m.deadRelays),
+		SampledOut:                sampledOut,
+		SampledOutByKind:          sampledOutByKind,
+	}
+}
+
+// getHealthState determines the health state based on consecutive failures
+func (m *MirrorManager) getHealthState(consecutiveFailures int64) string {
+	if consecutiveFailures <= 2 {
+		return HealthGreen
+	} else if consecutiveFailures < 10 {
+		return HealthYellow
+	}
+	return HealthRed
+}
+
+// StartMirroring begins continuous mirroring of events from query relays to the khatru relay
+func (m *MirrorManager) StartMirroring(relay *khatru.Relay) error {
+	m.lifecycleMu.Lock()
+	defer m.lifecycleMu.Unlock()
+	return m.startMirroring(relay)
+}
+
+// startMirroring starts mirroring with lifecycleMu held
+func (m *MirrorManager) startMirroring(relay *khatru.Relay) error {
+	if m.mirrorCtx != nil {
+		// already started
+		return nil
+	}
+
+	m.relay = relay
+	queryUrls := m.remotes()
+	if len(queryUrls) == 0 {
+		// No query relays configured - this is OK, relay can work without mirroring
+		logging.DebugMethod("mirror", "StartMirroring", "no query relays configured, skipping mirroring")
+		return nil
+	}
+
+	// Connect to all query relays first, staggered and bounded by the deadline
+	started := time.Now()
+	liveCount := connectAll(m.pool, queryUrls, m.connectDeadline, m.connectJitter)
+	m.startupMu.Lock()
+	m.startup = StartupStats{
+		Connected: int64(liveCount),
+		Deferred:  int64(len(queryUrls) - liveCount),
+		Took:      time.Since(started),
+	}
+	m.startupMu.Unlock()
+	logging.Info("connected to %d of %d query relays in %v, %d deferred to lazy reconnect",
+		liveCount, len(queryUrls), time.Since(started).Round(time.Millisecond), len(queryUrls)-liveCount)
+
+	if liveCount == 0 {
+		// Query relays are configured but none are available - this is a fatal error
+		return fmt.Errorf("no query relays are available (configured: %d)", len(queryUrls))
+	}
+
+	logging.DebugMethod("mirror", "StartMirroring", "starting event mirroring from %d query relays (%d/%d available)", len(queryUrls), liveCount, len(queryUrls))
+
+	m.mirrorCtx, m.mirrorCancel = context.WithCancel(context.Background())
+
+	// start single mirroring goroutine for all query relays
+	go m.mirrorFromRelays(m.mirrorCtx, relay)
+
+	return nil
+}
+
+// SetQueryRemotes replaces the mirrored relays, restarting mirroring on the
+// new set if it is running
+func (m *MirrorManager) SetQueryRemotes(queryUrls []string) error {
+	m.lifecycleMu.Lock()
+	defer m.lifecycleMu.Unlock()
+	running := m.mirrorCtx != nil
+	if running {
+		m.stopMirroring()
+	}
+	m.urlsMu.Lock()
+	m.queryUrls = slices.Clone(queryUrls)
+	m.urlsMu.Unlock()
+	logging.DebugMethod("mirror", "SetQueryRemotes", "query remotes: %v", queryUrls)
+	if running {
+		return m.startMirroring(m.relay)
+	}
+	return nil
+}
+
+// remotes returns a copy of the current mirrored relays
+func (m *MirrorManager) remotes() []string {
+	m.urlsMu.RLock()
+	defer m.urlsMu.RUnlock()
+	return slices.Clone(m.queryUrls)
+}
+
+// DropConnection closes the connection to the mirrored relay url as if the
+// relay had gone away; the subscription reconnects as after any other drop.
+// It reports whether there was a connection to close.
+func (m *MirrorManager) DropConnection(url string) bool {
+	relay, ok := m.pool.SimplePool().Relays.Load(nostr.NormalizeURL(url))
+	if !ok || relay == nil || !relay.IsConnected() {
+		return false
+	}
+	logging.DebugMethod("mirror", "DropConnection", "dropping connection to %s", url)
+	relay.Close()
+	return true
+}
+
+// Remotes returns the relays currently mirrored
+func (m *MirrorManager) Remotes() []string {
+	return m.remotes()
+}
+
+// StopMirroring stops the continuous mirroring of events
+func (m *MirrorManager) StopMirroring() {
+	m.lifecycleMu.Lock()
+	defer m.lifecycleMu.Unlock()
+	m.stopMirroring()
+}
+
+// stopMirroring stops mirroring with lifecycleMu held
+func (m *MirrorManager) stopMirroring() {
+	if m.mirrorCancel != nil {
+		logging.DebugMethod("mirror", "StopMirroring", "stopping event mirroring")
+		m.mirrorCancel()
+		m.mirrorCtx = nil
+		m.mirrorCancel = nil
+	}
+}
+
+// mirrorFromRelays continuously mirrors events from all query relays
+func (m *MirrorManager) mirrorFromRelays(ctx context.Context, relay *khatru.Relay) {
+	queryUrls := m.remotes()
+	logging.DebugMethod("mirror", "mirrorFromRelays", "starting mirror from %d query relays: %v", len(queryUrls), queryUrls)
+
+	// create a filter that gets all events since now
+	now := nostr.Now()
+	filter := nostr.Filter{Since: &now}
+
+	// subscribe to all query relays at once (handles deduplication)
+	sub := m.pool.SubscribeMany(ctx, queryUrls, filter)
+
+	// Start relay health monitoring goroutine
+	go m.monitorRelayHealth(ctx)
+	if m.trust != nil && m.trust.low {
+		go m.trust.expire(ctx)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			logging.DebugMethod("mirror", "mirrorFromRelays", "mirror from query relays stopped (context cancelled)")
+			return
+		case relayEvent, ok := <-sub:
+			if !ok {
+				logging.DebugMethod("mirror", "mirrorFromRelays", "mirror subscription closed")
+				return
+			}
+
+			if relayEvent.Event != nil {
+				if m.trust != nil && !m.trust.Admit(relayEvent.Relay.URL, relayEvent.Event) {
+					logging.DebugMethod("mirror", "mirrorFromRelays", "holding event %s from low-trust relay %s", relayEvent.Event.ID, relayEvent.Relay.URL)
+					continue
+				}
+				m.rebroadcast(relay, relayEvent.Event, relayEvent.Relay.URL)
+			}
+		}
+	}
+}
+
+// rebroadcast sends an event delivered by from to the clients of relay,
+// unless it is sampled out or this is a dry run
+func (m *MirrorManager) rebroadcast(relay *khatru.Relay, evt *nostr.Event, from string) {
+	kept := m.sampled(evt)
+	if m.mirrored != nil {
+		m.mirrored(evt, kept)
+	}
+	if !kept {
+		logging.DebugMethod("mirror", "mirrorFromRelays", "sampled out kind %d event %s from %s", evt.Kind, evt.ID, from)
+		return
+	}
+	if m.dryRun {
+		atomic.AddInt64(&m.dryRunSkipped, 1)
+		atomic.AddInt64(&m.mirroredEvents, 1)
+		atomic.AddInt64(&m.mirrorSuccesses, 1)
+		logging.DebugMethod("mirror", "mirrorFromRelays", "dry run: would rebroadcast event %s from %s to clients", evt.ID, from)
+		return
+	}
+	// broadcast the event to all connected clients
+	clientCount := relay.BroadcastEvent(evt)
+	atomic.AddInt64(&m.mirroredEvents, 1)
+	atomic.AddInt64(&m.mirrorSuccesses, 1)
+	logging.DebugMethod("mirror", "mirrorFromRelays", "mirrored event %s from %s to %d clients", evt.ID, from, clientCount)
+}
+
+// monitorRelayHealth periodically checks the health of all query relays
+func (m *MirrorManager) monitorRelayHealth(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.checkRelayHealth()
+		}
+	}
+}
+
+// checkRelayHealth checks each relay and updates health counters
+func (m *MirrorManager) checkRelayHealth() {
+	queryUrls := m.remotes()
+	if len(queryUrls) == 0 {
+		return
+	}
+
+	deadCount := int64(0)
+
+	for _, url := range queryUrls {
+		_, err := m.pool.EnsureRelay(url)
+		if err != nil {
+			deadCount++
+			logging.DebugMethod("mirror", "monitorRelayHealth", "relay %s is dead: %v", url, err)
+		}
+	}
+
+	// Calculate live count from total and dead
+	totalRelays := int64(len(queryUrls))
+	liveCount := totalRelays - deadCount
+
+	// Update counters
+	atomic.StoreInt64(&m.liveRelays, liveCount)
+	atomic.StoreInt64(&m.deadRelays, deadCount)
+
+	// Check if more than half are dead
+	threshold := totalRelays / 2
+
+	if deadCount > threshold {
+		// More than half are dead - count as failure
+		atomic.AddInt64(&m.mirrorFailures, 1)
+		atomic.AddInt64(&m.consecutiveMirrorFailures, 1)
+		logging.DebugMethod("mirror", "monitorRelayHealth", "mirror health check failed: %d/%d relays dead", deadCount, totalRelays)
+	} else {
+		// Half or less are dead (more than half are alive) - reset failures
+		atomic.StoreInt64(&m.consecutiveMirrorFailures, 0)
+		logging.DebugMethod("mirror", "monitorRelayHealth", "mirror health check passed: %d/%d relays alive", liveCount, totalRelays)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Mirror - staggered initial connections to the query relays.
+package mirror
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+)
+
+// Initial connection defaults
+const (
+	DefaultInitialConnectDeadline = 10 * time.Second
+	DefaultInitialConnectJitter   = 500 * time.Millisecond
+)
+
+// StartupStats summarizes the last round of initial connections
+type StartupStats struct {
+	Connected int64         `json:"connected"`
+	Deferred  int64         `json:"deferred"`
+	Took      time.Duration `json:"took"`
+}
+
+// SetInitialConnect sets how long StartMirroring waits for the query relays
+// to connect and the maximum random delay before each attempt starts. Relays
+// not connected by the deadline are left to the pool's lazy reconnects.
+func (m *MirrorManager) SetInitialConnect(deadline, jitter time.Duration) {
+	m.connectDeadline = deadline
+	m.connectJitter = jitter
+}
+
+// connectAll connects to urls concurrently, each attempt starting after a
+// random delay of up to the jitter so a restart does not hit every relay at
+// the same instant. It returns once all attempts finish or the deadline
+// passes; attempts still running keep going in the background and their
+// relays join the pool whenever they connect.
+func connectAll(pool *relaypool.Role, urls []string, deadline, jitter time.Duration) (connected int) {
+	if deadline <= 0 {
+		deadline = DefaultInitialConnectDeadline
+	}
+	results := make(chan bool, len(urls))
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if jitter > 0 {
+				time.Sleep(rand.N(jitter))
+			}
+			_, err := pool.EnsureRelay(url)
+			if err != nil {
+				logging.DebugMethod("mirror", "connectAll", "failed initial connect to %s: %v", url, err)
+			}
+			results <- err == nil
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	for {
+		select {
+		case ok := <-results:
+			if ok {
+				connected++
+			}
+		case <-done:
+			// drain what finished together with the last attempt
+			for {
+				select {
+				case ok := <-results:
+					if ok {
+						connected++
+					}
+				default:
+					return connected
+				}
+			}
+		case <-timer.C:
+			return connected
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Relay trust tiers for the mirror of Espelho de São Miguel.
+package mirror
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Trust tiers of upstream relays
+const (
+	// TrustHigh relays are believed as they are: their events skip signature
+	// verification
+	TrustHigh = "high"
+	// TrustNormal relays have their events signature-verified by go-nostr
+	TrustNormal = "normal"
+	// TrustLow relays have their events verified again and only rebroadcast
+	// once other relays delivered them too
+	TrustLow = "low"
+)
+
+// TrustTiers maps normalized relay URLs to trust tiers; relays not listed
+// are TrustNormal
+type TrustTiers map[string]string
+
+// Tier returns the trust tier of the relay at url
+func (t TrustTiers) Tier(url string) string {
+	if tier, ok := t[nostr.NormalizeURL(url)]; ok {
+		return tier
+	}
+	return TrustNormal
+}
+
+// hasLow reports whether any relay is TrustLow
+func (t TrustTiers) hasLow() bool {
+	for _, tier := range t {
+		if tier == TrustLow {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyRelayOption turns off signature verification on connections to
+// TrustHigh relays; pass the tiers to go-nostr with nostr.WithRelayOptions
+func (t TrustTiers) ApplyRelayOption(r *nostr.Relay) {
+	if t.Tier(r.URL) == TrustHigh {
+		r.AssumeValid = true
+	}
+}
+
+// heldEvent records the relays that delivered an event and, while none of
+// them vouches for it, holds the copy of a low-trust relay
+type heldEvent struct {
+	evt    *nostr.Event
+	relays map[string]struct{}
+	added  time.Time
+}
+
+// trustGate holds the events of low-trust relays until enough relays
+// delivered them: quorum distinct relays, or any relay that is not low-trust.
+// go-nostr's SubscribeMany hands the mirror the copy of every relay, so the
+// gate sees each relay that delivers an event; the copy that vouches for a
+// held event is the one rebroadcast.
+type trustGate struct {
+	tiers  TrustTiers
+	low    bool // some relay is TrustLow
+	quorum int
+	window time.Duration
+	mu     sync.Mutex
+	held   map[string]*heldEvent // by event id
+	// stats
+	byTier       map[string]*int64
+	badSignature int64
+	heldEvents   int64
+	released     int64
+	expired      int64
+}
+
+// SetTrust assigns trust tiers to the mirrored relays. Events from low-trust
+// relays are rebroadcast only once quorum distinct relays, or one relay of a
+// higher tier, delivered them within window. It must be called before Init.
+func (m *MirrorManager) SetTrust(tiers TrustTiers, quorum int, window time.Duration) {
+	m.trust = &trustGate{
+		tiers:  tiers,
+		low:    tiers.hasLow(),
+		quorum: max(quorum, 1),
+		window: window,
+		held:   map[string]*heldEvent{},
+		byTier: map[string]*int64{TrustHigh: new(int64), TrustNormal: new(int64), TrustLow: new(int64)},
+	}
+}
+
+// vouched reports whether the relays of h are enough to rebroadcast its event
+func (g *trustGate) vouched(h *heldEvent) bool {
+	if len(h.relays) >= g.quorum {
+		return true
+	}
+	for relay := range h.relays {
+		if g.tiers.Tier(relay) != TrustLow {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns the record of event id, creating it; g.mu must be held
+func (g *trustGate) entry(id string) *heldEvent {
+	h, ok := g.held[id]
+	if !ok {
+		h = &heldEvent{relays: map[string]struct{}{}, added: time.Now()}
+		g.held[id] = h
+	}
+	return h
+}
+
+// Admit counts evt, delivered by relay, and reports whether it can be
+// rebroadcast. Events of low-trust relays with a bad signature are dropped;
+// the others are held until a copy from another relay vouches for them.
+func (g *trustGate) Admit(relay string, evt *nostr.Event) bool {
+	tier := g.tiers.Tier(relay)
+	atomic.AddInt64(g.byTier[tier], 1)
+	if !g.low {
+		return true
+	}
+	if tier == TrustLow {
+		if ok, _ := evt.CheckSignature(); !ok {
+			atomic.AddInt64(&g.badSignature, 1)
+			logging.Warn("mirror: dropping event %s from low-trust relay %s: bad signature", evt.ID, relay)
+			return false
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	h := g.entry(evt.ID)
+	h.relays[nostr.NormalizeURL(relay)] = struct{}{}
+	if g.vouched(h) {
+		if h.evt != nil {
+			h.evt = nil
+			g.released++
+		}
+		return true
+	}
+	if h.evt == nil {
+		h.evt = evt
+		g.heldEvents++
+	}
+	return false
+}
+
+// expire forgets the records older than the window every window until ctx
+// is done; held events that expire are not rebroadcast
+func (g *trustGate) expire(ctx context.Context) {
+	ticker := time.NewTicker(g.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-g.window)
+		g.mu.Lock()
+		for id, h := range g.held {
+			if h.added.Before(cutoff) {
+				if h.evt != nil {
+					g.expired++
+					logging.DebugMethod("mirror", "expire", "dropping event %s: not vouched for within %v", id, g.window)
+				}
+				delete(g.held, id)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// stats renders the trust tier counters
+func (g *trustGate) stats() jsonlib.JsonEntity {
+	byTier := jsonlib.NewJsonObject()
+	for _, tier := range []string{TrustHigh, TrustNormal, TrustLow} {
+		byTier.Set(tier, jsonlib.NewJsonValue(atomic.LoadInt64(g.byTier[tier])))
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("events_by_tier", byTier)
+	obj.Set("low_quorum", jsonlib.NewJsonValue(g.quorum))
+	obj.Set("low_bad_signature", jsonlib.NewJsonValue(atomic.LoadInt64(&g.badSignature)))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pending := 0
+	for _, h := range g.held {
+		if h.evt != nil {
+			pending++
+		}
+	}
+	obj.Set("low_held", jsonlib.NewJsonValue(g.heldEvents))
+	obj.Set("low_pending", jsonlib.NewJsonValue(pending))
+	obj.Set("low_released", jsonlib.NewJsonValue(g.released))
+	obj.Set("low_expired", jsonlib.NewJsonValue(g.expired))
+	return obj
+}
@@ -0,0 +1,404 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package relayerrors provides the error taxonomy shared by the stores that
+// talk to upstream relays. Errors carry the NIP-01 machine-readable prefix
+// ("blocked", "rate-limited", ...) of the relay that produced them, can be
+// classified as transient or permanent, and can be aggregated across relays
+// without losing any per-relay prefix.
+package relayerrors
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Machine-readable prefixes defined by NIP-01 for OK and CLOSED messages
+const (
+	PrefixDuplicate    = "duplicate"
+	PrefixPoW          = "pow"
+	PrefixBlocked      = "blocked"
+	PrefixRateLimited  = "rate-limited"
+	PrefixInvalid      = "invalid"
+	PrefixRestricted   = "restricted"
+	PrefixMute         = "mute"
+	PrefixError        = "error"
+	PrefixAuthRequired = "auth-required"
+)
+
+// prefixPrecedence decides which prefix an aggregate error reports when its
+// relays disagree. auth-required comes first so khatru still triggers AUTH,
+// then transient prefixes the client may retry, then permanent rejections.
+var prefixPrecedence = []string{
+	PrefixAuthRequired,
+	PrefixRateLimited,
+	PrefixBlocked,
+	PrefixRestricted,
+	PrefixInvalid,
+	PrefixPoW,
+	PrefixDuplicate,
+	PrefixMute,
+	PrefixError,
+}
+
+// Class groups errors by how callers should react to them
+type Class int
+
+const (
+	// ClassUnknown is used for nil errors
+	ClassUnknown Class = iota
+	// ClassTransient errors may succeed when retried (timeouts, resets, rate limits)
+	ClassTransient
+	// ClassPermanent errors will fail again (blocked, invalid, pow, ...)
+	ClassPermanent
+	// ClassDuplicate means the relay already has the event
+	ClassDuplicate
+)
+
+// String returns the lowercase name of the class
+func (c Class) String() string {
+	switch c {
+	case ClassTransient:
+		return "transient"
+	case ClassPermanent:
+		return "permanent"
+	case ClassDuplicate:
+		return "duplicate"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrClosed is wrapped by the errors of subscriptions a relay ended with a
+// CLOSED message, telling them apart from connection failures
+var ErrClosed = errors.New("closed by relay")
+
+// Closed returns the error of a subscription relay closed with reason,
+// keeping the reason's prefix and wrapping ErrClosed
+func Closed(relay, reason string) error {
+	prefix, message := splitPrefix(reason)
+	return &PrefixedError{Relay: relay, Prefix: prefix, Message: message, Err: ErrClosed}
+}
+
+// OKPrefixer is implemented by errors that know their NIP-01 prefix. khatru
+// forwards err.Error() verbatim when it starts with "<prefix>: ", so errors
+// implementing this interface always start their message with OKPrefix().
+type OKPrefixer interface {
+	OKPrefix() string
+}
+
+// PrefixedError is an error reported by (or about) a single relay
+type PrefixedError struct {
+	Relay   string
+	Prefix  string
+	Message string
+	Err     error
+}
+
+// New creates a PrefixedError with the given prefix and message
+func New(prefix string, message string) *PrefixedError {
+	return &PrefixedError{Prefix: prefix, Message: message}
+}
+
+// Wrap attaches the relay URL to err, keeping the prefix the relay sent. Errors
+// without a recognizable prefix get "error". Returns nil for a nil err.
+func Wrap(relay string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var m *MultiError
+	if errors.As(err, &m) {
+		return &PrefixedError{Relay: relay, Prefix: m.OKPrefix(), Message: strings.TrimPrefix(m.Error(), m.OKPrefix()+": "), Err: err}
+	}
+	var pe *PrefixedError
+	if errors.As(err, &pe) {
+		if pe.Relay == relay {
+			return pe
+		}
+		return &PrefixedError{Relay: relay, Prefix: pe.Prefix, Message: pe.Message, Err: err}
+	}
+	prefix, message := splitPrefix(err.Error())
+	return &PrefixedError{Relay: relay, Prefix: prefix, Message: message, Err: err}
+}
+
+// Error returns "<prefix>: <message>"
+func (e *PrefixedError) Error() string {
+	return e.Prefix + ": " + e.Message
+}
+
+// Unwrap returns the underlying error
+func (e *PrefixedError) Unwrap() error {
+	return e.Err
+}
+
+// OKPrefix returns the NIP-01 prefix of the error
+func (e *PrefixedError) OKPrefix() string {
+	return e.Prefix
+}
+
+// splitPrefix extracts a NIP-01 prefix from a relay message. go-nostr reports
+// rejected publishes as "msg: <reason>", which is unwrapped first.
+func splitPrefix(message string) (string, string) {
+	message = strings.TrimPrefix(message, "msg: ")
+	if idx := strings.Index(message, ": "); idx != -1 {
+		candidate := message[:idx]
+		for _, known := range prefixPrecedence {
+			if candidate == known {
+				return candidate, message[idx+2:]
+			}
+		}
+	}
+	return PrefixError, message
+}
+
+// Prefix returns the NIP-01 prefix of err, or "" for nil
+func Prefix(err error) string {
+	if err == nil {
+		return ""
+	}
+	var p OKPrefixer
+	if errors.As(err, &p) {
+		return p.OKPrefix()
+	}
+	prefix, _ := splitPrefix(err.Error())
+	return prefix
+}
+
+// Classify reports whether err is worth retrying
+func Classify(err error) Class {
+	if err == nil {
+		return ClassUnknown
+	}
+	var m *MultiError
+	if errors.As(err, &m) {
+		return m.class()
+	}
+	switch Prefix(err) {
+	case PrefixDuplicate:
+		return ClassDuplicate
+	case PrefixRateLimited:
+		return ClassTransient
+	case PrefixError:
+		if isTransientCause(err) {
+			return ClassTransient
+		}
+		return ClassPermanent
+	default:
+		return ClassPermanent
+	}
+}
+
+// IsTransient is a shortcut for Classify(err) == ClassTransient
+func IsTransient(err error) bool {
+	return Classify(err) == ClassTransient
+}
+
+// isTransientCause recognizes network failures behind a generic "error:"
+func isTransientCause(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// go-nostr flattens most connection errors into strings
+	message := strings.ToLower(err.Error())
+	for _, hint := range []string{"timeout", "took too long", "timed out", "connection", "not connected", "broken pipe", "eof", "given up waiting"} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Causes of TLS failures reported by TLSCause
+const (
+	TLSExpired            = "expired_certificate"
+	TLSNotYetValid        = "not_yet_valid_certificate"
+	TLSHostnameMismatch   = "hostname_mismatch"
+	TLSUnknownAuthority   = "unknown_authority"
+	TLSInvalidCertificate = "invalid_certificate"
+	TLSProtocol           = "protocol_error"
+)
+
+// TLSCause tells why err failed at the TLS level: an expired or not yet
+// valid certificate, one issued for other names (the relay answering SNI
+// with the wrong certificate), one signed by an unknown authority, another
+// certificate problem, or a failed handshake. It returns "" for errors that
+// are not about TLS, such as refused connections and DNS failures.
+func TLSCause(err error) string {
+	if err == nil {
+		return ""
+	}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		if invalid.Reason != x509.Expired {
+			return TLSInvalidCertificate
+		}
+		// x509 reports both ends of the validity period as Expired
+		if strings.Contains(invalid.Detail, "is before") {
+			return TLSNotYetValid
+		}
+		return TLSExpired
+	}
+	var hostname x509.HostnameError
+	if errors.As(err, &hostname) {
+		return TLSHostnameMismatch
+	}
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) {
+		return TLSUnknownAuthority
+	}
+	var verification *tls.CertificateVerificationError
+	if errors.As(err, &verification) {
+		return TLSInvalidCertificate
+	}
+	var header tls.RecordHeaderError
+	var alert tls.AlertError
+	if errors.As(err, &header) || errors.As(err, &alert) {
+		return TLSProtocol
+	}
+	// go-nostr flattens some connection errors into strings
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "x509: certificate has expired or is not yet valid"):
+		if strings.Contains(message, "is before") {
+			return TLSNotYetValid
+		}
+		return TLSExpired
+	case strings.Contains(message, "x509: certificate is valid for"), strings.Contains(message, "x509: certificate is not valid for any names"):
+		return TLSHostnameMismatch
+	case strings.Contains(message, "x509: certificate signed by unknown authority"):
+		return TLSUnknownAuthority
+	case strings.Contains(message, "x509: "):
+		return TLSInvalidCertificate
+	case strings.Contains(message, "tls: "):
+		return TLSProtocol
+	}
+	return ""
+}
+
+// MultiError aggregates the errors of an operation fanned out to several
+// relays. It is safe for concurrent use.
+type MultiError struct {
+	mu     sync.Mutex
+	errors []*PrefixedError
+}
+
+// Add records the error returned by relay; nil errors are ignored
+func (m *MultiError) Add(relay string, err error) {
+	if err == nil {
+		return
+	}
+	var pe *PrefixedError
+	errors.As(Wrap(relay, err), &pe)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors = append(m.errors, pe)
+}
+
+// Len returns the number of recorded errors
+func (m *MultiError) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.errors)
+}
+
+// Errors returns a copy of the recorded per-relay errors
+func (m *MultiError) Errors() []*PrefixedError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*PrefixedError(nil), m.errors...)
+}
+
+// ErrorOrNil returns m when it holds errors and nil otherwise
+func (m *MultiError) ErrorOrNil() error {
+	if m.Len() == 0 {
+		return nil
+	}
+	return m
+}
+
+// OKPrefix returns the prefix all relays agree on, or the one with the
+// highest precedence when they disagree
+func (m *MultiError) OKPrefix() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	for _, e := range m.errors {
+		seen[e.Prefix] = true
+	}
+	for _, prefix := range prefixPrecedence {
+		if seen[prefix] {
+			return prefix
+		}
+	}
+	return PrefixError
+}
+
+// Error returns "<prefix>: <relay>: <prefix>: <message>; ..." listing every
+// relay, sorted by relay URL so messages are stable
+func (m *MultiError) Error() string {
+	errs := m.Errors()
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Relay < errs[j].Relay })
+	parts := make([]string, 0, len(errs))
+	for _, e := range errs {
+		parts = append(parts, e.Relay+": "+e.Error())
+	}
+	return m.OKPrefix() + ": " + strings.Join(parts, "; ")
+}
+
+// Unwrap exposes the per-relay errors to errors.Is and errors.As
+func (m *MultiError) Unwrap() []error {
+	errs := m.Errors()
+	out := make([]error, len(errs))
+	for i, e := range errs {
+		out[i] = e
+	}
+	return out
+}
+
+// ByPrefix counts the recorded errors per prefix
+func (m *MultiError) ByPrefix() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int{}
+	for _, e := range m.errors {
+		counts[e.Prefix]++
+	}
+	return counts
+}
+
+// class is transient when any relay might accept a retry, duplicate when
+// every relay already had the event, and permanent otherwise
+func (m *MultiError) class() Class {
+	errs := m.Errors()
+	allDuplicate := len(errs) > 0
+	for _, e := range errs {
+		c := Classify(e)
+		if c == ClassTransient {
+			return ClassTransient
+		}
+		if c != ClassDuplicate {
+			allDuplicate = false
+		}
+	}
+	if allDuplicate {
+		return ClassDuplicate
+	}
+	return ClassPermanent
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the relay error taxonomy.
+package relayerrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestWrap(t *testing.T) {
+	pe := New(PrefixBlocked, "go away")
+	pe.Relay = "wss://a"
+
+	tests := []struct {
+		name    string
+		err     error
+		prefix  string
+		message string
+	}{
+		{"known prefix", errors.New("rate-limited: slow down"), PrefixRateLimited, "slow down"},
+		{"go-nostr publish rejection", errors.New("msg: blocked: not allowed"), PrefixBlocked, "not allowed"},
+		{"unknown prefix", errors.New("oops: something"), PrefixError, "oops: something"},
+		{"no prefix", errors.New("connection refused"), PrefixError, "connection refused"},
+		{"prefixed error of another relay", pe, PrefixBlocked, "go away"},
+		{"wrapped prefixed error", fmt.Errorf("publishing: %w", New(PrefixPoW, "difficulty 20")), PrefixPoW, "difficulty 20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Wrap("wss://b", tt.err)
+			var got *PrefixedError
+			if !errors.As(err, &got) {
+				t.Fatalf("Wrap returned %T", err)
+			}
+			if got.Relay != "wss://b" || got.Prefix != tt.prefix || got.Message != tt.message {
+				t.Fatalf("Wrap = {%q %q %q}, want {wss://b %q %q}", got.Relay, got.Prefix, got.Message, tt.prefix, tt.message)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatal("Wrap lost the original error")
+			}
+		})
+	}
+
+	if Wrap("wss://a", nil) != nil {
+		t.Fatal("Wrap(nil) is not nil")
+	}
+	if Wrap("wss://a", pe) != error(pe) {
+		t.Fatal("Wrap rewrapped an error of the same relay")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"nil", nil, ClassUnknown},
+		{"duplicate", errors.New("duplicate: have it"), ClassDuplicate},
+		{"rate-limited", errors.New("rate-limited: slow down"), ClassTransient},
+		{"blocked", errors.New("blocked: spam"), ClassPermanent},
+		{"auth-required", errors.New("auth-required: who are you"), ClassPermanent},
+		{"deadline", context.DeadlineExceeded, ClassTransient},
+		{"eof", fmt.Errorf("reading: %w", io.EOF), ClassTransient},
+		{"connection reset", syscall.ECONNRESET, ClassTransient},
+		{"flattened timeout", errors.New("publish took too long"), ClassTransient},
+		{"generic error", errors.New("error: bad event"), ClassPermanent},
+		{"closed rate-limited", Closed("wss://a", "rate-limited: slow down"), ClassTransient},
+		{"closed without prefix", Closed("wss://a", "nope"), ClassPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Fatalf("Classify = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	err := Closed("wss://a", "auth-required: sign in")
+	if !errors.Is(err, ErrClosed) {
+		t.Fatal("Closed does not wrap ErrClosed")
+	}
+	if Prefix(err) != PrefixAuthRequired || err.Error() != "auth-required: sign in" {
+		t.Fatalf("Closed = %q with prefix %q", err, Prefix(err))
+	}
+	if errors.Is(Wrap("wss://a", errors.New("auth-required: sign in")), ErrClosed) {
+		t.Fatal("Wrap marked an error as closed")
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	tests := []struct {
+		name   string
+		errs   map[string]error
+		prefix string
+		class  Class
+		text   string
+	}{
+		{
+			name:   "empty",
+			errs:   nil,
+			prefix: PrefixError,
+			class:  ClassPermanent,
+		},
+		{
+			name:   "all duplicate",
+			errs:   map[string]error{"wss://b": errors.New("duplicate: x"), "wss://a": errors.New("duplicate: y")},
+			prefix: PrefixDuplicate,
+			class:  ClassDuplicate,
+			text:   "duplicate: wss://a: duplicate: y; wss://b: duplicate: x",
+		},
+		{
+			name:   "auth-required wins",
+			errs:   map[string]error{"wss://a": errors.New("blocked: no"), "wss://b": errors.New("auth-required: sign in")},
+			prefix: PrefixAuthRequired,
+			class:  ClassPermanent,
+			text:   "auth-required: wss://a: blocked: no; wss://b: auth-required: sign in",
+		},
+		{
+			name:   "one transient",
+			errs:   map[string]error{"wss://a": errors.New("blocked: no"), "wss://b": context.DeadlineExceeded},
+			prefix: PrefixBlocked,
+			class:  ClassTransient,
+			text:   "blocked: wss://a: blocked: no; wss://b: error: context deadline exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m MultiError
+			for relay, err := range tt.errs {
+				m.Add(relay, err)
+			}
+			m.Add("wss://ignored", nil)
+			if m.Len() != len(tt.errs) {
+				t.Fatalf("Len = %d, want %d", m.Len(), len(tt.errs))
+			}
+			if len(tt.errs) == 0 {
+				if m.ErrorOrNil() != nil {
+					t.Fatal("ErrorOrNil of an empty MultiError is not nil")
+				}
+				return
+			}
+			if got := m.OKPrefix(); got != tt.prefix {
+				t.Fatalf("OKPrefix = %q, want %q", got, tt.prefix)
+			}
+			if got := Classify(&m); got != tt.class {
+				t.Fatalf("Classify = %s, want %s", got, tt.class)
+			}
+			if got := m.Error(); got != tt.text {
+				t.Fatalf("Error = %q, want %q", got, tt.text)
+			}
+			for _, err := range tt.errs {
+				if !errors.Is(&m, err) {
+					t.Fatalf("errors.Is does not find %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package relaypool lets the components that talk to upstream relays share a
+// single go-nostr SimplePool, so a relay used for queries, mirroring and
+// publishing gets one connection instead of three. Each component gets a
+// Role, a view of the pool that attributes its use to the component in the
+// pool's stats.
+package relaypool
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Roles of the components sharing a pool
+const (
+	RoleQuery   = "query"
+	RoleMirror  = "mirror"
+	RolePublish = "publish"
+	RoleCount   = "count"
+	RoleSearch  = "search"
+	RoleQuorum  = "quorum"
+)
+
+// EventObserver is told which relay delivered which event on pool-level
+// subscriptions, including duplicates already delivered by another relay
+type EventObserver func(relayURL string, id string)
+
+// roleStats counts the use of a pool by one role
+type roleStats struct {
+	ensures  int64
+	failures int64
+}
+
+// Pool is a SimplePool shared between roles
+type Pool struct {
+	pool     *nostr.SimplePool
+	observer atomic.Pointer[EventObserver]
+	mu       sync.Mutex
+	roles    map[string]*roleStats
+	relays   map[string]map[string]struct{} // roles by normalized URL
+}
+
+// New creates a pool whose connections live until ctx is done. opts are
+// passed to go-nostr; event middlewares are reserved for SetEventObserver.
+func New(ctx context.Context, opts ...nostr.PoolOption) *Pool {
+	p := &Pool{
+		roles:  map[string]*roleStats{},
+		relays: map[string]map[string]struct{}{},
+	}
+	opts = append(opts,
+		nostr.WithEventMiddleware(func(ie nostr.RelayEvent) {
+			p.observe(ie.Relay.URL, ie.Event.ID)
+		}),
+		nostr.WithDuplicateMiddleware(func(relay string, id string) {
+			p.observe(relay, id)
+		}),
+	)
+	p.pool = nostr.NewSimplePool(ctx, opts...)
+	return p
+}
+
+// SetEventObserver registers fn to see the events of pool-level
+// subscriptions (SubscribeMany, FetchMany, ...). Only the mirror subscribes
+// through the pool; the relaystore subscribes relay by relay and reports its
+// events itself.
+func (p *Pool) SetEventObserver(fn EventObserver) {
+	p.observer.Store(&fn)
+}
+
+// observe passes an event to the observer, if any
+func (p *Pool) observe(relay string, id string) {
+	if fn := p.observer.Load(); fn != nil && *fn != nil {
+		(*fn)(relay, id)
+	}
+}
+
+// SimplePool returns the underlying go-nostr pool
+func (p *Pool) SimplePool() *nostr.SimplePool {
+	return p.pool
+}
+
+// Close closes the connections of every role
+func (p *Pool) Close() {
+	p.pool.Close("shutting down")
+}
+
+// Role returns the view of the pool used by role
+func (p *Pool) Role(role string) *Role {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.roles[role]
+	if !ok {
+		stats = &roleStats{}
+		p.roles[role] = stats
+	}
+	return &Role{pool: p, name: role, stats: stats}
+}
+
+// use records that role connected to url
+func (p *Pool) use(role string, url string) {
+	url = nostr.NormalizeURL(url)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	roles, ok := p.relays[url]
+	if !ok {
+		roles = map[string]struct{}{}
+		p.relays[url] = roles
+	}
+	roles[role] = struct{}{}
+}
+
+// GetStatsName returns the name of this stats provider
+func (p *Pool) GetStatsName() string {
+	return "upstream_pool"
+}
+
+// GetStats returns stats as JsonEntity
+func (p *Pool) GetStats() jsonlib.JsonEntity {
+	connected := 0
+	p.pool.Relays.Range(func(_ string, relay *nostr.Relay) bool {
+		if relay.IsConnected() {
+			connected++
+		}
+		return true
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.roles))
+	for name := range p.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	urls := make([]string, 0, len(p.relays))
+	for url := range p.relays {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+
+	relaysByRole := map[string]int{}
+	shared := 0
+	relays := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		roles := make([]string, 0, len(p.relays[url]))
+		for role := range p.relays[url] {
+			roles = append(roles, role)
+			relaysByRole[role]++
+		}
+		sort.Strings(roles)
+		if len(roles) > 1 {
+			shared++
+		}
+		list := jsonlib.NewJsonList()
+		for _, role := range roles {
+			list.Append(jsonlib.NewJsonValue(role))
+		}
+		relays.Set(url, list)
+	}
+
+	roles := jsonlib.NewJsonObject()
+	for _, name := range names {
+		stats := p.roles[name]
+		obj := jsonlib.NewJsonObject()
+		obj.Set("ensure_calls", jsonlib.NewJsonValue(atomic.LoadInt64(&stats.ensures)))
+		obj.Set("ensure_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&stats.failures)))
+		obj.Set("relays", jsonlib.NewJsonValue(relaysByRole[name]))
+		roles.Set(name, obj)
+	}
+
+	obj := jsonlib.NewJsonObject()
+	obj.Set("connected_relays", jsonlib.NewJsonValue(connected))
+	obj.Set("shared_relays", jsonlib.NewJsonValue(shared))
+	obj.Set("roles", roles)
+	obj.Set("relays", relays)
+	return obj
+}
+
+// Role is the view of a Pool used by one component
+type Role struct {
+	pool  *Pool
+	name  string
+	stats *roleStats
+}
+
+// Name returns the name of the role
+func (r *Role) Name() string {
+	return r.name
+}
+
+// Pool returns the pool shared by the role
+func (r *Role) Pool() *Pool {
+	return r.pool
+}
+
+// SimplePool returns the underlying go-nostr pool
+func (r *Role) SimplePool() *nostr.SimplePool {
+	return r.pool.pool
+}
+
+// EnsureRelay returns a connection to url, opening one if no role has
+func (r *Role) EnsureRelay(url string) (*nostr.Relay, error) {
+	atomic.AddInt64(&r.stats.ensures, 1)
+	relay, err := r.pool.pool.EnsureRelay(url)
+	if err != nil {
+		atomic.AddInt64(&r.stats.failures, 1)
+		return nil, err
+	}
+	r.pool.use(r.name, url)
+	return relay, nil
+}
+
+// SubscribeMany subscribes to filter on every relay of urls. The pool
+// normalizes the URLs it is given in place, so it gets a copy of urls.
+func (r *Role) SubscribeMany(ctx context.Context, urls []string, filter nostr.Filter, opts ...nostr.SubscriptionOption) chan nostr.RelayEvent {
+	for _, url := range urls {
+		r.pool.use(r.name, url)
+	}
+	return r.pool.pool.SubscribeMany(ctx, slices.Clone(urls), filter, opts...)
+}
+
+// CountMany counts the events matching filter on every relay of urls, handing
+// the pool a copy of urls as SubscribeMany does
+func (r *Role) CountMany(ctx context.Context, urls []string, filter nostr.Filter, opts []nostr.SubscriptionOption) int {
+	for _, url := range urls {
+		r.pool.use(r.name, url)
+	}
+	return r.pool.pool.CountMany(ctx, slices.Clone(urls), filter, opts)
+}
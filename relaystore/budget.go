@@ -0,0 +1,111 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Per-subscription budget for upstream queries of the relaystore.
+package relaystore
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// errBudgetExhausted is the error of upstream subscriptions closed by their
+// budget
+var errBudgetExhausted = relayerrors.New(relayerrors.PrefixError, "upstream subscription budget exhausted")
+
+// SubscriptionBudget bounds each upstream subscription of a forwarded query.
+// A subscription exceeding it is closed upstream and not reopened: the
+// client gets what arrived so far, and its next REQ opens fresh ones. Zero
+// fields are unlimited; durations beyond QueryTimeoutDuration have no effect.
+type SubscriptionBudget struct {
+	MaxEvents   int
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+// budgetStats counts the upstream subscriptions closed by each limit
+type budgetStats struct {
+	events   int64
+	bytes    int64
+	duration int64
+}
+
+// budgetMeter tracks how much of the budget one subscription has used
+type budgetMeter struct {
+	budget SubscriptionBudget
+	events int
+	bytes  int64
+}
+
+// spend accounts evt and returns the limit it exhausted, if any
+func (m *budgetMeter) spend(evt *nostr.Event) string {
+	m.events++
+	if m.budget.MaxBytes > 0 {
+		if data, err := evt.MarshalJSON(); err == nil {
+			m.bytes += int64(len(data))
+		}
+		if m.bytes >= m.budget.MaxBytes {
+			return "bytes"
+		}
+	}
+	if m.budget.MaxEvents > 0 && m.events >= m.budget.MaxEvents {
+		return "events"
+	}
+	return ""
+}
+
+// SetSubscriptionBudget bounds every upstream subscription opened for a
+// client query
+func (r *RelayStore) SetSubscriptionBudget(budget SubscriptionBudget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget = budget
+}
+
+// subscriptionBudget returns the budget of new upstream subscriptions
+func (r *RelayStore) subscriptionBudget() SubscriptionBudget {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.budget
+}
+
+// withBudgetDeadline bounds ctx by the duration of budget, if any
+func withBudgetDeadline(ctx context.Context, budget SubscriptionBudget) (context.Context, context.CancelFunc) {
+	if budget.MaxDuration <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, budget.MaxDuration, errBudgetExhausted)
+}
+
+// exhausted counts a subscription closed by limit
+func (s *budgetStats) exhausted(limit string) {
+	switch limit {
+	case "events":
+		atomic.AddInt64(&s.events, 1)
+	case "bytes":
+		atomic.AddInt64(&s.bytes, 1)
+	case "duration":
+		atomic.AddInt64(&s.duration, 1)
+	}
+}
+
+// budgetToJSON renders the budget and how often each limit was hit
+func (r *RelayStore) budgetToJSON() *jsonlib.JsonObject {
+	budget := r.subscriptionBudget()
+	obj := jsonlib.NewJsonObject()
+	obj.Set("max_events", jsonlib.NewJsonValue(budget.MaxEvents))
+	obj.Set("max_bytes", jsonlib.NewJsonValue(budget.MaxBytes))
+	obj.Set("max_duration", jsonlib.NewJsonValue(budget.MaxDuration.String()))
+	obj.Set("exhausted_events", jsonlib.NewJsonValue(atomic.LoadInt64(&r.budgetStats.events)))
+	obj.Set("exhausted_bytes", jsonlib.NewJsonValue(atomic.LoadInt64(&r.budgetStats.bytes)))
+	obj.Set("exhausted_duration", jsonlib.NewJsonValue(atomic.LoadInt64(&r.budgetStats.duration)))
+	return obj
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Overall query deadline and partial results for the relaystore.
+package relaystore
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PartialHandler is told that the client query running with ctx was answered
+// at the deadline, without the events the upstreams in pending had yet to send
+type PartialHandler func(ctx context.Context, pending []string)
+
+// pendingRelays are the upstreams of a query that have not finished yet
+type pendingRelays struct {
+	mu   sync.Mutex
+	urls map[string]struct{}
+}
+
+// add marks url as queried
+func (p *pendingRelays) add(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.urls == nil {
+		p.urls = map[string]struct{}{}
+	}
+	p.urls[url] = struct{}{}
+}
+
+// done marks url as finished, whether it reached EOSE or failed
+func (p *pendingRelays) done(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.urls, url)
+}
+
+// list returns the upstreams not finished yet, sorted
+func (p *pendingRelays) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	urls := make([]string, 0, len(p.urls))
+	for url := range p.urls {
+		urls = append(urls, url)
+	}
+	slices.Sort(urls)
+	return urls
+}
+
+// SetQueryDeadline sets how long a client query waits for the upstreams
+// before its results are closed with what arrived so far, so one hung
+// upstream does not hold back EOSE. Upstreams still running are given until
+// QueryTimeoutDuration, if that is later, to be measured. onPartial, when
+// set, is called for every query answered at the deadline. A deadline of 0
+// restores QueryTimeoutDuration. It must be called before Init.
+func (r *RelayStore) SetQueryDeadline(deadline time.Duration, onPartial PartialHandler) {
+	r.deadline = deadline
+	r.onPartial = onPartial
+}
+
+// queryDeadline returns how long client queries wait for the upstreams
+func (r *RelayStore) queryDeadline() time.Duration {
+	if r.deadline > 0 {
+		return r.deadline
+	}
+	return QueryTimeoutDuration
+}
+
+// upstreamTimeout returns how long upstream subscriptions of a query may run
+func (r *RelayStore) upstreamTimeout() time.Duration {
+	return max(r.queryDeadline(), QueryTimeoutDuration)
+}
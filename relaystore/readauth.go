@@ -0,0 +1,130 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tracking of query remotes that require NIP-42 AUTH for reads.
+package relaystore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	jsonlib "github.com/girino/nostr-lib/json"
+)
+
+// readAuth counts how one query remote answered queries closed with
+// auth-required
+type readAuth struct {
+	required   int64 // queries closed with auth-required
+	authed     int64 // AUTH accepted and query retried
+	failed     int64 // AUTH refused or timed out
+	unanswered int64 // no authenticator to answer with
+	refused    int64 // retried query closed again
+	events     int64 // events returned by retried queries
+	last       time.Time
+	lastError  string
+}
+
+// readAuthStats records which query remotes require AUTH for reads, so
+// operators can tell a relay closed to the mirror's key from one that is
+// simply empty
+type readAuthStats struct {
+	mu     sync.Mutex
+	remote map[string]*readAuth // by url
+}
+
+// get returns the record of url, creating it; s.mu must be held
+func (s *readAuthStats) get(url string) *readAuth {
+	if s.remote == nil {
+		s.remote = map[string]*readAuth{}
+	}
+	a, ok := s.remote[url]
+	if !ok {
+		a = &readAuth{}
+		s.remote[url] = a
+	}
+	return a
+}
+
+// challenged records a query on url closed with auth-required and the
+// outcome of answering it: err of the AUTH, or unanswered when there was no
+// authenticator
+func (s *readAuthStats) challenged(url string, unanswered bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.get(url)
+	a.required++
+	a.last = time.Now()
+	switch {
+	case unanswered:
+		a.unanswered++
+	case err != nil:
+		a.failed++
+		a.lastError = err.Error()
+	default:
+		a.authed++
+	}
+}
+
+// retried records how a query retried on url after AUTH ended: the events
+// it returned and, if it was closed again, the reason
+func (s *readAuthStats) retried(url string, events int64, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.get(url)
+	a.events += events
+	if reason != "" {
+		a.refused++
+		a.lastError = reason
+	}
+}
+
+// AuthRequiredRemotes returns the query remotes that closed a query with
+// auth-required
+func (r *RelayStore) AuthRequiredRemotes() []string {
+	r.readAuth.mu.Lock()
+	defer r.readAuth.mu.Unlock()
+	urls := make([]string, 0, len(r.readAuth.remote))
+	for url := range r.readAuth.remote {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// readAuthToJSON renders the query remotes requiring AUTH for reads
+func (r *RelayStore) readAuthToJSON() *jsonlib.JsonObject {
+	urls := r.AuthRequiredRemotes()
+	r.readAuth.mu.Lock()
+	defer r.readAuth.mu.Unlock()
+	var required, authed, failed int64
+	remotes := jsonlib.NewJsonObject()
+	for _, url := range urls {
+		a := r.readAuth.remote[url]
+		required += a.required
+		authed += a.authed
+		failed += a.failed + a.unanswered + a.refused
+		obj := jsonlib.NewJsonObject()
+		obj.Set("auth_required", jsonlib.NewJsonValue(a.required))
+		obj.Set("authenticated", jsonlib.NewJsonValue(a.authed))
+		obj.Set("auth_failures", jsonlib.NewJsonValue(a.failed))
+		obj.Set("unanswered", jsonlib.NewJsonValue(a.unanswered))
+		obj.Set("refused_after_auth", jsonlib.NewJsonValue(a.refused))
+		obj.Set("events_after_auth", jsonlib.NewJsonValue(a.events))
+		obj.Set("last_seen", jsonlib.NewJsonValue(a.last.Unix()))
+		if a.lastError != "" {
+			obj.Set("last_error", jsonlib.NewJsonValue(a.lastError))
+		}
+		remotes.Set(url, obj)
+	}
+	obj := jsonlib.NewJsonObject()
+	obj.Set("remotes_requiring_auth", jsonlib.NewJsonValue(len(urls)))
+	obj.Set("auth_required", jsonlib.NewJsonValue(required))
+	obj.Set("retried", jsonlib.NewJsonValue(authed))
+	obj.Set("failed", jsonlib.NewJsonValue(failed))
+	obj.Set("remotes", remotes)
+	return obj
+}
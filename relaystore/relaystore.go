@@ -0,0 +1,1014 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// RelayStore - Nostr relay aggregation and forwarding functionality.
+//
+// This package started as a copy of eventstore/relaystore from
+// github.com/girino/nostr-lib v0.0.0-20251027142055-a7108048b09e, vendored to
+// add the observer hooks the relay needs, and has diverged since. Fixes made
+// to it upstream must be ported here by hand.
+package relaystore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	jsonlib "github.com/girino/nostr-lib/json"
+	"github.com/girino/saint-michaels-mirror/logging"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Health state constants
+const (
+	HealthGreen  = "GREEN"
+	HealthYellow = "YELLOW"
+	HealthRed    = "RED"
+)
+
+// Query timeout duration for both QueryEvents and CountEvents
+const QueryTimeoutDuration = 5 * time.Second
+
+// EventObserver is notified of every event id an upstream relay returns,
+// including copies of an event already returned by another relay.
+type EventObserver func(relayURL string, id string)
+
+// LatencyObserver is notified, for every query sent to a query remote, of how
+// long it took to send its first event and its EOSE. A zero duration means
+// it never happened; err is set when the query did not reach EOSE.
+type LatencyObserver func(relayURL string, firstEvent, eose time.Duration, err error)
+
+// ClosedObserver is told when a query remote closes a forwarded query with
+// a CLOSED the store could not recover from; ctx is the client's query
+// context
+type ClosedObserver func(ctx context.Context, relayURL string, reason string)
+
+// Authenticator answers the AUTH challenge of relay
+type Authenticator func(ctx context.Context, relay *nostr.Relay) error
+
+// RelayOrder returns the query remotes in the order queries should reach them,
+// fastest first.
+type RelayOrder func(urls []string) []string
+
+// QueryRouter returns the relays that should receive filter, given the query
+// remotes in urls. It may leave remotes out and add relays that are not
+// query remotes.
+type QueryRouter func(filter nostr.Filter, urls []string) []string
+
+// QueryFault is a failure simulated on one upstream query
+type QueryFault struct {
+	// Timeout makes the relay look like it never answers
+	Timeout bool
+	// EOSEDelay holds back the relay's EOSE
+	EOSEDelay time.Duration
+}
+
+// FaultInjector decides the failure, if any, simulated on the next query
+// sent to relayURL
+type FaultInjector func(relayURL string) QueryFault
+
+type RelayStore struct {
+	// queryUrls are the remotes used for answering queries/subscriptions
+	queryUrls []string
+	// pool manages connections for query remotes, unless the upstream
+	// interfaces below are set directly
+	pool *relaypool.Role
+	// ownPool is set when the pool is private to the store
+	ownPool bool
+	mu   sync.RWMutex
+	// fetcher, counter and auther reach the query remotes; Init backs the
+	// ones not set with the pool
+	fetcher Fetcher
+	counter Counter
+	auther  Auther
+	// observer, when set, sees every event returned by query remotes
+	observer EventObserver
+	// authenticate, when set, answers AUTH challenges of query remotes
+	// that close a query with auth-required
+	authenticate Authenticator
+	// latencyObserver, when set, sees the timing of every upstream query
+	latencyObserver LatencyObserver
+	// closedObserver, when set, sees upstream CLOSED reasons
+	closedObserver ClosedObserver
+	// router, when set, picks the relays that receive each filter
+	router QueryRouter
+	// order, when set, ranks query remotes before fanning out
+	order RelayOrder
+	// hedgeDelay, when positive, splits the fanout into a fast tier and a slow
+	// tier that is only queried if the fast tier has not finished in time
+	hedgeDelay time.Duration
+	// faults, when set, simulates upstream failures for testing
+	faults FaultInjector
+	// queries tracks the client queries holding upstream subscriptions
+	queries queryTracker
+	// deadline, when positive, replaces QueryTimeoutDuration as the time
+	// client queries wait for the upstreams; onPartial is told about the
+	// queries answered at the deadline
+	deadline  time.Duration
+	onPartial PartialHandler
+	// budget bounds each upstream subscription
+	budget      SubscriptionBudget
+	budgetStats budgetStats
+	// readAuth records the query remotes that require AUTH for reads
+	readAuth readAuthStats
+	// stats
+	queryRequests       int64
+	queryInternal       int64
+	queryExternal       int64
+	queryEventsReturned int64
+	queryFailures       int64
+	// queries that stopped answering before their upstreams were done,
+	// because the client went away or the query timed out
+	queryClientAborts int64
+	queryTimeouts     int64
+	// queries answered with the events of every upstream, or up to their
+	// limit, versus answered at the deadline without some upstreams
+	queryComplete int64
+	queryPartial  int64
+	// outcome of individual upstream subscriptions: aborted by us (eviction)
+	// or by the deadline, versus failed by the relay
+	upstreamCanceled int64
+	upstreamTimeouts int64
+	upstreamFailures int64
+	// separate counters for CountEvents
+	countRequests       int64
+	countInternal       int64
+	countExternal       int64
+	countEventsReturned int64
+	countFailures       int64
+	countClientAborts   int64
+	countTimeouts       int64
+	// hedging counters
+	hedgesFired   int64
+	hedgesSkipped int64
+	// subset of queryUrls that advertise NIP-45 in their NIP-11
+	countableQueryUrls []string
+	// health check tracking
+	consecutiveQueryFailures int64
+	maxConsecutiveFailures   int64
+	// query remotes reachable on the last query, out of lastQueryRemotes
+	reachableQueryRemotes int64
+	lastQueryRemotes      int64
+	// timing statistics
+	totalQueryDurationNs int64
+	totalCountDurationNs int64
+	queryCount           int64
+	countCount           int64
+}
+
+// Stats holds runtime counters exported by RelayStore (DEPRECATED: not used anymore)
+type Stats struct {
+	QueryRequests       int64 `json:"query_requests"`
+	QueryInternal       int64 `json:"query_internal_requests"`
+	QueryExternal       int64 `json:"query_external_requests"`
+	QueryEventsReturned int64 `json:"query_events_returned"`
+	QueryFailures       int64 `json:"query_failures"`
+	// CountEvents-specific counters
+	CountRequests       int64 `json:"count_requests"`
+	CountInternal       int64 `json:"count_internal_requests"`
+	CountExternal       int64 `json:"count_external_requests"`
+	CountEventsReturned int64 `json:"count_events_returned"`
+	CountFailures       int64 `json:"count_failures"`
+	// Health check fields
+	ConsecutiveQueryFailures int64  `json:"consecutive_query_failures"`
+	IsHealthy                bool   `json:"is_healthy"`
+	HealthStatus             string `json:"health_status"`
+	// Detailed health indicators
+	QueryHealthState string `json:"query_health_state"`
+	MainHealthState  string `json:"main_health_state"`
+	// Timing statistics
+	AverageQueryDurationMs float64 `json:"average_query_duration_ms"`
+	AverageCountDurationMs float64 `json:"average_count_duration_ms"`
+	TotalQueryDurationMs   int64   `json:"total_query_duration_ms"`
+	TotalCountDurationMs   int64   `json:"total_count_duration_ms"`
+}
+
+// getHealthState determines the health state based on consecutive failures
+func getHealthState(consecutiveFailures int64) string {
+	if consecutiveFailures <= 2 {
+		return HealthGreen
+	} else if consecutiveFailures < 10 {
+		return HealthYellow
+	}
+	return HealthRed
+}
+
+// GetStatsName returns the name of this stats provider
+func (r *RelayStore) GetStatsName() string {
+	return "relay"
+}
+
+// GetStats returns stats as JsonEntity
+func (r *RelayStore) GetStats() jsonlib.JsonEntity {
+	// Load all counters
+	consecutiveQueryFailures := atomic.LoadInt64(&r.consecutiveQueryFailures)
+	maxFailures := atomic.LoadInt64(&r.maxConsecutiveFailures)
+	totalQueryDurationNs := atomic.LoadInt64(&r.totalQueryDurationNs)
+	totalCountDurationNs := atomic.LoadInt64(&r.totalCountDurationNs)
+	queryCount := atomic.LoadInt64(&r.queryCount)
+	countCount := atomic.LoadInt64(&r.countCount)
+
+	// Calculate health states
+	isHealthy := consecutiveQueryFailures < maxFailures
+	healthStatus := "healthy"
+	if !isHealthy {
+		healthStatus = "unhealthy"
+	}
+
+	queryHealthState := getHealthState(consecutiveQueryFailures)
+	mainHealthState := queryHealthState
+
+	// Calculate timing statistics
+	var averageQueryDurationMs float64
+	var averageCountDurationMs float64
+
+	if queryCount > 0 {
+		averageQueryDurationMs = float64(totalQueryDurationNs) / float64(queryCount) / 1e6
+	}
+	if countCount > 0 {
+		averageCountDurationMs = float64(totalCountDurationNs) / float64(countCount) / 1e6
+	}
+
+	// Build JsonObject directly
+	obj := jsonlib.NewJsonObject()
+	obj.Set("query_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryRequests)))
+	obj.Set("query_internal_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryInternal)))
+	obj.Set("query_external_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryExternal)))
+	obj.Set("query_events_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryEventsReturned)))
+	obj.Set("query_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryFailures)))
+	r.queries.mu.Lock()
+	obj.Set("max_upstream_queries", jsonlib.NewJsonValue(r.queries.max))
+	obj.Set("peak_upstream_queries", jsonlib.NewJsonValue(r.queries.peak))
+	r.queries.mu.Unlock()
+	obj.Set("active_upstream_queries", jsonlib.NewJsonValue(r.queries.active()))
+	obj.Set("evicted_queries", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queries.evictions)))
+	obj.Set("query_client_aborts", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryClientAborts)))
+	obj.Set("query_timeouts", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryTimeouts)))
+	obj.Set("query_deadline_ms", jsonlib.NewJsonValue(r.queryDeadline().Milliseconds()))
+	obj.Set("query_complete", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryComplete)))
+	obj.Set("query_partial", jsonlib.NewJsonValue(atomic.LoadInt64(&r.queryPartial)))
+	obj.Set("upstream_queries_canceled", jsonlib.NewJsonValue(atomic.LoadInt64(&r.upstreamCanceled)))
+	obj.Set("upstream_query_timeouts", jsonlib.NewJsonValue(atomic.LoadInt64(&r.upstreamTimeouts)))
+	obj.Set("upstream_query_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&r.upstreamFailures)))
+	obj.Set("upstream_budget", r.budgetToJSON())
+	obj.Set("upstream_read_auth", r.readAuthToJSON())
+	obj.Set("consecutive_query_failures", jsonlib.NewJsonValue(consecutiveQueryFailures))
+	obj.Set("query_health_state", jsonlib.NewJsonValue(queryHealthState))
+	obj.Set("reachable_query_remotes", jsonlib.NewJsonValue(atomic.LoadInt64(&r.reachableQueryRemotes)))
+	obj.Set("count_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countRequests)))
+	obj.Set("count_internal_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countInternal)))
+	obj.Set("count_external_requests", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countExternal)))
+	obj.Set("count_events_returned", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countEventsReturned)))
+	obj.Set("count_failures", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countFailures)))
+	obj.Set("count_client_aborts", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countClientAborts)))
+	obj.Set("count_timeouts", jsonlib.NewJsonValue(atomic.LoadInt64(&r.countTimeouts)))
+	obj.Set("hedges_fired", jsonlib.NewJsonValue(atomic.LoadInt64(&r.hedgesFired)))
+	obj.Set("hedges_skipped", jsonlib.NewJsonValue(atomic.LoadInt64(&r.hedgesSkipped)))
+	obj.Set("main_health_state", jsonlib.NewJsonValue(mainHealthState))
+	obj.Set("health_status", jsonlib.NewJsonValue(healthStatus))
+	obj.Set("is_healthy", jsonlib.NewJsonValue(isHealthy))
+	obj.Set("average_query_duration_ms", jsonlib.NewJsonValue(averageQueryDurationMs))
+	obj.Set("average_count_duration_ms", jsonlib.NewJsonValue(averageCountDurationMs))
+	obj.Set("total_query_duration_ms", jsonlib.NewJsonValue(totalQueryDurationNs/1e6))
+	obj.Set("total_count_duration_ms", jsonlib.NewJsonValue(totalCountDurationNs/1e6))
+	return obj
+}
+
+// New creates a RelayStore with mandatory query relays for querying only.
+func New(queryUrls []string) *RelayStore {
+	if len(queryUrls) == 0 {
+		panic("query relays are mandatory - at least one query relay must be provided")
+	}
+
+	rs := &RelayStore{
+		queryUrls:              slices.Clone(queryUrls),
+		maxConsecutiveFailures: 10, // Default threshold: 10 consecutive failures
+	}
+	return rs
+}
+
+// SetEventObserver registers fn to be told which relay returned which event.
+// It must be called before Init.
+func (r *RelayStore) SetEventObserver(fn EventObserver) {
+	r.observer = fn
+}
+
+// SetLatencyObserver registers fn to be told how fast each query remote answers
+func (r *RelayStore) SetLatencyObserver(fn LatencyObserver) {
+	r.latencyObserver = fn
+}
+
+// SetClosedObserver registers fn to be told why query remotes closed
+// forwarded queries
+func (r *RelayStore) SetClosedObserver(fn ClosedObserver) {
+	r.closedObserver = fn
+}
+
+// SetRelayOrder registers fn to rank query remotes before each query. With a
+// positive hedgeDelay only the faster half is queried at first; the slower
+// half is queried too if the faster half has not finished after hedgeDelay.
+func (r *RelayStore) SetRelayOrder(fn RelayOrder, hedgeDelay time.Duration) {
+	r.order = fn
+	r.hedgeDelay = hedgeDelay
+}
+
+// SetQueryRouter registers fn to pick the relays each query is sent to,
+// before they are ranked
+func (r *RelayStore) SetQueryRouter(fn QueryRouter) {
+	r.router = fn
+}
+
+// SetFaultInjector makes upstream queries fail as fn decides, so the
+// timeout and health handling can be exercised without failing relays
+func (r *RelayStore) SetFaultInjector(fn FaultInjector) {
+	r.faults = fn
+}
+
+// SetAuthenticator makes queries closed with auth-required authenticate
+// and retry once
+func (r *RelayStore) SetAuthenticator(fn Authenticator) {
+	r.authenticate = fn
+}
+
+// SetPool makes the store connect through a pool shared with other
+// components. It must be called before Init, which otherwise creates a
+// private pool.
+func (r *RelayStore) SetPool(pool *relaypool.Role) {
+	r.pool = pool
+}
+
+// SetUpstream makes the store reach its query remotes through fetcher,
+// counter and auther instead of a relay pool, e.g. the mocks of the
+// relaystoretest package. Nil ones are backed by the pool; auther takes
+// precedence over SetAuthenticator. It must be called before Init.
+func (r *RelayStore) SetUpstream(fetcher Fetcher, counter Counter, auther Auther) {
+	r.fetcher = fetcher
+	r.counter = counter
+	r.auther = auther
+}
+
+func (r *RelayStore) Init() error {
+	// setup query pool: create pool even if no queryUrls provided
+	if r.fetcher == nil || r.counter == nil || (r.auther == nil && r.authenticate != nil) {
+		if r.pool == nil {
+			r.pool = relaypool.New(context.Background(), nostr.WithPenaltyBox()).Role(relaypool.RoleQuery)
+			r.ownPool = true
+		}
+		upstream := &poolUpstream{pool: r.pool, authenticate: r.authenticate}
+		if r.fetcher == nil {
+			r.fetcher = upstream
+		}
+		if r.counter == nil {
+			r.counter = upstream
+		}
+		if r.auther == nil && r.authenticate != nil {
+			r.auther = upstream
+		}
+	}
+
+	r.countableQueryUrls = r.counter.Countable(r.queryUrls)
+
+	logging.DebugMethod("relaystore", "Init", "query remotes: %v", r.queryUrls)
+	logging.DebugMethod("relaystore", "Init", "countable query remotes (NIP-45): %v", r.countableQueryUrls)
+	return nil
+}
+
+// probeCountable returns the subset of queryUrls advertising NIP-45 in their NIP-11
+func probeCountable(queryUrls []string) []string {
+	// build countableQueryUrls by probing each query relay's NIP-11 to see if
+	// it advertises support for NIP-45. We do a best-effort HTTP(S) GET to the
+	// relay's /.well-known/nostr.json or the host root as per NIP-11. If the
+	// probe fails, we skip the relay for counting but keep it as a query
+	// remote for FetchMany.
+	countable := []string{}
+	for _, q := range queryUrls {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			continue
+		}
+		// derive a well-formed URL to probe NIP-11 via Accept header: GET / with
+		// Accept: application/nostr+json. Convert ws(s):// to http(s):// as
+		// needed and probe the root path.
+		u := q
+		if strings.HasPrefix(u, "ws://") {
+			u = "http://" + strings.TrimPrefix(u, "ws://")
+		} else if strings.HasPrefix(u, "wss://") {
+			u = "https://" + strings.TrimPrefix(u, "wss://")
+		}
+		parsed, err := neturl.Parse(u)
+		if err != nil {
+			logging.DebugMethod("relaystore", "probeCountable", "cannot parse query url %s: %v", q, err)
+			continue
+		}
+		// ensure root path
+		parsed.Path = "/"
+		probeURL := parsed.String()
+
+		logging.DebugMethod("relaystore", "probeCountable", "probing NIP-11 for %s -> %s", q, probeURL)
+		client := &http.Client{Timeout: 4 * time.Second}
+		req, err := http.NewRequest("GET", probeURL, nil)
+		if err != nil {
+			logging.DebugMethod("relaystore", "probeCountable", "failed to build NIP-11 probe request for %s: %v", q, err)
+			continue
+		}
+		// NIP-01 requires Accept: application/nostr+json
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := client.Do(req)
+		if err != nil {
+			logging.DebugMethod("relaystore", "probeCountable", "failed probing NIP-11 for %s: %v", q, err)
+			continue
+		}
+		func() {
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				logging.DebugMethod("relaystore", "probeCountable", "non-200 NIP-11 response from %s: %d", q, resp.StatusCode)
+				return
+			}
+			var doc map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+				logging.DebugMethod("relaystore", "probeCountable", "failed to decode NIP-11 from %s: %v", q, err)
+				return
+			}
+			// check supported_nips (NIP-11) for 45
+			if s, ok := doc["supported_nips"]; ok {
+				switch arr := s.(type) {
+				case []interface{}:
+					for _, v := range arr {
+						// JSON numbers decode to float64
+						if num, ok := v.(float64); ok {
+							if int(num) == 45 {
+								countable = append(countable, q)
+								logging.DebugMethod("relaystore", "probeCountable", "relay %s advertises NIP-45; added to countable list", q)
+								return
+							}
+						}
+					}
+				case []int:
+					for _, nip := range arr {
+						if nip == 45 {
+							countable = append(countable, q)
+							logging.DebugMethod("relaystore", "probeCountable", "relay %s advertises NIP-45; added to countable list", q)
+							return
+						}
+					}
+				}
+			}
+			logging.DebugMethod("relaystore", "probeCountable", "relay %s does not advertise NIP-45", q)
+		}()
+	}
+	return countable
+}
+
+// SetQueryRemotes replaces the query remotes, re-probing them for NIP-45.
+// Queries already running keep the remotes they started with.
+func (r *RelayStore) SetQueryRemotes(queryUrls []string) {
+	var countable []string
+	if r.counter != nil {
+		countable = r.counter.Countable(queryUrls)
+	} else {
+		countable = probeCountable(queryUrls)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queryUrls = slices.Clone(queryUrls)
+	r.countableQueryUrls = countable
+	logging.DebugMethod("relaystore", "SetQueryRemotes", "query remotes: %v, countable: %v", queryUrls, countable)
+}
+
+// remotes returns the current query remotes and their NIP-45 subset
+func (r *RelayStore) remotes() ([]string, []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.queryUrls, r.countableQueryUrls
+}
+
+// QueryRemotes returns the configured query remotes
+func (r *RelayStore) QueryRemotes() []string {
+	queryUrls, _ := r.remotes()
+	return slices.Clone(queryUrls)
+}
+
+// QueryHealthState returns the health of the query remotes as GREEN, YELLOW or RED
+func (r *RelayStore) QueryHealthState() string {
+	return getHealthState(atomic.LoadInt64(&r.consecutiveQueryFailures))
+}
+
+// Reachability returns how many of the query remotes were reachable on the
+// last client query
+func (r *RelayStore) Reachability() (reachable, total int) {
+	return int(atomic.LoadInt64(&r.reachableQueryRemotes)), int(atomic.LoadInt64(&r.lastQueryRemotes))
+}
+
+// Close closes the connections of a private pool; a shared pool is closed
+// by its owner
+func (r *RelayStore) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ownPool {
+		r.pool.Pool().Close()
+	}
+}
+
+// QueryEvents returns an empty, closed channel because this store does not persist events.
+func (r *RelayStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	// count total requests
+	atomic.AddInt64(&r.queryRequests, 1)
+
+	// If khatru explicitly marked this as an internal call, short-circuit.
+	if khatru.IsInternalCall(ctx) || ctx.Value(1) == nil {
+		atomic.AddInt64(&r.queryInternal, 1)
+		logging.DebugMethod("relaystore", "QueryEvents", "internal query short-circuited (khatru internal call) filter=%+v", filter)
+		ch := make(chan *nostr.Event)
+		close(ch)
+		return ch, nil
+	}
+
+	atomic.AddInt64(&r.queryExternal, 1)
+
+	// if no pool available, return closed channel
+	if r.fetcher == nil {
+		logging.DebugMethod("relaystore", "QueryEvents", "QueryEvents called but no pool initialized (khatru_internal_call=%v) filter=%+v", khatru.IsInternalCall(ctx), filter)
+		ch := make(chan *nostr.Event)
+		close(ch)
+		return ch, nil
+	}
+
+	// use FetchMany which ends when all relays return EOSE
+	logging.DebugMethod("relaystore", "QueryEvents", "QueryEvents called (khatru_internal_call=%v) filter=%+v", khatru.IsInternalCall(ctx), filter)
+
+	queryUrls, _ := r.remotes()
+	if r.router != nil {
+		queryUrls = r.router(filter, slices.Clone(queryUrls))
+	}
+	if r.order != nil {
+		queryUrls = r.order(slices.Clone(queryUrls))
+	}
+
+	// before subscribing, try ensuring relays to detect quick failures and count them
+	querySuccesses := 0
+	for _, q := range queryUrls {
+		if q == "" {
+			continue
+		}
+		if err := r.fetcher.Ensure(q); err != nil {
+			// count query relay failure
+			atomic.AddInt64(&r.queryFailures, 1)
+			logging.DebugMethod("relaystore", "QueryEvents", "failed to ensure query relay %s: %v", q, err)
+		} else {
+			querySuccesses++
+		}
+	}
+
+	// Track consecutive query failures for health checking
+	// Require at least 1/4 of relays to be online (rounded up)
+	totalRelays := len(queryUrls)
+	threshold := (totalRelays + 3) / 4 // 1/4 rounded up
+
+	atomic.StoreInt64(&r.reachableQueryRemotes, int64(querySuccesses))
+	atomic.StoreInt64(&r.lastQueryRemotes, int64(totalRelays))
+
+	if querySuccesses >= threshold {
+		// Success: reset consecutive failure counter
+		atomic.StoreInt64(&r.consecutiveQueryFailures, 0)
+	} else {
+		// Failure: increment consecutive failure counter
+		atomic.AddInt64(&r.consecutiveQueryFailures, 1)
+	}
+
+	// Start timing measurement for the complete query operation
+	startTime := time.Now()
+
+	// split the fanout into hedging tiers, fastest first
+	tiers := [][]string{queryUrls}
+	if r.hedgeDelay > 0 && len(queryUrls) > 1 {
+		split := (len(queryUrls) + 1) / 2
+		tiers = [][]string{queryUrls[:split], queryUrls[split:]}
+	}
+
+	// query deadline or cancel - timeout starts AFTER semaphore acquisition
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, r.queryDeadline())
+	// an evicted query stops answering its client as if it had timed out;
+	// q.ctx is also cancelled once the upstreams are done, which must not
+	// cut off the events still on their way to the client
+	q := r.queries.track(ctx)
+	stopEviction := context.AfterFunc(q.ctx, func() {
+		if q.Evicted() {
+			timeoutCancel()
+		}
+	})
+	evch := r.fetchTiers(timeoutCtx, q, tiers, filter)
+	out := make(chan *nostr.Event)
+
+	go func() {
+		// Complete timing measurement for the complete query operation
+		defer timeoutCancel()
+		defer stopEviction()
+		defer r.queries.answered(q)
+		defer func() {
+			duration := time.Since(startTime)
+			atomic.AddInt64(&r.totalQueryDurationNs, duration.Nanoseconds())
+			atomic.AddInt64(&r.queryCount, 1)
+		}()
+		defer close(out)
+
+		maxEvents := 100
+		if filter.Limit > 0 {
+			maxEvents = int(filter.Limit)
+		}
+		numEvents := 0
+		for {
+			select {
+			case <-timeoutCtx.Done():
+				r.queryStopped(ctx, q)
+				return
+			case evt, ok := <-evch:
+				if !ok {
+					logging.DebugMethod("relaystore", "QueryEvents", "query channel closed")
+					atomic.AddInt64(&r.queryComplete, 1)
+					return
+				}
+				atomic.AddInt64(&r.queryEventsReturned, 1)
+				r.queries.touch(q)
+				select {
+				case out <- evt:
+					numEvents++ // Event sent successfully
+					if numEvents >= maxEvents {
+						logging.DebugMethod("relaystore", "QueryEvents", "query reached max events limit of %d", maxEvents)
+						atomic.AddInt64(&r.queryComplete, 1)
+						return
+					}
+				case <-timeoutCtx.Done():
+					r.queryStopped(ctx, q)
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// queryStopped logs and counts why a query stopped answering its client
+// before its upstreams were done. Only timeouts say anything about upstream
+// health; evictions and clients going away do not. A query that reached the
+// deadline is answered with partial results, which onPartial is told about
+// while the client can still be sent a notice ahead of the EOSE.
+func (r *RelayStore) queryStopped(clientCtx context.Context, q *activeQuery) {
+	switch {
+	case q.Evicted():
+		logging.DebugMethod("relaystore", "QueryEvents", "query evicted to make room for newer queries")
+	case clientCtx.Err() != nil:
+		atomic.AddInt64(&r.queryClientAborts, 1)
+		logging.DebugMethod("relaystore", "QueryEvents", "client went away before the query finished: %v", context.Cause(clientCtx))
+	default:
+		atomic.AddInt64(&r.queryTimeouts, 1)
+		atomic.AddInt64(&r.queryPartial, 1)
+		pending := q.pending.list()
+		logging.Warn("query timed out after %v, answered without %d upstreams: %v", r.queryDeadline(), len(pending), pending)
+		if r.onPartial != nil {
+			r.onPartial(clientCtx, pending)
+		}
+	}
+}
+
+// fetchTiers queries every relay of each tier, starting the next tier only if
+// the previous one has not finished within the hedge delay, and returns the
+// de-duplicated events. The channel is closed when all queried relays have
+// sent EOSE or ctx is done. Upstream queries outlive a reader that stops
+// early, until EOSE or the upstream timeout, so their latency is measured,
+// unless q is evicted. q is released once every upstream subscription closed.
+func (r *RelayStore) fetchTiers(ctx context.Context, q *activeQuery, tiers [][]string, filter nostr.Filter) chan *nostr.Event {
+	out := make(chan *nostr.Event)
+	var seenMu sync.Mutex
+	seen := map[string]struct{}{}
+	readerCtx := ctx
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.upstreamTimeout())
+	stopEviction := context.AfterFunc(q.ctx, cancel)
+
+	go func() {
+		defer r.queries.release(q)
+		defer stopEviction()
+		defer cancel()
+		defer close(out)
+		var wg sync.WaitGroup
+		for i, tier := range tiers {
+			var tierWg sync.WaitGroup
+			for _, url := range tier {
+				if url == "" {
+					continue
+				}
+				wg.Add(1)
+				tierWg.Add(1)
+				q.pending.add(url)
+				go func(url string) {
+					defer wg.Done()
+					defer tierWg.Done()
+					defer q.pending.done(url)
+					r.fetchRelay(ctx, url, filter, func(evt *nostr.Event) bool {
+						seenMu.Lock()
+						_, dup := seen[evt.ID]
+						seen[evt.ID] = struct{}{}
+						seenMu.Unlock()
+						if dup {
+							return true
+						}
+						select {
+						case out <- evt:
+							return true
+						case <-readerCtx.Done():
+							return false
+						}
+					})
+				}(url)
+			}
+			if i == len(tiers)-1 {
+				break
+			}
+
+			tierDone := make(chan struct{})
+			go func() {
+				tierWg.Wait()
+				close(tierDone)
+			}()
+			timer := time.NewTimer(r.hedgeDelay)
+			select {
+			case <-tierDone:
+			case <-readerCtx.Done():
+			case <-timer.C:
+				atomic.AddInt64(&r.hedgesFired, 1)
+				logging.DebugMethod("relaystore", "fetchTiers", "tier %d slower than %v, hedging to %v", i, r.hedgeDelay, tiers[i+1])
+				continue
+			}
+			// the fast tier finished or the reader has enough events
+			timer.Stop()
+			atomic.AddInt64(&r.hedgesSkipped, 1)
+			logging.DebugMethod("relaystore", "fetchTiers", "tier %d done within %v, not querying slower relays", i, r.hedgeDelay)
+			break
+		}
+		wg.Wait()
+	}()
+
+	return out
+}
+
+// fetchRelay runs filter on a single query remote until EOSE or until the
+// subscription budget runs out, passing every event to emit and reporting
+// the relay's timing to the latency observer. Once emit returns false the
+// remaining events are drained but not emitted. Subscriptions canceled on
+// our side are not the relay's fault and are kept from the latency observer.
+func (r *RelayStore) fetchRelay(ctx context.Context, url string, filter nostr.Filter, emit func(*nostr.Event) bool) {
+	start := time.Now()
+	var firstEvent, eose time.Duration
+	var err error
+	budget := budgetMeter{budget: r.subscriptionBudget()}
+	ctx, cancelBudget := withBudgetDeadline(ctx, budget.budget)
+	defer cancelBudget()
+	defer func() {
+		switch {
+		case errors.Is(err, errBudgetExhausted):
+			return
+		case err != nil && errors.Is(context.Cause(ctx), errBudgetExhausted):
+			r.budgetExhausted(url, "duration")
+			return
+		case errors.Is(err, context.Canceled):
+			atomic.AddInt64(&r.upstreamCanceled, 1)
+			return
+		case errors.Is(err, context.DeadlineExceeded):
+			atomic.AddInt64(&r.upstreamTimeouts, 1)
+		case err != nil || eose == 0:
+			atomic.AddInt64(&r.upstreamFailures, 1)
+		}
+		if r.latencyObserver != nil {
+			r.latencyObserver(url, firstEvent, eose, err)
+		}
+	}()
+
+	var fault QueryFault
+	if r.faults != nil {
+		fault = r.faults(url)
+	}
+	if fault.Timeout {
+		// sit out the query as a relay that never answers would
+		<-ctx.Done()
+		err = ctx.Err()
+		return
+	}
+
+	sub, err := r.fetcher.Subscribe(ctx, url, filter)
+	if err != nil {
+		logging.DebugMethod("relaystore", "fetchRelay", "failed to subscribe to %s: %v", url, err)
+		return
+	}
+	defer func() {
+		if sub != nil {
+			sub.Unsub()
+		}
+	}()
+
+	reading := true
+	authed := false
+	// retried is set once the query was asked again after AUTH
+	retried := false
+	var retriedEvents int64
+	var retriedReason string
+	defer func() {
+		if retried {
+			r.readAuth.retried(url, retriedEvents, retriedReason)
+		}
+	}()
+	for {
+		select {
+		case evt, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			if firstEvent == 0 {
+				firstEvent = time.Since(start)
+			}
+			if r.observer != nil {
+				r.observer(url, evt.ID)
+			}
+			if retried {
+				retriedEvents++
+			}
+			if reading && !emit(evt) {
+				reading = false
+			}
+			if limit := budget.spend(evt); limit != "" {
+				r.budgetExhausted(url, limit)
+				err = errBudgetExhausted
+				return
+			}
+		case <-sub.EndOfStoredEvents:
+			if fault.EOSEDelay > 0 {
+				select {
+				case <-time.After(fault.EOSEDelay):
+				case <-ctx.Done():
+					err = ctx.Err()
+					return
+				}
+			}
+			eose = time.Since(start)
+			return
+		case reason := <-sub.ClosedReason:
+			logging.DebugMethod("relaystore", "fetchRelay", "%s closed the query: %s", url, reason)
+			if retried {
+				retriedReason = reason
+			}
+			if strings.HasPrefix(reason, "auth-required:") && !authed {
+				// authenticate once and ask again
+				authed = true
+				if r.auther == nil {
+					r.readAuth.challenged(url, true, nil)
+				} else {
+					authErr := r.auther.Auth(ctx, url)
+					r.readAuth.challenged(url, false, authErr)
+					if authErr == nil {
+						sub.Unsub()
+						if sub, err = r.fetcher.Subscribe(ctx, url, filter); err != nil {
+							logging.DebugMethod("relaystore", "fetchRelay", "failed to resubscribe to %s: %v", url, err)
+							return
+						}
+						retried = true
+						continue
+					}
+					logging.DebugMethod("relaystore", "fetchRelay", "failed to authenticate to %s: %v", url, authErr)
+				}
+			}
+			if r.closedObserver != nil {
+				r.closedObserver(ctx, url, reason)
+			}
+			err = relayerrors.Closed(url, reason)
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// budgetExhausted counts and logs an upstream subscription closed by limit
+func (r *RelayStore) budgetExhausted(url, limit string) {
+	r.budgetStats.exhausted(limit)
+	logging.DebugMethod("relaystore", "fetchRelay", "closing subscription on %s: %s budget exhausted", url, limit)
+}
+
+// DeleteEvent is a no-op for relay forwarding store.
+func (r *RelayStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	// RelayStore is query-only, no-op for DeleteEvent
+	return nil
+}
+
+// SaveEvent is a no-op since RelayStore is query-only
+func (r *RelayStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	// RelayStore is query-only, no-op for SaveEvent
+	logging.DebugMethod("relaystore", "SaveEvent", "RelayStore is query-only, ignoring save for event %s", evt.ID)
+	return nil
+}
+
+// ReplaceEvent is a no-op since RelayStore is query-only
+func (r *RelayStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	// RelayStore is query-only, no-op for ReplaceEvent
+	logging.DebugMethod("relaystore", "ReplaceEvent", "RelayStore is query-only, ignoring replace for event %s", evt.ID)
+	return nil
+}
+
+// CountEvents forwards the filter to query remotes and returns the total number
+// of matching events observed. It follows the same short-circuit rules as
+// QueryEvents: internal khatru calls and the exact adding.go kind=5/#e
+// short-circuit (when ctx.Value(1) == nil) are not forwarded.
+func (r *RelayStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	// Start timing measurement
+	startTime := time.Now()
+	defer func() {
+		duration := time.Since(startTime)
+		atomic.AddInt64(&r.totalCountDurationNs, duration.Nanoseconds())
+		atomic.AddInt64(&r.countCount, 1)
+	}()
+
+	// count total requests
+	atomic.AddInt64(&r.countRequests, 1)
+
+	// short-circuit khatru internal calls
+	if khatru.IsInternalCall(ctx) {
+		atomic.AddInt64(&r.countInternal, 1)
+		logging.DebugMethod("relaystore", "CountEvents", "internal count short-circuited (khatru internal call) filter=%+v", filter)
+		return 0, nil
+	}
+
+	atomic.AddInt64(&r.countExternal, 1)
+
+	if r.counter == nil {
+		logging.DebugMethod("relaystore", "CountEvents", "CountEvents called but no pool initialized (khatru_internal_call=%v) filter=%+v", khatru.IsInternalCall(ctx), filter)
+		return 0, nil
+	}
+
+	logging.DebugMethod("relaystore", "CountEvents", "CountEvents called (khatru_internal_call=%v) filter=%+v", khatru.IsInternalCall(ctx), filter)
+
+	// ensure relays and count failures (only for countable query remotes)
+	_, countableQueryUrls := r.remotes()
+	if len(countableQueryUrls) == 0 {
+		logging.DebugMethod("relaystore", "CountEvents", "no NIP-45-capable query remotes available; returning 0")
+		return 0, nil
+	}
+
+	// before counting, try ensuring relays to detect quick failures and count them
+	countSuccesses := 0
+	for _, q := range countableQueryUrls {
+		if q == "" {
+			continue
+		}
+		if err := r.fetcher.Ensure(q); err != nil {
+			// count query relay failure
+			atomic.AddInt64(&r.countFailures, 1)
+			logging.DebugMethod("relaystore", "CountEvents", "failed to ensure query relay %s: %v", q, err)
+		} else {
+			countSuccesses++
+		}
+	}
+
+	// Track consecutive count failures for health checking
+	// Require at least 1/4 of relays to be online (rounded up)
+	totalRelays := len(countableQueryUrls)
+	threshold := (totalRelays + 3) / 4 // 1/4 rounded up
+
+	if countSuccesses >= threshold {
+		// Success: reset consecutive failure counter
+		atomic.StoreInt64(&r.consecutiveQueryFailures, 0)
+	} else {
+		// Failure: increment consecutive failure counter
+		atomic.AddInt64(&r.consecutiveQueryFailures, 1)
+	}
+
+	// use CountMany which aggregates counts across relays (NIP-45 HyperLogLog)
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, r.queryDeadline())
+	defer timeoutCancel()
+	cnt := r.counter.Count(timeoutCtx, countableQueryUrls, filter)
+	if ctx.Err() != nil {
+		atomic.AddInt64(&r.countClientAborts, 1)
+	} else if timeoutCtx.Err() != nil {
+		atomic.AddInt64(&r.countTimeouts, 1)
+	}
+	if cnt > 0 {
+		atomic.AddInt64(&r.countEventsReturned, int64(cnt))
+	}
+	return int64(cnt), nil
+}
+
+// Ensure RelayStore implements eventstore.Store and eventstore.Counter
+var _ eventstore.Store = (*RelayStore)(nil)
+var _ eventstore.Counter = (*RelayStore)(nil)
@@ -0,0 +1,223 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Tests of the relaystore against scripted and in-process query remotes.
+package relaystore_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/girino/saint-michaels-mirror/relaystoretest"
+	"github.com/girino/saint-michaels-mirror/testrelay"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const remoteURL = "wss://remote.example.com"
+
+// observed collects what the latency observer is told, by relay
+type observed struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (o *observed) observe(url string, firstEvent, eose time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.errs[url] = err
+}
+
+func (o *observed) err(url string) (error, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err, ok := o.errs[url]
+	return err, ok
+}
+
+// newStore returns a store over up whose latency observer reports into the
+// returned observed; a nil auther leaves AUTH challenges unanswered
+func newStore(t *testing.T, up *relaystoretest.Upstream, auther relaystore.Auther, urls ...string) (*relaystore.RelayStore, *observed) {
+	t.Helper()
+	rs := relaystore.New(urls)
+	o := &observed{errs: map[string]error{}}
+	rs.SetLatencyObserver(o.observe)
+	rs.SetUpstream(up, up, auther)
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rs.Close)
+	return rs, o
+}
+
+// textNotes returns n signed kind 1 events
+func textNotes(t *testing.T, n int) []*nostr.Event {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+	events := make([]*nostr.Event, n)
+	for i := range events {
+		events[i] = &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(1700000000 + i), Content: "note"}
+		if err := events[i].Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return events
+}
+
+// query runs filter as a client query and returns the events it answers
+func query(t *testing.T, rs *relaystore.RelayStore, filter nostr.Filter) []*nostr.Event {
+	t.Helper()
+	// khatru sets the subscription id under key 1 on client queries
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), 1, "test"), 10*time.Second)
+	defer cancel()
+	ch, err := rs.QueryEvents(ctx, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events
+}
+
+func TestQueryAuthRetry(t *testing.T) {
+	events := textNotes(t, 3)
+	filter := nostr.Filter{Kinds: []int{nostr.KindTextNote}}
+
+	t.Run("authenticates and asks again", func(t *testing.T) {
+		up := relaystoretest.New()
+		remote := up.Remote(remoteURL).Add(events...).RequireAuth(true, nil)
+		rs, o := newStore(t, up, up, remoteURL)
+		if got := query(t, rs, filter); len(got) != len(events) {
+			t.Fatalf("got %d events, want %d", len(got), len(events))
+		}
+		if remote.Auths() != 1 || remote.Subscriptions() != 2 {
+			t.Fatalf("%d auths and %d subscriptions, want 1 and 2", remote.Auths(), remote.Subscriptions())
+		}
+		if err, ok := o.err(remoteURL); !ok || err != nil {
+			t.Fatalf("observed %v (reported %v), want success", err, ok)
+		}
+	})
+
+	t.Run("without authenticator", func(t *testing.T) {
+		up := relaystoretest.New()
+		remote := up.Remote(remoteURL).Add(events...).RequireAuth(true, nil)
+		rs, o := newStore(t, up, nil, remoteURL)
+		if got := query(t, rs, filter); len(got) != 0 {
+			t.Fatalf("got %d events from a remote requiring AUTH", len(got))
+		}
+		if remote.Auths() != 0 || remote.Subscriptions() != 1 {
+			t.Fatalf("%d auths and %d subscriptions, want 0 and 1", remote.Auths(), remote.Subscriptions())
+		}
+		err, _ := o.err(remoteURL)
+		if !errors.Is(err, relayerrors.ErrClosed) || relayerrors.Prefix(err) != relayerrors.PrefixAuthRequired {
+			t.Fatalf("observed %v, want a closed auth-required error", err)
+		}
+	})
+
+	t.Run("failed authentication", func(t *testing.T) {
+		up := relaystoretest.New()
+		remote := up.Remote(remoteURL).Add(events...).RequireAuth(true, errors.New("restricted: not on the list"))
+		rs, o := newStore(t, up, up, remoteURL)
+		if got := query(t, rs, filter); len(got) != 0 {
+			t.Fatalf("got %d events after a failed AUTH", len(got))
+		}
+		if remote.Auths() != 1 || remote.Subscriptions() != 1 {
+			t.Fatalf("%d auths and %d subscriptions, want 1 and 1", remote.Auths(), remote.Subscriptions())
+		}
+		err, _ := o.err(remoteURL)
+		if !errors.Is(err, relayerrors.ErrClosed) || relayerrors.Prefix(err) != relayerrors.PrefixAuthRequired {
+			t.Fatalf("observed %v, want a closed auth-required error", err)
+		}
+	})
+}
+
+func TestQueryErrorClassification(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(*relaystoretest.Remote)
+		closed bool
+		class  relayerrors.Class
+	}{
+		{"blocked", func(r *relaystoretest.Remote) { r.CloseWith("blocked: not allowed") }, true, relayerrors.ClassPermanent},
+		{"rate-limited", func(r *relaystoretest.Remote) { r.CloseWith("rate-limited: slow down") }, true, relayerrors.ClassTransient},
+		{"no prefix", func(r *relaystoretest.Remote) { r.CloseWith("go away") }, true, relayerrors.ClassPermanent},
+		{"subscribe failure", func(r *relaystoretest.Remote) { r.FailSubscribe(errors.New("connection reset by peer")) }, false, relayerrors.ClassTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := relaystoretest.New()
+			healthy := "wss://healthy.example.com"
+			up.Remote(healthy).Add(textNotes(t, 2)...)
+			tt.script(up.Remote(remoteURL))
+			rs, o := newStore(t, up, up, remoteURL, healthy)
+
+			if got := query(t, rs, nostr.Filter{Kinds: []int{nostr.KindTextNote}}); len(got) != 2 {
+				t.Fatalf("got %d events, want the 2 of the healthy remote", len(got))
+			}
+			err, ok := o.err(remoteURL)
+			if !ok || err == nil {
+				t.Fatal("failure was not reported to the latency observer")
+			}
+			if errors.Is(err, relayerrors.ErrClosed) != tt.closed {
+				t.Fatalf("%v: closed by relay = %v, want %v", err, !tt.closed, tt.closed)
+			}
+			if got := relayerrors.Classify(err); got != tt.class {
+				t.Fatalf("%v classified %s, want %s", err, got, tt.class)
+			}
+			if err, _ := o.err(healthy); err != nil {
+				t.Fatalf("healthy remote observed %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryFanOutOverWebsockets(t *testing.T) {
+	a, b := testrelay.New(), testrelay.New()
+	defer a.Close()
+	defer b.Close()
+	events := textNotes(t, 4)
+	// both relays have the first two events, each has one of its own
+	if err := a.Add(events[0], events[1], events[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(events[0], events[1], events[3]); err != nil {
+		t.Fatal(err)
+	}
+	b.RequireAuth(true)
+
+	rs := relaystore.New([]string{a.URL(), b.URL()})
+	sk := nostr.GeneratePrivateKey()
+	rs.SetAuthenticator(func(ctx context.Context, relay *nostr.Relay) error {
+		return relay.Auth(ctx, func(evt *nostr.Event) error { return evt.Sign(sk) })
+	})
+	if err := rs.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	got := query(t, rs, nostr.Filter{Kinds: []int{nostr.KindTextNote}})
+	seen := map[string]int{}
+	for _, evt := range got {
+		seen[evt.ID]++
+	}
+	for _, evt := range events {
+		if seen[evt.ID] != 1 {
+			t.Errorf("event %s returned %d times, want once", evt.ID, seen[evt.ID])
+		}
+	}
+	if len(got) != len(events) {
+		t.Fatalf("got %d events, want %d", len(got), len(events))
+	}
+	if a.Queries() == 0 || b.Queries() == 0 {
+		t.Fatalf("queries reached the relays %d and %d times", a.Queries(), b.Queries())
+	}
+}
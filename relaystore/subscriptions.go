@@ -0,0 +1,145 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Cap on concurrent upstream subscriptions for the relaystore.
+package relaystore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+)
+
+// EvictionReason is the reason evicted client queries are closed with
+const EvictionReason = "rate-limited: too many concurrent queries, try again later"
+
+// errEvicted is the cancel cause of evicted queries
+var errEvicted = relayerrors.New(relayerrors.PrefixRateLimited, "query evicted: too many concurrent queries")
+
+// EvictionHandler is told that the client query running with ctx was evicted
+// to make room for a newer one, so the client can be sent a CLOSED
+type EvictionHandler func(ctx context.Context, reason string)
+
+// activeQuery is a client query holding one subscription on each queried
+// remote until they all reach EOSE
+type activeQuery struct {
+	clientCtx context.Context
+	// ctx is cancelled when the query is evicted or done
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	elem      *list.Element
+	answering bool // still forwarding events to the client
+	// pending are the upstreams that have not finished yet
+	pending pendingRelays
+}
+
+// Evicted reports whether the query was evicted
+func (q *activeQuery) Evicted() bool {
+	return errors.Is(context.Cause(q.ctx), errEvicted)
+}
+
+// queryTracker keeps the active queries in least-recently-active order and
+// evicts the least recently active one when a new query exceeds the cap
+type queryTracker struct {
+	mu      sync.Mutex
+	max     int // 0 = unlimited
+	lru     *list.List
+	onEvict EvictionHandler
+	// stats
+	peak      int64
+	evictions int64
+}
+
+// track registers a new query, evicting the least recently active ones
+// beyond the cap
+func (t *queryTracker) track(clientCtx context.Context) *activeQuery {
+	q := &activeQuery{clientCtx: clientCtx, answering: true}
+	q.ctx, q.cancel = context.WithCancelCause(context.Background())
+
+	type victim struct {
+		q         *activeQuery
+		answering bool
+	}
+	victims := []victim{}
+	t.mu.Lock()
+	if t.lru == nil {
+		t.lru = list.New()
+	}
+	for t.max > 0 && t.lru.Len() >= t.max {
+		oldest := t.lru.Back().Value.(*activeQuery)
+		t.lru.Remove(oldest.elem)
+		oldest.elem = nil
+		victims = append(victims, victim{oldest, oldest.answering})
+	}
+	q.elem = t.lru.PushFront(q)
+	if n := int64(t.lru.Len()); n > t.peak {
+		t.peak = n
+	}
+	onEvict := t.onEvict
+	t.mu.Unlock()
+
+	for _, v := range victims {
+		atomic.AddInt64(&t.evictions, 1)
+		v.q.cancel(errEvicted)
+		// queries only draining upstreams have already answered the client
+		if v.answering && onEvict != nil {
+			onEvict(v.q.clientCtx, EvictionReason)
+		}
+	}
+	return q
+}
+
+// touch marks q as the most recently active query
+func (t *queryTracker) touch(q *activeQuery) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if q.elem != nil {
+		t.lru.MoveToFront(q.elem)
+	}
+}
+
+// answered records that the client has all the events it will get from q
+func (t *queryTracker) answered(q *activeQuery) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q.answering = false
+}
+
+// release removes q once its upstream subscriptions are closed
+func (t *queryTracker) release(q *activeQuery) {
+	t.mu.Lock()
+	if q.elem != nil {
+		t.lru.Remove(q.elem)
+		q.elem = nil
+	}
+	t.mu.Unlock()
+	q.cancel(nil)
+}
+
+// active returns the number of active queries
+func (t *queryTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lru == nil {
+		return 0
+	}
+	return t.lru.Len()
+}
+
+// SetMaxSubscriptions caps the client queries forwarded upstream at once;
+// each holds at most one subscription on every query remote. When a new
+// query exceeds max, the least recently active one is cancelled and onEvict
+// is called with its context. 0 disables the cap.
+func (r *RelayStore) SetMaxSubscriptions(max int, onEvict EvictionHandler) {
+	r.queries.mu.Lock()
+	defer r.queries.mu.Unlock()
+	r.queries.max = max
+	r.queries.onEvict = onEvict
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Upstream interfaces of the relaystore and their relay pool implementation.
+package relaystore
+
+import (
+	"context"
+
+	"github.com/girino/saint-michaels-mirror/relaypool"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Subscription is a subscription open on one query remote
+type Subscription struct {
+	// Events carries the events the remote returns
+	Events <-chan *nostr.Event
+	// EndOfStoredEvents is signaled when the remote sends EOSE
+	EndOfStoredEvents <-chan struct{}
+	// ClosedReason carries the reason of a CLOSED sent by the remote
+	ClosedReason <-chan string
+	// Unsub closes the subscription
+	Unsub func()
+}
+
+// Fetcher connects to query remotes and subscribes to them
+type Fetcher interface {
+	// Ensure connects to url unless already connected
+	Ensure(url string) error
+	// Subscribe opens a subscription to filter on url
+	Subscribe(ctx context.Context, url string, filter nostr.Filter) (*Subscription, error)
+}
+
+// Counter answers NIP-45 counts
+type Counter interface {
+	// Countable returns the subset of urls supporting NIP-45
+	Countable(urls []string) []string
+	// Count returns the number of distinct events matching filter on urls
+	Count(ctx context.Context, urls []string, filter nostr.Filter) int
+}
+
+// Auther answers the AUTH challenge of a query remote
+type Auther interface {
+	Auth(ctx context.Context, url string) error
+}
+
+// There is no Publisher interface: the store is query-only, SaveEvent never
+// reaches an upstream, and events are published by the broadcaster of the
+// main package through its own pool role.
+
+// poolUpstream reaches the query remotes through a relay pool
+type poolUpstream struct {
+	pool *relaypool.Role
+	// authenticate, when set, answers AUTH challenges on pool connections
+	authenticate Authenticator
+}
+
+func (p *poolUpstream) Ensure(url string) error {
+	_, err := p.pool.EnsureRelay(url)
+	return err
+}
+
+func (p *poolUpstream) Subscribe(ctx context.Context, url string, filter nostr.Filter) (*Subscription, error) {
+	relay, err := p.pool.EnsureRelay(url)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := relay.Subscribe(ctx, nostr.Filters{filter})
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{
+		Events:            sub.Events,
+		EndOfStoredEvents: sub.EndOfStoredEvents,
+		ClosedReason:      sub.ClosedReason,
+		Unsub:             sub.Unsub,
+	}, nil
+}
+
+// Countable probes the NIP-11 document of each remote
+func (p *poolUpstream) Countable(urls []string) []string {
+	return probeCountable(urls)
+}
+
+func (p *poolUpstream) Count(ctx context.Context, urls []string, filter nostr.Filter) int {
+	return p.pool.CountMany(ctx, urls, filter, nil)
+}
+
+func (p *poolUpstream) Auth(ctx context.Context, url string) error {
+	relay, err := p.pool.EnsureRelay(url)
+	if err != nil {
+		return err
+	}
+	return p.authenticate(ctx, relay)
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package relaystoretest provides scripted query remotes implementing the
+// upstream interfaces of the relaystore, so its auth retry, failure
+// classification and health tracking can be exercised without websockets.
+// Unlike the relays of the testrelay package, a Remote answers instantly and
+// deterministically, and can be told at any time to be unreachable, close
+// queries, require AUTH, hold back EOSE or never answer.
+package relaystoretest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Upstream is a set of scripted query remotes keyed by URL. Pass it as the
+// fetcher, counter and auther of relaystore.RelayStore.SetUpstream; URLs
+// without a Remote are unreachable.
+type Upstream struct {
+	mu      sync.Mutex
+	remotes map[string]*Remote
+}
+
+// Remote is a scripted query remote
+type Remote struct {
+	mu sync.RWMutex
+	// behaviors
+	events       []*nostr.Event
+	ensureErr    error
+	subscribeErr error
+	closeReason  string
+	requireAuth  bool
+	authErr      error
+	authed       bool
+	countable    bool
+	eoseDelay    time.Duration
+	silent       bool
+	// stats
+	subscriptions int64
+	auths         int64
+	unsubs        int64
+}
+
+// New creates an Upstream without remotes
+func New() *Upstream {
+	return &Upstream{remotes: map[string]*Remote{}}
+}
+
+// Remote returns the remote at url, creating one that answers every query
+// with no events if there is none
+func (u *Upstream) Remote(url string) *Remote {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r, ok := u.remotes[url]
+	if !ok {
+		r = &Remote{}
+		u.remotes[url] = r
+	}
+	return r
+}
+
+// lookup returns the remote at url, if any
+func (u *Upstream) lookup(url string) (*Remote, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r, ok := u.remotes[url]
+	if !ok {
+		return nil, fmt.Errorf("no remote at %s", url)
+	}
+	return r, nil
+}
+
+// Add stores events on the remote, as if they had been published earlier
+func (r *Remote) Add(events ...*nostr.Event) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, events...)
+	return r
+}
+
+// FailConnect makes connecting to the remote fail with err; nil connects again
+func (r *Remote) FailConnect(err error) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ensureErr = err
+	return r
+}
+
+// FailSubscribe makes subscribing fail with err; nil subscribes again
+func (r *Remote) FailSubscribe(err error) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribeErr = err
+	return r
+}
+
+// CloseWith makes the remote close every query with reason (e.g.
+// "blocked: not allowed") instead of answering it; "" answers again
+func (r *Remote) CloseWith(reason string) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeReason = reason
+	return r
+}
+
+// RequireAuth makes the remote close queries with auth-required until Auth
+// is called, which fails with err if it is not nil
+func (r *Remote) RequireAuth(require bool, err error) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requireAuth, r.authErr, r.authed = require, err, false
+	return r
+}
+
+// Countable makes the remote advertise NIP-45
+func (r *Remote) Countable(countable bool) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.countable = countable
+	return r
+}
+
+// DelayEOSE makes the remote hold back the EOSE of every query by d
+func (r *Remote) DelayEOSE(d time.Duration) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eoseDelay = d
+	return r
+}
+
+// Silent makes the remote accept queries and never answer them
+func (r *Remote) Silent(silent bool) *Remote {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.silent = silent
+	return r
+}
+
+// Subscriptions returns how many subscriptions were opened on the remote
+func (r *Remote) Subscriptions() int64 {
+	return atomic.LoadInt64(&r.subscriptions)
+}
+
+// Unsubscriptions returns how many subscriptions were closed by the client
+func (r *Remote) Unsubscriptions() int64 {
+	return atomic.LoadInt64(&r.unsubs)
+}
+
+// Auths returns how many times the client authenticated to the remote
+func (r *Remote) Auths() int64 {
+	return atomic.LoadInt64(&r.auths)
+}
+
+// Ensure fails for unknown remotes and remotes told to FailConnect
+func (u *Upstream) Ensure(url string) error {
+	r, err := u.lookup(url)
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ensureErr
+}
+
+// Subscribe answers filter with the matching events of the remote, as
+// scripted
+func (u *Upstream) Subscribe(ctx context.Context, url string, filter nostr.Filter) (*relaystore.Subscription, error) {
+	if err := u.Ensure(url); err != nil {
+		return nil, err
+	}
+	r, _ := u.lookup(url)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.subscribeErr != nil {
+		return nil, r.subscribeErr
+	}
+	atomic.AddInt64(&r.subscriptions, 1)
+
+	events := make(chan *nostr.Event)
+	eose := make(chan struct{}, 1)
+	closed := make(chan string, 1)
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &relaystore.Subscription{
+		Events:            events,
+		EndOfStoredEvents: eose,
+		ClosedReason:      closed,
+		Unsub: func() {
+			atomic.AddInt64(&r.unsubs, 1)
+			cancel()
+		},
+	}
+
+	switch {
+	case r.requireAuth && !r.authed:
+		closed <- "auth-required: authenticate to query"
+		return sub, nil
+	case r.closeReason != "":
+		closed <- r.closeReason
+		return sub, nil
+	case r.silent:
+		return sub, nil
+	}
+	var matching []*nostr.Event
+	for _, evt := range r.events {
+		if filter.Matches(evt) {
+			matching = append(matching, evt)
+		}
+	}
+	delay := r.eoseDelay
+	go func() {
+		for _, evt := range matching {
+			select {
+			case events <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(delay):
+			eose <- struct{}{}
+		case <-ctx.Done():
+		}
+	}()
+	return sub, nil
+}
+
+// Countable returns the urls of remotes told to be Countable
+func (u *Upstream) Countable(urls []string) []string {
+	countable := []string{}
+	for _, url := range urls {
+		r, err := u.lookup(url)
+		if err != nil {
+			continue
+		}
+		r.mu.RLock()
+		if r.countable {
+			countable = append(countable, url)
+		}
+		r.mu.RUnlock()
+	}
+	return countable
+}
+
+// Count returns the number of distinct events matching filter on the
+// reachable remotes of urls
+func (u *Upstream) Count(ctx context.Context, urls []string, filter nostr.Filter) int {
+	seen := map[string]struct{}{}
+	for _, url := range urls {
+		if u.Ensure(url) != nil {
+			continue
+		}
+		r, _ := u.lookup(url)
+		r.mu.RLock()
+		for _, evt := range r.events {
+			if filter.Matches(evt) {
+				seen[evt.ID] = struct{}{}
+			}
+		}
+		r.mu.RUnlock()
+	}
+	return len(seen)
+}
+
+// Auth authenticates to the remote, failing as told by RequireAuth
+func (u *Upstream) Auth(ctx context.Context, url string) error {
+	if err := u.Ensure(url); err != nil {
+		return err
+	}
+	r, _ := u.lookup(url)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	atomic.AddInt64(&r.auths, 1)
+	if r.authErr != nil {
+		return r.authErr
+	}
+	r.authed = true
+	return nil
+}
+
+// Ensure Upstream implements the upstream interfaces of the relaystore
+var _ relaystore.Fetcher = (*Upstream)(nil)
+var _ relaystore.Counter = (*Upstream)(nil)
+var _ relaystore.Auther = (*Upstream)(nil)
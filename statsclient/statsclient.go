@@ -0,0 +1,271 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package statsclient fetches and parses the /api/v1/stats document of a
+// saint-michaels-mirror relay into typed structs. The document carries a
+// schema_version; fields are only renamed or removed when it changes, so
+// tooling built on this package keeps working across relay releases.
+// Sections not modelled here remain available as raw JSON.
+package statsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the stats document this package parses.
+// It is bumped whenever a documented field is renamed, removed or changes
+// type; adding fields or sections does not change it.
+const SchemaVersion = 1
+
+// StatsPath is the path of the stats document on a relay
+const StatsPath = "/api/v1/stats"
+
+// ErrUnsupportedSchema is returned for documents of another schema version
+var ErrUnsupportedSchema = errors.New("unsupported stats schema version")
+
+// Health states reported by the relay
+const (
+	HealthGreen  = "GREEN"
+	HealthYellow = "YELLOW"
+	HealthRed    = "RED"
+)
+
+// Stats is a parsed stats document
+type Stats struct {
+	SchemaVersion  int             `json:"schema_version"`
+	App            *App            `json:"app,omitempty"`
+	Relay          *Relay          `json:"relay,omitempty"`
+	Mirror         *Mirror         `json:"mirror,omitempty"`
+	BroadcastStore *BroadcastStore `json:"broadcaststore,omitempty"`
+	Publisher      *Publisher      `json:"publisher,omitempty"`
+	EventLimits    *EventLimits    `json:"event_limits,omitempty"`
+	PenaltyBox     *PenaltyBox     `json:"penalty_box,omitempty"`
+	Maintenance    *Maintenance    `json:"maintenance,omitempty"`
+	UpdateCheck    *UpdateCheck    `json:"update_check,omitempty"`
+	// Sections holds every section, including those modelled above, as raw JSON
+	Sections map[string]json.RawMessage `json:"-"`
+}
+
+// App describes the relay process
+type App struct {
+	Version    string  `json:"version"`
+	Uptime     float64 `json:"uptime"` // seconds
+	Goroutines struct {
+		Count       int64  `json:"count"`
+		HealthState string `json:"health_state"`
+	} `json:"goroutines"`
+	Memory struct {
+		AllocBytes     int64 `json:"alloc_bytes"`
+		HeapAllocBytes int64 `json:"heap_alloc_bytes"`
+		HeapInuseBytes int64 `json:"heap_inuse_bytes"`
+		SysBytes       int64 `json:"sys_bytes"`
+		TotalAlloc     int64 `json:"total_alloc_bytes"`
+	} `json:"memory"`
+	Build struct {
+		Commit    string `json:"commit"`
+		Date      string `json:"date"`
+		Modified  bool   `json:"modified"`
+		GoVersion string `json:"go_version"`
+	} `json:"build"`
+	// Features tells which optional subsystems are active
+	Features map[string]bool `json:"features"`
+}
+
+// Relay holds query and count counters and the overall health
+type Relay struct {
+	MainHealthState          string  `json:"main_health_state"`
+	QueryHealthState         string  `json:"query_health_state"`
+	IsHealthy                bool    `json:"is_healthy"`
+	QueryRequests            int64   `json:"query_requests"`
+	QueryExternalRequests    int64   `json:"query_external_requests"`
+	QueryInternalRequests    int64   `json:"query_internal_requests"`
+	QueryEventsReturned      int64   `json:"query_events_returned"`
+	QueryFailures            int64   `json:"query_failures"`
+	ConsecutiveQueryFailures int64   `json:"consecutive_query_failures"`
+	AverageQueryDurationMs   float64 `json:"average_query_duration_ms"`
+	CountRequests            int64   `json:"count_requests"`
+	CountFailures            int64   `json:"count_failures"`
+	CountEventsReturned      int64   `json:"count_events_returned"`
+	AverageCountDurationMs   float64 `json:"average_count_duration_ms"`
+	HedgesFired              int64   `json:"hedges_fired"`
+	HedgesSkipped            int64   `json:"hedges_skipped"`
+}
+
+// Mirror holds the counters of live mirroring
+type Mirror struct {
+	MirrorHealthState         string           `json:"mirror_health_state"`
+	MirroredEvents            int64            `json:"mirrored_events"`
+	MirrorSuccesses           int64            `json:"mirror_successes"`
+	MirrorFailures            int64            `json:"mirror_failures"`
+	ConsecutiveMirrorFailures int64            `json:"consecutive_mirror_failures"`
+	LiveRelays                int64            `json:"live_relays"`
+	DeadRelays                int64            `json:"dead_relays"`
+	SampledOut                int64            `json:"sampled_out"`
+	SampledOutByKind          map[string]int64 `json:"sampled_out_by_kind"`
+}
+
+// BroadcastStore holds the counters of event publishing through broadcast
+type BroadcastStore struct {
+	HealthState         string  `json:"health_state"`
+	IsHealthy           bool    `json:"is_healthy"`
+	Attempts            int64   `json:"attempts"`
+	Successes           int64   `json:"successes"`
+	Failures            int64   `json:"failures"`
+	ConsecutiveFailures int64   `json:"consecutive_failures"`
+	AverageExecutionMs  float64 `json:"average_execution_ms"`
+}
+
+// Publisher holds the counters of the retrying publisher
+type Publisher struct {
+	Events         int64                     `json:"events"`
+	EventsAccepted int64                     `json:"events_accepted"`
+	EventsFailed   int64                     `json:"events_failed"`
+	Duplicates     int64                     `json:"duplicates"`
+	Dropped        int64                     `json:"dropped"`
+	Retries        int64                     `json:"retries"`
+	QueueSize      int64                     `json:"queue_size"`
+	QueueCapacity  int64                     `json:"queue_capacity"`
+	MaxAttempts    int64                     `json:"max_attempts"`
+	Paused         bool                      `json:"paused"`
+	Relays         map[string]PublisherRelay `json:"relays"`
+}
+
+// PublisherRelay holds the publish counters of one upstream relay
+type PublisherRelay struct {
+	Attempts          int64  `json:"attempts"`
+	Successes         int64  `json:"successes"`
+	Failures          int64  `json:"failures"`
+	Retries           int64  `json:"retries"`
+	TransientFailures int64  `json:"transient_failures"`
+	PermanentFailures int64  `json:"permanent_failures"`
+	Duplicates        int64  `json:"duplicates"`
+	LastError         string `json:"last_error,omitempty"`
+}
+
+// EventLimits holds the counters of the event size and tag limits
+type EventLimits struct {
+	MaxEventSize    int64 `json:"max_event_size"`
+	MaxEventTags    int64 `json:"max_event_tags"`
+	Checked         int64 `json:"checked"`
+	RejectedBySize  int64 `json:"rejected_by_size"`
+	RejectedByTags  int64 `json:"rejected_by_tags"`
+	LargestAccepted int64 `json:"largest_accepted"`
+}
+
+// PenaltyBox holds the state of the upstream connection penalty box
+type PenaltyBox struct {
+	BaseDuration        string `json:"base_duration"`
+	MaxDuration         string `json:"max_duration"`
+	FailureThreshold    int64  `json:"failure_threshold"`
+	PenalizedCount      int64  `json:"penalized_count"`
+	TotalPenalties      int64  `json:"total_penalties"`
+	RejectedConnections int64  `json:"rejected_connections"`
+}
+
+// Maintenance holds the state of maintenance mode
+type Maintenance struct {
+	Active         bool     `json:"active"`
+	Manual         bool     `json:"manual"`
+	Scheduled      bool     `json:"scheduled"`
+	Schedule       []string `json:"schedule"`
+	Since          int64    `json:"since,omitempty"`
+	Periods        int64    `json:"periods"`
+	RejectedEvents int64    `json:"rejected_events"`
+	HealthState    string   `json:"health_state"`
+}
+
+// UpdateCheck holds the outcome of the release checks, when enabled
+type UpdateCheck struct {
+	CurrentVersion  string `json:"current_version"`
+	LatestVersion   string `json:"latest_version,omitempty"`
+	LatestURL       string `json:"latest_url,omitempty"`
+	UpdateAvailable bool   `json:"update_available"`
+	CheckedAt       int64  `json:"checked_at,omitempty"`
+	LastError       string `json:"last_error,omitempty"`
+	Checks          int64  `json:"checks"`
+	Failures        int64  `json:"failures"`
+}
+
+// Section decodes the raw section with the given name into v and reports
+// whether the section was present
+func (s *Stats) Section(name string, v any) (bool, error) {
+	raw, ok := s.Sections[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Parse parses a stats document. Documents without a schema_version predate
+// versioning and are parsed as version 1.
+func Parse(data []byte) (*Stats, error) {
+	sections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("parsing stats: %w", err)
+	}
+	stats := &Stats{}
+	if err := json.Unmarshal(data, stats); err != nil {
+		return nil, fmt.Errorf("parsing stats: %w", err)
+	}
+	if stats.SchemaVersion == 0 {
+		stats.SchemaVersion = 1
+	}
+	if stats.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("%w: %d, expected %d", ErrUnsupportedSchema, stats.SchemaVersion, SchemaVersion)
+	}
+	delete(sections, "schema_version")
+	stats.Sections = sections
+	return stats, nil
+}
+
+// Client fetches stats from one relay
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New creates a client for the relay at baseURL, e.g. https://relay.example.com
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WithHTTPClient replaces the HTTP client used for requests
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	c.httpClient = httpClient
+	return c
+}
+
+// Fetch downloads and parses the stats document
+func (c *Client) Fetch(ctx context.Context) (*Stats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+StatsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", c.baseURL+StatsPath, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
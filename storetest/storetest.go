@@ -0,0 +1,495 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package storetest checks that an eventstore used by the relay pipeline
+// (the relaystore, the broadcaststore, ...) keeps the semantics khatru and
+// the rest of the pipeline rely on: SaveEvent errors carry a NIP-01 prefix,
+// QueryEvents returns only matching events, each once, and always closes its
+// channel, CountEvents agrees with QueryEvents, and cancelling the context
+// ends every call promptly. A Subject wraps the store with hooks that script
+// its upstreams, e.g. with the relaystoretest or testrelay packages; checks
+// needing a hook the Subject leaves nil are skipped.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/girino/saint-michaels-mirror/relayerrors"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultTimeout bounds each check of a Subject without a Timeout
+const DefaultTimeout = 10 * time.Second
+
+// CancelGrace is how soon a call must return once its context is cancelled
+const CancelGrace = time.Second
+
+// Subject is a store under test and the hooks scripting its upstreams. The
+// caller initializes and closes the store; Run only calls SaveEvent,
+// QueryEvents and, if the store implements eventstore.Counter, CountEvents.
+type Subject struct {
+	Name  string
+	Store eventstore.Store
+	// External, when set, marks ctx as a query from a client, for stores
+	// that only forward those; queries without it must return nothing
+	External func(ctx context.Context) context.Context
+	// Seed makes events available to queries. Without it the store is
+	// expected to answer every query with no events.
+	Seed func(events ...*nostr.Event)
+	// Stall makes the upstreams accept queries and never answer them
+	Stall func(stall bool)
+	// Reject makes the upstreams refuse events with prefix and message; an
+	// empty prefix accepts them again
+	Reject func(prefix, message string)
+	// Stored reports whether a saved event reached the upstreams
+	Stored func(id string) bool
+	// Async marks stores whose SaveEvent only queues the event for the
+	// upstreams, or drops it like the query-only relaystore, so refusals
+	// never reach the client: save/error-prefix then requires the save to
+	// be accepted, with the upstreams refusing it when Reject is set
+	Async bool
+	// Timeout bounds each check, DefaultTimeout when zero
+	Timeout time.Duration
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Check   string
+	Err     error  // nil when the check passed
+	Skipped string // why the check did not run, if it did not
+}
+
+// Report holds the results of every check run on a Subject
+type Report struct {
+	Subject string
+	Results []Result
+}
+
+// Failed returns the results of the checks that failed
+func (r Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Err returns the failures of the report as one error, or nil
+func (r Report) Err() error {
+	var errs []error
+	for _, res := range r.Failed() {
+		errs = append(errs, fmt.Errorf("%s %s: %w", r.Subject, res.Check, res.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// check is one conformance check; it returns a reason to skip or an error
+type check struct {
+	name string
+	run  func(c *runner) (skip string, err error)
+}
+
+// checks lists the checks in the order they run
+var checks = []check{
+	{"query/matching", (*runner).queryMatching},
+	{"query/unique", (*runner).queryUnique},
+	{"query/limit", (*runner).queryLimit},
+	{"query/closes", (*runner).queryCloses},
+	{"query/internal", (*runner).queryInternal},
+	{"query/cancel", (*runner).queryCancel},
+	{"query/canceled", (*runner).queryCanceled},
+	{"count/matching", (*runner).countMatching},
+	{"count/canceled", (*runner).countCanceled},
+	{"save/accepted", (*runner).saveAccepted},
+	{"save/error-prefix", (*runner).saveErrorPrefix},
+	{"save/canceled", (*runner).saveCanceled},
+}
+
+// runner holds the state shared by the checks of one Run
+type runner struct {
+	ctx     context.Context
+	s       Subject
+	timeout time.Duration
+	secret  string
+	pubkey  string
+	// seeded are the kind 1 events seeded for the queries; other is a
+	// seeded event of the same author no query matches
+	seeded []*nostr.Event
+	other  *nostr.Event
+}
+
+// Run runs every check on s and reports how each went
+func Run(ctx context.Context, s Subject) Report {
+	c := &runner{ctx: ctx, s: s, timeout: s.Timeout, secret: nostr.GeneratePrivateKey()}
+	if c.timeout <= 0 {
+		c.timeout = DefaultTimeout
+	}
+	c.pubkey, _ = nostr.GetPublicKey(c.secret)
+	for i := range 3 {
+		c.seeded = append(c.seeded, c.event(1, fmt.Sprintf("conformance %d", i)))
+	}
+	c.other = c.event(7, "+")
+	if s.Seed != nil {
+		s.Seed(append(c.seeded, c.other)...)
+	}
+
+	report := Report{Subject: s.Name}
+	for _, ch := range checks {
+		skip, err := ch.run(c)
+		report.Results = append(report.Results, Result{Check: ch.name, Err: err, Skipped: skip})
+	}
+	return report
+}
+
+// event returns a signed event of the run's author
+func (c *runner) event(kind int, content string) *nostr.Event {
+	evt := &nostr.Event{Kind: kind, Content: content, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	evt.Sign(c.secret)
+	return evt
+}
+
+// filter matches the seeded kind 1 events
+func (c *runner) filter() nostr.Filter {
+	return nostr.Filter{Authors: []string{c.pubkey}, Kinds: []int{1}}
+}
+
+// external marks ctx as a client query if the Subject needs it
+func (c *runner) external(ctx context.Context) context.Context {
+	if c.s.External != nil {
+		return c.s.External(ctx)
+	}
+	return ctx
+}
+
+// expected returns how many events a query for the seeded ones must return
+func (c *runner) expected() int {
+	if c.s.Seed == nil {
+		return 0
+	}
+	return len(c.seeded)
+}
+
+// query runs filter and collects what it returns until the channel closes,
+// failing if it is still open after the check's timeout
+func (c *runner) query(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ch, err := c.s.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("QueryEvents: %w", err)
+	}
+	if ch == nil {
+		return nil, errors.New("QueryEvents returned a nil channel")
+	}
+	// the store has until the deadline to close the channel by itself
+	deadline := time.NewTimer(c.timeout + CancelGrace)
+	defer deadline.Stop()
+	var events []*nostr.Event
+	for {
+		select {
+		case evt, ok := <-ch:
+			if !ok {
+				return events, nil
+			}
+			events = append(events, evt)
+		case <-deadline.C:
+			return events, fmt.Errorf("channel still open %v after the query started", c.timeout+CancelGrace)
+		}
+	}
+}
+
+// closesWithin reports whether ch is closed within d, draining it
+func closesWithin(ch chan *nostr.Event, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// returnsWithin reports whether fn returns within d
+func returnsWithin(d time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// prefixed checks that err, if any, starts with a NIP-01 prefix, as khatru
+// sends it to the client in the OK message as is
+func prefixed(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.HasPrefix(err.Error(), relayerrors.Prefix(err)+": ") {
+		return nil
+	}
+	return fmt.Errorf("error without a NIP-01 prefix: %q", err.Error())
+}
+
+// queryMatching checks that a query returns the seeded events it matches
+// and nothing else
+func (c *runner) queryMatching() (string, error) {
+	events, err := c.query(c.external(c.ctx), c.filter())
+	if err != nil {
+		return "", err
+	}
+	filter := c.filter()
+	for _, evt := range events {
+		if !filter.Matches(evt) {
+			return "", fmt.Errorf("returned event %s of kind %d, not matching the filter", evt.ID, evt.Kind)
+		}
+	}
+	want := map[string]bool{}
+	if c.s.Seed != nil {
+		for _, evt := range c.seeded {
+			want[evt.ID] = true
+		}
+	}
+	got := map[string]bool{}
+	for _, evt := range events {
+		got[evt.ID] = true
+	}
+	for id := range want {
+		if !got[id] {
+			return "", fmt.Errorf("seeded event %s not returned (%d of %d returned)", id, len(got), len(want))
+		}
+	}
+	if len(got) != len(want) {
+		return "", fmt.Errorf("returned %d events, want %d", len(got), len(want))
+	}
+	return "", nil
+}
+
+// queryUnique checks that no event is returned twice, even when several
+// upstreams have it
+func (c *runner) queryUnique() (string, error) {
+	if c.s.Seed == nil {
+		return "store answers no queries", nil
+	}
+	events, err := c.query(c.external(c.ctx), c.filter())
+	if err != nil {
+		return "", err
+	}
+	seen := map[string]bool{}
+	for _, evt := range events {
+		if seen[evt.ID] {
+			return "", fmt.Errorf("event %s returned twice", evt.ID)
+		}
+		seen[evt.ID] = true
+	}
+	return "", nil
+}
+
+// queryLimit checks that a query returns at most the limit of its filter
+func (c *runner) queryLimit() (string, error) {
+	if c.s.Seed == nil {
+		return "store answers no queries", nil
+	}
+	filter := c.filter()
+	filter.Limit = 1
+	events, err := c.query(c.external(c.ctx), filter)
+	if err != nil {
+		return "", err
+	}
+	if len(events) > filter.Limit {
+		return "", fmt.Errorf("returned %d events for a limit of %d", len(events), filter.Limit)
+	}
+	return "", nil
+}
+
+// queryCloses checks that the channel of a query matching nothing is closed
+func (c *runner) queryCloses() (string, error) {
+	filter := nostr.Filter{Authors: []string{c.pubkey}, Kinds: []int{30078}}
+	events, err := c.query(c.external(c.ctx), filter)
+	if err != nil {
+		return "", err
+	}
+	if len(events) > 0 {
+		return "", fmt.Errorf("returned %d events for a filter matching none", len(events))
+	}
+	return "", nil
+}
+
+// queryInternal checks that queries not marked as from a client return
+// nothing, for stores that only forward client queries
+func (c *runner) queryInternal() (string, error) {
+	if c.s.External == nil {
+		return "store does not tell client queries apart", nil
+	}
+	events, err := c.query(c.ctx, c.filter())
+	if err != nil {
+		return "", err
+	}
+	if len(events) > 0 {
+		return "", fmt.Errorf("internal query returned %d events", len(events))
+	}
+	return "", nil
+}
+
+// queryCancel checks that cancelling a query waiting on its upstreams closes
+// its channel promptly
+func (c *runner) queryCancel() (string, error) {
+	if c.s.Stall == nil {
+		return "no Stall hook", nil
+	}
+	c.s.Stall(true)
+	defer c.s.Stall(false)
+	ctx, cancel := context.WithCancel(c.external(c.ctx))
+	defer cancel()
+	ch, err := c.s.Store.QueryEvents(ctx, c.filter())
+	if err != nil {
+		return "", fmt.Errorf("QueryEvents: %w", err)
+	}
+	// give the query time to reach the upstreams
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if !closesWithin(ch, CancelGrace) {
+		return "", fmt.Errorf("channel still open %v after the context was cancelled", CancelGrace)
+	}
+	return "", nil
+}
+
+// queryCanceled checks that a query with a cancelled context fails or
+// closes its channel promptly
+func (c *runner) queryCanceled() (string, error) {
+	ctx, cancel := context.WithCancel(c.external(c.ctx))
+	cancel()
+	ch, err := c.s.Store.QueryEvents(ctx, c.filter())
+	if err != nil {
+		return "", nil
+	}
+	if !closesWithin(ch, CancelGrace) {
+		return "", fmt.Errorf("channel of a cancelled query still open after %v", CancelGrace)
+	}
+	return "", nil
+}
+
+// countMatching checks that a count agrees with the seeded events
+func (c *runner) countMatching() (string, error) {
+	counter, ok := c.s.Store.(eventstore.Counter)
+	if !ok {
+		return "store does not count", nil
+	}
+	ctx, cancel := context.WithTimeout(c.external(c.ctx), c.timeout)
+	defer cancel()
+	n, err := counter.CountEvents(ctx, c.filter())
+	if err != nil {
+		return "", fmt.Errorf("CountEvents: %w", err)
+	}
+	if n != int64(c.expected()) {
+		return "", fmt.Errorf("counted %d events, want %d", n, c.expected())
+	}
+	return "", nil
+}
+
+// countCanceled checks that a count with a cancelled context returns
+// promptly
+func (c *runner) countCanceled() (string, error) {
+	counter, ok := c.s.Store.(eventstore.Counter)
+	if !ok {
+		return "store does not count", nil
+	}
+	ctx, cancel := context.WithCancel(c.external(c.ctx))
+	cancel()
+	if !returnsWithin(CancelGrace, func() { counter.CountEvents(ctx, c.filter()) }) {
+		return "", fmt.Errorf("CountEvents with a cancelled context still running after %v", CancelGrace)
+	}
+	return "", nil
+}
+
+// saveAccepted checks that a valid event is saved without error and, when
+// the Subject can tell, reaches the upstreams
+func (c *runner) saveAccepted() (string, error) {
+	evt := c.event(1, "conformance save")
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	if err := c.s.Store.SaveEvent(ctx, evt); err != nil {
+		if perr := prefixed(err); perr != nil {
+			return "", perr
+		}
+		return "", fmt.Errorf("SaveEvent: %w", err)
+	}
+	if c.s.Stored == nil {
+		return "", nil
+	}
+	for !c.s.Stored(evt.ID) {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("event %s did not reach the upstreams within %v", evt.ID, c.timeout)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return "", nil
+}
+
+// saveErrorPrefix checks that an event the upstreams refuse fails with
+// their prefix, so khatru tells the client why, or that an Async store
+// accepts it
+func (c *runner) saveErrorPrefix() (string, error) {
+	if c.s.Reject == nil && !c.s.Async {
+		return "no Reject hook", nil
+	}
+	if c.s.Reject != nil {
+		c.s.Reject(relayerrors.PrefixBlocked, "conformance")
+		defer c.s.Reject("", "")
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	err := c.s.Store.SaveEvent(ctx, c.event(1, "conformance reject"))
+	if c.s.Async {
+		if perr := prefixed(err); perr != nil {
+			return "", perr
+		}
+		if err != nil {
+			return "", fmt.Errorf("SaveEvent failed although the store only queues events: %w", err)
+		}
+		return "", nil
+	}
+	if err == nil {
+		return "", errors.New("SaveEvent succeeded although every upstream refused the event")
+	}
+	if perr := prefixed(err); perr != nil {
+		return "", perr
+	}
+	if prefix := relayerrors.Prefix(err); prefix != relayerrors.PrefixBlocked {
+		return "", fmt.Errorf("error has prefix %q, want %q: %v", prefix, relayerrors.PrefixBlocked, err)
+	}
+	return "", nil
+}
+
+// saveCanceled checks that a save with a cancelled context returns promptly,
+// with a prefixed error if any
+func (c *runner) saveCanceled() (string, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	cancel()
+	var err error
+	if !returnsWithin(CancelGrace, func() { err = c.s.Store.SaveEvent(ctx, c.event(1, "conformance canceled")) }) {
+		return "", fmt.Errorf("SaveEvent with a cancelled context still running after %v", CancelGrace)
+	}
+	return "", prefixed(err)
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Package testrelay runs in-process khatru relays on random local ports, so
+// the relaystore, mirror and publishing code can be exercised against real
+// websocket relays without depending on external ones. Events are kept in
+// memory, and each relay can be told at any time to reject events with a
+// given prefix, hold back its EOSE or require NIP-42 authentication, to
+// reproduce the upstream behaviors the relay has to cope with.
+package testrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Relay is an in-process relay listening on a random local port
+type Relay struct {
+	// Khatru is the underlying relay, for hooks beyond the built-in behaviors
+	Khatru *khatru.Relay
+	server *httptest.Server
+	store  *slicestore.SliceStore
+	mu     sync.RWMutex
+	// behaviors
+	rejectPrefix  string
+	rejectMessage string
+	eoseDelay     time.Duration
+	requireAuth   bool
+	// stats
+	received int64
+	rejected int64
+	queries  int64
+}
+
+// New starts a relay that accepts every event; Close stops it
+func New() *Relay {
+	store := &slicestore.SliceStore{}
+	store.Init()
+	r := &Relay{Khatru: khatru.NewRelay(), store: store}
+	r.Khatru.Info.Name = "testrelay"
+	r.Khatru.StoreEvent = append(r.Khatru.StoreEvent, store.SaveEvent)
+	r.Khatru.DeleteEvent = append(r.Khatru.DeleteEvent, store.DeleteEvent)
+	r.Khatru.ReplaceEvent = append(r.Khatru.ReplaceEvent, store.ReplaceEvent)
+	r.Khatru.QueryEvents = append(r.Khatru.QueryEvents, r.queryEvents)
+	r.Khatru.CountEvents = append(r.Khatru.CountEvents, store.CountEvents)
+	r.Khatru.RejectEvent = append(r.Khatru.RejectEvent, r.rejectEvent)
+	r.Khatru.RejectFilter = append(r.Khatru.RejectFilter, r.rejectFilter)
+	r.server = httptest.NewServer(r.Khatru)
+	return r
+}
+
+// URL returns the websocket URL of the relay
+func (r *Relay) URL() string {
+	return "ws" + strings.TrimPrefix(r.server.URL, "http")
+}
+
+// Close stops the relay, dropping its connections
+func (r *Relay) Close() {
+	r.server.CloseClientConnections()
+	r.server.Close()
+}
+
+// RejectWith makes the relay refuse every event with prefix (e.g.
+// "rate-limited" or "blocked") and message in its OK; an empty prefix
+// accepts events again
+func (r *Relay) RejectWith(prefix, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejectPrefix, r.rejectMessage = prefix, message
+}
+
+// DelayEOSE makes the relay hold back the EOSE of every query by d
+func (r *Relay) DelayEOSE(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.eoseDelay = d
+}
+
+// RequireAuth makes the relay refuse events and queries with auth-required
+// until the connection authenticates
+func (r *Relay) RequireAuth(require bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requireAuth = require
+}
+
+// Add stores events directly, as if they had been published earlier
+func (r *Relay) Add(events ...*nostr.Event) error {
+	for _, evt := range events {
+		if err := r.store.SaveEvent(context.Background(), evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Events returns the stored events matching filter
+func (r *Relay) Events(filter nostr.Filter) []*nostr.Event {
+	ch, err := r.store.QueryEvents(context.Background(), filter)
+	if err != nil {
+		return nil
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events
+}
+
+// Has reports whether the relay stores the event with id
+func (r *Relay) Has(id string) bool {
+	return len(r.Events(nostr.Filter{IDs: []string{id}})) > 0
+}
+
+// Received returns how many events were published to the relay, accepted or not
+func (r *Relay) Received() int64 {
+	return atomic.LoadInt64(&r.received)
+}
+
+// Rejected returns how many published events the relay refused
+func (r *Relay) Rejected() int64 {
+	return atomic.LoadInt64(&r.rejected)
+}
+
+// Queries returns how many filters clients queried the relay with
+func (r *Relay) Queries() int64 {
+	return atomic.LoadInt64(&r.queries)
+}
+
+// rejectEvent applies the auth and reject behaviors to published events
+func (r *Relay) rejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	atomic.AddInt64(&r.received, 1)
+	r.mu.RLock()
+	prefix, message, requireAuth := r.rejectPrefix, r.rejectMessage, r.requireAuth
+	r.mu.RUnlock()
+	switch {
+	case requireAuth && khatru.GetAuthed(ctx) == "":
+		atomic.AddInt64(&r.rejected, 1)
+		return true, "auth-required: authenticate to publish"
+	case prefix != "":
+		atomic.AddInt64(&r.rejected, 1)
+		return true, fmt.Sprintf("%s: %s", prefix, message)
+	}
+	return false, ""
+}
+
+// rejectFilter applies the auth behavior to queries
+func (r *Relay) rejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	r.mu.RLock()
+	requireAuth := r.requireAuth
+	r.mu.RUnlock()
+	if requireAuth && khatru.GetAuthed(ctx) == "" {
+		return true, "auth-required: authenticate to query"
+	}
+	return false, ""
+}
+
+// queryEvents answers from the store, holding the channel open, and with it
+// the EOSE, for the configured delay. Only client subscriptions are counted
+// and delayed, not the lookups khatru makes while storing events.
+func (r *Relay) queryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	stored, err := r.store.QueryEvents(ctx, filter)
+	// khatru keeps the subscription id under key 1 of the context of REQs
+	if ctx.Value(1) == nil {
+		return stored, err
+	}
+	atomic.AddInt64(&r.queries, 1)
+	r.mu.RLock()
+	delay := r.eoseDelay
+	r.mu.RUnlock()
+	if err != nil || delay <= 0 {
+		return stored, err
+	}
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for evt := range stored {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// store-conformance runs the checks of the storetest package on the
+// eventstores of the relay pipeline: the relaystore against scripted query
+// remotes of the relaystoretest package, and the broadcaststore against an
+// in-process testrelay. It exits with status 1 if any check fails, so it can
+// gate changes to either store.
+//
+// Usage:
+//
+//	go run ./tools/store-conformance [-store relaystore,broadcaststore] [-timeout 10s] [-v]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/girino/nostr-lib/broadcast"
+	"github.com/girino/nostr-lib/eventstore/broadcaststore"
+	"github.com/girino/saint-michaels-mirror/relaystore"
+	"github.com/girino/saint-michaels-mirror/relaystoretest"
+	"github.com/girino/saint-michaels-mirror/storetest"
+	"github.com/girino/saint-michaels-mirror/testrelay"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subjects builds each store under test and returns it with the function
+// that tears it down
+var subjects = map[string]func(timeout time.Duration) (storetest.Subject, func()){
+	"relaystore":     relayStoreSubject,
+	"broadcaststore": broadcastStoreSubject,
+}
+
+// relayStoreSubject is a relaystore over two scripted query remotes holding
+// the same events, so de-duplication is exercised too
+func relayStoreSubject(timeout time.Duration) (storetest.Subject, func()) {
+	upstream := relaystoretest.New()
+	urls := []string{"wss://a.conformance.invalid", "wss://b.conformance.invalid"}
+	var remotes []*relaystoretest.Remote
+	for _, url := range urls {
+		remotes = append(remotes, upstream.Remote(url).Countable(true))
+	}
+	rs := relaystore.New(urls)
+	rs.SetUpstream(upstream, upstream, upstream)
+	rs.Init()
+	return storetest.Subject{
+		Name:  "relaystore",
+		Store: rs,
+		Async: true, // query-only, events are published by the broadcaststore
+		External: func(ctx context.Context) context.Context {
+			// khatru passes the client connection under key 1; the
+			// relaystore only forwards queries carrying it
+			return context.WithValue(ctx, 1, "conformance")
+		},
+		Seed: func(events ...*nostr.Event) {
+			for _, r := range remotes {
+				r.Add(events...)
+			}
+		},
+		Stall: func(stall bool) {
+			for _, r := range remotes {
+				r.Silent(stall)
+			}
+		},
+		Timeout: timeout,
+	}, rs.Close
+}
+
+// broadcastStoreSubject is a broadcaststore publishing to a testrelay as its
+// only, mandatory relay
+func broadcastStoreSubject(timeout time.Duration) (storetest.Subject, func()) {
+	relay := testrelay.New()
+	bs := broadcaststore.NewBroadcastStore(&broadcast.Config{
+		TopNRelays:       1,
+		SuccessRateDecay: 0.9,
+		MandatoryRelays:  []string{relay.URL()},
+		WorkerCount:      2,
+		CacheTTL:         time.Minute,
+		InitialTimeout:   timeout,
+	}, 10)
+	bs.Init()
+	bs.GetBroadcastSystem().AddMandatoryRelays([]string{relay.URL()})
+	bs.GetBroadcastSystem().MarkInitialized()
+	return storetest.Subject{
+		Name:    "broadcaststore",
+		Store:   bs,
+		Reject:  relay.RejectWith,
+		Stored:  relay.Has,
+		Async:   true, // events are queued for the broadcast workers
+		Timeout: timeout,
+	}, func() {
+		bs.Close()
+		relay.Close()
+	}
+}
+
+func main() {
+	names := make([]string, 0, len(subjects))
+	for name := range subjects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	stores := flag.String("store", strings.Join(names, ","), "comma-separated stores to check")
+	timeout := flag.Duration("timeout", storetest.DefaultTimeout, "time each check may take")
+	verbose := flag.Bool("v", false, "list passed and skipped checks too")
+	flag.Parse()
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range strings.Split(*stores, ",") {
+		build, ok := subjects[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown store %q: must be one of %s\n", name, strings.Join(names, ", "))
+			os.Exit(2)
+		}
+		subject, teardown := build(*timeout)
+		report := storetest.Run(context.Background(), subject)
+		teardown()
+
+		passed := 0
+		for _, res := range report.Results {
+			switch {
+			case res.Err != nil:
+				failed = true
+				fmt.Fprintf(w, "%s\t%s\tFAIL\t%v\n", name, res.Check, res.Err)
+			case res.Skipped != "":
+				if *verbose {
+					fmt.Fprintf(w, "%s\t%s\tskip\t%s\n", name, res.Check, res.Skipped)
+				}
+			default:
+				passed++
+				if *verbose {
+					fmt.Fprintf(w, "%s\t%s\tok\t\n", name, res.Check)
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d of %d checks passed, %d failed\t\t\n", name, passed, len(report.Results), len(report.Failed()))
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// Eventstore conformance tests for Espelho de São Miguel.
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/girino/saint-michaels-mirror/storetest"
+)
+
+// required lists checks every store must run rather than skip
+var required = []string{"query/matching", "query/closes", "query/canceled", "save/accepted", "save/error-prefix", "save/canceled"}
+
+// TestConformance runs the storetest checks on every store of the pipeline
+func TestConformance(t *testing.T) {
+	for name, build := range subjects {
+		t.Run(name, func(t *testing.T) {
+			subject, teardown := build(5 * time.Second)
+			defer teardown()
+			report := storetest.Run(context.Background(), subject)
+			for _, res := range report.Results {
+				switch {
+				case res.Err != nil:
+					t.Errorf("%s: %v", res.Check, res.Err)
+				case res.Skipped != "" && slices.Contains(required, res.Check):
+					t.Errorf("%s skipped: %s", res.Check, res.Skipped)
+				case res.Skipped != "":
+					t.Logf("%s skipped: %s", res.Check, res.Skipped)
+				}
+			}
+		})
+	}
+}
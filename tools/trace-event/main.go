@@ -0,0 +1,365 @@
+// Copyright (c) 2025 Girino Vey.
+//
+// This software is licensed under Girino's Anarchist License (GAL).
+// See LICENSE file for full license text.
+// License available at: https://license.girino.org/
+//
+// trace-event publishes a uniquely tagged test event through a
+// saint-michaels-mirror relay and measures how long it takes to become
+// queryable on each upstream relay, to validate the broadcast relay
+// selection. The relays polled are those the mirror reports having sent the
+// event to, read from its broadcast status as the event's author, plus any
+// given with -relays.
+//
+// Usage:
+//
+//	go run ./tools/trace-event -relay wss://mirror.example.com [-relays wss://a,wss://b] [-timeout 60s] [-json]
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// TraceTag marks trace events so they can be recognized and filtered out
+const TraceTag = "propagation-trace"
+
+// relayTrace is what was observed on one relay
+type relayTrace struct {
+	Relay     string  `json:"relay"`
+	Broadcast string  `json:"broadcast,omitempty"` // status reported by the mirror
+	Hint      bool    `json:"hint,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
+	Found     bool    `json:"found"`
+	SeenAfter float64 `json:"seen_after_seconds,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// report is the outcome of one trace
+type report struct {
+	Event       string        `json:"event"`
+	Mirror      string        `json:"mirror"`
+	PublishedIn float64       `json:"published_in_seconds"`
+	Relays      []*relayTrace `json:"relays"`
+	Found       int           `json:"found"`
+	Median      float64       `json:"median_seconds,omitempty"`
+	P90         float64       `json:"p90_seconds,omitempty"`
+}
+
+// tracer polls relays for one event
+type tracer struct {
+	evt      nostr.Event
+	start    time.Time
+	interval time.Duration
+	mu       sync.Mutex
+	relays   map[string]*relayTrace
+	wg       sync.WaitGroup
+}
+
+func main() {
+	mirrorURL := flag.String("relay", "", "websocket URL of the mirror to publish through (required)")
+	apiURL := flag.String("api", "", "HTTP base URL of the mirror's API, derived from -relay by default")
+	extra := flag.String("relays", "", "comma-separated relays to poll besides those the mirror reports sending the event to")
+	key := flag.String("key", "", "secret key (hex or nsec) to sign the test event with; a one-off key by default")
+	kind := flag.Int("kind", nostr.KindTextNote, "kind of the test event")
+	timeout := flag.Duration("timeout", 60*time.Second, "how long to wait for the event to show up")
+	interval := flag.Duration("interval", 2*time.Second, "how often each relay is polled")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	if *mirrorURL == "" {
+		fmt.Fprintln(os.Stderr, "-relay is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	secret, err := secretKey(*key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -key: %v\n", err)
+		os.Exit(2)
+	}
+	if *apiURL == "" {
+		*apiURL = "http" + strings.TrimPrefix(strings.TrimSuffix(*mirrorURL, "/"), "ws")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	t := &tracer{
+		evt: nostr.Event{
+			Kind:      *kind,
+			CreatedAt: nostr.Now(),
+			Tags:      nostr.Tags{{"t", TraceTag}, {"nonce", hex.EncodeToString(nonce)}},
+			Content:   "saint-michaels-mirror propagation trace, please ignore",
+		},
+		interval: *interval,
+		relays:   map[string]*relayTrace{},
+	}
+	if err := t.evt.Sign(secret); err != nil {
+		fmt.Fprintf(os.Stderr, "signing the test event: %v\n", err)
+		os.Exit(1)
+	}
+	mirror, err := nostr.RelayConnect(ctx, *mirrorURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connecting to %s: %v\n", *mirrorURL, err)
+		os.Exit(1)
+	}
+	t.start = time.Now()
+	if err := mirror.Publish(ctx, t.evt); err != nil {
+		fmt.Fprintf(os.Stderr, "publishing through %s: %v\n", *mirrorURL, err)
+		os.Exit(1)
+	}
+	publishedIn := time.Since(t.start)
+	mirror.Close()
+
+	for _, url := range strings.Split(*extra, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			t.watch(ctx, url)
+		}
+	}
+
+	if err := t.followBroadcast(ctx, *apiURL, secret); err != nil {
+		fmt.Fprintf(os.Stderr, "broadcast status unavailable, polling only -relays: %v\n", err)
+	}
+	t.wg.Wait()
+
+	r := t.report(*mirrorURL, publishedIn)
+	if *asJSON {
+		out, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		r.print()
+	}
+	if r.Found == 0 {
+		os.Exit(1)
+	}
+}
+
+// secretKey parses a hex or nsec key, generating one when s is empty
+func secretKey(s string) (string, error) {
+	switch {
+	case s == "":
+		return nostr.GeneratePrivateKey(), nil
+	case strings.HasPrefix(s, "nsec1"):
+		_, value, err := nip19.Decode(s)
+		if err != nil {
+			return "", err
+		}
+		return value.(string), nil
+	case nostr.IsValid32ByteHex(s):
+		return s, nil
+	}
+	return "", errors.New("expected 64 hex characters or an nsec")
+}
+
+// watch starts polling url for the event unless it is polled already
+func (t *tracer) watch(ctx context.Context, url string) *relayTrace {
+	url = nostr.NormalizeURL(url)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.relays[url]; ok {
+		return rt
+	}
+	rt := &relayTrace{Relay: url}
+	t.relays[url] = rt
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.poll(ctx, rt)
+	}()
+	return rt
+}
+
+// poll queries rt's relay for the event until it shows up or ctx is done
+func (t *tracer) poll(ctx context.Context, rt *relayTrace) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var relay *nostr.Relay
+	var lastErr error
+	for {
+		if relay == nil || !relay.IsConnected() {
+			relay, lastErr = nostr.RelayConnect(ctx, rt.Relay)
+		}
+		if lastErr == nil {
+			qctx, cancel := context.WithTimeout(ctx, t.interval)
+			events, err := relay.QuerySync(qctx, nostr.Filter{IDs: []string{t.evt.ID}})
+			cancel()
+			lastErr = err
+			if len(events) > 0 {
+				t.mu.Lock()
+				rt.Found = true
+				rt.SeenAfter = time.Since(t.start).Seconds()
+				t.mu.Unlock()
+				relay.Close()
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			if lastErr != nil && !errors.Is(lastErr, context.DeadlineExceeded) {
+				rt.Error = lastErr.Error()
+			}
+			t.mu.Unlock()
+			if relay != nil {
+				relay.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// broadcastStatus is the part of the mirror's broadcast status used here
+type broadcastStatus struct {
+	State  string `json:"state"`
+	Relays []struct {
+		Relay  string `json:"relay"`
+		Status string `json:"status"`
+		Hint   bool   `json:"hint"`
+		Reason string `json:"reason"`
+	} `json:"relays"`
+}
+
+// followBroadcast reads the mirror's broadcast status of the event until
+// the mirror is done with it, polling every relay it was sent to
+func (t *tracer) followBroadcast(ctx context.Context, apiURL, secret string) error {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		status, err := t.fetchStatus(ctx, apiURL, secret)
+		if err != nil {
+			return err
+		}
+		for _, res := range status.Relays {
+			rt := t.watch(ctx, res.Relay)
+			t.mu.Lock()
+			rt.Broadcast, rt.Hint, rt.Reason = res.Status, res.Hint, res.Reason
+			t.mu.Unlock()
+		}
+		if status.State == "done" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchStatus requests the broadcast status, authenticated with NIP-98 as
+// the author of the event
+func (t *tracer) fetchStatus(ctx context.Context, apiURL, secret string) (*broadcastStatus, error) {
+	url := strings.TrimSuffix(apiURL, "/") + "/api/v1/events/" + t.evt.ID + "/broadcast-status"
+	auth := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", url}, {"method", http.MethodGet}},
+	}
+	if err := auth.Sign(secret); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(auth.String())))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var status broadcastStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("decoding broadcast status: %w", err)
+	}
+	return &status, nil
+}
+
+// report summarizes the trace, fastest relays first
+func (t *tracer) report(mirror string, publishedIn time.Duration) *report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := &report{Event: t.evt.ID, Mirror: mirror, PublishedIn: publishedIn.Seconds()}
+	var seen []float64
+	for _, rt := range t.relays {
+		r.Relays = append(r.Relays, rt)
+		if rt.Found {
+			seen = append(seen, rt.SeenAfter)
+		}
+	}
+	sort.Slice(r.Relays, func(i, j int) bool {
+		a, b := r.Relays[i], r.Relays[j]
+		if a.Found != b.Found {
+			return a.Found
+		}
+		if a.SeenAfter != b.SeenAfter {
+			return a.SeenAfter < b.SeenAfter
+		}
+		return a.Relay < b.Relay
+	})
+	r.Found = len(seen)
+	if len(seen) > 0 {
+		sort.Float64s(seen)
+		r.Median = seen[len(seen)/2]
+		r.P90 = seen[min(len(seen)-1, len(seen)*9/10)]
+	}
+	return r
+}
+
+// print writes the report as a table
+func (r *report) print() {
+	fmt.Printf("event %s accepted by %s in %s\n\n", r.Event, r.Mirror, seconds(r.PublishedIn))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELAY\tBROADCAST\tSEEN AFTER\tNOTE")
+	for _, rt := range r.Relays {
+		broadcast := rt.Broadcast
+		if broadcast == "" {
+			broadcast = "-"
+		}
+		if rt.Hint {
+			broadcast += " (hint)"
+		}
+		seen := "not seen"
+		if rt.Found {
+			seen = seconds(rt.SeenAfter)
+		}
+		note := rt.Reason
+		if rt.Error != "" {
+			note = rt.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", rt.Relay, broadcast, seen, note)
+	}
+	w.Flush()
+	fmt.Printf("\nseen on %d of %d relays", r.Found, len(r.Relays))
+	if r.Found > 0 {
+		fmt.Printf("; median %s, p90 %s", seconds(r.Median), seconds(r.P90))
+	}
+	fmt.Println()
+}
+
+// seconds formats a duration given in seconds
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}